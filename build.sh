@@ -4,6 +4,13 @@ set -e
 # Create bin directory if it doesn't exist
 mkdir -p bin
 
+# Stamp the build into the binaries' /version and -version
+VERSION_PKG=github.com/vikasavn/attachcloudip/pkg/version
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse HEAD 2>/dev/null || true)
+BUILD_TIME=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+LDFLAGS="-X $VERSION_PKG.Version=$VERSION -X $VERSION_PKG.Commit=$COMMIT -X $VERSION_PKG.BuildTime=$BUILD_TIME"
+
 # Build function
 build_binary() {
     local dir=$1
@@ -15,7 +22,7 @@ build_binary() {
     GO_FILES=$(find "$dir" -maxdepth 1 -name "*.go")
     
     # Build with cross-compilation support
-    CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o "bin/$binary_name" $GO_FILES
+    CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -ldflags "$LDFLAGS" -o "bin/$binary_name" $GO_FILES
     
     if [ $? -eq 0 ]; then
         echo "Successfully built $binary_name"
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/client"
+)
+
+// runBench handles the bench subcommand, which has the server measure a
+// tunnel's round trip time and throughput and prints the results as JSON.
+// Without -id it benchmarks a tunnel of its own, registered for the run.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	serverAddr := fs.String("server", "localhost:9999", "Server address")
+	id := fs.String("id", "", "Client ID of a running tunnel to benchmark (registers a temporary tunnel if empty)")
+	path := fs.String("path", "", "Path of the temporary tunnel (generated if empty)")
+	payload := fs.Int("payload", 0, "Bytes in each request or response body (server default if 0)")
+	duration := fs.Duration("duration", 0, "Duration of each throughput phase (server default if 0)")
+	probes := fs.Int("probes", 0, "Round trips to time (server default if 0)")
+	apiKey := fs.String("api-key", "", "API key of the tunnel's tenant, or an operator key")
+	fs.Parse(args)
+
+	c, err := client.New(*serverAddr, client.WithAPIKey(*apiKey))
+	if err != nil {
+		log.Fatalf("Failed to benchmark tunnel: %v", err)
+	}
+	ctx := context.Background()
+	clientID := *id
+	if clientID == "" {
+		if *path == "" {
+			*path = "/bench-" + uuid.NewString()[:8]
+		}
+		tunnel, err := c.RegisterPath(ctx, *path, http.NotFoundHandler(), client.TunnelOptions{})
+		if err != nil {
+			log.Fatalf("Failed to register benchmark tunnel: %v", err)
+		}
+		defer c.Close()
+		clientID = tunnel.ID()
+	}
+
+	result, err := c.Bench(ctx, clientID, client.BenchOptions{
+		PayloadBytes: *payload,
+		Duration:     *duration,
+		Probes:       *probes,
+	})
+	if err != nil {
+		c.Close()
+		log.Fatalf("Failed to benchmark tunnel: %v", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
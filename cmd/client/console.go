@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/client"
+	"golang.org/x/term"
+)
+
+// Console settings
+const (
+	consoleRefresh  = 250 * time.Millisecond
+	consoleRequests = 500 // Requests kept for the scrolling list
+	consoleLogLines = 4   // Latest log lines shown below the requests
+)
+
+// consoleRequest is a proxied request shown in the console
+type consoleRequest struct {
+	method   string
+	path     string
+	status   int // 0 when the server cancelled the request
+	latency  time.Duration
+	streamed bool
+}
+
+// console is the terminal UI started with -tui. It shows the tunnel's
+// status, heartbeat round trip, and the latest proxied requests, and takes
+// over the log so log lines don't scramble the screen.
+type console struct {
+	mu       sync.Mutex
+	tunnel   atomic.Pointer[client.Tunnel] // nil until the tunnel is registered
+	clientID string
+	path     string
+	upstream string
+	started  time.Time
+	requests []consoleRequest // Oldest first
+	logLines []string
+	partial  []byte // Log output not yet ended by a newline
+
+	restore     func()
+	restoreOnce sync.Once
+}
+
+func newConsole(clientID, path, upstream string) (*console, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, fmt.Errorf("-tui needs an interactive terminal")
+	}
+	return &console{
+		clientID: clientID,
+		started:  time.Now(),
+		path:     path,
+		upstream: upstream,
+	}, nil
+}
+
+// Start switches the terminal to the console until q or Ctrl-C is pressed,
+// which exits the process
+func (c *console) Start() error {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to set up the terminal: %v", err)
+	}
+	// Use the alternate screen so the shell's scrollback is left alone
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	c.restore = func() {
+		os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, state)
+	}
+
+	go c.readKeys()
+	go func() {
+		ticker := time.NewTicker(consoleRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.draw()
+		}
+	}()
+	return nil
+}
+
+// Stop gives the terminal and the log back, e.g. before exiting
+func (c *console) Stop() {
+	c.restoreOnce.Do(func() {
+		if c.restore != nil {
+			c.restore()
+		}
+		log.SetOutput(os.Stderr)
+	})
+}
+
+func (c *console) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, key := range buf[:n] {
+			switch key {
+			case 'q', 'Q', 3: // 3 is Ctrl-C, which raw mode delivers as a key
+				c.Stop()
+				os.Exit(0)
+			case 'c', 'C':
+				c.mu.Lock()
+				c.requests = nil
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+// observe adds a proxied request to the list
+func (c *console) observe(r client.RequestLog) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, consoleRequest{
+		method:   r.Method,
+		path:     r.Path,
+		status:   r.Status,
+		latency:  r.Latency,
+		streamed: r.Streamed,
+	})
+	if len(c.requests) > consoleRequests {
+		c.requests = c.requests[len(c.requests)-consoleRequests:]
+	}
+}
+
+// Write keeps the latest log lines, so the console can be the log's output
+func (c *console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.partial = append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		c.logLines = append(c.logLines, string(c.partial[:i]))
+		c.partial = c.partial[i+1:]
+	}
+	if len(c.logLines) > consoleLogLines {
+		c.logLines = c.logLines[len(c.logLines)-consoleLogLines:]
+	}
+	return len(p), nil
+}
+
+func (c *console) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 20 || height < 12 {
+		width, height = 80, 24
+	}
+
+	status := client.Status{State: "connecting", Since: c.started}
+	if t := c.tunnel.Load(); t != nil {
+		status = t.Status()
+	}
+	c.mu.Lock()
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	add("\x1b[1mattachcloudip\x1b[0m  \x1b[2m(q quit, c clear)\x1b[0m")
+	add("")
+	add("%-12s %s %s", "Status", colorStatus(status.State), dim("for "+time.Since(status.Since).Truncate(time.Second).String()))
+	add("%-12s %s", "Client ID", c.clientID)
+	add("%-12s %s", "Forwarding", status.Server+c.path+" -> "+c.upstream)
+	rtt := "-"
+	if status.RTTMs > 0 {
+		rtt = time.Duration(status.RTTMs * float64(time.Millisecond)).Round(10 * time.Microsecond).String()
+	}
+	add("%-12s %s", "RTT", rtt)
+	add("%-12s %d", "Requests", status.Requests)
+	add("")
+	add("\x1b[1m%-8s %-*s %6s %10s\x1b[0m", "METHOD", max(10, width-29), "PATH", "STATUS", "LATENCY")
+
+	// The request list takes whatever rows the header and log leave
+	rows := height - len(lines) - consoleLogLines - 2
+	start := max(0, len(c.requests)-rows)
+	for i := len(c.requests) - 1; i >= start; i-- {
+		r := c.requests[i]
+		latency := r.latency.Round(100 * time.Microsecond).String()
+		if r.streamed {
+			latency += "+"
+		}
+		add("%-8s %-*s %s %10s", r.method, max(10, width-29), truncate(r.path, max(10, width-29)), colorCode(r.status), latency)
+	}
+	for len(lines) < height-consoleLogLines-1 {
+		add("")
+	}
+	add("\x1b[1mLog\x1b[0m")
+	for _, line := range c.logLines {
+		add("%s", dim(line))
+	}
+	c.mu.Unlock()
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		screen.WriteString(clip(line, width))
+		screen.WriteString("\x1b[K")
+		if i < len(lines)-1 && i < height-1 {
+			// Raw mode doesn't turn newlines into carriage returns
+			screen.WriteString("\r\n")
+		}
+	}
+	screen.WriteString("\x1b[J")
+	os.Stdout.WriteString(screen.String())
+}
+
+func colorStatus(status string) string {
+	switch status {
+	case "online":
+		return "\x1b[32m" + status + "\x1b[0m"
+	case "reconnecting":
+		return "\x1b[33m" + status + "\x1b[0m"
+	}
+	return status
+}
+
+func colorCode(status int) string {
+	if status == 0 {
+		return dim("   ---")
+	}
+	color := "32"
+	switch {
+	case status >= 500:
+		color = "31"
+	case status >= 400:
+		color = "33"
+	case status >= 300:
+		color = "36"
+	}
+	return fmt.Sprintf("\x1b[%sm%6d\x1b[0m", color, status)
+}
+
+func dim(s string) string {
+	return "\x1b[2m" + s + "\x1b[0m"
+}
+
+// truncate shortens s to n characters, marking the cut
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// clip cuts a line with escape sequences to width visible characters
+func clip(line string, width int) string {
+	var out strings.Builder
+	visible := 0
+	escape := false
+	for _, r := range line {
+		switch {
+		case escape:
+			out.WriteRune(r)
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+				escape = false
+			}
+		case r == '\x1b':
+			escape = true
+			out.WriteRune(r)
+		case visible < width:
+			out.WriteRune(r)
+			visible++
+		}
+	}
+	return out.String() + "\x1b[0m"
+}
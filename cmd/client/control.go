@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/client"
+)
+
+// runControl handles the pause, resume, and renew subcommands, which change
+// a running tunnel's state on the server
+func runControl(command string, args []string) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	serverAddr := fs.String("server", "localhost:9999", "Server address")
+	id := fs.String("id", "", "Client ID of the tunnel")
+	message := fs.String("message", "", "Maintenance message shown while paused")
+	ttl := fs.Duration("ttl", 0, "New TTL when renewing (defaults to the registered TTL)")
+	apiKey := fs.String("api-key", "", "API key of the tunnel's tenant, or an operator key")
+	fs.Parse(args)
+
+	if *id == "" {
+		log.Fatal("Client ID is required. Use -id flag to specify the tunnel")
+	}
+	c, err := client.New(*serverAddr, client.WithAPIKey(*apiKey))
+	if err != nil {
+		log.Fatalf("Failed to %s tunnel: %v", command, err)
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "pause":
+		err = c.Pause(ctx, *id, *message)
+	case "resume":
+		err = c.Resume(ctx, *id)
+	case "renew":
+		var expiresAt time.Time
+		if expiresAt, err = c.Renew(ctx, *id, *ttl); err == nil {
+			log.Printf("Tunnel %s: renewed until %s", *id, expiresAt.Format(time.RFC3339))
+			return
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to %s tunnel: %v", command, err)
+	}
+	log.Printf("Tunnel %s: %sd", *id, command)
+}
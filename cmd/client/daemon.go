@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/client"
+)
+
+// daemonizedEnv marks the background process started by `client start -daemon`
+const daemonizedEnv = "ATTACHCLOUDIP_DAEMONIZED"
+
+// How long start waits for the daemon to come up, and stop for it to exit
+const (
+	daemonStartTimeout = 15 * time.Second
+	daemonStopTimeout  = 10 * time.Second
+)
+
+// daemonOptions are the flags of the start subcommand, which runs the tunnel
+// with a control socket that `client stop` and `client status` talk to
+type daemonOptions struct {
+	detach        bool
+	name          string
+	pidFile       string
+	logFile       string
+	controlSocket string
+}
+
+// register adds the start subcommand's flags to the tunnel's
+func (d *daemonOptions) register(fs *flag.FlagSet) {
+	fs.BoolVar(&d.detach, "daemon", false, "Run the tunnel in the background, logging to -log-file")
+	fs.StringVar(&d.name, "name", "default", "Name of the tunnel, so several can run side by side")
+	fs.StringVar(&d.pidFile, "pidfile", "", "Where to write the process ID (in the runtime directory if empty)")
+	fs.StringVar(&d.logFile, "log-file", "", "Where to write the log (in the runtime directory if empty with -daemon)")
+	fs.StringVar(&d.controlSocket, "control-socket", "", "Unix socket for stop and status (in the runtime directory if empty)")
+}
+
+// runtimeFile returns the default path of one of a named tunnel's files
+func runtimeFile(name, ext string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("attachcloudip-client-%s.%s", name, ext))
+}
+
+func (d *daemonOptions) setDefaults() error {
+	if d.name == "" || strings.ContainsAny(d.name, `/\`) {
+		return fmt.Errorf("invalid -name %q", d.name)
+	}
+	if d.pidFile == "" {
+		d.pidFile = runtimeFile(d.name, "pid")
+	}
+	if d.controlSocket == "" {
+		d.controlSocket = runtimeFile(d.name, "sock")
+	}
+	if d.logFile == "" && d.detach {
+		d.logFile = runtimeFile(d.name, "log")
+	}
+	return nil
+}
+
+// prepare runs before the tunnel is registered. With -daemon it starts the
+// tunnel again in the background and exits once it is up; otherwise it
+// opens the log file.
+func (d *daemonOptions) prepare(args []string) {
+	if err := d.setDefaults(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := queryDaemon(d.controlSocket, http.MethodGet, "/status", nil); err == nil {
+		log.Fatalf("Tunnel %s is already running (control socket %s)", d.name, d.controlSocket)
+	}
+	if d.detach && os.Getenv(daemonizedEnv) != "1" {
+		d.spawn(args)
+		os.Exit(0)
+	}
+
+	if d.logFile != "" {
+		f, err := os.OpenFile(d.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		log.SetOutput(f)
+	}
+}
+
+// spawn starts the daemon and waits until its control socket answers
+func (d *daemonOptions) spawn(args []string) {
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Failed to find the client executable: %v", err)
+	}
+	logFile, err := os.OpenFile(d.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Fatalf("Failed to open log file: %v", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(os.Environ(), daemonizedEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedProcess()
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Failed to start daemon: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	deadline := time.Now().Add(daemonStartTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			log.Fatalf("Daemon exited during startup, see %s", d.logFile)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if _, err := queryDaemon(d.controlSocket, http.MethodGet, "/status", nil); err == nil {
+			fmt.Printf("Tunnel %s started (pid %d), logging to %s\n", d.name, cmd.Process.Pid, d.logFile)
+			return
+		}
+	}
+	log.Fatalf("Daemon didn't come up within %v, see %s", daemonStartTimeout, d.logFile)
+}
+
+// daemonStatus is what `client status` reports
+type daemonStatus struct {
+	Name     string   `json:"name"`
+	PID      int      `json:"pid"`
+	ClientID string   `json:"client_id"`
+	Paths    []string `json:"paths"`
+	Upstream string   `json:"upstream"`
+	client.Status
+}
+
+// pathUpdate adds and removes paths of the tunnel over the control socket
+type pathUpdate struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// serve writes the pidfile and answers stop, status, and paths on the control socket
+// until the process is stopped, removing both on the way out
+func (d *daemonOptions) serve(t *client.Tunnel, upstream string) {
+	os.Remove(d.controlSocket) // Left behind by a daemon that was killed
+	listener, err := net.Listen("unix", d.controlSocket)
+	if err != nil {
+		log.Fatalf("Failed to listen on control socket: %v", err)
+	}
+	os.Chmod(d.controlSocket, 0o600)
+	if err := os.WriteFile(d.pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		log.Fatalf("Failed to write pidfile: %v", err)
+	}
+
+	stop := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(daemonStatus{
+			Name:     d.name,
+			PID:      os.Getpid(),
+			ClientID: t.ID(),
+			Paths:    t.Paths(),
+			Upstream: upstream,
+			Status:   t.Status(),
+		})
+	})
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		select {
+		case stop <- struct{}{}:
+		default:
+		}
+	})
+	mux.HandleFunc("/paths", func(w http.ResponseWriter, r *http.Request) {
+		paths := t.Paths()
+		if r.Method == http.MethodPost {
+			var update pathUpdate
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+				return
+			}
+			var err error
+			if paths, err = t.UpdatePaths(update.Add, update.Remove); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"paths": paths})
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		select {
+		case <-stop:
+			log.Printf("Stop requested on control socket")
+		case sig := <-signals:
+			log.Printf("Received %v", sig)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		server.Shutdown(ctx) // Also removes the socket
+		cancel()
+		os.Remove(d.pidFile)
+		log.Printf("Tunnel %s stopped", d.name)
+		os.Exit(0)
+	}()
+}
+
+// runDaemonControl handles the stop, status, and paths subcommands
+func runDaemonControl(command string, args []string) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	name := fs.String("name", "default", "Name the tunnel was started with")
+	controlSocket := fs.String("control-socket", "", "Control socket of the tunnel (in the runtime directory if empty)")
+	var add, remove []string
+	if command == "paths" {
+		fs.Func("add", "Path to add to the tunnel (repeatable)", func(path string) error {
+			add = append(add, path)
+			return nil
+		})
+		fs.Func("remove", "Path to remove from the tunnel (repeatable)", func(path string) error {
+			remove = append(remove, path)
+			return nil
+		})
+	}
+	fs.Parse(args)
+	if *controlSocket == "" {
+		*controlSocket = runtimeFile(*name, "sock")
+	}
+
+	if command == "paths" {
+		method, payload := http.MethodGet, []byte(nil)
+		if len(add) > 0 || len(remove) > 0 {
+			method = http.MethodPost
+			payload, _ = json.Marshal(pathUpdate{Add: add, Remove: remove})
+		}
+		body, err := queryDaemon(*controlSocket, method, "/paths", payload)
+		if err != nil {
+			log.Fatalf("Tunnel %s: %v", *name, err)
+		}
+		var report struct {
+			Paths []string `json:"paths"`
+		}
+		if err := json.Unmarshal(body, &report); err != nil {
+			log.Fatalf("Invalid paths from tunnel %s: %v", *name, err)
+		}
+		fmt.Printf("Tunnel %s paths: %s\n", *name, strings.Join(report.Paths, ", "))
+		return
+	}
+
+	if command == "stop" {
+		if _, err := queryDaemon(*controlSocket, http.MethodPost, "/stop", nil); err != nil {
+			fmt.Printf("Tunnel %s is not running\n", *name)
+			os.Exit(1)
+		}
+		deadline := time.Now().Add(daemonStopTimeout)
+		for time.Now().Before(deadline) {
+			if _, err := queryDaemon(*controlSocket, http.MethodGet, "/status", nil); err != nil {
+				fmt.Printf("Tunnel %s stopped\n", *name)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		log.Fatalf("Tunnel %s didn't stop within %v", *name, daemonStopTimeout)
+	}
+
+	body, err := queryDaemon(*controlSocket, http.MethodGet, "/status", nil)
+	if err != nil {
+		fmt.Printf("Tunnel %s is not running\n", *name)
+		os.Exit(3) // Like init scripts' status for a stopped service
+	}
+	var status daemonStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		log.Fatalf("Invalid status from tunnel %s: %v", *name, err)
+	}
+	fmt.Printf("Tunnel %s (pid %d) is %s for %v\n", status.Name, status.PID, status.State,
+		time.Since(status.Since).Truncate(time.Second))
+	fmt.Printf("  Client ID:  %s\n", status.ClientID)
+	fmt.Printf("  Forwarding: %s%s -> %s\n", status.Server, strings.Join(status.Paths, ", "), status.Upstream)
+	fmt.Printf("  RTT:        %.2fms\n", status.RTTMs)
+	fmt.Printf("  Requests:   %d\n", status.Requests)
+}
+
+// queryDaemon sends a request to a tunnel's control socket
+func queryDaemon(socket, method, path string, payload []byte) ([]byte, error) {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://daemon"+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
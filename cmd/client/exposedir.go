@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+)
+
+// serveDir serves dir for the expose-dir subcommand. Requests under a
+// literal tunnel path map to the root of the directory, so /site/a.html
+// serves ./a.html.
+func serveDir(dir, tunnelPath string) (http.Handler, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	files := http.FileServer(hiddenFS{http.Dir(dir)})
+	prefix := literalPrefix(tunnelPath)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if prefix != "" {
+			if r.URL.Path == prefix {
+				http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+				return
+			}
+			http.StripPrefix(prefix, files).ServeHTTP(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+	log.Printf("Serving %s for %s", dir, tunnelPath)
+	return handler, nil
+}
+
+// literalPrefix returns the tunnel path to strip from requests, or "" for
+// root, parameterized, and regular expression paths, which are served as is
+func literalPrefix(path string) string {
+	if routing.IsRegex(path) || strings.ContainsAny(path, ":*") {
+		return ""
+	}
+	return strings.TrimRight(path, "/")
+}
+
+// hiddenFS hides files and directories whose names start with a dot, such as
+// .git or .env, from both requests and directory listings
+type hiddenFS struct {
+	http.FileSystem
+}
+
+func (h hiddenFS) Open(name string) (http.File, error) {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+	f, err := h.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return hiddenFile{f}, nil
+}
+
+type hiddenFile struct {
+	http.File
+}
+
+func (f hiddenFile) Readdir(count int) ([]fs.FileInfo, error) {
+	entries, err := f.File.Readdir(count)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
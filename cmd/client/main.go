@@ -1,207 +1,306 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/client"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/sockopt"
+	"github.com/vikasavn/attachcloudip/pkg/sshkey"
+	"github.com/vikasavn/attachcloudip/pkg/version"
 )
 
 func init() {
 	log.SetFlags(log.Llongfile)
 }
 
-type Client struct {
-	ID         string
-	TCPConn    net.Conn
-	TCPPort    int
-	serverHost string
-	path       string
-}
-
-func registerClient(serverAddr string, clientID string, path string) (*Client, error) {
-	// Prepare registration request
-	registrationPayload := struct {
-		ClientID string   `json:"client_id"`
-		Paths    []string `json:"paths"`
-	}{
-		ClientID: clientID,
-		Paths:    []string{path},
-	}
-
-	payloadBytes, err := json.Marshal(registrationPayload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal registration payload: %v", err)
+func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "pause" || os.Args[1] == "resume" || os.Args[1] == "renew") {
+		runControl(os.Args[1], os.Args[2:])
+		return
 	}
-
-	// Send registration request
-	resp, err := http.Post(fmt.Sprintf("http://%s/register", serverAddr),
-		"application/json", bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		return nil, fmt.Errorf("failed to send registration request: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("registration failed with status: %d", resp.StatusCode)
+	if len(os.Args) > 1 && os.Args[1] == "visit" {
+		runVisit(os.Args[2:])
+		return
 	}
-
-	// Parse registration response
-	var regResponse struct {
-		Port []int `json:"port"`
+	if len(os.Args) > 1 && os.Args[1] == "update" {
+		runUpdate(os.Args[2:])
+		return
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&regResponse); err != nil {
-		return nil, fmt.Errorf("failed to decode registration response: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "sign-release" {
+		runSignRelease(os.Args[2:])
+		return
 	}
-
-	// Extract TCP port from JSON response
-	if len(regResponse.Port) == 0 {
-		return nil, fmt.Errorf("no TCP port received from server")
+	if len(os.Args) > 1 && (os.Args[1] == "stop" || os.Args[1] == "status" || os.Args[1] == "paths") {
+		runDaemonControl(os.Args[1], os.Args[2:])
+		return
 	}
-	tcpPort := regResponse.Port[0]
-	log.Printf("Received TCP port: %+v", regResponse)
-
-	// Extract host from serverAddr
-	host, _, err := net.SplitHostPort(serverAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse server address: %v", err)
+	// start runs the tunnel with a control socket, in the background with
+	// -daemon, taking the same flags as a regular tunnel
+	var daemon *daemonOptions
+	daemonArgs := os.Args[1:]
+	if len(os.Args) > 1 && os.Args[1] == "start" {
+		daemon = &daemonOptions{}
+		daemon.register(flag.CommandLine)
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
 	}
-	log.Printf("Received Host: %+v", host)
-
-	client := &Client{
-		ID:         clientID,
-		TCPPort:    tcpPort,
-		serverHost: host,
-		path:       path,
+	// expose-dir tunnels a local directory through an embedded file server,
+	// taking the same flags as a regular tunnel
+	var exposeDir string
+	if len(os.Args) > 1 && os.Args[1] == "expose-dir" {
+		if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+			log.Fatal("Usage: client expose-dir <directory> -path /site [flags]")
+		}
+		exposeDir = os.Args[2]
+		os.Args = append(os.Args[:1:1], os.Args[3:]...)
 	}
 
-	return client, nil
-}
+	// Command line flags
+	serverAddr := flag.String("server", "localhost:9999", "Server address, or comma-separated addresses in order of preference to fail over between")
+	probeInterval := flag.Duration("server-probe-interval", 10*time.Second, "Interval between health probes of servers preferred over the current one")
+	proxy := flag.String("proxy", "", "Reach the server through this HTTP CONNECT or SOCKS5 proxy, e.g. socks5://localhost:1080, or \"direct\" for none (HTTPS_PROXY if empty)")
+	watchPath := flag.String("path", "", "Path to watch for changes")
+	upstream := flag.String("upstream", "http://localhost:8080", "Local service URL")
+	forward := flag.String("forward", "", "Forward to a local Unix socket speaking HTTP instead of -upstream, e.g. unix:///var/run/docker.sock")
+	healthPath := flag.String("health-path", "", "Local service path to probe for health (disabled if empty)")
+	weight := flag.Int("weight", 1, "Relative share of the path's traffic (e.g. 90 and 10 for a canary)")
+	hostname := flag.String("hostname", "", "Hostname to serve over TLS on the server's HTTPS port, passed through undecrypted with -tcp-upstream")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate for -hostname (server generates one if empty)")
+	tlsKey := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	apiKey := flag.String("api-key", "", "API key identifying the client's tenant")
+	certFile := flag.String("cert", "", "Client certificate for mTLS identity (its common name becomes the client ID)")
+	keyFile := flag.String("key", "", "Private key for -cert")
+	caFile := flag.String("ca", "", "CA bundle used to verify the server's certificate")
+	sshKeyFile := flag.String("ssh-key", "", "SSH private key signing the registration, for servers with identity.ssh_keys")
+	id := flag.String("id", "", "Client ID to register with, e.g. one with reserved endpoints (generated if empty)")
+	healthInterval := flag.Duration("health-interval", 10*time.Second, "Interval between local health probes")
+	codec := flag.String("codec", "json", "Tunnel codec to ask the server for: json or msgpack")
+	tcpNoDelay := flag.Bool("tcp-nodelay", true, "Send small tunnel writes without delay (TCP_NODELAY)")
+	tcpKeepAlive := flag.Duration("tcp-keepalive", 0, "Keepalive probe period of the tunnel connection (system default if 0, disabled if negative)")
+	tcpReadBuffer := flag.Int("tcp-read-buffer", 0, "Socket receive buffer of the tunnel connection in bytes (system default if 0)")
+	tcpWriteBuffer := flag.Int("tcp-write-buffer", 0, "Socket send buffer of the tunnel connection in bytes (system default if 0)")
+	tcpLinger := flag.Int("tcp-linger", -1, "Seconds closing the tunnel connection waits to send unsent data, 0 resets it (system default if negative)")
+	compress := flag.Bool("compress", false, "Ask the server to snappy-compress large tunnel messages")
+	compressMinSize := flag.Int("compress-min-size", protocol.DefaultCompressMinSize, "Smallest response in bytes compressed with -compress")
+	bootstrap := flag.Bool("bootstrap", false, "Register on the tunnel connection itself, with -server set to the server's registration port")
+	workers := flag.Int("workers", 64, "Tunneled requests handled at once")
+	queueSize := flag.Int("queue-size", 256, "Tunneled requests queued while all workers are busy")
+	requestTimeout := flag.Duration("request-timeout", 0, "How long to wait for the upstream's response, e.g. 30s (0 waits until the server gives up)")
+	encrypt := flag.Bool("encrypt", false, "Encrypt tunnel traffic with a key exchanged at registration (no certificates needed)")
+	tui := flag.Bool("tui", false, "Show live tunnel status and traffic in an interactive terminal console")
+	reportMetrics := flag.Bool("report-metrics", false, "Send goroutine, memory, upstream latency, and stream metrics with heartbeats")
+	ttl := flag.Duration("ttl", 0, "Expire the tunnel after this long unless renewed, e.g. 2h (never if 0)")
+	methods := flag.String("methods", "", "Claim -path only for these comma-separated methods, e.g. GET,HEAD (all if empty)")
+	alpn := flag.String("alpn", "", "Claim -path only for requests over TLS negotiating these comma-separated protocols, e.g. h2 (any if empty)")
+	opts := client.TunnelOptions{}
+	flag.BoolVar(&opts.Shadow, "shadow", false, "Receive copies of -path's traffic, discarding the responses, without serving it")
+	flag.StringVar(&opts.Class, "class", "", "QoS priority class of the tunnel, e.g. prod (the server's default if empty)")
+	flag.StringVar(&opts.Schedule, "schedule", "", "Cron-like window the tunnel is reachable in, e.g. \"* 9-17 * * mon-fri\" (always if empty)")
+	flag.StringVar(&opts.Timezone, "schedule-tz", "", "Time zone of -schedule, e.g. Europe/Berlin (UTC if empty)")
+	flag.StringVar(&opts.Profile, "profile", "", "Server-side tunnel profile to take timeouts, limits, and defaults from")
+	flag.StringVar(&opts.TCPUpstream, "tcp-upstream", "", "Expose a local TCP service such as localhost:5432 on a public port of its own, forwarding raw bytes instead of HTTP")
+	flag.Func("match-header", "Claim -path only for requests with this header, e.g. X-Env=staging (repeatable)", func(value string) error {
+		name, headerValue, ok := strings.Cut(value, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("expected Name=value")
+		}
+		if opts.Headers == nil {
+			opts.Headers = make(map[string]string)
+		}
+		opts.Headers[strings.TrimSpace(name)] = headerValue
+		return nil
+	})
+	showVersion := flag.Bool("version", false, "Print the build and tunnel protocol versions and exit")
+	flag.Parse()
 
-func (c *Client) ConnectTCP() error {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", c.serverHost, c.TCPPort))
-	if err != nil {
-		return fmt.Errorf("failed to connect to TCP server: %v", err)
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
 	}
-	c.TCPConn = conn
-
-	// Send initial registration message with client ID and path
-	registrationMsg := fmt.Sprintf("%s|%s\n", c.ID, c.path)
-	log.Println(registrationMsg)
-	if _, err := c.TCPConn.Write([]byte(registrationMsg)); err != nil {
-		return fmt.Errorf("failed to send registration message: %v", err)
+	if *watchPath == "" {
+		log.Fatal("Path is required. Use -path flag to specify the path to watch")
 	}
-	log.Println("Registration message sent and waiting for confirmation...")
-
-	go func() {
-		// Wait for registration confirmation
-		buf := make([]byte, 1024)
-		n, err := c.TCPConn.Read(buf)
+	if daemon != nil {
+		if *tui && daemon.detach {
+			log.Fatal("-tui needs a terminal and can't be used with -daemon")
+		}
+		daemon.prepare(daemonArgs)
+	}
+	var handler http.Handler
+	if opts.TCPUpstream != "" {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "upstream", "forward", "health-path":
+				log.Fatalf("-tcp-upstream replaces HTTP forwarding and can't be used with -%s", f.Name)
+			}
+		})
+		if exposeDir != "" {
+			log.Fatal("expose-dir serves the directory itself and can't be used with -tcp-upstream")
+		}
+		*upstream = "tcp://" + opts.TCPUpstream
+	}
+	if *forward != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "upstream" {
+				log.Fatal("-forward replaces -upstream and can't be used with it")
+			}
+		})
+		if exposeDir != "" {
+			log.Fatal("expose-dir serves the directory itself and can't be used with -forward")
+		}
+		socket, err := parseForward(*forward)
 		if err != nil {
-			fmt.Printf("failed to read registration confirmation: %v", err)
-			return
+			log.Fatalf("Invalid -forward: %v", err)
 		}
-
-		response := strings.TrimSpace(string(buf[:n]))
-		if response != "registered" {
-			fmt.Printf("unexpected registration response: %s", response)
-			return
+		opts.Transport = unixTransport(socket)
+		*upstream = unixUpstream
+		log.Printf("Forwarding to Unix socket %s", socket)
+	}
+	if exposeDir != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "upstream" {
+				log.Fatal("expose-dir serves the directory itself and can't be used with -upstream")
+			}
+		})
+		var err error
+		if handler, err = serveDir(exposeDir, *watchPath); err != nil {
+			log.Fatalf("Failed to expose directory: %v", err)
 		}
-
-		log.Printf("Successfully registered with server")
-	}()
-	return nil
-}
-
-func (c *Client) sendMessage(message string) error {
-	_, err := c.TCPConn.Write([]byte(message + "\n"))
-	return err
-}
-
-func (c *Client) receiveMessage() (string, error) {
-	buf := make([]byte, 1024)
-	n, err := c.TCPConn.Read(buf)
-	if err != nil {
-		return "", err
+		*upstream = exposeDir
 	}
-	return string(buf[:n]), nil
-}
+	opts.Upstream = *upstream
 
-func (c *Client) receiveMessages() {
-	for {
-		message, err := c.receiveMessage()
+	// Generate a unique client ID, unless one is given or proven by a client certificate
+	clientID := *id
+	if clientID == "" {
+		clientID = uuid.New().String()
+	}
+	clientOpts := []client.Option{client.WithAPIKey(*apiKey), client.WithProbeInterval(*probeInterval)}
+	if *certFile != "" {
+		tlsConfig, certID, err := client.LoadCertificate(*certFile, *keyFile, *caFile)
 		if err != nil {
-			log.Printf("Failed to receive message: %v", err)
-			return
+			log.Fatalf("Failed to load TLS config: %v", err)
 		}
-
-		message = strings.TrimSpace(message)
-
-		// Handle heartbeat acknowledgment
-		if message == "heartbeat-ack" {
-			log.Printf("Received heartbeat acknowledgment from server")
-			continue
+		clientID = certID
+		clientOpts = append(clientOpts, client.WithTLSConfig(tlsConfig))
+		log.Printf("Using client ID from certificate: %s", clientID)
+	} else if *id == "" {
+		log.Printf("Generated client ID: %s", clientID)
+	}
+	if *bootstrap {
+		clientOpts = append(clientOpts, client.WithBootstrap())
+	}
+	if *sshKeyFile != "" {
+		key, err := sshkey.LoadPrivateKey(*sshKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load SSH key: %v", err)
 		}
-
-		log.Printf("Received message: '%s'", message)
+		clientOpts = append(clientOpts, client.WithSSHKey(key))
 	}
-}
-
-func (c *Client) startHeartbeat(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		log.Printf("Sending heartbeat...")
-		if err := c.sendMessage("heartbeat"); err != nil {
-			log.Printf("Failed to send heartbeat: %v", err)
-			return
+	sockets := sockopt.Options{
+		KeepAlive:       *tcpKeepAlive,
+		ReadBufferSize:  *tcpReadBuffer,
+		WriteBufferSize: *tcpWriteBuffer,
+	}
+	if !*tcpNoDelay {
+		sockets.NoDelay = tcpNoDelay
+	}
+	if *tcpLinger >= 0 {
+		sockets.Linger = tcpLinger
+	}
+	clientOpts = append(clientOpts, client.WithSocketOptions(sockets))
+	switch *proxy {
+	case "":
+	case "direct":
+		clientOpts = append(clientOpts, client.WithProxy(nil))
+	default:
+		proxyURL, err := client.ParseProxy(*proxy)
+		if err != nil {
+			log.Fatalf("Invalid -proxy: %v", err)
 		}
+		clientOpts = append(clientOpts, client.WithProxy(proxyURL))
 	}
-}
+	opts.ID = clientID
 
-func main() {
-	// Command line flags
-	serverAddr := flag.String("server", "localhost:9999", "Server address")
-	watchPath := flag.String("path", "", "Path to watch for changes")
-	flag.Parse()
-
-	if *watchPath == "" {
-		log.Fatal("Path is required. Use -path flag to specify the path to watch")
+	for _, method := range strings.Split(*methods, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			opts.Methods = append(opts.Methods, strings.ToUpper(method))
+		}
+	}
+	for _, protocol := range strings.Split(*alpn, ",") {
+		if protocol = strings.TrimSpace(protocol); protocol != "" {
+			opts.ALPN = append(opts.ALPN, protocol)
+		}
 	}
 
-	// Generate a unique client ID
-	clientID := uuid.New().String()
-	log.Printf("Generated client ID: %s", clientID)
-
-	client, err := registerClient(*serverAddr, clientID, *watchPath)
+	if *hostname != "" && *bootstrap && opts.TCPUpstream == "" {
+		log.Fatalf("-hostname needs the server's HTTP API and can't be used with -bootstrap")
+	}
+	opts.Weight = *weight
+	opts.TTL = *ttl
+	opts.Hostname, opts.HostnameCert, opts.HostnameKey = *hostname, *tlsCert, *tlsKey
+	opts.Codec = *codec
+	opts.Compress = *compress
+	opts.CompressMinSize = *compressMinSize
+	opts.Encrypt = *encrypt
+	opts.Workers = *workers
+	opts.QueueSize = *queueSize
+	opts.RequestTimeout = *requestTimeout
+	opts.ReportMetrics = *reportMetrics
+	opts.HealthPath = *healthPath
+	opts.HealthInterval = *healthInterval
+
+	c, err := client.New(*serverAddr, clientOpts...)
 	if err != nil {
-		log.Fatalf("Failed to register client: %v", err)
+		log.Fatalf("%v. Use -server flag to specify it", err)
 	}
 
-	log.Println("connecting to TCP server...")
-	if err := client.ConnectTCP(); err != nil {
-		log.Printf("failed to connect to TCP server: %v", err)
-		return
+	var console *console
+	if *tui {
+		var err error
+		console, err = newConsole(clientID, *watchPath, *upstream)
+		if err != nil {
+			log.Fatalf("Failed to start console: %v", err)
+		}
+		if err := console.Start(); err != nil {
+			log.Fatalf("Failed to start console: %v", err)
+		}
+		opts.OnRequest = console.observe
+		log.SetOutput(console)
+	}
+	// fatal gives the terminal back before exiting
+	fatal := func(format string, args ...any) {
+		if console != nil {
+			console.Stop()
+		}
+		log.Fatalf(format, args...)
 	}
-	log.Printf("Received client: %+v", client)
-	log.Printf("Client registered with ID: %s", client.ID)
 
+	tunnel, err := c.RegisterPath(context.Background(), *watchPath, handler, opts)
+	if err != nil {
+		fatal("%v", err)
+	}
+	if console != nil {
+		console.tunnel.Store(tunnel)
+	}
+	if daemon != nil {
+		daemon.serve(tunnel, *upstream)
+	}
 	log.Println("Client started")
 
-	// Start receiving messages in a separate goroutine
-	go client.receiveMessages()
-
-	// Start heartbeat in a separate goroutine
-	go client.startHeartbeat(2 * time.Second)
-
-	// Keep the main function running
-	select {}
+	// The tunnel reconnects until the server ends it or the process exits
+	<-tunnel.Done()
+	fatal("%v", tunnel.Err())
 }
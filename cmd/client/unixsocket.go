@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// unixUpstream is the upstream URL of tunnels forwarded to a Unix socket. The
+// host only names the service in the Host header; every request is dialed to
+// the socket.
+const unixUpstream = "http://localhost"
+
+// parseForward reads a -forward target such as unix:///var/run/docker.sock
+// and returns the socket path
+func parseForward(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid forward target %q: %v", target, err)
+	}
+	if u.Scheme != "unix" {
+		return "", fmt.Errorf("unsupported forward target %q, expected unix:///path.sock", target)
+	}
+	// unix:///abs/path has an empty host, unix://relative/path does not
+	path := u.Host + u.Path
+	if path == "" {
+		return "", fmt.Errorf("forward target %q has no socket path", target)
+	}
+	return path, nil
+}
+
+// unixTransport sends upstream requests over the Unix socket at path
+func unixTransport(path string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	return transport
+}
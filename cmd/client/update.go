@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/client"
+	"github.com/vikasavn/attachcloudip/pkg/update"
+	"github.com/vikasavn/attachcloudip/pkg/version"
+)
+
+// updateTimeout bounds checking for and downloading a release
+const updateTimeout = 5 * time.Minute
+
+// runUpdate handles the update subcommand, which replaces the client binary
+// with the release its server or a release URL offers
+func runUpdate(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	serverAddr := fs.String("server", "localhost:9999", "Server whose /client/latest offers the release")
+	releaseURL := fs.String("release-url", "", "URL of a release JSON to use instead of the server")
+	publicKey := fs.String("public-key", "", "Base64 Ed25519 key releases must be signed with (checksum only if empty)")
+	check := fs.Bool("check", false, "Only report whether an update is available")
+	force := fs.Bool("force", false, "Install the release even if it isn't newer than the running version")
+	fs.Parse(args)
+
+	var key ed25519.PublicKey
+	if *publicKey != "" {
+		var err error
+		if key, err = update.ParsePublicKey(*publicKey); err != nil {
+			log.Fatalf("Invalid -public-key: %v", err)
+		}
+	}
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		log.Fatalf("Failed to find the client binary: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+	c, err := client.New(*serverAddr)
+	if err != nil {
+		log.Fatalf("Failed to check for updates: %v", err)
+	}
+	var release *update.Release
+	if *releaseURL != "" {
+		release, err = update.Fetch(ctx, http.DefaultClient, *releaseURL)
+	} else {
+		release, err = c.LatestRelease(ctx)
+	}
+	if err != nil {
+		log.Fatalf("Failed to check for updates: %v", err)
+	}
+
+	current := version.Get().Version
+	if !*force {
+		order, err := update.Compare(release.Version, current)
+		if err != nil {
+			log.Fatalf("Failed to compare release %s with client %s: %v, use -force to install it anyway", release.Version, current, err)
+		}
+		if order == 0 {
+			fmt.Printf("Client %s is up to date\n", current)
+			return
+		}
+		if order < 0 {
+			fmt.Printf("Client %s is newer than release %s, use -force to downgrade\n", current, release.Version)
+			return
+		}
+	}
+	if *check {
+		fmt.Printf("Client %s can be updated to %s\n", current, release.Version)
+		return
+	}
+	if *releaseURL != "" {
+		err = update.Install(ctx, http.DefaultClient, release, key, executable)
+	} else {
+		err = c.InstallRelease(ctx, release, key, executable)
+	}
+	if err != nil {
+		log.Fatalf("Failed to update to %s: %v", release.Version, err)
+	}
+	fmt.Printf("Updated client %s to %s, restart running tunnels to use it\n", current, release.Version)
+}
+
+// runSignRelease handles the sign-release subcommand, which writes the .sig
+// files `update -public-key` verifies next to release binaries
+func runSignRelease(args []string) {
+	fs := flag.NewFlagSet("sign-release", flag.ExitOnError)
+	keyFile := fs.String("key", "", "File holding the base64 Ed25519 private key seed")
+	generate := fs.Bool("generate", false, "Create -key if it doesn't exist")
+	releaseVersion := fs.String("version", "", "Version the binaries are released as, e.g. v1.4.0")
+	fs.Parse(args)
+	if *keyFile == "" || *releaseVersion == "" {
+		log.Fatal("Usage: client sign-release -key release.key -version v1.4.0 [-generate] <binary>...")
+	}
+	if _, err := update.Compare(*releaseVersion, *releaseVersion); err != nil {
+		log.Fatalf("Invalid -version: %v", err)
+	}
+
+	key, err := loadSigningKey(*keyFile, *generate)
+	if err != nil {
+		log.Fatalf("Failed to load signing key: %v", err)
+	}
+	fmt.Printf("Public key: %s\n", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	for _, binary := range fs.Args() {
+		goos, goarch, ok := update.ParseBinaryName(binary)
+		if !ok {
+			log.Fatalf("Can't tell the platform of %s, name it like %s", binary, update.BinaryName("linux", "amd64"))
+		}
+		signature, err := update.Sign(key, binary, *releaseVersion, goos, goarch)
+		if err != nil {
+			log.Fatalf("Failed to sign %s: %v", binary, err)
+		}
+		if err := os.WriteFile(binary+".sig", []byte(signature+"\n"), 0o644); err != nil {
+			log.Fatalf("Failed to write signature of %s: %v", binary, err)
+		}
+		fmt.Printf("Signed %s as %s for %s/%s\n", binary, *releaseVersion, goos, goarch)
+	}
+}
+
+// loadSigningKey reads a private key seed, creating one if generate is set
+// and the file doesn't exist
+func loadSigningKey(path string, generate bool) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && generate {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(seed)+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated signing key %s, keep it off the server", path)
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a base64 Ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
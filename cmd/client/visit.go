@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/vikasavn/attachcloudip/pkg/client"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+)
+
+// runVisit handles the visit subcommand, which forwards a local port to the
+// raw TCP tunnel of another client, peer-to-peer when possible
+func runVisit(args []string) {
+	fs := flag.NewFlagSet("visit", flag.ExitOnError)
+	serverAddr := fs.String("server", "localhost:9999", "Server address")
+	id := fs.String("id", "", "Client ID of the raw TCP tunnel to visit")
+	listen := fs.String("listen", "127.0.0.1:0", "Local address to accept connections on")
+	apiKey := fs.String("api-key", "", "API key of the tunnel's tenant")
+	proxy := fs.String("proxy", "", "Reach the server through this HTTP CONNECT or SOCKS5 proxy, which rules out direct connections, or \"direct\" for none (HTTPS_PROXY if empty)")
+	fs.Parse(args)
+
+	if *id == "" {
+		log.Fatal("Client ID is required. Use -id flag to specify the tunnel")
+	}
+	clientOpts := []client.Option{client.WithAPIKey(*apiKey)}
+	switch *proxy {
+	case "":
+	case "direct":
+		clientOpts = append(clientOpts, client.WithProxy(nil))
+	default:
+		proxyURL, err := client.ParseProxy(*proxy)
+		if err != nil {
+			log.Fatalf("Invalid -proxy: %v", err)
+		}
+		clientOpts = append(clientOpts, client.WithProxy(proxyURL))
+	}
+	c, err := client.New(*serverAddr, clientOpts...)
+	if err != nil {
+		log.Fatalf("Failed to visit tunnel: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	visitor, err := c.Visit(ctx, *id)
+	if err != nil {
+		log.Fatalf("Failed to visit tunnel: %v", err)
+	}
+	defer visitor.Close()
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *listen, err)
+	}
+	context.AfterFunc(ctx, func() { listener.Close() })
+	log.Printf("Forwarding %s to tunnel %s", listener.Addr(), *id)
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to accept connection: %v", err)
+			}
+			return
+		}
+		go func() {
+			remote, err := visitor.Dial(ctx)
+			if err != nil {
+				log.Printf("Failed to reach tunnel %s: %v", *id, err)
+				local.Close()
+				return
+			}
+			traffic.Splice(local, remote)
+		}()
+	}
+}
@@ -1,52 +1,83 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
-)
+	"os/signal"
+	"syscall"
 
-var (
-	HTTPPort      = 9999
-	TCPPort       = 9998
-	tcpmanager    = NewTCPManager()
-	clientManager = NewClientManager()
+	"github.com/vikasavn/attachcloudip/pkg/server"
+	"github.com/vikasavn/attachcloudip/pkg/version"
 )
 
 func init() {
-	// Set up logging with file name and line number
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	log.SetFlags(log.Llongfile)
 }
 
-// loadConfig loads the configuration from a YAML file
-
 func main() {
-	log.Println("Starting server...")
+	configPath := flag.String("config", "", "Path to the server configuration file")
+	validate := flag.Bool("validate", false, "Check the configuration, print it with defaults applied, and exit without serving")
+	showVersion := flag.Bool("version", false, "Print the build and tunnel protocol versions and exit")
+	flag.Parse()
 
-	// Start TCP listener on port 8080
-	if err := tcpmanager.StartListener(TCPPort); err != nil {
-		log.Fatalf("Failed to start TCP listener: %v", err)
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
 	}
-	log.Println("TCP Listener started on port", TCPPort)
 
-	// Start handling TCP connections in a goroutine
+	config := &server.Config{}
+	if *configPath != "" {
+		var err error
+		config, err = server.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
+	if *validate {
+		if err := server.Validate(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+		effective, err := server.EffectiveConfig(config)
+		if err != nil {
+			log.Fatalf("Failed to print config: %v", err)
+		}
+		os.Stdout.Write(effective)
+		return
+	}
+
+	log.Printf("Tunnel server %s", version.Get())
+	srv, err := server.New(config)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+
+	// The first SIGTERM or SIGINT drains the server, a second cuts it short
+	stopped := make(chan struct{})
 	go func() {
-		log.Println("Starting TCP connection handler...")
-		tcpmanager.HandleIncomingRequests()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-signals
+			log.Printf("Received second signal, exiting now")
+			cancel()
+		}()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown cut short: %v", err)
+		}
+		close(stopped)
 	}()
 
-	log.Printf("HTTP Server starting on port %d...", HTTPPort)
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
-	http.HandleFunc("/register", RegisterClient)
-	http.HandleFunc("/healthz", HealthCheck)
-	http.HandleFunc("/clients", ListClients) // Add new route for listing clients
-
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", HTTPPort), nil); err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
-		os.Exit(1)
+	if err := srv.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
 	}
+	<-stopped
 }
@@ -0,0 +1,241 @@
+package admission
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shedResponse is written to connections accepted beyond the connection limit
+const shedResponse = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Retry-After: 1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Length: 20\r\n" +
+	"Connection: close\r\n" +
+	"\r\n" +
+	"Service Unavailable\n"
+
+// Stats is a snapshot of the controller's saturation
+type Stats struct {
+	Connections         int64
+	MaxConnections      int64
+	InFlight            int64
+	MaxInFlight         int64
+	RejectedConnections int64
+	RejectedRequests    int64
+	Classes             []ClassStats // Empty unless priority classes are set
+}
+
+// ClassStats counts the queued and dropped requests of a priority class
+type ClassStats struct {
+	Name        string
+	Queued      int64 // Waiting for a slot now
+	QueuedTotal int64 // Ever made to wait
+	Dropped     int64 // Rejected at capacity or after waiting too long
+}
+
+// Controller caps the server-wide number of open public connections and
+// in-flight proxy jobs, shedding anything beyond the limits. With priority
+// classes, jobs beyond the in-flight limit may instead wait for a slot, which
+// goes to the highest class waiting.
+type Controller struct {
+	maxConnections      atomic.Int64
+	maxInFlight         atomic.Int64
+	connections         atomic.Int64
+	inFlight            atomic.Int64
+	rejectedConnections atomic.Int64
+	rejectedRequests    atomic.Int64
+
+	mu           sync.Mutex // Guards in-flight changes once classes are set
+	classes      []*class   // Highest priority first
+	queueTimeout time.Duration
+}
+
+type class struct {
+	name        string
+	waiting     []chan struct{} // Oldest first
+	queuedTotal int64
+	dropped     int64
+}
+
+// NewController creates a new admission controller. A limit of 0 means unlimited.
+func NewController(maxConnections, maxInFlight int) *Controller {
+	c := &Controller{}
+	c.SetLimits(maxConnections, maxInFlight)
+	return c
+}
+
+// SetLimits updates the connection and in-flight limits
+func (c *Controller) SetLimits(maxConnections, maxInFlight int) {
+	c.maxConnections.Store(int64(maxConnections))
+	c.maxInFlight.Store(int64(maxInFlight))
+}
+
+// SetClasses names the priority classes, highest first. Jobs beyond the
+// in-flight limit wait up to queueTimeout for a slot, or are shed at once if
+// it is zero. It must be called before jobs are admitted.
+func (c *Controller) SetClasses(names []string, queueTimeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.classes = make([]*class, len(names))
+	for i, name := range names {
+		c.classes[i] = &class{name: name}
+	}
+	c.queueTimeout = queueTimeout
+}
+
+// Acquire admits one in-flight job of the given priority class, 0 being the
+// highest. When admitted the returned function must be called once the job
+// is done.
+func (c *Controller) Acquire(ctx context.Context, priority int) (func(), bool) {
+	c.mu.Lock()
+	if len(c.classes) == 0 {
+		c.mu.Unlock()
+		return c.acquireUnclassed()
+	}
+	if priority < 0 || priority >= len(c.classes) {
+		priority = len(c.classes) - 1
+	}
+	cl := c.classes[priority]
+	if max := c.maxInFlight.Load(); max <= 0 || c.inFlight.Load() < max {
+		c.inFlight.Add(1)
+		c.mu.Unlock()
+		return c.releaser(), true
+	}
+	if c.queueTimeout <= 0 {
+		cl.dropped++
+		c.mu.Unlock()
+		c.rejectedRequests.Add(1)
+		return nil, false
+	}
+	ready := make(chan struct{})
+	cl.waiting = append(cl.waiting, ready)
+	cl.queuedTotal++
+	c.mu.Unlock()
+
+	timer := time.NewTimer(c.queueTimeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return c.releaser(), true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, waiter := range cl.waiting {
+		if waiter == ready {
+			cl.waiting = append(cl.waiting[:i], cl.waiting[i+1:]...)
+			cl.dropped++
+			c.rejectedRequests.Add(1)
+			return nil, false
+		}
+	}
+	// A slot was handed over while giving up
+	return c.releaser(), true
+}
+
+func (c *Controller) acquireUnclassed() (func(), bool) {
+	n := c.inFlight.Add(1)
+	if max := c.maxInFlight.Load(); max > 0 && n > max {
+		c.inFlight.Add(-1)
+		c.rejectedRequests.Add(1)
+		return nil, false
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { c.inFlight.Add(-1) })
+	}, true
+}
+
+// releaser returns the function giving back a classed job's slot, handing
+// it to the oldest waiter of the highest class waiting
+func (c *Controller) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			for _, cl := range c.classes {
+				if len(cl.waiting) > 0 {
+					close(cl.waiting[0])
+					cl.waiting = cl.waiting[1:]
+					return
+				}
+			}
+			c.inFlight.Add(-1)
+		})
+	}
+}
+
+// Listener wraps l so connections beyond the connection limit are answered
+// with a 503 and closed instead of being served
+func (c *Controller) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, controller: c}
+}
+
+// Stats returns the current saturation counters
+func (c *Controller) Stats() Stats {
+	c.mu.Lock()
+	classes := make([]ClassStats, len(c.classes))
+	for i, cl := range c.classes {
+		classes[i] = ClassStats{Name: cl.name, Queued: int64(len(cl.waiting)), QueuedTotal: cl.queuedTotal, Dropped: cl.dropped}
+	}
+	c.mu.Unlock()
+	return Stats{
+		Connections:         c.connections.Load(),
+		MaxConnections:      c.maxConnections.Load(),
+		InFlight:            c.inFlight.Load(),
+		MaxInFlight:         c.maxInFlight.Load(),
+		RejectedConnections: c.rejectedConnections.Load(),
+		RejectedRequests:    c.rejectedRequests.Load(),
+		Classes:             classes,
+	}
+}
+
+type listener struct {
+	net.Listener
+	controller *Controller
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		c := l.controller
+		n := c.connections.Add(1)
+		if max := c.maxConnections.Load(); max > 0 && n > max {
+			c.connections.Add(-1)
+			c.rejectedConnections.Add(1)
+			go shed(conn)
+			continue
+		}
+
+		return &trackedConn{Conn: conn, controller: c}, nil
+	}
+}
+
+// shed answers a connection that exceeded the limit without reading its request
+func shed(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte(shedResponse))
+}
+
+type trackedConn struct {
+	net.Conn
+	controller *Controller
+	once       sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.controller.connections.Add(-1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,236 @@
+// Package alerts tracks which alert rules are firing and notifies webhook,
+// Slack, and PagerDuty integrations when an alert fires or resolves, once
+// per change
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert statuses
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+// notifyTimeout bounds each call to an integration
+const notifyTimeout = 10 * time.Second
+
+// Alert is a rule breached by one subject, such as a client ID, or "server"
+// for server-wide rules
+type Alert struct {
+	Rule       string     `json:"rule"`
+	Severity   string     `json:"severity"`
+	Subject    string     `json:"subject"`
+	Message    string     `json:"message"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+func (a Alert) key() string {
+	return a.Rule + "/" + a.Subject
+}
+
+// Notifier delivers alerts to an integration
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// Manager remembers the firing alerts so each change is notified once
+type Manager struct {
+	mu        sync.Mutex
+	active    map[string]Alert
+	notifiers map[string]Notifier
+	routes    map[string][]string // Rule -> integrations it notifies, all if empty
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		active:    make(map[string]Alert),
+		notifiers: make(map[string]Notifier),
+		routes:    make(map[string][]string),
+	}
+}
+
+// AddNotifier adds a named integration
+func (m *Manager) AddNotifier(name string, n Notifier) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifiers[name] = n
+}
+
+// Route limits a rule's notifications to the named integrations
+func (m *Manager) Route(rule string, integrations []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes[rule] = integrations
+}
+
+// Update sets the alerts a rule currently has firing. Alerts that weren't
+// firing before are notified as firing, and those no longer in current as
+// resolved.
+func (m *Manager) Update(rule string, current []Alert) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool, len(current))
+	for _, alert := range current {
+		alert.Rule = rule
+		alert.Status = Firing
+		seen[alert.key()] = true
+		if _, ok := m.active[alert.key()]; ok {
+			continue
+		}
+		alert.StartedAt = now
+		m.active[alert.key()] = alert
+		m.notifyLocked(alert)
+	}
+	for key, alert := range m.active {
+		if alert.Rule != rule || seen[key] {
+			continue
+		}
+		delete(m.active, key)
+		alert.Status = Resolved
+		alert.ResolvedAt = &now
+		m.notifyLocked(alert)
+	}
+}
+
+// Active returns the firing alerts, oldest first
+func (m *Manager) Active() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alerts := make([]Alert, 0, len(m.active))
+	for _, alert := range m.active {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if !alerts[i].StartedAt.Equal(alerts[j].StartedAt) {
+			return alerts[i].StartedAt.Before(alerts[j].StartedAt)
+		}
+		return alerts[i].key() < alerts[j].key()
+	})
+	return alerts
+}
+
+func (m *Manager) notifyLocked(alert Alert) {
+	log.Printf("Alerts: %s %s for %s: %s", alert.Rule, alert.Status, alert.Subject, alert.Message)
+	names := m.routes[alert.Rule]
+	if len(names) == 0 {
+		for name := range m.notifiers {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		n, ok := m.notifiers[name]
+		if !ok {
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := n.Notify(ctx, alert); err != nil {
+				log.Printf("Alerts: Failed to notify %s of %s: %v", name, alert.key(), err)
+			}
+		}()
+	}
+}
+
+// Webhook posts alerts as JSON
+type Webhook struct {
+	URL     string
+	Headers map[string]string
+}
+
+func (w *Webhook) Notify(ctx context.Context, alert Alert) error {
+	return postJSON(ctx, w.URL, w.Headers, alert)
+}
+
+// Slack posts alerts to an incoming webhook
+type Slack struct {
+	URL string
+}
+
+func (s *Slack) Notify(ctx context.Context, alert Alert) error {
+	icon := ":rotating_light:"
+	if alert.Status == Resolved {
+		icon = ":white_check_mark:"
+	}
+	text := fmt.Sprintf("%s *[%s] %s* (%s) %s: %s", icon, strings.ToUpper(alert.Status), alert.Rule, alert.Severity, alert.Subject, alert.Message)
+	return postJSON(ctx, s.URL, nil, map[string]string{"text": text})
+}
+
+// DefaultPagerDutyURL is the PagerDuty Events API v2 endpoint
+const DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty triggers and resolves incidents, one per rule and subject
+type PagerDuty struct {
+	URL        string
+	RoutingKey string
+}
+
+func (p *PagerDuty) Notify(ctx context.Context, alert Alert) error {
+	action := "trigger"
+	if alert.Status == Resolved {
+		action = "resolve"
+	}
+	severity := alert.Severity
+	switch severity {
+	case "critical", "error", "warning", "info":
+	default:
+		severity = "error"
+	}
+	event := map[string]any{
+		"routing_key":  p.RoutingKey,
+		"event_action": action,
+		"dedup_key":    "attachcloudip/" + alert.key(),
+		"payload": map[string]any{
+			"summary":   fmt.Sprintf("%s: %s", alert.Rule, alert.Message),
+			"source":    alert.Subject,
+			"severity":  severity,
+			"timestamp": alert.StartedAt.Format(time.RFC3339),
+		},
+	}
+	url := p.URL
+	if url == "" {
+		url = DefaultPagerDutyURL
+	}
+	return postJSON(ctx, url, nil, event)
+}
+
+func postJSON(ctx context.Context, url string, headers map[string]string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
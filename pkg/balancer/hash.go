@@ -0,0 +1,54 @@
+// Package balancer spreads requests for a route over the clients serving it
+package balancer
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Replica is one client serving a route
+type Replica struct {
+	ID     string
+	Weight int
+}
+
+// Pick returns the index of the replica key is assigned to, or -1 if none has
+// a positive weight. Assignment uses weighted rendezvous hashing: every
+// replica scores the key and the highest score wins, so a replica joining or
+// leaving only moves the keys it gains or loses and keeps the rest in place.
+// Replicas win a share of keys proportional to their weight.
+func Pick(key string, replicas []Replica) int {
+	best := -1
+	bestScore := math.Inf(-1)
+	for i, replica := range replicas {
+		if replica.Weight <= 0 {
+			continue
+		}
+		if score := score(key, replica); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// score is the replica's claim on key, higher winning
+func score(key string, replica Replica) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(replica.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	// Map the hash into (0, 1) and scale by weight; -w/ln(u) is the
+	// standard weighted rendezvous score
+	u := (float64(mix(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -float64(replica.Weight) / math.Log(u)
+}
+
+// mix finalizes a hash so nearby inputs spread over the whole range
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,369 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// revalidateGrace is how long a stale entry with a validator is kept so it
+// can be refreshed by a 304 instead of fetched again
+const revalidateGrace = 10 * time.Minute
+
+// cacheableStatus lists the statuses stored when the response allows it
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// Options tune a Cache
+type Options struct {
+	MaxEntrySize int64 // Largest body stored in bytes, unlimited if zero
+	// DefaultTTL applies to responses without Cache-Control or Expires; zero
+	// leaves them uncached
+	DefaultTTL time.Duration
+	// BypassHeaders are request headers that identify the caller, such as
+	// those an authenticating proxy sets, besides Authorization and Cookie.
+	// Requests carrying any of them skip the cache.
+	BypassHeaders []string
+}
+
+// credentialHeaders identify the caller of every request carrying them, so
+// answers to it are never shared
+var credentialHeaders = []string{"Authorization", "Cookie"}
+
+// Cache answers GET and HEAD requests from a Store as an HTTP shared cache
+type Cache struct {
+	store Store
+	opts  Options
+}
+
+func New(store Store, opts Options) *Cache {
+	return &Cache{store: store, opts: opts}
+}
+
+// Middleware serves cacheable requests from the store, filling it from next
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Host + r.URL.RequestURI()
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			rec := &recorder{ResponseWriter: w, tooBig: true}
+			next.ServeHTTP(rec, r)
+			// A successful change to the resource makes the stored copy wrong
+			if rec.status < 400 {
+				c.store.Delete(r.Context(), key)
+			}
+			return
+		}
+		directives := parseCacheControl(r.Header.Get("Cache-Control"))
+		if _, ok := directives["no-store"]; ok || c.identifiesCaller(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry, ok := c.store.Get(r.Context(), key)
+		if ok && !entry.varyMatches(r) {
+			entry, ok = nil, false
+		}
+		_, noCache := directives["no-cache"]
+		if ok && !noCache && time.Now().Before(entry.Expires) {
+			serveEntry(w, r, entry, "HIT")
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, maxSize: c.opts.MaxEntrySize, state: "MISS"}
+		req := r
+		if ok && entry.hasValidator() {
+			// Ask whether the stored copy is still good
+			req = r.Clone(r.Context())
+			if etag := entry.Header.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if modified := entry.Header.Get("Last-Modified"); modified != "" {
+				req.Header.Set("If-Modified-Since", modified)
+			}
+			rec.revalidating = true
+			rec.state = "EXPIRED"
+		}
+		next.ServeHTTP(rec, req)
+
+		if rec.notModified {
+			serveEntry(w, r, c.refresh(r.Context(), key, entry, rec.header), "REVALIDATED")
+			return
+		}
+		if r.Method == http.MethodGet && !rec.tooBig && !rec.hijacked {
+			c.maybeStore(r, key, rec)
+		}
+	})
+}
+
+// identifiesCaller reports whether the request carries the caller's
+// credentials or identity, whose responses may be personal
+func (c *Cache) identifiesCaller(r *http.Request) bool {
+	for _, headers := range [][]string{credentialHeaders, c.opts.BypassHeaders} {
+		for _, name := range headers {
+			if r.Header.Get(name) != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maybeStore keeps a response the headers allow to be cached
+func (c *Cache) maybeStore(r *http.Request, key string, rec *recorder) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := rec.header
+	if !cacheableStatus[status] || header == nil || header.Get("Set-Cookie") != "" {
+		return
+	}
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return
+	}
+	if _, ok := directives["private"]; ok {
+		return
+	}
+
+	vary := make(map[string]string)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary[name] = r.Header.Get(name)
+			}
+		}
+	}
+
+	now := time.Now()
+	entry := &Entry{Status: status, Header: header, Body: rec.body.Bytes(), Stored: now, Vary: vary}
+	lifetime, explicit := freshness(header, directives, now)
+	if !explicit {
+		lifetime = c.opts.DefaultTTL
+	}
+	if _, ok := directives["no-cache"]; ok {
+		lifetime = 0
+	}
+	entry.Expires = now.Add(lifetime)
+
+	ttl := lifetime
+	if entry.hasValidator() {
+		ttl += revalidateGrace
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.store.Set(r.Context(), key, entry, ttl)
+}
+
+// refresh stores a revalidated entry updated from the headers of the 304.
+// Stored entries are shared by concurrent requests, so the update is a copy.
+func (c *Cache) refresh(ctx context.Context, key string, stale *Entry, header http.Header) *Entry {
+	entry := *stale
+	entry.Header = stale.Header.Clone()
+	for _, name := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified"} {
+		if value := header.Get(name); value != "" {
+			entry.Header.Set(name, value)
+		}
+	}
+	now := time.Now()
+	directives := parseCacheControl(entry.Header.Get("Cache-Control"))
+	lifetime, explicit := freshness(entry.Header, directives, now)
+	if !explicit {
+		lifetime = c.opts.DefaultTTL
+	}
+	if _, ok := directives["no-cache"]; ok {
+		lifetime = 0
+	}
+	entry.Stored = now
+	entry.Expires = now.Add(lifetime)
+	c.store.Set(ctx, key, &entry, lifetime+revalidateGrace)
+	return &entry
+}
+
+// serveEntry writes a stored response, answering conditional requests the
+// stored validators satisfy with 304
+func serveEntry(w http.ResponseWriter, r *http.Request, entry *Entry, state string) {
+	h := w.Header()
+	for name, values := range entry.Header {
+		h[name] = append([]string(nil), values...)
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+	h.Set("X-Cache", state)
+
+	if notModified(r, entry.Header) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// notModified reports whether the request's conditions match the stored
+// validators
+func notModified(r *http.Request, header http.Header) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+func (e *Entry) hasValidator() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+func (e *Entry) varyMatches(r *http.Request) bool {
+	for name, value := range e.Vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// freshness returns how long a response stays fresh, and whether its
+// headers said so rather than leaving it to the cache
+func freshness(header http.Header, directives map[string]string, now time.Time) (time.Duration, bool) {
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			// An invalid Expires means already expired
+			return 0, true
+		}
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		return at.Sub(now), true
+	}
+	return 0, false
+}
+
+// parseCacheControl splits a Cache-Control header into lower-cased
+// directives and their values
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+	}
+	return directives
+}
+
+// recorder passes a response through while keeping a copy of it. When
+// revalidating, a 304 is held back so the stored copy can be served instead.
+type recorder struct {
+	http.ResponseWriter
+	maxSize      int64
+	state        string // X-Cache value for responses passed through
+	revalidating bool
+
+	status      int
+	header      http.Header // Snapshot taken when the headers were written
+	body        bytes.Buffer
+	tooBig      bool
+	notModified bool
+	hijacked    bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status != 0 {
+		return
+	}
+	r.status = status
+	r.header = r.ResponseWriter.Header().Clone()
+	if r.revalidating && status == http.StatusNotModified {
+		// The stored headers replace these when the entry is served
+		r.notModified = true
+		return
+	}
+	if r.state != "" {
+		r.ResponseWriter.Header().Set("X-Cache", r.state)
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.notModified {
+		return len(p), nil
+	}
+	if !r.tooBig {
+		if r.maxSize > 0 && int64(r.body.Len()+len(p)) > r.maxSize {
+			r.tooBig = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *recorder) Flush() {
+	if r.notModified {
+		return
+	}
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	if h, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("response does not support hijacking")
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,168 @@
+// Package cache keeps responses from tunnels so repeated GETs are answered
+// without crossing them again, following the Cache-Control, Expires, ETag,
+// and Last-Modified headers of the responses
+package cache
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/redis"
+)
+
+// Entry is a stored response
+type Entry struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"` // Fresh until then, revalidated after
+	// Vary holds the request headers the response varies on, with the values
+	// of the request that stored it
+	Vary map[string]string `json:"vary,omitempty"`
+}
+
+func (e *Entry) size() int64 {
+	size := int64(len(e.Body))
+	for name, values := range e.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// Store holds entries by key. Entries may be dropped at any time.
+type Store interface {
+	Get(ctx context.Context, key string) (*Entry, bool)
+	// Set keeps entry for at least ttl, after which it may be dropped
+	Set(ctx context.Context, key string, entry *Entry, ttl time.Duration)
+	Delete(ctx context.Context, key string)
+}
+
+// Memory is a Store evicting the least recently used entries beyond a total
+// size
+type Memory struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	order   *list.List // Front is most recently used
+}
+
+type memoryItem struct {
+	key      string
+	entry    *Entry
+	deadline time.Time
+	size     int64
+}
+
+func NewMemory(maxSize int64) *Memory {
+	return &Memory{maxSize: maxSize, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*memoryItem)
+	if time.Now().After(item.deadline) {
+		m.removeLocked(el)
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return item.entry, true
+}
+
+func (m *Memory) Set(ctx context.Context, key string, entry *Entry, ttl time.Duration) {
+	item := &memoryItem{key: key, entry: entry, deadline: time.Now().Add(ttl), size: entry.size() + int64(len(key))}
+	if item.size > m.maxSize {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		m.removeLocked(el)
+	}
+	m.items[key] = m.order.PushFront(item)
+	m.size += item.size
+	for m.size > m.maxSize {
+		m.removeLocked(m.order.Back())
+	}
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		m.removeLocked(el)
+	}
+}
+
+func (m *Memory) removeLocked(el *list.Element) {
+	item := m.order.Remove(el).(*memoryItem)
+	delete(m.items, item.key)
+	m.size -= item.size
+}
+
+// Redis is a Store shared by every server using the same Redis, so a
+// response cached by one node serves the others
+type Redis struct {
+	client *redis.Client
+	prefix string
+	// onError reports failures, which otherwise read as misses
+	onError func(error)
+}
+
+func NewRedis(client *redis.Client, prefix string, onError func(error)) *Redis {
+	return &Redis{client: client, prefix: prefix, onError: onError}
+}
+
+func (s *Redis) Get(ctx context.Context, key string) (*Entry, bool) {
+	reply, err := s.client.Do(ctx, "GET", s.prefix+key)
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			s.onError(err)
+		}
+		return nil, false
+	}
+	data, _ := reply.(string)
+	var entry Entry
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		s.onError(err)
+		return nil, false
+	}
+	return &entry, true
+}
+
+func (s *Redis) Set(ctx context.Context, key string, entry *Entry, ttl time.Duration) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		s.onError(err)
+		return
+	}
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	if _, err := s.client.Do(ctx, "SET", s.prefix+key, string(data), "PX", strconv.FormatInt(ms, 10)); err != nil {
+		s.onError(err)
+	}
+}
+
+func (s *Redis) Delete(ctx context.Context, key string) {
+	if _, err := s.client.Do(ctx, "DEL", s.prefix+key); err != nil {
+		s.onError(err)
+	}
+}
@@ -0,0 +1,295 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var hostnamePattern = regexp.MustCompile(`^(\*\.)?[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// ErrOwned is returned for changes to a hostname another client owns
+var ErrOwned = errors.New("hostname belongs to another client")
+
+// Owner is the client a hostname's certificate belongs to
+type Owner struct {
+	Tenant   string `json:"tenant,omitempty"`
+	ClientID string `json:"client_id"`
+}
+
+// Store holds per-hostname TLS certificates, persisted as PEM files in a
+// directory next to a <hostname>.owner file naming the owning client
+type Store struct {
+	dir         string
+	certs       map[string]*tls.Certificate
+	owners      map[string]Owner
+	defaultCert *tls.Certificate
+	mu          sync.RWMutex
+	writeMu     sync.Mutex // Serializes Put and Remove between checking and storing
+}
+
+// NewStore creates a certificate store backed by dir and loads any certificates already in it
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %v", err)
+	}
+
+	s := &Store{
+		dir:    dir,
+		certs:  make(map[string]*tls.Certificate),
+		owners: make(map[string]Owner),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %v", err)
+	}
+	for _, certFile := range files {
+		hostname := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		cert, err := tls.LoadX509KeyPair(certFile, strings.TrimSuffix(certFile, ".crt")+".key")
+		if err != nil {
+			log.Printf("[CERTS] Skipping certificate for %s: %v", hostname, err)
+			continue
+		}
+		s.certs[hostname] = &cert
+
+		// Certificates stored before owners were recorded stay unowned until
+		// the next upload claims them
+		data, err := os.ReadFile(filepath.Join(dir, hostname+".owner"))
+		if err != nil {
+			continue
+		}
+		var owner Owner
+		if err := json.Unmarshal(data, &owner); err != nil {
+			log.Printf("[CERTS] Ignoring invalid owner of %s: %v", hostname, err)
+			continue
+		}
+		s.owners[hostname] = owner
+	}
+
+	log.Printf("[CERTS] Loaded %d certificates from %s", len(s.certs), dir)
+	return s, nil
+}
+
+// SetDefault loads the certificate served when no per-hostname certificate matches
+func (s *Store) SetDefault(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load default certificate: %v", err)
+	}
+
+	s.mu.Lock()
+	s.defaultCert = &cert
+	s.mu.Unlock()
+	return nil
+}
+
+// SetDefaultPEM sets the certificate served when no per-hostname certificate
+// matches from PEM data
+func (s *Store) SetDefaultPEM(certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to load default certificate: %v", err)
+	}
+
+	s.mu.Lock()
+	s.defaultCert = &cert
+	s.mu.Unlock()
+	return nil
+}
+
+// Put validates and stores a PEM certificate and key for hostname on behalf
+// of owner, replacing any existing certificate owner already has there
+func (s *Store) Put(hostname string, owner Owner, certPEM, keyPEM []byte) (*x509.Certificate, error) {
+	hostname, err := normalizeHostname(hostname)
+	if err != nil {
+		return nil, err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.checkOwner(hostname, owner); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate or key: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	// A wildcard entry must be backed by a certificate valid for any name below it
+	checkName := hostname
+	if strings.HasPrefix(hostname, "*.") {
+		checkName = "wildcard" + hostname[1:]
+	}
+	if err := leaf.VerifyHostname(checkName); err != nil {
+		return nil, fmt.Errorf("certificate does not cover %s: %v", hostname, err)
+	}
+	cert.Leaf = leaf
+
+	ownerJSON, err := json.Marshal(owner)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writeFile(hostname+".owner", ownerJSON); err != nil {
+		return nil, err
+	}
+	if err := s.writeFile(hostname+".key", keyPEM); err != nil {
+		return nil, err
+	}
+	if err := s.writeFile(hostname+".crt", certPEM); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.certs[hostname] = &cert
+	s.owners[hostname] = owner
+	s.mu.Unlock()
+
+	log.Printf("[CERTS] Stored certificate for %s (expires %s)", hostname, leaf.NotAfter.Format(time.RFC3339))
+	return leaf, nil
+}
+
+// Generate creates and stores a self-signed certificate for hostname on
+// behalf of owner
+func (s *Store) Generate(hostname string, owner Owner) (*x509.Certificate, error) {
+	hostname, err := normalizeHostname(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return s.Put(hostname, owner, certPEM, keyPEM)
+}
+
+// Remove deletes owner's certificate for hostname, releasing the hostname
+func (s *Store) Remove(hostname string, owner Owner) error {
+	hostname, err := normalizeHostname(hostname)
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.checkOwner(hostname, owner); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.certs, hostname)
+	delete(s.owners, hostname)
+	s.mu.Unlock()
+
+	for _, ext := range []string{".crt", ".key", ".owner"} {
+		if err := os.Remove(filepath.Join(s.dir, hostname+ext)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove certificate file: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkOwner fails with ErrOwned unless hostname is unowned or owner's
+func (s *Store) checkOwner(hostname string, owner Owner) error {
+	s.mu.RLock()
+	current, ok := s.owners[hostname]
+	s.mu.RUnlock()
+	if ok && current != owner {
+		return fmt.Errorf("%s: %w", hostname, ErrOwned)
+	}
+	return nil
+}
+
+// GetCertificate picks the certificate for the SNI hostname, for use in tls.Config
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.certs[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.certs["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if s.defaultCert != nil {
+		return s.defaultCert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// writeFile atomically replaces a file in the store directory
+func (s *Store) writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(s.dir, name+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", name, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return fmt.Errorf("failed to store %s: %v", name, err)
+	}
+	return nil
+}
+
+func normalizeHostname(hostname string) (string, error) {
+	hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+	if !hostnamePattern.MatchString(hostname) {
+		return "", fmt.Errorf("invalid hostname: %q", hostname)
+	}
+	return hostname, nil
+}
@@ -0,0 +1,145 @@
+// Package chaos injects faults into tunnels at configured rates, to exercise
+// client reconnects and failover under adverse conditions. A nil Injector
+// injects nothing, so callers hold one only while fault injection is on.
+package chaos
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Faults an Injector can inject
+const (
+	FaultDrop             = "drop"
+	FaultDelay            = "delay"
+	FaultReset            = "reset"
+	FaultCorruptHeartbeat = "corrupt_heartbeat"
+)
+
+// Faults lists the fault names in a stable order
+var Faults = []string{FaultDrop, FaultDelay, FaultReset, FaultCorruptHeartbeat}
+
+// Config holds the chance of each fault, from 0 for never to 1 for always
+type Config struct {
+	DropRate             float64       // Per tunnel frame
+	DelayRate            float64       // Per response frame
+	MaxDelay             time.Duration // Delays are uniform up to this long
+	ResetRate            float64       // Per message read from a tunnel
+	CorruptHeartbeatRate float64       // Per heartbeat acknowledgment
+	Seed                 int64         // Seeds the random source, 0 for the time
+}
+
+// Injector decides which events get a fault
+type Injector struct {
+	config Config
+
+	mu     sync.Mutex
+	random *rand.Rand
+
+	injected map[string]*atomic.Uint64
+}
+
+// New returns an Injector for config
+func New(config Config) (*Injector, error) {
+	rates := []struct {
+		name string
+		rate float64
+	}{
+		{"drop_rate", config.DropRate},
+		{"delay_rate", config.DelayRate},
+		{"reset_rate", config.ResetRate},
+		{"corrupt_heartbeat_rate", config.CorruptHeartbeatRate},
+	}
+	for _, r := range rates {
+		if r.rate < 0 || r.rate > 1 {
+			return nil, fmt.Errorf("%s must be between 0 and 1, got %v", r.name, r.rate)
+		}
+	}
+	if config.MaxDelay < 0 {
+		return nil, fmt.Errorf("max delay must not be negative")
+	}
+	if config.DelayRate > 0 && config.MaxDelay == 0 {
+		return nil, fmt.Errorf("delay_rate needs a max delay")
+	}
+
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	injected := make(map[string]*atomic.Uint64, len(Faults))
+	for _, fault := range Faults {
+		injected[fault] = new(atomic.Uint64)
+	}
+	return &Injector{config: config, random: rand.New(rand.NewSource(seed)), injected: injected}, nil
+}
+
+// roll reports whether an event with the given chance happens, counting it
+// as an injected fault. Callers check for a nil Injector.
+func (i *Injector) roll(fault string, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	i.mu.Lock()
+	hit := i.random.Float64() < rate
+	i.mu.Unlock()
+	if hit {
+		i.injected[fault].Add(1)
+	}
+	return hit
+}
+
+// Drop reports whether to drop a tunnel frame
+func (i *Injector) Drop() bool {
+	return i != nil && i.roll(FaultDrop, i.config.DropRate)
+}
+
+// Delay returns how long to hold a response frame back, 0 for not at all
+func (i *Injector) Delay() time.Duration {
+	if i == nil || !i.roll(FaultDelay, i.config.DelayRate) {
+		return 0
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return time.Duration(i.random.Int63n(int64(i.config.MaxDelay)) + 1)
+}
+
+// Reset reports whether to reset the tunnel connection
+func (i *Injector) Reset() bool {
+	return i != nil && i.roll(FaultReset, i.config.ResetRate)
+}
+
+// CorruptHeartbeat reports whether to corrupt a heartbeat acknowledgment
+func (i *Injector) CorruptHeartbeat() bool {
+	return i != nil && i.roll(FaultCorruptHeartbeat, i.config.CorruptHeartbeatRate)
+}
+
+// Corrupt garbles about half the bytes of line, replacing them with random
+// printable characters so it still reads as one message
+func (i *Injector) Corrupt(line string) string {
+	if i == nil {
+		return line
+	}
+	corrupted := []byte(line)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for n := range corrupted {
+		if i.random.Intn(2) == 0 {
+			corrupted[n] = '!' + byte(i.random.Intn('~'-'!'+1))
+		}
+	}
+	return string(corrupted)
+}
+
+// Injected returns how many of each fault were injected so far
+func (i *Injector) Injected() map[string]uint64 {
+	counts := make(map[string]uint64, len(Faults))
+	for _, fault := range Faults {
+		if i != nil {
+			counts[fault] = i.injected[fault].Load()
+		}
+	}
+	return counts
+}
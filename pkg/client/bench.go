@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// answerBench answers a benchmark request from the server with as many bytes
+// as it asks for, without involving the handler or upstream
+func (t *Tunnel) answerBench(tcpReq *types.Request) {
+	resp := &types.Response{
+		RequestID:  tcpReq.ID,
+		StatusCode: http.StatusOK,
+		Timestamp:  time.Now().Unix(),
+	}
+	size, err := strconv.Atoi(tcpReq.QueryParams[protocol.BenchSizeParam])
+	if err != nil || size < 0 || size > protocol.MaxBenchPayload {
+		resp.StatusCode = http.StatusBadRequest
+		resp.Error = fmt.Sprintf("invalid benchmark size %q", tcpReq.QueryParams[protocol.BenchSizeParam])
+	} else if size > 0 {
+		resp.Body = make([]byte, size)
+	}
+	if _, err := t.transport.WriteResponse(t.conn(), resp); err != nil {
+		log.Printf("Failed to send response for benchmark request %s: %v", tcpReq.ID, err)
+	}
+}
+
+// BenchOptions configures a tunnel benchmark, zero values taking the
+// server's defaults
+type BenchOptions struct {
+	PayloadBytes int           // Of each request or response body
+	Duration     time.Duration // Of each throughput phase
+	Probes       int           // Round trips timed
+}
+
+// BenchRTT summarizes the round trips of empty benchmark requests
+type BenchRTT struct {
+	Probes int     `json:"probes"`
+	MinMs  float64 `json:"min_ms"`
+	AvgMs  float64 `json:"avg_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+// BenchThroughput summarizes the payloads moved one way during a benchmark
+type BenchThroughput struct {
+	Requests      int     `json:"requests"`
+	Bytes         int64   `json:"bytes"`
+	Seconds       float64 `json:"seconds"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+}
+
+// BenchResult is what the server measured over a tunnel
+type BenchResult struct {
+	ClientID     string          `json:"client_id"`
+	PayloadBytes int             `json:"payload_bytes"`
+	Duration     string          `json:"duration"`
+	RTT          BenchRTT        `json:"rtt"`
+	Download     BenchThroughput `json:"download"` // Client to server
+	Upload       BenchThroughput `json:"upload"`   // Server to client
+}
+
+// Bench has the server measure the round trip time and throughput of the
+// HTTP tunnel of clientID, with requests the tunnel's client answers itself
+func (c *Client) Bench(ctx context.Context, clientID string, opts BenchOptions) (*BenchResult, error) {
+	body := map[string]any{}
+	if opts.PayloadBytes > 0 {
+		body["payload_bytes"] = opts.PayloadBytes
+	}
+	if opts.Duration > 0 {
+		body["duration"] = opts.Duration.String()
+	}
+	if opts.Probes > 0 {
+		body["probes"] = opts.Probes
+	}
+	data, err := c.control(ctx, "bench", clientID, body)
+	if err != nil {
+		return nil, err
+	}
+	var result BenchResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode bench response: %v", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,290 @@
+// Package client opens tunnels to an attachcloudip server from Go programs.
+// Connect to a server, then register paths, each served by an http.Handler
+// or forwarded to an upstream URL:
+//
+//	c, err := client.Connect(ctx, "tunnel.example.com:9999", client.WithAPIKey(key))
+//	tunnel, err := c.RegisterPath(ctx, "/docs", docsHandler, client.TunnelOptions{})
+//	defer c.Close()
+//
+// cmd/client is built on this package.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/sockopt"
+	"github.com/vikasavn/attachcloudip/pkg/sshkey"
+)
+
+// Client registers tunnels with one server, or with the first healthy one of
+// several to fail over between
+type Client struct {
+	servers       []string // In order of preference
+	apiKey        string
+	tlsConfig     *tls.Config
+	bootstrap     bool
+	probeInterval time.Duration
+	sockets       sockopt.Options // Applied to tunnel connections
+	sshKey        crypto.Signer   // Signs registrations, nil unless configured
+	// api is used for HTTP calls to the server and carries the client
+	// certificate when one is configured
+	api *http.Client
+	// dial opens connections to servers, nil for TCP
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// proxy is the proxy set with WithProxy, nil for none; without
+	// proxySet the environment names it
+	proxy    *url.URL
+	proxySet bool
+
+	mu      sync.Mutex
+	tunnels map[*Tunnel]struct{}
+	closed  bool
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithAPIKey identifies the client's tenant on multi-tenant servers
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithTLSConfig presents the config's client certificate to the server's API
+// and tunnel port, see LoadCertificate
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) { c.tlsConfig = config }
+}
+
+// WithBootstrap registers tunnels on the tunnel connection itself instead of
+// the HTTP API, with the server address being its registration port
+func WithBootstrap() Option {
+	return func(c *Client) { c.bootstrap = true }
+}
+
+// WithProbeInterval sets how often tunnels probe the servers preferred over
+// the one they are on, to move back once one is healthy. Defaults to 10s.
+func WithProbeInterval(interval time.Duration) Option {
+	return func(c *Client) { c.probeInterval = interval }
+}
+
+// WithSocketOptions tunes the TCP sockets of tunnel connections
+func WithSocketOptions(opts sockopt.Options) Option {
+	return func(c *Client) { c.sockets = opts }
+}
+
+// WithSSHKey signs registrations with an SSH private key the server lists for
+// the client ID, see sshkey.LoadPrivateKey
+func WithSSHKey(key crypto.Signer) Option {
+	return func(c *Client) { c.sshKey = key }
+}
+
+// WithDialer opens the client's connections to servers with dial instead of
+// TCP, e.g. over an in-memory network in tests. Socket options don't apply.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(c *Client) { c.dial = dial }
+}
+
+// New creates a Client for server, or for comma-separated servers in order
+// of preference, without contacting them
+func New(server string, opts ...Option) (*Client, error) {
+	c := &Client{
+		servers:       parseServers(server),
+		probeInterval: 10 * time.Second,
+		api:           http.DefaultClient,
+		tunnels:       make(map[*Tunnel]struct{}),
+	}
+	if len(c.servers) == 0 {
+		return nil, fmt.Errorf("server address is required")
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	switch {
+	case c.dial != nil:
+		c.api = &http.Client{Transport: &http.Transport{DialContext: c.dial, TLSClientConfig: c.tlsConfig}}
+	case c.proxySet:
+		c.api = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(c.proxy), TLSClientConfig: c.tlsConfig}}
+	case c.tlsConfig != nil:
+		c.api = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: c.tlsConfig}}
+	}
+	return c, nil
+}
+
+// dialServer connects to a server's registration port, through a proxy if
+// one applies
+func (c *Client) dialServer(ctx context.Context, addr string) (net.Conn, error) {
+	if c.dial != nil {
+		return c.dial(ctx, "tcp", addr)
+	}
+	proxyURL, err := c.proxyFor(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %v", err)
+	}
+	if proxyURL != nil {
+		return c.dialProxy(ctx, proxyURL, addr)
+	}
+	return c.sockets.DialContext(ctx, "tcp", addr)
+}
+
+// Connect creates a Client and checks that one of its servers is ready to
+// register tunnels
+func Connect(ctx context.Context, server string, opts ...Option) (*Client, error) {
+	c, err := New(server, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, server := range c.servers {
+		if lastErr = c.probe(ctx, server); lastErr == nil {
+			return c, nil
+		}
+	}
+	if len(c.servers) == 1 {
+		return nil, fmt.Errorf("server %s is not ready: %v", c.servers[0], lastErr)
+	}
+	return nil, fmt.Errorf("none of the %d servers is ready", len(c.servers))
+}
+
+// Close closes the client's tunnels
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	tunnels := make([]*Tunnel, 0, len(c.tunnels))
+	for t := range c.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	c.mu.Unlock()
+
+	for _, t := range tunnels {
+		t.Close()
+	}
+	return nil
+}
+
+// track adds a tunnel for Close, failing once the client is closed
+func (c *Client) track(t *Tunnel) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return fmt.Errorf("client is closed")
+	}
+	c.tunnels[t] = struct{}{}
+	return nil
+}
+
+func (c *Client) untrack(t *Tunnel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tunnels, t)
+}
+
+// post sends a JSON payload to a server API endpoint
+func (c *Client) post(ctx context.Context, server, endpoint string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, serverURL(server)+endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	return c.api.Do(req)
+}
+
+// sshChallenge fetches a registration challenge for clientID and signs it
+// with the client's SSH key, returning the nonce and base64 signature
+func (c *Client) sshChallenge(ctx context.Context, server, clientID string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		serverURL(server)+"/register/challenge?client_id="+url.QueryEscape(clientID), nil)
+	if err != nil {
+		return "", "", err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.api.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to request SSH challenge: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return "", "", fmt.Errorf("SSH challenge failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var challenge struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+		return "", "", fmt.Errorf("failed to decode SSH challenge: %v", err)
+	}
+	// Must match the server's sshRegistrationMessage
+	message := []byte("attachcloudip-register\n" + clientID + "\n" + challenge.Nonce)
+	signature, err := sshkey.Sign(c.sshKey, message)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to sign SSH challenge: %v", err)
+	}
+	return challenge.Nonce, base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// serverURL turns a server address into a base URL, defaulting to plain HTTP
+func serverURL(server string) string {
+	if strings.Contains(server, "://") {
+		return strings.TrimRight(server, "/")
+	}
+	return "http://" + server
+}
+
+func parseServers(value string) []string {
+	var servers []string
+	for _, server := range strings.Split(value, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// LoadCertificate builds the TLS config used to present a client certificate
+// and returns the client ID (certificate common name) it proves. caFile, if
+// set, verifies the server's certificate.
+func LoadCertificate(certFile, keyFile, caFile string) (*tls.Config, string, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse client certificate: %v", err)
+	}
+	if leaf.Subject.CommonName == "" {
+		return nil, "", fmt.Errorf("client certificate has no common name")
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read server CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, "", fmt.Errorf("no certificates found in server CA file: %s", caFile)
+		}
+	}
+	return config, leaf.Subject.CommonName, nil
+}
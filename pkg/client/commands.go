@@ -0,0 +1,155 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+)
+
+// drainPoll is how often a drain checks for requests still in flight
+const drainPoll = 100 * time.Millisecond
+
+// tunnelHealth is what the tunnel tells the server about its health: failing
+// while the upstream's health check fails or the tunnel is drained, so the
+// server routes to the path's other clients
+type tunnelHealth struct {
+	mu       sync.Mutex
+	upstream bool // The latest health check passed, or there is none
+	draining bool
+	reported bool // What the server was told last, healthy on connecting
+}
+
+func newTunnelHealth() *tunnelHealth {
+	return &tunnelHealth{upstream: true, reported: true}
+}
+
+// reportHealth tells the server the tunnel's health if it changed, after
+// applying change to the health under its lock
+func (t *Tunnel) reportHealth(change func(h *tunnelHealth)) {
+	h := t.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	change(h)
+	healthy := h.upstream && !h.draining
+	if healthy == h.reported {
+		return
+	}
+	status := "ok"
+	if !healthy {
+		status = "fail"
+	}
+	log.Printf("Reporting health: %s", status)
+	if err := t.sendMessage("health|" + status); err != nil {
+		// Retried on the next change or reconnect
+		log.Printf("Failed to send health status: %v", err)
+		return
+	}
+	h.reported = healthy
+}
+
+// handleCommand runs a command the server sent (format: "command|<json>")
+// and reports its result. Commands run apart from the message loop, since
+// some wait for the server's answers.
+func (t *Tunnel) handleCommand(data string) {
+	var command protocol.Command
+	if err := json.Unmarshal([]byte(data), &command); err != nil {
+		log.Printf("Invalid command from server: %v", err)
+		return
+	}
+	go func() {
+		log.Printf("Running command %s from server", strings.TrimSpace(command.Name+" "+command.Args))
+		output, err := t.runCommand(command)
+		result := protocol.CommandResult{ID: command.ID, OK: err == nil, Output: output}
+		if err != nil {
+			log.Printf("Command %s failed: %v", command.Name, err)
+			result.Output = err.Error()
+		}
+		data, _ := json.Marshal(result)
+		if err := t.sendMessage("command-result|" + string(data)); err != nil {
+			log.Printf("Failed to report result of command %s: %v", command.Name, err)
+		}
+		if err == nil && command.Name == protocol.CommandReconnect {
+			// After the result, which wouldn't make it otherwise
+			t.conn().Close()
+		}
+	}()
+}
+
+func (t *Tunnel) runCommand(command protocol.Command) (string, error) {
+	if err := command.Validate(); err != nil {
+		return "", err
+	}
+	switch command.Name {
+	case protocol.CommandReconnect:
+		return "reconnecting", nil
+	case protocol.CommandDrain:
+		timeout, _ := command.DrainTimeout()
+		return t.drain(timeout)
+	case protocol.CommandUndrain:
+		t.reportHealth(func(h *tunnelHealth) { h.draining = false })
+		return "taking requests", nil
+	case protocol.CommandRefreshPaths:
+		// Releasing and claiming every path at once rebuilds the server's
+		// routes for the tunnel
+		current := t.Paths()
+		paths, err := t.UpdatePaths(current, current)
+		if err != nil {
+			return "", err
+		}
+		return "paths are " + strings.Join(paths, ", "), nil
+	case protocol.CommandDebug:
+		if command.Args == "on" {
+			logging.SetLevel(logging.LevelDebug)
+		} else {
+			logging.SetLevel(logging.LevelInfo)
+		}
+		return "debug logging " + command.Args, nil
+	}
+	return "", fmt.Errorf("unknown command %q", command.Name)
+}
+
+// handleBroadcast logs a message the server broadcast and passes it to
+// OnBroadcast
+func (t *Tunnel) handleBroadcast(data string) {
+	var broadcast Broadcast
+	if err := json.Unmarshal([]byte(data), &broadcast); err != nil {
+		log.Printf("Invalid broadcast from server: %v", err)
+		return
+	}
+	if broadcast.Topic != "" {
+		log.Printf("Message from server [%s]: %s", broadcast.Topic, broadcast.Message)
+	} else {
+		log.Printf("Message from server: %s", broadcast.Message)
+	}
+	if t.opts.OnBroadcast != nil {
+		t.opts.OnBroadcast(broadcast)
+	}
+}
+
+// drain stops the server from routing new requests to the tunnel and waits
+// up to timeout for those in flight to finish. The tunnel stays drained
+// until undrained.
+func (t *Tunnel) drain(timeout time.Duration) (string, error) {
+	t.reportHealth(func(h *tunnelHealth) { h.draining = true })
+	deadline := time.Now().Add(timeout)
+	for {
+		inFlight := t.inFlight.Load()
+		if inFlight == 0 {
+			return "drained", nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("%d requests still in flight after %v", inFlight, timeout)
+		}
+		select {
+		case <-time.After(drainPoll):
+		case <-t.ctx.Done():
+			return "", fmt.Errorf("tunnel closed while draining")
+		}
+	}
+}
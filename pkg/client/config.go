@@ -0,0 +1,160 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+)
+
+// tunnelSettings are the tunnel's settings the server can change while it
+// runs by pushing a protocol.ClientConfig
+type tunnelSettings struct {
+	heartbeat      atomic.Int64  // Interval in nanoseconds
+	heartbeatReset chan struct{} // Restarts the heartbeat ticker at the new interval
+	requestTimeout atomic.Int64  // Nanoseconds, 0 until the server gives up
+
+	mu          sync.Mutex
+	readBuffer  int // Socket buffers of each connection, 0 for the OS default
+	writeBuffer int
+	bandwidth   int64 // Bytes per second each way, 0 for no cap
+}
+
+func newTunnelSettings(opts TunnelOptions) *tunnelSettings {
+	s := &tunnelSettings{heartbeatReset: make(chan struct{}, 1)}
+	s.heartbeat.Store(int64(opts.HeartbeatInterval))
+	s.requestTimeout.Store(int64(opts.RequestTimeout))
+	return s
+}
+
+func (s *tunnelSettings) heartbeatInterval() time.Duration {
+	return time.Duration(s.heartbeat.Load())
+}
+
+func (s *tunnelSettings) timeout() time.Duration {
+	return time.Duration(s.requestTimeout.Load())
+}
+
+// socketBuffer is the part of *net.TCPConn that sizes socket buffers
+type socketBuffer interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// applySocket sizes the socket buffers of a freshly dialed connection
+func (s *tunnelSettings) applySocket(conn net.Conn) error {
+	s.mu.Lock()
+	read, write := s.readBuffer, s.writeBuffer
+	s.mu.Unlock()
+	return setBuffers(conn, read, write)
+}
+
+func setBuffers(conn net.Conn, read, write int) error {
+	if read == 0 && write == 0 {
+		return nil
+	}
+	socket, ok := conn.(socketBuffer)
+	if !ok {
+		return fmt.Errorf("the tunnel connection has no socket buffers to size")
+	}
+	if read > 0 {
+		if err := socket.SetReadBuffer(read); err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		if err := socket.SetWriteBuffer(write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttle wraps a connection in the tunnel's bandwidth cap
+func (s *tunnelSettings) throttle(conn net.Conn) *traffic.ThrottledConn {
+	throttled := traffic.NewThrottledConn(conn)
+	s.mu.Lock()
+	throttled.SetRate(s.bandwidth)
+	s.mu.Unlock()
+	return throttled
+}
+
+// handleConfig applies a configuration update the server pushed (format:
+// "config|<json>") and acknowledges it. A re-registration closes the
+// connection afterwards so the tunnel reconnects with a new session.
+func (t *Tunnel) handleConfig(data string) {
+	var update protocol.ClientConfig
+	if err := json.Unmarshal([]byte(data), &update); err != nil {
+		log.Printf("Invalid config update from server: %v", err)
+		return
+	}
+	if err := t.applyConfig(update); err != nil {
+		log.Printf("Failed to apply config revision %d: %v", update.Revision, err)
+		reason := strings.ReplaceAll(err.Error(), "\n", " ")
+		if err := t.sendMessage(fmt.Sprintf("config-error|%d|%s", update.Revision, reason)); err != nil {
+			log.Printf("Failed to reject config update: %v", err)
+		}
+		return
+	}
+	log.Printf("Applied config revision %d from server", update.Revision)
+	if err := t.sendMessage(fmt.Sprintf("config-ack|%d", update.Revision)); err != nil {
+		log.Printf("Failed to acknowledge config update: %v", err)
+	}
+	if update.Reregister {
+		log.Printf("Server asked the tunnel to re-register")
+		// receiveMessages runs on the same goroutine as connect, so the
+		// token can be cleared without a lock
+		t.sessionToken = ""
+		t.conn().Close()
+	}
+}
+
+// applyConfig changes the settings an update sets, rejecting it as a whole
+// if any is invalid
+func (t *Tunnel) applyConfig(update protocol.ClientConfig) error {
+	if err := update.Validate(); err != nil {
+		return err
+	}
+	s := t.settings
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t.connMu.Lock()
+	socket, throttle := t.socket, t.throttle
+	t.connMu.Unlock()
+	if update.ReadBuffer != nil || update.WriteBuffer != nil {
+		read, write := s.readBuffer, s.writeBuffer
+		if update.ReadBuffer != nil {
+			read = *update.ReadBuffer
+		}
+		if update.WriteBuffer != nil {
+			write = *update.WriteBuffer
+		}
+		if err := setBuffers(socket, read, write); err != nil {
+			return fmt.Errorf("failed to size socket buffers: %v", err)
+		}
+		s.readBuffer, s.writeBuffer = read, write
+	}
+	if update.Bandwidth != nil {
+		s.bandwidth = *update.Bandwidth
+		throttle.SetRate(s.bandwidth)
+	}
+	if update.RequestTimeoutMs != nil {
+		s.requestTimeout.Store(int64(time.Duration(*update.RequestTimeoutMs) * time.Millisecond))
+	}
+	if update.HeartbeatIntervalMs != nil {
+		s.heartbeat.Store(int64(time.Duration(*update.HeartbeatIntervalMs) * time.Millisecond))
+		select {
+		case s.heartbeatReset <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
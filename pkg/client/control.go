@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Pause makes the server answer the tunnel's requests with a maintenance
+// page, showing message if set
+func (c *Client) Pause(ctx context.Context, clientID, message string) error {
+	var body any
+	if message != "" {
+		body = map[string]string{"message": message}
+	}
+	_, err := c.control(ctx, "pause", clientID, body)
+	return err
+}
+
+// Resume routes requests to a paused tunnel again
+func (c *Client) Resume(ctx context.Context, clientID string) error {
+	_, err := c.control(ctx, "resume", clientID, nil)
+	return err
+}
+
+// Renew extends a tunnel's registration by ttl, or by its registered TTL if
+// zero, and returns when it now expires
+func (c *Client) Renew(ctx context.Context, clientID string, ttl time.Duration) (time.Time, error) {
+	var body any
+	if ttl > 0 {
+		body = map[string]string{"ttl": ttl.String()}
+	}
+	data, err := c.control(ctx, "renew", clientID, body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var renewed struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(data, &renewed); err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode renew response: %v", err)
+	}
+	return renewed.ExpiresAt, nil
+}
+
+// control changes a tunnel's state on the client's first server, returning
+// the response body
+func (c *Client) control(ctx context.Context, command, clientID string, body any) ([]byte, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s request: %v", command, err)
+		}
+	}
+
+	resp, err := c.post(ctx, c.servers[0], fmt.Sprintf("/clients/%s?client_id=%s", command, url.QueryEscape(clientID)), payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
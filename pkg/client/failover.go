@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Failover settings
+const (
+	failoverAfter = 2 // Failed reconnects to the current server before trying the others
+	probeTimeout  = 2 * time.Second
+)
+
+// serverPool is the client's servers in order of preference. A tunnel
+// registers with the first healthy one and moves to the next when its
+// current server stops answering.
+type serverPool struct {
+	servers   []string
+	bootstrap bool // Servers are registration ports, probed by connecting
+	client    *Client
+
+	mu       sync.Mutex
+	current  int
+	failback atomic.Bool // A preferred server is healthy again
+}
+
+// probe checks a server's readiness, or for registration ports that it
+// accepts connections
+func (c *Client) probe(ctx context.Context, server string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	if c.bootstrap {
+		conn, err := c.dialServer(ctx, server)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL(server)+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.api.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("not ready (status %d)", resp.StatusCode)
+	}
+	return nil
+}
+
+// first registers the tunnel with the most preferred healthy server. A
+// single server is registered with directly, as before failover existed.
+func (p *serverPool) first(ctx context.Context, t *Tunnel) (string, error) {
+	if len(p.servers) == 1 {
+		return p.servers[0], t.registerWith(ctx, p.servers[0])
+	}
+	for i, server := range p.servers {
+		if err := p.client.probe(ctx, server); err != nil {
+			log.Printf("Server %s is unhealthy: %v", server, err)
+			continue
+		}
+		if err := t.registerWith(ctx, server); err != nil {
+			log.Printf("Failed to register with server %s: %v", server, err)
+			continue
+		}
+		p.setCurrent(i)
+		return server, nil
+	}
+	return "", fmt.Errorf("none of the %d servers is reachable", len(p.servers))
+}
+
+func (p *serverPool) setCurrent(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = i
+}
+
+func (p *serverPool) currentIndex() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current
+}
+
+// failover re-registers the tunnel with the most preferred healthy server
+// and connects to it. The tunnel's path claims start over there, since the
+// session belongs to the server it came from.
+func (t *Tunnel) failover(ctx context.Context) error {
+	pool := t.servers
+	for i, server := range pool.servers {
+		if err := pool.client.probe(ctx, server); err != nil {
+			log.Printf("Server %s is unhealthy: %v", server, err)
+			continue
+		}
+		if err := t.registerWith(ctx, server); err != nil {
+			log.Printf("Failed to register with server %s: %v", server, err)
+			continue
+		}
+		t.sessionToken = ""
+		if err := t.connect(ctx); err != nil {
+			log.Printf("Failed to connect to server %s: %v", server, err)
+			continue
+		}
+		pool.setCurrent(i)
+		t.status.setServer(server)
+		log.Printf("Failed over to server %s", server)
+		return nil
+	}
+	return fmt.Errorf("none of the %d servers is reachable", len(pool.servers))
+}
+
+// watchPreferred probes the servers preferred over the current one and
+// closes the tunnel connection once one is healthy, so the tunnel moves back
+// to it
+func (t *Tunnel) watchPreferred(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.ctx.Done():
+			return
+		}
+		pool := t.servers
+		for _, server := range pool.servers[:pool.currentIndex()] {
+			if pool.client.probe(t.ctx, server) != nil {
+				continue
+			}
+			log.Printf("Preferred server %s is healthy again, moving back to it", server)
+			pool.failback.Store(true)
+			if conn := t.conn(); conn != nil {
+				conn.Close()
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// serveHandler runs handler for req and returns its response once known.
+// Responses are buffered until the handler returns, so they are sent whole
+// with their length, unless the handler flushes or writes more than a
+// stream chunk, which streams the rest of the body as it is written.
+func serveHandler(handler http.Handler, req *http.Request) (*http.Response, error) {
+	req.RequestURI = req.URL.RequestURI()
+	if req.RemoteAddr == "" {
+		req.RemoteAddr = "tunnel"
+	}
+	w := &responseWriter{
+		req:      req,
+		header:   make(http.Header),
+		response: make(chan *http.Response, 1),
+	}
+	go w.serve(handler)
+
+	select {
+	case resp := <-w.response:
+		return resp, nil
+	case <-req.Context().Done():
+		// Unblock a handler still writing to the response
+		go func() { (<-w.response).Body.Close() }()
+		return nil, req.Context().Err()
+	}
+}
+
+// responseWriter hands the handler's response to serveHandler
+type responseWriter struct {
+	req      *http.Request
+	header   http.Header
+	status   int // 0 until the head is written
+	buf      bytes.Buffer
+	body     *io.PipeWriter // Streams the body once the response is handed over
+	response chan *http.Response
+}
+
+// serve runs the handler, sending back a 500 if it panics before the head
+// is handed over
+func (w *responseWriter) serve(handler http.Handler) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("Handler for %s %s panicked: %v", w.req.Method, w.req.URL.Path, v)
+			if w.body != nil {
+				w.body.CloseWithError(fmt.Errorf("handler panicked: %v", v))
+				return
+			}
+			w.header = make(http.Header)
+			w.status = http.StatusInternalServerError
+			w.buf.Reset()
+			w.buf.WriteString(http.StatusText(http.StatusInternalServerError) + "\n")
+		}
+		w.finish()
+	}()
+	handler.ServeHTTP(w, w.req)
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.body != nil {
+		return w.body.Write(p)
+	}
+	n, _ := w.buf.Write(p)
+	if w.buf.Len() > streamChunkSize {
+		w.stream()
+	}
+	return n, nil
+}
+
+// Flush hands the response over, streaming what the handler writes next
+func (w *responseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+	if w.body == nil {
+		w.stream()
+	}
+}
+
+// stream hands over the response with a body read as the handler writes it
+func (w *responseWriter) stream() {
+	reader, writer := io.Pipe()
+	resp := w.head()
+	resp.ContentLength = -1
+	if length, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = length
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(bytes.Clone(w.buf.Bytes())), reader), reader}
+	w.buf.Reset()
+	w.body = writer
+	w.response <- resp
+}
+
+// finish hands over the whole response once the handler returns, or ends a
+// streamed body
+func (w *responseWriter) finish() {
+	if w.body != nil {
+		w.body.Close()
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	resp := w.head()
+	resp.ContentLength = int64(w.buf.Len())
+	resp.Body = io.NopCloser(&w.buf)
+	w.response <- resp
+}
+
+func (w *responseWriter) head() *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode: w.status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     w.header.Clone(),
+		Request:    w.req,
+	}
+}
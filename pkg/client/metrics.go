@@ -0,0 +1,50 @@
+package client
+
+import (
+	"net/url"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// clientMetrics collects the resource metrics piggybacked on heartbeats
+type clientMetrics struct {
+	streams       atomic.Int64
+	upstreamTotal time.Duration
+	upstreamCount int
+	mu            sync.Mutex
+}
+
+// observeUpstream records the response time of a request to the local service
+func (m *clientMetrics) observeUpstream(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstreamTotal += d
+	m.upstreamCount++
+}
+
+// encode returns the current metrics in heartbeat form and starts a new
+// upstream response time window
+func (m *clientMetrics) encode() string {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	values := url.Values{}
+	values.Set(types.MetricGoroutines, strconv.Itoa(runtime.NumGoroutine()))
+	values.Set(types.MetricHeapBytes, strconv.FormatUint(mem.HeapAlloc, 10))
+	values.Set(types.MetricOpenStreams, strconv.FormatInt(m.streams.Load(), 10))
+
+	m.mu.Lock()
+	if m.upstreamCount > 0 {
+		mean := m.upstreamTotal / time.Duration(m.upstreamCount)
+		values.Set(types.MetricUpstreamResponseSeconds, strconv.FormatFloat(mean.Seconds(), 'f', -1, 64))
+	}
+	m.upstreamTotal, m.upstreamCount = 0, 0
+	m.mu.Unlock()
+
+	return values.Encode()
+}
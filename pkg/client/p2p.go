@@ -0,0 +1,371 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+)
+
+const (
+	// p2pMeetTimeout bounds how long the ends of a peer-to-peer session
+	// wait for each other at the rendezvous port
+	p2pMeetTimeout = 10 * time.Second
+	// p2pRetryInterval is how often rendezvous and punch datagrams are sent
+	p2pRetryInterval = 250 * time.Millisecond
+	// p2pConnectTimeout bounds the QUIC handshake through the punched hole
+	p2pConnectTimeout = 5 * time.Second
+)
+
+// p2pQUICConfig keeps the direct connection's NAT mappings open while idle
+var p2pQUICConfig = &quic.Config{
+	KeepAlivePeriod: 15 * time.Second,
+	MaxIdleTimeout:  time.Minute,
+}
+
+// rendezvous sends the role of this end to the server's rendezvous port from
+// conn until the server answers with the other end's address and the
+// fingerprint of the client's certificate
+func rendezvous(ctx context.Context, conn *net.UDPConn, server *net.UDPAddr, session, role, fingerprint string) (*net.UDPAddr, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, p2pMeetTimeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	defer conn.SetReadDeadline(time.Time{})
+
+	message := []byte(fmt.Sprintf("p2p|%s|%s|%s", session, role, fingerprint))
+	buf := make([]byte, 2048)
+	for {
+		if _, err := conn.WriteToUDP(message, server); err != nil {
+			return nil, "", fmt.Errorf("failed to reach rendezvous port: %v", err)
+		}
+		retry := time.Now().Add(p2pRetryInterval)
+		for time.Now().Before(retry) {
+			conn.SetReadDeadline(retry)
+			n, from, err := conn.ReadFromUDP(buf)
+			if ctx.Err() != nil {
+				return nil, "", fmt.Errorf("no peer met at the rendezvous port: %v", ctx.Err())
+			}
+			if err != nil {
+				continue
+			}
+			// Punch datagrams from the other end may arrive first
+			if !from.IP.Equal(server.IP) || from.Port != server.Port {
+				continue
+			}
+			fields := strings.Split(string(buf[:n]), "|")
+			if len(fields) < 2 || fields[1] != session {
+				continue
+			}
+			switch fields[0] {
+			case "p2p-peer":
+				if len(fields) != 4 {
+					return nil, "", fmt.Errorf("malformed rendezvous answer")
+				}
+				peer, err := net.ResolveUDPAddr("udp", fields[2])
+				if err != nil {
+					return nil, "", fmt.Errorf("invalid peer address %q: %v", fields[2], err)
+				}
+				return peer, fields[3], nil
+			case "p2p-error":
+				return nil, "", fmt.Errorf("rendezvous refused: %s", strings.Join(fields[2:], "|"))
+			}
+		}
+	}
+}
+
+// punch sends datagrams to the other end so this end's NAT lets its packets in
+func punch(conn *net.UDPConn, peer *net.UDPAddr) {
+	for i := 0; i < 3; i++ {
+		conn.WriteToUDP([]byte("punch"), peer)
+	}
+}
+
+// p2pStream is a QUIC stream of a direct connection as a net.Conn, closing
+// its send side to half-close
+type p2pStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (s *p2pStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *p2pStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *p2pStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+func (s *p2pStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// p2pCertificate generates the self-signed certificate a client presents on
+// direct connections, which visitors check by its fingerprint
+func p2pCertificate() (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, fingerprint(der), nil
+}
+
+// fingerprint returns the hex encoded SHA-256 fingerprint of a DER certificate
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// openP2P meets a visitor for a peer-to-peer session the server opened
+// (format: "<session>|<rendezvous port>") and serves its direct connection,
+// each stream of which is connected to the TCP upstream. The visitor relays
+// through the public port instead when no direct connection can be made.
+func (t *Tunnel) openP2P(data string) {
+	session, portValue, ok := strings.Cut(data, "|")
+	port, err := strconv.Atoi(portValue)
+	if !ok || err != nil {
+		log.Printf("Invalid peer-to-peer session from server: %s", data)
+		return
+	}
+	if err := t.serveP2P(session, port); err != nil {
+		log.Printf("Peer-to-peer session %s: %v", session, err)
+	}
+}
+
+func (t *Tunnel) serveP2P(session string, port int) error {
+	cert, certFingerprint, err := p2pCertificate()
+	if err != nil {
+		return err
+	}
+	server, err := net.ResolveUDPAddr("udp", net.JoinHostPort(t.serverHost, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("invalid rendezvous address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("failed to open UDP socket: %v", err)
+	}
+	defer conn.Close()
+	peer, _, err := rendezvous(t.ctx, conn, server, session, protocol.P2PClient, certFingerprint)
+	if err != nil {
+		return err
+	}
+	punch(conn, peer)
+
+	transport := &quic.Transport{Conn: conn}
+	defer transport.Close()
+	listener, err := transport.Listen(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{protocol.P2PALPN},
+	}, p2pQUICConfig)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the visitor: %v", err)
+	}
+	defer listener.Close()
+
+	// Only the visitor that met at the rendezvous port may connect
+	ctx, cancel := context.WithTimeout(t.ctx, p2pConnectTimeout)
+	defer cancel()
+	var visitor quic.Connection
+	for visitor == nil {
+		accepted, err := listener.Accept(ctx)
+		if err != nil {
+			return fmt.Errorf("visitor didn't connect directly: %v", err)
+		}
+		if remote := accepted.RemoteAddr().String(); remote != peer.String() {
+			logging.Debugf("Refusing direct connection from %s for peer-to-peer session %s", remote, session)
+			accepted.CloseWithError(0, "unexpected peer")
+			continue
+		}
+		visitor = accepted
+	}
+	log.Printf("Peer-to-peer session %s connected directly to %s", session, peer)
+
+	for {
+		stream, err := visitor.AcceptStream(t.ctx)
+		if err != nil {
+			logging.Debugf("Peer-to-peer session %s closed: %v", session, err)
+			return nil
+		}
+		go t.spliceP2P(session, &p2pStream{Stream: stream, conn: visitor})
+	}
+}
+
+// spliceP2P connects a stream of a direct connection to the TCP upstream
+func (t *Tunnel) spliceP2P(session string, stream *p2pStream) {
+	dialer := net.Dialer{Timeout: tcpDialTimeout}
+	local, err := dialer.DialContext(t.ctx, "tcp", t.opts.TCPUpstream)
+	if err != nil {
+		log.Printf("Failed to reach %s for peer-to-peer session %s: %v", t.opts.TCPUpstream, session, err)
+		stream.CancelWrite(0)
+		stream.Close()
+		return
+	}
+	t.status.countRequest()
+	sent, received := traffic.Splice(local, stream)
+	logging.Debugf("Peer-to-peer stream of session %s closed after %d bytes out and %d back", session, sent, received)
+}
+
+// Visitor connects to the raw TCP tunnel of another client, directly once
+// both ends found each other through the server, or relayed through the
+// tunnel's public port otherwise
+type Visitor struct {
+	relay     string // Public port of the tunnel
+	dial      func(ctx context.Context, addr string) (net.Conn, error)
+	transport *quic.Transport
+	conn      quic.Connection // Nil when relaying
+}
+
+// Visit opens a peer-to-peer session to the raw TCP tunnel of clientID. The
+// direct connection is skipped when a proxy applies, which can't carry UDP.
+func (c *Client) Visit(ctx context.Context, clientID string) (*Visitor, error) {
+	payload, err := json.Marshal(map[string]string{"client_id": clientID})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.post(ctx, c.servers[0], "/p2p", payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var session struct {
+		Session        string `json:"session"`
+		RendezvousPort int    `json:"rendezvous_port"`
+		TCPPort        int    `json:"tcp_port"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&session); err != nil {
+		return nil, fmt.Errorf("failed to decode peer-to-peer session: %v", err)
+	}
+
+	u, err := url.Parse(serverURL(c.servers[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server address: %v", err)
+	}
+	host := u.Hostname()
+	v := &Visitor{relay: net.JoinHostPort(host, strconv.Itoa(session.TCPPort)), dial: c.dialServer}
+
+	proxyURL, err := c.proxyFor(v.relay)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %v", err)
+	}
+	if proxyURL != nil || c.dial != nil {
+		log.Printf("Relaying to client %s through %s", clientID, v.relay)
+		return v, nil
+	}
+	if err := v.connect(ctx, net.JoinHostPort(host, strconv.Itoa(session.RendezvousPort)), session.Session); err != nil {
+		log.Printf("Relaying to client %s through %s: %v", clientID, v.relay, err)
+		return v, nil
+	}
+	log.Printf("Connected directly to client %s at %s", clientID, v.conn.RemoteAddr())
+	return v, nil
+}
+
+// connect meets the client at the rendezvous port and connects to it
+// directly, checking its certificate by the fingerprint the server relayed
+func (v *Visitor) connect(ctx context.Context, rendezvousAddr, session string) error {
+	server, err := net.ResolveUDPAddr("udp", rendezvousAddr)
+	if err != nil {
+		return fmt.Errorf("invalid rendezvous address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("failed to open UDP socket: %v", err)
+	}
+	peer, peerFingerprint, err := rendezvous(ctx, conn, server, session, protocol.P2PVisitor, "")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	punch(conn, peer)
+
+	transport := &quic.Transport{Conn: conn}
+	dialCtx, cancel := context.WithTimeout(ctx, p2pConnectTimeout)
+	defer cancel()
+	direct, err := transport.Dial(dialCtx, peer, &tls.Config{
+		NextProtos: []string{protocol.P2PALPN},
+		// The certificate is self-signed, its fingerprint is what counts
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || fingerprint(rawCerts[0]) != peerFingerprint {
+				return errors.New("certificate doesn't match the client's fingerprint")
+			}
+			return nil
+		},
+	}, p2pQUICConfig)
+	if err != nil {
+		transport.Close()
+		conn.Close()
+		return fmt.Errorf("direct connection to %s failed: %v", peer, err)
+	}
+	v.transport, v.conn = transport, direct
+	return nil
+}
+
+// Direct reports whether the visitor is connected straight to the client
+func (v *Visitor) Direct() bool {
+	return v.conn != nil && v.conn.Context().Err() == nil
+}
+
+// Dial opens a connection to the tunnel's TCP upstream, relaying through
+// the server once the direct connection is lost
+func (v *Visitor) Dial(ctx context.Context) (net.Conn, error) {
+	if v.Direct() {
+		stream, err := v.conn.OpenStreamSync(ctx)
+		if err == nil {
+			return &p2pStream{Stream: stream, conn: v.conn}, nil
+		}
+		log.Printf("Direct connection lost, relaying through %s: %v", v.relay, err)
+	}
+	return v.dial(ctx, v.relay)
+}
+
+// Close ends the direct connection, if any
+func (v *Visitor) Close() error {
+	if v.conn == nil {
+		return nil
+	}
+	v.conn.CloseWithError(0, "")
+	v.transport.Close()
+	return v.transport.Conn.Close()
+}
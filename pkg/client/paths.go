@@ -0,0 +1,129 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pathUpdateTimeout bounds how long a path update waits for the server
+const pathUpdateTimeout = 5 * time.Second
+
+// pathUpdate adds and removes paths of the tunnel
+type pathUpdate struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// tunnelPaths keeps the paths the server routes to the tunnel once they
+// have been updated at runtime, so a reconnect claims them again
+type tunnelPaths struct {
+	mu      sync.Mutex
+	paths   []string    // nil until the server reports an update
+	replies chan string // The server's answers to updates
+	update  sync.Mutex  // Held while an update waits for its answer
+}
+
+func newTunnelPaths() *tunnelPaths {
+	return &tunnelPaths{replies: make(chan string, 1)}
+}
+
+// Paths returns the tunnel's paths, starting out as the registered path
+func (t *Tunnel) Paths() []string {
+	t.paths.mu.Lock()
+	defer t.paths.mu.Unlock()
+	if t.paths.paths == nil {
+		return []string{t.path}
+	}
+	return slices.Clone(t.paths.paths)
+}
+
+// restorePaths asks a server the tunnel just connected to for the paths it
+// had before, since registration only claims the first path
+func (t *Tunnel) restorePaths() {
+	t.paths.mu.Lock()
+	paths := t.paths.paths
+	t.paths.mu.Unlock()
+	if paths == nil {
+		return
+	}
+	var update pathUpdate
+	for _, path := range paths {
+		if path != t.path {
+			update.Add = append(update.Add, path)
+		}
+	}
+	if !slices.Contains(paths, t.path) {
+		update.Remove = []string{t.path}
+	}
+	if len(update.Add) == 0 && len(update.Remove) == 0 {
+		return
+	}
+	if err := t.sendPathUpdate(update); err != nil {
+		log.Printf("Failed to restore paths %v: %v", paths, err)
+	}
+}
+
+func (t *Tunnel) sendPathUpdate(update pathUpdate) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return t.sendMessage("update-paths|" + string(data))
+}
+
+// UpdatePaths adds and removes paths of the tunnel and returns the paths
+// the server routes to it afterwards. The server rejects updates that
+// remove every path, or add invalid paths or ones another client holds.
+func (t *Tunnel) UpdatePaths(add, remove []string) ([]string, error) {
+	update := pathUpdate{Add: add, Remove: remove}
+	t.paths.update.Lock()
+	defer t.paths.update.Unlock()
+	select {
+	case <-t.paths.replies: // An answer to a restore nobody waited for
+	default:
+	}
+	if err := t.sendPathUpdate(update); err != nil {
+		return nil, fmt.Errorf("failed to send path update: %v", err)
+	}
+	select {
+	case reply := <-t.paths.replies:
+		if reason, failed := strings.CutPrefix(reply, "error|"); failed {
+			return nil, errors.New(reason)
+		}
+		return t.Paths(), nil
+	case <-time.After(pathUpdateTimeout):
+		return nil, fmt.Errorf("no answer from server within %v", pathUpdateTimeout)
+	}
+}
+
+// handlePaths records the paths the server reported (format:
+// "paths|<json>" or "paths-error|<reason>")
+func (t *Tunnel) handlePaths(message string) {
+	reply := "ok"
+	if reason, failed := strings.CutPrefix(message, "paths-error|"); failed {
+		log.Printf("Server rejected path update: %s", reason)
+		reply = "error|" + reason
+	} else {
+		var report struct {
+			Paths []string `json:"paths"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(message, "paths|")), &report); err != nil || len(report.Paths) == 0 {
+			log.Printf("Invalid paths from server: %s", message)
+			return
+		}
+		t.paths.mu.Lock()
+		t.paths.paths = report.Paths
+		t.paths.mu.Unlock()
+		log.Printf("Tunnel paths are now %v", report.Paths)
+	}
+	select {
+	case t.paths.replies <- reply:
+	default:
+	}
+}
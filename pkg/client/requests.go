@@ -0,0 +1,302 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+const (
+	// requestKeepalive is how often the server hears about requests still in progress
+	requestKeepalive = 10 * time.Second
+	// streamChunkSize caps the size of each chunk of a streamed response
+	streamChunkSize = 32 * 1024
+)
+
+var (
+	errRequestCancelled = errors.New("request cancelled by server")
+	errUpstreamTimeout  = errors.New("upstream did not respond in time")
+	errRequestDeadline  = errors.New("request passed its deadline")
+)
+
+// requestJob handles one tunneled request on the worker pool. Its context
+// ends when the server cancels the request, even while it is queued.
+type requestJob struct {
+	tunnel *Tunnel
+	req    *types.Request
+	ctx    context.Context
+}
+
+func (j requestJob) Execute(context.Context) error {
+	defer j.tunnel.inFlight.Add(-1)
+	if errors.Is(context.Cause(j.ctx), errRequestCancelled) {
+		log.Printf("Dropping request %s %s, cancelled by the server while queued", j.req.Method, j.req.Path)
+		j.tunnel.forgetRequest(j.req.ID)
+		return nil
+	}
+	j.tunnel.handleRequest(j.ctx, j.req)
+	return nil
+}
+
+// submitRequest queues a tunneled request for the worker pool, turning it
+// away when the queue is full
+func (t *Tunnel) submitRequest(tcpReq *types.Request) {
+	ctx, cancel := context.WithCancelCause(t.ctx)
+	t.requestsMu.Lock()
+	t.requests[tcpReq.ID] = cancel
+	t.requestsMu.Unlock()
+	if tcpReq.Stream {
+		t.startUpload(ctx, cancel, tcpReq)
+	}
+
+	t.inFlight.Add(1)
+	err := t.workers.Submit(t.ctx, requestJob{tunnel: t, req: tcpReq, ctx: ctx})
+	if err == nil {
+		return
+	}
+	t.inFlight.Add(-1)
+	t.forgetRequest(tcpReq.ID)
+	log.Printf("Rejecting request %s %s: %v", tcpReq.Method, tcpReq.Path, err)
+	t.observeRequest(tcpReq.Method, tcpReq.Path, http.StatusServiceUnavailable, 0, false)
+	busy := &types.Response{
+		RequestID:  tcpReq.ID,
+		StatusCode: http.StatusServiceUnavailable,
+		Error:      err.Error(),
+		Timestamp:  time.Now().Unix(),
+	}
+	if _, err := t.transport.WriteResponse(t.conn(), busy); err != nil {
+		log.Printf("Failed to send response for request %s: %v", tcpReq.ID, err)
+	}
+}
+
+// handleRequest serves a tunneled request with the handler or upstream and
+// sends the response back over the tunnel. Responses of unknown length,
+// such as Server-Sent Events, are streamed chunk by chunk.
+func (t *Tunnel) handleRequest(ctx context.Context, tcpReq *types.Request) {
+	if tcpReq.Type == types.RequestTypeBench {
+		defer t.forgetRequest(tcpReq.ID)
+		t.answerBench(tcpReq)
+		return
+	}
+	if t.metrics != nil {
+		t.metrics.streams.Add(1)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	finish := func() {
+		t.forgetRequest(tcpReq.ID)
+		cancel(nil)
+		if t.metrics != nil {
+			t.metrics.streams.Add(-1)
+		}
+	}
+	go t.keepAlive(ctx, tcpReq.ID)
+
+	// The timeout bounds the wait for the response, not how long a streamed
+	// body runs
+	if timeout := t.settings.timeout(); timeout > 0 {
+		timer := time.AfterFunc(timeout, func() { cancel(errUpstreamTimeout) })
+		defer timer.Stop()
+		// It restarts as the upstream reads a streamed request body
+		if upload := t.upload(tcpReq.ID); upload != nil {
+			upload.onRead = func() { timer.Reset(timeout) }
+		}
+	}
+	// So does the deadline the server gives up on the request at. Streamed
+	// requests have none, the server timing them from the end of the body
+	// and cancelling them when it gives up.
+	if tcpReq.Deadline > 0 && !tcpReq.Stream {
+		timer := time.AfterFunc(time.Until(time.UnixMilli(tcpReq.Deadline)), func() { cancel(errRequestDeadline) })
+		defer timer.Stop()
+	}
+
+	start := time.Now()
+	resp, err := t.forward(ctx, tcpReq)
+	if err == nil && resp.ContentLength < 0 {
+		if t.metrics != nil {
+			t.metrics.observeUpstream(time.Since(start))
+		}
+		t.observeRequest(tcpReq.Method, tcpReq.Path, resp.StatusCode, time.Since(start), true)
+		// Streams can run indefinitely, so they don't hold on to a worker
+		go func() {
+			defer finish()
+			t.streamResponse(ctx, tcpReq, resp)
+		}()
+		return
+	}
+	defer finish()
+
+	var tcpResp *types.Response
+	if err == nil {
+		tcpResp, err = protocol.HTTPResponseToTCP(resp, tcpReq.ID)
+	}
+	if err == nil && t.metrics != nil {
+		t.metrics.observeUpstream(time.Since(start))
+	}
+	if err != nil {
+		cause := context.Cause(ctx)
+		if errors.Is(cause, errRequestCancelled) {
+			// The server has already given up on the request
+			t.observeRequest(tcpReq.Method, tcpReq.Path, 0, time.Since(start), false)
+			return
+		}
+		status := http.StatusBadGateway
+		if errors.Is(cause, errUpstreamTimeout) || errors.Is(cause, errRequestDeadline) {
+			status = http.StatusGatewayTimeout
+			err = cause
+		}
+		log.Printf("Failed to forward request %s %s: %v", tcpReq.Method, tcpReq.Path, err)
+		tcpResp = &types.Response{
+			RequestID:  tcpReq.ID,
+			StatusCode: status,
+			Error:      err.Error(),
+			Timestamp:  time.Now().Unix(),
+		}
+	}
+
+	t.observeRequest(tcpReq.Method, tcpReq.Path, tcpResp.StatusCode, time.Since(start), false)
+	if _, err := t.transport.WriteResponse(t.conn(), tcpResp); err != nil {
+		log.Printf("Failed to send response for request %s: %v", tcpReq.ID, err)
+	}
+}
+
+// observeRequest counts a handled request and reports it to OnRequest.
+// Requests the server cancelled have status 0.
+func (t *Tunnel) observeRequest(method, path string, status int, latency time.Duration, streamed bool) {
+	t.status.countRequest()
+	if t.opts.OnRequest != nil {
+		t.opts.OnRequest(RequestLog{Method: method, Path: path, Status: status, Latency: latency, Streamed: streamed})
+	}
+}
+
+// streamResponse sends the response head, then each read of its body as a
+// chunk until the body ends or the server cancels the request
+func (t *Tunnel) streamResponse(ctx context.Context, tcpReq *types.Request, resp *http.Response) {
+	defer resp.Body.Close()
+
+	head := protocol.HTTPResponseHeadToTCP(resp, tcpReq.ID)
+	head.Stream = true
+	if _, err := t.transport.WriteResponse(t.conn(), head); err != nil {
+		log.Printf("Failed to send response for request %s: %v", tcpReq.ID, err)
+		return
+	}
+
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		chunk := &types.Response{RequestID: tcpReq.ID, Stream: true, Timestamp: time.Now().Unix()}
+		if n > 0 {
+			chunk.Body = buf[:n]
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			chunk.Stream = false
+			if err != io.EOF {
+				log.Printf("Stream of request %s %s failed: %v", tcpReq.Method, tcpReq.Path, err)
+				chunk.Error = err.Error()
+			}
+		}
+		if n > 0 || !chunk.Stream {
+			if _, err := t.transport.WriteChunk(t.conn(), chunk); err != nil {
+				log.Printf("Failed to send response chunk for request %s: %v", tcpReq.ID, err)
+				return
+			}
+		}
+		if !chunk.Stream {
+			return
+		}
+	}
+}
+
+// keepAlive tells the server the request is still being worked on until ctx
+// is done, so slow upstreams and idle streams don't time out
+func (t *Tunnel) keepAlive(ctx context.Context, requestID string) {
+	ticker := time.NewTicker(requestKeepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := t.sendMessage("pending|" + requestID); err != nil {
+			log.Printf("Failed to send keepalive for request %s: %v", requestID, err)
+		}
+	}
+}
+
+// cancelRequest stops the call of a request the server gave up on
+func (t *Tunnel) cancelRequest(requestID string) {
+	t.requestsMu.Lock()
+	cancel, ok := t.requests[requestID]
+	t.requestsMu.Unlock()
+	if ok {
+		log.Printf("Server cancelled request %s", requestID)
+		cancel(errRequestCancelled)
+	}
+}
+
+// forgetRequest stops tracking a request that is done with
+func (t *Tunnel) forgetRequest(requestID string) {
+	t.requestsMu.Lock()
+	cancel, ok := t.requests[requestID]
+	delete(t.requests, requestID)
+	delete(t.uploads, requestID)
+	t.requestsMu.Unlock()
+	if ok {
+		cancel(nil)
+	}
+}
+
+// conn returns the current tunnel connection
+func (t *Tunnel) conn() net.Conn {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+	return t.tcpConn
+}
+
+// forward serves a tunneled request with the handler or upstream
+func (t *Tunnel) forward(ctx context.Context, tcpReq *types.Request) (*http.Response, error) {
+	req, err := protocol.TCPToHTTPRequest(tcpReq)
+	if err != nil {
+		return nil, err
+	}
+	if upload := t.upload(tcpReq.ID); upload != nil {
+		req.Body = upload
+		req.ContentLength = protocol.StreamedRequestLength(tcpReq)
+		req.GetBody = nil
+	}
+	resp, err := t.roundTrip(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Proxied %s %s -> %d", tcpReq.Method, tcpReq.Path, resp.StatusCode)
+	return resp, nil
+}
+
+// roundTrip serves req with the handler, or sends it to the upstream
+func (t *Tunnel) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.handler != nil {
+		return serveHandler(t.handler, req)
+	}
+	req.URL.Scheme = t.upstream.Scheme
+	req.URL.Host = t.upstream.Host
+	req.Host = t.upstream.Host
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %v", err)
+	}
+	return resp, nil
+}
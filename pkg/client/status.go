@@ -0,0 +1,72 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// tunnelStatus tracks the tunnel's connection
+type tunnelStatus struct {
+	mu       sync.Mutex
+	state    string // connecting, online, or reconnecting
+	since    time.Time
+	server   string // Server the tunnel is registered with
+	rtt      time.Duration
+	requests int64
+}
+
+// Status is a tunnel's connection status
+type Status struct {
+	State    string    `json:"state"` // connecting, online, or reconnecting
+	Since    time.Time `json:"since"`
+	Server   string    `json:"server"`
+	RTTMs    float64   `json:"rtt_ms"`
+	Requests int64     `json:"requests"`
+}
+
+func newTunnelStatus() *tunnelStatus {
+	return &tunnelStatus{state: "connecting", since: time.Now()}
+}
+
+// set records a change to the tunnel's connection
+func (s *tunnelStatus) set(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state != s.state {
+		s.state = state
+		s.since = time.Now()
+	}
+}
+
+// setServer records the server the tunnel is registered with
+func (s *tunnelStatus) setServer(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.server = server
+}
+
+// setRTT records the latest heartbeat round trip
+func (s *tunnelStatus) setRTT(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rtt = rtt
+}
+
+// countRequest counts a handled request
+func (s *tunnelStatus) countRequest() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+}
+
+func (s *tunnelStatus) snapshot() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Status{
+		State:    s.state,
+		Since:    s.since,
+		Server:   s.server,
+		RTTMs:    float64(s.rtt) / float64(time.Millisecond),
+		Requests: s.requests,
+	}
+}
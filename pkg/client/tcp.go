@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+)
+
+// tcpDialTimeout bounds how long a raw TCP tunnel takes to reach its
+// upstream for a new stream
+const tcpDialTimeout = 5 * time.Second
+
+// openStream connects a stream the server opened for a connection to the
+// tunnel's public port to the TCP upstream, copying bytes between them
+// until both are done. The stream has a connection of its own to the
+// server, so a busy stream doesn't hold up the tunnel's messages.
+func (t *Tunnel) openStream(id string) {
+	dialer := net.Dialer{Timeout: tcpDialTimeout}
+	local, err := dialer.DialContext(t.ctx, "tcp", t.opts.TCPUpstream)
+	if err != nil {
+		log.Printf("Failed to reach %s for stream %s: %v", t.opts.TCPUpstream, id, err)
+		reason := strings.ReplaceAll(err.Error(), "\n", " ")
+		if err := t.sendMessage(fmt.Sprintf("tcp-error|%s|%s", id, reason)); err != nil {
+			log.Printf("Failed to report stream %s: %v", id, err)
+		}
+		return
+	}
+	stream, _, err := t.dial(t.ctx)
+	if err != nil {
+		// The server gives up on the stream after a while
+		log.Printf("Failed to open stream %s to server: %v", id, err)
+		local.Close()
+		return
+	}
+	if _, err := stream.Write([]byte("stream|" + id + "\n")); err != nil {
+		log.Printf("Failed to open stream %s to server: %v", id, err)
+		local.Close()
+		stream.Close()
+		return
+	}
+
+	// Closing the tunnel ends its streams
+	stop := context.AfterFunc(t.ctx, func() {
+		local.Close()
+		stream.Close()
+	})
+	defer stop()
+	logging.Debugf("Stream %s opened to %s", id, t.opts.TCPUpstream)
+	t.status.countRequest()
+	sent, received := traffic.Splice(local, stream)
+	logging.Debugf("Stream %s closed after %d bytes out and %d back", id, sent, received)
+}
@@ -0,0 +1,1038 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+	"github.com/vikasavn/attachcloudip/pkg/worker"
+)
+
+var (
+	// ErrExpired ends tunnels whose registration TTL lapsed
+	ErrExpired = errors.New("registration expired, tunnel closed by server")
+	// ErrEvicted ends tunnels another client took a path over from
+	ErrEvicted = errors.New("tunnel evicted by server")
+	// ErrIncompatible ends tunnels to servers without a protocol version in
+	// common with the client, which an upgrade of either side fixes
+	ErrIncompatible = protocol.ErrIncompatible
+)
+
+// TunnelOptions configure a tunnel. The zero value registers a generated
+// client ID with weight 1 and no TTL.
+type TunnelOptions struct {
+	ID     string        // Client ID to register with (generated if empty)
+	Weight int           // Relative share of the path's traffic (1 if 0)
+	TTL    time.Duration // Expire the tunnel after this long unless renewed (never if 0)
+
+	Methods []string          // Claim the path only for these methods (all if empty)
+	Headers map[string]string // Claim the path only for requests with these headers
+	ALPN    []string          // Claim the path only for requests over TLS with these protocols, e.g. h2
+	Shadow  bool              // Receive copies of the path's traffic without serving it
+	Class   string            // QoS priority class (the server's default if empty)
+
+	// Schedule is a cron-like window outside which the server answers 503,
+	// e.g. "* 9-17 * * mon-fri", in Timezone (UTC if empty); always if empty
+	Schedule string
+	Timezone string
+
+	// Profile names a server-side profile whose settings the tunnel takes,
+	// where these options leave them unset
+	Profile string
+
+	// Hostname is served over TLS on the server's HTTPS port, with the PEM
+	// certificate and key files, or one the server generates if empty. A raw
+	// TCP tunnel takes the TLS connections for Hostname undecrypted instead,
+	// for its upstream to terminate with certificates of its own.
+	Hostname     string
+	HostnameCert string
+	HostnameKey  string
+
+	// Upstream is the URL requests are forwarded to when RegisterPath has no
+	// handler, reached with Transport (the default transport if nil)
+	Upstream  string
+	Transport http.RoundTripper
+
+	// TCPUpstream, such as "localhost:5432", makes the tunnel a raw TCP
+	// tunnel: the server exposes it on a public port of its own and forwards
+	// the bytes of each connection to this address as they are. The path
+	// only names the tunnel, and there is no handler or Upstream.
+	TCPUpstream string
+
+	Codec           string // Tunnel codec to ask for: json (default) or msgpack
+	Compress        bool   // Ask the server to snappy-compress large messages
+	CompressMinSize int    // Smallest response compressed (protocol default if 0)
+	Encrypt         bool   // Encrypt tunnel traffic with a key exchanged at registration
+
+	Workers        int           // Requests handled at once (64 if 0)
+	QueueSize      int           // Requests queued while all workers are busy (256 if 0)
+	RequestTimeout time.Duration // Wait for each response (until the server gives up if 0)
+
+	ReportMetrics     bool          // Send resource metrics with heartbeats
+	HealthPath        string        // Path probed for health, reported to the server (off if empty)
+	HealthInterval    time.Duration // Interval between health probes (10s if 0)
+	HeartbeatInterval time.Duration // Interval between heartbeats (2s if 0)
+
+	// OnRequest, if set, is called after each request the tunnel handles
+	OnRequest func(RequestLog)
+	// OnBroadcast, if set, is called with each message the server broadcasts
+	OnBroadcast func(Broadcast)
+}
+
+// Broadcast is a message the server sent to its clients
+type Broadcast = protocol.Broadcast
+
+// RequestLog describes a request the tunnel handled
+type RequestLog struct {
+	Method   string
+	Path     string
+	Status   int // 0 when the server cancelled the request
+	Latency  time.Duration
+	Streamed bool // The response was streamed, Latency is to its head
+}
+
+// Tunnel serves a path registered with the server, reconnecting until it is
+// closed, its registration expires, or it is evicted
+type Tunnel struct {
+	client     *Client
+	opts       TunnelOptions
+	id         string
+	path       string
+	handler    http.Handler // Serves requests, nil to forward them to upstream
+	upstream   *url.URL
+	tcpPort    int
+	serverHost string
+	tlsConfig  *tls.Config
+	tcpConn    net.Conn
+	// socket is the dialed connection under tcpConn's TLS and throttle
+	socket     net.Conn
+	throttle   *traffic.ThrottledConn
+	reader     *protocol.Reader
+	httpClient *http.Client
+	// sessionToken resumes the tunnel's server-side session after a reconnect
+	sessionToken string
+	connMu       sync.Mutex
+	// ticket admits the tunnel's connections after an SSH-signed registration
+	ticket string
+	// apiServer is the server the tunnel registered with over HTTP, where
+	// certStored tells whether its hostname's certificate was uploaded
+	apiServer  string
+	certStored bool
+	// metrics are sent with heartbeats when set
+	metrics *clientMetrics
+	// servers are the servers to fail over between when the client has
+	// several, nil otherwise
+	servers *serverPool
+	// status tracks the tunnel's connection
+	status *tunnelStatus
+	// health is what the server was told about the tunnel's health
+	health *tunnelHealth
+	// inFlight counts the requests queued or running
+	inFlight atomic.Int64
+	// publicPort is the server's public port of a raw TCP tunnel
+	publicPort atomic.Int64
+	// paths are the tunnel's paths after runtime updates
+	paths *tunnelPaths
+	// offer is the transport asked for at registration, transport the one
+	// the server confirmed
+	offer     *protocol.Transport
+	transport *protocol.Transport
+	// workers handle tunneled requests, each waiting up to the settings'
+	// request timeout for its response
+	workers *worker.Pool
+	// settings are the ones the server can push while the tunnel runs
+	settings *tunnelSettings
+	// register carries the registration in the tunnel's first message for
+	// clients that bootstrap without HTTP registration
+	register url.Values
+	// requests cancels the calls of requests still in progress, and
+	// uploads holds the bodies of those that are streamed
+	requests   map[string]context.CancelCauseFunc
+	uploads    map[string]*uploadBody
+	requestsMu sync.Mutex
+
+	ctx    context.Context // Done once the tunnel ends
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// RegisterPath registers a tunnel for path with the client's server and
+// connects it, serving its requests with handler, or forwarding them to
+// opts.Upstream if handler is nil. ctx bounds the registration, not the
+// tunnel, which runs until closed.
+func (c *Client) RegisterPath(ctx context.Context, path string, handler http.Handler, opts TunnelOptions) (*Tunnel, error) {
+	t, err := c.newTunnel(path, handler, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.track(t); err != nil {
+		return nil, err
+	}
+
+	pool := &serverPool{servers: c.servers, bootstrap: c.bootstrap, client: c}
+	server, err := pool.first(ctx, t)
+	if err != nil {
+		t.end(err)
+		return nil, fmt.Errorf("failed to register client: %v", err)
+	}
+	t.status.setServer(server)
+	if len(pool.servers) > 1 {
+		t.servers = pool
+	}
+
+	log.Println("connecting to TCP server...")
+	if err := t.connect(ctx); err != nil {
+		if t.servers == nil {
+			t.end(err)
+			return nil, fmt.Errorf("failed to connect to TCP server: %v", err)
+		}
+		log.Printf("failed to connect to TCP server %s: %v", server, err)
+		if err := t.failover(ctx); err != nil {
+			t.end(err)
+			return nil, fmt.Errorf("failed to connect to TCP server: %v", err)
+		}
+	}
+	t.status.set("online")
+	log.Printf("Client registered with ID: %s", t.id)
+
+	if t.servers != nil && !c.bootstrap {
+		// Registration ports can't be probed without a failed registration
+		// each time, so bootstrapping clients only move back on failover
+		go t.watchPreferred(c.probeInterval)
+	}
+	if opts.HealthPath != "" {
+		go t.startHealthCheck(opts.HealthPath, t.opts.HealthInterval)
+	}
+	// Receive messages and send heartbeats, reconnecting until the tunnel ends
+	go t.run()
+	return t, nil
+}
+
+// newTunnel applies the defaults to opts and sets up a tunnel that is yet to
+// be registered
+func (c *Client) newTunnel(path string, handler http.Handler, opts TunnelOptions) (*Tunnel, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	if opts.Hostname != "" && opts.TCPUpstream == "" && c.bootstrap {
+		return nil, fmt.Errorf("a hostname needs the server's HTTP API and can't be used when bootstrapping")
+	}
+	var upstream *url.URL
+	if opts.TCPUpstream != "" {
+		if handler != nil {
+			return nil, fmt.Errorf("a raw TCP tunnel forwards to its TCP upstream and takes no handler")
+		}
+		if _, _, err := net.SplitHostPort(opts.TCPUpstream); err != nil {
+			return nil, fmt.Errorf("invalid TCP upstream: %v", err)
+		}
+		if opts.HealthPath != "" || opts.Shadow {
+			return nil, fmt.Errorf("health checks and shadowing need HTTP and can't be used with a raw TCP tunnel")
+		}
+		if opts.HostnameCert != "" || opts.HostnameKey != "" {
+			return nil, fmt.Errorf("a raw TCP tunnel's upstream terminates TLS for its hostname and takes no certificate")
+		}
+	} else if handler == nil {
+		if opts.Upstream == "" {
+			return nil, fmt.Errorf("a handler or an upstream is required")
+		}
+		var err error
+		if upstream, err = url.Parse(opts.Upstream); err != nil {
+			return nil, fmt.Errorf("invalid upstream URL: %v", err)
+		}
+	}
+	if opts.ID == "" {
+		opts.ID = uuid.New().String()
+		log.Printf("Generated client ID: %s", opts.ID)
+	}
+	if opts.Weight == 0 {
+		opts.Weight = 1
+	}
+	if opts.Workers == 0 {
+		opts.Workers = 64
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = 256
+	}
+	if opts.CompressMinSize == 0 {
+		opts.CompressMinSize = protocol.DefaultCompressMinSize
+	}
+	if opts.HealthInterval == 0 {
+		opts.HealthInterval = 10 * time.Second
+	}
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = 2 * time.Second
+	}
+	if opts.Codec == "" {
+		opts.Codec = "json"
+	}
+	preferred, err := protocol.CodecByName(opts.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid codec: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Tunnel{
+		client:    c,
+		opts:      opts,
+		id:        opts.ID,
+		path:      path,
+		handler:   handler,
+		upstream:  upstream,
+		tlsConfig: c.tlsConfig,
+		requests:  make(map[string]context.CancelCauseFunc),
+		uploads:   make(map[string]*uploadBody),
+		status:    newTunnelStatus(),
+		health:    newTunnelHealth(),
+		paths:     newTunnelPaths(),
+		offer:     &protocol.Transport{Codec: preferred, CompressMinSize: opts.CompressMinSize},
+		// No overall timeout: RequestTimeout bounds the wait for the
+		// response, and streamed bodies run until the server cancels them
+		httpClient: &http.Client{
+			Transport: opts.Transport,
+			// Pass upstream redirects back to the caller instead of following them
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		settings: newTunnelSettings(opts),
+		workers:  worker.NewPool(opts.Workers, opts.QueueSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	if opts.Compress {
+		t.offer.Compression = "snappy"
+	}
+	if opts.Encrypt {
+		t.offer.Encryption = protocol.EncryptionX25519
+	}
+	if opts.ReportMetrics {
+		t.metrics = &clientMetrics{}
+	}
+	if c.bootstrap {
+		t.register = t.bootstrapValues()
+	}
+	t.workers.Start(ctx)
+	return t, nil
+}
+
+// ID returns the client ID the tunnel is registered with
+func (t *Tunnel) ID() string {
+	return t.id
+}
+
+// PublicPort returns the server's public port of a raw TCP tunnel, 0 for
+// other tunnels
+func (t *Tunnel) PublicPort() int {
+	return int(t.publicPort.Load())
+}
+
+// Status returns the tunnel's connection status
+func (t *Tunnel) Status() Status {
+	return t.status.snapshot()
+}
+
+// Done is closed once the tunnel ends
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns why the tunnel ended, such as ErrExpired or ErrEvicted, or nil
+// while it runs and after Close
+func (t *Tunnel) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// Close disconnects the tunnel and stops its requests
+func (t *Tunnel) Close() error {
+	t.end(nil)
+	return nil
+}
+
+// end stops the tunnel for err, nil when closed
+func (t *Tunnel) end(err error) {
+	t.once.Do(func() {
+		t.err = err
+		t.cancel() // Also stops the workers
+		if conn := t.conn(); conn != nil {
+			conn.Close()
+		}
+		t.client.untrack(t)
+		close(t.done)
+	})
+}
+
+// registerWith registers the tunnel with server, over its HTTP API or, when
+// bootstrapping, in the tunnel's first message
+func (t *Tunnel) registerWith(ctx context.Context, server string) error {
+	if t.client.bootstrap {
+		return t.bootstrapWith(server)
+	}
+
+	// Prepare registration request
+	registrationPayload := struct {
+		ClientID string            `json:"client_id"`
+		Paths    []string          `json:"paths"`
+		Weight   int               `json:"weight"`
+		TTL      string            `json:"ttl,omitempty"`
+		Methods  []string          `json:"methods,omitempty"`
+		Headers  map[string]string `json:"headers,omitempty"`
+		ALPN     []string          `json:"alpn,omitempty"`
+		Shadow   bool              `json:"shadow,omitempty"`
+		Class    string            `json:"class,omitempty"`
+		Schedule string            `json:"schedule,omitempty"`
+		Timezone string            `json:"timezone,omitempty"`
+		Profile  string            `json:"profile,omitempty"`
+		SSHNonce string            `json:"ssh_nonce,omitempty"`
+		SSHSig   string            `json:"ssh_signature,omitempty"`
+	}{
+		ClientID: t.id,
+		Paths:    []string{t.path},
+		Weight:   t.opts.Weight,
+		Methods:  t.opts.Methods,
+		Headers:  t.opts.Headers,
+		ALPN:     t.opts.ALPN,
+		Shadow:   t.opts.Shadow,
+		Class:    t.opts.Class,
+		Schedule: t.opts.Schedule,
+		Timezone: t.opts.Timezone,
+		Profile:  t.opts.Profile,
+	}
+	if t.opts.TTL > 0 {
+		registrationPayload.TTL = t.opts.TTL.String()
+	}
+	if t.client.sshKey != nil {
+		var err error
+		registrationPayload.SSHNonce, registrationPayload.SSHSig, err = t.client.sshChallenge(ctx, server, t.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	payloadBytes, err := json.Marshal(registrationPayload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration payload: %v", err)
+	}
+
+	// Send registration request
+	resp, err := t.client.post(ctx, server, "/register", payloadBytes)
+	if err != nil {
+		return fmt.Errorf("failed to send registration request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("registration failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	// Parse registration response
+	var regResponse struct {
+		Port         []int  `json:"port"`
+		TunnelTicket string `json:"tunnel_ticket"`
+		Claims       []struct {
+			Path       string   `json:"path"`
+			SharedWith []string `json:"shared_with"`
+			TookOver   []string `json:"took_over"`
+		} `json:"claims"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&regResponse); err != nil {
+		return fmt.Errorf("failed to decode registration response: %v", err)
+	}
+
+	// Extract TCP port from JSON response
+	if len(regResponse.Port) == 0 {
+		return fmt.Errorf("no TCP port received from server")
+	}
+	log.Printf("Received TCP port: %v", regResponse.Port)
+	for _, claim := range regResponse.Claims {
+		if len(claim.SharedWith) > 0 {
+			log.Printf("Path %s is shared with clients %s", claim.Path, strings.Join(claim.SharedWith, ", "))
+		}
+		if len(claim.TookOver) > 0 {
+			log.Printf("Path %s is taken over from clients %s", claim.Path, strings.Join(claim.TookOver, ", "))
+		}
+	}
+
+	// Extract host from the server address
+	u, err := url.Parse(serverURL(server))
+	if err != nil {
+		return fmt.Errorf("failed to parse server address: %v", err)
+	}
+	host := u.Hostname()
+	log.Printf("Received Host: %+v", host)
+
+	t.apiServer = server
+	t.certStored = false
+	t.tcpPort = regResponse.Port[0]
+	t.serverHost = host
+	t.ticket = regResponse.TunnelTicket
+	return nil
+}
+
+// bootstrapWith points the tunnel at a server's registration port, where it
+// registers with its first message
+func (t *Tunnel) bootstrapWith(server string) error {
+	host, portValue, err := net.SplitHostPort(server)
+	if err != nil {
+		return fmt.Errorf("invalid registration port address %q: %v", server, err)
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return fmt.Errorf("invalid registration port %q", portValue)
+	}
+	t.serverHost, t.tcpPort = host, port
+	return nil
+}
+
+// bootstrapValues is the registration sent in the first message of
+// bootstrapping tunnels
+func (t *Tunnel) bootstrapValues() url.Values {
+	register := url.Values{"register": {"1"}, "weight": {strconv.Itoa(t.opts.Weight)}}
+	if t.opts.TTL > 0 {
+		register.Set("ttl", t.opts.TTL.String())
+	}
+	if len(t.opts.Methods) > 0 {
+		register.Set("methods", strings.Join(t.opts.Methods, ","))
+	}
+	for name, value := range t.opts.Headers {
+		register.Add("header", name+"="+value)
+	}
+	if len(t.opts.ALPN) > 0 {
+		register.Set("alpn", strings.Join(t.opts.ALPN, ","))
+	}
+	if t.opts.Shadow {
+		register.Set("shadow", "1")
+	}
+	if t.opts.Class != "" {
+		register.Set("class", t.opts.Class)
+	}
+	if t.opts.Schedule != "" {
+		register.Set("schedule", t.opts.Schedule)
+		register.Set("timezone", t.opts.Timezone)
+	}
+	if t.opts.Profile != "" {
+		register.Set("profile", t.opts.Profile)
+	}
+	if t.client.apiKey != "" {
+		register.Set("api_key", t.client.apiKey)
+	}
+	return register
+}
+
+// uploadCertificate registers a TLS certificate for the tunnel's hostname
+// once its tunnel has a session. When no certificate file is given the
+// server generates a self-signed one.
+func (t *Tunnel) uploadCertificate(ctx context.Context, server string) error {
+	payload := struct {
+		ClientID string `json:"client_id"`
+		Hostname string `json:"hostname"`
+		Cert     string `json:"cert,omitempty"`
+		Key      string `json:"key,omitempty"`
+		// SessionToken and Ticket prove the upload comes from the tunnel
+		SessionToken string `json:"session_token"`
+		Ticket       string `json:"ticket,omitempty"`
+	}{
+		ClientID:     t.id,
+		Hostname:     t.opts.Hostname,
+		SessionToken: t.sessionToken,
+		Ticket:       t.ticket,
+	}
+
+	if t.opts.HostnameCert != "" {
+		certPEM, err := os.ReadFile(t.opts.HostnameCert)
+		if err != nil {
+			return fmt.Errorf("failed to read certificate: %v", err)
+		}
+		keyPEM, err := os.ReadFile(t.opts.HostnameKey)
+		if err != nil {
+			return fmt.Errorf("failed to read key: %v", err)
+		}
+		payload.Cert = string(certPEM)
+		payload.Key = string(keyPEM)
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal certificate payload: %v", err)
+	}
+
+	resp, err := t.client.post(ctx, server, "/certificates", payloadBytes)
+	if err != nil {
+		return fmt.Errorf("failed to upload certificate: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("certificate upload failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	log.Printf("Certificate for %s registered with server", t.opts.Hostname)
+	return nil
+}
+
+// connect opens the tunnel connection and registers it, resuming the
+// session after a reconnect
+func (t *Tunnel) connect(ctx context.Context) error {
+	conn, socket, err := t.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to TCP server: %v", err)
+	}
+	throttle := t.settings.throttle(conn)
+	conn = throttle
+	t.connMu.Lock()
+	t.tcpConn, t.socket, t.throttle = conn, socket, throttle
+	t.connMu.Unlock()
+	if t.ctx.Err() != nil {
+		// Closed while dialing
+		conn.Close()
+		return net.ErrClosed
+	}
+	t.reader = protocol.NewReader(conn)
+
+	// Send initial registration message with client ID and path, plus the
+	// session token when reconnecting and the transport options if any
+	path := t.path
+	if routing.IsRegex(path) {
+		// Escape the expression since it may contain '|'
+		path = routing.RegexPrefix + url.PathEscape(strings.TrimPrefix(path, routing.RegexPrefix))
+	}
+	registrationMsg := fmt.Sprintf("%s|%s", t.id, path)
+	logging.Debugf("Registering tunnel %s for path %s", t.id, path)
+	options, err := t.offer.Offer()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to prepare transport options: %v", err)
+	}
+	for key, values := range t.register {
+		options[key] = values
+	}
+	if t.ticket != "" {
+		options.Set("ticket", t.ticket)
+	}
+	if t.opts.TCPUpstream != "" {
+		options.Set(protocol.TCPOption, "1")
+		if t.opts.Hostname != "" {
+			options.Set(protocol.SNIOption, t.opts.Hostname)
+		}
+	}
+	if t.sessionToken != "" || len(options) > 0 {
+		registrationMsg += "|" + t.sessionToken
+	}
+	if len(options) > 0 {
+		registrationMsg += "|" + options.Encode()
+	}
+	if _, err := conn.Write([]byte(registrationMsg + "\n")); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send registration message: %v", err)
+	}
+	log.Println("Registration message sent and waiting for confirmation...")
+
+	// Wait for registration confirmation before any other reads on the connection
+	response, err := t.reader.ReadLine()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to read registration confirmation: %v", err)
+	}
+
+	if reason, ok := strings.CutPrefix(response, "incompatible|"); ok {
+		conn.Close()
+		return &protocol.IncompatibleError{Detail: reason}
+	}
+	if !strings.HasPrefix(response, "registered|") {
+		conn.Close()
+		if response == "unauthorized" && t.sessionToken != "" {
+			// The session can no longer be resumed, start a new one next time
+			t.sessionToken = ""
+		}
+		return fmt.Errorf("unexpected registration response: %s", response)
+	}
+
+	token, confirmed, _ := strings.Cut(strings.TrimPrefix(response, "registered|"), "|")
+	accepted, err := url.ParseQuery(confirmed)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid transport options from server: %v", err)
+	}
+	transport, err := t.offer.Accept(accepted)
+	if errors.Is(err, ErrIncompatible) {
+		conn.Close()
+		return err
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("unsupported transport from server: %v", err)
+	}
+	if transport.Codec.Name() != t.offer.Codec.Name() {
+		log.Printf("Server doesn't support the %s codec, using %s", t.offer.Codec.Name(), transport.Codec.Name())
+	}
+	if t.offer.Compression != "" && transport.Compression == "" && !transport.Encrypted() {
+		log.Printf("Server doesn't support %s compression", t.offer.Compression)
+	}
+	if t.offer.Encryption != "" && !transport.Encrypted() {
+		log.Printf("WARNING: Server doesn't support encryption, tunnel traffic is sent in the clear")
+	}
+	t.transport = transport
+	if t.opts.TCPUpstream != "" {
+		port, err := strconv.Atoi(accepted.Get(protocol.TCPPortOption))
+		if transport.Version < protocol.TCPVersion || err != nil {
+			conn.Close()
+			return &protocol.IncompatibleError{Detail: "server doesn't support raw TCP tunnels"}
+		}
+		if t.opts.Hostname != "" && accepted.Get(protocol.SNIOption) == "" {
+			conn.Close()
+			return &protocol.IncompatibleError{Detail: "server doesn't pass TLS through to raw TCP tunnels"}
+		}
+		if t.publicPort.Swap(int64(port)) != int64(port) {
+			log.Printf("Exposing %s at %s", t.opts.TCPUpstream, net.JoinHostPort(t.serverHost, strconv.Itoa(port)))
+			if t.opts.Hostname != "" {
+				log.Printf("Passing TLS for %s through to %s", t.opts.Hostname, t.opts.TCPUpstream)
+			}
+		}
+	}
+
+	if token == t.sessionToken {
+		log.Printf("Resumed session with server")
+	} else {
+		log.Printf("Successfully registered with server")
+	}
+	t.sessionToken = token
+	if t.opts.Hostname != "" && t.opts.TCPUpstream == "" && t.apiServer != "" && !t.certStored {
+		// The upload is authorized by the session token
+		if err := t.uploadCertificate(ctx, t.apiServer); err != nil {
+			conn.Close()
+			return err
+		}
+		t.certStored = true
+	}
+	t.restorePaths()
+	// The server takes a new connection as healthy
+	t.reportHealth(func(h *tunnelHealth) { h.reported = true })
+	return nil
+}
+
+// dial connects to the server's registration port, returning the connection
+// after the TLS handshake if any and the socket under it
+func (t *Tunnel) dial(ctx context.Context) (conn, socket net.Conn, err error) {
+	addr := net.JoinHostPort(t.serverHost, strconv.Itoa(t.tcpPort))
+	if conn, err = t.client.dialServer(ctx, addr); err != nil {
+		return nil, nil, err
+	}
+	socket = conn
+	if err := t.settings.applySocket(socket); err != nil {
+		log.Printf("Failed to size socket buffers: %v", err)
+	}
+	if t.tlsConfig != nil {
+		config := t.tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = t.serverHost
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, socket, nil
+}
+
+// run keeps the tunnel connected, reconnecting with the session token so the
+// server restores the client's port and path claims
+func (t *Tunnel) run() {
+	backoff := time.Second
+	for {
+		done := make(chan struct{})
+		go t.startHeartbeat(done)
+		err := t.receiveMessages()
+		close(done)
+		if err != nil || t.ctx.Err() != nil {
+			t.end(err)
+			return
+		}
+		t.status.set("reconnecting")
+
+		for failures := 0; ; failures++ {
+			select {
+			case <-time.After(backoff):
+			case <-t.ctx.Done():
+				return
+			}
+			var err error
+			if t.servers != nil && (failures >= failoverAfter || t.servers.failback.Swap(false)) {
+				log.Println("failing over to another server...")
+				err = t.failover(t.ctx)
+			} else {
+				log.Println("reconnecting to TCP server...")
+				err = t.connect(t.ctx)
+			}
+			if err == nil {
+				backoff = time.Second
+				t.status.set("online")
+				break
+			}
+			if t.ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, ErrIncompatible) {
+				// Retrying can't succeed until one side is upgraded
+				t.end(err)
+				return
+			}
+			log.Printf("failed to reconnect to TCP server: %v", err)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+func (t *Tunnel) sendMessage(message string) error {
+	_, err := t.conn().Write([]byte(message + "\n"))
+	return err
+}
+
+// receiveMessages handles the server's messages until the connection drops,
+// returning an error if the server ended the tunnel
+func (t *Tunnel) receiveMessages() error {
+	for {
+		msg, err := t.reader.ReadMessage()
+		if err != nil {
+			// A malformed frame leaves the connection open but unusable
+			if t.ctx.Err() == nil {
+				log.Printf("Failed to receive message: %v", err)
+			}
+			t.conn().Close()
+			return nil
+		}
+
+		message := msg.Line
+
+		// The registration's TTL lapsed, the server has released the tunnel
+		if message == "expired" {
+			return ErrExpired
+		}
+
+		// Another client took over one of the tunnel's paths
+		if reason, ok := strings.CutPrefix(message, "evicted|"); ok {
+			return fmt.Errorf("%w: %s", ErrEvicted, reason)
+		}
+
+		// Handle heartbeat acknowledgment, which echoes the heartbeat's send
+		// time (format: "heartbeat-ack|<unix nanos>")
+		if message == "heartbeat-ack" || strings.HasPrefix(message, "heartbeat-ack|") {
+			logging.Debugf("Received heartbeat acknowledgment from server")
+			t.reportRTT(strings.TrimPrefix(message, "heartbeat-ack|"))
+			continue
+		}
+
+		// The server reports the tunnel's paths after an update
+		if strings.HasPrefix(message, "paths|") || strings.HasPrefix(message, "paths-error|") {
+			t.handlePaths(message)
+			continue
+		}
+
+		// The server pushed a configuration update (format: "config|<json>")
+		if data, ok := strings.CutPrefix(message, "config|"); ok {
+			t.handleConfig(data)
+			continue
+		}
+
+		// The server sent a command to run (format: "command|<json>")
+		if data, ok := strings.CutPrefix(message, "command|"); ok {
+			t.handleCommand(data)
+			continue
+		}
+
+		// The server broadcast a message (format: "broadcast|<json>")
+		if data, ok := strings.CutPrefix(message, "broadcast|"); ok {
+			t.handleBroadcast(data)
+			continue
+		}
+
+		// Someone connected to the public port of a raw TCP tunnel (format:
+		// "tcp-open|<stream id>")
+		if id, ok := strings.CutPrefix(message, "tcp-open|"); ok {
+			go t.openStream(id)
+			continue
+		}
+
+		// A visitor asked to connect to the raw TCP tunnel directly (format:
+		// "p2p-open|<session>|<rendezvous port>")
+		if data, ok := strings.CutPrefix(message, "p2p-open|"); ok {
+			go t.openP2P(data)
+			continue
+		}
+
+		// The server gave up on a request (format: "cancel|<request id>")
+		if requestID, ok := strings.CutPrefix(message, "cancel|"); ok {
+			t.cancelRequest(requestID)
+			continue
+		}
+
+		// Handle proxied requests (format: "request|<json>")
+		if strings.HasPrefix(message, "request|") {
+			if t.transport.Encrypted() {
+				log.Printf("Ignoring unencrypted request on an encrypted tunnel")
+				continue
+			}
+			req, err := protocol.JSONCodec{}.UnmarshalRequest([]byte(strings.TrimPrefix(message, "request|")))
+			if err != nil {
+				log.Printf("Invalid request from server: %v", err)
+				continue
+			}
+			t.submitRequest(req)
+			continue
+		}
+
+		// Handle chunks of streamed request bodies (format: "body|<json>")
+		if strings.HasPrefix(message, "body|") {
+			if t.transport.Encrypted() {
+				log.Printf("Ignoring unencrypted request body on an encrypted tunnel")
+				continue
+			}
+			chunk, err := protocol.JSONCodec{}.UnmarshalRequest([]byte(strings.TrimPrefix(message, "body|")))
+			if err != nil {
+				log.Printf("Invalid request body from server: %v", err)
+				continue
+			}
+			t.deliverBody(chunk)
+			continue
+		}
+
+		// Handle requests and request bodies framed by the negotiated codec
+		// or compression
+		if frame := msg.Frame; frame != nil {
+			if frame.Kind != "request" && frame.Kind != "body" {
+				log.Printf("Unexpected %s frame from server", frame.Kind)
+				continue
+			}
+			req, err := t.transport.DecodeRequest(*frame)
+			if err != nil {
+				log.Printf("Invalid %s from server: %v", frame.Kind, err)
+				continue
+			}
+			if frame.Kind == "body" {
+				t.deliverBody(req)
+				continue
+			}
+			t.submitRequest(req)
+			continue
+		}
+
+		log.Printf("Received message: '%s'", message)
+	}
+}
+
+func (t *Tunnel) startHeartbeat(done <-chan struct{}) {
+	ticker := time.NewTicker(t.settings.heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.settings.heartbeatReset:
+			ticker.Reset(t.settings.heartbeatInterval())
+			continue
+		case <-ticker.C:
+		}
+		logging.Debugf("Sending heartbeat...")
+		heartbeat := fmt.Sprintf("heartbeat|%d", time.Now().UnixNano())
+		if t.metrics != nil {
+			heartbeat += "|" + t.metrics.encode()
+		}
+		if err := t.sendMessage(heartbeat); err != nil {
+			log.Printf("Failed to send heartbeat: %v", err)
+			return
+		}
+	}
+}
+
+// reportRTT sends the round-trip time of the heartbeat sent at the echoed
+// timestamp back to the server
+func (t *Tunnel) reportRTT(echoed string) {
+	sent, err := strconv.ParseInt(echoed, 10, 64)
+	if err != nil {
+		return
+	}
+	rtt := time.Since(time.Unix(0, sent))
+	logging.Debugf("Heartbeat round trip: %v", rtt)
+	t.status.setRTT(rtt)
+	if err := t.sendMessage("rtt|" + rtt.String()); err != nil {
+		log.Printf("Failed to report heartbeat round trip: %v", err)
+	}
+}
+
+// startHealthCheck periodically probes the handler or upstream and reports
+// changes in its health to the server so it can stop routing to a dead service
+func (t *Tunnel) startHealthCheck(healthPath string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status := "ok"
+		resp, err := t.probe(healthPath, interval)
+		if err != nil {
+			log.Printf("Health check failed: %v", err)
+			status = "fail"
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				log.Printf("Health check returned status: %d", resp.StatusCode)
+				status = "fail"
+			}
+		}
+
+		t.reportHealth(func(h *tunnelHealth) { h.upstream = status == "ok" })
+
+		select {
+		case <-ticker.C:
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// probe sends a health check request to the handler or upstream
+func (t *Tunnel) probe(healthPath string, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+healthPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// Drain the body while the timeout still applies
+	io.Copy(io.Discard, resp.Body)
+	return resp, nil
+}
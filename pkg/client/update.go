@@ -0,0 +1,20 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+
+	"github.com/vikasavn/attachcloudip/pkg/update"
+)
+
+// LatestRelease asks the client's first server for the client release of
+// this platform
+func (c *Client) LatestRelease(ctx context.Context) (*update.Release, error) {
+	return update.Fetch(ctx, c.api, serverURL(c.servers[0])+"/client/latest")
+}
+
+// InstallRelease downloads a release and replaces the binary at executable
+// with it, verifying its signature with key if key is set, see update.Install
+func (c *Client) InstallRelease(ctx context.Context, release *update.Release, key ed25519.PublicKey, executable string) error {
+	return update.Install(ctx, c.api, release, key, executable)
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+var errBodyOverrun = errors.New("request body overran its window")
+
+// uploadBody is the body of a streamed request, read as its chunks arrive
+// from the server. Each chunk read is acknowledged, which lets the server
+// send more.
+type uploadBody struct {
+	tunnel *Tunnel
+	id     string
+	ctx    context.Context // Done when the request is cancelled or forgotten
+	fail   context.CancelCauseFunc
+	chunks chan []byte // Closed after the last chunk
+
+	mu    sync.Mutex
+	ended bool // The last chunk arrived
+
+	buf    []byte
+	eof    bool
+	onRead func() // Called as the upstream makes progress
+}
+
+// startUpload tracks the body of a streamed request until it is forgotten
+func (t *Tunnel) startUpload(ctx context.Context, fail context.CancelCauseFunc, tcpReq *types.Request) *uploadBody {
+	upload := &uploadBody{
+		tunnel: t,
+		id:     tcpReq.ID,
+		ctx:    ctx,
+		fail:   fail,
+		chunks: make(chan []byte, protocol.UploadWindow/protocol.UploadChunkSize+1),
+	}
+	t.requestsMu.Lock()
+	t.uploads[tcpReq.ID] = upload
+	t.requestsMu.Unlock()
+	return upload
+}
+
+// upload returns the body of a streamed request, nil if there isn't one
+func (t *Tunnel) upload(requestID string) *uploadBody {
+	t.requestsMu.Lock()
+	defer t.requestsMu.Unlock()
+	return t.uploads[requestID]
+}
+
+// deliverBody passes a chunk of a streamed request body to its reader. The
+// server's window leaves room for every chunk, so a full queue fails the
+// request rather than stalling the tunnel.
+func (t *Tunnel) deliverBody(chunk *types.Request) {
+	upload := t.upload(chunk.ID)
+	if upload == nil {
+		// The request is done with, or was never streamed
+		return
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if upload.ended {
+		return
+	}
+	select {
+	case upload.chunks <- chunk.Body:
+	default:
+		log.Printf("Failing request %s: %v", chunk.ID, errBodyOverrun)
+		upload.ended = true
+		upload.fail(errBodyOverrun)
+		return
+	}
+	if !chunk.Stream {
+		upload.ended = true
+		close(upload.chunks)
+	}
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+		select {
+		case chunk, ok := <-b.chunks:
+			if !ok {
+				b.eof = true
+				continue
+			}
+			b.buf = chunk
+			if len(chunk) > 0 {
+				b.ack(len(chunk))
+			}
+		case <-b.ctx.Done():
+			return 0, fmt.Errorf("request body not received: %v", context.Cause(b.ctx))
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *uploadBody) Close() error {
+	return nil
+}
+
+// ack tells the server the upstream took a chunk of the body
+func (b *uploadBody) ack(n int) {
+	if b.onRead != nil {
+		b.onRead()
+	}
+	if err := b.tunnel.sendMessage(fmt.Sprintf("body-ack|%s|%d", b.id, n)); err != nil {
+		log.Printf("Failed to acknowledge body of request %s: %v", b.id, err)
+	}
+}
@@ -0,0 +1,100 @@
+// Package events fans out registry changes to subscribers such as the
+// server's /events stream, keeping recent events so subscribers that
+// reconnect can catch up
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	ClientAdded   = "client_added"
+	ClientRemoved = "client_removed"
+	ClientStatus  = "client_status"
+	PathClaimed   = "path_claimed"
+	PathReleased  = "path_released"
+)
+
+// Event is a change to the registry
+type Event struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"client_id"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Status   string    `json:"status,omitempty"` // New status of client_status events
+	Reason   string    `json:"reason,omitempty"` // Why a client was removed, e.g. expired
+}
+
+// Broker publishes events to its subscribers. Subscribers that fall behind
+// by more than their buffer are dropped, and can resume from the last event
+// they saw while it is still in the history.
+type Broker struct {
+	mu          sync.Mutex
+	nextID      uint64
+	history     []Event // Oldest first
+	historySize int
+	subscribers map[chan Event]struct{}
+}
+
+func NewBroker(historySize int) *Broker {
+	return &Broker{
+		nextID:      1,
+		historySize: historySize,
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish assigns the event its ID and time and sends it to every subscriber
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e.ID = b.nextID
+	b.nextID++
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if b.historySize > 0 {
+		b.history = append(b.history, e)
+		if len(b.history) > b.historySize {
+			b.history = b.history[len(b.history)-b.historySize:]
+		}
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// Too far behind, the subscriber sees its channel close
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the events after the one with ID after that are still
+// in the history, and a channel of the events published from now on. The
+// channel is closed if the subscriber falls behind; call cancel when done.
+func (b *Broker) Subscribe(after uint64, buffer int) (missed []Event, events <-chan Event, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if after > 0 {
+		for _, e := range b.history {
+			if e.ID > after {
+				missed = append(missed, e)
+			}
+		}
+	}
+	ch := make(chan Event, buffer)
+	b.subscribers[ch] = struct{}{}
+	return missed, ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
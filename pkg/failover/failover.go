@@ -0,0 +1,163 @@
+package failover
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Role defines whether an instance currently owns the floating IP
+type Role string
+
+const (
+	RoleActive  Role = "active"
+	RoleStandby Role = "standby"
+)
+
+// Provider reassigns a floating IP to a server instance
+type Provider interface {
+	AssignFloatingIP(ctx context.Context, floatingIP string, targetID string) error
+	// CheckFloatingIP verifies the credentials can see the floating IP
+	CheckFloatingIP(ctx context.Context, floatingIP string) error
+}
+
+// Config holds the settings for an active/standby pair
+type Config struct {
+	Role             Role
+	PeerURL          string
+	FloatingIP       string
+	TargetID         string
+	CheckInterval    time.Duration
+	FailureThreshold int
+}
+
+// Monitor watches the active peer's health endpoint from the standby
+// and takes over the floating IP once the peer is considered down
+type Monitor struct {
+	config     Config
+	provider   Provider
+	client     *http.Client
+	onSync     func(ctx context.Context) error
+	onTakeover func()
+	role       Role
+	mu         sync.RWMutex
+}
+
+// NewMonitor creates a new failover monitor
+func NewMonitor(config Config, provider Provider) *Monitor {
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = 5 * time.Second
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 3
+	}
+
+	return &Monitor{
+		config:   config,
+		provider: provider,
+		client:   &http.Client{Timeout: config.CheckInterval},
+		role:     config.Role,
+	}
+}
+
+// OnSync sets the callback used to mirror the active peer's state while healthy
+func (m *Monitor) OnSync(fn func(ctx context.Context) error) {
+	m.onSync = fn
+}
+
+// OnTakeover sets the callback invoked after the floating IP has been reassigned
+func (m *Monitor) OnTakeover(fn func()) {
+	m.onTakeover = fn
+}
+
+// Role returns the current role of this instance
+func (m *Monitor) Role() Role {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.role
+}
+
+// Start begins monitoring the peer until the context is cancelled or a takeover completes
+func (m *Monitor) Start(ctx context.Context) {
+	if m.Role() != RoleStandby {
+		log.Printf("[FAILOVER] Running as %s, peer monitoring disabled", m.Role())
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(m.config.CheckInterval)
+		defer ticker.Stop()
+
+		failures := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := m.checkPeer(ctx); err != nil {
+				failures++
+				log.Printf("[FAILOVER] Peer health check failed (%d/%d): %v",
+					failures, m.config.FailureThreshold, err)
+				if failures < m.config.FailureThreshold {
+					continue
+				}
+
+				if err := m.takeover(ctx); err != nil {
+					log.Printf("[FAILOVER] Takeover failed: %v", err)
+					continue
+				}
+				return
+			}
+
+			failures = 0
+			if m.onSync != nil {
+				if err := m.onSync(ctx); err != nil {
+					log.Printf("[FAILOVER] Failed to sync state from peer: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (m *Monitor) checkPeer(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.config.PeerURL+"/health", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create health request: %v", err)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach peer: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (m *Monitor) takeover(ctx context.Context) error {
+	log.Printf("[FAILOVER] Peer is down, assigning floating IP %s to %s",
+		m.config.FloatingIP, m.config.TargetID)
+
+	if err := m.provider.AssignFloatingIP(ctx, m.config.FloatingIP, m.config.TargetID); err != nil {
+		return fmt.Errorf("failed to assign floating IP: %v", err)
+	}
+
+	m.mu.Lock()
+	m.role = RoleActive
+	m.mu.Unlock()
+
+	if m.onTakeover != nil {
+		m.onTakeover()
+	}
+
+	log.Printf("[FAILOVER] Takeover complete, now active for %s", m.config.FloatingIP)
+	return nil
+}
@@ -0,0 +1,131 @@
+package failover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	digitalOceanAPI = "https://api.digitalocean.com/v2"
+	hetznerAPI      = "https://api.hetzner.cloud/v1"
+)
+
+// NewProvider returns the floating IP provider for the given name
+func NewProvider(name string, apiToken string) (Provider, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	switch name {
+	case "digitalocean":
+		return &DigitalOcean{token: apiToken, baseURL: digitalOceanAPI, client: client}, nil
+	case "hetzner":
+		return &Hetzner{token: apiToken, baseURL: hetznerAPI, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown floating IP provider: %s", name)
+	}
+}
+
+// DigitalOcean assigns DigitalOcean floating (reserved) IPs to droplets
+type DigitalOcean struct {
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+// AssignFloatingIP assigns the floating IP address to the droplet with the given ID
+func (d *DigitalOcean) AssignFloatingIP(ctx context.Context, floatingIP string, targetID string) error {
+	dropletID, err := strconv.Atoi(targetID)
+	if err != nil {
+		return fmt.Errorf("invalid droplet ID %q: %v", targetID, err)
+	}
+
+	payload := map[string]interface{}{
+		"type":       "assign",
+		"droplet_id": dropletID,
+	}
+	url := fmt.Sprintf("%s/floating_ips/%s/actions", d.baseURL, floatingIP)
+	return postAction(ctx, d.client, url, d.token, payload)
+}
+
+// CheckFloatingIP looks the floating IP address up with the API token
+func (d *DigitalOcean) CheckFloatingIP(ctx context.Context, floatingIP string) error {
+	return getResource(ctx, d.client, fmt.Sprintf("%s/floating_ips/%s", d.baseURL, floatingIP), d.token)
+}
+
+// Hetzner assigns Hetzner Cloud floating IPs to servers
+type Hetzner struct {
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+// AssignFloatingIP assigns the floating IP with the given ID to the server with the given ID
+func (h *Hetzner) AssignFloatingIP(ctx context.Context, floatingIP string, targetID string) error {
+	serverID, err := strconv.Atoi(targetID)
+	if err != nil {
+		return fmt.Errorf("invalid server ID %q: %v", targetID, err)
+	}
+
+	payload := map[string]interface{}{
+		"server": serverID,
+	}
+	url := fmt.Sprintf("%s/floating_ips/%s/actions/assign", h.baseURL, floatingIP)
+	return postAction(ctx, h.client, url, h.token, payload)
+}
+
+// CheckFloatingIP looks the floating IP with the given ID up with the API token
+func (h *Hetzner) CheckFloatingIP(ctx context.Context, floatingIP string) error {
+	return getResource(ctx, h.client, fmt.Sprintf("%s/floating_ips/%s", h.baseURL, floatingIP), h.token)
+}
+
+// getResource fetches an API resource, failing unless the token may read it
+func getResource(ctx context.Context, client *http.Client, url, token string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach provider API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("lookup failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func postAction(ctx context.Context, client *http.Client, url, token string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal action payload: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create action request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send action request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("action failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Level controls which messages are written. Messages logged directly with
+// the log package are always written at info.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+)
+
+var level atomic.Int32
+
+func init() {
+	level.Store(int32(LevelInfo))
+}
+
+// ParseLevel parses "debug" or "info"
+func ParseLevel(name string) (Level, error) {
+	switch name {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level: %s", name)
+	}
+}
+
+func (l Level) String() string {
+	if l == LevelDebug {
+		return "debug"
+	}
+	return "info"
+}
+
+// SetLevel changes the level at runtime
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+// GetLevel returns the current level
+func GetLevel() Level {
+	return Level(level.Load())
+}
+
+// Debugf logs a message with the standard logger when debug logging is enabled
+func Debugf(format string, args ...interface{}) {
+	if GetLevel() > LevelDebug {
+		return
+	}
+	log.Output(2, "[DEBUG] "+fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,169 @@
+// Package middleware composes an HTTP frontend from an ordered chain of
+// handler wrappers, each looked up by name and configured with options so
+// operators can pick and scope them per route
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+)
+
+// Middleware wraps a handler
+type Middleware func(http.Handler) http.Handler
+
+// Factory builds a middleware from its configured options
+type Factory func(options map[string]string) (Middleware, error)
+
+// Registry holds middleware factories by name. Besides its own, a registry
+// builds chains from the middleware Register adds for every registry.
+type Registry struct {
+	factories map[string]Factory
+	mu        sync.RWMutex
+}
+
+// NewRegistry creates a registry with only the package-level middleware
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]Factory)}
+}
+
+// global holds the middleware added with Register
+var global = NewRegistry()
+
+// Register makes a middleware available to every registry under name. Like
+// http.Handle, it panics when name is already registered.
+func Register(name string, factory Factory) {
+	global.Register(name, factory)
+}
+
+// Names returns the package-level middleware, sorted
+func Names() []string {
+	return global.Names()
+}
+
+// Build resolves entries into a chain from the package-level middleware
+func Build(entries []Entry) (*Chain, error) {
+	return global.Build(entries)
+}
+
+// Register makes a middleware available to the registry's chains under name,
+// panicking when name is already registered with it or at package level
+func (r *Registry) Register(name string, factory Factory) {
+	if _, ok := r.factory(name); ok {
+		panic("middleware: " + name + " registered twice")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[name] = factory
+}
+
+// Names returns the middleware available to the registry's chains, sorted
+func (r *Registry) Names() []string {
+	seen := make(map[string]bool)
+	for _, registry := range []*Registry{r, global} {
+		registry.mu.RLock()
+		for name := range registry.factories {
+			seen[name] = true
+		}
+		registry.mu.RUnlock()
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// factory looks name up in the registry, then at package level
+func (r *Registry) factory(name string) (Factory, bool) {
+	for _, registry := range []*Registry{r, global} {
+		registry.mu.RLock()
+		factory, ok := registry.factories[name]
+		registry.mu.RUnlock()
+		if ok {
+			return factory, true
+		}
+	}
+	return nil, false
+}
+
+// Entry configures one link of a chain
+type Entry struct {
+	Name    string
+	Paths   []string          // Route patterns the link applies to, every request if empty
+	Options map[string]string // Passed to the middleware's factory
+}
+
+// Chain is an ordered list of middleware. The first entry sees requests
+// first and responses last.
+type Chain struct {
+	links []link
+}
+
+type link struct {
+	name   string
+	wrap   Middleware
+	routes *routing.Table // nil applies to every request
+}
+
+// Build resolves entries into a chain, failing on unknown names, invalid
+// paths, or options their middleware refuses
+func (r *Registry) Build(entries []Entry) (*Chain, error) {
+	chain := &Chain{}
+	for _, entry := range entries {
+		factory, ok := r.factory(entry.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q", entry.Name)
+		}
+		wrap, err := factory(entry.Options)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %v", entry.Name, err)
+		}
+
+		l := link{name: entry.Name, wrap: wrap}
+		if len(entry.Paths) > 0 {
+			l.routes = routing.NewTable()
+			for _, path := range entry.Paths {
+				if err := l.routes.Insert(path, entry.Name); err != nil {
+					return nil, fmt.Errorf("middleware %s: %v", entry.Name, err)
+				}
+			}
+		}
+		chain.links = append(chain.links, l)
+	}
+	return chain, nil
+}
+
+// Names returns the middleware of the chain in order
+func (c *Chain) Names() []string {
+	names := make([]string, len(c.links))
+	for i, l := range c.links {
+		names[i] = l.name
+	}
+	return names
+}
+
+// Then wraps h in the chain
+func (c *Chain) Then(h http.Handler) http.Handler {
+	for i := len(c.links) - 1; i >= 0; i-- {
+		l := c.links[i]
+		wrapped := l.wrap(h)
+		if l.routes == nil {
+			h = wrapped
+			continue
+		}
+		next := h
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := l.routes.Lookup(r.URL.Path); ok {
+				wrapped.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	return h
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idleBucketAge is how long a caller's bucket is kept after it refills
+const idleBucketAge = time.Minute
+
+// Limiter decides whether a key may make another request
+type Limiter interface {
+	// Allow takes one request from key's allowance, or reports how long
+	// until the next one is due
+	Allow(ctx context.Context, key string) (time.Duration, bool)
+}
+
+// RateLimit answers 429 to requests the limiter refuses. Requests key
+// returns "" for are not limited.
+func RateLimit(limiter Limiter, key func(*http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if k == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if wait, ok := limiter.Allow(r.Context(), k); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NewLocalLimiter allows each key rate requests per second with bursts of up
+// to burst, counted in this process only
+func NewLocalLimiter(rate float64, burst int) Limiter {
+	return &limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// ParseRate reads the "rate" (requests per second) and "burst" options of a
+// rate limit, with burst defaulting to the rate rounded up
+func ParseRate(options map[string]string) (float64, int, error) {
+	rate, err := strconv.ParseFloat(options["rate"], 64)
+	if err != nil || rate <= 0 {
+		return 0, 0, fmt.Errorf("rate must be a positive number of requests per second")
+	}
+	burst := int(math.Ceil(rate))
+	if value, ok := options["burst"]; ok {
+		if burst, err = strconv.Atoi(value); err != nil || burst < 1 {
+			return 0, 0, fmt.Errorf("burst must be a positive integer")
+		}
+	}
+	return rate, burst, nil
+}
+
+type limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Allow takes a token from key's bucket, or reports how long until one is due
+func (l *limiter) Allow(ctx context.Context, key string) (time.Duration, bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > idleBucketAge {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep forgets callers whose buckets have been full for a while
+func (l *limiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > refill+idleBucketAge {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/redis"
+)
+
+// gcraScript spaces requests by an emission interval with a burst
+// tolerance, keeping one theoretical arrival time per key. Times come from
+// the Redis clock, so servers with skewed clocks share one view.
+const gcraScript = `
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then tat = now end
+local wait = tat + interval - tolerance - now
+if wait > 0 then return math.ceil(wait) end
+redis.call('SET', KEYS[1], tostring(tat + interval), 'PX', math.ceil((tat + interval - now) / 1000))
+return 0
+`
+
+// redisLimiter enforces one limit across every server sharing a Redis
+type redisLimiter struct {
+	client    *redis.Client
+	prefix    string
+	interval  float64 // Microseconds between requests at the steady rate
+	tolerance float64 // Microseconds of requests allowed ahead of the rate
+	onError   func(error)
+}
+
+// NewRedisLimiter allows each key rate requests per second with bursts of up
+// to burst, counted in Redis under prefix. Keys are allowed while Redis is
+// unreachable, and the errors are reported to onError.
+func NewRedisLimiter(client *redis.Client, prefix string, rate float64, burst int, onError func(error)) Limiter {
+	interval := 1e6 / rate
+	return &redisLimiter{
+		client:    client,
+		prefix:    prefix,
+		interval:  interval,
+		tolerance: interval * float64(burst),
+		onError:   onError,
+	}
+}
+
+func (l *redisLimiter) Allow(ctx context.Context, key string) (time.Duration, bool) {
+	reply, err := l.client.Do(ctx, "EVAL", gcraScript, "1", l.prefix+key,
+		strconv.FormatFloat(l.interval, 'f', 3, 64), strconv.FormatFloat(l.tolerance, 'f', 3, 64))
+	if err != nil {
+		l.onError(err)
+		return 0, true
+	}
+	wait, _ := reply.(int64)
+	if wait > 0 {
+		return time.Duration(wait) * time.Microsecond, false
+	}
+	return 0, true
+}
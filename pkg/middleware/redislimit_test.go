@@ -0,0 +1,127 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/middleware"
+	"github.com/vikasavn/attachcloudip/pkg/redis"
+	"github.com/vikasavn/attachcloudip/pkg/testutil"
+)
+
+// errorLog collects the errors a limiter reports
+type errorLog struct {
+	mu     sync.Mutex
+	errors []error
+}
+
+func (l *errorLog) add(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, err)
+}
+
+func (l *errorLog) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.errors)
+}
+
+// startLimiter starts a fake Redis answering EVAL with the next of waits,
+// in microseconds, and returns a limiter of 4 requests per second with
+// bursts of 2 using it
+func startLimiter(t *testing.T, waits ...string) (*testutil.RedisServer, middleware.Limiter, *errorLog) {
+	t.Helper()
+	var mu sync.Mutex
+	s, err := testutil.StartRedis(func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if args[0] != "EVAL" || len(waits) == 0 {
+			return "-ERR unexpected command\r\n"
+		}
+		reply := waits[0]
+		waits = waits[1:]
+		return reply
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	client := redis.New(s.Addr, "", 0)
+	t.Cleanup(client.Close)
+	errors := &errorLog{}
+	return s, middleware.NewRedisLimiter(client, "limit:", 4, 2, errors.add), errors
+}
+
+func TestRedisLimiter(t *testing.T) {
+	s, limiter, errors := startLimiter(t, ":0\r\n", ":250000\r\n")
+	ctx := context.Background()
+	if wait, ok := limiter.Allow(ctx, "1.2.3.4"); !ok || wait != 0 {
+		t.Fatalf("first request = %s, %v, want allowed", wait, ok)
+	}
+	if wait, ok := limiter.Allow(ctx, "1.2.3.4"); ok || wait != 250*time.Millisecond {
+		t.Fatalf("limited request = %s, %v, want a 250ms wait", wait, ok)
+	}
+	if errors.count() != 0 {
+		t.Fatalf("reported %v", errors.errors)
+	}
+
+	// The key is prefixed and the rate sent as microseconds between requests
+	// and of burst tolerance
+	commands := s.Commands()
+	if len(commands) != 2 {
+		t.Fatalf("sent %d commands, want 2", len(commands))
+	}
+	if got, want := commands[0][2:], []string{"1", "limit:1.2.3.4", "250000.000", "500000.000"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("EVAL arguments = %q, want %q", got, want)
+	}
+}
+
+func TestRedisLimiterAllowsOnErrors(t *testing.T) {
+	s, limiter, errors := startLimiter(t, "-NOSCRIPT script error\r\n", ":nope\r\n", ":0\r\n", ":0\r\n")
+	ctx := context.Background()
+	for i, want := range []int{1, 2, 2} {
+		if _, ok := limiter.Allow(ctx, "key"); !ok {
+			t.Fatalf("request %d refused", i)
+		}
+		if errors.count() != want {
+			t.Fatalf("request %d: reported %d errors, want %d", i, errors.count(), want)
+		}
+	}
+
+	// A restarted Redis fails one request, then the limiter reconnects
+	s.Drop()
+	if _, ok := limiter.Allow(ctx, "key"); !ok || errors.count() != 3 {
+		t.Fatalf("request over a dropped connection = %v with %d errors", ok, errors.count())
+	}
+	if _, ok := limiter.Allow(ctx, "key"); !ok || errors.count() != 3 {
+		t.Fatalf("request after reconnecting = %v with %d errors", ok, errors.count())
+	}
+
+	s.Close()
+	if _, ok := limiter.Allow(ctx, "key"); !ok || errors.count() != 4 {
+		t.Fatalf("request with Redis down = %v with %d errors", ok, errors.count())
+	}
+}
+
+func TestRedisRateLimit(t *testing.T) {
+	_, limiter, _ := startLimiter(t, ":0\r\n", ":1500000\r\n")
+	handler := middleware.RateLimit(limiter, func(r *http.Request) string { return "key" })(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != want {
+			t.Fatalf("request %d = %d, want %d", i, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "2" {
+			t.Fatalf("Retry-After = %q, want 2", w.Header().Get("Retry-After"))
+		}
+	}
+}
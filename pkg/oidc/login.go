@@ -0,0 +1,111 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client signs users in with the authorization code flow
+type Client struct {
+	id       string
+	secret   string
+	scopes   []string
+	verifier *Verifier
+}
+
+// NewClient creates a client registered with issuer as clientID. ID tokens it
+// receives must be intended for clientID.
+func NewClient(issuer, clientID, clientSecret string, scopes []string) *Client {
+	return &Client{
+		id:       clientID,
+		secret:   clientSecret,
+		scopes:   scopes,
+		verifier: NewVerifier(issuer, clientID),
+	}
+}
+
+func (c *Client) endpoints(ctx context.Context) (*discovery, error) {
+	c.verifier.mu.Lock()
+	defer c.verifier.mu.Unlock()
+	provider, err := c.verifier.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" {
+		return nil, fmt.Errorf("OIDC discovery document has no authorization or token endpoint")
+	}
+	return provider, nil
+}
+
+// AuthCodeURL returns the provider's login page, which sends the user back to
+// redirectURI with a code and state
+func (c *Client) AuthCodeURL(ctx context.Context, redirectURI, state, nonce string) (string, error) {
+	provider, err := c.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {c.id},
+		"redirect_uri":  {redirectURI},
+		"scope":         {strings.Join(c.scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems a code for an ID token and returns its verified claims,
+// checking that the token carries nonce
+func (c *Client) Exchange(ctx context.Context, code, redirectURI, nonce string) (Claims, error) {
+	provider, err := c.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.id), url.QueryEscape(c.secret))
+
+	resp, err := c.verifier.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem code: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to redeem code: unexpected status: %d", resp.StatusCode)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+
+	claims, err := c.verifier.Verify(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("ID token nonce doesn't match")
+	}
+	return claims, nil
+}
@@ -0,0 +1,230 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// provider is a fake OpenID Connect provider serving its discovery document,
+// its key set, and a token endpoint that answers with idToken
+type provider struct {
+	*httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	idToken string
+}
+
+func newProvider(t *testing.T) *provider {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &provider{rsaKey: rsaKey, ecKey: ecKey}
+	encode := base64.RawURLEncoding.EncodeToString
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"jwks_uri":               p.URL + "/keys",
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "rsa", "kty": "RSA", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kid": "ec", "kty": "EC", "crv": "P-256", "x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// claims returns valid claims for a token from p to audience
+func (p *provider) claims(audience string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": p.URL,
+		"aud": audience,
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// sign issues a token with header and claims, signed by the key the
+// header's alg and kid name
+func (p *provider) sign(t *testing.T, header map[string]string, claims map[string]interface{}) string {
+	t.Helper()
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch header["kid"] {
+	case "ec":
+		r, s, err := ecdsa.Sign(rand.Reader, p.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, p.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func rs256() map[string]string { return map[string]string{"alg": "RS256", "kid": "rsa"} }
+
+func TestVerify(t *testing.T) {
+	p := newProvider(t)
+	v := NewVerifier(p.URL+"/", "app")
+	for _, header := range []map[string]string{rs256(), {"alg": "ES256", "kid": "ec"}} {
+		claims := p.claims("app")
+		claims["aud"] = []string{"other", "app"}
+		verified, err := v.Verify(context.Background(), p.sign(t, header, claims))
+		if err != nil {
+			t.Fatalf("%s: Verify: %v", header["alg"], err)
+		}
+		if verified["sub"] != "user-1" || len(verified.Strings("aud")) != 2 {
+			t.Fatalf("%s: claims = %v", header["alg"], verified)
+		}
+	}
+}
+
+func TestVerifyRefuses(t *testing.T) {
+	p := newProvider(t)
+	v := NewVerifier(p.URL, "app")
+	other := newProvider(t)
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := p.claims("app")
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	valid := p.sign(t, rs256(), p.claims("app"))
+	parts := strings.Split(valid, ".")
+	flipped := []byte(parts[2])
+	flipped[10] ^= 0x01
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"malformed", "not-a-token"},
+		{"bad header", "!!." + parts[1] + "." + parts[2]},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!"},
+		{"other issuer", p.sign(t, rs256(), with("iss", other.URL))},
+		{"no issuer", p.sign(t, rs256(), with("iss", nil))},
+		{"other audience", p.sign(t, rs256(), with("aud", "other"))},
+		{"no audience", p.sign(t, rs256(), with("aud", nil))},
+		{"expired", p.sign(t, rs256(), with("exp", time.Now().Add(-time.Minute).Unix()))},
+		{"no expiry", p.sign(t, rs256(), with("exp", nil))},
+		{"string expiry", p.sign(t, rs256(), with("exp", "never"))},
+		{"alg none", p.sign(t, map[string]string{"alg": "none", "kid": "rsa"}, p.claims("app"))},
+		{"alg HS256", p.sign(t, map[string]string{"alg": "HS256", "kid": "rsa"}, p.claims("app"))},
+		{"RS256 with the EC key", p.sign(t, map[string]string{"alg": "RS256", "kid": "ec"}, p.claims("app"))},
+		{"ES256 with the RSA key", p.sign(t, map[string]string{"alg": "ES256", "kid": "rsa"}, p.claims("app"))},
+		{"unknown key", p.sign(t, map[string]string{"alg": "RS256", "kid": "missing"}, p.claims("app"))},
+		{"signed by another provider", other.sign(t, rs256(), p.claims("app"))},
+		{"tampered claims", parts[0] + "." + strings.Split(p.sign(t, rs256(), with("sub", "admin")), ".")[1] + "." + parts[2]},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + string(flipped)},
+		{"no signature", parts[0] + "." + parts[1] + "."},
+	}
+	for _, tt := range tests {
+		if _, err := v.Verify(context.Background(), tt.token); err == nil {
+			t.Errorf("%s: Verify accepted the token", tt.name)
+		}
+	}
+	if _, err := v.Verify(context.Background(), valid); err != nil {
+		t.Fatalf("Verify of the untampered token: %v", err)
+	}
+
+	// Without an audience every token is refused
+	if _, err := NewVerifier(p.URL, "").Verify(context.Background(), p.sign(t, rs256(), with("aud", ""))); err == nil {
+		t.Error("a verifier without an audience accepted a token")
+	}
+}
+
+func TestVerifyUnreachableProvider(t *testing.T) {
+	p := newProvider(t)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			w.Write([]byte(`{"jwks_uri": ""}`))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer broken.Close()
+	for _, issuer := range []string{broken.URL, broken.URL + "/missing"} {
+		claims := p.claims("app")
+		claims["iss"] = issuer
+		if _, err := NewVerifier(issuer, "app").Verify(context.Background(), p.sign(t, rs256(), claims)); err == nil {
+			t.Errorf("Verify accepted a token without the keys of %s", issuer)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p := newProvider(t)
+	c := NewClient(p.URL, "app", "secret", []string{"openid"})
+	claims := p.claims("app")
+	claims["nonce"] = "nonce-1"
+	p.idToken = p.sign(t, rs256(), claims)
+
+	target, err := c.AuthCodeURL(context.Background(), "https://app.example/cb", "state-1", "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(target, p.URL+"/authorize?") || !strings.Contains(target, "state=state-1") {
+		t.Fatalf("AuthCodeURL = %s", target)
+	}
+	if _, err := c.Exchange(context.Background(), "good-code", "https://app.example/cb", "nonce-1"); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	if _, err := c.Exchange(context.Background(), "good-code", "https://app.example/cb", "nonce-2"); err == nil {
+		t.Error("Exchange accepted an ID token for another nonce")
+	}
+	if _, err := c.Exchange(context.Background(), "bad-code", "https://app.example/cb", "nonce-1"); err == nil {
+		t.Error("Exchange accepted a refused code")
+	}
+	// An ID token for another client is refused even with the right nonce
+	claims["aud"] = "other-app"
+	p.idToken = p.sign(t, rs256(), claims)
+	if _, err := c.Exchange(context.Background(), "good-code", "https://app.example/cb", "nonce-1"); err == nil {
+		t.Error("Exchange accepted an ID token for another client")
+	}
+}
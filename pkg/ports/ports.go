@@ -0,0 +1,197 @@
+// Package ports hands out TCP ports from configured ranges, skipping ports
+// reserved for a client and ports the OS reports in use
+package ports
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Range is an inclusive span of ports
+type Range struct {
+	Min, Max int
+}
+
+func (r Range) contains(port int) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// Allocator allocates ports from its ranges. Released ports are handed out
+// again first, then the ranges are walked from where the last allocation
+// left off.
+type Allocator struct {
+	mu       sync.Mutex
+	ranges   []Range
+	next     int // Next port to try
+	inUse    map[int]bool
+	reserved map[int]string // Port -> client it is reserved for
+	released []int
+	// Available reports whether the OS lets the port be listened on, every
+	// port is if nil
+	Available func(port int) bool
+}
+
+// New returns an allocator over the ranges that checks ports with Free
+func New(ranges ...Range) *Allocator {
+	a := &Allocator{
+		ranges:    ranges,
+		inUse:     make(map[int]bool),
+		reserved:  make(map[int]string),
+		Available: Free,
+	}
+	if len(ranges) > 0 {
+		a.next = ranges[0].Min
+	}
+	return a
+}
+
+// Of returns an allocator over exactly the given ports
+func Of(ports []int) *Allocator {
+	ranges := make([]Range, 0, len(ports))
+	for _, port := range ports {
+		ranges = append(ranges, Range{Min: port, Max: port})
+	}
+	return New(ranges...)
+}
+
+// Free reports whether nothing is listening on the port
+func Free(port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// Reserve keeps the port for the client, excluding it from Allocate
+func (a *Allocator) Reserve(port int, clientID string) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port: %d", port)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if owner, ok := a.reserved[port]; ok && owner != clientID {
+		return fmt.Errorf("port %d is already reserved for client %s", port, owner)
+	}
+	if a.inUse[port] {
+		return fmt.Errorf("port %d is in use", port)
+	}
+	a.reserved[port] = clientID
+	return nil
+}
+
+// Unreserve returns a reserved port to the pool
+func (a *Allocator) Unreserve(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.reserved, port)
+}
+
+// Reservation returns the port reserved for the client
+func (a *Allocator) Reservation(clientID string) (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for port, owner := range a.reserved {
+		if owner == clientID {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// Reserved reports whether the port is reserved for a client
+func (a *Allocator) Reserved(port int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.reserved[port]
+	return ok
+}
+
+// Allocate hands out a free port
+func (a *Allocator) Allocate() (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for len(a.released) > 0 {
+		port := a.released[len(a.released)-1]
+		a.released = a.released[:len(a.released)-1]
+		if a.usableLocked(port) {
+			a.inUse[port] = true
+			return port, nil
+		}
+	}
+
+	size := a.sizeLocked()
+	for i := 0; i < size; i++ {
+		port := a.next
+		a.advanceLocked()
+		if a.usableLocked(port) {
+			a.inUse[port] = true
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no available ports")
+}
+
+func (a *Allocator) usableLocked(port int) bool {
+	if a.inUse[port] {
+		return false
+	}
+	if _, reserved := a.reserved[port]; reserved {
+		return false
+	}
+	return a.Available == nil || a.Available(port)
+}
+
+// advanceLocked moves next to the following port, wrapping around to the
+// first range after the last
+func (a *Allocator) advanceLocked() {
+	for i, r := range a.ranges {
+		if !r.contains(a.next) {
+			continue
+		}
+		if a.next < r.Max {
+			a.next++
+		} else {
+			a.next = a.ranges[(i+1)%len(a.ranges)].Min
+		}
+		return
+	}
+}
+
+// Release returns an allocated port to the pool. Reserved ports stay with
+// their client.
+func (a *Allocator) Release(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.inUse[port] {
+		return
+	}
+	delete(a.inUse, port)
+	a.released = append(a.released, port)
+}
+
+// InUse returns how many ports are allocated
+func (a *Allocator) InUse() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.inUse)
+}
+
+// Size returns how many ports the ranges span
+func (a *Allocator) Size() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sizeLocked()
+}
+
+func (a *Allocator) sizeLocked() int {
+	size := 0
+	for _, r := range a.ranges {
+		size += r.Max - r.Min + 1
+	}
+	return size
+}
@@ -0,0 +1,15 @@
+package protocol
+
+// BenchVersion is the first protocol version whose clients answer tunnel
+// benchmarks
+const BenchVersion = 7
+
+// A benchmark request is a request of type bench, which the client answers
+// itself without reaching its upstream: status 200 with a body of as many
+// zero bytes as the BenchSizeParam query parameter asks for, whatever body
+// the request carried. Older clients would pass it on to their upstream.
+const (
+	BenchSizeParam = "size"
+	// MaxBenchPayload bounds the request and response bodies of a benchmark
+	MaxBenchPayload = 16 << 20
+)
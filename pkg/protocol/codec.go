@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// Codec serializes the requests and responses sent over a tunnel
+type Codec interface {
+	Name() string
+	MarshalRequest(req *types.Request) ([]byte, error)
+	UnmarshalRequest(data []byte) (*types.Request, error)
+	MarshalResponse(resp *types.Response) ([]byte, error)
+	UnmarshalResponse(data []byte) (*types.Response, error)
+}
+
+// JSONCodec is the default codec, understood by every client and server
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string { return "json" }
+
+func (JSONCodec) MarshalRequest(req *types.Request) ([]byte, error) {
+	return json.Marshal(req)
+}
+
+func (JSONCodec) UnmarshalRequest(data []byte) (*types.Request, error) {
+	var req types.Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (JSONCodec) MarshalResponse(resp *types.Response) ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+func (JSONCodec) UnmarshalResponse(data []byte) (*types.Response, error) {
+	var resp types.Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+var codecs = map[string]Codec{
+	"json":    JSONCodec{},
+	"msgpack": MsgpackCodec{},
+}
+
+// CodecByName returns the named codec
+func CodecByName(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec: %s", name)
+	}
+	return codec, nil
+}
+
+// NegotiateCodec picks the first codec of the client's preference list this
+// side supports, falling back to JSON
+func NegotiateCodec(offered []string) Codec {
+	for _, name := range offered {
+		if codec, ok := codecs[name]; ok {
+			return codec
+		}
+	}
+	return JSONCodec{}
+}
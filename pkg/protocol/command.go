@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// CommandVersion is the first protocol version whose clients run remote
+// commands
+const CommandVersion = 4
+
+// Commands an admin can run on a connected client
+const (
+	CommandReconnect    = "reconnect"     // Reconnect, resuming the session
+	CommandDrain        = "drain"         // Take no new requests and wait for those in flight
+	CommandUndrain      = "undrain"       // Take requests again after a drain
+	CommandRefreshPaths = "refresh-paths" // Claim the client's paths again
+	CommandDebug        = "debug"         // Turn debug logging "on" or "off"
+)
+
+// Command is a command the server sends to a connected client as
+// "command|<json>". The client answers "command-result|<json>" with a
+// CommandResult once the command finished.
+type Command struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Args string `json:"args,omitempty"` // "on" or "off" for debug, how long to wait for drain
+}
+
+// CommandResult is a client's answer to a command
+type CommandResult struct {
+	ID     string `json:"id"`
+	OK     bool   `json:"ok"`
+	Output string `json:"output,omitempty"` // What the command did, or why it failed
+}
+
+// DefaultDrainTimeout bounds a drain without args
+const DefaultDrainTimeout = 30 * time.Second
+
+// Validate checks that the command is known and its args suit it
+func (c Command) Validate() error {
+	switch c.Name {
+	case CommandReconnect, CommandUndrain, CommandRefreshPaths:
+		if c.Args != "" {
+			return fmt.Errorf("%s takes no args", c.Name)
+		}
+	case CommandDrain:
+		if _, err := c.DrainTimeout(); err != nil {
+			return err
+		}
+	case CommandDebug:
+		if c.Args != "on" && c.Args != "off" {
+			return fmt.Errorf("debug takes \"on\" or \"off\"")
+		}
+	default:
+		return fmt.Errorf("unknown command %q", c.Name)
+	}
+	return nil
+}
+
+// DrainTimeout returns how long a drain waits for requests in flight
+func (c Command) DrainTimeout() (time.Duration, error) {
+	if c.Args == "" {
+		return DefaultDrainTimeout, nil
+	}
+	timeout, err := time.ParseDuration(c.Args)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("drain takes a positive duration, e.g. 1m")
+	}
+	return timeout, nil
+}
+
+// Broadcast is a message the server sends to connected clients as
+// "broadcast|<json>". Clients log it and pass it to their handler if any.
+type Broadcast struct {
+	ID      string    `json:"id"`
+	Topic   string    `json:"topic,omitempty"`
+	Message string    `json:"message"`
+	SentAt  time.Time `json:"sent_at"`
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"errors"
+	"time"
+)
+
+// ConfigVersion is the first protocol version whose clients accept pushed
+// configuration
+const ConfigVersion = 3
+
+// ClientConfig is a configuration update the server pushes to a connected
+// client as "config|<json>". The client answers "config-ack|<revision>" once
+// it applied the update, or "config-error|<revision>|<reason>". Unset fields
+// leave the client's setting as it is.
+type ClientConfig struct {
+	Revision            int64  `json:"revision"`                        // Increases with each push
+	HeartbeatIntervalMs *int64 `json:"heartbeat_interval_ms,omitempty"` // Between heartbeats
+	RequestTimeoutMs    *int64 `json:"request_timeout_ms,omitempty"`    // Wait for each response, 0 until the server gives up
+	ReadBuffer          *int   `json:"read_buffer,omitempty"`           // Socket receive buffer of the tunnel connection in bytes
+	WriteBuffer         *int   `json:"write_buffer,omitempty"`          // Socket send buffer of the tunnel connection in bytes
+	Bandwidth           *int64 `json:"bandwidth,omitempty"`             // Bytes per second the tunnel carries each way, 0 lifts the cap
+	Reregister          bool   `json:"reregister,omitempty"`            // Reconnect with a new session
+}
+
+// minHeartbeatInterval keeps pushed heartbeats from flooding the server
+const minHeartbeatInterval = 100 * time.Millisecond
+
+// Validate checks that the update changes something and that its settings
+// are in range
+func (c ClientConfig) Validate() error {
+	if c.HeartbeatIntervalMs == nil && c.RequestTimeoutMs == nil && c.ReadBuffer == nil &&
+		c.WriteBuffer == nil && c.Bandwidth == nil && !c.Reregister {
+		return errors.New("config update changes nothing")
+	}
+	if c.HeartbeatIntervalMs != nil && time.Duration(*c.HeartbeatIntervalMs)*time.Millisecond < minHeartbeatInterval {
+		return errors.New("heartbeat_interval_ms must be at least 100")
+	}
+	if c.RequestTimeoutMs != nil && *c.RequestTimeoutMs < 0 {
+		return errors.New("request_timeout_ms must not be negative")
+	}
+	if (c.ReadBuffer != nil && *c.ReadBuffer <= 0) || (c.WriteBuffer != nil && *c.WriteBuffer <= 0) {
+		return errors.New("buffer sizes must be positive")
+	}
+	if c.Bandwidth != nil && *c.Bandwidth < 0 {
+		return errors.New("bandwidth must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// EncryptionX25519 encrypts frame payloads with AES-256-GCM under keys from
+// an ephemeral X25519 exchange made at registration. The exchange is not
+// authenticated, so it protects against eavesdropping but not against an
+// active man in the middle; use TLS for that.
+const EncryptionX25519 = "x25519-aes256gcm"
+
+// tunnelCipher seals one direction of the tunnel and opens the other
+type tunnelCipher struct {
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	counter atomic.Uint64 // Nonce of the last sealed payload
+	writeMu sync.Mutex    // Held from sealing a frame until it is written
+	// received is the nonce of the last payload opened, which the next one
+	// has to exceed so that replayed payloads are refused
+	received uint64
+	recvMu   sync.Mutex
+}
+
+// newKeyExchange creates the ephemeral key of one side of the exchange
+func newKeyExchange() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key exchange key: %v", err)
+	}
+	return key, nil
+}
+
+func encodePublicKey(key *ecdh.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+// newTunnelCipher completes the exchange with the peer's public key and
+// derives a key for each direction
+func newTunnelCipher(private *ecdh.PrivateKey, peerKey string, isServer bool) (*tunnelCipher, error) {
+	peerBytes, err := base64.RawURLEncoding.DecodeString(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer key: %v", err)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(peerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer key: %v", err)
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failed: %v", err)
+	}
+
+	// Bind the keys to both public keys, client first
+	clientKey, serverKey := peerBytes, private.PublicKey().Bytes()
+	if !isServer {
+		clientKey, serverKey = serverKey, clientKey
+	}
+	info := append([]byte(EncryptionX25519), clientKey...)
+	info = append(info, serverKey...)
+	keys := hkdfSHA256(secret, info, 64)
+
+	toServer, err := newGCM(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := newGCM(keys[32:])
+	if err != nil {
+		return nil, err
+	}
+	if isServer {
+		return &tunnelCipher{send: toClient, recv: toServer}, nil
+	}
+	return &tunnelCipher{send: toServer, recv: toClient}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// hkdfSHA256 derives length bytes from secret (RFC 5869, empty salt)
+func hkdfSHA256(secret, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for i := byte(1); len(out) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// seal encrypts a payload, prefixing the nonce it used
+func (c *tunnelCipher) seal(plaintext []byte) []byte {
+	nonce := make([]byte, c.send.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.counter.Add(1))
+	return c.send.Seal(nonce, nonce, plaintext, nil)
+}
+
+// open decrypts a payload sealed by the peer
+func (c *tunnelCipher) open(sealed []byte) ([]byte, error) {
+	size := c.recv.NonceSize()
+	if len(sealed) < size+c.recv.Overhead() {
+		return nil, fmt.Errorf("encrypted payload too short")
+	}
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	if counter := binary.BigEndian.Uint64(sealed[size-8 : size]); counter <= c.received {
+		return nil, fmt.Errorf("replayed or reordered encrypted payload")
+	}
+	plaintext, err := c.recv.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %v", err)
+	}
+	c.received = binary.BigEndian.Uint64(sealed[size-8 : size])
+	return plaintext, nil
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MaxFrameSize bounds the payload of a single tunnel frame
+const MaxFrameSize = 64 << 20
+
+// framePrefix starts the header line of a binary frame. The tunnel is
+// otherwise newline-delimited text, so binary payloads are length-prefixed:
+//
+//	frame|<kind>|<length>[|c]\n<length bytes>
+//
+// where c marks a payload compressed with the negotiated compression.
+const framePrefix = "frame|"
+
+// Frame is a length-prefixed binary message on the tunnel
+type Frame struct {
+	Kind       string // e.g. "request" or "response"
+	Compressed bool
+	Payload    []byte
+}
+
+// IsFrame reports whether a line read from the tunnel is a frame header
+func IsFrame(line string) bool {
+	return strings.HasPrefix(line, framePrefix)
+}
+
+// WriteFrame writes the frame with a single Write, so frames from concurrent
+// writers don't interleave. It returns the bytes written.
+func WriteFrame(w io.Writer, f Frame) (int, error) {
+	if len(f.Payload) > MaxFrameSize {
+		return 0, fmt.Errorf("frame of %d bytes exceeds the limit of %d", len(f.Payload), MaxFrameSize)
+	}
+	header := framePrefix + f.Kind + "|" + strconv.Itoa(len(f.Payload))
+	if f.Compressed {
+		header += "|c"
+	}
+	buf := make([]byte, 0, len(header)+1+len(f.Payload))
+	buf = append(buf, header...)
+	buf = append(buf, '\n')
+	buf = append(buf, f.Payload...)
+	return w.Write(buf)
+}
+
+// ReadFrame reads the payload of the frame whose header line was just read
+func ReadFrame(r *bufio.Reader, header string) (Frame, error) {
+	fields := strings.Split(strings.TrimSpace(strings.TrimPrefix(header, framePrefix)), "|")
+	if len(fields) != 2 && !(len(fields) == 3 && fields[2] == "c") {
+		return Frame{}, fmt.Errorf("invalid frame header: %q", header)
+	}
+	size, err := strconv.Atoi(fields[1])
+	if err != nil || size < 0 || size > MaxFrameSize {
+		return Frame{}, fmt.Errorf("invalid frame length: %q", fields[1])
+	}
+	f := Frame{Kind: fields[0], Compressed: len(fields) == 3, Payload: make([]byte, size)}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return Frame{}, fmt.Errorf("failed to read frame: %v", err)
+	}
+	return f, nil
+}
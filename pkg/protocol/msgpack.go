@@ -0,0 +1,625 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// MsgpackCodec encodes requests and responses as msgpack maps keyed by their
+// JSON field names. Bodies are sent as raw bytes instead of base64, and
+// Request.Payload is not carried.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string { return "msgpack" }
+
+func (MsgpackCodec) MarshalRequest(req *types.Request) ([]byte, error) {
+	w := &msgpackWriter{}
+	w.writeMapLen(13)
+	w.writeString("id")
+	w.writeString(req.ID)
+	w.writeString("type")
+	w.writeString(string(req.Type))
+	w.writeString("path")
+	w.writeString(req.Path)
+	w.writeString("method")
+	w.writeString(req.Method)
+	w.writeString("headers")
+	w.writeHeader(req.Headers)
+	w.writeString("body")
+	w.writeBytes(req.Body)
+	w.writeString("timestamp")
+	w.writeInt(req.Timestamp)
+	w.writeString("query_params")
+	w.writeStringMap(req.QueryParams)
+	w.writeString("host")
+	w.writeString(req.Host)
+	w.writeString("protocol")
+	w.writeString(req.Protocol)
+	w.writeString("client_id")
+	w.writeString(req.ClientID)
+	w.writeString("deadline")
+	w.writeInt(req.Deadline)
+	w.writeString("stream")
+	w.writeBool(req.Stream)
+	return w.buf, nil
+}
+
+func (MsgpackCodec) UnmarshalRequest(data []byte) (*types.Request, error) {
+	r := &msgpackReader{data: data}
+	req := &types.Request{}
+	err := r.readFields(func(key string) error {
+		var err error
+		switch key {
+		case "id":
+			req.ID, err = r.readString()
+		case "type":
+			var t string
+			t, err = r.readString()
+			req.Type = types.RequestType(t)
+		case "path":
+			req.Path, err = r.readString()
+		case "method":
+			req.Method, err = r.readString()
+		case "headers":
+			req.Headers, err = r.readHeader()
+		case "body":
+			req.Body, err = r.readBytes()
+		case "timestamp":
+			req.Timestamp, err = r.readInt()
+		case "query_params":
+			req.QueryParams, err = r.readStringMap()
+		case "host":
+			req.Host, err = r.readString()
+		case "protocol":
+			req.Protocol, err = r.readString()
+		case "client_id":
+			req.ClientID, err = r.readString()
+		case "deadline":
+			req.Deadline, err = r.readInt()
+		case "stream":
+			req.Stream, err = r.readBool()
+		default:
+			err = r.skip(0)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode msgpack request: %v", err)
+	}
+	return req, nil
+}
+
+func (MsgpackCodec) MarshalResponse(resp *types.Response) ([]byte, error) {
+	w := &msgpackWriter{}
+	w.writeMapLen(11)
+	w.writeString("request_id")
+	w.writeString(resp.RequestID)
+	w.writeString("status_code")
+	w.writeInt(int64(resp.StatusCode))
+	w.writeString("headers")
+	w.writeHeader(resp.Headers)
+	w.writeString("body")
+	w.writeBytes(resp.Body)
+	w.writeString("error")
+	w.writeString(resp.Error)
+	w.writeString("timestamp")
+	w.writeInt(resp.Timestamp)
+	w.writeString("port")
+	w.writeInt(int64(resp.Port))
+	w.writeString("client_id")
+	w.writeString(resp.ClientID)
+	w.writeString("protocol")
+	w.writeString(resp.Protocol)
+	w.writeString("content_type")
+	w.writeString(resp.ContentType)
+	w.writeString("stream")
+	w.writeBool(resp.Stream)
+	return w.buf, nil
+}
+
+func (MsgpackCodec) UnmarshalResponse(data []byte) (*types.Response, error) {
+	r := &msgpackReader{data: data}
+	resp := &types.Response{}
+	err := r.readFields(func(key string) error {
+		var err error
+		var n int64
+		switch key {
+		case "request_id":
+			resp.RequestID, err = r.readString()
+		case "status_code":
+			n, err = r.readInt()
+			resp.StatusCode = int(n)
+		case "headers":
+			resp.Headers, err = r.readHeader()
+		case "body":
+			resp.Body, err = r.readBytes()
+		case "error":
+			resp.Error, err = r.readString()
+		case "timestamp":
+			resp.Timestamp, err = r.readInt()
+		case "port":
+			n, err = r.readInt()
+			resp.Port = int(n)
+		case "client_id":
+			resp.ClientID, err = r.readString()
+		case "protocol":
+			resp.Protocol, err = r.readString()
+		case "content_type":
+			resp.ContentType, err = r.readString()
+		case "stream":
+			resp.Stream, err = r.readBool()
+		default:
+			err = r.skip(0)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode msgpack response: %v", err)
+	}
+	return resp, nil
+}
+
+// msgpackWriter appends msgpack values to a buffer
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) writeNil() {
+	w.buf = append(w.buf, 0xc0)
+}
+
+func (w *msgpackWriter) writeBool(v bool) {
+	if v {
+		w.buf = append(w.buf, 0xc3)
+	} else {
+		w.buf = append(w.buf, 0xc2)
+	}
+}
+
+func (w *msgpackWriter) writeInt(v int64) {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		w.buf = append(w.buf, byte(v))
+	case v < 0 && v >= -32:
+		w.buf = append(w.buf, byte(int8(v)))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		w.buf = append(w.buf, 0xd2)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(int32(v)))
+	default:
+		w.buf = append(w.buf, 0xd3)
+		w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v))
+	}
+}
+
+func (w *msgpackWriter) writeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		w.buf = append(w.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xda)
+		w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, 0xdb)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+	}
+	w.buf = append(w.buf, s...)
+}
+
+func (w *msgpackWriter) writeBytes(b []byte) {
+	if b == nil {
+		w.writeNil()
+		return
+	}
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xc5)
+		w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, 0xc6)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+	}
+	w.buf = append(w.buf, b...)
+}
+
+func (w *msgpackWriter) writeArrayLen(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xdc)
+		w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, 0xdd)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+	}
+}
+
+func (w *msgpackWriter) writeMapLen(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xde)
+		w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, 0xdf)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+	}
+}
+
+func (w *msgpackWriter) writeHeader(h http.Header) {
+	if h == nil {
+		w.writeNil()
+		return
+	}
+	w.writeMapLen(len(h))
+	for key, values := range h {
+		w.writeString(key)
+		w.writeArrayLen(len(values))
+		for _, v := range values {
+			w.writeString(v)
+		}
+	}
+}
+
+func (w *msgpackWriter) writeStringMap(m map[string]string) {
+	if m == nil {
+		w.writeNil()
+		return
+	}
+	w.writeMapLen(len(m))
+	for key, value := range m {
+		w.writeString(key)
+		w.writeString(value)
+	}
+}
+
+// msgpackReader decodes msgpack values from a buffer
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *msgpackReader) readN(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.pos {
+		return nil, fmt.Errorf("length %d exceeds remaining data", n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *msgpackReader) readUint(size int) (uint64, error) {
+	b, err := r.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// peekNil consumes a nil value if one is next
+func (r *msgpackReader) peekNil() bool {
+	if r.pos < len(r.data) && r.data[r.pos] == 0xc0 {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+func (r *msgpackReader) readBool() (bool, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return false, err
+	}
+	switch b {
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	}
+	return false, fmt.Errorf("expected bool, got 0x%02x", b)
+}
+
+func (r *msgpackReader) readInt() (int64, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	}
+	var v uint64
+	switch b {
+	case 0xcc, 0xd0:
+		v, err = r.readUint(1)
+	case 0xcd, 0xd1:
+		v, err = r.readUint(2)
+	case 0xce, 0xd2:
+		v, err = r.readUint(4)
+	case 0xcf, 0xd3:
+		v, err = r.readUint(8)
+	default:
+		return 0, fmt.Errorf("expected integer, got type 0x%02x", b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch b {
+	case 0xd0:
+		return int64(int8(v)), nil
+	case 0xd1:
+		return int64(int16(v)), nil
+	case 0xd2:
+		return int64(int32(v)), nil
+	case 0xcf:
+		if v > math.MaxInt64 {
+			return 0, fmt.Errorf("integer overflows int64")
+		}
+	}
+	return int64(v), nil
+}
+
+// readLen reads the length of a value of one family: its fixed format (if
+// fixMask is set) carries the length in the type byte, the sized formats in
+// the following 1, 2, or 4 bytes
+func (r *msgpackReader) readLen(b byte, fixMask, fixBase byte, sized [3]byte) (int, bool, error) {
+	if fixMask != 0 && b&fixMask == fixBase {
+		return int(b &^ fixMask), true, nil
+	}
+	for i, t := range sized {
+		if t != 0 && b == t {
+			n, err := r.readUint(1 << i)
+			return int(n), true, err
+		}
+	}
+	return 0, false, nil
+}
+
+func (r *msgpackReader) readString() (string, error) {
+	b, err := r.readBytes()
+	return string(b), err
+}
+
+// readBytes reads a bin or str value as bytes, nil for msgpack nil
+func (r *msgpackReader) readBytes() ([]byte, error) {
+	if r.peekNil() {
+		return nil, nil
+	}
+	b, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	n, ok, err := r.readLen(b, 0xe0, 0xa0, [3]byte{0xd9, 0xda, 0xdb})
+	if !ok {
+		n, ok, err = r.readLen(b, 0, 0, [3]byte{0xc4, 0xc5, 0xc6})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("expected string or binary, got type 0x%02x", b)
+	}
+	data, err := r.readN(n)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	copy(out, data)
+	return out, nil
+}
+
+func (r *msgpackReader) readArrayLen() (int, error) {
+	if r.peekNil() {
+		return 0, nil
+	}
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	n, ok, err := r.readLen(b, 0xf0, 0x90, [3]byte{0, 0xdc, 0xdd})
+	if err == nil && !ok {
+		err = fmt.Errorf("expected array, got type 0x%02x", b)
+	}
+	return n, err
+}
+
+// readMapLen returns the number of entries of the next map, -1 for nil
+func (r *msgpackReader) readMapLen() (int, error) {
+	if r.peekNil() {
+		return -1, nil
+	}
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	n, ok, err := r.readLen(b, 0xf0, 0x80, [3]byte{0, 0xde, 0xdf})
+	if err == nil && !ok {
+		err = fmt.Errorf("expected map, got type 0x%02x", b)
+	}
+	return n, err
+}
+
+// readFields reads a map with string keys, calling field to decode each value
+func (r *msgpackReader) readFields(field func(key string) error) error {
+	n, err := r.readMapLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return err
+		}
+		if err := field(key); err != nil {
+			return fmt.Errorf("field %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (r *msgpackReader) readHeader() (http.Header, error) {
+	n, err := r.readMapLen()
+	if err != nil || n < 0 {
+		return nil, err
+	}
+	h := make(http.Header, min(n, len(r.data)-r.pos))
+	for i := 0; i < n; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		count, err := r.readArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		values := make([]string, 0, min(count, len(r.data)-r.pos))
+		for j := 0; j < count; j++ {
+			v, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		h[key] = values
+	}
+	return h, nil
+}
+
+func (r *msgpackReader) readStringMap() (map[string]string, error) {
+	n, err := r.readMapLen()
+	if err != nil || n < 0 {
+		return nil, err
+	}
+	m := make(map[string]string, min(n, len(r.data)-r.pos))
+	for i := 0; i < n; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// maxSkipDepth bounds the nesting of unknown values that are skipped
+const maxSkipDepth = 32
+
+// skip discards the next value, whatever its type
+func (r *msgpackReader) skip(depth int) error {
+	if depth > maxSkipDepth {
+		return fmt.Errorf("value nested too deeply")
+	}
+	b, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	var size, count int
+	switch {
+	case b <= 0x7f, b >= 0xe0, b == 0xc0, b == 0xc2, b == 0xc3:
+		return nil
+	case b&0xe0 == 0xa0:
+		size = int(b & 0x1f)
+	case b&0xf0 == 0x90:
+		count = int(b & 0x0f)
+	case b&0xf0 == 0x80:
+		count = 2 * int(b&0x0f)
+	default:
+		switch b {
+		case 0xcc, 0xd0:
+			size = 1
+		case 0xcd, 0xd1:
+			size = 2
+		case 0xce, 0xd2, 0xca:
+			size = 4
+		case 0xcf, 0xd3, 0xcb:
+			size = 8
+		case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+			size = 1 + 1<<(b-0xd4) // Extension type plus fixed data
+		case 0xc4, 0xd9, 0xc7:
+			n, err := r.readUint(1)
+			size = int(n)
+			if b == 0xc7 {
+				size++
+			}
+			if err != nil {
+				return err
+			}
+		case 0xc5, 0xda, 0xc8:
+			n, err := r.readUint(2)
+			size = int(n)
+			if b == 0xc8 {
+				size++
+			}
+			if err != nil {
+				return err
+			}
+		case 0xc6, 0xdb, 0xc9:
+			n, err := r.readUint(4)
+			size = int(n)
+			if b == 0xc9 {
+				size++
+			}
+			if err != nil {
+				return err
+			}
+		case 0xdc, 0xdd:
+			n, err := r.readUint(2 << (b - 0xdc))
+			if err != nil {
+				return err
+			}
+			count = int(n)
+		case 0xde, 0xdf:
+			n, err := r.readUint(2 << (b - 0xde))
+			if err != nil {
+				return err
+			}
+			count = 2 * int(n)
+		default:
+			return fmt.Errorf("unsupported type 0x%02x", b)
+		}
+	}
+	if _, err := r.readN(size); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		if err := r.skip(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	codec := MsgpackCodec{}
+	req := &types.Request{
+		ID:          "req-1",
+		Type:        types.RequestType("http"),
+		Path:        "/api/items",
+		Method:      http.MethodPost,
+		Headers:     http.Header{"Content-Type": {"application/json"}, "X-Multi": {"a", "b"}},
+		Body:        []byte("{\"binary\":\"\x00\xff\"}"),
+		Timestamp:   -1234567890123,
+		QueryParams: map[string]string{"page": "2", "empty": ""},
+		Host:        "example.com",
+		Protocol:    "HTTP/1.1",
+		ClientID:    "client-a",
+		Deadline:    1 << 40,
+		Stream:      true,
+	}
+	data, err := codec.MarshalRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotReq, err := codec.UnmarshalRequest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotReq, req) {
+		t.Fatalf("request = %+v, want %+v", gotReq, req)
+	}
+
+	resp := &types.Response{
+		RequestID:   "req-1",
+		StatusCode:  http.StatusTeapot,
+		Headers:     http.Header{"Set-Cookie": {"a=1", "b=2"}},
+		Body:        make([]byte, 70000), // Needs a bin32 length
+		Error:       "upstream failed",
+		Timestamp:   42,
+		Port:        65535,
+		ClientID:    "client-a",
+		Protocol:    "HTTP/2.0",
+		ContentType: "text/plain",
+		Stream:      true,
+	}
+	data, err = codec.MarshalResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotResp, err := codec.UnmarshalResponse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotResp, resp) {
+		t.Fatalf("response = %+v, want %+v", gotResp, resp)
+	}
+}
+
+func TestMsgpackTruncated(t *testing.T) {
+	codec := MsgpackCodec{}
+	data, err := codec.MarshalResponse(&types.Response{
+		RequestID: "req-1",
+		Headers:   http.Header{"X-A": {"1"}},
+		Body:      []byte("body"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		if _, err := codec.UnmarshalResponse(data[:n]); err == nil {
+			t.Fatalf("UnmarshalResponse accepted %d of %d bytes", n, len(data))
+		}
+	}
+}
+
+// TestMsgpackHugeLengths checks that lengths far beyond the data are refused
+// without first allocating for them
+func TestMsgpackHugeLengths(t *testing.T) {
+	field := func(name string, value ...byte) []byte {
+		return append(append([]byte{0x81, 0xa0 | byte(len(name))}, name...), value...)
+	}
+	max32 := []byte{0xff, 0xff, 0xff, 0xff}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"map32 of fields", append([]byte{0xdf}, max32...)},
+		{"map32 of headers", field("headers", append([]byte{0xdf}, max32...)...)},
+		{"array32 of header values", field("headers", append([]byte{0x81, 0xa1, 'x', 0xdd}, max32...)...)},
+		{"str32", field("error", append([]byte{0xdb}, max32...)...)},
+		{"bin32", field("body", append([]byte{0xc6}, max32...)...)},
+		{"skipped array32", field("unknown", append([]byte{0xdd}, max32...)...)},
+		{"skipped map32", field("unknown", append([]byte{0xdf}, max32...)...)},
+		{"skipped ext32", field("unknown", append([]byte{0xc9}, max32...)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := MsgpackCodec{}.UnmarshalResponse(tt.data)
+			runtime.ReadMemStats(&after)
+			if err == nil {
+				t.Fatal("UnmarshalResponse accepted a length beyond the data")
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+				t.Fatalf("allocated %d bytes decoding %d", allocated, len(tt.data))
+			}
+		})
+	}
+
+	query := field("query_params", append([]byte{0xdf}, max32...)...)
+	if _, err := (MsgpackCodec{}).UnmarshalRequest(query); err == nil {
+		t.Fatal("UnmarshalRequest accepted a query_params length beyond the data")
+	}
+}
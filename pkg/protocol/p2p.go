@@ -0,0 +1,23 @@
+package protocol
+
+// P2PVersion is the first protocol version whose raw TCP tunnels take
+// peer-to-peer connections
+const P2PVersion = 6
+
+// A visitor asks the server's /p2p endpoint to reach a raw TCP tunnel
+// directly, and the server sends "p2p-open|<session>|<rendezvous port>" over
+// the tunnel. Both ends then send "p2p|<session>|<role>|<fingerprint>" from
+// the UDP socket they will connect over to the rendezvous port, role being
+// P2PVisitor or P2PClient and fingerprint the SHA-256 of the client's
+// certificate, empty for the visitor. The server answers
+// "p2p-wait|<session>" until both have, then "p2p-peer|<session>|<address>|
+// <fingerprint>" with the other end's address as the server saw it. The
+// ends punch through their NATs towards each other and the visitor opens a
+// QUIC connection (ALPN P2PALPN) to the client, one stream per TCP
+// connection. An unknown or expired session gets "p2p-error|<session>|
+// <reason>".
+const (
+	P2PVisitor = "visitor"
+	P2PClient  = "client"
+	P2PALPN    = "attachcloudip-p2p"
+)
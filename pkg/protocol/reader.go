@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MaxLineSize bounds a single text message on the tunnel. Legacy JSON
+// messages carry whole bodies, so it leaves room for a base64-encoded body
+// of MaxFrameSize.
+const MaxLineSize = MaxFrameSize/3*4 + 64<<10
+
+// Message is one message read from the tunnel
+type Message struct {
+	Line  string // Text of the message, or the header of a frame
+	Frame *Frame // Set for binary frames
+	Size  int    // Bytes the message took on the wire
+}
+
+// Reader splits the tunnel stream into messages, however the stream was
+// fragmented or coalesced into reads
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// ReadLine reads the next text message, without surrounding whitespace
+func (r *Reader) ReadLine() (string, error) {
+	line, _, err := r.readLine()
+	return line, err
+}
+
+// ReadMessage reads the next message, along with the payload of a frame. A
+// malformed frame is an error since the rest of the stream can't be trusted.
+func (r *Reader) ReadMessage() (Message, error) {
+	line, size, err := r.readLine()
+	if err != nil {
+		return Message{}, err
+	}
+	msg := Message{Line: line, Size: size}
+	if IsFrame(line) {
+		frame, err := ReadFrame(r.r, line)
+		if err != nil {
+			return Message{}, err
+		}
+		msg.Frame = &frame
+		msg.Size += len(frame.Payload)
+	}
+	return msg, nil
+}
+
+// Remaining returns the rest of the stream after the messages read so far,
+// starting with any bytes already buffered
+func (r *Reader) Remaining() io.Reader {
+	return r.r
+}
+
+// readLine reads up to the next newline, failing rather than buffering
+// without bound when none comes
+func (r *Reader) readLine() (string, int, error) {
+	var buf []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if len(buf)+len(chunk) > MaxLineSize {
+			return "", 0, fmt.Errorf("message exceeds the limit of %d bytes", MaxLineSize)
+		}
+		buf = append(buf, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(bytes.TrimSpace(buf)) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", 0, err
+		}
+		return strings.TrimSpace(string(buf)), len(buf), nil
+	}
+}
@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkedReader returns its data in reads of the given sizes, then the rest
+// in one read
+type chunkedReader struct {
+	data  []byte
+	sizes []int
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := len(c.data)
+	if len(c.sizes) > 0 {
+		n, c.sizes = min(c.sizes[0], n), c.sizes[1:]
+	}
+	n = copy(p, c.data[:n])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+// frameBytes encodes f as WriteFrame does
+func frameBytes(t *testing.T, f Frame) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := WriteFrame(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestReaderMessages(t *testing.T) {
+	request := Frame{Kind: "request", Payload: []byte("binary\npayload\x00with newlines\n")}
+	response := Frame{Kind: "response", Compressed: true, Payload: []byte{0xff, '\n', 0x00, '\n'}}
+	empty := Frame{Kind: "body", Payload: []byte{}}
+
+	requestHeader := "frame|request|" + strconv.Itoa(len(request.Payload))
+
+	stream := "heartbeat\n" +
+		frameBytes(t, request) +
+		"  register|client|/api  \n" +
+		frameBytes(t, response) +
+		frameBytes(t, empty) +
+		"{\"type\":\"response\"}\n"
+	want := []Message{
+		{Line: "heartbeat", Size: len("heartbeat\n")},
+		{Line: requestHeader, Frame: &request, Size: len(requestHeader) + 1 + len(request.Payload)},
+		{Line: "register|client|/api", Size: len("  register|client|/api  \n")},
+		{Line: "frame|response|4|c", Frame: &response, Size: len("frame|response|4|c\n") + len(response.Payload)},
+		{Line: "frame|body|0", Frame: &empty, Size: len("frame|body|0\n")},
+		{Line: "{\"type\":\"response\"}", Size: len("{\"type\":\"response\"}\n")},
+	}
+
+	// Split the stream inside the first frame's header and payload, and
+	// inside a line
+	header := strings.Index(stream, "frame|request") + 4
+	payload := strings.Index(stream, "payload")
+	line := strings.Index(stream, "client|")
+	splits := []int{header, payload - header, line - payload}
+
+	tests := []struct {
+		name   string
+		reader func() io.Reader
+	}{
+		{"one read", func() io.Reader { return strings.NewReader(stream) }},
+		{"one byte at a time", func() io.Reader { return iotest.OneByteReader(strings.NewReader(stream)) }},
+		{"several frames per read", func() io.Reader {
+			return &chunkedReader{data: []byte(stream), sizes: []int{len(stream) / 2}}
+		}},
+		{"frames split across reads", func() io.Reader {
+			return &chunkedReader{data: []byte(stream), sizes: splits}
+		}},
+		{"half reads", func() io.Reader { return iotest.HalfReader(strings.NewReader(stream)) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(tt.reader())
+			for i, w := range want {
+				got, err := r.ReadMessage()
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if !reflect.DeepEqual(got, w) {
+					t.Fatalf("message %d = %+v, want %+v", i, got, w)
+				}
+			}
+			if _, err := r.ReadMessage(); err != io.EOF {
+				t.Fatalf("after the last message: err = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   error // nil for any error but io.EOF
+	}{
+		{"empty stream", "", io.EOF},
+		{"line cut short", "heartbeat", io.ErrUnexpectedEOF},
+		{"payload cut short", "frame|request|10\nshort", nil},
+		{"bad length", "frame|request|x\n", nil},
+		{"negative length", "frame|request|-1\n", nil},
+		{"oversized frame", "frame|request|999999999999\n", nil},
+		{"bad flag", "frame|request|1|z\nx", nil},
+		{"missing length", "frame|request\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(iotest.OneByteReader(strings.NewReader(tt.stream))).ReadMessage()
+			switch {
+			case err == nil:
+				t.Fatal("ReadMessage succeeded")
+			case tt.want != nil && !errors.Is(err, tt.want):
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			case tt.want == nil && errors.Is(err, io.EOF):
+				t.Fatalf("err = %v, want a malformed frame error", err)
+			}
+		})
+	}
+}
+
+func TestReaderLineLimit(t *testing.T) {
+	stream := strings.Repeat("x", MaxLineSize+1) + "\n"
+	if _, err := NewReader(strings.NewReader(stream)).ReadLine(); err == nil {
+		t.Fatal("ReadLine accepted a line over MaxLineSize")
+	}
+}
+
+func TestReaderRemaining(t *testing.T) {
+	r := NewReader(iotest.HalfReader(strings.NewReader("upgrade\nraw bytes\nafter")))
+	if line, err := r.ReadLine(); err != nil || line != "upgrade" {
+		t.Fatalf("ReadLine = %q, %v", line, err)
+	}
+	rest, err := io.ReadAll(r.Remaining())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "raw bytes\nafter" {
+		t.Fatalf("Remaining = %q, want %q", rest, "raw bytes\nafter")
+	}
+}
@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The snappy block format (https://github.com/google/snappy/blob/main/format_description.txt):
+// the uncompressed length as a uvarint, then literal and copy elements.
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	// snappyMaxBlock keeps match offsets within two bytes
+	snappyMaxBlock  = 65536
+	snappyTableBits = 14
+)
+
+// snappyEncode compresses src in the snappy block format
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyMaxBlock {
+			block = block[:snappyMaxBlock]
+		}
+		src = src[len(block):]
+		dst = snappyEncodeBlock(dst, block)
+	}
+	return dst
+}
+
+func snappyEncodeBlock(dst, src []byte) []byte {
+	// Too short to find a match worth a copy element
+	if len(src) < 16 {
+		return snappyEmitLiteral(dst, src)
+	}
+
+	var table [1 << snappyTableBits]uint16 // hash of 4 bytes -> last position seen
+	hash := func(u uint32) uint32 { return (u * 0x1e35a7bd) >> (32 - snappyTableBits) }
+
+	nextEmit := 0
+	for s := 1; s+4 <= len(src); {
+		h := hash(binary.LittleEndian.Uint32(src[s:]))
+		candidate := int(table[h])
+		table[h] = uint16(s)
+		if candidate >= s || binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[s:]) {
+			s++
+			continue
+		}
+
+		dst = snappyEmitLiteral(dst, src[nextEmit:s])
+		offset, base := s-candidate, s
+		for s += 4; s < len(src) && src[s] == src[s-offset]; s++ {
+		}
+		dst = snappyEmitCopy(dst, offset, s-base)
+		nextEmit = s
+	}
+	return snappyEmitLiteral(dst, src[nextEmit:])
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyEmitCopy writes a match of length >= 4 at the given offset
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+// snappyDecode decompresses a snappy block of at most maxLen bytes
+func snappyDecode(src []byte, maxLen int) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid snappy length")
+	}
+	if length > uint64(maxLen) {
+		return nil, fmt.Errorf("snappy block of %d bytes exceeds the limit of %d", length, maxLen)
+	}
+
+	// A copy element of three bytes expands to at most 64, so a short block
+	// claiming a huge length doesn't get that much allocated up front
+	dst := make([]byte, 0, min(length, uint64(len(src))*22))
+	for s := n; s < len(src); {
+		tag := src[s]
+		var offset, size int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			size = int(tag >> 2)
+			s++
+			if size >= 60 {
+				extra := size - 59
+				if s+extra > len(src) {
+					return nil, fmt.Errorf("truncated snappy literal")
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[s+i])
+				}
+				s += extra
+			}
+			size++
+			if size > len(src)-s || size > int(length)-len(dst) {
+				return nil, fmt.Errorf("snappy literal overflows block")
+			}
+			dst = append(dst, src[s:s+size]...)
+			s += size
+			continue
+		case snappyTagCopy1:
+			if s+2 > len(src) {
+				return nil, fmt.Errorf("truncated snappy copy")
+			}
+			size = 4 + int(tag>>2)&0x07
+			offset = int(tag>>5)<<8 | int(src[s+1])
+			s += 2
+		case snappyTagCopy2:
+			if s+3 > len(src) {
+				return nil, fmt.Errorf("truncated snappy copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case snappyTagCopy4:
+			if s+5 > len(src) {
+				return nil, fmt.Errorf("truncated snappy copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) || size > int(length)-len(dst) {
+			return nil, fmt.Errorf("invalid snappy copy")
+		}
+		// Copies may overlap their own output, so go byte by byte
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(length) {
+		return nil, fmt.Errorf("snappy block is %d bytes, expected %d", len(dst), length)
+	}
+	return dst, nil
+}
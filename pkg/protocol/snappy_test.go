@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSnappyRoundTrip(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("hello")},
+		{"repeated", []byte(strings.Repeat("abcd", 5000))},
+		{"one byte runs", bytes.Repeat([]byte{0}, 70000)},
+		{"far matches", append(append(bytes.Clone(random[:3000]), random[:5000]...), random[:3000]...)},
+		{"several blocks", []byte(strings.Repeat("the quick brown fox ", 10000))},
+		{"incompressible", random},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := snappyEncode(tt.data)
+			decoded, err := snappyDecode(encoded, len(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, tt.data) {
+				t.Fatal("decoded data differs")
+			}
+		})
+	}
+}
+
+func TestSnappyMalformed(t *testing.T) {
+	uvarint := func(n uint64) []byte { return binary.AppendUvarint(nil, n) }
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unterminated length", []byte{0x80, 0x80}},
+		{"length over the limit", uvarint(1025)},
+		{"huge length", uvarint(1 << 62)},
+		{"missing data", uvarint(10)},
+		{"literal past the input", append(uvarint(10), 9<<2, 'a')},
+		{"literal past the length", append(uvarint(1), 1<<2, 'a', 'b')},
+		{"truncated literal length", append(uvarint(100), 61<<2, 0x01)},
+		{"copy before any output", append(uvarint(4), 0<<2|snappyTagCopy1, 1)},
+		{"copy past the output", append(uvarint(8), 0<<2|snappyTagLiteral, 'a', 0<<2|snappyTagCopy1, 2)},
+		{"zero copy offset", append(uvarint(8), 0<<2|snappyTagLiteral, 'a', 3<<2|snappyTagCopy2, 0, 0)},
+		{"copy past the length", append(uvarint(5), 0<<2|snappyTagLiteral, 'a', 63<<2|snappyTagCopy2, 1, 0)},
+		{"truncated copy1", append(uvarint(8), 0<<2|snappyTagLiteral, 'a', snappyTagCopy1)},
+		{"truncated copy2", append(uvarint(8), 0<<2|snappyTagLiteral, 'a', snappyTagCopy2, 1)},
+		{"truncated copy4", append(uvarint(8), 0<<2|snappyTagLiteral, 'a', snappyTagCopy4, 1, 0, 0)},
+		{"huge copy4 offset", append(uvarint(8), 0<<2|snappyTagLiteral, 'a', snappyTagCopy4, 0xff, 0xff, 0xff, 0xff)},
+		{"shorter than the length", append(uvarint(3), 0<<2|snappyTagLiteral, 'a')},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := snappyDecode(tt.data, 1024); err == nil {
+				t.Fatal("snappyDecode accepted malformed input")
+			}
+		})
+	}
+}
+
+// TestSnappyClaimedLength checks that a block claiming the largest length
+// allowed isn't allocated for before its data is there
+func TestSnappyClaimedLength(t *testing.T) {
+	data := binary.AppendUvarint(nil, MaxFrameSize)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := snappyDecode(data, MaxFrameSize)
+	runtime.ReadMemStats(&after)
+	if err == nil {
+		t.Fatal("snappyDecode accepted a block without its data")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("allocated %d bytes decoding %d", allocated, len(data))
+	}
+}
+
+// TestSnappyGarbage decodes truncated and corrupted blocks and random input,
+// which must fail or decode within the limit but never panic
+func TestSnappyGarbage(t *testing.T) {
+	encoded := snappyEncode([]byte(strings.Repeat("snappy garbage test ", 200)))
+	for n := 0; n < len(encoded); n++ {
+		if _, err := snappyDecode(encoded[:n], 1<<20); err == nil {
+			t.Fatalf("snappyDecode accepted %d of %d bytes", n, len(encoded))
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		data := bytes.Clone(encoded)
+		for j := r.Intn(4); j >= 0; j-- {
+			data[r.Intn(len(data))] = byte(r.Intn(256))
+		}
+		if decoded, err := snappyDecode(data, 1<<20); err == nil && len(decoded) > 1<<20 {
+			t.Fatalf("decoded %d bytes past the limit", len(decoded))
+		}
+
+		random := make([]byte, r.Intn(64))
+		r.Read(random)
+		snappyDecode(random, 1<<10)
+	}
+}
@@ -0,0 +1,23 @@
+package protocol
+
+// TCPVersion is the first protocol version whose clients run raw TCP
+// tunnels
+const TCPVersion = 5
+
+// A raw TCP tunnel asks for a public port with the "tcp=1" registration
+// option, and the server confirms the port in "tcp_port". For each
+// connection to the port the server sends "tcp-open|<stream id>" over the
+// tunnel. The client dials its local service and opens a new connection to
+// the registration port whose first line is "stream|<stream id>", after
+// which both ends copy bytes verbatim. A client that can't reach its service
+// answers "tcp-error|<stream id>|<reason>" instead.
+//
+// A raw TCP tunnel may also ask with "sni=<hostname>" for the TLS
+// connections to the server's HTTPS port naming the hostname, which the
+// server passes through undecrypted as streams of the tunnel. The server
+// confirms the hostname in "sni" as well.
+const (
+	TCPOption     = "tcp"
+	TCPPortOption = "tcp_port"
+	SNIOption     = "sni"
+)
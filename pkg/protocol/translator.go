@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/vikasavn/attachcloudip/pkg/types"
@@ -19,6 +20,14 @@ func HTTPToTCPRequest(r *http.Request, clientID string) (*types.Request, error)
 	}
 	defer r.Body.Close()
 
+	tcpReq := HTTPToTCPRequestHead(r, clientID)
+	tcpReq.Body = body
+	return tcpReq, nil
+}
+
+// HTTPToTCPRequestHead converts the method, URL, and headers of an HTTP
+// request, leaving the body to the caller
+func HTTPToTCPRequestHead(r *http.Request, clientID string) *types.Request {
 	// Convert headers
 	headers := make(http.Header)
 	for key, values := range r.Header {
@@ -39,7 +48,6 @@ func HTTPToTCPRequest(r *http.Request, clientID string) (*types.Request, error)
 		Path:        r.URL.Path,
 		Method:      r.Method,
 		Headers:     headers,
-		Body:        body,
 		Timestamp:   time.Now().Unix(),
 		QueryParams: queryParams,
 		Host:        r.Host,
@@ -47,22 +55,12 @@ func HTTPToTCPRequest(r *http.Request, clientID string) (*types.Request, error)
 		ClientID:    clientID,
 	}
 
-	return tcpReq, nil
+	return tcpReq
 }
 
 // TCPToHTTPResponse converts our internal TCP response to an HTTP response
 func TCPToHTTPResponse(tcpResp *types.Response, w http.ResponseWriter) error {
-	// Set headers
-	for key, values := range tcpResp.Headers {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
-	}
-
-	// Set content type if provided
-	if tcpResp.ContentType != "" {
-		w.Header().Set("Content-Type", tcpResp.ContentType)
-	}
+	copyResponseHeaders(tcpResp, w)
 
 	// Set content length
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(tcpResp.Body)))
@@ -80,6 +78,28 @@ func TCPToHTTPResponse(tcpResp *types.Response, w http.ResponseWriter) error {
 	return nil
 }
 
+// TCPToHTTPResponseHead writes the status and headers of a streamed
+// response, whose body follows in chunks of unknown total length
+func TCPToHTTPResponseHead(tcpResp *types.Response, w http.ResponseWriter) {
+	copyResponseHeaders(tcpResp, w)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(tcpResp.StatusCode)
+}
+
+func copyResponseHeaders(tcpResp *types.Response, w http.ResponseWriter) {
+	// Set headers
+	for key, values := range tcpResp.Headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	// Set content type if provided
+	if tcpResp.ContentType != "" {
+		w.Header().Set("Content-Type", tcpResp.ContentType)
+	}
+}
+
 // HTTPResponseToTCP converts an HTTP response to our internal TCP response format
 func HTTPResponseToTCP(httpResp *http.Response, requestID string) (*types.Response, error) {
 	// Read body
@@ -89,18 +109,22 @@ func HTTPResponseToTCP(httpResp *http.Response, requestID string) (*types.Respon
 	}
 	defer httpResp.Body.Close()
 
-	// Create TCP response
-	tcpResp := &types.Response{
+	tcpResp := HTTPResponseHeadToTCP(httpResp, requestID)
+	tcpResp.Body = body
+	return tcpResp, nil
+}
+
+// HTTPResponseHeadToTCP converts the status and headers of an HTTP response,
+// leaving the body to the caller
+func HTTPResponseHeadToTCP(httpResp *http.Response, requestID string) *types.Response {
+	return &types.Response{
 		RequestID:   requestID,
 		StatusCode:  httpResp.StatusCode,
 		Headers:     httpResp.Header,
-		Body:        body,
 		Timestamp:   time.Now().Unix(),
 		Protocol:    httpResp.Proto,
 		ContentType: httpResp.Header.Get("Content-Type"),
 	}
-
-	return tcpResp, nil
 }
 
 // TCPToHTTPRequest converts our internal TCP request to an HTTP request
@@ -140,3 +164,13 @@ func TCPToHTTPRequest(tcpReq *types.Request) (*http.Request, error) {
 
 	return req, nil
 }
+
+// StreamedRequestLength returns the length a streamed request body declared
+// in its Content-Length header, -1 if unknown
+func StreamedRequestLength(tcpReq *types.Request) int64 {
+	length, err := strconv.ParseInt(tcpReq.Headers.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return -1
+	}
+	return length
+}
@@ -0,0 +1,283 @@
+package protocol
+
+import (
+	"crypto/ecdh"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// DefaultCompressMinSize is the smallest payload worth compressing
+const DefaultCompressMinSize = 1024
+
+// Transport is how requests and responses travel over one tunnel, as
+// negotiated when the client registers. The zero value is the original
+// JSON line protocol.
+type Transport struct {
+	Codec Codec
+	// Compression is "snappy" to compress frame payloads, empty for none
+	Compression string
+	// CompressMinSize is the payload size from which this side compresses
+	// frames, DefaultCompressMinSize if zero
+	CompressMinSize int
+	// Encryption is EncryptionX25519 to encrypt frame payloads, empty for none
+	Encryption string
+	// Version is the negotiated protocol version
+	Version int
+
+	exchange *ecdh.PrivateKey // Client's key of the exchange in progress
+	cipher   *tunnelCipher
+}
+
+// codec returns the negotiated codec, JSON if none was
+func (t *Transport) codec() Codec {
+	if t == nil || t.Codec == nil {
+		return JSONCodec{}
+	}
+	return t.Codec
+}
+
+// framed reports whether messages need binary frames instead of JSON lines
+func (t *Transport) framed() bool {
+	return t.codec().Name() != "json" || (t != nil && (t.Compression != "" || t.cipher != nil))
+}
+
+// Encrypted reports whether frame payloads are encrypted, in which case
+// plain JSON messages must not be trusted
+func (t *Transport) Encrypted() bool {
+	return t != nil && t.cipher != nil
+}
+
+// Offer returns the registration options a client sends to ask for this
+// transport, starting a new key exchange if it asks for encryption. The
+// options announce the client's protocol version.
+func (t *Transport) Offer() (url.Values, error) {
+	offer := url.Values{}
+	offer.Set("proto", strconv.Itoa(Version))
+	if t == nil {
+		return offer, nil
+	}
+	if t.codec().Name() != "json" {
+		// Fall back to JSON if the server doesn't know the codec
+		offer.Set("codec", t.codec().Name()+",json")
+	}
+	if t.Compression != "" {
+		offer.Set("compress", t.Compression)
+	}
+	if t.Encryption != "" {
+		exchange, err := newKeyExchange()
+		if err != nil {
+			return nil, err
+		}
+		t.exchange = exchange
+		offer.Set("encrypt", t.Encryption)
+		offer.Set("key", encodePublicKey(exchange))
+	}
+	return offer, nil
+}
+
+// NegotiateTransport picks the transport for a client's registration options
+// and returns it with the options to confirm back to the client, or an
+// ErrIncompatible error if they have no protocol version in common
+func NegotiateTransport(offer url.Values) (*Transport, url.Values, error) {
+	version, err := negotiateVersion(offer)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &Transport{Codec: NegotiateCodec(strings.Split(offer.Get("codec"), ",")), Version: version}
+	accepted := url.Values{}
+	accepted.Set("proto", strconv.Itoa(version))
+	accepted.Set("codec", t.Codec.Name())
+
+	if offer.Get("encrypt") == EncryptionX25519 {
+		exchange, err := newKeyExchange()
+		if err != nil {
+			return nil, nil, err
+		}
+		if t.cipher, err = newTunnelCipher(exchange, offer.Get("key"), true); err != nil {
+			return nil, nil, err
+		}
+		t.Encryption = EncryptionX25519
+		accepted.Set("encrypt", EncryptionX25519)
+		accepted.Set("key", encodePublicKey(exchange))
+		// Compressing before encrypting leaks content through the length
+		// of the ciphertext, so encrypted tunnels go uncompressed
+		return t, accepted, nil
+	}
+
+	for _, name := range strings.Split(offer.Get("compress"), ",") {
+		if name == "snappy" {
+			t.Compression = name
+			accepted.Set("compress", name)
+			break
+		}
+	}
+	return t, accepted, nil
+}
+
+// Accept returns the transport the server confirmed for this offer, JSON if
+// the server sent no options
+func (t *Transport) Accept(accepted url.Values) (*Transport, error) {
+	confirmed := &Transport{Codec: JSONCodec{}}
+	if t != nil {
+		confirmed.CompressMinSize = t.CompressMinSize
+	}
+	if err := confirmed.accept(accepted, t); err != nil {
+		return nil, err
+	}
+	return confirmed, nil
+}
+
+func (t *Transport) accept(accepted url.Values, offer *Transport) error {
+	version, err := acceptVersion(accepted)
+	if err != nil {
+		return err
+	}
+	t.Version = version
+	if name := accepted.Get("codec"); name != "" {
+		codec, err := CodecByName(name)
+		if err != nil {
+			return err
+		}
+		t.Codec = codec
+	}
+	switch name := accepted.Get("compress"); name {
+	case "", "snappy":
+		t.Compression = name
+	default:
+		return fmt.Errorf("unknown compression: %s", name)
+	}
+	switch name := accepted.Get("encrypt"); name {
+	case "":
+	case EncryptionX25519:
+		if offer == nil || offer.exchange == nil {
+			return fmt.Errorf("server enabled encryption that wasn't asked for")
+		}
+		cipher, err := newTunnelCipher(offer.exchange, accepted.Get("key"), false)
+		if err != nil {
+			return err
+		}
+		t.Encryption, t.cipher = name, cipher
+	default:
+		return fmt.Errorf("unknown encryption: %s", name)
+	}
+	return nil
+}
+
+// WriteRequest sends a request to the client and returns the bytes written
+func (t *Transport) WriteRequest(w io.Writer, req *types.Request) (int, error) {
+	data, err := t.codec().MarshalRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	if !t.framed() {
+		return w.Write([]byte("request|" + string(data) + "\n"))
+	}
+	return t.writeFrame(w, "request", data)
+}
+
+// WriteBodyChunk sends the next chunk of a streamed request body, carried in
+// the Body of a request with the same ID
+func (t *Transport) WriteBodyChunk(w io.Writer, chunk *types.Request) (int, error) {
+	data, err := t.codec().MarshalRequest(chunk)
+	if err != nil {
+		return 0, err
+	}
+	if !t.framed() {
+		return w.Write([]byte("body|" + string(data) + "\n"))
+	}
+	return t.writeFrame(w, "body", data)
+}
+
+// WriteResponse sends a response to the server and returns the bytes written
+func (t *Transport) WriteResponse(w io.Writer, resp *types.Response) (int, error) {
+	return t.writeResponse(w, "response", resp)
+}
+
+// WriteChunk sends the next chunk of a streamed response body, carried in
+// the Body of a response with the same RequestID
+func (t *Transport) WriteChunk(w io.Writer, chunk *types.Response) (int, error) {
+	return t.writeResponse(w, "chunk", chunk)
+}
+
+func (t *Transport) writeResponse(w io.Writer, kind string, resp *types.Response) (int, error) {
+	data, err := t.codec().MarshalResponse(resp)
+	if err != nil {
+		return 0, err
+	}
+	if !t.framed() {
+		return w.Write([]byte(kind + "|" + string(data) + "\n"))
+	}
+	return t.writeFrame(w, kind, data)
+}
+
+// DecodeRequest decodes a request or body chunk frame
+func (t *Transport) DecodeRequest(f Frame) (*types.Request, error) {
+	payload, err := t.open(f)
+	if err != nil {
+		return nil, err
+	}
+	return t.codec().UnmarshalRequest(payload)
+}
+
+// DecodeResponse decodes a response or chunk frame
+func (t *Transport) DecodeResponse(f Frame) (*types.Response, error) {
+	payload, err := t.open(f)
+	if err != nil {
+		return nil, err
+	}
+	return t.codec().UnmarshalResponse(payload)
+}
+
+// writeFrame seals an encoded message and writes its frame. Encrypted frames
+// are written in the order they were sealed, since the peer refuses nonces
+// that don't increase.
+func (t *Transport) writeFrame(w io.Writer, kind string, data []byte) (int, error) {
+	if t.cipher != nil {
+		t.cipher.writeMu.Lock()
+		defer t.cipher.writeMu.Unlock()
+	}
+	return WriteFrame(w, t.seal(kind, data))
+}
+
+// seal builds the frame for an encoded message, compressing payloads large
+// enough to be worth it and encrypting them as negotiated
+func (t *Transport) seal(kind string, data []byte) Frame {
+	f := Frame{Kind: kind, Payload: data}
+	minSize := t.CompressMinSize
+	if minSize <= 0 {
+		minSize = DefaultCompressMinSize
+	}
+	if t.Compression != "" && len(data) >= minSize {
+		// Incompressible payloads are sent as they are
+		if compressed := snappyEncode(data); len(compressed) < len(data) {
+			f.Payload, f.Compressed = compressed, true
+		}
+	}
+	if t.cipher != nil {
+		f.Payload = t.cipher.seal(f.Payload)
+	}
+	return f
+}
+
+// open returns the encoded message carried by a frame
+func (t *Transport) open(f Frame) ([]byte, error) {
+	if t.Encrypted() {
+		payload, err := t.cipher.open(f.Payload)
+		if err != nil {
+			return nil, err
+		}
+		f.Payload = payload
+	}
+	if !f.Compressed {
+		return f.Payload, nil
+	}
+	if t == nil || t.Compression == "" {
+		return nil, fmt.Errorf("compressed frame without negotiated compression")
+	}
+	return snappyDecode(f.Payload, MaxFrameSize)
+}
@@ -0,0 +1,277 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// negotiate runs the registration exchange for offer and returns the
+// client's and the server's side of the transport
+func negotiate(t *testing.T, offer *Transport) (client, server *Transport) {
+	t.Helper()
+	values, err := offer.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, accepted, err := NegotiateTransport(values)
+	if err != nil {
+		t.Fatalf("NegotiateTransport: %v", err)
+	}
+	client, err = offer.Accept(accepted)
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	return client, server
+}
+
+// readFrames reads every frame written to buf
+func readFrames(t *testing.T, buf *bytes.Buffer) []Frame {
+	t.Helper()
+	r := NewReader(buf)
+	var frames []Frame
+	for {
+		msg, err := r.ReadMessage()
+		if errors.Is(err, io.EOF) {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Frame == nil {
+			t.Fatalf("message %q is not a frame", msg.Line)
+		}
+		frames = append(frames, *msg.Frame)
+	}
+}
+
+func encrypted() *Transport {
+	return &Transport{Codec: JSONCodec{}, Encryption: EncryptionX25519}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	client, server := negotiate(t, encrypted())
+	if !client.Encrypted() || !server.Encrypted() {
+		t.Fatalf("Encrypted() = %v, %v after negotiating encryption", client.Encrypted(), server.Encrypted())
+	}
+
+	var toClient, toServer bytes.Buffer
+	for i := 0; i < 3; i++ {
+		req := &types.Request{ID: fmt.Sprintf("req-%d", i), Method: "POST", Path: "/api", Body: []byte("secret request body")}
+		if _, err := server.WriteRequest(&toClient, req); err != nil {
+			t.Fatal(err)
+		}
+		resp := &types.Response{RequestID: req.ID, StatusCode: 200, Body: []byte("secret response body")}
+		if _, err := client.WriteResponse(&toServer, resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Contains(toClient.Bytes(), []byte("secret")) || bytes.Contains(toServer.Bytes(), []byte("secret")) {
+		t.Fatal("encrypted frames carry the plaintext")
+	}
+
+	requests, responses := readFrames(t, &toClient), readFrames(t, &toServer)
+	if len(requests) != 3 || len(responses) != 3 {
+		t.Fatalf("read %d requests and %d responses, want 3 of each", len(requests), len(responses))
+	}
+	for i, f := range requests {
+		req, err := client.DecodeRequest(f)
+		if err != nil {
+			t.Fatalf("DecodeRequest %d: %v", i, err)
+		}
+		if req.ID != fmt.Sprintf("req-%d", i) || string(req.Body) != "secret request body" {
+			t.Fatalf("request %d = %+v", i, req)
+		}
+	}
+	for i, f := range responses {
+		resp, err := server.DecodeResponse(f)
+		if err != nil {
+			t.Fatalf("DecodeResponse %d: %v", i, err)
+		}
+		if resp.RequestID != fmt.Sprintf("req-%d", i) || string(resp.Body) != "secret response body" {
+			t.Fatalf("response %d = %+v", i, resp)
+		}
+	}
+}
+
+func TestEncryptedTampered(t *testing.T) {
+	client, server := negotiate(t, encrypted())
+	var buf bytes.Buffer
+	if _, err := server.WriteRequest(&buf, &types.Request{ID: "req-1", Body: []byte("body")}); err != nil {
+		t.Fatal(err)
+	}
+	f := readFrames(t, &buf)[0]
+
+	// The nonce, the ciphertext, and the tag are each authenticated
+	for _, i := range []int{0, 11, 12, len(f.Payload) / 2, len(f.Payload) - 1} {
+		tampered := f
+		tampered.Payload = bytes.Clone(f.Payload)
+		tampered.Payload[i] ^= 0x01
+		if _, err := client.DecodeRequest(tampered); err == nil {
+			t.Errorf("DecodeRequest accepted a payload with byte %d flipped", i)
+		}
+	}
+	truncated := f
+	truncated.Payload = f.Payload[:8]
+	if _, err := client.DecodeRequest(truncated); err == nil {
+		t.Error("DecodeRequest accepted a truncated payload")
+	}
+	if _, err := client.DecodeRequest(f); err != nil {
+		t.Fatalf("DecodeRequest of the untampered frame: %v", err)
+	}
+
+	// Another exchange derives other keys
+	other, _ := negotiate(t, encrypted())
+	if _, err := server.WriteRequest(&buf, &types.Request{ID: "req-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.DecodeRequest(readFrames(t, &buf)[0]); err == nil {
+		t.Error("a frame decrypted under another exchange's keys")
+	}
+}
+
+func TestEncryptedReplay(t *testing.T) {
+	client, server := negotiate(t, encrypted())
+	var buf bytes.Buffer
+	for _, id := range []string{"req-1", "req-2", "req-3"} {
+		if _, err := server.WriteRequest(&buf, &types.Request{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames := readFrames(t, &buf)
+
+	if _, err := client.DecodeRequest(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DecodeRequest(frames[0]); err == nil {
+		t.Error("DecodeRequest accepted a replayed frame")
+	}
+	if _, err := client.DecodeRequest(frames[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DecodeRequest(frames[1]); err == nil {
+		t.Error("DecodeRequest accepted a frame older than the last one")
+	}
+
+	// A frame sealed for one direction doesn't open in the other
+	if _, err := client.WriteResponse(&buf, &types.Response{RequestID: "req-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DecodeResponse(readFrames(t, &buf)[0]); err == nil {
+		t.Error("a client frame was reflected back to the client")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writers, which yields
+// before each write so that writers overtake each other where they can
+type lockedBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	runtime.Gosched()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// TestEncryptedConcurrentWriters checks that frames written from several
+// goroutines reach the peer in the order of their nonces
+func TestEncryptedConcurrentWriters(t *testing.T) {
+	client, server := negotiate(t, encrypted())
+	var buf lockedBuffer
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				server.WriteRequest(&buf, &types.Request{ID: fmt.Sprintf("req-%d-%d", i, j)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	frames := readFrames(t, &buf.buf)
+	if len(frames) != 400 {
+		t.Fatalf("read %d frames, want 400", len(frames))
+	}
+	for i, f := range frames {
+		if _, err := client.DecodeRequest(f); err != nil {
+			t.Fatalf("DecodeRequest of frame %d: %v", i, err)
+		}
+	}
+}
+
+func TestKeyExchangeErrors(t *testing.T) {
+	offer, err := encrypted().Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "not base64!", "c2hvcnQ"} {
+		offer.Set("key", key)
+		if _, _, err := NegotiateTransport(offer); err == nil {
+			t.Errorf("NegotiateTransport accepted client key %q", key)
+		}
+	}
+
+	// Clients refuse encryption they didn't ask for and invalid server keys
+	client := encrypted()
+	values, err := client.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, accepted, err := NegotiateTransport(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Transport{Codec: JSONCodec{}}).Accept(accepted); err == nil {
+		t.Error("Accept took encryption that wasn't offered")
+	}
+	accepted.Set("key", "c2hvcnQ")
+	if _, err := client.Accept(accepted); err == nil {
+		t.Error("Accept took an invalid server key")
+	}
+	accepted.Set("encrypt", "rot13")
+	if _, err := client.Accept(accepted); err == nil {
+		t.Error("Accept took an unknown encryption")
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	client, server := negotiate(t, &Transport{Codec: JSONCodec{}, Compression: "snappy"})
+	if client.Compression != "snappy" || server.Compression != "snappy" {
+		t.Fatalf("compression = %q, %q, want snappy", client.Compression, server.Compression)
+	}
+
+	body := strings.Repeat("compressible ", 1000)
+	var buf bytes.Buffer
+	if _, err := client.WriteResponse(&buf, &types.Response{RequestID: "req-1", Body: []byte(body)}); err != nil {
+		t.Fatal(err)
+	}
+	f := readFrames(t, &buf)[0]
+	if !f.Compressed || len(f.Payload) >= len(body) {
+		t.Fatalf("frame of %d bytes, compressed %v, for a %d byte body", len(f.Payload), f.Compressed, len(body))
+	}
+	resp, err := server.DecodeResponse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != body {
+		t.Fatal("decompressed body differs")
+	}
+
+	// Compressed frames are refused where compression wasn't negotiated
+	plain, _ := negotiate(t, &Transport{Codec: JSONCodec{}})
+	if _, err := plain.DecodeResponse(f); err == nil {
+		t.Error("DecodeResponse accepted a compressed frame without compression")
+	}
+}
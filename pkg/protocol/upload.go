@@ -0,0 +1,16 @@
+package protocol
+
+// UploadVersion is the first protocol version whose clients take streamed
+// request bodies
+const UploadVersion = 8
+
+// A request whose body is streamed has "stream" set and no body. The body
+// follows in "body" messages, requests with the same ID whose Body is the
+// next chunk, the last one with "stream" unset. The client acknowledges each
+// chunk its upstream has read with "body-ack|<request id>|<bytes>", and the
+// server keeps at most UploadWindow bytes unacknowledged, so the upload goes
+// no faster than the upstream takes it.
+const (
+	UploadChunkSize = 32 << 10
+	UploadWindow    = 1 << 20
+)
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Tunnel protocol versions. Clients announce theirs in the "proto"
+// registration option and the server confirms the one both speak. Peers that
+// announce none speak version 1, the line protocol with transport options;
+// version 2 added the announcement, version 3 pushed configuration,
+// version 4 remote commands, version 5 raw TCP tunnels, version 6
+// peer-to-peer connections to them, version 7 tunnel benchmarks, and
+// version 8 streamed request bodies.
+const (
+	Version    = 8 // Spoken by this build
+	MinVersion = 1 // Oldest still spoken by this build
+)
+
+// ErrIncompatible rejects peers without a protocol version in common
+var ErrIncompatible = errors.New("incompatible tunnel protocol")
+
+// IncompatibleError is an ErrIncompatible with the versions involved
+type IncompatibleError struct {
+	Detail string // Sent to the client refused
+}
+
+func (e *IncompatibleError) Error() string {
+	return ErrIncompatible.Error() + ": " + e.Detail
+}
+
+func (e *IncompatibleError) Is(target error) bool {
+	return target == ErrIncompatible
+}
+
+func incompatible(format string, args ...interface{}) error {
+	return &IncompatibleError{Detail: fmt.Sprintf(format, args...)}
+}
+
+// announcedVersion returns the version in a peer's options, 1 if it
+// announced none
+func announcedVersion(options url.Values) (int, error) {
+	announced := options.Get("proto")
+	if announced == "" {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(announced)
+	if err != nil || version < 1 {
+		return 0, incompatible("invalid protocol version %q", announced)
+	}
+	return version, nil
+}
+
+// negotiateVersion picks the version to speak with a client that announced
+// its own in offer
+func negotiateVersion(offer url.Values) (int, error) {
+	version, err := announcedVersion(offer)
+	if err != nil {
+		return 0, err
+	}
+	if version < MinVersion {
+		return 0, incompatible("client speaks version %d, server needs at least %d", version, MinVersion)
+	}
+	return min(version, Version), nil
+}
+
+// acceptVersion checks the version the server confirmed
+func acceptVersion(accepted url.Values) (int, error) {
+	version, err := announcedVersion(accepted)
+	if err != nil {
+		return 0, err
+	}
+	if version < MinVersion || version > Version {
+		return 0, incompatible("server speaks version %d, client speaks %d to %d", version, MinVersion, Version)
+	}
+	return version, nil
+}
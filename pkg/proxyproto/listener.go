@@ -0,0 +1,180 @@
+// Package proxyproto reads HAProxy PROXY protocol headers (v1 and v2) so a
+// server behind a load balancer sees the original client addresses
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerTimeout bounds how long a connection may take to send its header
+const headerTimeout = 10 * time.Second
+
+// v2Signature starts every version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Length is the longest version 1 header, including the CRLF
+const maxV1Length = 107
+
+// NewListener wraps l so connections from trusted addresses report the
+// client address of their PROXY header. All addresses are trusted if trusted
+// is empty. Connections without a header are served as they are.
+func NewListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &listener{Listener: l, trusted: trusted}
+}
+
+type listener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	// The header is read on first use so a slow sender can't stall Accept
+	return &Conn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (l *listener) trusts(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection that may start with a PROXY header
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	source net.Addr // Client address from the header, nil if none
+	err    error
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the
+// address of the peer when there was none
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	first, err := c.r.Peek(1)
+	if err != nil {
+		// Leave the error to the caller's first read
+		return
+	}
+	switch first[0] {
+	case 'P':
+		c.source, c.err = c.readV1()
+	case '\r':
+		c.source, c.err = c.readV2()
+	}
+}
+
+// readV1 parses "PROXY TCP4|TCP6 <src> <dst> <sport> <dport>\r\n" or "PROXY UNKNOWN ...\r\n"
+func (c *Conn) readV1() (net.Addr, error) {
+	if prefix, err := c.r.Peek(6); err != nil || string(prefix) != "PROXY " {
+		return nil, nil
+	}
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1Length {
+			return nil, fmt.Errorf("PROXY header too long")
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY header: %v", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY header: %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid PROXY header source: %s %s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readV2 parses the binary header: signature, version and command, address
+// family, length, then the addresses and optional TLVs
+func (c *Conn) readV2() (net.Addr, error) {
+	if prefix, err := c.r.Peek(len(v2Signature)); err != nil || !bytes.Equal(prefix, v2Signature) {
+		return nil, nil
+	}
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %v", err)
+	}
+	command, family := header[12], header[13]
+	if command>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY header version %d", command>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %v", err)
+	}
+
+	// LOCAL commands come from the proxy itself, e.g. health checks
+	if command&0x0f == 0 {
+		return nil, nil
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY header too short for IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY header too short for IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// Other families such as UDP or unix sockets keep the peer address
+	return nil, nil
+}
@@ -0,0 +1,199 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accept sends data over a loopback connection to a listener trusting
+// trusted and returns the address and data the server side sees
+func accept(t *testing.T, trusted []*net.IPNet, data []byte) (net.Addr, []byte, error) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(inner, trusted)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go func() {
+		client.Write(data)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	addr := conn.RemoteAddr()
+	received, err := io.ReadAll(conn)
+	return addr, received, err
+}
+
+// v2Header builds a version 2 header for command and family with body
+func v2Header(command, family byte, body []byte) []byte {
+	header := append([]byte(nil), v2Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+// ipv4Body holds 203.0.113.7:4321 to 10.0.0.1:443 followed by tlvs
+func ipv4Body(tlvs []byte) []byte {
+	body := []byte{203, 0, 113, 7, 10, 0, 0, 1}
+	body = binary.BigEndian.AppendUint16(body, 4321)
+	body = binary.BigEndian.AppendUint16(body, 443)
+	return append(body, tlvs...)
+}
+
+// tlv encodes one type-length-value entry
+func tlv(kind byte, value []byte) []byte {
+	return append(binary.BigEndian.AppendUint16([]byte{kind}, uint16(len(value))), value...)
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestHeaders(t *testing.T) {
+	ipv6Body := make([]byte, 36)
+	copy(ipv6Body, net.ParseIP("2001:db8::7"))
+	copy(ipv6Body[16:], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ipv6Body[32:], 4321)
+
+	tests := []struct {
+		name   string
+		header []byte
+		source string // Empty if the peer's address is kept
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4321 443\r\n"), "203.0.113.7:4321"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 4321 443\r\n"), "[2001:db8::7]:4321"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 IPv4", v2Header(0x21, 0x11, ipv4Body(nil)), "203.0.113.7:4321"},
+		{"v2 IPv6", v2Header(0x21, 0x21, ipv6Body), "[2001:db8::7]:4321"},
+		{"v2 IPv4 with TLVs", v2Header(0x21, 0x11, ipv4Body(append(tlv(0x01, []byte("h2")), tlv(0x04, []byte("ns"))...))), "203.0.113.7:4321"},
+		{"v2 LOCAL", v2Header(0x20, 0x00, nil), ""},
+		{"v2 UDP", v2Header(0x21, 0x12, ipv4Body(nil)), ""},
+		{"no header", nil, ""},
+		{"not a header", []byte("POST / HTTP/1.1\r\n"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := "GET / HTTP/1.1\r\n\r\n"
+			addr, data, err := accept(t, nil, append(append([]byte(nil), tt.header...), payload...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := payload
+			if tt.name == "not a header" {
+				want = string(tt.header) + payload
+			}
+			if string(data) != want {
+				t.Fatalf("read %q, want %q", data, want)
+			}
+			if tt.source == "" {
+				if !strings.HasPrefix(addr.String(), "127.0.0.1:") {
+					t.Fatalf("RemoteAddr = %s, want the peer", addr)
+				}
+			} else if addr.String() != tt.source {
+				t.Fatalf("RemoteAddr = %s, want %s", addr, tt.source)
+			}
+		})
+	}
+}
+
+// TestUntrustedSource checks that headers from untrusted peers are passed
+// through as data rather than believed
+func TestUntrustedSource(t *testing.T) {
+	header := "PROXY TCP4 203.0.113.7 10.0.0.1 4321 443\r\n"
+	for _, raw := range [][]byte{[]byte(header), v2Header(0x21, 0x11, ipv4Body(nil))} {
+		addr, data, err := accept(t, []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}, append(raw, "data"...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(addr.String(), "127.0.0.1:") {
+			t.Fatalf("RemoteAddr = %s from an untrusted peer", addr)
+		}
+		if !bytes.Equal(data, append(raw, "data"...)) {
+			t.Fatalf("read %q, want the header as data", data)
+		}
+	}
+
+	addr, _, err := accept(t, []*net.IPNet{mustCIDR(t, "10.0.0.0/8"), mustCIDR(t, "127.0.0.0/8")}, []byte(header))
+	if err != nil || addr.String() != "203.0.113.7:4321" {
+		t.Fatalf("trusted peer's RemoteAddr = %s, %v", addr, err)
+	}
+
+	// Peers without an IP address are never trusted by a list
+	l := &listener{trusted: []*net.IPNet{mustCIDR(t, "0.0.0.0/0")}}
+	if l.trusts(&net.UnixAddr{Name: "/tmp/socket", Net: "unix"}) {
+		t.Fatal("a unix peer was trusted")
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"v1 truncated", []byte("PROXY TCP4 203.0.113.7 10.0.0.1")},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n")},
+		{"v1 bad protocol", []byte("PROXY UDP4 203.0.113.7 10.0.0.1 4321 443\r\n")},
+		{"v1 missing field", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4321\r\n")},
+		{"v1 bad address", []byte("PROXY TCP4 203.0.113.999 10.0.0.1 4321 443\r\n")},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 99999 443\r\n")},
+		{"v2 truncated fixed header", v2Header(0x21, 0x11, nil)[:14]},
+		{"v2 truncated addresses", v2Header(0x21, 0x11, ipv4Body(nil))[:20]},
+		{"v2 version 1", v2Header(0x11, 0x11, ipv4Body(nil))},
+		{"v2 short IPv4", v2Header(0x21, 0x11, make([]byte, 8))},
+		{"v2 short IPv6", v2Header(0x21, 0x21, make([]byte, 20))},
+		// A length past what the peer sends is never satisfied
+		{"v2 truncated TLV", v2Header(0x21, 0x11, ipv4Body(tlv(0x01, make([]byte, 100))))[:60]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, data, err := accept(t, nil, append(tt.header, "data"...)); err == nil {
+				t.Fatalf("read %q, want an error", data)
+			}
+		})
+	}
+}
+
+// TestOversizedTLVs sends the largest header the length field allows,
+// which is consumed whole before the connection's data
+func TestOversizedTLVs(t *testing.T) {
+	// 12 bytes of addresses and a TLV of 3 bytes plus its value
+	header := v2Header(0x21, 0x11, ipv4Body(tlv(0xe0, bytes.Repeat([]byte{'x'}, 0xffff-12-3))))
+	addr, data, err := accept(t, nil, append(header, "data"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "203.0.113.7:4321" || string(data) != "data" {
+		t.Fatalf("RemoteAddr = %s, read %q", addr, data)
+	}
+
+	// A TLV claiming more than the header holds is left to the header's
+	// length, so the data after it is intact
+	header = v2Header(0x21, 0x11, ipv4Body(binary.BigEndian.AppendUint16([]byte{0xe0}, 0xffff)))
+	addr, data, err = accept(t, nil, append(header, "data"...))
+	if err != nil || addr.String() != "203.0.113.7:4321" || string(data) != "data" {
+		t.Fatalf("RemoteAddr = %s, read %q, %v", addr, data, err)
+	}
+}
@@ -0,0 +1,293 @@
+// Package recording writes the messages of tunnel sessions to disk and reads
+// them back for replay. A recording is a JSON lines file: a Header, then one
+// Entry per message in the order the server saw them.
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// Redacted replaces the values of redacted headers
+const Redacted = "<redacted>"
+
+// Directions of recorded messages
+const (
+	DirectionIn  = "in"  // From the client
+	DirectionOut = "out" // To the client
+)
+
+// Header starts a recording
+type Header struct {
+	ClientID string    `json:"client_id"`
+	Path     string    `json:"path"`
+	Started  time.Time `json:"started"`
+}
+
+// Entry is one recorded message, a request, a response or chunk, or a
+// control line
+type Entry struct {
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction"`
+	Line      string          `json:"line,omitempty"`
+	Request   *types.Request  `json:"request,omitempty"`
+	Response  *types.Response `json:"response,omitempty"`
+	// Truncated marks the last entry of a recording that hit its size cap
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Recorder records one tunnel session. Its methods are safe to call
+// concurrently and do nothing on a nil Recorder.
+type Recorder struct {
+	name   string
+	redact map[string]bool // Canonical header names
+
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	written int64
+	limit   int64 // 0 for none
+	stopped bool  // Closed, truncated, or failed
+}
+
+// Create starts a recording of the client's session in dir, stopping once it
+// reaches limit bytes if limit is positive. Values of the redact headers are
+// replaced before they are written.
+func Create(dir string, header Header, limit int64, redact []string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %v", err)
+	}
+	name := fmt.Sprintf("%s-%s.jsonl", safeName(header.ClientID), header.Started.UTC().Format("20060102T150405.000000000"))
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %v", err)
+	}
+	r := &Recorder{
+		name:   name,
+		redact: make(map[string]bool, len(redact)),
+		file:   file,
+		w:      bufio.NewWriter(file),
+		limit:  limit,
+	}
+	for _, h := range redact {
+		r.redact[http.CanonicalHeaderKey(h)] = true
+	}
+	data, err := marshal(header)
+	if err == nil {
+		err = r.writeLocked(data)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// safeName makes a client ID usable in a file name
+func safeName(clientID string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, clientID)
+}
+
+// Name returns the recording's file name in its directory
+func (r *Recorder) Name() string {
+	if r == nil {
+		return ""
+	}
+	return r.name
+}
+
+// Request records a request sent to the client
+func (r *Recorder) Request(req *types.Request) {
+	if r == nil {
+		return
+	}
+	recorded := *req
+	recorded.Headers = r.redactHeaders(req.Headers)
+	r.record(Entry{Direction: DirectionOut, Request: &recorded})
+}
+
+// Response records a response or chunk from the client
+func (r *Recorder) Response(resp *types.Response) {
+	if r == nil {
+		return
+	}
+	recorded := *resp
+	recorded.Headers = r.redactHeaders(resp.Headers)
+	r.record(Entry{Direction: DirectionIn, Response: &recorded})
+}
+
+// Line records a control message in either direction
+func (r *Recorder) Line(direction, line string) {
+	if r == nil {
+		return
+	}
+	r.record(Entry{Direction: direction, Line: line})
+}
+
+func (r *Recorder) redactHeaders(headers http.Header) http.Header {
+	if len(r.redact) == 0 || headers == nil {
+		return headers
+	}
+	redacted := make(http.Header, len(headers))
+	for name, values := range headers {
+		if r.redact[http.CanonicalHeaderKey(name)] {
+			values = []string{Redacted}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+func (r *Recorder) record(entry Entry) {
+	entry.Time = time.Now()
+	data, err := marshal(entry)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	if r.limit > 0 && r.written+int64(len(data))+1 > r.limit {
+		marker, _ := marshal(Entry{Time: entry.Time, Direction: entry.Direction, Truncated: true})
+		r.writeLocked(marker)
+		r.closeLocked()
+		return
+	}
+	if err := r.writeLocked(data); err != nil {
+		r.closeLocked()
+	}
+}
+
+// marshal encodes v without escaping HTML, so recordings read as they were
+// sent
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// writeLocked writes one line of the recording
+func (r *Recorder) writeLocked(data []byte) error {
+	n, err := r.w.Write(append(data, '\n'))
+	r.written += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write recording: %v", err)
+	}
+	// Flush per message so a recording survives the server crashing
+	return r.w.Flush()
+}
+
+// Close ends the recording
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeLocked()
+}
+
+func (r *Recorder) closeLocked() error {
+	if r.file == nil {
+		return nil
+	}
+	r.stopped = true
+	err := r.w.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	return err
+}
+
+// Read parses a recording
+func Read(reader io.Reader) (Header, []Entry, error) {
+	var header Header
+	var entries []Entry
+	scanner := bufio.NewScanner(reader)
+	// Entries carry whole request and response bodies
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var err error
+		if line == 1 {
+			err = json.Unmarshal(scanner.Bytes(), &header)
+		} else {
+			var entry Entry
+			if err = json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+				entries = append(entries, entry)
+			}
+		}
+		if err != nil {
+			return Header{}, nil, fmt.Errorf("invalid recording line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Header{}, nil, err
+	}
+	if header.ClientID == "" {
+		return Header{}, nil, fmt.Errorf("recording has no header")
+	}
+	return header, entries, nil
+}
+
+// Exchange is a recorded request with the response the client gave it
+type Exchange struct {
+	Request *types.Request
+	// Response is nil if the recording has none, with the body of a
+	// streamed response joined from its chunks
+	Response *types.Response
+}
+
+// Exchanges pairs the recorded requests with their responses, in the order
+// the requests were sent
+func Exchanges(entries []Entry) []Exchange {
+	var exchanges []Exchange
+	byID := make(map[string]int)
+	for _, entry := range entries {
+		switch {
+		case entry.Request != nil && entry.Direction == DirectionOut:
+			byID[entry.Request.ID] = len(exchanges)
+			exchanges = append(exchanges, Exchange{Request: entry.Request})
+		case entry.Response != nil && entry.Direction == DirectionIn:
+			i, ok := byID[entry.Response.RequestID]
+			if !ok {
+				continue
+			}
+			if first := exchanges[i].Response; first != nil {
+				// A chunk of a streamed response
+				first.Body = append(first.Body, entry.Response.Body...)
+				if entry.Response.Error != "" {
+					first.Error = entry.Response.Error
+				}
+				continue
+			}
+			resp := *entry.Response
+			exchanges[i].Response = &resp
+		}
+	}
+	return exchanges
+}
@@ -0,0 +1,237 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/redis"
+	"github.com/vikasavn/attachcloudip/pkg/testutil"
+)
+
+// startRedis starts a fake Redis answering each command with the reply
+// replies holds for its name, closed when the test ends
+func startRedis(t *testing.T, replies map[string]string) *testutil.RedisServer {
+	t.Helper()
+	s, err := testutil.StartRedis(func(args []string) string {
+		if reply, ok := replies[args[0]]; ok {
+			return reply
+		}
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestDoReplies(t *testing.T) {
+	s := startRedis(t, map[string]string{
+		"SIMPLE":  "+OK\r\n",
+		"INT":     ":-42\r\n",
+		"BULK":    "$12\r\nline\r\nbreak!\r\n",
+		"EMPTY":   "$0\r\n\r\n",
+		"NIL":     "$-1\r\n",
+		"NILLIST": "*-1\r\n",
+		"LIST":    "*4\r\n+a\r\n:1\r\n$-1\r\n-ERR inner\r\n",
+		"NESTED":  "*2\r\n*1\r\n$1\r\nx\r\n*0\r\n",
+		"ERROR":   "-WRONGTYPE Operation against a key\r\n",
+	})
+	c := redis.New(s.Addr, "", 0)
+	defer c.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		command string
+		want    any
+	}{
+		{"SIMPLE", "OK"},
+		{"INT", int64(-42)},
+		{"BULK", "line\r\nbreak!"},
+		{"EMPTY", ""},
+		{"NESTED", []any{[]any{"x"}, []any{}}},
+	}
+	for _, tt := range tests {
+		got, err := c.Do(ctx, tt.command)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %#v, %v, want %#v", tt.command, got, err, tt.want)
+		}
+	}
+
+	for _, command := range []string{"NIL", "NILLIST"} {
+		if _, err := c.Do(ctx, command); !errors.Is(err, redis.Nil) {
+			t.Errorf("%s error = %v, want redis.Nil", command, err)
+		}
+	}
+	// Nil items are nil, and error items keep their error
+	list, err := c.Do(ctx, "LIST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := list.([]any); len(items) != 4 || items[0] != "a" || items[1] != int64(1) ||
+		items[2] != nil || items[3].(error).Error() != "redis: ERR inner" {
+		t.Errorf("LIST = %#v", list)
+	}
+
+	var replyErr redis.Error
+	if _, err := c.Do(ctx, "ERROR"); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "WRONGTYPE") {
+		t.Errorf("ERROR error = %v, want a reply error", err)
+	}
+	// Replies, nil, and error replies all leave the connection reusable
+	if n := s.Connections(); n != 1 {
+		t.Errorf("opened %d connections, want 1", n)
+	}
+}
+
+func TestDoSendsArguments(t *testing.T) {
+	s := startRedis(t, map[string]string{"SET": "+OK\r\n"})
+	c := redis.New(s.Addr, "", 0)
+	defer c.Close()
+	value := "binary\r\n*1\r\n$3\r\nvalue \x00"
+	if _, err := c.Do(context.Background(), "SET", "key", value, "PX", "1000"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Commands(), [][]string{{"SET", "key", value, "PX", "1000"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestDoMalformedReplies(t *testing.T) {
+	replies := map[string]string{
+		"UNKNOWN":   "?what\r\n",
+		"SHORT":     "+\n",
+		"INT":       ":forty-two\r\n",
+		"BULKLEN":   "$many\r\n",
+		"LISTLEN":   "*many\r\n",
+		"TRUNCATED": "$10\r\nshort\r\n",
+		"ITEM":      "*2\r\n+a\r\n:x\r\n",
+	}
+	s := startRedis(t, replies)
+	c := redis.New(s.Addr, "", 0)
+	defer c.Close()
+	// Each command goes out on the connection the last PING left idle
+	c.Ping(context.Background())
+
+	for command := range replies {
+		before := s.Connections()
+		// A truncated reply waits for the deadline
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, err := c.Do(ctx, command)
+		cancel()
+		var replyErr redis.Error
+		if err == nil || errors.As(err, &replyErr) || errors.Is(err, redis.Nil) {
+			t.Errorf("%s error = %v, want a malformed reply", command, err)
+		}
+		// The connection is dropped since the rest of the reply is unknown
+		if _, err := c.Do(context.Background(), "PING"); err == nil {
+			t.Errorf("PING after %s answered, want an unknown command error", command)
+		}
+		if s.Connections() != before+1 {
+			t.Errorf("%s: connection reused after a malformed reply", command)
+		}
+	}
+}
+
+func TestAuthAndSelect(t *testing.T) {
+	s, err := testutil.StartRedis(func(args []string) string {
+		switch {
+		case args[0] == "AUTH" && args[1] == "secret":
+			return "+OK\r\n"
+		case args[0] == "AUTH":
+			return "-WRONGPASS invalid password\r\n"
+		case args[0] == "SELECT" && args[1] == "3":
+			return "+OK\r\n"
+		case args[0] == "SELECT":
+			return "-ERR DB index is out of range\r\n"
+		}
+		return "+PONG\r\n"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	c := redis.New(s.Addr, "secret", 3)
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	c.Close()
+	if got, want := s.Commands(), [][]string{{"AUTH", "secret"}, {"SELECT", "3"}, {"PING"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("commands = %q, want %q", got, want)
+	}
+
+	for _, c := range []*redis.Client{redis.New(s.Addr, "guess", 3), redis.New(s.Addr, "secret", 99)} {
+		var replyErr redis.Error
+		if err := c.Ping(ctx); !errors.As(err, &replyErr) {
+			t.Errorf("Ping error = %v, want a reply error", err)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := startRedis(t, map[string]string{"PING": "+PONG\r\n"})
+	c := redis.New(s.Addr, "", 0)
+	defer c.Close()
+	ctx := context.Background()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pooled connection fails once, then the client dials again
+	s.Drop()
+	if err := c.Ping(ctx); err == nil {
+		t.Fatal("Ping over a dropped connection succeeded")
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping after reconnecting: %v", err)
+	}
+	if n := s.Connections(); n != 2 {
+		t.Fatalf("opened %d connections, want 2", n)
+	}
+
+	s.Close()
+	if err := c.Ping(ctx); err == nil {
+		t.Fatal("Ping of a stopped server succeeded")
+	}
+	if err := c.Ping(ctx); err == nil || !strings.Contains(err.Error(), "failed to connect") {
+		t.Fatalf("Ping error = %v, want a connection error", err)
+	}
+}
+
+func TestDoTimeout(t *testing.T) {
+	release := make(chan struct{})
+	s, err := testutil.StartRedis(func(args []string) string {
+		if args[0] == "SLOW" {
+			<-release
+		}
+		return "+OK\r\n"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer close(release)
+
+	c := redis.New(s.Addr, "", 0)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Do(ctx, "SLOW"); err == nil {
+		t.Fatal("Do answered past its deadline")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Do returned after %s, want the context's deadline", elapsed)
+	}
+	if _, err := c.Do(context.Background(), "FAST"); err != nil {
+		t.Fatalf("Do after a timeout: %v", err)
+	}
+	if n := s.Connections(); n != 2 {
+		t.Fatalf("opened %d connections, want the timed out one replaced", n)
+	}
+}
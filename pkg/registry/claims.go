@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// ClaimPolicy decides what happens when a client claims a path another
+// client of the tenant already has
+type ClaimPolicy string
+
+const (
+	PolicyShare    ClaimPolicy = "share"    // Both clients get the path's traffic, by weight
+	PolicyReject   ClaimPolicy = "reject"   // The new claim fails
+	PolicyTakeover ClaimPolicy = "takeover" // The clients that had the path are evicted
+)
+
+// ParseClaimPolicy reads "share", "reject", or "takeover", with "" as share
+func ParseClaimPolicy(s string) (ClaimPolicy, error) {
+	switch policy := ClaimPolicy(s); policy {
+	case "":
+		return PolicyShare, nil
+	case PolicyShare, PolicyReject, PolicyTakeover:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown claim policy %q, expected share, reject, or takeover", s)
+}
+
+// ClaimPolicies are the claim policies of paths, matched by their exact
+// pattern, falling back to Default
+type ClaimPolicies struct {
+	Default ClaimPolicy
+	Paths   map[string]ClaimPolicy
+}
+
+// For returns the policy of a path
+func (p ClaimPolicies) For(path string) ClaimPolicy {
+	if policy, ok := p.Paths[path]; ok {
+		return policy
+	}
+	if p.Default == "" {
+		return PolicyShare
+	}
+	return p.Default
+}
+
+// PathClaim is the outcome of claiming a path, as reported to the client
+type PathClaim struct {
+	Path       string      `json:"path"`
+	Policy     ClaimPolicy `json:"policy"`
+	SharedWith []string    `json:"shared_with,omitempty"` // Clients the path is load-balanced across
+	TookOver   []string    `json:"took_over,omitempty"`   // Clients evicted from the path
+}
+
+// Claim applies the policy of path to a new claim, given the other clients
+// that have it. It fails with ErrPathClaimed if the policy rejects it.
+func (p ClaimPolicies) Claim(path string, owners []string) (PathClaim, error) {
+	claim := PathClaim{Path: path, Policy: p.For(path)}
+	if len(owners) == 0 {
+		return claim, nil
+	}
+	switch claim.Policy {
+	case PolicyReject:
+		return claim, fmt.Errorf("%w: %s is claimed by client %s", ErrPathClaimed, path, owners[0])
+	case PolicyTakeover:
+		claim.TookOver = owners
+	default:
+		claim.SharedWith = owners
+	}
+	return claim, nil
+}
+
+// SetClaimPolicies sets what happens to clients registering paths other
+// clients already have
+func (r *Registry) SetClaimPolicies(policies ClaimPolicies) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policies = policies
+}
+
+// ownersLocked returns the other clients of the tenant registered for path
+func (r *Registry) ownersLocked(tenant, path, clientID string) []string {
+	var owners []string
+	for id, client := range r.clients {
+		if id == clientID || client.Tenant != tenant {
+			continue
+		}
+		if slices.Contains(client.Paths, path) {
+			owners = append(owners, id)
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
@@ -0,0 +1,295 @@
+package registry
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+)
+
+// Number of entries a client's history keeps of each kind
+const (
+	historyHeartbeats  = 60
+	historyConnections = 20
+	historyErrors      = 20
+	historyConfigs     = 10
+	historyCommands    = 20
+)
+
+// ring keeps the latest entries appended to it, dropping the oldest
+type ring[T any] struct {
+	entries []T
+	next    int
+	full    bool
+}
+
+func newRing[T any](size int) ring[T] {
+	return ring[T]{entries: make([]T, size)}
+}
+
+func (r *ring[T]) add(entry T) {
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns the latest entry, or nil if there is none
+func (r *ring[T]) last() *T {
+	if !r.full && r.next == 0 {
+		return nil
+	}
+	return &r.entries[(r.next+len(r.entries)-1)%len(r.entries)]
+}
+
+// list returns the entries oldest first
+func (r *ring[T]) list() []T {
+	if !r.full {
+		return append([]T{}, r.entries[:r.next]...)
+	}
+	return append(append([]T{}, r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+// Heartbeat is a heartbeat received from a client
+type Heartbeat struct {
+	At    time.Time `json:"at"`
+	RTTMs float64   `json:"rtt_ms,omitempty"` // Round trip the client reported for it
+}
+
+// Connection is one tunnel connection of a client. The counts are what the
+// connection carried, so far for the open one.
+type Connection struct {
+	RemoteAddr     string     `json:"remote_addr"`
+	ConnectedAt    time.Time  `json:"connected_at"`
+	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
+	Reason         string     `json:"reason,omitempty"` // Why it ended, e.g. disconnected or expired
+	Requests       int64      `json:"requests"`
+	BytesSent      int64      `json:"bytes_sent"`
+	BytesReceived  int64      `json:"bytes_received"`
+
+	counters *traffic.Counters // Counters of the open connection
+	base     traffic.Stats     // Counts when it connected, as resumed sessions keep theirs
+}
+
+// Error is an error on a client's tunnel or one of its proxied requests
+type Error struct {
+	At      time.Time `json:"at"`
+	Message string    `json:"message"`
+}
+
+// ConfigPush is a configuration update pushed to a client, pending until
+// the client acknowledges it
+type ConfigPush struct {
+	Revision int64           `json:"revision"`
+	Settings json.RawMessage `json:"settings"`
+	PushedAt time.Time       `json:"pushed_at"`
+	AckedAt  *time.Time      `json:"acked_at,omitempty"` // When the client applied or rejected it
+	Error    string          `json:"error,omitempty"`    // Why the client rejected it
+}
+
+// CommandRun is a remote command sent to a client, running until the
+// client reports its result
+type CommandRun struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Args       string     `json:"args,omitempty"`
+	SentAt     time.Time  `json:"sent_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	OK         bool       `json:"ok"`
+	Output     string     `json:"output,omitempty"` // What the command did, or why it failed
+}
+
+// History keeps a client's recent heartbeats, connections, errors,
+// configuration pushes, and commands
+type History struct {
+	mu          sync.Mutex
+	heartbeats  ring[Heartbeat]
+	connections ring[Connection]
+	errors      ring[Error]
+	configs     ring[ConfigPush]
+	commands    ring[CommandRun]
+}
+
+// HistorySnapshot is a copy of a client's history, oldest entries first
+type HistorySnapshot struct {
+	Heartbeats   []Heartbeat  `json:"heartbeats"`
+	Connections  []Connection `json:"connections"`
+	Errors       []Error      `json:"errors"`
+	ConfigPushes []ConfigPush `json:"config_pushes"`
+	Commands     []CommandRun `json:"commands"`
+}
+
+func NewHistory() *History {
+	return &History{
+		heartbeats:  newRing[Heartbeat](historyHeartbeats),
+		connections: newRing[Connection](historyConnections),
+		errors:      newRing[Error](historyErrors),
+		configs:     newRing[ConfigPush](historyConfigs),
+		commands:    newRing[CommandRun](historyCommands),
+	}
+}
+
+// RecordHeartbeat adds a heartbeat received at at
+func (h *History) RecordHeartbeat(at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.heartbeats.add(Heartbeat{At: at})
+}
+
+// RecordRTT sets the round trip of the latest heartbeat
+func (h *History) RecordRTT(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if last := h.heartbeats.last(); last != nil {
+		last.RTTMs = float64(rtt) / float64(time.Millisecond)
+	}
+}
+
+// Connected adds a connection from remoteAddr whose traffic goes to
+// counters, ending the previous one if it is still open
+func (h *History) Connected(remoteAddr string, counters *traffic.Counters) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.endLocked("replaced")
+	conn := Connection{RemoteAddr: remoteAddr, ConnectedAt: time.Now(), counters: counters}
+	if counters != nil {
+		conn.base = counters.Snapshot()
+	}
+	h.connections.add(conn)
+}
+
+// Disconnected ends the open connection for reason
+func (h *History) Disconnected(reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.endLocked(reason)
+}
+
+func (h *History) endLocked(reason string) {
+	last := h.connections.last()
+	if last == nil || last.DisconnectedAt != nil {
+		return
+	}
+	now := time.Now()
+	last.count()
+	last.DisconnectedAt = &now
+	last.Reason = reason
+	last.counters = nil
+}
+
+// count sets the counts of an open connection from its counters
+func (c *Connection) count() {
+	if c.counters == nil {
+		return
+	}
+	stats := c.counters.Snapshot()
+	c.Requests = stats.Requests - c.base.Requests
+	c.BytesSent = stats.BytesSent - c.base.BytesSent
+	c.BytesReceived = stats.BytesReceived - c.base.BytesReceived
+}
+
+// DisconnectedAt returns when the latest connection ended, or the zero time
+// while it is open or if there never was one
+func (h *History) DisconnectedAt() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if last := h.connections.last(); last != nil && last.DisconnectedAt != nil {
+		return *last.DisconnectedAt
+	}
+	return time.Time{}
+}
+
+// RecordError adds an error with the given message
+func (h *History) RecordError(message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errors.add(Error{At: time.Now(), Message: message})
+}
+
+// RecordConfigPush adds a configuration update pushed to the client
+func (h *History) RecordConfigPush(revision int64, settings json.RawMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.configs.add(ConfigPush{Revision: revision, Settings: settings, PushedAt: time.Now()})
+}
+
+// AckConfig marks the pushed update with the revision as applied, or as
+// rejected with reason if reason isn't empty. It reports whether the update
+// was pending.
+func (h *History) AckConfig(revision int64, reason string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.configs.entries {
+		push := &h.configs.entries[i]
+		if push.Revision != revision || push.PushedAt.IsZero() || push.AckedAt != nil {
+			continue
+		}
+		now := time.Now()
+		push.AckedAt, push.Error = &now, reason
+		return true
+	}
+	return false
+}
+
+// LastConfigPush returns the latest configuration update pushed to the
+// client, or nil if there was none
+func (h *History) LastConfigPush() *ConfigPush {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	last := h.configs.last()
+	if last == nil {
+		return nil
+	}
+	push := *last
+	return &push
+}
+
+// RecordCommand adds a command sent to the client
+func (h *History) RecordCommand(id, name, args string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commands.add(CommandRun{ID: id, Name: name, Args: args, SentAt: time.Now()})
+}
+
+// FinishCommand records the result of the running command with the ID and
+// reports whether it was running
+func (h *History) FinishCommand(id string, ok bool, output string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.commands.entries {
+		run := &h.commands.entries[i]
+		if run.ID != id || run.SentAt.IsZero() || run.FinishedAt != nil {
+			continue
+		}
+		now := time.Now()
+		run.FinishedAt, run.OK, run.Output = &now, ok, output
+		return true
+	}
+	return false
+}
+
+// Commands returns the commands sent to the client, oldest first
+func (h *History) Commands() []CommandRun {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.commands.list()
+}
+
+// Snapshot copies the history, counting the open connection's traffic so far
+func (h *History) Snapshot() HistorySnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snap := HistorySnapshot{
+		Heartbeats:   h.heartbeats.list(),
+		Connections:  h.connections.list(),
+		Errors:       h.errors.list(),
+		ConfigPushes: h.configs.list(),
+		Commands:     h.commands.list(),
+	}
+	for i := range snap.Connections {
+		snap.Connections[i].count()
+	}
+	return snap
+}
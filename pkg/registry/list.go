@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// maxListLimit caps the page size of list requests
+const maxListLimit = 1000
+
+// ListOptions filters and pages a client listing. Empty fields match every
+// client, and a zero Limit returns every client from Offset on.
+type ListOptions struct {
+	Tenant       string
+	FilterTenant bool // Tenant is set, possibly to the default tenant ""
+	Status       string
+	Path         string      // Clients registered for exactly this path
+	Type         *ClientType // Clients of this type
+	Offset       int
+	Limit        int
+}
+
+// ParseListOptions reads ?tenant=&status=&path=&type=http|tcp&offset=&limit=
+func ParseListOptions(query url.Values) (ListOptions, error) {
+	opts := ListOptions{
+		Tenant:       query.Get("tenant"),
+		FilterTenant: query.Has("tenant"),
+		Status:       query.Get("status"),
+		Path:         query.Get("path"),
+	}
+	switch query.Get("type") {
+	case "":
+	case "http":
+		t := ClientTypeHTTP
+		opts.Type = &t
+	case "tcp":
+		t := ClientTypeTCP
+		opts.Type = &t
+	default:
+		return opts, fmt.Errorf("type must be http or tcp")
+	}
+	var err error
+	if value := query.Get("offset"); value != "" {
+		if opts.Offset, err = strconv.Atoi(value); err != nil || opts.Offset < 0 {
+			return opts, fmt.Errorf("invalid offset: %s", value)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if opts.Limit, err = strconv.Atoi(value); err != nil || opts.Limit < 0 || opts.Limit > maxListLimit {
+			return opts, fmt.Errorf("limit must be between 0 and %d", maxListLimit)
+		}
+	}
+	return opts, nil
+}
+
+// Page returns the bounds of the requested page within total results
+func (o ListOptions) Page(total int) (start, end int) {
+	start = min(o.Offset, total)
+	end = total
+	if o.Limit > 0 {
+		end = min(start+o.Limit, total)
+	}
+	return start, end
+}
+
+// snapshot copies the client's registration, so callers can read it without
+// racing heartbeats and health updates
+func (c *ClientRegistration) snapshot() *ClientRegistration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	metadata := make(map[string]string, len(c.Metadata))
+	for name, value := range c.Metadata {
+		metadata[name] = value
+	}
+	return &ClientRegistration{
+		ID:                   c.ID,
+		Tenant:               c.Tenant,
+		Type:                 c.Type,
+		Paths:                slices.Clone(c.Paths),
+		LastHeartbeat:        c.LastHeartbeat,
+		TCPPort:              c.TCPPort,
+		ActiveTCPConnections: c.ActiveTCPConnections,
+		Status:               c.Status,
+		Healthy:              c.Healthy,
+		Weight:               c.Weight,
+		Metadata:             metadata,
+		Traffic:              c.Traffic,
+		ExpiresAt:            c.ExpiresAt,
+		RTT:                  c.RTT,
+		History:              c.History,
+		Claims:               slices.Clone(c.Claims),
+	}
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+)
+
+// ErrPathClaimed is returned for paths already registered by another client
+var ErrPathClaimed = errors.New("path is claimed by another client")
+
+// UpdatePaths adds and removes paths of a registered client, changing its
+// registration and the tenant's route table together. Nothing changes if a
+// path is invalid, not the client's to remove, or registered by another
+// client of the tenant under the reject policy. Clients whose paths are
+// taken over are evicted. It returns the client's paths after the update.
+func (r *Registry) UpdatePaths(clientID string, add, remove []string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, exists := r.clients[clientID]
+	if !exists {
+		return nil, fmt.Errorf("client not found: %s", clientID)
+	}
+
+	client.mu.Lock()
+	paths := slices.Clone(client.Paths)
+	client.mu.Unlock()
+	for _, path := range remove {
+		i := slices.Index(paths, path)
+		if i < 0 {
+			return nil, fmt.Errorf("client %s has no path %s", clientID, path)
+		}
+		paths = slices.Delete(paths, i, i+1)
+	}
+	var claims []PathClaim
+	for _, path := range add {
+		if err := routing.Validate(path); err != nil {
+			return nil, err
+		}
+		if slices.Contains(paths, path) {
+			return nil, fmt.Errorf("client %s already has path %s", clientID, path)
+		}
+		claim, err := r.policies.Claim(path, r.ownersLocked(client.Tenant, path, clientID))
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, claim)
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("client %s must keep at least one path", clientID)
+	}
+
+	r.evictLocked(claims)
+	table, ok := r.routes[client.Tenant]
+	if !ok {
+		table = routing.NewTable()
+		r.routes[client.Tenant] = table
+	}
+	for _, path := range remove {
+		table.Remove(path, clientID)
+	}
+	for _, path := range add {
+		table.Insert(path, clientID) // Validated above
+	}
+	if table.Len() == 0 {
+		delete(r.routes, client.Tenant)
+	}
+
+	client.mu.Lock()
+	client.Paths = paths
+	client.mu.Unlock()
+	return slices.Clone(paths), nil
+}
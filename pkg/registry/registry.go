@@ -1,12 +1,17 @@
 package registry
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/ports"
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
 )
 
 // ClientType defines the type of client
@@ -20,110 +25,262 @@ const (
 // ClientRegistration represents a registered client
 type ClientRegistration struct {
 	ID                   string
+	Tenant               string
 	Type                 ClientType
 	Paths                []string
 	LastHeartbeat        time.Time
 	TCPPort              int
 	ActiveTCPConnections int
 	Status               string
+	Healthy              bool
+	Weight               int
 	Metadata             map[string]string
+	Traffic              *traffic.Counters // Cumulative and per-minute requests and bytes
+	ExpiresAt            time.Time         // Zero if the registration never expires
+	RTT                  *traffic.RTT      // Rolling average of heartbeat round trips
+	History              *History          // Recent heartbeats, connections, and errors
+	Claims               []PathClaim       // How the paths were claimed at registration
 	mu                   sync.Mutex
 }
 
 // Registry manages client registrations
 type Registry struct {
-	mu               sync.RWMutex
-	clients          map[string]*ClientRegistration
-	pathToClientIDs  map[string][]string
-	availableTCPPort int
+	mu       sync.RWMutex
+	clients  map[string]*ClientRegistration
+	routes   map[string]*routing.Table // Map tenant to its route table
+	ports    *ports.Allocator          // TCP ports of TCP clients
+	policies ClaimPolicies             // What happens to paths claimed twice
 }
 
-// NewRegistry creates a new client registry
+// NewRegistry creates a new client registry allocating TCP ports from
+// startPort up
 func NewRegistry(startPort int) *Registry {
+	return NewRegistryWithPorts(ports.New(ports.Range{Min: startPort, Max: 65535}))
+}
+
+// NewRegistryWithPorts creates a new client registry allocating TCP ports
+// with the allocator
+func NewRegistryWithPorts(allocator *ports.Allocator) *Registry {
 	return &Registry{
-		clients:          make(map[string]*ClientRegistration),
-		pathToClientIDs:  make(map[string][]string),
-		availableTCPPort: startPort,
+		clients: make(map[string]*ClientRegistration),
+		routes:  make(map[string]*routing.Table),
+		ports:   allocator,
 	}
 }
 
+// ReservePort excludes a port from dynamic allocation, keeping it for the named client
+func (r *Registry) ReservePort(clientID string, port int) error {
+	return r.ports.Reserve(port, clientID)
+}
+
 // AllocateTCPPort allocates a TCP port for a client
 func (r *Registry) AllocateTCPPort(clientType ClientType) (int, error) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	// Allocate port
-	tcpPort := r.availableTCPPort
-	r.availableTCPPort++
-
-	return tcpPort, nil
+	return r.ports.Allocate()
 }
 
-// RegisterClient adds a new client to the registry
-func (r *Registry) RegisterClient(paths []string, clientType ClientType, metadata map[string]string) (*ClientRegistration, error) {
+// RegisterClient adds a new client to the tenant's namespace in the registry.
+// Nothing is registered once ctx is done.
+func (r *Registry) RegisterClient(ctx context.Context, tenant string, paths []string, clientType ClientType, metadata map[string]string) (*ClientRegistration, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// Generate unique client ID
 	clientID := uuid.New().String()
 
+	// Apply the claim policies before changing anything
+	claims := make([]PathClaim, 0, len(paths))
+	for _, path := range paths {
+		claim, err := r.policies.Claim(path, r.ownersLocked(tenant, path, clientID))
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, claim)
+	}
+
+	// Map paths to client IDs within the tenant
+	table, ok := r.routes[tenant]
+	if !ok {
+		table = routing.NewTable()
+		r.routes[tenant] = table
+	}
+	for i, path := range paths {
+		if err := table.Insert(path, clientID); err != nil {
+			for _, inserted := range paths[:i] {
+				table.Remove(inserted, clientID)
+			}
+			if table.Len() == 0 {
+				delete(r.routes, tenant)
+			}
+			return nil, err
+		}
+	}
+
 	// Allocate TCP port if needed
 	var tcpPort int
 	if clientType == ClientTypeTCP {
 		var err error
-		tcpPort, err = r.AllocateTCPPort(clientType)
-		if err != nil {
-			return nil, fmt.Errorf("failed to allocate TCP port: %w", err)
+		if tcpPort, err = r.ports.Allocate(); err != nil {
+			for _, path := range paths {
+				table.Remove(path, clientID)
+			}
+			if table.Len() == 0 {
+				delete(r.routes, tenant)
+			}
+			return nil, err
 		}
 	}
 
 	client := &ClientRegistration{
 		ID:                   clientID,
+		Tenant:               tenant,
 		Type:                 clientType,
 		Paths:                paths,
 		LastHeartbeat:        time.Now(),
 		TCPPort:              tcpPort,
 		ActiveTCPConnections: 0,
 		Status:               "active",
+		Healthy:              true,
+		Weight:               1,
 		Metadata:             metadata,
+		Traffic:              traffic.NewCounters(),
+		RTT:                  traffic.NewRTT(),
+		History:              NewHistory(),
+		Claims:               claims,
 	}
 
-	// Store client
+	// Evict the clients whose paths were taken over, then store the client
+	r.evictLocked(claims)
 	r.clients[clientID] = client
 
-	// Map paths to client IDs
-	for _, path := range paths {
-		r.pathToClientIDs[path] = append(r.pathToClientIDs[path], clientID)
-	}
-
 	// Debug logging
-	fmt.Printf("Registered client: ID=%s, Type=%v, Paths=%v, TCPPort=%d\n",
-		clientID, clientType, paths, tcpPort)
+	fmt.Printf("Registered client: ID=%s, Tenant=%q, Type=%v, Paths=%v, TCPPort=%d\n",
+		clientID, tenant, clientType, paths, tcpPort)
 	fmt.Printf("Current clients: %d\n", len(r.clients))
 
 	return client, nil
 }
 
-// FindClientForPath finds clients registered for a specific path
-func (r *Registry) FindClientForPath(path string) ([]*ClientRegistration, error) {
+// evictLocked removes the clients that claims took paths over from
+func (r *Registry) evictLocked(claims []PathClaim) {
+	for _, claim := range claims {
+		for _, id := range claim.TookOver {
+			if victim, ok := r.clients[id]; ok {
+				log.Printf("Client %s evicted: path %s taken over", id, claim.Path)
+				r.removeClientLocked(victim)
+			}
+		}
+	}
+}
+
+// FindClientForPath finds healthy clients of a tenant registered for the most
+// specific route matching path
+func (r *Registry) FindClientForPath(ctx context.Context, tenant, path string) ([]*ClientRegistration, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	clientIDs, exists := r.pathToClientIDs[path]
-	if !exists || len(clientIDs) == 0 {
+	table, ok := r.routes[tenant]
+	if !ok {
+		return nil, fmt.Errorf("no clients found for path: %s", path)
+	}
+	match, ok := table.Lookup(path)
+	if !ok {
 		return nil, fmt.Errorf("no clients found for path: %s", path)
 	}
 
-	clients := make([]*ClientRegistration, 0, len(clientIDs))
-	for _, clientID := range clientIDs {
-		if client, ok := r.clients[clientID]; ok {
+	clients := make([]*ClientRegistration, 0, len(match.IDs))
+	for _, clientID := range match.IDs {
+		client, ok := r.clients[clientID]
+		if !ok {
+			continue
+		}
+		client.mu.Lock()
+		healthy := client.Healthy
+		client.mu.Unlock()
+		if healthy {
 			clients = append(clients, client)
 		}
 	}
 
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no healthy clients found for path: %s", path)
+	}
+
 	return clients, nil
 }
 
+// SelectClientForPath picks one healthy client for the path, honoring client weights
+func (r *Registry) SelectClientForPath(ctx context.Context, tenant, path string) (*ClientRegistration, error) {
+	clients, err := r.FindClientForPath(ctx, tenant, path)
+	if err != nil {
+		return nil, err
+	}
+
+	totalWeight := 0
+	weights := make([]int, len(clients))
+	for i, client := range clients {
+		client.mu.Lock()
+		weights[i] = client.Weight
+		client.mu.Unlock()
+		totalWeight += weights[i]
+	}
+	if totalWeight <= 0 {
+		return nil, fmt.Errorf("no weighted clients found for path: %s", path)
+	}
+
+	n := rand.Intn(totalWeight)
+	for i, client := range clients {
+		if n < weights[i] {
+			return client, nil
+		}
+		n -= weights[i]
+	}
+	return clients[len(clients)-1], nil
+}
+
+// SetWeight sets the share of traffic a client receives relative to other clients on its paths
+func (r *Registry) SetWeight(clientID string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("weight must not be negative: %d", weight)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, exists := r.clients[clientID]
+	if !exists {
+		return fmt.Errorf("client not found: %s", clientID)
+	}
+
+	client.mu.Lock()
+	client.Weight = weight
+	client.mu.Unlock()
+	return nil
+}
+
+// SetHealth records the health of a client's local upstream as reported by the client
+func (r *Registry) SetHealth(clientID string, healthy bool) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, exists := r.clients[clientID]
+	if !exists {
+		return fmt.Errorf("client not found: %s", clientID)
+	}
+
+	client.mu.Lock()
+	client.Healthy = healthy
+	client.mu.Unlock()
+
+	log.Printf("[REGISTRY] Client %s upstream healthy: %v", clientID, healthy)
+	return nil
+}
+
 // UpdateHeartbeat updates the client's heartbeat timestamp and status
 func (r *Registry) UpdateHeartbeat(clientID string) error {
 	r.mu.Lock()
@@ -139,6 +296,7 @@ func (r *Registry) UpdateHeartbeat(clientID string) error {
 
 	client.LastHeartbeat = time.Now()
 	client.Status = "active"
+	client.History.RecordHeartbeat(client.LastHeartbeat)
 
 	// Log heartbeat with connection info
 	log.Printf("❤️  Heartbeat from client %s (TCP Connections: %d, Last Seen: %s)",
@@ -147,6 +305,42 @@ func (r *Registry) UpdateHeartbeat(clientID string) error {
 	return nil
 }
 
+// UpdateMetrics stores the metrics a client reported with its heartbeat in its metadata
+func (r *Registry) UpdateMetrics(clientID string, metrics map[string]string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, exists := r.clients[clientID]
+	if !exists {
+		return fmt.Errorf("client not found: %s", clientID)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.Metadata == nil {
+		client.Metadata = make(map[string]string)
+	}
+	for name, value := range metrics {
+		client.Metadata[name] = value
+	}
+	return nil
+}
+
+// RecordRTT adds a heartbeat round trip measured by the client to its rolling average
+func (r *Registry) RecordRTT(clientID string, rtt time.Duration) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, exists := r.clients[clientID]
+	if !exists {
+		return fmt.Errorf("client not found: %s", clientID)
+	}
+
+	client.RTT.Add(rtt)
+	client.History.RecordRTT(rtt)
+	return nil
+}
+
 // StartHeartbeatMonitor starts monitoring client heartbeats
 func (r *Registry) StartHeartbeatMonitor(interval time.Duration) {
 	go func() {
@@ -185,24 +379,7 @@ func (r *Registry) CleanupStaleClients(timeout time.Duration) []string {
 
 	for clientID, client := range r.clients {
 		if now.Sub(client.LastHeartbeat) > timeout {
-			// Remove from clients
-			delete(r.clients, clientID)
-
-			// Remove from path mappings
-			for _, path := range client.Paths {
-				clientList := r.pathToClientIDs[path]
-				for i, id := range clientList {
-					if id == clientID {
-						r.pathToClientIDs[path] = append(clientList[:i], clientList[i+1:]...)
-						break
-					}
-				}
-				// Remove path if no clients
-				if len(r.pathToClientIDs[path]) == 0 {
-					delete(r.pathToClientIDs, path)
-				}
-			}
-
+			r.removeClientLocked(client)
 			staleClientIDs = append(staleClientIDs, clientID)
 		}
 	}
@@ -210,6 +387,66 @@ func (r *Registry) CleanupStaleClients(timeout time.Duration) []string {
 	return staleClientIDs
 }
 
+// SetTTL makes the client's registration expire ttl from now. Calling it
+// again renews the registration, and a zero ttl removes the expiry.
+func (r *Registry) SetTTL(clientID string, ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("ttl must not be negative: %v", ttl)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, exists := r.clients[clientID]
+	if !exists {
+		return fmt.Errorf("client not found: %s", clientID)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if ttl == 0 {
+		client.ExpiresAt = time.Time{}
+	} else {
+		client.ExpiresAt = time.Now().Add(ttl)
+	}
+	return nil
+}
+
+// ExpireClients removes clients whose TTL has lapsed, releasing their ports
+func (r *Registry) ExpireClients() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expiredClientIDs := make([]string, 0)
+	now := time.Now()
+
+	for clientID, client := range r.clients {
+		client.mu.Lock()
+		expiresAt := client.ExpiresAt
+		client.mu.Unlock()
+
+		if !expiresAt.IsZero() && now.After(expiresAt) {
+			r.removeClientLocked(client)
+			expiredClientIDs = append(expiredClientIDs, clientID)
+			log.Printf("[REGISTRY] Registration of client %s expired", clientID)
+		}
+	}
+
+	return expiredClientIDs
+}
+
+// StartExpiryMonitor periodically removes clients whose TTL has lapsed
+func (r *Registry) StartExpiryMonitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			r.ExpireClients()
+		}
+	}()
+}
+
 // ClientCount returns the total number of registered clients
 func (r *Registry) ClientCount() int {
 	r.mu.RLock()
@@ -221,8 +458,13 @@ func (r *Registry) ClientCount() int {
 
 // ListClients returns a copy of all registered clients
 func (r *Registry) ListClients() map[string]*ClientRegistration {
-
-	return r.clients
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make(map[string]*ClientRegistration, len(r.clients))
+	for id, client := range r.clients {
+		clients[id] = client.snapshot()
+	}
+	return clients
 }
 
 // IncrementTCPConnection increments the active TCP connection count for a client
@@ -263,13 +505,12 @@ func (r *Registry) DecrementTCPConnection(clientID string) error {
 	return nil
 }
 
-// GetNextTCPPort returns the next available TCP port
+// GetNextTCPPort allocates a TCP port, returning 0 when none is free
 func (r *Registry) GetNextTCPPort() int {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	port := r.availableTCPPort
-	r.availableTCPPort++
+	port, err := r.ports.Allocate()
+	if err != nil {
+		return 0
+	}
 	return port
 }
 
@@ -278,18 +519,29 @@ func (r *Registry) RemoveClient(clientID string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// Remove client from the registry
-	delete(r.clients, clientID)
+	client, exists := r.clients[clientID]
+	if !exists {
+		return
+	}
+
+	r.removeClientLocked(client)
+	log.Printf("[REGISTRY] Removed client %s from registry", clientID)
+}
+
+// removeClientLocked drops the client and its path mappings and releases its TCP port
+func (r *Registry) removeClientLocked(client *ClientRegistration) {
+	delete(r.clients, client.ID)
 
-	// Remove client ID from path mappings
-	for path, ids := range r.pathToClientIDs {
-		for i, id := range ids {
-			if id == clientID {
-				r.pathToClientIDs[path] = append(ids[:i], ids[i+1:]...)
-				break
-			}
+	if table, ok := r.routes[client.Tenant]; ok {
+		for _, path := range client.Paths {
+			table.Remove(path, client.ID)
+		}
+		if table.Len() == 0 {
+			delete(r.routes, client.Tenant)
 		}
 	}
 
-	log.Printf("[REGISTRY] Removed client %s from registry", clientID)
+	if client.TCPPort != 0 {
+		r.ports.Release(client.TCPPort)
+	}
 }
@@ -0,0 +1,70 @@
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Conditions restrict a route to some requests. A route with conditions is
+// more specific than one without on the same pattern, and each condition
+// adds to that.
+type Conditions struct {
+	Methods []string          // Request methods served, any if empty
+	Headers map[string]string // Header values a request must all carry
+	// ALPN lists the protocols negotiated over TLS served, such as h2 or
+	// http/1.1, any if empty. Requests not over TLS never match it.
+	ALPN []string
+}
+
+// Empty reports whether the conditions allow every request
+func (c Conditions) Empty() bool {
+	return len(c.Methods) == 0 && len(c.Headers) == 0 && len(c.ALPN) == 0
+}
+
+func (c Conditions) matches(req request) bool {
+	if len(c.Methods) > 0 && !containsFold(c.Methods, req.method) {
+		return false
+	}
+	if len(c.ALPN) > 0 && (req.alpn == "" || !containsFold(c.ALPN, req.alpn)) {
+		return false
+	}
+	for name, value := range c.Headers {
+		if req.header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// specificity ranks conditions; a header narrows a route more than a method
+// or protocol list does
+func (c Conditions) specificity() int {
+	score := 2 * len(c.Headers)
+	if len(c.Methods) > 0 {
+		score++
+	}
+	if len(c.ALPN) > 0 {
+		score++
+	}
+	return score
+}
+
+// ParseHeaderCondition splits "Name=value" into a header name and value
+func ParseHeaderCondition(s string) (string, string, error) {
+	name, value, ok := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid header condition %q, expected Name=value", s)
+	}
+	return http.CanonicalHeaderKey(name), strings.TrimSpace(value), nil
+}
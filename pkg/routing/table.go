@@ -0,0 +1,450 @@
+// Package routing maps URL path patterns to the clients registered for them,
+// finding the most specific pattern for a request path in time proportional
+// to the depth of the path rather than the number of routes
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// RegexPrefix marks a pattern as a regular expression matched against the
+// whole request path, e.g. "~^/v[0-9]+/(?P<item>[^/]+)$"
+const RegexPrefix = "~"
+
+// Limits on regular expression routes, which are tried one by one
+const (
+	maxRegexLength = 512  // Bytes of the expression
+	maxRegexInsts  = 2000 // Instructions of its compiled program
+)
+
+// Table is a tree of path patterns keyed by segment. A pattern matches its
+// own path and every path below it. Segments starting with ':' match any one
+// segment, and a final '*' or '*name' matches the rest of the path. Patterns
+// starting with RegexPrefix are regular expressions, tried in registration
+// order when no other pattern matches. Table is not safe for concurrent use;
+// callers hold their own locks.
+type Table struct {
+	root    *node
+	routes  map[string]*node // Map pattern to its node
+	regexes []*regexRoute
+}
+
+type regexRoute struct {
+	pattern string
+	re      *regexp.Regexp
+	routed
+}
+
+// routed holds the IDs registered at a pattern with their conditions
+type routed struct {
+	ids        []string
+	conditions map[string]Conditions // Map ID to its conditions, if it has any
+}
+
+// Match is the result of a lookup
+type Match struct {
+	Pattern string
+	IDs     []string          // Registered for the pattern, in registration order
+	Params  map[string]string // Values of the pattern's parameters
+}
+
+type node struct {
+	literal  map[string]*node
+	param    *node    // Child for a ':name' segment
+	wildcard *node    // Child for a trailing '*name' segment
+	pattern  string   // Set when IDs are registered here
+	names    []string // Parameter names of pattern, in order
+	depth    int      // Literal and parameter segments from the root
+	routed
+}
+
+func NewTable() *Table {
+	return &Table{root: &node{}, routes: make(map[string]*node)}
+}
+
+// Validate reports whether pattern is a valid route
+func Validate(pattern string) error {
+	if IsRegex(pattern) {
+		_, err := compileRegex(pattern)
+		return err
+	}
+	_, err := parse(pattern)
+	return err
+}
+
+// IsRegex reports whether pattern is a regular expression route
+func IsRegex(pattern string) bool {
+	return strings.HasPrefix(pattern, RegexPrefix)
+}
+
+// compileRegex compiles a regular expression route, refusing expressions too
+// large to try on every unmatched request
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	expr := strings.TrimPrefix(pattern, RegexPrefix)
+	if len(expr) > maxRegexLength {
+		return nil, fmt.Errorf("invalid route %s: expression longer than %d bytes", pattern, maxRegexLength)
+	}
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route %s: %v", pattern, err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("invalid route %s: %v", pattern, err)
+	}
+	if len(prog.Inst) > maxRegexInsts {
+		return nil, fmt.Errorf("invalid route %s: expression too complex", pattern)
+	}
+	return regexp.Compile(expr)
+}
+
+// parse returns the parameter names of pattern
+func parse(pattern string) ([]string, error) {
+	segments := split(pattern)
+	var names []string
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("invalid route %s: wildcard must be the last segment", pattern)
+			}
+			names = append(names, wildcardName(segment))
+		case strings.HasPrefix(segment, ":"):
+			if segment == ":" {
+				return nil, fmt.Errorf("invalid route %s: parameter needs a name", pattern)
+			}
+			names = append(names, segment[1:])
+		}
+	}
+	return names, nil
+}
+
+// Insert registers id for pattern. Patterns differing only in parameter
+// names are the same route, which keeps the names it was first registered
+// with.
+func (t *Table) Insert(pattern, id string) error {
+	return t.InsertConditional(pattern, id, Conditions{})
+}
+
+// InsertConditional registers id for the requests to pattern that meet the
+// conditions, replacing any conditions id had there
+func (t *Table) InsertConditional(pattern, id string, conditions Conditions) error {
+	if IsRegex(pattern) {
+		return t.insertRegex(pattern, id, conditions)
+	}
+	names, err := parse(pattern)
+	if err != nil {
+		return err
+	}
+	n := t.root
+	for _, segment := range split(pattern) {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			if n.wildcard == nil {
+				n.wildcard = &node{depth: n.depth}
+			}
+			n = n.wildcard
+		case strings.HasPrefix(segment, ":"):
+			if n.param == nil {
+				n.param = &node{depth: n.depth + 1}
+			}
+			n = n.param
+		default:
+			if n.literal == nil {
+				n.literal = make(map[string]*node)
+			}
+			child, ok := n.literal[segment]
+			if !ok {
+				child = &node{depth: n.depth + 1}
+				n.literal[segment] = child
+			}
+			n = child
+		}
+	}
+
+	if n.pattern == "" {
+		n.pattern = pattern
+		n.names = names
+		t.routes[pattern] = n
+	}
+	n.add(id, conditions)
+	return nil
+}
+
+func (r *routed) add(id string, conditions Conditions) {
+	if conditions.Empty() {
+		delete(r.conditions, id)
+	} else {
+		if r.conditions == nil {
+			r.conditions = make(map[string]Conditions)
+		}
+		r.conditions[id] = conditions
+	}
+	for _, existing := range r.ids {
+		if existing == id {
+			return
+		}
+	}
+	r.ids = append(r.ids, id)
+}
+
+func (r *routed) remove(id string) {
+	for i, existing := range r.ids {
+		if existing == id {
+			r.ids = append(r.ids[:i:i], r.ids[i+1:]...)
+			break
+		}
+	}
+	delete(r.conditions, id)
+}
+
+// selectIDs returns the IDs whose conditions the request meets, keeping only
+// the most specific
+func (r *routed) selectIDs(req request) []string {
+	if len(r.conditions) == 0 {
+		return r.ids
+	}
+	best := -1
+	var selected []string
+	for _, id := range r.ids {
+		conditions := r.conditions[id]
+		if !conditions.matches(req) {
+			continue
+		}
+		switch score := conditions.specificity(); {
+		case score > best:
+			best = score
+			selected = []string{id}
+		case score == best:
+			selected = append(selected, id)
+		}
+	}
+	return selected
+}
+
+func (t *Table) insertRegex(pattern, id string, conditions Conditions) error {
+	for _, route := range t.regexes {
+		if route.pattern == pattern {
+			route.add(id, conditions)
+			return nil
+		}
+	}
+	re, err := compileRegex(pattern)
+	if err != nil {
+		return err
+	}
+	route := &regexRoute{pattern: pattern, re: re}
+	route.add(id, conditions)
+	t.regexes = append(t.regexes, route)
+	return nil
+}
+
+// Remove unregisters id from pattern
+func (t *Table) Remove(pattern, id string) {
+	if IsRegex(pattern) {
+		t.removeRegex(pattern, id)
+		return
+	}
+	n, ok := t.routes[pattern]
+	if !ok {
+		// Look for the node under the spelling it was inserted with
+		if n = t.find(split(pattern)); n == nil || n.pattern == "" {
+			return
+		}
+	}
+	n.remove(id)
+	if len(n.ids) == 0 {
+		delete(t.routes, n.pattern)
+		n.pattern = ""
+		n.names = nil
+		n.routed = routed{}
+		// Empty nodes are left in place; they cost a map entry and are
+		// reused when the pattern registers again
+	}
+}
+
+func (t *Table) removeRegex(pattern, id string) {
+	for i, route := range t.regexes {
+		if route.pattern != pattern {
+			continue
+		}
+		route.remove(id)
+		if len(route.ids) == 0 {
+			t.regexes = append(t.regexes[:i:i], t.regexes[i+1:]...)
+		}
+		return
+	}
+}
+
+// Lookup returns the most specific pattern matching path, skipping routes
+// with conditions
+func (t *Table) Lookup(path string) (Match, bool) {
+	return t.LookupRequest(path, "", nil, "")
+}
+
+// LookupRequest returns the most specific route for a request. Patterns with
+// more segments win; between equally long ones, literal segments beat
+// parameters and parameters beat wildcards. Regular expressions are tried
+// last, and their named groups become parameters. A pattern only matches
+// through IDs whose conditions the request meets, and of those, only the
+// IDs with the most specific conditions are returned. alpn is the protocol
+// negotiated for the request over TLS, empty for requests not over TLS.
+func (t *Table) LookupRequest(path, method string, header http.Header, alpn string) (Match, bool) {
+	req := request{method: method, header: header, alpn: alpn}
+	var best *candidate
+	var values []string
+	t.root.match(split(path), &values, &best, req)
+	if best == nil {
+		return t.lookupRegex(path, req)
+	}
+	match := Match{Pattern: best.node.pattern, IDs: best.ids}
+	if len(best.node.names) > 0 {
+		match.Params = make(map[string]string, len(best.node.names))
+		for i, name := range best.node.names {
+			match.Params[name] = best.values[i]
+		}
+	}
+	return match, true
+}
+
+func (t *Table) lookupRegex(path string, req request) (Match, bool) {
+	for _, route := range t.regexes {
+		ids := route.selectIDs(req)
+		if len(ids) == 0 {
+			continue
+		}
+		groups := route.re.FindStringSubmatch(path)
+		if groups == nil {
+			continue
+		}
+		match := Match{Pattern: route.pattern, IDs: append([]string(nil), ids...)}
+		for i, name := range route.re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			if match.Params == nil {
+				match.Params = make(map[string]string)
+			}
+			match.Params[name] = groups[i]
+		}
+		return match, true
+	}
+	return Match{}, false
+}
+
+// Routes returns every pattern with its IDs
+func (t *Table) Routes() map[string][]string {
+	routes := make(map[string][]string, len(t.routes)+len(t.regexes))
+	for pattern, n := range t.routes {
+		routes[pattern] = append([]string(nil), n.ids...)
+	}
+	for _, route := range t.regexes {
+		routes[route.pattern] = append([]string(nil), route.ids...)
+	}
+	return routes
+}
+
+// Matches reports whether path matches a single pattern
+func Matches(pattern, path string) bool {
+	t := NewTable()
+	if err := t.Insert(pattern, ""); err != nil {
+		return false
+	}
+	_, ok := t.Lookup(path)
+	return ok
+}
+
+// Len returns the number of registered patterns
+func (t *Table) Len() int {
+	return len(t.routes) + len(t.regexes)
+}
+
+// request is what conditions are checked against
+type request struct {
+	method string
+	header http.Header
+	alpn   string
+}
+
+// candidate is the best match found so far, with the values of its
+// parameters and the IDs the request can be routed to
+type candidate struct {
+	node   *node
+	values []string
+	ids    []string
+}
+
+// match walks segments in priority order, recording every registered node
+// passed as a candidate since patterns also match the paths below them
+func (n *node) match(segments []string, values *[]string, best **candidate, req request) {
+	if len(n.ids) > 0 {
+		record(n, *values, best, req)
+	}
+	if n.wildcard != nil && len(n.wildcard.ids) > 0 {
+		record(n.wildcard, append(*values, strings.Join(segments, "/")), best, req)
+	}
+	if len(segments) == 0 {
+		return
+	}
+
+	segment, rest := segments[0], segments[1:]
+	if child, ok := n.literal[segment]; ok {
+		child.match(rest, values, best, req)
+	}
+	if n.param != nil && segment != "" {
+		*values = append(*values, segment)
+		n.param.match(rest, values, best, req)
+		*values = (*values)[:len(*values)-1]
+	}
+}
+
+func record(n *node, values []string, best **candidate, req request) {
+	// Strictly deeper only, so the first found among equals, in priority order, wins
+	if *best != nil && n.depth <= (*best).node.depth {
+		return
+	}
+	ids := n.selectIDs(req)
+	if len(ids) == 0 {
+		return
+	}
+	*best = &candidate{node: n, values: append([]string(nil), values...), ids: append([]string(nil), ids...)}
+}
+
+// find returns the node for a pattern's segments, if it exists
+func (t *Table) find(segments []string) *node {
+	n := t.root
+	for _, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			n = n.wildcard
+		case strings.HasPrefix(segment, ":"):
+			n = n.param
+		default:
+			n = n.literal[segment]
+		}
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// split breaks a path into segments, ignoring leading and trailing slashes
+func split(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func wildcardName(segment string) string {
+	if name := segment[1:]; name != "" {
+		return name
+	}
+	return "*"
+}
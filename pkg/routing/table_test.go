@@ -0,0 +1,61 @@
+package routing
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchTable returns a table of n routes, a third each of literal routes,
+// routes with a parameter, and literal routes under a shared prefix
+func benchTable(b *testing.B, n int) *Table {
+	b.Helper()
+	t := NewTable()
+	for i := 0; i < n; i++ {
+		var pattern string
+		switch i % 3 {
+		case 0:
+			pattern = fmt.Sprintf("/svc%d/api", i)
+		case 1:
+			pattern = fmt.Sprintf("/users%d/:id/profile", i)
+		case 2:
+			pattern = fmt.Sprintf("/shared/team%d", i)
+		}
+		if err := t.Insert(pattern, fmt.Sprintf("client%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return t
+}
+
+func BenchmarkLookup(b *testing.B) {
+	for _, n := range []int{10_000, 100_000} {
+		t := benchTable(b, n)
+		// Paths hitting routes spread over the table, 0 mod 3 being literal
+		// routes, 1 mod 3 parameter routes, and 2 mod 3 the shared prefix
+		kinds := []struct {
+			name string
+			path func(i int) string
+		}{
+			{"exact", func(i int) string { return fmt.Sprintf("/svc%d/api", i) }},
+			{"prefix", func(i int) string { return fmt.Sprintf("/shared/team%d/deeper/path", i+2) }},
+			{"param", func(i int) string { return fmt.Sprintf("/users%d/%d/profile", i+1, i) }},
+			{"miss", func(i int) string { return fmt.Sprintf("/nothing/%d", i) }},
+		}
+		for _, kind := range kinds {
+			paths := make([]string, 1024)
+			step := n / len(paths) / 3 * 3
+			for i := range paths {
+				paths[i] = kind.path(i * step)
+			}
+			b.Run(fmt.Sprintf("%s/%d", kind.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, ok := t.Lookup(paths[i%len(paths)])
+					if ok == (kind.name == "miss") {
+						b.Fatalf("Lookup(%s) = %v", paths[i%len(paths)], ok)
+					}
+				}
+			})
+		}
+	}
+}
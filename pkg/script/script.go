@@ -0,0 +1,279 @@
+// Package script runs operator-supplied Lua hooks on frontend requests and
+// responses, so rewrites, extra headers, and rejections can change without
+// rebuilding the server.
+//
+// A script defines either or both of
+//
+//	function on_request(req) ... end
+//	function on_response(res) ... end
+//
+// req has method, host, path, query, remote_addr, and headers (a table of
+// canonical header names to values). Changing path, query, host, or headers
+// changes the request before it is routed. Returning a table such as
+// {status = 403, body = "denied", headers = {...}} answers the request
+// without routing it. res has status and headers, which may be changed before
+// the response is sent.
+package script
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// DefaultTimeout bounds each hook call when no timeout is configured
+const DefaultTimeout = 50 * time.Millisecond
+
+// Hook is a loaded script. Each request gets its own Lua state from a pool,
+// so globals a script sets are not reliably seen by later requests.
+type Hook struct {
+	name    string
+	proto   *lua.FunctionProto
+	timeout time.Duration
+	states  sync.Pool
+}
+
+// Load compiles the script at path, running it once to check that it loads
+func Load(path string, timeout time.Duration) (*Hook, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(strings.NewReader(string(source)), path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile %s: %v", path, err)
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	h := &Hook{name: path, proto: proto, timeout: timeout}
+	L, err := h.newState()
+	if err != nil {
+		return nil, err
+	}
+	if L.GetGlobal("on_request") == lua.LNil && L.GetGlobal("on_response") == lua.LNil {
+		L.Close()
+		return nil, fmt.Errorf("%s defines neither on_request nor on_response", path)
+	}
+	h.states.Put(L)
+	return h, nil
+}
+
+// newState returns a Lua state with the script loaded and only the libraries
+// that can't touch the host
+func (h *Hook) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.Push(L.NewFunctionFromProto(h.proto))
+	if err := h.call(L, func() error { return L.PCall(0, lua.MultRet, nil) }); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to run %s: %v", h.name, err)
+	}
+	L.SetTop(0)
+	return L, nil
+}
+
+// call runs fn under the hook's timeout
+func (h *Hook) call(L *lua.LState, fn func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	return fn()
+}
+
+// Middleware runs the hooks around next. A script error answers 500 and is
+// reported to onError.
+func (h *Hook) Middleware(onError func(error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			L, _ := h.states.Get().(*lua.LState)
+			if L == nil {
+				var err error
+				if L, err = h.newState(); err != nil {
+					onError(err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+			}
+			failed := false
+			fail := func(err error) {
+				failed = true
+				onError(fmt.Errorf("%s: %v", h.name, err))
+			}
+			defer func() {
+				// A state interrupted mid-call may be inconsistent
+				if failed {
+					L.Close()
+				} else {
+					h.states.Put(L)
+				}
+			}()
+
+			if fn, ok := L.GetGlobal("on_request").(*lua.LFunction); ok {
+				req, answered, err := h.onRequest(L, fn, r)
+				if err != nil {
+					fail(err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				if answered != nil {
+					writeAnswer(w, answered)
+					return
+				}
+				r = req
+			}
+
+			if fn, ok := L.GetGlobal("on_response").(*lua.LFunction); ok {
+				rw := &responseWriter{ResponseWriter: w}
+				rw.hook = func(status int) int {
+					status, err := h.onResponse(L, fn, status, w.Header())
+					if err != nil {
+						fail(err)
+						return http.StatusInternalServerError
+					}
+					return status
+				}
+				w = rw
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// onRequest calls on_request, returning the possibly changed request or the
+// table the script answered with
+func (h *Hook) onRequest(L *lua.LState, fn *lua.LFunction, r *http.Request) (*http.Request, *lua.LTable, error) {
+	req := L.NewTable()
+	req.RawSetString("method", lua.LString(r.Method))
+	req.RawSetString("host", lua.LString(r.Host))
+	req.RawSetString("path", lua.LString(r.URL.Path))
+	req.RawSetString("query", lua.LString(r.URL.RawQuery))
+	req.RawSetString("remote_addr", lua.LString(r.RemoteAddr))
+	req.RawSetString("headers", headerTable(L, r.Header))
+
+	var answer lua.LValue = lua.LNil
+	err := h.call(L, func() error {
+		if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, req); err != nil {
+			return err
+		}
+		answer = L.Get(-1)
+		L.Pop(1)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if table, ok := answer.(*lua.LTable); ok {
+		return nil, table, nil
+	}
+
+	r = r.Clone(r.Context())
+	if path := lua.LVAsString(req.RawGetString("path")); path != r.URL.Path {
+		if !strings.HasPrefix(path, "/") {
+			return nil, nil, fmt.Errorf("rewritten path %q must start with /", path)
+		}
+		r.URL.Path = path
+		r.URL.RawPath = ""
+	}
+	r.URL.RawQuery = lua.LVAsString(req.RawGetString("query"))
+	r.Host = lua.LVAsString(req.RawGetString("host"))
+	if headers, ok := req.RawGetString("headers").(*lua.LTable); ok {
+		applyHeaders(r.Header, headers)
+	}
+	return r, nil, nil
+}
+
+// onResponse calls on_response, applying its header changes to header and
+// returning the status to send
+func (h *Hook) onResponse(L *lua.LState, fn *lua.LFunction, status int, header http.Header) (int, error) {
+	res := L.NewTable()
+	res.RawSetString("status", lua.LNumber(status))
+	res.RawSetString("headers", headerTable(L, header))
+	err := h.call(L, func() error {
+		return L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, res)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if headers, ok := res.RawGetString("headers").(*lua.LTable); ok {
+		applyHeaders(header, headers)
+	}
+	if changed, ok := res.RawGetString("status").(lua.LNumber); ok && changed >= 100 && changed <= 999 {
+		status = int(changed)
+	}
+	return status, nil
+}
+
+// writeAnswer sends the response a script answered a request with
+func writeAnswer(w http.ResponseWriter, answer *lua.LTable) {
+	status := http.StatusForbidden
+	if value, ok := answer.RawGetString("status").(lua.LNumber); ok && value >= 100 && value <= 999 {
+		status = int(value)
+	}
+	if headers, ok := answer.RawGetString("headers").(*lua.LTable); ok {
+		headers.ForEach(func(key, value lua.LValue) {
+			w.Header().Set(lua.LVAsString(key), lua.LVAsString(value))
+		})
+	}
+	body := lua.LVAsString(answer.RawGetString("body"))
+	if body != "" && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// headerTable copies the first value of each header into a Lua table
+func headerTable(L *lua.LState, header http.Header) *lua.LTable {
+	table := L.CreateTable(0, len(header))
+	for name := range header {
+		table.RawSetString(name, lua.LString(header.Get(name)))
+	}
+	return table
+}
+
+// applyHeaders makes header match a table the script may have changed,
+// deleting the headers it removed
+func applyHeaders(header http.Header, table *lua.LTable) {
+	seen := make(map[string]bool)
+	table.ForEach(func(key, value lua.LValue) {
+		name := http.CanonicalHeaderKey(lua.LVAsString(key))
+		seen[name] = true
+		// Only the first value is visible to scripts, so untouched headers
+		// keep all of theirs
+		if v := lua.LVAsString(value); header.Get(name) != v {
+			header.Set(name, v)
+		}
+	})
+	for name := range header {
+		if !seen[name] {
+			header.Del(name)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AWSCredentials sign requests to AWS
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // Set for temporary credentials
+}
+
+// AWSSecretsManager reads secrets from AWS Secrets Manager. Paths are secret
+// names or ARNs. Secrets holding a JSON object have its members as fields;
+// any other string is returned whole.
+type AWSSecretsManager struct {
+	region      string
+	endpoint    string
+	credentials AWSCredentials
+	client      *http.Client
+}
+
+// NewAWSSecretsManager creates a provider for region. endpoint overrides the
+// regional endpoint, e.g. for a VPC endpoint, and may be empty.
+func NewAWSSecretsManager(region, endpoint string, credentials AWSCredentials) *AWSSecretsManager {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", region)
+	}
+	return &AWSSecretsManager{
+		region:      region,
+		endpoint:    strings.TrimRight(endpoint, "/"),
+		credentials: credentials,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (a *AWSSecretsManager) Fetch(ctx context.Context, path string) (map[string]string, error) {
+	body, _ := json.Marshal(map[string]string{"SecretId": path})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	a.sign(req, body, time.Now().UTC())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach Secrets Manager: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return nil, fmt.Errorf("Secrets Manager returned status %d for %s: %s %s", resp.StatusCode, path, failure.Type, failure.Message)
+	}
+
+	var secret struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("invalid Secrets Manager response: %v", err)
+	}
+	if secret.SecretString == nil {
+		return nil, fmt.Errorf("secret %s is binary, only string secrets are supported", path)
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(*secret.SecretString), &object); err != nil {
+		return map[string]string{"": *secret.SecretString}, nil
+	}
+	fields := make(map[string]string, len(object))
+	for name, value := range object {
+		if s, ok := value.(string); ok {
+			fields[name] = s
+		} else {
+			encoded, _ := json.Marshal(value)
+			fields[name] = string(encoded)
+		}
+	}
+	return fields, nil
+}
+
+// sign adds a Signature Version 4 Authorization header to req
+func (a *AWSSecretsManager) sign(req *http.Request, body []byte, now time.Time) {
+	const service = "secretsmanager"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if a.credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.credentials.SessionToken)
+	}
+	host := req.URL.Host
+	if u, err := url.Parse(a.endpoint); err == nil {
+		host = u.Host
+	}
+
+	headers := map[string]string{
+		"content-type": req.Header.Get("Content-Type"),
+		"host":         host,
+		"x-amz-date":   amzDate,
+		"x-amz-target": req.Header.Get("X-Amz-Target"),
+	}
+	if a.credentials.SessionToken != "" {
+		headers["x-amz-security-token"] = a.credentials.SessionToken
+	}
+	names := []string{"content-type", "host", "x-amz-date", "x-amz-security-token", "x-amz-target"}
+	var canonicalHeaders strings.Builder
+	var signed []string
+	for _, name := range names {
+		if value, ok := headers[name]; ok {
+			fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+			signed = append(signed, name)
+		}
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, "/", "", canonicalHeaders.String(), signedHeaders, hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, a.region, service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+a.credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,165 @@
+package secrets
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testCredentials = AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", SessionToken: "session"}
+
+// checkSignature recomputes the Signature Version 4 of a request as Secrets
+// Manager would, from the headers the request says it signed
+func checkSignature(r *http.Request, body []byte, credentials AWSCredentials) error {
+	auth := r.Header.Get("Authorization")
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		name, value, _ := strings.Cut(part, "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+	keyID, scope, _ := strings.Cut(credential, "/")
+	if keyID != credentials.AccessKeyID {
+		return fmt.Errorf("unknown access key %q", keyID)
+	}
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 || scopeParts[2] != "secretsmanager" || scopeParts[3] != "aws4_request" {
+		return fmt.Errorf("invalid credential scope %q", scope)
+	}
+	if !strings.Contains(signedHeaders, "host") || !strings.Contains(signedHeaders, "x-amz-date") {
+		return fmt.Errorf("host and x-amz-date aren't signed: %s", signedHeaders)
+	}
+
+	var canonical strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		fmt.Fprintf(&canonical, "%s:%s\n", name, value)
+	}
+	bodyHash := sha256.Sum256(body)
+	request := sha256.Sum256([]byte(strings.Join([]string{r.Method, r.URL.Path, r.URL.RawQuery, canonical.String(), signedHeaders, hex.EncodeToString(bodyHash[:])}, "\n")))
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", r.Header.Get("X-Amz-Date"), scope, hex.EncodeToString(request[:])}, "\n")
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range scopeParts {
+		key = hmacSHA256(key, part)
+	}
+	if want := hex.EncodeToString(hmacSHA256(key, toSign)); signature != want {
+		return fmt.Errorf("signature %s doesn't match", signature)
+	}
+	return nil
+}
+
+// fakeSecretsManager answers GetSecretValue with secrets by name for
+// requests signed with testCredentials in us-east-1
+func fakeSecretsManager(t *testing.T, secrets map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fail := func(status int, kind, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"__type": kind, "message": message})
+		}
+		if err := checkSignature(r, body, testCredentials); err != nil {
+			fail(http.StatusForbidden, "InvalidSignatureException", err.Error())
+			return
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/") || r.Header.Get("X-Amz-Security-Token") != "session" {
+			fail(http.StatusBadRequest, "UnrecognizedClientException", "The security token included in the request is invalid")
+			return
+		}
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || r.Method != http.MethodPost {
+			fail(http.StatusBadRequest, "InvalidAction", r.Header.Get("X-Amz-Target"))
+			return
+		}
+		var input struct{ SecretId string }
+		json.Unmarshal(body, &input)
+		reply, ok := secrets[input.SecretId]
+		if !ok {
+			fail(http.StatusBadRequest, "ResourceNotFoundException", "Secrets Manager can't find the specified secret.")
+			return
+		}
+		w.Write([]byte(reply))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAWSFetch(t *testing.T) {
+	server := fakeSecretsManager(t, map[string]string{
+		"tunnel/db":    `{"Name": "tunnel/db", "SecretString": "{\"user\": \"tunnel\", \"port\": 5432, \"tls\": {\"mode\": \"require\"}}"}`,
+		"tunnel/token": `{"Name": "tunnel/token", "SecretString": "plain-token"}`,
+	})
+	a := NewAWSSecretsManager("us-east-1", server.URL+"/", testCredentials)
+	tests := []struct {
+		path string
+		want map[string]string
+	}{
+		{"tunnel/db", map[string]string{"user": "tunnel", "port": "5432", "tls": `{"mode":"require"}`}},
+		{"tunnel/token", map[string]string{"": "plain-token"}},
+	}
+	for _, tt := range tests {
+		got, err := a.Fetch(context.Background(), tt.path)
+		if err != nil {
+			t.Fatalf("Fetch %s: %v", tt.path, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Fetch %s = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAWSFetchErrors(t *testing.T) {
+	server := fakeSecretsManager(t, map[string]string{
+		"binary":    `{"Name": "binary", "SecretBinary": "AAEC"}`,
+		"truncated": `{"SecretString": `,
+		"not json":  `<html>gateway error</html>`,
+	})
+	good := NewAWSSecretsManager("us-east-1", server.URL, testCredentials)
+	wrongSecret := testCredentials
+	wrongSecret.SecretAccessKey = "guess"
+	unknownKey := testCredentials
+	unknownKey.AccessKeyID = "AKIDUNKNOWN"
+	noToken := testCredentials
+	noToken.SessionToken = ""
+
+	tests := []struct {
+		name     string
+		provider *AWSSecretsManager
+		path     string
+		message  string // Part of the error
+	}{
+		{"wrong secret key", NewAWSSecretsManager("us-east-1", server.URL, wrongSecret), "binary", "InvalidSignatureException"},
+		{"unknown access key", NewAWSSecretsManager("us-east-1", server.URL, unknownKey), "binary", "status 403"},
+		{"no session token", NewAWSSecretsManager("us-east-1", server.URL, noToken), "binary", "UnrecognizedClientException"},
+		{"other region", NewAWSSecretsManager("eu-west-1", server.URL, testCredentials), "binary", "UnrecognizedClientException"},
+		{"missing secret", good, "missing", "ResourceNotFoundException"},
+		{"binary secret", good, "binary", "binary"},
+		{"truncated response", good, "truncated", "invalid Secrets Manager response"},
+		{"not json", good, "not json", "invalid Secrets Manager response"},
+		{"unreachable", NewAWSSecretsManager("us-east-1", "http://127.0.0.1:1", testCredentials), "binary", "failed to reach"},
+	}
+	for _, tt := range tests {
+		fields, err := tt.provider.Fetch(context.Background(), tt.path)
+		if err == nil {
+			t.Errorf("%s: Fetch = %v, want an error", tt.name, fields)
+		} else if !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("%s: error %q doesn't mention %q", tt.name, err, tt.message)
+		}
+	}
+}
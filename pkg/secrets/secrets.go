@@ -0,0 +1,129 @@
+// Package secrets resolves credentials referenced in configuration from
+// secret stores such as HashiCorp Vault and AWS Secrets Manager, so they
+// don't have to be written into config files
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Provider fetches secrets from a store. A secret is a set of named fields;
+// stores holding a plain value return it under the empty name.
+type Provider interface {
+	Fetch(ctx context.Context, path string) (map[string]string, error)
+}
+
+// reference matches ${provider:path} and ${provider:path#field}
+var reference = regexp.MustCompile(`\$\{([a-z0-9_]+):([^}#]+)(?:#([^}]+))?\}`)
+
+// HasReferences reports whether s refers to any secret
+func HasReferences(s string) bool {
+	return reference.MatchString(s)
+}
+
+// Resolver expands secret references using registered providers. Each
+// secret is fetched once until Forget is called, so a value referring to
+// several fields of one secret costs one request.
+type Resolver struct {
+	providers map[string]Provider
+	cache     map[string]map[string]string // provider:path -> fields
+	values    map[string]string            // Reference -> value last expanded
+	mu        sync.Mutex
+}
+
+func NewResolver() *Resolver {
+	return &Resolver{
+		providers: make(map[string]Provider),
+		cache:     make(map[string]map[string]string),
+		values:    make(map[string]string),
+	}
+}
+
+// Register makes provider available to references under name
+func (r *Resolver) Register(name string, provider Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[name] = provider
+}
+
+// Expand replaces every secret reference in s with the secret's value
+func (r *Resolver) Expand(ctx context.Context, s string) (string, error) {
+	var expandErr error
+	expanded := reference.ReplaceAllStringFunc(s, func(ref string) string {
+		if expandErr != nil {
+			return ref
+		}
+		m := reference.FindStringSubmatch(ref)
+		value, err := r.lookup(ctx, m[1], m[2], m[3])
+		if err != nil {
+			expandErr = fmt.Errorf("%s: %v", ref, err)
+			return ref
+		}
+		r.mu.Lock()
+		r.values[ref] = value
+		r.mu.Unlock()
+		return value
+	})
+	return expanded, expandErr
+}
+
+func (r *Resolver) lookup(ctx context.Context, name, path, field string) (string, error) {
+	r.mu.Lock()
+	provider, ok := r.providers[name]
+	fields, cached := r.cache[name+":"+path]
+	r.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("secret provider %s is not configured", name)
+	}
+	if !cached {
+		var err error
+		if fields, err = provider.Fetch(ctx, path); err != nil {
+			return "", err
+		}
+		r.mu.Lock()
+		r.cache[name+":"+path] = fields
+		r.mu.Unlock()
+	}
+	value, ok := fields[field]
+	if !ok && field == "" && len(fields) == 1 {
+		// A secret with one field needs no #field
+		for _, value := range fields {
+			return value, nil
+		}
+	}
+	if !ok {
+		if field == "" {
+			return "", fmt.Errorf("secret has several fields, name one with #field")
+		}
+		return "", fmt.Errorf("secret has no field %s", field)
+	}
+	return value, nil
+}
+
+// Forget drops the fetched secrets so the next expansions fetch them again,
+// returning the values expanded so far by reference
+func (r *Resolver) Forget() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := r.values
+	r.cache = make(map[string]map[string]string)
+	r.values = make(map[string]string)
+	return values
+}
+
+// Changed returns the references whose values differ between two results
+// of Forget, sorted
+func Changed(before, after map[string]string) []string {
+	var changed []string
+	for ref, value := range after {
+		if old, ok := before[ref]; !ok || old != value {
+			changed = append(changed, ref)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
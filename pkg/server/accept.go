@@ -0,0 +1,236 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Backoff bounds between retries of failed Accepts, doubling from the first
+// to the last while failures continue
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// acceptErrorCounts counts failed Accepts by port and kind, temporary or fatal,
+// and how often each port's listener was opened again
+type acceptErrorCounts struct {
+	failures    map[acceptFailure]int64
+	recreations map[int]int64
+	mu          sync.Mutex
+}
+
+type acceptFailure struct {
+	port int
+	kind string
+}
+
+func (s *Server) countAcceptFailure(port int, kind string) {
+	s.acceptErrors.mu.Lock()
+	s.acceptErrors.failures[acceptFailure{port, kind}]++
+	s.acceptErrors.mu.Unlock()
+}
+
+// writeAcceptMetrics writes the accept failure and listener recreation
+// counters in the Prometheus text format
+func (s *Server) writeAcceptMetrics(w io.Writer) {
+	s.acceptErrors.mu.Lock()
+	defer s.acceptErrors.mu.Unlock()
+
+	failures := make([]acceptFailure, 0, len(s.acceptErrors.failures))
+	for key := range s.acceptErrors.failures {
+		failures = append(failures, key)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].port != failures[j].port {
+			return failures[i].port < failures[j].port
+		}
+		return failures[i].kind < failures[j].kind
+	})
+	fmt.Fprintf(w, "# HELP attachcloudip_accept_failures_total Failed accepts of new connections per port, temporary or fatal.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_accept_failures_total counter\n")
+	for _, key := range failures {
+		fmt.Fprintf(w, "attachcloudip_accept_failures_total{port=\"%d\",kind=%q} %d\n", key.port, key.kind, s.acceptErrors.failures[key])
+	}
+
+	ports := make([]int, 0, len(s.acceptErrors.recreations))
+	for port := range s.acceptErrors.recreations {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	fmt.Fprintf(w, "# HELP attachcloudip_listener_recreations_total Listeners opened again after a fatal accept failure per port.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_listener_recreations_total counter\n")
+	for _, port := range ports {
+		fmt.Fprintf(w, "attachcloudip_listener_recreations_total{port=\"%d\"} %d\n", port, s.acceptErrors.recreations[port])
+	}
+}
+
+// acceptBackoff is the growing wait between retries of failed Accepts
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+// next returns how long to wait before the next retry
+func (b *acceptBackoff) next() time.Duration {
+	if b.delay == 0 {
+		b.delay = minAcceptBackoff
+	} else if b.delay *= 2; b.delay > maxAcceptBackoff {
+		b.delay = maxAcceptBackoff
+	}
+	return b.delay
+}
+
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
+
+// isTemporaryAcceptError reports whether an Accept failed for a reason that
+// passes, such as running out of file descriptors or a connection aborted
+// before it was accepted
+func isTemporaryAcceptError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// resilientListener retries Accepts that fail temporarily, backing off
+// exponentially, and opens the listener again after fatal errors, so its
+// Accepts only fail once it is closed
+type resilientListener struct {
+	srv    *Server
+	port   int
+	listen func() (net.Listener, error) // nil if the listener can't be opened again
+	done   chan struct{}
+	once   sync.Once
+
+	mu      sync.Mutex
+	current net.Listener
+}
+
+func (s *Server) newResilientListener(port int, l net.Listener, listen func() (net.Listener, error)) *resilientListener {
+	return &resilientListener{srv: s, port: port, listen: listen, done: make(chan struct{}), current: l}
+}
+
+func (l *resilientListener) Accept() (net.Conn, error) {
+	var backoff acceptBackoff
+	for {
+		l.mu.Lock()
+		current := l.current
+		l.mu.Unlock()
+
+		conn, err := current.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if l.closed() {
+			return nil, net.ErrClosed
+		}
+		if isTemporaryAcceptError(err) {
+			l.srv.countAcceptFailure(l.port, "temporary")
+			delay := backoff.next()
+			log.Printf("Accept on port %d failed: %v; retrying in %s", l.port, err, delay)
+			if !l.wait(delay) {
+				return nil, net.ErrClosed
+			}
+			continue
+		}
+
+		l.srv.countAcceptFailure(l.port, "fatal")
+		if l.listen == nil {
+			log.Printf("Accept on port %d failed: %v", l.port, err)
+			return nil, err
+		}
+		log.Printf("Accept on port %d failed: %v; opening the listener again", l.port, err)
+		if !l.reopen(current) {
+			return nil, net.ErrClosed
+		}
+		backoff.reset()
+	}
+}
+
+// reopen replaces the failed listener, retrying with backoff until it
+// succeeds or l is closed
+func (l *resilientListener) reopen(failed net.Listener) bool {
+	failed.Close()
+	var backoff acceptBackoff
+	for {
+		next, err := l.listen()
+		if err == nil {
+			l.mu.Lock()
+			if l.closed() {
+				l.mu.Unlock()
+				next.Close()
+				return false
+			}
+			l.current = next
+			l.mu.Unlock()
+
+			l.srv.acceptErrors.mu.Lock()
+			l.srv.acceptErrors.recreations[l.port]++
+			l.srv.acceptErrors.mu.Unlock()
+			log.Printf("Listener on port %d opened again", l.port)
+			return true
+		}
+		delay := backoff.next()
+		log.Printf("Failed to open listener on port %d again: %v; retrying in %s", l.port, err, delay)
+		if !l.wait(delay) {
+			return false
+		}
+	}
+}
+
+// wait sleeps for delay and reports whether l is still open
+func (l *resilientListener) wait(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *resilientListener) closed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *resilientListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		l.mu.Lock()
+		close(l.done)
+		err = l.current.Close()
+		l.mu.Unlock()
+	})
+	return err
+}
+
+func (l *resilientListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current.Addr()
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+)
+
+// setupLogging points the server log and the access log at their configured
+// files, rotating them by size and age
+func (s *Server) setupLogging(config *Config) error {
+	lc := config.Server.Log
+	rotation := logging.RotateConfig{
+		MaxSize:    int64(lc.MaxSizeMB) << 20,
+		MaxAge:     time.Duration(lc.MaxAgeHours) * time.Hour,
+		MaxBackups: lc.MaxBackups,
+		Compress:   lc.Compress,
+	}
+
+	if lc.File != "" {
+		file, err := logging.OpenRotatingFile(lc.File, rotation)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(file)
+	}
+	if lc.AccessFile != "" {
+		file, err := logging.OpenRotatingFile(lc.AccessFile, rotation)
+		if err != nil {
+			return err
+		}
+		s.accessLog = log.New(file, "", 0)
+	}
+	return nil
+}
+
+// statusRecorder captures the status and size of a response for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("response does not support hijacking")
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withAccessLog writes a Common Log Format line, extended with host and
+// duration, for every request served by next
+func (s *Server) withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.accessLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		s.accessLog.Printf("%s - - [%s] %q %d %d %q %q host=%s duration=%s",
+			host, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto, rec.status, rec.bytes,
+			r.Referer(), r.UserAgent(), r.Host, time.Since(start).Round(time.Microsecond))
+	})
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/alerts"
+)
+
+// Alert rule types
+const (
+	ruleClientInactive  = "client_inactive"
+	ruleClientUnhealthy = "client_unhealthy"
+	ruleConnections     = "connections"
+	ruleInFlight        = "in_flight"
+)
+
+const defaultAlertInterval = 15 * time.Second
+
+// alertRule is a configured rule, evaluated by the alert monitor
+type alertRule struct {
+	name      string
+	kind      string
+	threshold float64
+	client    string
+	severity  string
+}
+
+// configureAlerts sets up the configured integrations and the alert rules
+func (s *Server) configureAlerts(config *Config) error {
+	ac := config.Server.Alerts
+	if len(ac.Rules) == 0 {
+		return nil
+	}
+	manager := alerts.NewManager()
+	integrations := make(map[string]bool)
+	for _, ic := range ac.Integrations {
+		if ic.Name == "" || integrations[ic.Name] {
+			return fmt.Errorf("integrations need a unique name")
+		}
+		integrations[ic.Name] = true
+		switch ic.Type {
+		case "webhook":
+			if ic.URL == "" {
+				return fmt.Errorf("webhook integration %s needs a url", ic.Name)
+			}
+			manager.AddNotifier(ic.Name, &alerts.Webhook{URL: ic.URL, Headers: ic.Headers})
+		case "slack":
+			if ic.URL == "" {
+				return fmt.Errorf("slack integration %s needs a url", ic.Name)
+			}
+			manager.AddNotifier(ic.Name, &alerts.Slack{URL: ic.URL})
+		case "pagerduty":
+			if ic.RoutingKey == "" {
+				return fmt.Errorf("pagerduty integration %s needs a routing_key", ic.Name)
+			}
+			manager.AddNotifier(ic.Name, &alerts.PagerDuty{URL: ic.URL, RoutingKey: ic.RoutingKey})
+		default:
+			return fmt.Errorf("integration %s has unknown type %q", ic.Name, ic.Type)
+		}
+	}
+
+	var rules []alertRule
+	names := make(map[string]bool)
+	for _, rc := range ac.Rules {
+		if rc.Name == "" || names[rc.Name] {
+			return fmt.Errorf("rules need a unique name")
+		}
+		names[rc.Name] = true
+		switch rc.Type {
+		case ruleClientInactive:
+			if rc.Threshold <= 0 {
+				return fmt.Errorf("rule %s needs a threshold in seconds", rc.Name)
+			}
+		case ruleConnections, ruleInFlight:
+			if rc.Threshold <= 0 || rc.Threshold > 100 {
+				return fmt.Errorf("rule %s needs a threshold between 0 and 100 percent", rc.Name)
+			}
+		case ruleClientUnhealthy:
+		default:
+			return fmt.Errorf("rule %s has unknown type %q", rc.Name, rc.Type)
+		}
+		for _, name := range rc.Notify {
+			if !integrations[name] {
+				return fmt.Errorf("rule %s notifies unknown integration %s", rc.Name, name)
+			}
+		}
+		severity := rc.Severity
+		if severity == "" {
+			severity = "warning"
+		}
+		manager.Route(rc.Name, rc.Notify)
+		rules = append(rules, alertRule{name: rc.Name, kind: rc.Type, threshold: rc.Threshold, client: rc.Client, severity: severity})
+	}
+
+	interval := defaultAlertInterval
+	if ac.IntervalSeconds > 0 {
+		interval = time.Duration(ac.IntervalSeconds) * time.Second
+	}
+	s.alerts = &alertMonitor{srv: s, manager: manager, rules: rules, interval: interval, lastSeen: make(map[string]time.Time)}
+	return nil
+}
+
+// startAlerts evaluates the configured alert rules until ctx is done
+func (s *Server) startAlerts(ctx context.Context) {
+	monitor := s.alerts
+	if monitor == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(monitor.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				monitor.evaluate(time.Now())
+			}
+		}
+	}()
+	log.Printf("Alerts: Evaluating %d rules every %v", len(monitor.rules), monitor.interval)
+}
+
+// alertMonitor evaluates the rules against the connected and registered
+// clients and the server's limits
+type alertMonitor struct {
+	srv     *Server
+	manager *alerts.Manager
+	rules   []alertRule
+	// interval is how often the rules are evaluated
+	interval time.Duration
+	// lastSeen is each client's last heartbeat, kept after it disconnects
+	// until its registration is gone
+	lastSeen map[string]time.Time
+}
+
+func (a *alertMonitor) evaluate(now time.Time) {
+	connected := make(map[string]clientInfo)
+	for _, client := range a.srv.tcpmanager.GetClients() {
+		connected[client.clientID] = client
+		a.lastSeen[client.clientID] = client.lastActive
+	}
+	registered := make(map[string]bool)
+	for _, id := range a.srv.clientManager.ClientIDs() {
+		registered[id] = true
+		if _, ok := a.lastSeen[id]; !ok {
+			// Registered but never connected, counted from now
+			a.lastSeen[id] = now
+		}
+	}
+	for id := range a.lastSeen {
+		if _, ok := connected[id]; !ok && !registered[id] {
+			delete(a.lastSeen, id)
+		}
+	}
+	stats := a.srv.admissionController.Stats()
+
+	for _, rule := range a.rules {
+		var firing []alerts.Alert
+		add := func(subject, format string, args ...any) {
+			firing = append(firing, alerts.Alert{Severity: rule.severity, Subject: subject, Message: fmt.Sprintf(format, args...)})
+		}
+		switch rule.kind {
+		case ruleClientInactive:
+			threshold := time.Duration(rule.threshold * float64(time.Second))
+			for id, seen := range a.lastSeen {
+				if rule.client != "" && id != rule.client {
+					continue
+				}
+				if idle := now.Sub(seen); idle > threshold {
+					add(id, "no heartbeat from client %s for %v", id, idle.Truncate(time.Second))
+				}
+			}
+		case ruleClientUnhealthy:
+			for id, client := range connected {
+				if (rule.client == "" || id == rule.client) && !client.healthy {
+					add(id, "client %s reports its upstream unhealthy", id)
+				}
+			}
+		case ruleConnections:
+			if usage, ok := percentUsed(stats.Connections, stats.MaxConnections); ok && usage >= rule.threshold {
+				add("server", "%.0f%% of max_connections in use (%d of %d)", usage, stats.Connections, stats.MaxConnections)
+			}
+		case ruleInFlight:
+			if usage, ok := percentUsed(stats.InFlight, stats.MaxInFlight); ok && usage >= rule.threshold {
+				add("server", "%.0f%% of max_in_flight in use (%d of %d)", usage, stats.InFlight, stats.MaxInFlight)
+			}
+		}
+		a.manager.Update(rule.name, firing)
+	}
+}
+
+// percentUsed reports how much of a limit is used, false if it's unlimited
+func percentUsed(used, limit int64) (float64, bool) {
+	if limit <= 0 {
+		return 0, false
+	}
+	return float64(used) / float64(limit) * 100, true
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// configureBalancer reads which request attribute, if any, routes callers
+// consistently
+func (s *Server) configureBalancer(config *Config) error {
+	spec := strings.TrimSpace(config.Server.Balancer.Hash)
+	if spec == "" {
+		return nil
+	}
+	key, err := s.requestKey(spec)
+	if err != nil {
+		return fmt.Errorf("hash: %v", err)
+	}
+	s.hashKey = key
+	log.Printf("Routing callers consistently by %s", spec)
+	return nil
+}
+
+// requestKey returns a function reading a request attribute, "ip",
+// "header:Name", or "cookie:name", that reports false when it is missing
+func (s *Server) requestKey(spec string) (func(r *http.Request) (string, bool), error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch strings.ToLower(kind) {
+	case "ip":
+		return func(r *http.Request) (string, bool) {
+			return s.sourceIP(r), true
+		}, nil
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("%q needs a header name", spec)
+		}
+		return func(r *http.Request) (string, bool) {
+			value := r.Header.Get(name)
+			return value, value != ""
+		}, nil
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("%q needs a cookie name", spec)
+		}
+		return func(r *http.Request) (string, bool) {
+			cookie, err := r.Cookie(name)
+			if err != nil || cookie.Value == "" {
+				return "", false
+			}
+			return cookie.Value, true
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown key %q, expected ip, header:Name, or cookie:name", spec)
+}
+
+// sourceIP is the caller's address, taken from X-Forwarded-For when the peer
+// is a trusted proxy
+func (s *Server) sourceIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if s.peerTrusted(peer) {
+		if first, _, _ := strings.Cut(r.Header.Get("X-Forwarded-For"), ","); strings.TrimSpace(first) != "" {
+			return strings.TrimSpace(first)
+		}
+	}
+	return peer
+}
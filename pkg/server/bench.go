@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// Benchmark defaults and bounds
+const (
+	defaultBenchPayload  = 64 << 10
+	defaultBenchDuration = 5 * time.Second
+	maxBenchDuration     = time.Minute
+	defaultBenchProbes   = 10
+	maxBenchProbes       = 1000
+)
+
+// benchRTT summarizes the round trips of empty benchmark requests
+type benchRTT struct {
+	Probes int     `json:"probes"`
+	MinMs  float64 `json:"min_ms"`
+	AvgMs  float64 `json:"avg_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+// benchThroughput summarizes the payloads moved one way during a benchmark
+type benchThroughput struct {
+	Requests      int     `json:"requests"`
+	Bytes         int64   `json:"bytes"`
+	Seconds       float64 `json:"seconds"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+}
+
+type benchResult struct {
+	ClientID     string          `json:"client_id"`
+	PayloadBytes int             `json:"payload_bytes"`
+	Duration     string          `json:"duration"` // Of each throughput phase
+	RTT          benchRTT        `json:"rtt"`
+	Download     benchThroughput `json:"download"` // Client to server
+	Upload       benchThroughput `json:"upload"`   // Server to client
+}
+
+// BenchClient measures a tunnel's round trip time and throughput with
+// requests the client answers itself (POST ?client_id=, optional body
+// {"payload_bytes": 65536, "duration": "5s", "probes": 10}). Each
+// throughput phase sends payloads one request at a time for the duration.
+func (s *Server) BenchClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.URL.Query().Get("client_id")
+	registered := s.clientManager.GetClient(clientID)
+	if registered == nil {
+		http.Error(w, fmt.Sprintf("Client not registered: %s", clientID), http.StatusNotFound)
+		return
+	}
+	if !s.authorizeTunnelControl(w, r, registered) {
+		return
+	}
+
+	var request struct {
+		PayloadBytes int    `json:"payload_bytes"`
+		Duration     string `json:"duration"`
+		Probes       int    `json:"probes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	payload, duration, probes := defaultBenchPayload, defaultBenchDuration, defaultBenchProbes
+	if request.PayloadBytes != 0 {
+		payload = request.PayloadBytes
+	}
+	if request.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(request.Duration); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid duration %q", request.Duration), http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Probes != 0 {
+		probes = request.Probes
+	}
+	if payload < 1 || payload > protocol.MaxBenchPayload {
+		http.Error(w, fmt.Sprintf("payload_bytes must be between 1 and %d", protocol.MaxBenchPayload), http.StatusBadRequest)
+		return
+	}
+	if duration <= 0 || duration > maxBenchDuration {
+		http.Error(w, fmt.Sprintf("duration must be positive and at most %s", maxBenchDuration), http.StatusBadRequest)
+		return
+	}
+	if probes < 1 || probes > maxBenchProbes {
+		http.Error(w, fmt.Sprintf("probes must be between 1 and %d", maxBenchProbes), http.StatusBadRequest)
+		return
+	}
+
+	client, ok := s.tcpmanager.GetClient(clientID)
+	if !ok || client.tcpPort != 0 {
+		http.Error(w, fmt.Sprintf("No HTTP tunnel connected for client %s", clientID), http.StatusNotFound)
+		return
+	}
+	if client.transport.Version < protocol.BenchVersion {
+		http.Error(w, fmt.Sprintf("Client %s speaks protocol version %d, benchmarks need %d",
+			clientID, client.transport.Version, protocol.BenchVersion), http.StatusConflict)
+		return
+	}
+
+	log.Printf("Benchmarking tunnel of client %s with %d byte payloads for %s", clientID, payload, duration)
+	result := benchResult{ClientID: clientID, PayloadBytes: payload, Duration: duration.String()}
+	var err error
+	if result.RTT, err = s.benchRoundTrips(r.Context(), client, probes); err == nil {
+		if result.Download, err = s.benchPhase(r.Context(), client, duration, payload, 0); err == nil {
+			result.Upload, err = s.benchPhase(r.Context(), client, duration, 0, payload)
+		}
+	}
+	if err != nil {
+		log.Printf("Benchmark of client %s failed: %v", clientID, err)
+		http.Error(w, fmt.Sprintf("Benchmark failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// benchRequest sends one benchmark request carrying upload bytes and asking
+// for download bytes back, returning the bytes received
+func (s *Server) benchRequest(ctx context.Context, client clientInfo, download, upload int) (int, error) {
+	req := &types.Request{
+		Type:        types.RequestTypeBench,
+		Method:      http.MethodPost,
+		Path:        "/",
+		Timestamp:   time.Now().Unix(),
+		ClientID:    client.clientID,
+		QueryParams: map[string]string{protocol.BenchSizeParam: strconv.Itoa(download)},
+	}
+	if upload > 0 {
+		req.Body = make([]byte, upload)
+	}
+	resp, err := s.tcpmanager.ForwardRequest(ctx, client, req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("client answered status %d: %s", resp.StatusCode, resp.Error)
+	}
+	return len(resp.Body), nil
+}
+
+func (s *Server) benchRoundTrips(ctx context.Context, client clientInfo, probes int) (benchRTT, error) {
+	rtts := make([]time.Duration, 0, probes)
+	var total time.Duration
+	for i := 0; i < probes; i++ {
+		start := time.Now()
+		if _, err := s.benchRequest(ctx, client, 0, 0); err != nil {
+			return benchRTT{}, err
+		}
+		rtt := time.Since(start)
+		rtts = append(rtts, rtt)
+		total += rtt
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return benchRTT{
+		Probes: probes,
+		MinMs:  ms(rtts[0]),
+		AvgMs:  ms(total / time.Duration(probes)),
+		P50Ms:  ms(rtts[probes/2]),
+		MaxMs:  ms(rtts[probes-1]),
+	}, nil
+}
+
+// benchPhase sends benchmark requests back to back for the duration,
+// counting the bytes moved in the direction measured
+func (s *Server) benchPhase(ctx context.Context, client clientInfo, duration time.Duration, download, upload int) (benchThroughput, error) {
+	var phase benchThroughput
+	start := time.Now()
+	for time.Since(start) < duration {
+		received, err := s.benchRequest(ctx, client, download, upload)
+		if err != nil {
+			return benchThroughput{}, err
+		}
+		phase.Requests++
+		phase.Bytes += int64(received + upload)
+	}
+	phase.Seconds = time.Since(start).Seconds()
+	phase.BitsPerSecond = float64(phase.Bytes*8) / phase.Seconds
+	return phase, nil
+}
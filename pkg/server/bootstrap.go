@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+)
+
+// bootstrapClient registers a client that skipped HTTP registration and sent
+// its registration in the options of the tunnel's first message instead. A
+// client reconnecting to its existing registration keeps it as it is.
+func (s *Server) bootstrapClient(clientID, path string, options url.Values) error {
+	tenant, ok := s.tenants.FromAPIKey(options.Get("api_key"))
+	if !ok {
+		return fmt.Errorf("missing or unknown API key")
+	}
+	if existing := s.clientManager.GetClient(clientID); existing != nil {
+		if existing.Tenant != tenant {
+			return fmt.Errorf("client ID %s belongs to another tenant", clientID)
+		}
+		return nil
+	}
+
+	weight := 0
+	if value := options.Get("weight"); value != "" {
+		var err error
+		if weight, err = strconv.Atoi(value); err != nil || weight < 0 {
+			return fmt.Errorf("invalid weight %q", value)
+		}
+	}
+	profile, err := s.lookupProfile(options.Get("profile"))
+	if err != nil {
+		return err
+	}
+	ttlValue, class := options.Get("ttl"), options.Get("class")
+	schedule, timezone := options.Get("schedule"), options.Get("timezone")
+	if profile != nil {
+		profile.applyDefaults(&ttlValue, &class, &schedule, &timezone)
+	}
+	ttl, err := parseTTL(ttlValue)
+	if err != nil {
+		return err
+	}
+
+	headers := make(map[string]string)
+	for _, value := range options["header"] {
+		name, headerValue, err := routing.ParseHeaderCondition(value)
+		if err != nil {
+			return err
+		}
+		headers[name] = headerValue
+	}
+	if err := s.validateClass(class); err != nil {
+		return err
+	}
+	window, err := parseSchedule(schedule, timezone)
+	if err != nil {
+		return err
+	}
+	var methods []string
+	if value := options.Get("methods"); value != "" {
+		methods = normalizeMethods(strings.Split(value, ","))
+	}
+	var alpn []string
+	if value := options.Get("alpn"); value != "" {
+		alpn = normalizeALPN(strings.Split(value, ","))
+	}
+
+	client := &Client{
+		ClientId: clientID,
+		Paths:    []string{path},
+		Weight:   weight,
+		Tenant:   tenant,
+		Methods:  methods,
+		Headers:  normalizeHeaders(headers),
+		ALPN:     alpn,
+		Shadow:   options.Get("shadow") == "1",
+		Class:    class,
+		Schedule: window,
+		Profile:  options.Get("profile"),
+		TTL:      ttl,
+	}
+	if ttl > 0 {
+		client.ExpiresAt = time.Now().Add(ttl)
+	}
+	s.clientManager.RegisterClient(client)
+	log.Printf("Registered client %s with path %s over its tunnel", clientID, path)
+	return nil
+}
+
+// normalizeALPN trims protocol IDs, dropping empty ones. Unlike methods
+// they are matched exactly.
+func normalizeALPN(protocols []string) []string {
+	var normalized []string
+	for _, protocol := range protocols {
+		if protocol = strings.TrimSpace(protocol); protocol != "" {
+			normalized = append(normalized, protocol)
+		}
+	}
+	return normalized
+}
+
+// normalizeMethods upper-cases method names, dropping empty ones
+func normalizeMethods(methods []string) []string {
+	var normalized []string
+	for _, method := range methods {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			normalized = append(normalized, method)
+		}
+	}
+	return normalized
+}
+
+// normalizeHeaders canonicalizes header names, returning nil for no headers
+func normalizeHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	normalized := make(map[string]string, len(headers))
+	for name, value := range headers {
+		normalized[http.CanonicalHeaderKey(name)] = value
+	}
+	return normalized
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+)
+
+const (
+	// maxBroadcastSize caps a broadcast message in bytes
+	maxBroadcastSize = 64 * 1024
+	// broadcastFanOut is how many clients a broadcast is written to at once,
+	// so a slow tunnel doesn't hold up the rest
+	broadcastFanOut = 32
+)
+
+// broadcastRequest is the body of a POST to /admin/broadcast. The filters
+// combine, and a broadcast without any goes to every connected client.
+type broadcastRequest struct {
+	Topic    string `json:"topic"`
+	Message  string `json:"message"`
+	ClientID string `json:"client_id"` // ID or path.Match pattern
+	Tenant   string `json:"tenant"`
+	Path     string `json:"path"` // One of the client's paths
+}
+
+// deliveryStatus is whether a broadcast was written to a client's tunnel
+type deliveryStatus struct {
+	ClientID  string `json:"client_id"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// broadcastResponse reports a broadcast to each client it was meant for
+type broadcastResponse struct {
+	ID      string           `json:"id"`
+	Clients []deliveryStatus `json:"clients"`
+}
+
+// Broadcast sends a message over the tunnels of the clients, returning
+// whether each got it
+func (m *TCPManager) Broadcast(message protocol.Broadcast, clients []clientInfo) []deliveryStatus {
+	data, err := json.Marshal(message)
+	statuses := make([]deliveryStatus, len(clients))
+	if err != nil {
+		for i, client := range clients {
+			statuses[i] = deliveryStatus{ClientID: client.clientID, Error: err.Error()}
+		}
+		return statuses
+	}
+	line := "broadcast|" + string(data)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, broadcastFanOut)
+	for i, client := range clients {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			statuses[i].ClientID = client.clientID
+			if _, err := m.srv.sendLine(client.clientID, client.conn, line); err != nil {
+				statuses[i].Error = err.Error()
+				m.recordError(client.clientID, fmt.Errorf("broadcast %s not delivered: %v", message.ID, err))
+				return
+			}
+			statuses[i].Delivered = true
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+// BroadcastHandler sends a message (POST with a broadcastRequest) to the
+// connected clients matching its filters, answering with each client's
+// delivery status
+func (s *Server) BroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req broadcastRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxBroadcastSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Message == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Message) > maxBroadcastSize {
+		http.Error(w, fmt.Sprintf("message must be at most %d bytes", maxBroadcastSize), http.StatusBadRequest)
+		return
+	}
+	matched, err := s.matchingClients(req.ClientID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid client_id pattern: %v", err), http.StatusBadRequest)
+		return
+	}
+	clients := matched[:0]
+	for _, client := range matched {
+		if req.Tenant != "" && client.tenant != req.Tenant {
+			continue
+		}
+		if req.Path != "" && !slices.Contains(client.paths(), req.Path) {
+			continue
+		}
+		clients = append(clients, client)
+	}
+	if len(clients) == 0 {
+		http.Error(w, "No connected client matches the broadcast", http.StatusNotFound)
+		return
+	}
+
+	message := protocol.Broadcast{ID: uuid.NewString(), Topic: req.Topic, Message: req.Message, SentAt: time.Now()}
+	statuses := s.tcpmanager.Broadcast(message, clients)
+	delivered := 0
+	for _, status := range statuses {
+		if status.Delivered {
+			delivered++
+		}
+	}
+	log.Printf("TCP Manager: Broadcast %s delivered to %d of %d clients", message.ID, delivered, len(statuses))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(broadcastResponse{ID: message.ID, Clients: statuses})
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/chaos"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// chaosState injects tunnel faults while server.chaos is enabled
+type chaosState struct {
+	injector *chaos.Injector // nil while disabled
+	clients  []string        // path.Match patterns of the client IDs targeted, all if empty
+}
+
+// configureChaos reads server.chaos
+func (s *Server) configureChaos(config *Config) error {
+	cc := config.Server.Chaos
+	if !cc.Enabled {
+		return nil
+	}
+	if cc.MaxDelayMs < 0 {
+		return fmt.Errorf("max_delay_ms must not be negative")
+	}
+	for _, pattern := range cc.Clients {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid client pattern %q: %v", pattern, err)
+		}
+	}
+	injector, err := chaos.New(chaos.Config{
+		DropRate:             cc.DropRate,
+		DelayRate:            cc.DelayRate,
+		MaxDelay:             time.Duration(cc.MaxDelayMs) * time.Millisecond,
+		ResetRate:            cc.ResetRate,
+		CorruptHeartbeatRate: cc.CorruptHeartbeatRate,
+		Seed:                 cc.Seed,
+	})
+	if err != nil {
+		return err
+	}
+	s.faults.injector, s.faults.clients = injector, cc.Clients
+	log.Printf("Chaos: Warning: injecting tunnel faults (drop %v, delay %v up to %dms, reset %v, corrupt heartbeat %v)",
+		cc.DropRate, cc.DelayRate, cc.MaxDelayMs, cc.ResetRate, cc.CorruptHeartbeatRate)
+	return nil
+}
+
+// chaosFor returns the injector for the client's tunnel, nil unless faults
+// are injected into it
+func (s *Server) chaosFor(clientID string) *chaos.Injector {
+	if s.faults.injector == nil || len(s.faults.clients) == 0 {
+		return s.faults.injector
+	}
+	for _, pattern := range s.faults.clients {
+		if ok, _ := path.Match(pattern, clientID); ok {
+			return s.faults.injector
+		}
+	}
+	return nil
+}
+
+// writeRequest sends a request frame over the client's tunnel, unless the
+// frame is dropped
+func (s *Server) writeRequest(client clientInfo, req *types.Request) (int, error) {
+	if s.chaosFor(client.clientID).Drop() {
+		logging.Debugf("Chaos: Dropping request %s to client %s", req.ID, client.clientID)
+		return 0, nil
+	}
+	n, err := client.transport.WriteRequest(client.conn, req)
+	if err == nil {
+		s.recorderFor(client.clientID).Request(req)
+	}
+	return n, err
+}
+
+// resetTunnel closes the tunnel connection without a graceful shutdown, so
+// the client sees a reset where the socket allows it
+func resetTunnel(clientID string, conn net.Conn) {
+	log.Printf("Chaos: Resetting tunnel of client %s", clientID)
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
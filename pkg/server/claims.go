@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/registry"
+)
+
+// configureClaimPolicies reads routing.claim_policy and the per-pattern
+// overrides in routing.paths
+func (s *Server) configureClaimPolicies(config *Config) error {
+	rc := config.Server.Routing
+	policy, err := registry.ParseClaimPolicy(rc.ClaimPolicy)
+	if err != nil {
+		return err
+	}
+	policies := registry.ClaimPolicies{Default: policy, Paths: make(map[string]registry.ClaimPolicy)}
+	for _, path := range rc.Paths {
+		if path.ClaimPolicy == "" {
+			continue
+		}
+		if policies.Paths[path.Pattern], err = registry.ParseClaimPolicy(path.ClaimPolicy); err != nil {
+			return fmt.Errorf("path %s: %v", path.Pattern, err)
+		}
+	}
+	s.claimPolicies = policies
+	return nil
+}
+
+// claimLocked applies the claim policies to the client claiming paths,
+// without changing anything. Shadow clients only get copies of a path's
+// traffic, so they neither claim paths nor conflict with each other.
+func (m *TCPManager) claimLocked(clientID, tenant string, shadow bool, paths []string) ([]registry.PathClaim, error) {
+	if shadow {
+		return nil, nil
+	}
+	claims := make([]registry.PathClaim, 0, len(paths))
+	for _, path := range paths {
+		var owners []string
+		for _, other := range m.clients {
+			if other.clientID != clientID && other.tenant == tenant && !other.shadow && slices.Contains(other.paths(), path) {
+				owners = append(owners, other.clientID)
+			}
+		}
+		sort.Strings(owners)
+		claim, err := m.srv.claimPolicies.Claim(path, owners)
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, claim)
+	}
+	return claims, nil
+}
+
+// CheckClaims reports how the client's paths would be claimed if its tunnel
+// connected now
+func (m *TCPManager) CheckClaims(clientID, tenant string, shadow bool, paths []string) ([]registry.PathClaim, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.claimLocked(clientID, tenant, shadow, paths)
+}
+
+// evictLocked closes the tunnels of the clients claims took paths over
+// from. Like expired clients they are told why and lose their session and
+// registration, so they don't reconnect and take the path back.
+func (m *TCPManager) evictLocked(claims []registry.PathClaim) {
+	for _, claim := range claims {
+		for _, clientID := range claim.TookOver {
+			client, exists := m.clients[clientID]
+			if !exists {
+				continue
+			}
+			m.srv.sendLine(clientID, client.conn, "evicted|path "+claim.Path+" was taken over")
+			client.conn.Close()
+			m.srv.metered.observe(client, time.Now())
+			delete(m.clients, clientID)
+			m.unrouteLocked(client)
+			m.srv.sessions.Remove(clientID)
+			m.srv.clientManager.RemoveClient(clientID)
+			m.srv.sshIdentity.Forget(clientID)
+			client.history.Disconnected("takeover")
+			m.srv.closeOutbox(clientID)
+			m.srv.closeTCPTunnel(clientID, true)
+			m.srv.publishTunnel(client, false, "takeover")
+			log.Printf("TCP Manager: Evicted client %s, path %s was taken over", clientID, claim.Path)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/registry"
+)
+
+// errConfigUnsupported refuses pushes to clients too old to apply them
+var errConfigUnsupported = errors.New("client doesn't accept pushed configuration")
+
+// PushConfig sends a configuration update to a connected client over its
+// tunnel and returns the update's revision. The client's history tracks
+// whether it acknowledged the update.
+func (m *TCPManager) PushConfig(clientID string, update protocol.ClientConfig) (int64, error) {
+	if err := update.Validate(); err != nil {
+		return 0, err
+	}
+	client, ok := m.GetClient(clientID)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", errNoClient, clientID)
+	}
+	if client.transport.Version < protocol.ConfigVersion {
+		return 0, fmt.Errorf("%w: it speaks protocol version %d, pushes need %d",
+			errConfigUnsupported, client.transport.Version, protocol.ConfigVersion)
+	}
+
+	update.Revision = m.configRevision.Add(1)
+	data, err := json.Marshal(update)
+	if err != nil {
+		return 0, err
+	}
+	client.history.RecordConfigPush(update.Revision, data)
+	if _, err := m.srv.sendLine(clientID, client.conn, "config|"+string(data)); err != nil {
+		client.history.AckConfig(update.Revision, fmt.Sprintf("not delivered: %v", err))
+		return 0, fmt.Errorf("failed to send config to client %s: %v", clientID, err)
+	}
+	log.Printf("TCP Manager: Pushed config revision %d to client %s", update.Revision, clientID)
+	return update.Revision, nil
+}
+
+// handleConfigAck records the client's answer to a pushed update
+func (m *TCPManager) handleConfigAck(clientID, message string) {
+	kind, fields, _ := strings.Cut(message, "|")
+	revisionField, reason, _ := strings.Cut(fields, "|")
+	revision, err := strconv.ParseInt(revisionField, 10, 64)
+	if err != nil {
+		log.Printf("TCP Manager: Invalid config acknowledgment from client %s: %s", clientID, message)
+		return
+	}
+	if kind == "config-error" && reason == "" {
+		reason = "rejected"
+	}
+	history, ok := m.GetHistory(clientID)
+	if !ok || !history.AckConfig(revision, reason) {
+		log.Printf("TCP Manager: Client %s acknowledged config revision %d, which isn't pending", clientID, revision)
+		return
+	}
+	if kind == "config-error" {
+		log.Printf("TCP Manager: Client %s rejected config revision %d: %s", clientID, revision, reason)
+		m.recordError(clientID, fmt.Errorf("config revision %d rejected: %s", revision, reason))
+		return
+	}
+	log.Printf("TCP Manager: Client %s applied config revision %d", clientID, revision)
+}
+
+// clientConfigStatus is a connected client's latest configuration push
+type clientConfigStatus struct {
+	ClientID        string               `json:"client_id"`
+	ProtocolVersion int                  `json:"protocol_version"`
+	LastPush        *registry.ConfigPush `json:"last_push"`
+	Pending         bool                 `json:"pending"` // Pushed but not acknowledged
+}
+
+// pushResult reports a push to each client it was meant for
+type pushResult struct {
+	Pushed []pushedConfig  `json:"pushed"`
+	Failed []clientFailure `json:"failed"`
+}
+
+type pushedConfig struct {
+	ClientID string `json:"client_id"`
+	Revision int64  `json:"revision"`
+}
+
+// clientFailure is why an admin action failed for one of the clients it
+// was meant for
+type clientFailure struct {
+	ClientID string `json:"client_id"`
+	Error    string `json:"error"`
+}
+
+// matchingClients returns the connected clients whose ID matches the
+// path.Match pattern, all of them if it is empty, sorted by ID
+func (s *Server) matchingClients(pattern string) ([]clientInfo, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var clients []clientInfo
+	for _, client := range s.tcpmanager.GetClients() {
+		if ok, _ := path.Match(pattern, client.clientID); ok || pattern == "" {
+			clients = append(clients, client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].clientID < clients[j].clientID })
+	return clients, nil
+}
+
+// ClientConfigHandler pushes a configuration update (POST with the settings
+// of protocol.ClientConfig) to the connected clients whose ID matches the
+// ?client_id= pattern, or lists their latest pushes (GET, all clients
+// without ?client_id=)
+func (s *Server) ClientConfigHandler(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("client_id")
+	clients, err := s.matchingClients(pattern)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid client_id pattern: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]clientConfigStatus, 0, len(clients))
+		for _, client := range clients {
+			status := clientConfigStatus{
+				ClientID:        client.clientID,
+				ProtocolVersion: client.transport.Version,
+				LastPush:        client.history.LastConfigPush(),
+			}
+			status.Pending = status.LastPush != nil && status.LastPush.AckedAt == nil
+			list = append(list, status)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		if pattern == "" {
+			http.Error(w, "client_id is required", http.StatusBadRequest)
+			return
+		}
+		var update protocol.ClientConfig
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := update.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(clients) == 0 {
+			http.Error(w, fmt.Sprintf("No connected client matches %s", pattern), http.StatusNotFound)
+			return
+		}
+		result := pushResult{Pushed: []pushedConfig{}, Failed: []clientFailure{}}
+		for _, client := range clients {
+			revision, err := s.tcpmanager.PushConfig(client.clientID, update)
+			if err != nil {
+				result.Failed = append(result.Failed, clientFailure{ClientID: client.clientID, Error: err.Error()})
+				continue
+			}
+			result.Pushed = append(result.Pushed, pushedConfig{ClientID: client.clientID, Revision: revision})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type ClientManager struct {
+	clients map[string]*Client
+	// pins are the certificate fingerprints client IDs are bound to, kept
+	// when clients go away so only the same certificate can reclaim an ID
+	pins     map[string]string
+	pinsFile string // Where pins are persisted, "" keeps them in memory
+	mu       sync.Mutex
+}
+
+func NewClientManager() *ClientManager {
+	return &ClientManager{
+		clients: make(map[string]*Client),
+		pins:    make(map[string]string),
+	}
+}
+
+func (m *ClientManager) RegisterClient(client *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Keep the certificate pin and pause state across re-registrations
+	if client.Fingerprint == "" {
+		client.Fingerprint = m.pins[client.ClientId]
+	}
+	if existing, ok := m.clients[client.ClientId]; ok {
+		client.Paused = existing.Paused
+		client.PauseMessage = existing.PauseMessage
+	}
+	m.clients[client.ClientId] = client
+}
+
+func (m *ClientManager) RemoveClient(clientID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.clients, clientID)
+}
+
+// ClientIDs returns the IDs of the registered clients
+func (m *ClientManager) ClientIDs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]string, 0, len(m.clients))
+	for id := range m.clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (m *ClientManager) GetClient(clientID string) *Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.clients[clientID]
+}
+
+// SetPaused pauses or resumes a registered client's tunnel
+func (m *ClientManager) SetPaused(clientID string, paused bool, message string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client, ok := m.clients[clientID]
+	if !ok {
+		return false
+	}
+	client.Paused = paused
+	client.PauseMessage = message
+	return true
+}
+
+// Paused reports whether the client's tunnel is paused, or parked outside
+// its schedule, with its maintenance message
+func (m *ClientManager) Paused(clientID string) (bool, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client, ok := m.clients[clientID]
+	if !ok {
+		return false, ""
+	}
+	if !client.Paused && client.Schedule != nil && !client.Schedule.Active(time.Now()) {
+		return true, scheduleMessage
+	}
+	return client.Paused, client.PauseMessage
+}
+
+// Parked reports whether the client is outside its schedule's window, and
+// when the window opens next. A paused client is reported as paused instead.
+func (m *ClientManager) Parked(clientID string) (bool, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client, ok := m.clients[clientID]
+	if !ok || client.Schedule == nil || client.Paused {
+		return false, time.Time{}
+	}
+	now := time.Now()
+	if client.Schedule.Active(now) {
+		return false, time.Time{}
+	}
+	return true, client.Schedule.Next(now)
+}
+
+// ParkedClients returns copies of the clients outside their schedule's
+// window at now
+func (m *ClientManager) ParkedClients(now time.Time) map[string]Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	parked := make(map[string]Client)
+	for id, client := range m.clients {
+		if client.Schedule != nil && !client.Schedule.Active(now) {
+			parked[id] = *client
+		}
+	}
+	return parked
+}
+
+// Renew extends the client's registration by ttl, or by its registered TTL
+// when ttl is zero, and returns the new expiry
+func (m *ClientManager) Renew(clientID string, ttl time.Duration) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client, ok := m.clients[clientID]
+	if !ok {
+		return time.Time{}, fmt.Errorf("client not registered: %s", clientID)
+	}
+	if ttl == 0 {
+		ttl = client.TTL
+	}
+	if ttl <= 0 {
+		return time.Time{}, fmt.Errorf("client %s has no ttl to renew", clientID)
+	}
+	client.TTL = ttl
+	client.ExpiresAt = time.Now().Add(ttl)
+	return client.ExpiresAt, nil
+}
+
+// Expiry returns when the client's registration expires, zero if never
+func (m *ClientManager) Expiry(clientID string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if client, ok := m.clients[clientID]; ok {
+		return client.ExpiresAt
+	}
+	return time.Time{}
+}
+
+// RemoveExpired drops registrations whose TTL has lapsed and returns their client IDs
+func (m *ClientManager) RemoveExpired() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []string
+	now := time.Now()
+	for id, client := range m.clients {
+		if !client.ExpiresAt.IsZero() && now.After(client.ExpiresAt) {
+			delete(m.clients, id)
+			expired = append(expired, id)
+		}
+	}
+	return expired
+}
+
+// PinFingerprint binds a client ID to the first certificate seen for it and
+// rejects any other certificate trying to claim the same ID
+func (m *ClientManager) PinFingerprint(clientID, fingerprint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pinned, ok := m.pins[clientID]; ok && pinned != fingerprint {
+		return fmt.Errorf("client %s is pinned to a different certificate", clientID)
+	} else if !ok {
+		m.pins[clientID] = fingerprint
+		m.savePinsLocked()
+	}
+
+	client, ok := m.clients[clientID]
+	if !ok {
+		client = &Client{ClientId: clientID}
+		m.clients[clientID] = client
+	}
+	client.Fingerprint = fingerprint
+	return nil
+}
+
+// LoadPins reads the pins persisted at path, a JSON object of client IDs to
+// fingerprints, and persists new pins there
+func (m *ClientManager) LoadPins(path string) error {
+	pins := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &pins); err != nil {
+			return fmt.Errorf("invalid pins file %s: %v", path, err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for clientID, fingerprint := range pins {
+		m.pins[clientID] = fingerprint
+	}
+	m.pinsFile = path
+	return nil
+}
+
+// savePinsLocked writes the pins to the pins file, replacing it whole so a
+// crash can't leave it half written
+func (m *ClientManager) savePinsLocked() {
+	if m.pinsFile == "" {
+		return
+	}
+	err := func() error {
+		data, err := json.Marshal(m.pins)
+		if err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(m.pinsFile), filepath.Base(m.pinsFile)+".tmp-*")
+		if err != nil {
+			return err
+		}
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		return os.Rename(tmp.Name(), m.pinsFile)
+	}()
+	if err != nil {
+		log.Printf("Identity: Failed to save certificate pins to %s: %v", m.pinsFile, err)
+	}
+}
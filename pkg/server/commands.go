@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/registry"
+)
+
+// maxCommandWait bounds how long /admin/commands waits for results
+const maxCommandWait = 5 * time.Minute
+
+// errCommandsUnsupported refuses commands to clients too old to run them
+var errCommandsUnsupported = errors.New("client doesn't run remote commands")
+
+// commandResultStore hands the results of running commands to the requests
+// waiting for them
+type commandResultStore struct {
+	mu      sync.Mutex
+	waiters map[string]chan protocol.CommandResult // Map command ID to its waiter
+}
+
+// SendCommand sends a command to a connected client over its tunnel and
+// returns the command's ID. The client's history tracks its result.
+func (m *TCPManager) SendCommand(clientID, name, args string) (string, error) {
+	command := protocol.Command{ID: uuid.NewString(), Name: name, Args: args}
+	if err := command.Validate(); err != nil {
+		return "", err
+	}
+	client, ok := m.GetClient(clientID)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errNoClient, clientID)
+	}
+	if client.transport.Version < protocol.CommandVersion {
+		return "", fmt.Errorf("%w: it speaks protocol version %d, commands need %d",
+			errCommandsUnsupported, client.transport.Version, protocol.CommandVersion)
+	}
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		return "", err
+	}
+	client.history.RecordCommand(command.ID, name, args)
+	if _, err := m.srv.sendLine(clientID, client.conn, "command|"+string(data)); err != nil {
+		client.history.FinishCommand(command.ID, false, fmt.Sprintf("not delivered: %v", err))
+		return "", fmt.Errorf("failed to send command to client %s: %v", clientID, err)
+	}
+	log.Printf("TCP Manager: Sent command %s %s to client %s", name, command.ID, clientID)
+	return command.ID, nil
+}
+
+// handleCommandResult records a command's result the client reported
+// (format: "command-result|<json>")
+func (m *TCPManager) handleCommandResult(clientID, data string) {
+	var result protocol.CommandResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		log.Printf("TCP Manager: Invalid command result from client %s: %v", clientID, err)
+		return
+	}
+	history, ok := m.GetHistory(clientID)
+	if !ok || !history.FinishCommand(result.ID, result.OK, result.Output) {
+		log.Printf("TCP Manager: Client %s reported a result for command %s, which isn't running", clientID, result.ID)
+		return
+	}
+	if result.OK {
+		log.Printf("TCP Manager: Client %s finished command %s: %s", clientID, result.ID, result.Output)
+	} else {
+		log.Printf("TCP Manager: Client %s failed command %s: %s", clientID, result.ID, result.Output)
+	}
+
+	m.srv.commandResults.mu.Lock()
+	waiter, ok := m.srv.commandResults.waiters[result.ID]
+	delete(m.srv.commandResults.waiters, result.ID)
+	m.srv.commandResults.mu.Unlock()
+	if ok {
+		waiter <- result
+	}
+}
+
+// awaitResult registers a waiter for the result of the command with the ID
+func (s *Server) awaitResult(id string) chan protocol.CommandResult {
+	waiter := make(chan protocol.CommandResult, 1)
+	s.commandResults.mu.Lock()
+	s.commandResults.waiters[id] = waiter
+	s.commandResults.mu.Unlock()
+	return waiter
+}
+
+func (s *Server) stopAwaiting(id string) {
+	s.commandResults.mu.Lock()
+	delete(s.commandResults.waiters, id)
+	s.commandResults.mu.Unlock()
+}
+
+// commandRequest is the body of a POST to /admin/commands
+type commandRequest struct {
+	Name        string `json:"name"`
+	Args        string `json:"args"`
+	WaitSeconds int    `json:"wait_seconds"` // How long to wait for results, 0 to return once sent
+}
+
+// sentCommand is a command sent to one client, with its result if it
+// arrived in time
+type sentCommand struct {
+	ClientID string                  `json:"client_id"`
+	ID       string                  `json:"id"`
+	Result   *protocol.CommandResult `json:"result,omitempty"`
+}
+
+// commandResponse reports a command to each client it was meant for
+type commandResponse struct {
+	Sent   []sentCommand   `json:"sent"`
+	Failed []clientFailure `json:"failed"`
+}
+
+// clientCommand is a command in a client's history
+type clientCommand struct {
+	ClientID string `json:"client_id"`
+	registry.CommandRun
+}
+
+// CommandsHandler runs a command (POST with a commandRequest) on the
+// connected clients whose ID matches the ?client_id= pattern, or lists the
+// commands sent to them and their results (GET, all clients without
+// ?client_id=)
+func (s *Server) CommandsHandler(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("client_id")
+	switch r.Method {
+	case http.MethodGet:
+		commands, err := s.tcpmanager.commandHistory(pattern)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid client_id pattern: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(commands)
+	case http.MethodPost:
+		if pattern == "" {
+			http.Error(w, "client_id is required", http.StatusBadRequest)
+			return
+		}
+		clients, err := s.matchingClients(pattern)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid client_id pattern: %v", err), http.StatusBadRequest)
+			return
+		}
+		var req commandRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := (protocol.Command{Name: req.Name, Args: req.Args}).Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wait := time.Duration(req.WaitSeconds) * time.Second
+		if wait < 0 || wait > maxCommandWait {
+			http.Error(w, fmt.Sprintf("wait_seconds must be between 0 and %d", int(maxCommandWait.Seconds())), http.StatusBadRequest)
+			return
+		}
+		if len(clients) == 0 {
+			http.Error(w, fmt.Sprintf("No connected client matches %s", pattern), http.StatusNotFound)
+			return
+		}
+
+		response := commandResponse{Sent: []sentCommand{}, Failed: []clientFailure{}}
+		waiters := make([]chan protocol.CommandResult, 0, len(clients))
+		for _, client := range clients {
+			id, err := s.tcpmanager.SendCommand(client.clientID, req.Name, req.Args)
+			if err != nil {
+				response.Failed = append(response.Failed, clientFailure{ClientID: client.clientID, Error: err.Error()})
+				continue
+			}
+			response.Sent = append(response.Sent, sentCommand{ClientID: client.clientID, ID: id})
+			if wait > 0 {
+				// Registered after sending, so a result that arrived first
+				// is read back from the history instead
+				waiters = append(waiters, s.awaitResult(id))
+			}
+		}
+		if wait > 0 {
+			deadline := time.NewTimer(wait)
+			defer deadline.Stop()
+			expired := false
+			for i := range waiters {
+				sent := &response.Sent[i]
+				sent.Result = s.finishedResult(sent.ClientID, sent.ID)
+				if sent.Result == nil && !expired {
+					select {
+					case result := <-waiters[i]:
+						sent.Result = &result
+					case <-deadline.C:
+						expired = true
+					case <-r.Context().Done():
+						expired = true
+					}
+				}
+				s.stopAwaiting(sent.ID)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// finishedResult returns the result of a command in the client's history,
+// nil while it runs
+func (s *Server) finishedResult(clientID, id string) *protocol.CommandResult {
+	history, ok := s.tcpmanager.GetHistory(clientID)
+	if !ok {
+		return nil
+	}
+	for _, run := range history.Commands() {
+		if run.ID == id && run.FinishedAt != nil {
+			return &protocol.CommandResult{ID: id, OK: run.OK, Output: run.Output}
+		}
+	}
+	return nil
+}
+
+// commandHistory returns the commands in the histories of the clients whose
+// ID matches the pattern, oldest first
+func (m *TCPManager) commandHistory(pattern string) ([]clientCommand, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	m.RLock()
+	histories := make(map[string]*registry.History, len(m.histories))
+	for clientID, history := range m.histories {
+		if ok, _ := path.Match(pattern, clientID); ok || pattern == "" {
+			histories[clientID] = history
+		}
+	}
+	m.RUnlock()
+
+	commands := []clientCommand{}
+	for clientID, history := range histories {
+		for _, run := range history.Commands() {
+			commands = append(commands, clientCommand{ClientID: clientID, CommandRun: run})
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].SentAt.Before(commands[j].SentAt) })
+	return commands, nil
+}
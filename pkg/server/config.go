@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/vikasavn/attachcloudip/pkg/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+// LoadConfig loads the configuration from a YAML file, fetching the secrets
+// its values refer to
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if secrets.HasReferences(string(data)) {
+		resolver, err := newSecretResolver(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secrets configuration: %v", err)
+		}
+		source := &secretSource{data: data, resolver: resolver}
+		config, err := source.load(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve secrets: %v", err)
+		}
+		return config, nil
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	return &config, nil
+}
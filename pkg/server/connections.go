@@ -0,0 +1,378 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+)
+
+// ConnectionInfo describes a public connection in the connection table
+type ConnectionInfo struct {
+	ID        string    `json:"id"`
+	Source    string    `json:"source"`
+	ClientID  string    `json:"client_id,omitempty"` // Client of the latest request proxied on the connection
+	Port      int       `json:"port"`
+	StartedAt time.Time `json:"started_at"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	State     string    `json:"state"` // new, active, idle, or hijacked
+}
+
+// ConnectionFilter selects connections from the table. Empty fields match
+// every connection.
+type ConnectionFilter struct {
+	ClientID string
+	State    string
+	Port     int
+	Source   string // IP address the connection came from
+}
+
+func (f ConnectionFilter) matches(info ConnectionInfo) bool {
+	if f.ClientID != "" && info.ClientID != f.ClientID {
+		return false
+	}
+	if f.State != "" && info.State != f.State {
+		return false
+	}
+	if f.Port != 0 && info.Port != f.Port {
+		return false
+	}
+	if f.Source != "" {
+		host, _, err := net.SplitHostPort(info.Source)
+		if err != nil {
+			host = info.Source
+		}
+		if host != f.Source {
+			return false
+		}
+	}
+	return true
+}
+
+// publicConn counts the bytes of a public connection while it is in the table
+type publicConn struct {
+	srv *Server
+	net.Conn
+	id       string
+	port     int
+	started  time.Time
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	state    atomic.Value // http.ConnState
+	clientID atomic.Value // string
+	manager  *TCPManager
+	once     sync.Once
+
+	// The source is counted on the first read, since with PROXY headers its
+	// address is only known once the header arrives
+	admit    sync.Once
+	source   string // Counted against the per-IP limit, "" if not counted
+	rejected bool
+}
+
+func (c *publicConn) Read(p []byte) (int, error) {
+	c.admit.Do(func() {
+		c.source, c.rejected = c.manager.countSource(c.RemoteAddr())
+	})
+	if c.rejected {
+		// Servers close the connection without answering
+		return 0, io.EOF
+	}
+	n, err := c.Conn.Read(p)
+	c.bytesIn.Add(int64(n))
+	if n > 0 {
+		c.dump("read from", p[:n])
+	}
+	return n, err
+}
+
+func (c *publicConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesOut.Add(int64(n))
+	if n > 0 {
+		c.dump("wrote to", p[:n])
+	}
+	return n, err
+}
+
+func (c *publicConn) Close() error {
+	c.once.Do(func() {
+		// Waits for a first read counting the source to finish
+		c.admit.Do(func() {})
+		c.manager.untrackConnection(c.id, c.source)
+	})
+	return c.Conn.Close()
+}
+
+func (c *publicConn) info() ConnectionInfo {
+	info := ConnectionInfo{
+		ID:        c.id,
+		Source:    c.RemoteAddr().String(),
+		Port:      c.port,
+		StartedAt: c.started,
+		BytesIn:   c.bytesIn.Load(),
+		BytesOut:  c.bytesOut.Load(),
+		State:     http.StateNew.String(),
+	}
+	if state, ok := c.state.Load().(http.ConnState); ok {
+		info.State = state.String()
+	}
+	if clientID, ok := c.clientID.Load().(string); ok {
+		info.ClientID = clientID
+	}
+	return info
+}
+
+// connListener adds the connections it accepts to the connection table
+type connListener struct {
+	srv *Server
+	net.Listener
+	manager *TCPManager
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &publicConn{
+		srv:     l.srv,
+		Conn:    conn,
+		id:      uuid.New().String(),
+		port:    localPort(conn),
+		started: time.Now(),
+		manager: l.manager,
+	}
+	l.manager.connsMu.Lock()
+	l.manager.conns[c.id] = c
+	l.manager.connsMu.Unlock()
+	return c, nil
+}
+
+// TrackConnections wraps l so the connections it accepts are listed in the
+// connection table until they close
+func (m *TCPManager) TrackConnections(l net.Listener) net.Listener {
+	return &connListener{srv: m.srv, Listener: l, manager: m}
+}
+
+func (m *TCPManager) untrackConnection(id, source string) {
+	m.connsMu.Lock()
+	delete(m.conns, id)
+	if source != "" {
+		if m.connsByIP[source]--; m.connsByIP[source] <= 0 {
+			delete(m.connsByIP, source)
+		}
+	}
+	m.connsMu.Unlock()
+}
+
+// SetConnectionsPerIP limits the open public connections from each source
+// IP, 0 meaning unlimited
+func (m *TCPManager) SetConnectionsPerIP(max int) {
+	m.connsMu.Lock()
+	m.maxConnsPerIP = max
+	m.connsMu.Unlock()
+}
+
+// countSource counts a connection against its source IP's limit, returning
+// the IP it was counted for, or reporting that the IP is over its limit
+func (m *TCPManager) countSource(addr net.Addr) (string, bool) {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	m.connsMu.Lock()
+	defer m.connsMu.Unlock()
+	if m.maxConnsPerIP <= 0 {
+		return "", false
+	}
+	if m.connsByIP[ip] >= m.maxConnsPerIP {
+		m.rejectedPerIP.Add(1)
+		logging.Debugf("Closing connection from %s, over its limit of %d connections", ip, m.maxConnsPerIP)
+		return "", true
+	}
+	m.connsByIP[ip]++
+	return ip, false
+}
+
+// Connections returns the open public connections matching filter, oldest first
+func (m *TCPManager) Connections(filter ConnectionFilter) []ConnectionInfo {
+	m.connsMu.Lock()
+	conns := make([]*publicConn, 0, len(m.conns))
+	for _, c := range m.conns {
+		conns = append(conns, c)
+	}
+	m.connsMu.Unlock()
+
+	list := make([]ConnectionInfo, 0, len(conns))
+	for _, c := range conns {
+		if info := c.info(); filter.matches(info) {
+			list = append(list, info)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// CloseConnection closes the public connection with the given ID and
+// reports whether it was open
+func (m *TCPManager) CloseConnection(id string) bool {
+	m.connsMu.Lock()
+	c, ok := m.conns[id]
+	m.connsMu.Unlock()
+	if ok {
+		c.Close()
+	}
+	return ok
+}
+
+// Frontend defaults for settings left unset
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// frontendLimitSettings bound how slowly and how much public clients may send
+type frontendLimitSettings struct {
+	readHeaderTimeout, readTimeout, idleTimeout time.Duration
+	maxHeaderBytes                              int
+	// requestTimeout is the deadline tunneled requests carry, 0 for none
+	requestTimeout time.Duration
+}
+
+// configureFrontendLimits reads the public frontend limits
+func (s *Server) configureFrontendLimits(config *Config) error {
+	settings := config.Server.HTTP
+	if settings.ReadHeaderTimeout < 0 || settings.ReadTimeout < 0 || settings.IdleTimeout < 0 ||
+		settings.RequestTimeout < 0 || settings.MaxHeaderBytes < 0 || settings.MaxConnectionsPerIP < 0 {
+		return errors.New("http limits must not be negative")
+	}
+	if settings.ReadHeaderTimeout > 0 {
+		s.frontendLimits.readHeaderTimeout = time.Duration(settings.ReadHeaderTimeout) * time.Second
+	}
+	s.frontendLimits.readTimeout = time.Duration(settings.ReadTimeout) * time.Second
+	if settings.IdleTimeout > 0 {
+		s.frontendLimits.idleTimeout = time.Duration(settings.IdleTimeout) * time.Second
+	}
+	s.frontendLimits.maxHeaderBytes = settings.MaxHeaderBytes
+	s.frontendLimits.requestTimeout = time.Duration(settings.RequestTimeout) * time.Second
+	s.tcpmanager.SetConnectionsPerIP(settings.MaxConnectionsPerIP)
+	return nil
+}
+
+// configureClientLimits reads the limits on each client's in-flight requests
+func (s *Server) configureClientLimits(config *Config) error {
+	limits := config.Server.Limits
+	if limits.ClientMaxInFlight < 0 || limits.ClientQueueTimeoutMs < 0 {
+		return errors.New("client in-flight limits must not be negative")
+	}
+	for clientID, maxInFlight := range limits.ClientInFlight {
+		if maxInFlight < 0 {
+			return fmt.Errorf("in-flight limit of client %s must not be negative", clientID)
+		}
+	}
+	busyStatus := limits.ClientBusyStatus
+	if busyStatus == 0 {
+		busyStatus = http.StatusServiceUnavailable
+	}
+	if busyStatus != http.StatusServiceUnavailable && busyStatus != http.StatusTooManyRequests {
+		return fmt.Errorf("invalid client_busy_status %d, must be 429 or 503", busyStatus)
+	}
+	s.tcpmanager.SetClientLimits(limits.ClientMaxInFlight, limits.ClientInFlight,
+		time.Duration(limits.ClientQueueTimeoutMs)*time.Millisecond, busyStatus)
+	return nil
+}
+
+type connContextKey struct{}
+
+// newPublicServer returns a server for handler with the frontend limits that
+// keeps the state of the connections it serves in the connection table
+func (s *Server) newPublicServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: s.frontendLimits.readHeaderTimeout,
+		ReadTimeout:       s.frontendLimits.readTimeout,
+		IdleTimeout:       s.frontendLimits.idleTimeout,
+		MaxHeaderBytes:    s.frontendLimits.maxHeaderBytes,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if conn := unwrapPublicConn(c); conn != nil {
+				return context.WithValue(ctx, connContextKey{}, conn)
+			}
+			return ctx
+		},
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if conn := unwrapPublicConn(c); conn != nil {
+				conn.state.Store(state)
+			}
+		},
+	}
+}
+
+// unwrapPublicConn returns the table entry of a served connection, looking
+// beneath TLS
+func unwrapPublicConn(c net.Conn) *publicConn {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	conn, _ := c.(*publicConn)
+	return conn
+}
+
+// recordConnectionClient notes the client a request is proxied to on the
+// connection the request arrived on
+func recordConnectionClient(ctx context.Context, clientID string) {
+	if conn, ok := ctx.Value(connContextKey{}).(*publicConn); ok {
+		conn.clientID.Store(clientID)
+	}
+}
+
+// ConnectionsHandler lists the open public connections (GET), filtered by
+// ?client_id=, ?state=, ?port=, and ?source=, or closes one (DELETE ?id=)
+func (s *Server) ConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		filter := ConnectionFilter{
+			ClientID: query.Get("client_id"),
+			State:    query.Get("state"),
+			Source:   query.Get("source"),
+		}
+		if port := query.Get("port"); port != "" {
+			var err error
+			if filter.Port, err = strconv.Atoi(port); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid port: %s", port), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.tcpmanager.Connections(filter))
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		if !s.tcpmanager.CloseConnection(id) {
+			http.Error(w, fmt.Sprintf("Connection not open: %s", id), http.StatusNotFound)
+			return
+		}
+		log.Printf("Closed connection %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultCORSMethods are allowed when a policy doesn't list its own
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// CORS applies cross-origin policies to the server's API and to proxied paths
+type CORS struct {
+	srv   *Server
+	api   *CORSPolicy
+	paths map[string]*CORSPolicy // Proxied path prefix -> policy
+	mu    sync.RWMutex
+}
+
+func NewCORS(srv *Server) *CORS {
+	return &CORS{srv: srv, paths: make(map[string]*CORSPolicy)}
+}
+
+// Configure loads the API policy and per-path policies from the server config
+func (c *CORS) Configure(config *Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.api = config.Server.CORS.API
+	for _, p := range config.Server.CORS.Paths {
+		policy := p.CORSPolicy
+		c.paths[p.Path] = &policy
+	}
+}
+
+// policyFor returns the policy covering the request, if any. Requests the
+// router sends to ProxyHandler use the longest matching path policy.
+func (c *CORS) policyFor(r *http.Request) (policy *CORSPolicy, proxied bool) {
+	_, pattern := c.srv.router.Handler(r)
+	proxied = pattern == "/"
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !proxied {
+		return c.api, false
+	}
+	best := -1
+	for path, p := range c.paths {
+		if pathMatches(path, r.URL.Path) && len(path) > best {
+			policy, best = p, len(path)
+		}
+	}
+	return policy, true
+}
+
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the CORS response headers for an allowed origin
+func (p *CORSPolicy) apply(h http.Header, origin string) {
+	h.Del("Access-Control-Allow-Origin")
+	if slices.Contains(p.AllowedOrigins, "*") && !p.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// Credentialed responses can't use the wildcard, so echo the origin
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(p.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+	}
+}
+
+// preflight answers an OPTIONS preflight request on behalf of the endpoint
+func (p *CORSPolicy) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	h := w.Header()
+	p.apply(h, origin)
+
+	methods := p.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(p.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(p.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// withCORS answers preflights and adds CORS headers to responses of
+// endpoints covered by a policy. Origins outside the policy get no CORS
+// headers, so browsers block them.
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policy, proxied := s.corsPolicies.policyFor(r)
+		if policy == nil || !policy.allowsOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			policy.preflight(w, r, origin)
+			return
+		}
+
+		if !proxied {
+			policy.apply(w.Header(), origin)
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Proxied responses copy the upstream's headers, so the policy is
+		// applied last to take precedence over them
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, apply: func(h http.Header) {
+			policy.apply(h, origin)
+		}}, r)
+	})
+}
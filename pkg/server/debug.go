@@ -0,0 +1,87 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// defaultDebugAddress keeps the profiling endpoints off public interfaces
+const defaultDebugAddress = "127.0.0.1:6060"
+
+// startDebugServer serves pprof and expvar on a separate admin address so
+// they are never reachable through the public frontend
+func (s *Server) startDebugServer(config *Config) error {
+	dc := config.Server.Debug
+	if !dc.Enabled {
+		return nil
+	}
+
+	address := dc.Address
+	if address == "" {
+		address = defaultDebugAddress
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// The server's vars are kept off the process-wide expvar registry, which
+	// panics when a second server publishes the same names
+	vars := new(expvar.Map)
+	vars.Set("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	vars.Set("clients", expvar.Func(func() interface{} {
+		return len(s.tcpmanager.GetClients())
+	}))
+	vars.Set("pending_requests", expvar.Func(func() interface{} {
+		s.tcpmanager.waitersMu.Lock()
+		defer s.tcpmanager.waitersMu.Unlock()
+		return len(s.tcpmanager.waiters)
+	}))
+	vars.Set("admission", expvar.Func(func() interface{} {
+		return s.admissionController.Stats()
+	}))
+	mux.Handle("/debug/vars", debugVars(vars))
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on debug address %s: %v", address, err)
+	}
+
+	s.track(listener)
+	log.Printf("[DEBUG] Serving pprof and expvar on %s", address)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("[DEBUG] Debug server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// debugVars serves the process-wide expvar registry, as expvar.Handler does,
+// followed by vars
+func debugVars(vars *expvar.Map) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		first := true
+		write := func(kv expvar.KeyValue) {
+			if !first {
+				fmt.Fprintf(w, ",\n")
+			}
+			first = false
+			fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+		}
+		expvar.Do(write)
+		vars.Do(write)
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
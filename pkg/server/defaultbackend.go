@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// defaultLandingPage is served for unmatched paths with static: builtin
+const defaultLandingPage = `<!DOCTYPE html>
+<html>
+<head><title>attachcloudip</title></head>
+<body>
+<h1>attachcloudip</h1>
+<p>This server publishes local services through tunnels. Nothing is published at this address yet.</p>
+</body>
+</html>
+`
+
+// configureDefaultBackend sets up the static directory, built-in landing
+// page, or upstream serving unmatched requests
+func (s *Server) configureDefaultBackend(config *Config) error {
+	dc := config.Server.DefaultBackend
+	switch {
+	case dc.Static != "" && dc.Upstream != "":
+		return fmt.Errorf("static and upstream can't both be set")
+	case dc.Static == "builtin":
+		s.defaultBackend = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				s.errorPages.Write(w, r, http.StatusNotFound, "No tunnel is registered for this path.")
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, defaultLandingPage)
+		})
+		log.Println("Serving the built-in landing page for unmatched paths")
+	case dc.Static != "":
+		info, err := os.Stat(dc.Static)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("static %s is not a directory", dc.Static)
+		}
+		s.defaultBackend = s.staticHandler(dc.Static)
+		log.Printf("Serving %s for unmatched paths", dc.Static)
+	case dc.Upstream != "":
+		target, err := url.Parse(dc.Upstream)
+		if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+			return fmt.Errorf("invalid upstream %q", dc.Upstream)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Proxy: Default backend failed for %s: %v", r.URL.Path, err)
+			s.errorPages.Write(w, r, http.StatusBadGateway, "The default backend could not be reached.")
+		}
+		s.defaultBackend = proxy
+		log.Printf("Forwarding unmatched paths to %s", target.Redacted())
+	}
+	return nil
+}
+
+// staticHandler serves files from dir without listing directories, falling
+// back to the error page for missing files
+func (s *Server) staticHandler(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if strings.HasSuffix(name, "/") {
+			name += "index.html"
+		}
+		f, err := http.Dir(dir).Open(name)
+		if err != nil {
+			s.errorPages.Write(w, r, http.StatusNotFound, "No tunnel is registered for this path.")
+			return
+		}
+		info, err := f.Stat()
+		f.Close()
+		if err != nil || info.IsDir() {
+			s.errorPages.Write(w, r, http.StatusNotFound, "No tunnel is registered for this path.")
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
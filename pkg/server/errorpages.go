@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultErrorPage is used for statuses without a template in the error page directory
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`
+
+// errorPageData is passed to error page templates
+type errorPageData struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Message    string `json:"message"`
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+}
+
+// ErrorPages renders the frontend's proxy errors from templates
+type ErrorPages struct {
+	templates map[int]*template.Template // Status -> page
+	fallback  *template.Template
+	mu        sync.RWMutex
+}
+
+func NewErrorPages() *ErrorPages {
+	return &ErrorPages{
+		templates: make(map[int]*template.Template),
+		fallback:  template.Must(template.New("default").Parse(defaultErrorPage)),
+	}
+}
+
+// Load parses <status>.html templates from dir, with default.html replacing
+// the built-in page for all other statuses
+func (p *ErrorPages) Load(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return fmt.Errorf("failed to list error pages: %v", err)
+	}
+
+	templates := make(map[int]*template.Template)
+	fallback := p.fallback
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".html")
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read error page: %v", err)
+		}
+		tmpl, err := template.New(name).Parse(string(data))
+		if err != nil {
+			return fmt.Errorf("failed to parse error page %s: %v", file, err)
+		}
+
+		if name == "default" {
+			fallback = tmpl
+			continue
+		}
+		status, err := strconv.Atoi(name)
+		if err != nil || status < 400 || status > 599 {
+			log.Printf("Ignoring error page %s: name is not an error status", file)
+			continue
+		}
+		templates[status] = tmpl
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.templates = templates
+	p.fallback = fallback
+	log.Printf("Loaded %d error pages from %s", len(templates), dir)
+	return nil
+}
+
+// Write sends an error response, as JSON when the caller accepts it and an
+// HTML page otherwise
+func (p *ErrorPages) Write(w http.ResponseWriter, r *http.Request, status int, message string) {
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+
+	p.mu.RLock()
+	tmpl, ok := p.templates[status]
+	if !ok {
+		tmpl = p.fallback
+	}
+	p.mu.RUnlock()
+
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, data); err != nil {
+		log.Printf("Failed to render error page for status %d: %v", status, err)
+		http.Error(w, data.StatusText, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(page.Bytes())
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/events"
+)
+
+// Event stream settings
+const (
+	eventHistory   = 1024 // Events kept for subscribers resuming with Last-Event-ID
+	eventBuffer    = 256  // Events a subscriber may fall behind by before it is dropped
+	eventKeepalive = 15 * time.Second
+)
+
+// publishTunnel publishes a client's tunnel being added or removed, along
+// with its paths being claimed or released
+func (s *Server) publishTunnel(client clientInfo, added bool, reason string) {
+	clientEvent, pathEvent := events.ClientAdded, events.PathClaimed
+	if !added {
+		clientEvent, pathEvent = events.ClientRemoved, events.PathReleased
+	}
+	s.registryEvents.Publish(events.Event{Type: clientEvent, ClientID: client.clientID, Tenant: client.tenant, Path: client.path, Reason: reason})
+	for _, path := range client.paths() {
+		s.registryEvents.Publish(events.Event{Type: pathEvent, ClientID: client.clientID, Tenant: client.tenant, Path: path})
+	}
+}
+
+// publishStatus publishes a change to a client's health or pause state
+func (s *Server) publishStatus(clientID, tenant, path, status string) {
+	s.registryEvents.Publish(events.Event{Type: events.ClientStatus, ClientID: clientID, Tenant: tenant, Path: path, Status: status})
+}
+
+// EventsHandler streams registry changes as Server-Sent Events (GET
+// ?types=client_added,...&client=<id>). Reconnecting subscribers get the
+// events they missed by sending Last-Event-ID.
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	tenant, tenantFiltered := query.Get("tenant"), query.Has("tenant")
+	scope, all, ok := s.tenantScope(w, r)
+	if !ok {
+		return
+	}
+	if !all {
+		tenant, tenantFiltered = scope, true
+	}
+	var types map[string]bool
+	if value := query.Get("types"); value != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(value, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+	clientID := query.Get("client")
+	wanted := func(e events.Event) bool {
+		return (types == nil || types[e.Type]) &&
+			(clientID == "" || e.ClientID == clientID) &&
+			(!tenantFiltered || e.Tenant == tenant)
+	}
+
+	lastID, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	if err != nil {
+		lastID = 0
+	}
+	missed, stream, cancel := s.registryEvents.Subscribe(lastID, eventBuffer)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(w)
+	flusher.Flush()
+
+	write := func(e events.Event) error {
+		if !wanted(e) {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		return flusher.Flush()
+	}
+	for _, e := range missed {
+		if write(e) != nil {
+			return
+		}
+	}
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-stream:
+			if !ok {
+				// Fell behind; the subscriber reconnects with Last-Event-ID
+				return
+			}
+			if write(e) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || flusher.Flush() != nil {
+				return
+			}
+		}
+	}
+}
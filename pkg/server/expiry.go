@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// expiryInterval is how often registrations are checked for a lapsed TTL
+const expiryInterval = time.Second
+
+// startExpiryReaper removes tunnels whose TTL lapsed without renewal
+func (s *Server) startExpiryReaper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(expiryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, clientID := range s.clientManager.RemoveExpired() {
+				s.tcpmanager.ExpireClient(clientID)
+				log.Printf("Registration of client %s expired", clientID)
+			}
+		}
+	}()
+}
+
+// RenewClient extends a tunnel's TTL (POST ?client_id=, optional body
+// {"ttl": "2h"}; defaults to the TTL it registered with)
+func (s *Server) RenewClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.URL.Query().Get("client_id")
+	client := s.clientManager.GetClient(clientID)
+	if client == nil {
+		http.Error(w, fmt.Sprintf("Client not registered: %s", clientID), http.StatusNotFound)
+		return
+	}
+	if !s.authorizeTunnelControl(w, r, client) {
+		return
+	}
+
+	var request struct {
+		TTL string `json:"ttl"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	ttl, err := parseTTL(request.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expiresAt, err := s.clientManager.Renew(clientID, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Renewed registration of client %s until %s", clientID, expiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}{expiresAt})
+}
+
+// parseTTL parses a registration TTL such as "2h", where empty means none
+func parseTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl %q: %v", value, err)
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("ttl must not be negative: %s", value)
+	}
+	return ttl, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/failover"
+)
+
+// peerState holds the last client list mirrored from the active peer
+type peerState struct {
+	srv     *Server
+	clients []ClientResponse
+	mu      sync.Mutex
+}
+
+// startFailover sets up the active/standby monitor from the server config
+func (s *Server) startFailover(ctx context.Context, config *Config) error {
+	fc := config.Server.Failover
+	if fc.Role == "" {
+		return nil
+	}
+
+	role := failover.Role(fc.Role)
+	if role != failover.RoleActive && role != failover.RoleStandby {
+		return fmt.Errorf("invalid failover role: %s", fc.Role)
+	}
+
+	provider, err := failover.NewProvider(fc.Provider, fc.APIToken)
+	if err != nil {
+		return err
+	}
+
+	monitor := failover.NewMonitor(failover.Config{
+		Role:             role,
+		PeerURL:          fc.PeerURL,
+		FloatingIP:       fc.FloatingIP,
+		TargetID:         fc.TargetID,
+		CheckInterval:    time.Duration(fc.CheckInterval) * time.Second,
+		FailureThreshold: fc.FailureThreshold,
+	}, provider)
+
+	state := &peerState{srv: s}
+	monitor.OnSync(func(ctx context.Context) error {
+		return state.sync(ctx, fc.PeerURL, fc.PeerAPIKey)
+	})
+	monitor.OnTakeover(state.takeover)
+	monitor.Start(ctx)
+
+	log.Printf("[FAILOVER] Started in %s mode for floating IP %s", role, fc.FloatingIP)
+	return nil
+}
+
+// sync fetches the active peer's client list so registrations survive a takeover
+func (p *peerState) sync(ctx context.Context, peerURL, apiKey string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peerURL+"/clients", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create clients request: %v", err)
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch peer clients: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned status: %d", resp.StatusCode)
+	}
+
+	var clients []ClientResponse
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		return fmt.Errorf("failed to decode peer clients: %v", err)
+	}
+
+	p.mu.Lock()
+	p.clients = clients
+	p.mu.Unlock()
+	return nil
+}
+
+// takeover restores the mirrored registrations so reconnecting clients keep their paths
+func (p *peerState) takeover() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range p.clients {
+		client := &Client{
+			ClientId: c.ID,
+			Paths:    []string{c.Path},
+			Tenant:   c.Tenant,
+			Methods:  c.Methods,
+			Headers:  c.Headers,
+			ALPN:     c.ALPN,
+			Shadow:   c.Shadow,
+			Class:    c.Class,
+		}
+		if c.ExpiresAt != nil {
+			// Keep the expiry, renewals extend by what is left of it
+			client.ExpiresAt = *c.ExpiresAt
+			client.TTL = time.Until(client.ExpiresAt)
+		}
+		p.srv.clientManager.RegisterClient(client)
+	}
+	log.Printf("[FAILOVER] Restored %d client registrations from peer", len(p.clients))
+}
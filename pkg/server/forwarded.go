@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// configureForwarded reads which peers may pass forwarding headers through
+func (s *Server) configureForwarded(config *Config) error {
+	trusted, err := parseNetworks(config.Server.Forwarded.Trusted)
+	if err != nil {
+		return err
+	}
+	s.forwardedTrusted = trusted
+	if len(trusted) > 0 {
+		log.Printf("Keeping forwarding headers from %s", describeTrusted(config.Server.Forwarded.Trusted))
+	}
+	return nil
+}
+
+// setForwardedHeaders adds X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host, and an RFC 7239 Forwarded element describing r to the
+// headers tunneled to the client
+func (s *Server) setForwardedHeaders(headers http.Header, r *http.Request) {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if !s.peerTrusted(peer) {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			headers.Del(name)
+		}
+	}
+
+	// Earlier proxies' values stay first, as the chain was built
+	if prior := strings.Join(headers.Values("X-Forwarded-For"), ", "); prior != "" {
+		headers.Set("X-Forwarded-For", prior+", "+peer)
+	} else {
+		headers.Set("X-Forwarded-For", peer)
+	}
+	if headers.Get("X-Forwarded-Proto") == "" {
+		headers.Set("X-Forwarded-Proto", proto)
+	}
+	if headers.Get("X-Forwarded-Host") == "" {
+		headers.Set("X-Forwarded-Host", r.Host)
+	}
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer), forwardedValue(r.Host), proto)
+	if prior := strings.Join(headers.Values("Forwarded"), ", "); prior != "" {
+		element = prior + ", " + element
+	}
+	headers.Set("Forwarded", element)
+}
+
+func (s *Server) peerTrusted(peer string) bool {
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.forwardedTrusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedNode formats an address as a Forwarded node, which brackets and
+// quotes IPv6 addresses
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+// forwardedValue quotes a value unless it is a plain token
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isToken(c) {
+			return fmt.Sprintf("%q", value)
+		}
+	}
+	return value
+}
+
+func isToken(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,823 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/certs"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/registry"
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+	"github.com/vikasavn/attachcloudip/pkg/version"
+)
+
+func HealthCheck(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("Not Found"))
+}
+
+func (s *Server) RegisterClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ClientID string   `json:"client_id"`
+		Paths    []string `json:"paths"`
+		Weight   int      `json:"weight"`
+		// SessionToken resumes an earlier session, keeping its port and path
+		SessionToken string `json:"session_token,omitempty"`
+		// TTL such as "2h" expires the registration unless it is renewed
+		TTL string `json:"ttl,omitempty"`
+		// Methods, Headers, and ALPN claim the paths only for matching
+		// requests, ALPN naming the protocols negotiated over TLS
+		Methods []string          `json:"methods,omitempty"`
+		Headers map[string]string `json:"headers,omitempty"`
+		ALPN    []string          `json:"alpn,omitempty"`
+		// Shadow asks for copies of the paths' traffic instead of the traffic itself
+		Shadow bool `json:"shadow,omitempty"`
+		// Class is the QoS priority class of the tunnel
+		Class string `json:"class,omitempty"`
+		// Schedule is a cron-like availability window such as
+		// "* 9-17 * * mon-fri" in Timezone, UTC if empty
+		Schedule string `json:"schedule,omitempty"`
+		Timezone string `json:"timezone,omitempty"`
+		// Profile names a server.profiles entry whose settings apply to the
+		// tunnel, as defaults for the fields above left empty
+		Profile string `json:"profile,omitempty"`
+		// SSHNonce is a challenge from /register/challenge, and SSHSignature
+		// its signature by the client's SSH key, base64 encoded
+		SSHNonce     string `json:"ssh_nonce,omitempty"`
+		SSHSignature string `json:"ssh_signature,omitempty"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Received registration request for client %s with paths: %v", request.ClientID, request.Paths)
+
+	tenant, ok := s.tenants.FromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized: missing or unknown API key", http.StatusUnauthorized)
+		return
+	}
+	if existing := s.clientManager.GetClient(request.ClientID); existing != nil && existing.Tenant != tenant {
+		http.Error(w, fmt.Sprintf("Client ID %s belongs to another tenant", request.ClientID), http.StatusConflict)
+		return
+	}
+
+	if err := s.authorizeClient(r.TLS, request.ClientID); err != nil {
+		log.Printf("Refusing registration for client %s: %v", request.ClientID, err)
+		http.Error(w, fmt.Sprintf("Unauthorized: %v", err), http.StatusForbidden)
+		return
+	}
+
+	var ticket string
+	if s.sshIdentity.Enabled() {
+		var err error
+		if ticket, err = s.sshIdentity.Authorize(request.ClientID, request.SSHNonce, request.SSHSignature); err != nil {
+			log.Printf("Refusing registration for client %s: %v", request.ClientID, err)
+			http.Error(w, fmt.Sprintf("Unauthorized: %v", err), http.StatusForbidden)
+			return
+		}
+	}
+
+	if request.Weight < 0 {
+		http.Error(w, "Weight must not be negative", http.StatusBadRequest)
+		return
+	}
+	for _, path := range request.Paths {
+		if err := routing.Validate(path); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.allowPaths(request.ClientID, request.Paths); err != nil {
+		log.Printf("Refusing registration for client %s: %v", request.ClientID, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	profile, err := s.lookupProfile(request.Profile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if profile != nil {
+		profile.applyDefaults(&request.TTL, &request.Class, &request.Schedule, &request.Timezone)
+	}
+	ttl, err := parseTTL(request.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.validateClass(request.Class); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window, err := parseSchedule(request.Schedule, request.Timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Return TCP port for client connection, and how its paths are claimed
+	response := struct {
+		Port   []int                `json:"port"`
+		Claims []registry.PathClaim `json:"claims,omitempty"`
+		// TunnelTicket admits the tunnel connections of SSH-signed registrations
+		TunnelTicket string `json:"tunnel_ticket,omitempty"`
+	}{
+		Port:         s.tcpmanager.Ports,
+		TunnelTicket: ticket,
+	}
+
+	if request.SessionToken != "" {
+		sess, err := s.sessions.Lookup(request.ClientID, request.SessionToken)
+		switch {
+		case err == nil && sess.tenant == tenant:
+			// Hand back the session's port and path instead of a fresh allocation
+			response.Port = []int{sess.port}
+			request.Paths = []string{sess.path}
+		case errors.Is(err, errSessionNotFound):
+			// Expired, register as a new client
+		default:
+			http.Error(w, "Unauthorized: session token does not match", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Report how the paths will be claimed, refusing claims the policy
+	// rejects. Claims are enforced again when the tunnel connects, which is
+	// when a takeover evicts the other clients.
+	response.Claims, err = s.tcpmanager.CheckClaims(request.ClientID, tenant, request.Shadow, request.Paths)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	// Store the client paths for later use
+	// Use first path for now
+	client := &Client{
+		ClientId: request.ClientID,
+		Paths:    request.Paths,
+		Weight:   request.Weight,
+		Tenant:   tenant,
+		Methods:  normalizeMethods(request.Methods),
+		Headers:  normalizeHeaders(request.Headers),
+		ALPN:     normalizeALPN(request.ALPN),
+		Shadow:   request.Shadow,
+		Class:    request.Class,
+		Schedule: window,
+		Profile:  request.Profile,
+		TTL:      ttl,
+	}
+	if ttl > 0 {
+		client.ExpiresAt = time.Now().Add(ttl)
+	}
+	s.clientManager.RegisterClient(client)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+type ClientResponse struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// ExtraPaths were added to the tunnel after it connected
+	ExtraPaths []string  `json:"extra_paths,omitempty"`
+	LastActive time.Time `json:"last_active"`
+	Healthy    bool      `json:"healthy"`
+	Weight     int       `json:"weight"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Paused     bool      `json:"paused,omitempty"`
+	// Parked tunnels are outside the availability window of their Schedule
+	Parked   bool   `json:"parked,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+	// Methods, Headers, and ALPN are the conditions on the client's path, if any
+	Methods []string          `json:"methods,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	ALPN    []string          `json:"alpn,omitempty"`
+	Shadow  bool              `json:"shadow,omitempty"`
+	Class   string            `json:"class,omitempty"`
+	Profile string            `json:"profile,omitempty"`
+	// ExpiresAt is when the registration lapses unless renewed
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// RTTMs is the rolling average heartbeat round trip in milliseconds
+	RTTMs float64 `json:"rtt_ms,omitempty"`
+	// Traffic counts the client's requests and tunnel bytes
+	Traffic *traffic.Stats `json:"traffic,omitempty"`
+	// TCPPort is the public port of a raw TCP tunnel, which isn't routed by path
+	TCPPort int `json:"tcp_port,omitempty"`
+}
+
+// ListClients lists connected clients ordered by ID, optionally filtered with
+// ?tenant=&status=healthy|unhealthy|paused|parked&path= and paged with ?offset=&limit=,
+// with the number of matching clients in X-Total-Count. Requests made with a
+// tenant API key only see that tenant's clients, see tenantScope.
+func (s *Server) ListClients(w http.ResponseWriter, r *http.Request) {
+	opts, ok := s.clientListOptions(w, r)
+	if !ok {
+		return
+	}
+	clients := s.listClients(opts)
+	start, end := opts.Page(len(clients))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(clients)))
+	json.NewEncoder(w).Encode(clients[start:end])
+}
+
+// StatusHandler reports a page of the clients ListClients would list, with
+// how many match in all and the paths each of them serves
+func (s *Server) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	opts, ok := s.clientListOptions(w, r)
+	if !ok {
+		return
+	}
+	clients := s.listClients(opts)
+	paths := make(map[string][]string)
+	for _, client := range clients {
+		for _, path := range append([]string{client.Path}, client.ExtraPaths...) {
+			paths[path] = append(paths[path], client.ID)
+		}
+	}
+	start, end := opts.Page(len(clients))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Clients []ClientResponse    `json:"clients"`
+		Total   int                 `json:"total"`
+		Paths   map[string][]string `json:"paths"`
+	}{clients[start:end], len(clients), paths})
+}
+
+// clientListOptions reads the filters and page of a client listing, limited
+// to the tenant the request may see. ok is false once an error is written.
+func (s *Server) clientListOptions(w http.ResponseWriter, r *http.Request) (registry.ListOptions, bool) {
+	opts, err := registry.ParseListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return opts, false
+	}
+	switch opts.Status {
+	case "", "healthy", "unhealthy", "paused", "parked":
+	default:
+		http.Error(w, "status must be healthy, unhealthy, paused, or parked", http.StatusBadRequest)
+		return opts, false
+	}
+	tenant, all, ok := s.tenantScope(w, r)
+	if !ok {
+		return opts, false
+	}
+	if !all {
+		opts.Tenant, opts.FilterTenant = tenant, true
+	}
+	return opts, true
+}
+
+// listClients returns every connected client matching the filters of opts,
+// ordered by ID, leaving the paging to the caller
+func (s *Server) listClients(opts registry.ListOptions) []ClientResponse {
+	clients := s.tcpmanager.GetClients()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].clientID < clients[j].clientID })
+	response := make([]ClientResponse, 0, len(clients))
+
+	for _, client := range clients {
+		if opts.FilterTenant && client.tenant != opts.Tenant {
+			continue
+		}
+		if opts.Path != "" && !slices.Contains(client.paths(), opts.Path) {
+			continue
+		}
+		if opts.Type != nil && (*opts.Type == registry.ClientTypeTCP) != (client.tcpPort != 0) {
+			continue
+		}
+		paused, _ := s.clientManager.Paused(client.clientID)
+		parked, _ := s.clientManager.Parked(client.clientID)
+		switch opts.Status {
+		case "healthy":
+			if !client.healthy || paused {
+				continue
+			}
+		case "unhealthy":
+			if client.healthy {
+				continue
+			}
+		case "paused":
+			if !paused || parked {
+				continue
+			}
+		case "parked":
+			if !parked {
+				continue
+			}
+		}
+		var schedule, profile string
+		if registered := s.clientManager.GetClient(client.clientID); registered != nil {
+			if registered.Schedule != nil {
+				schedule = registered.Schedule.String()
+			}
+			profile = registered.Profile
+		}
+		stats := client.traffic.Snapshot()
+		var expiresAt *time.Time
+		if expiry := s.clientManager.Expiry(client.clientID); !expiry.IsZero() {
+			expiresAt = &expiry
+		}
+		response = append(response, ClientResponse{
+			ID:         client.clientID,
+			Path:       client.path,
+			ExtraPaths: client.extraPaths,
+			LastActive: client.lastActive,
+			Healthy:    client.healthy,
+			Weight:     client.weight,
+			Tenant:     client.tenant,
+			Paused:     paused && !parked,
+			Parked:     parked,
+			Schedule:   schedule,
+			Methods:    client.conditions.Methods,
+			Headers:    client.conditions.Headers,
+			ALPN:       client.conditions.ALPN,
+			Shadow:     client.shadow,
+			Class:      s.effectiveClass(client.class),
+			Profile:    profile,
+			ExpiresAt:  expiresAt,
+			RTTMs:      float64(client.rtt.Average()) / float64(time.Millisecond),
+			Traffic:    &stats,
+			TCPPort:    client.tcpPort,
+		})
+	}
+
+	return response
+}
+
+// ClientDetailResponse is everything the server knows about one client
+type ClientDetailResponse struct {
+	ID     string   `json:"id"`
+	Tenant string   `json:"tenant,omitempty"`
+	Paths  []string `json:"paths"`
+	// Port is the tunnel listener port the client connected to, 0 while disconnected
+	Port int `json:"port,omitempty"`
+	// TCPPort is the public port of a raw TCP tunnel
+	TCPPort int `json:"tcp_port,omitempty"`
+	// Status is online, unhealthy, paused, parked, or disconnected
+	Status string `json:"status"`
+	// NextWindow is when a parked tunnel's scheduled window opens
+	NextWindow  *time.Time     `json:"next_window,omitempty"`
+	LastActive  *time.Time     `json:"last_active,omitempty"`
+	ConnectedAt *time.Time     `json:"connected_at,omitempty"`
+	ExpiresAt   *time.Time     `json:"expires_at,omitempty"`
+	RTTMs       float64        `json:"rtt_ms,omitempty"`
+	Traffic     *traffic.Stats `json:"traffic,omitempty"`
+	registry.HistorySnapshot
+}
+
+// ClientDetail reports a registered, connected, or recently disconnected
+// client with its recent heartbeats, connections, and errors (GET
+// /clients/<id>). Requests made with a tenant API key only see that
+// tenant's clients, see tenantScope.
+func (s *Server) ClientDetail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	clientID := strings.TrimPrefix(r.URL.Path, "/clients/")
+	if clientID == "" || strings.Contains(clientID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	tenant, all, ok := s.tenantScope(w, r)
+	if !ok {
+		return
+	}
+
+	client, connected := s.tcpmanager.GetClient(clientID)
+	registered := s.clientManager.GetClient(clientID)
+	history, known := s.tcpmanager.GetHistory(clientID)
+	if !connected && registered == nil && !known {
+		http.Error(w, fmt.Sprintf("Client not found: %s", clientID), http.StatusNotFound)
+		return
+	}
+
+	response := ClientDetailResponse{ID: clientID, Paths: []string{}, Status: "disconnected"}
+	if registered != nil {
+		response.Tenant = registered.Tenant
+		response.Paths = append(response.Paths, registered.Paths...)
+	}
+	if connected {
+		response.Tenant = client.tenant
+		response.Paths = client.paths()
+		response.Port = localPort(client.conn)
+		response.TCPPort = client.tcpPort
+		response.Status = "online"
+		if parked, opens := s.clientManager.Parked(clientID); parked {
+			response.Status = "parked"
+			if !opens.IsZero() {
+				response.NextWindow = &opens
+			}
+		} else if paused, _ := s.clientManager.Paused(clientID); paused {
+			response.Status = "paused"
+		} else if !client.healthy {
+			response.Status = "unhealthy"
+		}
+		lastActive, connectedAt := client.lastActive, client.connectedAt
+		response.LastActive, response.ConnectedAt = &lastActive, &connectedAt
+		response.RTTMs = float64(client.rtt.Average()) / float64(time.Millisecond)
+		stats := client.traffic.Snapshot()
+		response.Traffic = &stats
+	}
+	if !all && tenant != response.Tenant {
+		http.Error(w, fmt.Sprintf("Client not found: %s", clientID), http.StatusNotFound)
+		return
+	}
+	if expiry := s.clientManager.Expiry(clientID); !expiry.IsZero() {
+		response.ExpiresAt = &expiry
+	}
+	if known {
+		response.HistorySnapshot = history.Snapshot()
+	} else {
+		response.HistorySnapshot = registry.HistorySnapshot{Heartbeats: []registry.Heartbeat{}, Connections: []registry.Connection{}, Errors: []registry.Error{}, ConfigPushes: []registry.ConfigPush{}, Commands: []registry.CommandRun{}}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// LogLevel reports (GET) or changes (PUT, body {"level": "debug"}) the server's log level
+func LogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var request struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+		level, err := logging.ParseLevel(request.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.SetLevel(level)
+		log.Printf("Log level set to %s", level)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": logging.GetLevel().String()})
+}
+
+// VersionHandler reports the server's build and the tunnel protocol versions
+// it speaks
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version.Get())
+}
+
+// KickClient disconnects a client's tunnel. The client may reconnect, after
+// signing a new registration when SSH identity is enabled.
+func (s *Server) KickClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" {
+		http.Error(w, "client_id is required", http.StatusBadRequest)
+		return
+	}
+	if !s.tcpmanager.RemoveClient(clientID) {
+		http.Error(w, fmt.Sprintf("Client not connected: %s", clientID), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Kicked client %s", clientID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ProxyHandler forwards public requests over the tunnel of the client
+// registered for the request path
+func (s *Server) ProxyHandler(w http.ResponseWriter, r *http.Request) {
+	if clientID, ok := s.reservations.ClientForHost(r.Host); ok {
+		logging.Debugf("Proxy: Host %s is reserved for client %s", r.Host, clientID)
+		s.proxyToReserved(w, r, clientID)
+		return
+	}
+
+	tenant, ok := s.tenants.FromHost(r.Host)
+	if !ok {
+		logging.Debugf("Proxy: No tenant for host %s", r.Host)
+		if s.defaultBackend != nil {
+			s.defaultBackend.ServeHTTP(w, r)
+			return
+		}
+		s.errorPages.Write(w, r, http.StatusNotFound, "No tunnel is configured for this host.")
+		return
+	}
+	s.countTenantRequest(tenant)
+	logging.Debugf("Proxy: Routing %s %s for host %s in tenant %q", r.Method, r.URL.Path, r.Host, tenant)
+
+	client, err := s.tcpmanager.selectClientForRouting(tenant, r)
+	if err != nil {
+		log.Printf("Proxy: %v", err)
+		if errors.Is(err, errTunnelPaused) {
+			s.writeMaintenance(w, r, client.clientID)
+			return
+		}
+		if errors.Is(err, errNoHealthyClient) {
+			s.errorPages.Write(w, r, http.StatusServiceUnavailable, "The tunnel for this path is down.")
+			return
+		}
+		if s.defaultBackend != nil {
+			s.defaultBackend.ServeHTTP(w, r)
+			return
+		}
+		s.errorPages.Write(w, r, http.StatusNotFound, "No tunnel is registered for this path.")
+		return
+	}
+
+	s.proxyToClient(w, r, client)
+}
+
+// proxyToReserved forwards a request for a reserved endpoint to the client it
+// is reserved for, whatever path the client registered
+func (s *Server) proxyToReserved(w http.ResponseWriter, r *http.Request, clientID string) {
+	if paused, _ := s.clientManager.Paused(clientID); paused {
+		s.writeMaintenance(w, r, clientID)
+		return
+	}
+	client, ok := s.tcpmanager.GetClient(clientID)
+	if !ok || !client.healthy {
+		log.Printf("Proxy: Reserved client %s is not available", clientID)
+		s.errorPages.Write(w, r, http.StatusServiceUnavailable, "The tunnel for this host is down.")
+		return
+	}
+	s.countTenantRequest(client.tenant)
+	s.proxyToClient(w, r, client)
+}
+
+// proxyToClient forwards a request over the client's tunnel, through its
+// profile's middleware if any, and writes its response
+func (s *Server) proxyToClient(w http.ResponseWriter, r *http.Request, client clientInfo) {
+	if !s.serveProfiled(w, r, client) {
+		s.forwardToClient(w, r, client)
+	}
+}
+
+// forwardToClient forwards a request over the client's tunnel and writes its response
+func (s *Server) forwardToClient(w http.ResponseWriter, r *http.Request, client clientInfo) {
+	priority, _ := s.classPriority(client.class)
+	admitted, ok := s.admissionController.Acquire(r.Context(), priority)
+	if !ok {
+		log.Printf("Proxy: Server at capacity, shedding request for %s", r.URL.Path)
+		w.Header().Set("Retry-After", "1")
+		s.errorPages.Write(w, r, http.StatusServiceUnavailable, "The server is at capacity. Please retry shortly.")
+		return
+	}
+	defer admitted()
+
+	release, err := s.tcpmanager.acquireSlot(r.Context(), client)
+	if err != nil {
+		log.Printf("Proxy: %v", err)
+		w.Header().Set("Retry-After", "1")
+		s.errorPages.Write(w, r, s.tcpmanager.clientBusyStatus(), "The tunnel is busy. Please retry shortly.")
+		return
+	}
+	defer release()
+
+	recordConnectionClient(r.Context(), client.clientID)
+	client.traffic.AddRequest()
+	// Large and unsized bodies are streamed, and so aren't mirrored
+	upload := streamsUpload(client, r.ContentLength)
+	var tcpReq *types.Request
+	if upload {
+		tcpReq = protocol.HTTPToTCPRequestHead(r, client.clientID)
+		if r.ContentLength >= 0 {
+			tcpReq.Headers.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		}
+	} else if tcpReq, err = protocol.HTTPToTCPRequest(r, client.clientID); err != nil {
+		log.Printf("Proxy: %v", err)
+		s.errorPages.Write(w, r, http.StatusBadRequest, "The request could not be read.")
+		return
+	}
+	s.setForwardedHeaders(tcpReq.Headers, r)
+	// An upload's timeout only starts once its body is through, see
+	// ForwardUpload
+	if timeout := s.frontendLimits.requestTimeout; timeout > 0 && !upload {
+		tcpReq.Deadline = time.Now().Add(timeout).UnixMilli()
+	}
+	if !client.shadow && !upload {
+		s.mirrorRequest(client.tenant, r, tcpReq)
+	}
+
+	var tcpResp *types.Response
+	if upload {
+		tcpResp, err = s.tcpmanager.ForwardUpload(r.Context(), client, tcpReq, r.Body, s.frontendLimits.requestTimeout)
+	} else {
+		tcpResp, err = s.tcpmanager.ForwardRequest(r.Context(), client, tcpReq)
+	}
+	if err != nil && r.Context().Err() != nil {
+		// The client was told to cancel, and nobody reads a response
+		logging.Debugf("Proxy: Caller of %s went away, cancelled request on client %s", r.URL.Path, client.clientID)
+		return
+	}
+	if err != nil {
+		log.Printf("Proxy: %v", err)
+		if errors.Is(err, errUploadFailed) {
+			s.errorPages.Write(w, r, http.StatusBadRequest, "The request could not be read.")
+			return
+		}
+		if errors.Is(err, errRequestTimeout) {
+			s.errorPages.Write(w, r, http.StatusGatewayTimeout, "The tunnel did not respond in time.")
+			return
+		}
+		s.errorPages.Write(w, r, http.StatusBadGateway, "The request could not be delivered over the tunnel.")
+		return
+	}
+
+	if tcpResp.Stream {
+		s.streamToClient(w, r, client, tcpResp)
+		return
+	}
+	if err := protocol.TCPToHTTPResponse(tcpResp, w); err != nil {
+		log.Printf("Proxy: Failed to write response for %s: %v", r.URL.Path, err)
+	}
+}
+
+// streamToClient writes a streamed response, flushing each chunk as it
+// arrives so Server-Sent Events and similar responses reach the caller live
+func (s *Server) streamToClient(w http.ResponseWriter, r *http.Request, client clientInfo, tcpResp *types.Response) {
+	flusher := http.NewResponseController(w)
+	protocol.TCPToHTTPResponseHead(tcpResp, w)
+	flusher.Flush()
+
+	err := s.tcpmanager.StreamBody(r.Context(), client, tcpResp.RequestID, func(chunk []byte) error {
+		if _, err := w.Write(chunk); err != nil {
+			return fmt.Errorf("failed to write response body: %v", err)
+		}
+		if err := flusher.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Proxy: Stream for %s ended: %v", r.URL.Path, err)
+	}
+}
+
+// UploadCertificate stores a TLS certificate for a registered client's
+// hostname, or generates a self-signed one when none is supplied. Callers
+// prove they are the client with the session token of its tunnel, or the
+// tunnel ticket of an SSH-signed registration. The first client to store a
+// certificate for a hostname owns it until it deletes the certificate with
+// DELETE ?client_id=&hostname=&session_token=.
+func (s *Server) UploadCertificate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.certStore == nil {
+		http.Error(w, "TLS is not enabled on this server", http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		ClientID     string `json:"client_id"`
+		Hostname     string `json:"hostname"`
+		Cert         string `json:"cert"` // PEM encoded, omit to generate
+		Key          string `json:"key"`
+		SessionToken string `json:"session_token"`
+		Ticket       string `json:"ticket"`
+	}
+
+	if r.Method == http.MethodDelete {
+		query := r.URL.Query()
+		request.ClientID = query.Get("client_id")
+		request.Hostname = query.Get("hostname")
+		request.SessionToken = query.Get("session_token")
+		request.Ticket = query.Get("ticket")
+	} else if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	registered := s.clientManager.GetClient(request.ClientID)
+	if registered == nil {
+		http.Error(w, fmt.Sprintf("Client not registered: %s", request.ClientID), http.StatusForbidden)
+		return
+	}
+	if tenant, ok := s.tenants.FromRequest(r); !ok || tenant != registered.Tenant {
+		http.Error(w, "Unauthorized: API key does not match the client's tenant", http.StatusUnauthorized)
+		return
+	}
+	if err := s.authorizeClientCredentials(request.ClientID, registered.Tenant, request.SessionToken, request.Ticket); err != nil {
+		log.Printf("Refusing certificate change for client %s hostname %s: %v", request.ClientID, request.Hostname, err)
+		http.Error(w, fmt.Sprintf("Unauthorized: %v", err), http.StatusUnauthorized)
+		return
+	}
+	owner := certs.Owner{Tenant: registered.Tenant, ClientID: request.ClientID}
+
+	if r.Method == http.MethodDelete {
+		if err := s.certStore.Remove(request.Hostname, owner); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, certs.ErrOwned) {
+				status = http.StatusConflict
+			}
+			http.Error(w, fmt.Sprintf("Failed to remove certificate: %v", err), status)
+			return
+		}
+		log.Printf("Removed certificate for client %s hostname %s", request.ClientID, request.Hostname)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := s.allowHostname(request.ClientID, request.Hostname); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if s.reservations.Reserved(request.Hostname, request.ClientID) {
+		http.Error(w, fmt.Sprintf("Hostname %s is reserved for another client", request.Hostname), http.StatusConflict)
+		return
+	}
+	if passthrough, ok := s.passthroughClient(request.Hostname); ok && passthrough != request.ClientID {
+		http.Error(w, fmt.Sprintf("Hostname %s is passed through to another client", request.Hostname), http.StatusConflict)
+		return
+	}
+
+	generated := request.Cert == ""
+	var leaf *x509.Certificate
+	var err error
+	if generated {
+		leaf, err = s.certStore.Generate(request.Hostname, owner)
+	} else {
+		leaf, err = s.certStore.Put(request.Hostname, owner, []byte(request.Cert), []byte(request.Key))
+	}
+	if errors.Is(err, certs.ErrOwned) {
+		http.Error(w, fmt.Sprintf("Failed to store certificate: %v", err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to store certificate: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Stored certificate for client %s hostname %s (generated: %v)", request.ClientID, request.Hostname, generated)
+
+	response := struct {
+		Hostname  string    `json:"hostname"`
+		Generated bool      `json:"generated"`
+		NotAfter  time.Time `json:"not_after"`
+	}{
+		Hostname:  request.Hostname,
+		Generated: generated,
+		NotAfter:  leaf.NotAfter,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// authorizeClientCredentials checks that a caller acting for clientID holds
+// the session token of the client's tunnel, or its SSH tunnel ticket
+func (s *Server) authorizeClientCredentials(clientID, tenant, sessionToken, ticket string) error {
+	if ticket != "" && s.sshIdentity.Enabled() {
+		return s.sshIdentity.AuthorizeTunnel(clientID, ticket)
+	}
+	if sessionToken == "" {
+		return fmt.Errorf("the session token of client %s is required", clientID)
+	}
+	sess, err := s.sessions.Lookup(clientID, sessionToken)
+	if err != nil || sess.tenant != tenant {
+		return fmt.Errorf("session token does not match client %s", clientID)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startHTTP3 serves the HTTPS frontend over QUIC on the UDP side of the
+// HTTPS port. Callers learn of it from the Alt-Svc header of the HTTPS
+// frontends and fall back to them while UDP is blocked.
+func (s *Server) startHTTP3(config *Config) error {
+	port := httpsPort(config)
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(s.bindAddresses.https, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("failed to listen on UDP port %d: %v", port, err)
+	}
+	server := &http3.Server{
+		Handler:        s.frontend.Then(s.router),
+		TLSConfig:      s.frontendTLSConfig(),
+		MaxHeaderBytes: s.frontendLimits.maxHeaderBytes,
+		IdleTimeout:    s.frontendLimits.idleTimeout,
+	}
+	s.mu.Lock()
+	s.servers = append(s.servers, server)
+	s.http3 = server
+	s.mu.Unlock()
+
+	log.Printf("HTTP/3 Server starting on UDP port %d...", port)
+	go func() {
+		if err := server.Serve(conn); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP/3 server failed: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/vikasavn/attachcloudip/pkg/certs"
+)
+
+// startTLS serves the public frontend over TLS, picking each tunnel's
+// certificate by SNI hostname, or passing the connection through to the raw
+// TCP tunnel of the hostname
+func (s *Server) startTLS(config *Config) error {
+	tlsConfig := config.Server.TLS
+	certDir := tlsConfig.CertDir
+	if certDir == "" {
+		certDir = "certs"
+	}
+
+	store, err := certs.NewStore(certDir)
+	if err != nil {
+		return err
+	}
+	if tlsConfig.Cert != "" {
+		if err := store.SetDefaultPEM([]byte(tlsConfig.Cert), []byte(tlsConfig.Key)); err != nil {
+			return err
+		}
+	} else if tlsConfig.CertFile != "" {
+		if err := store.SetDefault(tlsConfig.CertFile, tlsConfig.KeyFile); err != nil {
+			return err
+		}
+	}
+	s.certStore = store
+
+	port := httpsPort(config)
+	listener, err := s.listenPublic(s.bindAddresses.https, port, s.listenSettings.public)
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %v", port, err)
+	}
+	tlsListener := tls.NewListener(s.tcpmanager.TrackConnections(s.withPassthrough(config, s.admissionController.Listener(listener))), s.frontendTLSConfig())
+
+	if tlsConfig.HTTP3 {
+		if err := s.startHTTP3(config); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	log.Printf("HTTPS Server starting on port %d...", port)
+	s.readiness.SetReady("https")
+	server := s.serve(s.httpsHandler(config))
+	go func() {
+		if err := server.Serve(tlsListener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTPS server failed: %v", err)
+			s.readiness.SetNotReady("https", err.Error())
+		}
+	}()
+	return nil
+}
+
+// frontendTLSConfig serves each tunnel's certificate by SNI hostname with
+// the configured TLS settings, offering HTTP/2 over ALPN
+func (s *Server) frontendTLSConfig() *tls.Config {
+	return s.hardenTLS(&tls.Config{
+		GetCertificate: s.certStore.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		ClientAuth:     s.tlsSettings.clientAuth,
+		ClientCAs:      s.clientCAs,
+	})
+}
+
+// httpsHandler serves the HTTPS frontend through the middleware chain,
+// advertising HTTP/3 while it is served
+func (s *Server) httpsHandler(config *Config) http.Handler {
+	handler := s.frontend.Then(s.router)
+	if s.http3 == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.http3.SetQUICHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// httpHandler serves the plain HTTP frontend, or redirects it to HTTPS
+func (s *Server) httpHandler(config *Config) http.Handler {
+	if config.Server.TLS.Enabled && config.Server.TLS.RedirectHTTP {
+		return s.withAccessLog(redirectToHTTPS(httpsPort(config)))
+	}
+	return s.frontend.Then(s.router)
+}
+
+// httpsPort returns the public HTTPS port, defaulting to 9443
+func httpsPort(config *Config) int {
+	if config.Server.Ports.HTTPS != 0 {
+		return config.Server.Ports.HTTPS
+	}
+	return 9443
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+)
+
+// loadClientCAs reads the PEM encoded operator CA bundle
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA file: %s", path)
+	}
+	return pool, nil
+}
+
+// certFingerprint returns the hex encoded SHA-256 fingerprint of a certificate
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifiedIdentity extracts the client ID and certificate fingerprint from a
+// verified client certificate
+func verifiedIdentity(state *tls.ConnectionState) (string, string, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", "", fmt.Errorf("no verified client certificate")
+	}
+
+	leaf := state.VerifiedChains[0][0]
+	if leaf.Subject.CommonName == "" {
+		return "", "", fmt.Errorf("client certificate has no common name")
+	}
+	return leaf.Subject.CommonName, certFingerprint(leaf), nil
+}
+
+// authorizeClient checks that the verified certificate belongs to clientID
+// and pins its fingerprint so only the same certificate can reclaim the ID
+func (s *Server) authorizeClient(state *tls.ConnectionState, clientID string) error {
+	if s.clientCAs == nil {
+		return nil
+	}
+
+	id, fingerprint, err := verifiedIdentity(state)
+	if err != nil {
+		return err
+	}
+	if id != clientID {
+		return fmt.Errorf("certificate identity %s does not match client ID %s", id, clientID)
+	}
+	return s.clientManager.PinFingerprint(clientID, fingerprint)
+}
+
+// authorizeTunnel performs the TLS handshake on a tunnel connection and
+// authorizes the client ID it registers with
+func (s *Server) authorizeTunnel(c net.Conn, clientID string) error {
+	if s.clientCAs == nil {
+		return nil
+	}
+
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return fmt.Errorf("tunnel connection is not using TLS")
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	state := tlsConn.ConnectionState()
+	return s.authorizeClient(&state, clientID)
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/proxyproto"
+	"github.com/vikasavn/attachcloudip/pkg/sockopt"
+	"github.com/vikasavn/attachcloudip/pkg/systemd"
+)
+
+// inherited holds sockets passed by systemd socket activation, by port,
+// until a listener for that port takes them
+var inherited = struct {
+	listeners map[int]net.Listener
+	mu        sync.Mutex
+}{listeners: make(map[int]net.Listener)}
+
+// bindSettings holds the address each kind of listener binds to, empty for
+// all interfaces
+type bindSettings struct {
+	http, https, registration, shared, reserved, tcpTunnels string
+}
+
+// listenOptions is how a kind of listener is opened
+type listenOptions struct {
+	sockets sockopt.Options
+	// acceptors is the number of SO_REUSEPORT listeners sharing the port,
+	// each with its own accept loop, 1 for a plain listener
+	acceptors int
+}
+
+// listenerSettings holds how public and tunnel listeners are opened
+type listenerSettings struct {
+	public, tunnel listenOptions
+}
+
+// configureSockets reads the TCP socket settings
+func (s *Server) configureSockets(config *Config) error {
+	sockets := []struct {
+		name   string
+		config SocketConfig
+		target *sockopt.Options
+	}{
+		{"public", config.Server.TCP.Public, &s.listenSettings.public.sockets},
+		{"tunnel", config.Server.TCP.Tunnel, &s.listenSettings.tunnel.sockets},
+	}
+	for _, socket := range sockets {
+		if socket.config.ReadBuffer < 0 || socket.config.WriteBuffer < 0 {
+			return fmt.Errorf("%s buffer sizes must not be negative", socket.name)
+		}
+		*socket.target = sockopt.Options{
+			NoDelay:         socket.config.NoDelay,
+			KeepAlive:       time.Duration(socket.config.KeepAliveSeconds) * time.Second,
+			ReadBufferSize:  socket.config.ReadBuffer,
+			WriteBufferSize: socket.config.WriteBuffer,
+			Linger:          socket.config.Linger,
+		}
+		if !socket.target.IsZero() {
+			log.Printf("Tuning %s TCP sockets", socket.name)
+		}
+	}
+
+	if n := config.Server.TCP.ReusePort; n < 0 {
+		return fmt.Errorf("reuse_port must not be negative")
+	} else if n > 1 {
+		s.listenSettings.public.acceptors = n
+		log.Printf("Opening %d SO_REUSEPORT listeners per public port", n)
+	}
+	return nil
+}
+
+// configureBind resolves the configured bind addresses. Each is an IP address
+// or the name of a network interface, and falls back to server.bind.address.
+func (s *Server) configureBind(config *Config) error {
+	bind := config.Server.Bind
+	listeners := []struct {
+		name   string
+		value  string
+		target *string
+	}{
+		{"http", bind.HTTP, &s.bindAddresses.http},
+		{"https", bind.HTTPS, &s.bindAddresses.https},
+		{"registration", bind.Registration, &s.bindAddresses.registration},
+		{"shared", bind.Shared, &s.bindAddresses.shared},
+		{"reserved", bind.Reserved, &s.bindAddresses.reserved},
+		{"tcp_tunnels", bind.TCPTunnels, &s.bindAddresses.tcpTunnels},
+	}
+	if bind.Address != "" {
+		log.Printf("Binding listeners to %s", bind.Address)
+	}
+	for _, l := range listeners {
+		value := l.value
+		if value == "" {
+			value = bind.Address
+		}
+		if value == "" {
+			continue
+		}
+		address, err := resolveBindAddress(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s bind address: %v", l.name, err)
+		}
+		*l.target = address
+		if l.value != "" {
+			log.Printf("Binding %s listeners to %s", l.name, address)
+		}
+	}
+	return nil
+}
+
+// resolveBindAddress returns value if it is an IP address, or else the first
+// address of the interface it names, preferring IPv4
+func resolveBindAddress(value string) (string, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		return value, nil
+	}
+	iface, err := net.InterfaceByName(value)
+	if err != nil {
+		return "", fmt.Errorf("%q is neither an IP address nor an interface", value)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to read addresses of interface %s: %v", value, err)
+	}
+	var fallback string
+	for _, addr := range addrs {
+		network, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if network.IP.To4() != nil {
+			return network.IP.String(), nil
+		}
+		if fallback == "" && !network.IP.IsLinkLocalUnicast() {
+			fallback = network.IP.String()
+		}
+	}
+	if fallback == "" {
+		return "", fmt.Errorf("interface %s has no usable address", value)
+	}
+	return fallback, nil
+}
+
+// inheritListeners takes the sockets systemd opened for the server. Each
+// replaces the listener for its port, whatever the bind address.
+func inheritListeners() error {
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	for _, l := range listeners {
+		addr, ok := l.Addr().(*net.TCPAddr)
+		if !ok {
+			log.Printf("Ignoring inherited non-TCP socket %s", l.Addr())
+			l.Close()
+			continue
+		}
+		inherited.listeners[addr.Port] = l
+		log.Printf("Inherited listener on %s from systemd", addr)
+	}
+	return nil
+}
+
+// listenPublic listens on a public port as opts say, reading PROXY headers
+// when enabled so connections report the address of the original client.
+// Temporary accept failures are retried, and the listener is opened again
+// after fatal ones, except for listeners passed with WithListener or
+// inherited from systemd, which are used alone.
+func (s *Server) listenPublic(host string, port int, opts listenOptions) (net.Listener, error) {
+	s.mu.Lock()
+	listener, ok := s.provided[port]
+	delete(s.provided, port)
+	s.mu.Unlock()
+	if !ok {
+		inherited.mu.Lock()
+		listener, ok = inherited.listeners[port]
+		delete(inherited.listeners, port)
+		inherited.mu.Unlock()
+	}
+
+	if ok {
+		// The socket was handed over, so it can't be opened again
+		listener = s.newResilientListener(port, listener, nil)
+	} else {
+		address := net.JoinHostPort(host, strconv.Itoa(port))
+		listen := func() (net.Listener, error) {
+			if opts.acceptors > 1 {
+				return sockopt.ListenReusePort("tcp", address, opts.acceptors)
+			}
+			return net.Listen("tcp", address)
+		}
+		first, err := listen()
+		if err != nil {
+			return nil, err
+		}
+		listener = s.newResilientListener(port, first, listen)
+	}
+	listener = opts.sockets.Listener(listener)
+	if s.proxyProtocol.enabled {
+		listener = proxyproto.NewListener(listener, s.proxyProtocol.trusted)
+	}
+	return listener, nil
+}
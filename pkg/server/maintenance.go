@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultMaintenanceMessage is shown for paused tunnels when neither the pause
+// request nor the config sets a message
+const defaultMaintenanceMessage = "This service is down for maintenance. Please try again later."
+
+// configureMaintenance sets the default maintenance response from the server config
+func (s *Server) configureMaintenance(config *Config) {
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+
+	if mc := config.Server.Maintenance; mc.Message != "" {
+		s.maintenanceMessage = mc.Message
+	}
+	s.maintenanceRetryAfter = config.Server.Maintenance.RetryAfter
+}
+
+// writeMaintenance answers a request for a paused tunnel, or one outside
+// its schedule, which is retried once its window opens
+func (s *Server) writeMaintenance(w http.ResponseWriter, r *http.Request, clientID string) {
+	_, message := s.clientManager.Paused(clientID)
+
+	s.maintenanceMu.RLock()
+	if message == "" {
+		message = s.maintenanceMessage
+	}
+	retryAfter := s.maintenanceRetryAfter
+	s.maintenanceMu.RUnlock()
+	if parked, opens := s.clientManager.Parked(clientID); parked && !opens.IsZero() {
+		retryAfter = int(time.Until(opens).Seconds()) + 1
+	}
+
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	s.errorPages.Write(w, r, http.StatusServiceUnavailable, message)
+}
+
+// authorizeTunnelControl checks that the caller may pause or resume the
+// client: an operator, the client's own tenant, or anyone on an open server
+func (s *Server) authorizeTunnelControl(w http.ResponseWriter, r *http.Request, client *Client) bool {
+	if s.accessControl.Enabled() && s.accessControl.roleForRequest(r) >= RoleOperator {
+		return true
+	}
+	if s.tenants.Enabled() {
+		if tenant, ok := s.tenants.FromRequest(r); ok && tenant == client.Tenant {
+			return true
+		}
+	} else if !s.accessControl.Enabled() {
+		return true
+	}
+
+	http.Error(w, "Unauthorized: requires the client's API key or the operator role", http.StatusUnauthorized)
+	return false
+}
+
+// PauseClient puts a tunnel into maintenance (POST ?client_id=, optional body
+// {"message": "..."}). The registration and its reservations are kept.
+func (s *Server) PauseClient(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, true)
+}
+
+// ResumeClient takes a tunnel out of maintenance (POST ?client_id=)
+func (s *Server) ResumeClient(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, false)
+}
+
+func (s *Server) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.URL.Query().Get("client_id")
+	client := s.clientManager.GetClient(clientID)
+	if client == nil {
+		http.Error(w, fmt.Sprintf("Client not registered: %s", clientID), http.StatusNotFound)
+		return
+	}
+	if !s.authorizeTunnelControl(w, r, client) {
+		return
+	}
+
+	var request struct {
+		Message string `json:"message"`
+	}
+	if paused && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.clientManager.SetPaused(clientID, paused, request.Message)
+	status := "resumed"
+	if paused {
+		status = "paused"
+		log.Printf("Paused tunnel of client %s", clientID)
+	} else {
+		log.Printf("Resumed tunnel of client %s", clientID)
+	}
+	var path string
+	if len(client.Paths) > 0 {
+		path = client.Paths[0]
+	}
+	s.publishStatus(clientID, client.Tenant, path, status)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/vikasavn/attachcloudip/pkg/chaos"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// clientMetricHelp describes the metrics clients report with heartbeats
+var clientMetricHelp = map[string]string{
+	types.MetricGoroutines:              "Goroutines running in the client.",
+	types.MetricHeapBytes:               "Heap memory allocated by the client.",
+	types.MetricUpstreamResponseSeconds: "Mean response time of the client's local service since its previous heartbeat.",
+	types.MetricOpenStreams:             "Tunneled requests the client is handling.",
+}
+
+// countTenantRequest records a public request routed within a tenant
+func (s *Server) countTenantRequest(tenant string) {
+	s.tenantRequestsMu.Lock()
+	s.tenantRequests[tenant]++
+	s.tenantRequestsMu.Unlock()
+}
+
+// MetricsHandler exposes server metrics in the Prometheus text format
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := s.admissionController.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP attachcloudip_open_connections Open public HTTP connections.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_open_connections gauge\n")
+	fmt.Fprintf(w, "attachcloudip_open_connections %d\n", stats.Connections)
+	fmt.Fprintf(w, "# HELP attachcloudip_max_connections Limit on open public HTTP connections (0 is unlimited).\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_max_connections gauge\n")
+	fmt.Fprintf(w, "attachcloudip_max_connections %d\n", stats.MaxConnections)
+	fmt.Fprintf(w, "# HELP attachcloudip_in_flight_requests Proxied requests currently in flight.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_in_flight_requests gauge\n")
+	fmt.Fprintf(w, "attachcloudip_in_flight_requests %d\n", stats.InFlight)
+	fmt.Fprintf(w, "# HELP attachcloudip_max_in_flight_requests Limit on proxied requests in flight (0 is unlimited).\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_max_in_flight_requests gauge\n")
+	fmt.Fprintf(w, "attachcloudip_max_in_flight_requests %d\n", stats.MaxInFlight)
+	fmt.Fprintf(w, "# HELP attachcloudip_rejected_connections_total Connections shed by admission control.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_rejected_connections_total counter\n")
+	fmt.Fprintf(w, "attachcloudip_rejected_connections_total %d\n", stats.RejectedConnections)
+	fmt.Fprintf(w, "# HELP attachcloudip_rejected_requests_total Requests shed by admission control.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_rejected_requests_total counter\n")
+	fmt.Fprintf(w, "attachcloudip_rejected_requests_total %d\n", stats.RejectedRequests)
+	if len(stats.Classes) > 0 {
+		fmt.Fprintf(w, "# HELP attachcloudip_qos_queued_requests Requests waiting for an in-flight slot per priority class.\n")
+		fmt.Fprintf(w, "# TYPE attachcloudip_qos_queued_requests gauge\n")
+		for _, class := range stats.Classes {
+			fmt.Fprintf(w, "attachcloudip_qos_queued_requests{class=%q} %d\n", class.Name, class.Queued)
+		}
+		fmt.Fprintf(w, "# HELP attachcloudip_qos_queued_requests_total Requests that waited for an in-flight slot per priority class.\n")
+		fmt.Fprintf(w, "# TYPE attachcloudip_qos_queued_requests_total counter\n")
+		for _, class := range stats.Classes {
+			fmt.Fprintf(w, "attachcloudip_qos_queued_requests_total{class=%q} %d\n", class.Name, class.QueuedTotal)
+		}
+		fmt.Fprintf(w, "# HELP attachcloudip_qos_dropped_requests_total Requests shed at capacity per priority class.\n")
+		fmt.Fprintf(w, "# TYPE attachcloudip_qos_dropped_requests_total counter\n")
+		for _, class := range stats.Classes {
+			fmt.Fprintf(w, "attachcloudip_qos_dropped_requests_total{class=%q} %d\n", class.Name, class.Dropped)
+		}
+	}
+
+	s.writeAcceptMetrics(w)
+	fmt.Fprintf(w, "# HELP attachcloudip_rejected_ip_connections_total Public connections closed for exceeding http.max_connections_per_ip.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_rejected_ip_connections_total counter\n")
+	fmt.Fprintf(w, "attachcloudip_rejected_ip_connections_total %d\n", s.tcpmanager.rejectedPerIP.Load())
+	fmt.Fprintf(w, "# HELP attachcloudip_tunnel_handshakes Tunnel connections that haven't sent their registration yet.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_tunnel_handshakes gauge\n")
+	fmt.Fprintf(w, "attachcloudip_tunnel_handshakes %d\n", s.tcpmanager.handshakes.Load())
+	fmt.Fprintf(w, "# HELP attachcloudip_tunnel_connections_dropped_total New tunnel connections dropped by a connection limit.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_tunnel_connections_dropped_total counter\n")
+	fmt.Fprintf(w, "attachcloudip_tunnel_connections_dropped_total{reason=\"rate\"} %d\n", s.tcpmanager.droppedRate.Load())
+	fmt.Fprintf(w, "attachcloudip_tunnel_connections_dropped_total{reason=\"handshakes\"} %d\n", s.tcpmanager.droppedHandshakes.Load())
+	if s.faults.injector != nil {
+		injected := s.faults.injector.Injected()
+		fmt.Fprintf(w, "# HELP attachcloudip_chaos_faults_total Tunnel faults injected by server.chaos.\n")
+		fmt.Fprintf(w, "# TYPE attachcloudip_chaos_faults_total counter\n")
+		for _, fault := range chaos.Faults {
+			fmt.Fprintf(w, "attachcloudip_chaos_faults_total{fault=%q} %d\n", fault, injected[fault])
+		}
+	}
+
+	clients := s.tcpmanager.GetClients()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].clientID < clients[j].clientID })
+	clientsByTenant := make(map[string]int)
+	for _, client := range clients {
+		clientsByTenant[client.tenant]++
+	}
+	fmt.Fprintf(w, "# HELP attachcloudip_clients Connected clients per tenant.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_clients gauge\n")
+	for _, tenant := range sortedKeys(clientsByTenant) {
+		fmt.Fprintf(w, "attachcloudip_clients{tenant=%q} %d\n", tenant, clientsByTenant[tenant])
+	}
+
+	s.tenantRequestsMu.Lock()
+	requests := make(map[string]int64, len(s.tenantRequests))
+	for tenant, n := range s.tenantRequests {
+		requests[tenant] = n
+	}
+	s.tenantRequestsMu.Unlock()
+	fmt.Fprintf(w, "# HELP attachcloudip_requests_total Public requests routed per tenant.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_requests_total counter\n")
+	for _, tenant := range sortedKeys(requests) {
+		fmt.Fprintf(w, "attachcloudip_requests_total{tenant=%q} %d\n", tenant, requests[tenant])
+	}
+
+	// Only counted when the metrics middleware is in the chain
+	s.frontendResponsesMu.Lock()
+	responses := make(map[string]int64, len(s.frontendResponses))
+	for class, n := range s.frontendResponses {
+		responses[class] = n
+	}
+	s.frontendResponsesMu.Unlock()
+	if len(responses) > 0 {
+		fmt.Fprintf(w, "# HELP attachcloudip_http_responses_total Public responses per status class.\n")
+		fmt.Fprintf(w, "# TYPE attachcloudip_http_responses_total counter\n")
+		for _, class := range sortedKeys(responses) {
+			fmt.Fprintf(w, "attachcloudip_http_responses_total{code=%q} %d\n", class, responses[class])
+		}
+	}
+
+	// In-flight limits, for clients that have one
+	fmt.Fprintf(w, "# HELP attachcloudip_client_in_flight_requests Proxied requests holding one of a client's in-flight slots.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_client_in_flight_requests gauge\n")
+	for _, client := range clients {
+		if client.inFlight != nil {
+			fmt.Fprintf(w, "attachcloudip_client_in_flight_requests{client_id=%q} %d\n", client.clientID, len(client.inFlight))
+		}
+	}
+	fmt.Fprintf(w, "# HELP attachcloudip_client_queued_requests Proxied requests waiting for one of a client's in-flight slots.\n")
+	fmt.Fprintf(w, "# TYPE attachcloudip_client_queued_requests gauge\n")
+	for _, client := range clients {
+		if client.inFlight != nil {
+			fmt.Fprintf(w, "attachcloudip_client_queued_requests{client_id=%q} %d\n", client.clientID, client.queued.Load())
+		}
+	}
+
+	// Metrics clients report with their heartbeats, for those that send them
+	for _, name := range types.ClientMetrics {
+		fmt.Fprintf(w, "# HELP attachcloudip_client_%s %s\n", name, clientMetricHelp[name])
+		fmt.Fprintf(w, "# TYPE attachcloudip_client_%s gauge\n", name)
+		for _, client := range clients {
+			if value, ok := client.metadata[name]; ok {
+				fmt.Fprintf(w, "attachcloudip_client_%s{client_id=%q} %s\n", name, client.clientID, value)
+			}
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseClientMetrics decodes the metrics of a heartbeat, keeping only known
+// metrics with numeric values
+func parseClientMetrics(encoded string) map[string]string {
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		return nil
+	}
+	metrics := make(map[string]string)
+	for _, name := range types.ClientMetrics {
+		value := values.Get(name)
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			metrics[name] = value
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/cache"
+	"github.com/vikasavn/attachcloudip/pkg/middleware"
+	"github.com/vikasavn/attachcloudip/pkg/script"
+)
+
+// defaultMiddleware is the chain used when none is configured
+var defaultMiddleware = []middleware.Entry{
+	{Name: "access_log"},
+	{Name: "security_headers"},
+	{Name: "cors"},
+}
+
+// configureMiddleware registers the built-in middleware and builds the
+// configured chain
+func (s *Server) configureMiddleware(config *Config) error {
+	s.middleware = s.builtinMiddleware(config)
+
+	entries := defaultMiddleware
+	if len(config.Server.Middleware) > 0 {
+		entries = make([]middleware.Entry, len(config.Server.Middleware))
+		for i, mc := range config.Server.Middleware {
+			entries[i] = middleware.Entry{Name: mc.Name, Paths: mc.Paths, Options: mc.Options}
+		}
+	}
+	chain, err := s.middleware.Build(entries)
+	if err != nil {
+		return err
+	}
+	s.frontend = chain
+	log.Printf("HTTP middleware: %s", strings.Join(chain.Names(), ", "))
+	return nil
+}
+
+// builtinMiddleware returns a registry of the server's own middleware, which
+// act on its state
+func (s *Server) builtinMiddleware(config *Config) *middleware.Registry {
+	registry := middleware.NewRegistry()
+	registry.Register("access_log", noOptions(s.withAccessLog))
+	registry.Register("cors", noOptions(s.withCORS))
+	registry.Register("security_headers", noOptions(func(next http.Handler) http.Handler {
+		secured := withSecurityHeaders(securityHeaders(config), next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// HSTS and friends only mean something over HTTPS
+			if r.TLS == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			secured.ServeHTTP(w, r)
+		})
+	}))
+	registry.Register("headers", func(options map[string]string) (middleware.Middleware, error) {
+		headers := make(map[string]string, len(options))
+		for name, value := range options {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+		return func(next http.Handler) http.Handler {
+			return withSecurityHeaders(headers, next)
+		}, nil
+	})
+	registry.Register("auth", func(options map[string]string) (middleware.Middleware, error) {
+		role := RoleViewer
+		if name, ok := options["role"]; ok {
+			var err error
+			if role, err = parseRole(name); err != nil {
+				return nil, err
+			}
+		}
+		return func(next http.Handler) http.Handler {
+			return s.accessControl.requireRole(role, next.ServeHTTP)
+		}, nil
+	})
+	registry.Register("rate_limit", func(options map[string]string) (middleware.Middleware, error) {
+		rate, burst, err := middleware.ParseRate(options)
+		if err != nil {
+			return nil, err
+		}
+		spec := options["key"]
+		if spec == "" {
+			spec = "ip"
+		}
+		key, err := s.requestKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		var limiter middleware.Limiter
+		switch options["store"] {
+		case "", "memory":
+			limiter = middleware.NewLocalLimiter(rate, burst)
+		case "redis":
+			if s.redisClient == nil {
+				return nil, fmt.Errorf("store redis needs server.redis.address")
+			}
+			// Entries with the same settings share a budget unless given an id
+			id := options["id"]
+			if id == "" {
+				id = fmt.Sprintf("%s:%g:%d", spec, rate, burst)
+			}
+			limiter = middleware.NewRedisLimiter(s.redisClient, "attachcloudip:ratelimit:"+id+":", rate, burst, redisErrorLogger("Rate limit"))
+		default:
+			return nil, fmt.Errorf("unknown store %q, expected memory or redis", options["store"])
+		}
+		return middleware.RateLimit(limiter, func(r *http.Request) string {
+			value, _ := key(r)
+			return value
+		}), nil
+	})
+	registry.Register("metrics", noOptions(s.withResponseMetrics))
+	registry.Register("oidc", s.newOIDCMiddleware)
+	registry.Register("cache", func(options map[string]string) (middleware.Middleware, error) {
+		maxSizeMB, err := intOption(options, "max_size_mb", 64)
+		if err != nil {
+			return nil, err
+		}
+		maxEntryKB, err := intOption(options, "max_entry_kb", 1024)
+		if err != nil {
+			return nil, err
+		}
+		defaultTTL, err := intOption(options, "default_ttl", 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var store cache.Store
+		switch options["store"] {
+		case "", "memory":
+			store = cache.NewMemory(int64(maxSizeMB) << 20)
+		case "redis":
+			if s.redisClient == nil {
+				return nil, fmt.Errorf("store redis needs server.redis.address")
+			}
+			store = cache.NewRedis(s.redisClient, "attachcloudip:cache:", redisErrorLogger("Cache"))
+		default:
+			return nil, fmt.Errorf("unknown store %q, expected memory or redis", options["store"])
+		}
+		c := cache.New(store, cache.Options{
+			MaxEntrySize: int64(maxEntryKB) << 10,
+			DefaultTTL:   time.Duration(defaultTTL) * time.Second,
+			// Set by the oidc middleware for signed-in callers
+			BypassHeaders: oidcIdentityHeaders,
+		})
+		return c.Middleware, nil
+	})
+	registry.Register("script", func(options map[string]string) (middleware.Middleware, error) {
+		if options["file"] == "" {
+			return nil, fmt.Errorf("file is required")
+		}
+		var timeout time.Duration
+		if value, ok := options["timeout_ms"]; ok {
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms <= 0 {
+				return nil, fmt.Errorf("timeout_ms must be a positive integer")
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+		hook, err := script.Load(options["file"], timeout)
+		if err != nil {
+			return nil, err
+		}
+		return hook.Middleware(func(err error) {
+			log.Printf("Script: %v", err)
+		}), nil
+	})
+	return registry
+}
+
+// intOption reads a non-negative integer option, or returns def when it is unset
+func intOption(options map[string]string, name string, def int) (int, error) {
+	value, ok := options[name]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// noOptions adapts a middleware that takes no options to a factory
+func noOptions(wrap middleware.Middleware) middleware.Factory {
+	return func(options map[string]string) (middleware.Middleware, error) {
+		if len(options) > 0 {
+			return nil, fmt.Errorf("takes no options")
+		}
+		return wrap, nil
+	}
+}
+
+// withResponseMetrics counts the responses of next by status class
+func (s *Server) withResponseMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		class := fmt.Sprintf("%dxx", rec.status/100)
+		s.frontendResponsesMu.Lock()
+		s.frontendResponses[class]++
+		s.frontendResponsesMu.Unlock()
+	})
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// maxMirrorsInFlight caps copies awaiting shadow clients, so a slow shadow
+// sheds copies instead of piling up
+const maxMirrorsInFlight = 256
+
+// mirrorRequest copies a request about to be proxied to a shadow client of
+// its path, if one is registered, and discards the shadow's response
+func (s *Server) mirrorRequest(tenant string, r *http.Request, req *types.Request) {
+	shadow, ok := s.tcpmanager.selectMirror(tenant, r)
+	if !ok {
+		return
+	}
+	select {
+	case s.mirrorSlots <- struct{}{}:
+	default:
+		logging.Debugf("Proxy: Dropping mirror of %s to client %s: %d copies in flight", r.URL.Path, shadow.clientID, maxMirrorsInFlight)
+		return
+	}
+
+	// The body is only read, so the copy shares it
+	mirrored := *req
+	mirrored.Headers = req.Headers.Clone()
+	mirrored.Headers.Set("X-Mirrored", "true")
+	mirrored.ClientID = shadow.clientID
+
+	go func() {
+		defer func() { <-s.mirrorSlots }()
+		// Mirrors outlive the request they copy
+		ctx := context.Background()
+		release, err := s.tcpmanager.acquireSlot(ctx, shadow)
+		if err != nil {
+			logging.Debugf("Proxy: Dropping mirror of %s: %v", mirrored.Path, err)
+			return
+		}
+		defer release()
+
+		shadow.traffic.AddRequest()
+		resp, err := s.tcpmanager.ForwardRequest(ctx, shadow, &mirrored)
+		if err != nil {
+			log.Printf("Proxy: Mirror of %s to client %s failed: %v", mirrored.Path, shadow.clientID, err)
+			return
+		}
+		if resp.Stream {
+			s.tcpmanager.StreamBody(ctx, shadow, resp.RequestID, func([]byte) error { return nil })
+		}
+		logging.Debugf("Proxy: Mirrored %s %s to client %s, discarding status %d",
+			mirrored.Method, mirrored.Path, shadow.clientID, resp.StatusCode)
+	}()
+}
+
+// selectMirror picks a healthy shadow client of the most specific shadow
+// route matching the request, by weight
+func (m *TCPManager) selectMirror(tenant string, r *http.Request) (clientInfo, bool) {
+	m.RLock()
+	var candidates []clientInfo
+	totalWeight := 0
+	if table, ok := m.mirrors[tenant]; ok {
+		if match, ok := table.LookupRequest(r.URL.Path, r.Method, r.Header, negotiatedALPN(r)); ok {
+			for _, clientID := range match.IDs {
+				client, ok := m.clients[clientID]
+				if !ok || !client.healthy || client.weight <= 0 {
+					continue
+				}
+				candidates = append(candidates, client)
+				totalWeight += client.weight
+			}
+		}
+	}
+	m.RUnlock()
+
+	var healthy []clientInfo
+	for _, client := range candidates {
+		if paused, _ := m.srv.clientManager.Paused(client.clientID); paused {
+			totalWeight -= client.weight
+			continue
+		}
+		healthy = append(healthy, client)
+	}
+	if len(healthy) == 0 {
+		return clientInfo{}, false
+	}
+	n := rand.Intn(totalWeight)
+	for _, client := range healthy {
+		if n < client.weight {
+			return client, true
+		}
+		n -= client.weight
+	}
+	return healthy[len(healthy)-1], true
+}
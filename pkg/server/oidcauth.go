@@ -0,0 +1,294 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/middleware"
+	"github.com/vikasavn/attachcloudip/pkg/oidc"
+)
+
+// Identity headers passed to clients for signed in users. Callers' own values
+// are removed so they can't be spoofed.
+var oidcIdentityHeaders = []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Preferred-Username"}
+
+const (
+	defaultOIDCCallback = "/_oidc/callback"
+	defaultOIDCCookie   = "attachcloudip_session"
+	oidcStateCookie     = "attachcloudip_oidc_state"
+	oidcLoginTimeout    = 10 * time.Minute
+)
+
+// oidcCallbackStore holds the callback handlers of oidc middleware entries, by
+// path, for the router. The callbacks sit outside the protected paths.
+type oidcCallbackStore struct {
+	handlers map[string]http.Handler
+	mu       sync.Mutex
+}
+
+// oidcLogin requires users to sign in with an OpenID Connect provider before
+// their requests are forwarded
+type oidcLogin struct {
+	srv         *Server
+	client      *oidc.Client
+	callback    string
+	redirectURL string // Fixed callback URL, derived from each request if empty
+	cookie      string
+	secret      []byte // Signs session and state cookies
+	ttl         time.Duration
+}
+
+// oidcSession is what a session cookie holds, signed
+type oidcSession struct {
+	Subject  string `json:"sub"`
+	Email    string `json:"email,omitempty"`
+	Username string `json:"username,omitempty"`
+	Expires  int64  `json:"exp"`
+}
+
+// oidcState ties a provider's callback to the login that started it
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Return   string `json:"return"` // URL the user goes back to after signing in
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+// newOIDCMiddleware builds the oidc middleware from its options: issuer,
+// client_id, client_secret, and optionally scopes, callback_path,
+// redirect_url, cookie_name, cookie_secret, and session_ttl
+func (s *Server) newOIDCMiddleware(options map[string]string) (middleware.Middleware, error) {
+	for _, name := range []string{"issuer", "client_id", "client_secret"} {
+		if options[name] == "" {
+			return nil, fmt.Errorf("%s is required", name)
+		}
+	}
+	scopes := strings.Fields(options["scopes"])
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	ttl, err := intOption(options, "session_ttl", 3600)
+	if err != nil {
+		return nil, err
+	}
+
+	login := &oidcLogin{
+		srv:         s,
+		client:      oidc.NewClient(options["issuer"], options["client_id"], options["client_secret"], scopes),
+		callback:    options["callback_path"],
+		redirectURL: options["redirect_url"],
+		cookie:      options["cookie_name"],
+		ttl:         time.Duration(ttl) * time.Second,
+	}
+	if login.callback == "" {
+		login.callback = defaultOIDCCallback
+	}
+	if !strings.HasPrefix(login.callback, "/") {
+		return nil, fmt.Errorf("callback_path must start with /")
+	}
+	if login.cookie == "" {
+		login.cookie = defaultOIDCCookie
+	}
+	if secret := options["cookie_secret"]; secret != "" {
+		login.secret = []byte(secret)
+	} else {
+		// Sessions then end with the process and aren't shared by other servers
+		login.secret = make([]byte, 32)
+		if _, err := rand.Read(login.secret); err != nil {
+			return nil, fmt.Errorf("failed to generate cookie secret: %v", err)
+		}
+		log.Printf("OIDC: No cookie_secret for %s, sessions won't survive a restart", options["issuer"])
+	}
+
+	s.oidcCallbacks.mu.Lock()
+	defer s.oidcCallbacks.mu.Unlock()
+	if _, ok := s.oidcCallbacks.handlers[login.callback]; ok {
+		return nil, fmt.Errorf("callback_path %s is used by another oidc entry", login.callback)
+	}
+	s.oidcCallbacks.handlers[login.callback] = http.HandlerFunc(login.handleCallback)
+	return login.wrap, nil
+}
+
+func (l *oidcLogin) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == l.callback {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, name := range oidcIdentityHeaders {
+			r.Header.Del(name)
+		}
+
+		var session oidcSession
+		if cookie, err := r.Cookie(l.cookie); err == nil && l.decode(cookie.Value, &session) == nil &&
+			time.Now().Unix() < session.Expires {
+			r.Header.Set("X-Forwarded-User", session.Subject)
+			if session.Email != "" {
+				r.Header.Set("X-Forwarded-Email", session.Email)
+			}
+			if session.Username != "" {
+				r.Header.Set("X-Forwarded-Preferred-Username", session.Username)
+			}
+			removeCookie(r, l.cookie)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Only page loads can follow a login redirect
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		l.startLogin(w, r)
+	})
+}
+
+// startLogin sends the user to the provider, remembering where they were going
+func (l *oidcLogin) startLogin(w http.ResponseWriter, r *http.Request) {
+	state := oidcState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Return:   r.URL.RequestURI(),
+		Redirect: l.redirectFor(r),
+		Expires:  time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+	target, err := l.client.AuthCodeURL(r.Context(), state.Redirect, state.State, state.Nonce)
+	if err != nil {
+		log.Printf("OIDC: Failed to start login: %v", err)
+		http.Error(w, "Login unavailable", http.StatusBadGateway)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    l.encode(state),
+		Path:     l.callback,
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	logging.Debugf("OIDC: Redirecting %s to sign in", r.URL.Path)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleCallback redeems the provider's code, sets the session cookie, and
+// sends the user back to the page they asked for
+func (l *oidcLogin) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var state oidcState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || l.decode(cookie.Value, &state) != nil || time.Now().Unix() >= state.Expires {
+		http.Error(w, "Login expired, try again", http.StatusBadRequest)
+		return
+	}
+	if query := r.URL.Query(); query.Get("state") != state.State {
+		http.Error(w, "Login state doesn't match", http.StatusBadRequest)
+		return
+	} else if reason := query.Get("error"); reason != "" {
+		http.Error(w, fmt.Sprintf("Login failed: %s", reason), http.StatusForbidden)
+		return
+	}
+
+	claims, err := l.client.Exchange(r.Context(), r.URL.Query().Get("code"), state.Redirect, state.Nonce)
+	if err != nil {
+		log.Printf("OIDC: Login failed: %v", err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	session := oidcSession{Expires: time.Now().Add(l.ttl).Unix()}
+	session.Subject, _ = claims["sub"].(string)
+	session.Email, _ = claims["email"].(string)
+	session.Username, _ = claims["preferred_username"].(string)
+	if session.Subject == "" {
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: l.callback, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{
+		Name:     l.cookie,
+		Value:    l.encode(session),
+		Path:     "/",
+		MaxAge:   int(l.ttl / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("OIDC: %s signed in", session.Subject)
+	target := state.Return
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		// A path like //host would send the user off site
+		target = "/"
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// redirectFor returns the callback URL the provider sends the user back to
+func (l *oidcLogin) redirectFor(r *http.Request) string {
+	if l.redirectURL != "" {
+		return l.redirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if peer, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && l.srv.peerTrusted(peer) &&
+		r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + l.callback
+}
+
+// encode signs value as a cookie value
+func (l *oidcLogin) encode(value interface{}) string {
+	data, _ := json.Marshal(value)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + l.sign(payload)
+}
+
+// decode checks a cookie value's signature and reads it into value
+func (l *oidcLogin) decode(cookie string, value interface{}) error {
+	payload, signature, ok := strings.Cut(cookie, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(l.sign(payload))) {
+		return errors.New("invalid cookie signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (l *oidcLogin) sign(payload string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// removeCookie drops a cookie from the request so it isn't forwarded
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oidcProvider is a fake OpenID Connect provider whose token endpoint
+// answers every code with idToken
+type oidcProvider struct {
+	*httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+}
+
+func newOIDCProvider(t *testing.T) *oidcProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &oidcProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"jwks_uri":               p.URL + "/keys",
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "key-1", "kty": "RSA", "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes())},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// sign issues a token signed with the provider's key under alg
+func (p *oidcProvider) sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "key-1"})
+	body, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// oidcLoginTest is an oidc middleware in front of a handler that echoes
+// the identity headers and cookies it gets
+type oidcLoginTest struct {
+	provider *oidcProvider
+	handler  http.Handler
+	callback http.Handler
+}
+
+func newOIDCLoginTest(t *testing.T) *oidcLoginTest {
+	t.Helper()
+	provider := newOIDCProvider(t)
+	s := &Server{oidcCallbacks: oidcCallbackStore{handlers: make(map[string]http.Handler)}}
+	mw, err := s.newOIDCMiddleware(map[string]string{
+		"issuer":        provider.URL,
+		"client_id":     "app",
+		"client_secret": "secret",
+		"redirect_url":  "https://app.example/_oidc/callback",
+		"cookie_secret": "cookie-secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Seen-User", r.Header.Get("X-Forwarded-User"))
+		w.Header().Set("Seen-Cookie", r.Header.Get("Cookie"))
+	})
+	return &oidcLoginTest{provider: provider, handler: mw(next), callback: s.oidcCallbacks.handlers[defaultOIDCCallback]}
+}
+
+// login starts a login for /page and returns the state cookie and the
+// state and nonce the provider was sent
+func (l *oidcLoginTest) login(t *testing.T) (*http.Cookie, url.Values) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	l.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/page?q=1", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("unauthenticated request = %d, want %d", w.Code, http.StatusFound)
+	}
+	target, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(target.String(), l.provider.URL+"/authorize") {
+		t.Fatalf("redirected to %s", w.Header().Get("Location"))
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			return c, target.Query()
+		}
+	}
+	t.Fatal("no state cookie set")
+	return nil, nil
+}
+
+// finish calls the callback with the state cookie and state, with the
+// provider answering idToken
+func (l *oidcLoginTest) finish(state *http.Cookie, stateValue, idToken string) *httptest.ResponseRecorder {
+	l.provider.idToken = idToken
+	r := httptest.NewRequest(http.MethodGet, defaultOIDCCallback+"?code=code&state="+url.QueryEscape(stateValue), nil)
+	if state != nil {
+		r.AddCookie(state)
+	}
+	w := httptest.NewRecorder()
+	l.callback.ServeHTTP(w, r)
+	return w
+}
+
+func (l *oidcLoginTest) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   l.provider.URL,
+		"aud":   "app",
+		"sub":   "user-1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	l := newOIDCLoginTest(t)
+	state, query := l.login(t)
+	w := l.finish(state, query.Get("state"), l.provider.sign(t, "RS256", l.claims(query.Get("nonce"))))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/page?q=1" {
+		t.Fatalf("callback = %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == defaultOIDCCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("no session cookie set")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.AddCookie(session)
+	r.AddCookie(&http.Cookie{Name: "app", Value: "kept"})
+	w = httptest.NewRecorder()
+	l.handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Seen-User") != "user-1" {
+		t.Fatalf("signed in request = %d as %q", w.Code, w.Header().Get("Seen-User"))
+	}
+	if cookie := w.Header().Get("Seen-Cookie"); cookie != "app=kept" {
+		t.Fatalf("forwarded cookies = %q, want only the app's", cookie)
+	}
+}
+
+func TestOIDCLoginRefusesTokens(t *testing.T) {
+	l := newOIDCLoginTest(t)
+	other := newOIDCProvider(t)
+	tests := []struct {
+		name  string
+		token func(claims map[string]interface{}) string
+	}{
+		{"other issuer", func(c map[string]interface{}) string {
+			c["iss"] = other.URL
+			return l.provider.sign(t, "RS256", c)
+		}},
+		{"other audience", func(c map[string]interface{}) string {
+			c["aud"] = "other-app"
+			return l.provider.sign(t, "RS256", c)
+		}},
+		{"expired", func(c map[string]interface{}) string {
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+			return l.provider.sign(t, "RS256", c)
+		}},
+		{"other nonce", func(c map[string]interface{}) string {
+			c["nonce"] = "other"
+			return l.provider.sign(t, "RS256", c)
+		}},
+		{"no subject", func(c map[string]interface{}) string {
+			delete(c, "sub")
+			return l.provider.sign(t, "RS256", c)
+		}},
+		{"alg none", func(c map[string]interface{}) string {
+			token := l.provider.sign(t, "none", c)
+			return token[:strings.LastIndex(token, ".")+1]
+		}},
+		{"signed by another key", func(c map[string]interface{}) string { return other.sign(t, "RS256", c) }},
+		{"tampered", func(c map[string]interface{}) string {
+			token := l.provider.sign(t, "RS256", c)
+			c["sub"] = "admin"
+			forged := strings.Split(l.provider.sign(t, "RS256", c), ".")
+			parts := strings.Split(token, ".")
+			return parts[0] + "." + forged[1] + "." + parts[2]
+		}},
+	}
+	for _, tt := range tests {
+		state, query := l.login(t)
+		w := l.finish(state, query.Get("state"), tt.token(l.claims(query.Get("nonce"))))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: callback = %d, want %d", tt.name, w.Code, http.StatusForbidden)
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == defaultOIDCCookie {
+				t.Errorf("%s: session cookie set", tt.name)
+			}
+		}
+	}
+}
+
+func TestOIDCLoginRefusesCallbacks(t *testing.T) {
+	l := newOIDCLoginTest(t)
+	state, query := l.login(t)
+	token := l.provider.sign(t, "RS256", l.claims(query.Get("nonce")))
+
+	if w := l.finish(nil, query.Get("state"), token); w.Code != http.StatusBadRequest {
+		t.Errorf("callback without state cookie = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := l.finish(state, "other-state", token); w.Code != http.StatusBadRequest {
+		t.Errorf("callback for another state = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	forged := *state
+	forged.Value = forged.Value[:strings.LastIndex(forged.Value, ".")] + ".forged"
+	if w := l.finish(&forged, query.Get("state"), token); w.Code != http.StatusBadRequest {
+		t.Errorf("callback with a forged state cookie = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCLoginRefusesSessions(t *testing.T) {
+	l := newOIDCLoginTest(t)
+	login := &oidcLogin{secret: []byte("cookie-secret")}
+	expired := login.encode(oidcSession{Subject: "user-1", Expires: time.Now().Add(-time.Minute).Unix()})
+	forged := (&oidcLogin{secret: []byte("guessed")}).encode(oidcSession{Subject: "admin", Expires: time.Now().Add(time.Hour).Unix()})
+
+	for name, value := range map[string]string{"expired": expired, "forged": forged, "garbage": "garbage"} {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.AddCookie(&http.Cookie{Name: defaultOIDCCookie, Value: value})
+		r.Header.Set("X-Forwarded-User", "admin")
+		w := httptest.NewRecorder()
+		l.handler.ServeHTTP(w, r)
+		if w.Code != http.StatusFound {
+			t.Errorf("%s session = %d, want a login redirect", name, w.Code)
+		}
+	}
+
+	// Callers can't name themselves, and only page loads are sent to sign in
+	r := httptest.NewRequest(http.MethodPost, "/page", nil)
+	r.Header.Set("X-Forwarded-User", "admin")
+	w := httptest.NewRecorder()
+	l.handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Seen-User") != "" {
+		t.Fatalf("unauthenticated POST = %d as %q", w.Code, w.Header().Get("Seen-User"))
+	}
+}
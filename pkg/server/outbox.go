@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/recording"
+	"github.com/vikasavn/attachcloudip/pkg/service"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+const (
+	// outboxSize is how many messages an outbox holds for a client's tunnel
+	outboxSize = 64
+	// outboxWriteTimeout bounds each write from an outbox to a tunnel
+	outboxWriteTimeout = 10 * time.Second
+)
+
+var (
+	errOutboxFull      = errors.New("outbound queue for client is full")
+	errOutboxClosed    = errors.New("tunnel closed before the message was written")
+	errUnsupportedSend = errors.New("message type can't be sent over a tunnel")
+)
+
+// outboundMessage is a message waiting in an outbox, done receiving the
+// result of its write
+type outboundMessage struct {
+	write func(io.Writer) (int, error)
+	done  chan error
+}
+
+// outbox writes the messages sent to a client through the service layer to
+// its tunnel one at a time, each within outboxWriteTimeout. A failed write
+// may leave part of a message on the tunnel, so it closes the connection
+// and the client reconnects.
+type outbox struct {
+	clientID string
+	conn     net.Conn
+	queue    chan outboundMessage
+	stop     chan struct{}
+}
+
+// outboxSet are the outboxes of connected clients, created on their first
+// message
+type outboxSet struct {
+	mu       sync.Mutex
+	byClient map[string]*outbox
+}
+
+// outboxFor returns the outbox of the client's current tunnel connection,
+// replacing one left from an earlier connection
+func (s *Server) outboxFor(client clientInfo) *outbox {
+	s.outboxes.mu.Lock()
+	defer s.outboxes.mu.Unlock()
+	if box, ok := s.outboxes.byClient[client.clientID]; ok {
+		if box.conn == client.conn {
+			return box
+		}
+		close(box.stop)
+	}
+	box := &outbox{
+		clientID: client.clientID,
+		conn:     client.conn,
+		queue:    make(chan outboundMessage, outboxSize),
+		stop:     make(chan struct{}),
+	}
+	s.outboxes.byClient[client.clientID] = box
+	go box.run()
+	return box
+}
+
+// closeOutbox stops the client's outbox, failing the messages still in it
+func (s *Server) closeOutbox(clientID string) {
+	s.outboxes.mu.Lock()
+	defer s.outboxes.mu.Unlock()
+	if box, ok := s.outboxes.byClient[clientID]; ok {
+		close(box.stop)
+		delete(s.outboxes.byClient, clientID)
+	}
+}
+
+func (b *outbox) run() {
+	for {
+		select {
+		case <-b.stop:
+			b.fail(errOutboxClosed)
+			return
+		case msg := <-b.queue:
+			b.conn.SetWriteDeadline(time.Now().Add(outboxWriteTimeout))
+			_, err := msg.write(b.conn)
+			b.conn.SetWriteDeadline(time.Time{})
+			if err != nil {
+				err = fmt.Errorf("failed to write to client %s: %v", b.clientID, err)
+				log.Printf("TCP Manager: %v, closing its tunnel", err)
+				b.conn.Close()
+			}
+			msg.done <- err
+		}
+	}
+}
+
+// fail answers the messages still queued with err
+func (b *outbox) fail(err error) {
+	for {
+		select {
+		case msg := <-b.queue:
+			msg.done <- err
+		default:
+			return
+		}
+	}
+}
+
+// Send delivers a service-layer message over the client's tunnel through
+// its outbox, returning once the message is written. A message whose ctx
+// ends while it is queued is still written.
+func (m *TCPManager) Send(ctx context.Context, clientID string, msg *service.StreamResponse) error {
+	client, ok := m.GetClient(clientID)
+	if !ok {
+		return fmt.Errorf("%w: %s", errNoClient, clientID)
+	}
+	write, err := m.srv.encodeServiceMessage(client, msg)
+	if err != nil {
+		return err
+	}
+
+	box := m.srv.outboxFor(client)
+	done := make(chan error, 1)
+	select {
+	case box.queue <- outboundMessage{write: write, done: done}:
+	default:
+		return fmt.Errorf("%w: %s", errOutboxFull, clientID)
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-box.stop:
+		// The outbox may have stopped after fail drained the queue
+		return fmt.Errorf("%w: %s", errOutboxClosed, clientID)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// encodeServiceMessage returns how to write a service-layer message in the
+// tunnel protocol the client negotiated
+func (s *Server) encodeServiceMessage(client clientInfo, msg *service.StreamResponse) (func(io.Writer) (int, error), error) {
+	switch msg.Type {
+	case service.StreamResponseType_HTTP_REQUEST:
+		if msg.HttpRequest == nil {
+			return nil, fmt.Errorf("request %s has no HTTP request", msg.RequestId)
+		}
+		req := &types.Request{
+			ID:        msg.RequestId,
+			Type:      types.RequestTypeHTTP,
+			Method:    msg.HttpRequest.Method,
+			Path:      msg.HttpRequest.Path,
+			Headers:   make(http.Header, len(msg.HttpRequest.Headers)),
+			Body:      msg.HttpRequest.Body,
+			Timestamp: time.Now().Unix(),
+			ClientID:  client.clientID,
+		}
+		for name, value := range msg.HttpRequest.Headers {
+			req.Headers.Set(name, value)
+		}
+		return func(w io.Writer) (int, error) {
+			n, err := client.transport.WriteRequest(w, req)
+			if err == nil {
+				s.recorderFor(client.clientID).Request(req)
+			}
+			return n, err
+		}, nil
+	case service.StreamResponseType_BROADCAST:
+		data, err := json.Marshal(protocol.Broadcast{ID: msg.RequestId, Message: msg.Message, SentAt: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+		line := "broadcast|" + string(data)
+		return func(w io.Writer) (int, error) {
+			s.recorderFor(client.clientID).Line(recording.DirectionOut, line)
+			return w.Write([]byte(line + "\n"))
+		}, nil
+	case service.StreamResponseType_CANCEL:
+		line := "cancel|" + msg.RequestId
+		return func(w io.Writer) (int, error) {
+			s.recorderFor(client.clientID).Line(recording.DirectionOut, line)
+			return w.Write([]byte(line + "\n"))
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", errUnsupportedSend, msg.Type)
+	}
+}
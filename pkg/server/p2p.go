@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+)
+
+// p2pSessionTTL is how long both ends of a peer-to-peer connection have to
+// meet at the rendezvous port
+const p2pSessionTTL = 30 * time.Second
+
+var errP2PDisabled = errors.New("peer-to-peer connections are not enabled on this server")
+
+// p2pEndpoint is one end of a session as seen by the rendezvous port
+type p2pEndpoint struct {
+	addr        net.Addr
+	fingerprint string // Of the client's certificate, empty for the visitor
+}
+
+// p2pSession pairs a visitor with the client of a raw TCP tunnel
+type p2pSession struct {
+	clientID  string
+	expires   time.Time
+	endpoints map[string]p2pEndpoint // Map role to the end that has met
+}
+
+// p2pSessionStore are the sessions waiting for both ends to meet
+type p2pSessionStore struct {
+	mu   sync.Mutex
+	port int // UDP rendezvous port, 0 while peer-to-peer connections are off
+	byID map[string]*p2pSession
+}
+
+// configureP2P reads the rendezvous port, which needs raw TCP tunnels to
+// relay through when no direct connection can be made
+func (s *Server) configureP2P(config *Config) error {
+	port := config.Server.P2P.Port
+	s.p2pSessions.mu.Lock()
+	defer s.p2pSessions.mu.Unlock()
+	s.p2pSessions.port = 0
+	if port == 0 {
+		return nil
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d is out of range", port)
+	}
+	if config.Server.TCPTunnels.PortMax == 0 {
+		return fmt.Errorf("peer-to-peer connections need tcp_tunnels")
+	}
+	s.p2pSessions.port = port
+	return nil
+}
+
+// startRendezvous answers the ends of peer-to-peer sessions on a UDP port
+// with each other's address
+func (s *Server) startRendezvous(port int) error {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(s.bindAddresses.registration, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("failed to listen on UDP port %d: %v", port, err)
+	}
+	s.track(conn)
+	log.Printf("Peer-to-peer rendezvous on UDP port %d", port)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				// Closed on shutdown
+				return
+			}
+			if reply := s.meet(addr, string(buf[:n])); reply != "" {
+				conn.WriteTo([]byte(reply), addr)
+			}
+		}
+	}()
+	return nil
+}
+
+// meet records the end of a session a rendezvous datagram came from
+// (format: "p2p|<session>|<role>|<fingerprint>") and returns the answer
+func (s *Server) meet(addr net.Addr, message string) string {
+	fields := strings.Split(message, "|")
+	if len(fields) != 4 || fields[0] != "p2p" {
+		return ""
+	}
+	id, role, fingerprint := fields[1], fields[2], fields[3]
+	if role != protocol.P2PVisitor && role != protocol.P2PClient {
+		return "p2p-error|" + id + "|unknown role"
+	}
+
+	s.p2pSessions.mu.Lock()
+	defer s.p2pSessions.mu.Unlock()
+	session, ok := s.p2pSessions.byID[id]
+	if !ok || time.Now().After(session.expires) {
+		return "p2p-error|" + id + "|unknown or expired session"
+	}
+	if role == protocol.P2PVisitor {
+		fingerprint = ""
+	}
+	if _, seen := session.endpoints[role]; !seen {
+		logging.Debugf("TCP Manager: %s of peer-to-peer session %s for client %s is at %s", role, id, session.clientID, addr)
+	}
+	session.endpoints[role] = p2pEndpoint{addr: addr, fingerprint: fingerprint}
+	peerRole := protocol.P2PClient
+	if role == protocol.P2PClient {
+		peerRole = protocol.P2PVisitor
+	}
+	peer, ok := session.endpoints[peerRole]
+	if !ok {
+		return "p2p-wait|" + id
+	}
+	return fmt.Sprintf("p2p-peer|%s|%s|%s", id, peer.addr, peer.fingerprint)
+}
+
+// openP2PSession asks the client of a raw TCP tunnel to meet a visitor at
+// the rendezvous port and returns the session
+func (m *TCPManager) openP2PSession(client clientInfo) (string, error) {
+	m.srv.p2pSessions.mu.Lock()
+	port := m.srv.p2pSessions.port
+	now := time.Now()
+	for id, session := range m.srv.p2pSessions.byID {
+		if now.After(session.expires) {
+			delete(m.srv.p2pSessions.byID, id)
+		}
+	}
+	id := uuid.NewString()
+	if port != 0 {
+		m.srv.p2pSessions.byID[id] = &p2pSession{
+			clientID:  client.clientID,
+			expires:   now.Add(p2pSessionTTL),
+			endpoints: make(map[string]p2pEndpoint, 2),
+		}
+	}
+	m.srv.p2pSessions.mu.Unlock()
+	if port == 0 {
+		return "", errP2PDisabled
+	}
+
+	if _, err := m.srv.sendLine(client.clientID, client.conn, fmt.Sprintf("p2p-open|%s|%d", id, port)); err != nil {
+		m.srv.p2pSessions.mu.Lock()
+		delete(m.srv.p2pSessions.byID, id)
+		m.srv.p2pSessions.mu.Unlock()
+		return "", fmt.Errorf("failed to reach client %s: %v", client.clientID, err)
+	}
+	log.Printf("TCP Manager: Opened peer-to-peer session %s for client %s", id, client.clientID)
+	return id, nil
+}
+
+// p2pResponse tells a visitor where to meet the client, and the public port
+// to relay through if no direct connection can be made
+type p2pResponse struct {
+	Session        string `json:"session"`
+	RendezvousPort int    `json:"rendezvous_port"`
+	TCPPort        int    `json:"tcp_port"`
+}
+
+// P2PHandler opens a peer-to-peer session to a raw TCP tunnel (POST with
+// {"client_id": ...}), for the tenant of the request's API key
+func (s *Server) P2PHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ClientID string `json:"client_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	tenant, ok := s.tenants.FromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized: missing or unknown API key", http.StatusUnauthorized)
+		return
+	}
+	client, ok := s.tcpmanager.GetClient(req.ClientID)
+	if !ok || client.tenant != tenant || client.tcpPort == 0 {
+		http.Error(w, fmt.Sprintf("No raw TCP tunnel connected for client %s", req.ClientID), http.StatusNotFound)
+		return
+	}
+	if client.transport.Version < protocol.P2PVersion {
+		http.Error(w, fmt.Sprintf("Client %s doesn't support peer-to-peer connections", req.ClientID), http.StatusConflict)
+		return
+	}
+	if paused, _ := s.clientManager.Paused(req.ClientID); paused {
+		http.Error(w, fmt.Sprintf("Client %s is paused", req.ClientID), http.StatusServiceUnavailable)
+		return
+	}
+	id, err := s.tcpmanager.openP2PSession(client)
+	if errors.Is(err, errP2PDisabled) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	s.p2pSessions.mu.Lock()
+	port := s.p2pSessions.port
+	s.p2pSessions.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p2pResponse{Session: id, RendezvousPort: port, TCPPort: client.tcpPort})
+}
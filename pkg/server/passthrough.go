@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/sniff"
+)
+
+// passthroughListener passes the TLS connections whose SNI hostname belongs
+// to a raw TCP tunnel through to it undecrypted, and accepts the rest for
+// the server to terminate
+type passthroughListener struct {
+	srv *Server
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// withPassthrough wraps a TLS listener to pass connections through to raw
+// TCP tunnels while they are enabled
+func (s *Server) withPassthrough(config *Config, l net.Listener) net.Listener {
+	if config.Server.TCPTunnels.PortMax == 0 {
+		return l
+	}
+	p := &passthroughListener{srv: s, Listener: l, conns: make(chan net.Conn), done: make(chan struct{})}
+	go p.serve()
+	return p
+}
+
+func (l *passthroughListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			// The resilient listener only fails once closed
+			l.Close()
+			return
+		}
+		go l.dispatch(conn)
+	}
+}
+
+// dispatch reads the connection's ClientHello to tell where it goes. One
+// that isn't TLS is accepted anyway, for the TLS server to report.
+func (l *passthroughListener) dispatch(conn net.Conn) {
+	hello, conn, err := sniff.PeekClientHello(conn)
+	if err == nil {
+		if clientID, ok := l.srv.passthroughClient(hello.ServerName); ok {
+			logging.Debugf("TCP Manager: Passing TLS for %s from %s through to client %s", hello.ServerName, conn.RemoteAddr(), clientID)
+			l.srv.tcpmanager.openStream(clientID, conn)
+			return
+		}
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *passthroughListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// refuseTerminated closes the connections a passthrough listener accepts,
+// where the server can't terminate TLS itself
+func refuseTerminated(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+)
+
+// errPathNotAllowed is returned for paths and hostnames a client's identity
+// may not claim
+var errPathNotAllowed = errors.New("not allowed for this client")
+
+// pathRule limits the paths and hostnames of the client IDs matching its
+// pattern
+type pathRule struct {
+	clientID  string // path.Match pattern
+	paths     []string
+	hostnames []string
+}
+
+// configurePathRules reads identity.path_rules, which need an identity
+// source, as otherwise clients could pick an ID whose rule suits them
+func (s *Server) configurePathRules(config *Config) error {
+	identity := config.Server.Identity
+	if len(identity.PathRules) > 0 && identity.ClientCAFile == "" && len(identity.SSHKeys) == 0 && identity.SSHAuthorizedKeys == "" {
+		return fmt.Errorf("path_rules need client certificate or SSH key identity")
+	}
+	var rules []pathRule
+	for _, rc := range config.Server.Identity.PathRules {
+		if rc.ClientID == "" {
+			return fmt.Errorf("path_rules entries need a client_id")
+		}
+		if _, err := path.Match(rc.ClientID, ""); err != nil {
+			return fmt.Errorf("invalid client_id pattern %q: %v", rc.ClientID, err)
+		}
+		rule := pathRule{clientID: rc.ClientID}
+		for _, p := range rc.Paths {
+			if err := routing.Validate(p); err != nil {
+				return fmt.Errorf("path rule for %s: %v", rc.ClientID, err)
+			}
+			rule.paths = append(rule.paths, p)
+		}
+		for _, host := range rc.Hostnames {
+			rule.hostnames = append(rule.hostnames, strings.ToLower(host))
+		}
+		rules = append(rules, rule)
+	}
+
+	s.pathRules = rules
+	if len(rules) > 0 {
+		log.Printf("Restricting claims by %d path rules", len(rules))
+	}
+	return nil
+}
+
+// ruleFor returns the first rule matching clientID. Once rules are set, a
+// client ID matching none gets the empty rule, which allows nothing.
+func (s *Server) ruleFor(clientID string) (pathRule, bool) {
+	for _, rule := range s.pathRules {
+		if ok, _ := path.Match(rule.clientID, clientID); ok {
+			return rule, true
+		}
+	}
+	return pathRule{clientID: clientID}, len(s.pathRules) > 0
+}
+
+// allowPaths checks that clientID may claim each path. A rule entry allows
+// its own path and, since a route also serves everything below it, the paths
+// under it; a trailing wildcard segment such as "/*" is optional. Patterns are compared as written, so
+// a parameter or wildcard segment is only allowed below an entry, and a
+// regular expression only if it is listed itself.
+func (s *Server) allowPaths(clientID string, paths []string) error {
+	rule, ok := s.ruleFor(clientID)
+	if !ok {
+		return nil
+	}
+	for _, p := range paths {
+		if !ruleAllowsPath(rule, p) {
+			return fmt.Errorf("path %s is %w", p, errPathNotAllowed)
+		}
+	}
+	return nil
+}
+
+func ruleAllowsPath(rule pathRule, p string) bool {
+	for _, allowed := range rule.paths {
+		if routing.IsRegex(allowed) || routing.IsRegex(p) {
+			if allowed == p {
+				return true
+			}
+			continue
+		}
+		prefix := strings.TrimSuffix(allowed, "/")
+		if i := strings.LastIndex(prefix, "/"); strings.HasPrefix(prefix[i+1:], "*") {
+			prefix = prefix[:i]
+		}
+		if prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHostname checks that clientID may serve hostname. Entries are
+// hostnames, "*.example.com" for any name below example.com, or "*" for any
+// hostname.
+func (s *Server) allowHostname(clientID, hostname string) error {
+	rule, ok := s.ruleFor(clientID)
+	if !ok {
+		return nil
+	}
+	hostname = strings.ToLower(hostname)
+	for _, allowed := range rule.hostnames {
+		if allowed == "*" || allowed == hostname || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(hostname, allowed[1:])) {
+			return nil
+		}
+	}
+	return fmt.Errorf("hostname %s is %w", hostname, errPathNotAllowed)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/vikasavn/attachcloudip/pkg/events"
+	"github.com/vikasavn/attachcloudip/pkg/registry"
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+)
+
+// pathUpdate adds and removes paths of a connected client's tunnel, sent by
+// the client as "update-paths|<json>" or to /clients/paths
+type pathUpdate struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// UpdatePaths applies the update to the client's paths and routes at once,
+// changing nothing if a path is invalid, missing, not allowed by the path
+// rules, or claimed by another client of the tenant under the reject policy. Clients whose paths are
+// taken over are evicted. It returns the client's paths after the update.
+func (m *TCPManager) UpdatePaths(clientID string, update pathUpdate) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	client, ok := m.clients[clientID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoClient, clientID)
+	}
+
+	paths := client.paths()
+	for _, path := range update.Remove {
+		i := slices.Index(paths, path)
+		if i < 0 {
+			return nil, fmt.Errorf("client %s has no path %s", clientID, path)
+		}
+		paths = slices.Delete(paths, i, i+1)
+	}
+	for _, path := range update.Add {
+		if err := routing.Validate(path); err != nil {
+			return nil, err
+		}
+		if slices.Contains(paths, path) {
+			return nil, fmt.Errorf("client %s already has path %s", clientID, path)
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("client %s must keep at least one path", clientID)
+	}
+	if err := m.srv.allowPaths(clientID, update.Add); err != nil {
+		return nil, err
+	}
+	claims, err := m.claimLocked(clientID, client.tenant, client.shadow, update.Add)
+	if err != nil {
+		return nil, err
+	}
+
+	m.evictLocked(claims)
+	m.unrouteLocked(client)
+	client.path, client.extraPaths = paths[0], paths[1:]
+	m.clients[clientID] = client
+	m.routeLocked(client)
+	for _, path := range update.Remove {
+		m.srv.registryEvents.Publish(events.Event{Type: events.PathReleased, ClientID: clientID, Tenant: client.tenant, Path: path})
+	}
+	for _, path := range update.Add {
+		m.srv.registryEvents.Publish(events.Event{Type: events.PathClaimed, ClientID: clientID, Tenant: client.tenant, Path: path})
+	}
+	log.Printf("TCP Manager: Client %s now has paths %v", clientID, paths)
+	return paths, nil
+}
+
+// updatePaths applies an update and tells the client its paths, so it claims
+// them again after reconnecting
+func (m *TCPManager) updatePaths(clientID string, update pathUpdate) ([]string, error) {
+	paths, err := m.UpdatePaths(clientID, update)
+	if err != nil {
+		return nil, err
+	}
+	if client, ok := m.GetClient(clientID); ok {
+		notice, _ := json.Marshal(map[string][]string{"paths": paths})
+		if _, err := m.srv.sendLine(clientID, client.conn, "paths|"+string(notice)); err != nil {
+			log.Printf("TCP Manager: Failed to send paths to client %s: %v", clientID, err)
+		}
+	}
+	return paths, nil
+}
+
+// handlePathUpdate applies an update the client sent over its tunnel,
+// answering with its paths or "paths-error|<reason>"
+func (m *TCPManager) handlePathUpdate(clientID, data string) {
+	var update pathUpdate
+	err := json.Unmarshal([]byte(data), &update)
+	if err == nil {
+		_, err = m.updatePaths(clientID, update)
+	}
+	if err != nil {
+		log.Printf("TCP Manager: Rejected path update from client %s: %v", clientID, err)
+		if client, ok := m.GetClient(clientID); ok {
+			m.srv.sendLine(clientID, client.conn, "paths-error|"+err.Error())
+		}
+	}
+}
+
+// UpdateClientPaths adds and removes paths of a connected client (POST
+// ?client_id=, body {"add": ["/docs"], "remove": ["/old"]}), answering with
+// {"paths": [...]}. Allowed like pause and resume.
+func (s *Server) UpdateClientPaths(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.URL.Query().Get("client_id")
+	registered := s.clientManager.GetClient(clientID)
+	if registered == nil {
+		http.Error(w, fmt.Sprintf("Client not registered: %s", clientID), http.StatusNotFound)
+		return
+	}
+	if !s.authorizeTunnelControl(w, r, registered) {
+		return
+	}
+
+	var update pathUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(update.Add) == 0 && len(update.Remove) == 0 {
+		http.Error(w, "add or remove is required", http.StatusBadRequest)
+		return
+	}
+
+	paths, err := s.tcpmanager.updatePaths(clientID, update)
+	switch {
+	case errors.Is(err, errNoClient):
+		http.Error(w, fmt.Sprintf("Client not connected: %s", clientID), http.StatusNotFound)
+		return
+	case errors.Is(err, registry.ErrPathClaimed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errPathNotAllowed):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"paths": paths})
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/middleware"
+)
+
+// tunnelProfile is a named set of tunnel settings from server.profiles.
+// Clients registering with the profile get its registration defaults, and
+// their requests its timeout and middleware.
+type tunnelProfile struct {
+	name    string
+	timeout time.Duration // 0 uses proxyTimeout
+	// Defaults for registrations that don't set their own
+	ttl, class, schedule, timezone string
+	// handler runs the profile's middleware before forwarding to the client
+	// in the request's context, nil without middleware
+	handler http.Handler
+}
+
+type profileClientKey struct{}
+
+// configureProfiles builds server.profiles, after the middleware and QoS
+// classes they refer to are configured
+func (s *Server) configureProfiles(config *Config) error {
+	profiles := make(map[string]*tunnelProfile)
+	for _, pc := range config.Server.Profiles {
+		if pc.Name == "" {
+			return fmt.Errorf("profiles need a name")
+		}
+		if _, ok := profiles[pc.Name]; ok {
+			return fmt.Errorf("duplicate profile %s", pc.Name)
+		}
+		if pc.Timeout < 0 {
+			return fmt.Errorf("profile %s: timeout must not be negative", pc.Name)
+		}
+		if _, err := parseTTL(pc.TTL); err != nil {
+			return fmt.Errorf("profile %s: %v", pc.Name, err)
+		}
+		if err := s.validateClass(pc.Class); err != nil {
+			return fmt.Errorf("profile %s: %v", pc.Name, err)
+		}
+		if _, err := parseSchedule(pc.Schedule, pc.Timezone); err != nil {
+			return fmt.Errorf("profile %s: %v", pc.Name, err)
+		}
+
+		profile := &tunnelProfile{
+			name:     pc.Name,
+			timeout:  time.Duration(pc.Timeout) * time.Second,
+			ttl:      pc.TTL,
+			class:    pc.Class,
+			schedule: pc.Schedule,
+			timezone: pc.Timezone,
+		}
+		if len(pc.Middleware) > 0 {
+			entries := make([]middleware.Entry, len(pc.Middleware))
+			for i, mc := range pc.Middleware {
+				entries[i] = middleware.Entry{Name: mc.Name, Paths: mc.Paths, Options: mc.Options}
+			}
+			chain, err := s.middleware.Build(entries)
+			if err != nil {
+				return fmt.Errorf("profile %s: %v", pc.Name, err)
+			}
+			profile.handler = chain.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				s.forwardToClient(w, r, r.Context().Value(profileClientKey{}).(clientInfo))
+			}))
+			log.Printf("Profile %s middleware: %s", pc.Name, strings.Join(chain.Names(), ", "))
+		}
+		profiles[pc.Name] = profile
+	}
+	s.tunnelProfiles = profiles
+
+	if len(profiles) > 0 {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Printf("Tunnel profiles: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// lookupProfile returns the named profile, or nil for no name
+func (s *Server) lookupProfile(name string) (*tunnelProfile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	profile, ok := s.tunnelProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	return profile, nil
+}
+
+// applyDefaults fills the registration settings left empty from the profile
+func (p *tunnelProfile) applyDefaults(ttl, class, schedule, timezone *string) {
+	if *ttl == "" {
+		*ttl = p.ttl
+	}
+	if *class == "" {
+		*class = p.class
+	}
+	if *schedule == "" {
+		*schedule, *timezone = p.schedule, p.timezone
+	}
+}
+
+// clientProfile returns the profile the client registered with, if any
+func (s *Server) clientProfile(clientID string) *tunnelProfile {
+	registered := s.clientManager.GetClient(clientID)
+	if registered == nil || registered.Profile == "" {
+		return nil
+	}
+	return s.tunnelProfiles[registered.Profile]
+}
+
+// responseTimeout is how long requests to the client wait without hearing
+// from it
+func (s *Server) responseTimeout(clientID string) time.Duration {
+	if profile := s.clientProfile(clientID); profile != nil && profile.timeout > 0 {
+		return profile.timeout
+	}
+	return proxyTimeout
+}
+
+// serveProfiled forwards a request to the client through its profile's
+// middleware, reporting false when the client's profile has none
+func (s *Server) serveProfiled(w http.ResponseWriter, r *http.Request, client clientInfo) bool {
+	profile := s.clientProfile(client.clientID)
+	if profile == nil || profile.handler == nil {
+		return false
+	}
+	ctx := context.WithValue(r.Context(), profileClientKey{}, client)
+	profile.handler.ServeHTTP(w, r.WithContext(ctx))
+	return true
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// proxyProtocolSettings controls whether public listeners read PROXY headers
+type proxyProtocolSettings struct {
+	enabled bool
+	trusted []*net.IPNet // Load balancers whose headers are believed, empty trusts all
+}
+
+// configureProxyProtocol reads the PROXY protocol settings
+func (s *Server) configureProxyProtocol(config *Config) error {
+	settings := config.Server.ProxyProtocol
+	if !settings.Enabled {
+		return nil
+	}
+	trusted, err := parseNetworks(settings.Trusted)
+	if err != nil {
+		return err
+	}
+	s.proxyProtocol.trusted = trusted
+	s.proxyProtocol.enabled = true
+	log.Printf("Accepting PROXY protocol headers from %s", describeTrusted(settings.Trusted))
+	return nil
+}
+
+// parseNetworks parses addresses and CIDRs, treating a bare address as a
+// network of one
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted address %q: %v", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func describeTrusted(trusted []string) string {
+	if len(trusted) == 0 {
+		return "any address"
+	}
+	return strings.Join(trusted, ", ")
+}
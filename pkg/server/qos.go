@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// qosClass is a priority class tunnels can be assigned to
+type qosClass struct {
+	name      string
+	bandwidth int64 // Per-tunnel cap for the class, 0 keeps the server-wide one
+}
+
+// configureQoS sets up the priority classes, under which requests beyond
+// the in-flight limit queue for slots by class
+func (s *Server) configureQoS(config *Config) error {
+	qc := config.Server.QoS
+	if len(qc.Classes) == 0 {
+		if qc.Default != "" {
+			return fmt.Errorf("default class %q without classes", qc.Default)
+		}
+		return nil
+	}
+
+	names := make([]string, 0, len(qc.Classes))
+	seen := make(map[string]bool)
+	for _, c := range qc.Classes {
+		name := strings.TrimSpace(c.Name)
+		if name == "" {
+			return fmt.Errorf("class without a name")
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate class %q", name)
+		}
+		if c.BytesPerSecond < 0 {
+			return fmt.Errorf("class %s: bytes_per_second must not be negative", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+		s.qosClasses = append(s.qosClasses, qosClass{name: name, bandwidth: c.BytesPerSecond})
+	}
+
+	s.qosDefault = names[len(names)-1]
+	if qc.Default != "" {
+		if !seen[qc.Default] {
+			return fmt.Errorf("unknown default class %q", qc.Default)
+		}
+		s.qosDefault = qc.Default
+	}
+	if qc.QueueTimeoutMs < 0 {
+		return fmt.Errorf("queue_timeout_ms must not be negative")
+	}
+	s.admissionController.SetClasses(names, time.Duration(qc.QueueTimeoutMs)*time.Millisecond)
+	log.Printf("QoS: Priority classes %s, default %s", strings.Join(names, " > "), s.qosDefault)
+	return nil
+}
+
+// validateClass checks a class named at registration, "" taking the default
+func (s *Server) validateClass(name string) error {
+	if name == "" {
+		return nil
+	}
+	if len(s.qosClasses) == 0 {
+		return fmt.Errorf("priority classes are not configured")
+	}
+	if _, ok := s.classPriority(name); !ok {
+		return fmt.Errorf("unknown priority class %q", name)
+	}
+	return nil
+}
+
+// classPriority returns the rank of a class, 0 being the highest, with ""
+// and unknown names ranked as the default class
+func (s *Server) classPriority(name string) (int, bool) {
+	if len(s.qosClasses) == 0 {
+		return 0, false
+	}
+	if name == "" {
+		name = s.qosDefault
+	}
+	for i, c := range s.qosClasses {
+		if c.name == name {
+			return i, true
+		}
+	}
+	if name != s.qosDefault {
+		priority, _ := s.classPriority(s.qosDefault)
+		return priority, false
+	}
+	return len(s.qosClasses) - 1, false
+}
+
+// classBandwidth returns the tunnel bandwidth cap of a class, 0 if it has none
+func (s *Server) classBandwidth(name string) int64 {
+	if len(s.qosClasses) == 0 {
+		return 0
+	}
+	priority, _ := s.classPriority(name)
+	return s.qosClasses[priority].bandwidth
+}
+
+// effectiveClass names the class a tunnel registered with name belongs to
+func (s *Server) effectiveClass(name string) string {
+	if name == "" {
+		return s.qosDefault
+	}
+	return name
+}
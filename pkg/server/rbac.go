@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/vikasavn/attachcloudip/pkg/oidc"
+)
+
+// Role is an access level for the server's admin endpoints. Each role
+// includes the permissions of the roles below it.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleOperator
+	RoleAdmin
+)
+
+func parseRole(name string) (Role, error) {
+	switch name {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return RoleNone, fmt.Errorf("unknown role: %s", name)
+	}
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+// RBAC binds roles to API keys and OIDC groups
+type RBAC struct {
+	srv         *Server
+	enabled     bool
+	keyRoles    map[string]Role
+	groupRoles  map[string]Role
+	groupsClaim string
+	verifier    *oidc.Verifier
+	mu          sync.RWMutex
+}
+
+func NewRBAC(srv *Server) *RBAC {
+	return &RBAC{
+		srv:        srv,
+		keyRoles:   make(map[string]Role),
+		groupRoles: make(map[string]Role),
+	}
+}
+
+// Configure enables access control with the role bindings from the server config
+func (a *RBAC) Configure(config *Config) error {
+	rc := config.Server.RBAC
+	if !rc.Enabled {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Replaced whole, so configuring again with rotated keys revokes the old ones
+	keyRoles := make(map[string]Role, len(rc.APIKeys))
+	for _, binding := range rc.APIKeys {
+		role, err := parseRole(binding.Role)
+		if err != nil {
+			return err
+		}
+		keyRoles[binding.Key] = role
+	}
+	a.keyRoles = keyRoles
+
+	if rc.OIDC.Issuer != "" {
+		// Without an audience, tokens issued for any application of the
+		// provider would be accepted
+		if rc.OIDC.Audience == "" {
+			return fmt.Errorf("oidc.audience is required with oidc.issuer")
+		}
+		groupRoles := make(map[string]Role, len(rc.OIDC.GroupRoles))
+		for group, name := range rc.OIDC.GroupRoles {
+			role, err := parseRole(name)
+			if err != nil {
+				return err
+			}
+			groupRoles[group] = role
+		}
+		a.groupRoles = groupRoles
+		a.groupsClaim = rc.OIDC.GroupsClaim
+		if a.groupsClaim == "" {
+			a.groupsClaim = "groups"
+		}
+		a.verifier = oidc.NewVerifier(rc.OIDC.Issuer, rc.OIDC.Audience)
+	}
+
+	a.enabled = true
+	return nil
+}
+
+// Enabled reports whether access control is configured
+func (a *RBAC) Enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.enabled
+}
+
+// roleForRequest resolves the caller's role from an API key or OIDC token.
+// Tenant API keys act as viewers of their own tenant.
+func (a *RBAC) roleForRequest(r *http.Request) Role {
+	key := apiKeyFromRequest(r)
+	if key == "" {
+		return RoleNone
+	}
+
+	a.mu.RLock()
+	role, ok := a.keyRoles[key]
+	verifier := a.verifier
+	a.mu.RUnlock()
+	if ok {
+		return role
+	}
+
+	if verifier != nil && strings.Count(key, ".") == 2 {
+		claims, err := verifier.Verify(r.Context(), key)
+		if err != nil {
+			log.Printf("[RBAC] Rejected OIDC token: %v", err)
+			return RoleNone
+		}
+		best := RoleNone
+		a.mu.RLock()
+		for _, group := range claims.Strings(a.groupsClaim) {
+			if role := a.groupRoles[group]; role > best {
+				best = role
+			}
+		}
+		a.mu.RUnlock()
+		return best
+	}
+
+	if _, ok := a.srv.tenants.FromRequest(r); ok && a.srv.tenants.Enabled() {
+		return RoleViewer
+	}
+	return RoleNone
+}
+
+// requireRole wraps an admin handler so only callers with at least the given role reach it
+func (a *RBAC) requireRole(min Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			next(w, r)
+			return
+		}
+
+		role := a.roleForRequest(r)
+		if role == RoleNone {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if role < min {
+			log.Printf("[RBAC] Denied %s %s: role %s, requires %s", r.Method, r.URL.Path, role, min)
+			http.Error(w, fmt.Sprintf("Forbidden: requires %s role", min), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Readiness tracks whether the components the server needs to take traffic
+// are up, so load balancers only send requests once they are
+type Readiness struct {
+	components map[string]string // Map component to a reason it isn't ready, empty when ready
+	draining   bool
+	mu         sync.Mutex
+}
+
+// readinessStatus is the body of /readyz
+type readinessStatus struct {
+	Ready      bool              `json:"ready"`
+	Draining   bool              `json:"draining,omitempty"`
+	Components map[string]string `json:"components"`
+}
+
+func NewReadiness() *Readiness {
+	return &Readiness{components: make(map[string]string)}
+}
+
+// Expect adds components that must be ready before the server is
+func (r *Readiness) Expect(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		if _, ok := r.components[name]; !ok {
+			r.components[name] = "starting"
+		}
+	}
+}
+
+// SetReady marks a component as operational
+func (r *Readiness) SetReady(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.components[name] = ""
+}
+
+// SetNotReady marks a component as down for the given reason
+func (r *Readiness) SetNotReady(name, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.components[name] = reason
+}
+
+// SetDraining takes the server out of rotation ahead of shutting down
+func (r *Readiness) SetDraining() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = true
+}
+
+func (r *Readiness) status() readinessStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := readinessStatus{Ready: !r.draining, Draining: r.draining, Components: make(map[string]string)}
+	for name, reason := range r.components {
+		if reason == "" {
+			status.Components[name] = "ok"
+			continue
+		}
+		status.Components[name] = reason
+		status.Ready = false
+	}
+	return status
+}
+
+// LivenessHandler reports that the process is up and serving HTTP
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// ReadinessHandler reports whether the server should receive traffic,
+// answering 503 while a component is down or the server is draining
+func (s *Server) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	status := s.readiness.status()
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
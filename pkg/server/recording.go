@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/recording"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// defaultRedactHeaders are redacted from recordings unless
+// recording.redact_headers lists others
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// recordingStore holds the recording settings and the sessions being recorded
+type recordingStore struct {
+	dir      string   // Empty while recording is off
+	clients  []string // path.Match patterns of the client IDs recorded, all if empty
+	maxBytes int64
+	redact   []string
+
+	mu     sync.Mutex
+	active map[string]*recording.Recorder // By client ID
+}
+
+// configureRecording reads server.recording
+func (s *Server) configureRecording(config *Config) error {
+	rc := config.Server.Recording
+	if rc.Dir == "" {
+		return nil
+	}
+	if rc.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes must not be negative")
+	}
+	for _, pattern := range rc.Clients {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid client pattern %q: %v", pattern, err)
+		}
+	}
+	s.recordings.dir = rc.Dir
+	s.recordings.clients = rc.Clients
+	s.recordings.maxBytes = rc.MaxBytes
+	s.recordings.redact = rc.RedactHeaders
+	if len(s.recordings.redact) == 0 {
+		s.recordings.redact = defaultRedactHeaders
+	}
+	log.Printf("Recording tunnel sessions to %s, redacting %s", rc.Dir, strings.Join(s.recordings.redact, ", "))
+	return nil
+}
+
+// startRecording starts recording the client's tunnel session if its client
+// ID is recorded, returning nil otherwise
+func (s *Server) startRecording(clientID, tunnelPath string) *recording.Recorder {
+	if s.recordings.dir == "" || !s.recordedClient(clientID) {
+		return nil
+	}
+	header := recording.Header{ClientID: clientID, Path: tunnelPath, Started: time.Now()}
+	recorder, err := recording.Create(s.recordings.dir, header, s.recordings.maxBytes, s.recordings.redact)
+	if err != nil {
+		log.Printf("Failed to record tunnel of client %s: %v", clientID, err)
+		return nil
+	}
+	s.recordings.mu.Lock()
+	s.recordings.active[clientID] = recorder
+	s.recordings.mu.Unlock()
+	log.Printf("Recording tunnel of client %s to %s", clientID, recorder.Name())
+	return recorder
+}
+
+func (s *Server) recordedClient(clientID string) bool {
+	if len(s.recordings.clients) == 0 {
+		return true
+	}
+	for _, pattern := range s.recordings.clients {
+		if ok, _ := path.Match(pattern, clientID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// stopRecording ends the recording of a tunnel session
+func (s *Server) stopRecording(clientID string, recorder *recording.Recorder) {
+	if recorder == nil {
+		return
+	}
+	s.recordings.mu.Lock()
+	if s.recordings.active[clientID] == recorder {
+		delete(s.recordings.active, clientID)
+	}
+	s.recordings.mu.Unlock()
+	if err := recorder.Close(); err != nil {
+		log.Printf("Failed to finish recording of client %s: %v", clientID, err)
+	}
+}
+
+// recorderFor returns the recorder of the client's tunnel session, nil if it
+// isn't recorded
+func (s *Server) recorderFor(clientID string) *recording.Recorder {
+	s.recordings.mu.Lock()
+	defer s.recordings.mu.Unlock()
+	return s.recordings.active[clientID]
+}
+
+// sendLine writes a control message to the client's tunnel, recording it
+// if the session is recorded
+func (s *Server) sendLine(clientID string, conn net.Conn, line string) (int, error) {
+	s.recorderFor(clientID).Line(recording.DirectionOut, line)
+	return conn.Write([]byte(line + "\n"))
+}
+
+// recordingInfo describes a recording on disk
+type recordingInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// RecordingsHandler lists the recordings (GET /admin/recordings), or returns
+// one with ?name=
+func (s *Server) RecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.recordings.dir == "" {
+		http.Error(w, "Session recording is not enabled", http.StatusNotFound)
+		return
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		http.ServeFile(w, r, filepath.Join(s.recordings.dir, filepath.Base(name)))
+		return
+	}
+
+	files, err := os.ReadDir(s.recordings.dir)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Failed to list recordings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	list := []recordingInfo{}
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || !strings.HasSuffix(file.Name(), ".jsonl") {
+			continue
+		}
+		list = append(list, recordingInfo{Name: file.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// replayMismatch is a replayed request whose response differs from the
+// recorded one
+type replayMismatch struct {
+	RequestID      string `json:"request_id"` // ID in the recording
+	Method         string `json:"method"`
+	Path           string `json:"path"`
+	RecordedStatus int    `json:"recorded_status,omitempty"`
+	Status         int    `json:"status,omitempty"`
+	BodyMatches    bool   `json:"body_matches"`
+	Error          string `json:"error,omitempty"`
+}
+
+// replayResult reports a replay
+type replayResult struct {
+	Recording  string           `json:"recording"`
+	ClientID   string           `json:"client_id"`
+	Replayed   int              `json:"replayed"`
+	Matched    int              `json:"matched"`
+	Mismatches []replayMismatch `json:"mismatches"`
+}
+
+// ReplayHandler sends the requests of a recording to a connected client in
+// order and compares its responses with the recorded ones (POST
+// /admin/recordings/replay with {"recording": name, "client_id": id}, the
+// client defaulting to the recorded one)
+func (s *Server) ReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.recordings.dir == "" {
+		http.Error(w, "Session recording is not enabled", http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Recording string `json:"recording"`
+		ClientID  string `json:"client_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	file, err := os.Open(filepath.Join(s.recordings.dir, filepath.Base(body.Recording)))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Recording not found: %s", body.Recording), http.StatusNotFound)
+		return
+	}
+	header, entries, err := recording.Read(file)
+	file.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	clientID := body.ClientID
+	if clientID == "" {
+		clientID = header.ClientID
+	}
+	client, ok := s.tcpmanager.GetClient(clientID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Client not connected: %s", clientID), http.StatusNotFound)
+		return
+	}
+
+	result := replayResult{Recording: filepath.Base(body.Recording), ClientID: clientID, Mismatches: []replayMismatch{}}
+	for _, exchange := range recording.Exchanges(entries) {
+		if r.Context().Err() != nil {
+			break
+		}
+		result.Replayed++
+		req := *exchange.Request
+		req.Headers = exchange.Request.Headers.Clone()
+		req.ClientID = clientID
+		status, replayedBody, err := s.replayRequest(r, client, &req)
+
+		mismatch := replayMismatch{RequestID: exchange.Request.ID, Method: req.Method, Path: req.Path, Status: status}
+		if recorded := exchange.Response; recorded != nil {
+			mismatch.RecordedStatus = recorded.StatusCode
+			mismatch.BodyMatches = bytes.Equal(recorded.Body, replayedBody)
+		}
+		if err != nil {
+			mismatch.Error = err.Error()
+		}
+		if err == nil && mismatch.BodyMatches && mismatch.Status == mismatch.RecordedStatus {
+			result.Matched++
+			continue
+		}
+		result.Mismatches = append(result.Mismatches, mismatch)
+	}
+	log.Printf("Replayed %d requests of recording %s to client %s, %d matched", result.Replayed, result.Recording, clientID, result.Matched)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// replayRequest forwards a recorded request to the client and returns its
+// status and whole body
+func (s *Server) replayRequest(r *http.Request, client clientInfo, req *types.Request) (int, []byte, error) {
+	resp, err := s.tcpmanager.ForwardRequest(r.Context(), client, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.Error != "" {
+		return resp.StatusCode, resp.Body, fmt.Errorf("client failed the request: %s", resp.Error)
+	}
+	body := resp.Body
+	if resp.Stream {
+		err = s.tcpmanager.StreamBody(r.Context(), client, resp.RequestID, func(chunk []byte) error {
+			body = append(body, chunk...)
+			return nil
+		})
+	}
+	return resp.StatusCode, body, err
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/redis"
+)
+
+// configureRedis connects to the configured Redis, checking it answers
+func (s *Server) configureRedis(config *Config) error {
+	rc := config.Server.Redis
+	if rc.Address == "" {
+		return nil
+	}
+	client := redis.New(rc.Address, rc.Password, rc.DB)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx); err != nil {
+		return err
+	}
+	s.redisClient = client
+	log.Printf("Using Redis at %s", rc.Address)
+	return nil
+}
+
+// redisErrorLogger returns an error callback that logs at most every ten
+// seconds, since an unreachable Redis fails every request
+func redisErrorLogger(feature string) func(error) {
+	var last atomic.Int64
+	var suppressed atomic.Int64
+	return func(err error) {
+		now := time.Now().UnixNano()
+		prev := last.Load()
+		if now-prev < int64(10*time.Second) || !last.CompareAndSwap(prev, now) {
+			suppressed.Add(1)
+			return
+		}
+		if n := suppressed.Swap(0); n > 0 {
+			log.Printf("%s: %v (%d more errors)", feature, err, n)
+			return
+		}
+		log.Printf("%s: %v", feature, err)
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestRedisErrorLogger(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	report := redisErrorLogger("Rate limit")
+	for i := 0; i < 5; i++ {
+		report(errors.New("redis: connection refused"))
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], "Rate limit: redis: connection refused") {
+		t.Fatalf("logged %q, want the first error only", lines)
+	}
+
+	// Another feature's errors are logged on their own schedule
+	redisErrorLogger("Cache")(errors.New("redis: timeout"))
+	if !strings.Contains(buf.String(), "Cache: redis: timeout") {
+		t.Fatalf("logged %q, want the cache error", buf.String())
+	}
+}
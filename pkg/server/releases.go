@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/update"
+)
+
+// platformPattern matches GOOS and GOARCH values
+var platformPattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// releaseStore serves client binaries while server.client_releases is set
+type releaseStore struct {
+	dir     string // Empty while off
+	version string
+
+	mu     sync.Mutex
+	byName map[string]cachedRelease // So binaries are only hashed when they change
+}
+
+type cachedRelease struct {
+	modified, signed time.Time // Of the binary and its signature
+	size             int64
+	release          update.Release
+}
+
+// configureReleases reads server.client_releases
+func (s *Server) configureReleases(config *Config) error {
+	rc := config.Server.ClientReleases
+	if rc.Dir == "" {
+		return nil
+	}
+	if rc.Version == "" {
+		return fmt.Errorf("version is required with dir")
+	}
+	if info, err := os.Stat(rc.Dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("dir %s is not a directory", rc.Dir)
+	}
+	s.releases.dir, s.releases.version = rc.Dir, rc.Version
+	log.Printf("Serving client release %s from %s", rc.Version, rc.Dir)
+	return nil
+}
+
+// releaseFor describes the binary for the platform in the request's ?os= and
+// ?arch=, writing an error if there is none
+func (s *Server) releaseFor(w http.ResponseWriter, r *http.Request) (update.Release, string, bool) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return update.Release{}, "", false
+	}
+	if s.releases.dir == "" {
+		http.Error(w, "Client releases are not served", http.StatusNotFound)
+		return update.Release{}, "", false
+	}
+	goos, goarch := r.URL.Query().Get("os"), r.URL.Query().Get("arch")
+	if !platformPattern.MatchString(goos) || !platformPattern.MatchString(goarch) {
+		http.Error(w, "os and arch are required", http.StatusBadRequest)
+		return update.Release{}, "", false
+	}
+	name := update.BinaryName(goos, goarch)
+	path := filepath.Join(s.releases.dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("No client release for %s/%s", goos, goarch), http.StatusNotFound)
+		return update.Release{}, "", false
+	}
+
+	var signed time.Time
+	if sig, err := os.Stat(path + ".sig"); err == nil {
+		signed = sig.ModTime()
+	}
+
+	s.releases.mu.Lock()
+	defer s.releases.mu.Unlock()
+	cached, ok := s.releases.byName[name]
+	if ok && cached.modified.Equal(info.ModTime()) && cached.size == info.Size() && cached.signed.Equal(signed) {
+		return cached.release, path, true
+	}
+	release, err := update.Describe(path, s.releases.version, goos, goarch)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read client release: %v", err), http.StatusInternalServerError)
+		return update.Release{}, "", false
+	}
+	release.URL = "download?" + url.Values{"os": {goos}, "arch": {goarch}}.Encode()
+	s.releases.byName[name] = cachedRelease{modified: info.ModTime(), signed: signed, size: info.Size(), release: release}
+	return release, path, true
+}
+
+// LatestReleaseHandler describes the client release for a platform (GET
+// /client/latest?os=linux&arch=amd64)
+func (s *Server) LatestReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	release, _, ok := s.releaseFor(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(release)
+}
+
+// DownloadReleaseHandler serves the client binary for a platform (GET
+// /client/download?os=linux&arch=amd64)
+func (s *Server) DownloadReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	release, path, ok := s.releaseFor(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	w.Header().Set("X-Checksum-Sha256", release.SHA256)
+	http.ServeFile(w, r, path)
+}
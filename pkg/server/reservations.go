@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Reservation pins a public port and/or hostname to a named client ID so the
+// tunnel always comes up on the same endpoint
+type Reservation struct {
+	ClientID string `json:"client_id"`
+	Port     int    `json:"port,omitempty"`     // Public HTTP port serving only this client
+	Hostname string `json:"hostname,omitempty"` // Public hostname serving only this client
+}
+
+func (res Reservation) validate() error {
+	if res.ClientID == "" {
+		return fmt.Errorf("client_id is required")
+	}
+	if res.Port == 0 && res.Hostname == "" {
+		return fmt.Errorf("reservation for client %s needs a port or hostname", res.ClientID)
+	}
+	if res.Port < 0 || res.Port > 65535 {
+		return fmt.Errorf("invalid reserved port: %d", res.Port)
+	}
+	return nil
+}
+
+// ReservationStore tracks reserved endpoints and runs the reserved port listeners
+type ReservationStore struct {
+	srv       *Server
+	byClient  map[string]Reservation
+	byHost    map[string]string // hostname -> client ID
+	listeners map[int]net.Listener
+	parked    map[string]bool // Clients whose reserved port is closed outside their schedule
+	mu        sync.RWMutex
+}
+
+func NewReservationStore(srv *Server) *ReservationStore {
+	return &ReservationStore{
+		srv:       srv,
+		byClient:  make(map[string]Reservation),
+		byHost:    make(map[string]string),
+		listeners: make(map[int]net.Listener),
+		parked:    make(map[string]bool),
+	}
+}
+
+// Add reserves the endpoints for the client, replacing its previous reservation
+func (s *ReservationStore) Add(res Reservation) error {
+	if err := res.validate(); err != nil {
+		return err
+	}
+	res.Hostname = strings.ToLower(res.Hostname)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, other := range s.byClient {
+		if id == res.ClientID {
+			continue
+		}
+		if res.Port != 0 && other.Port == res.Port {
+			return fmt.Errorf("port %d is already reserved for client %s", res.Port, id)
+		}
+		if res.Hostname != "" && other.Hostname == res.Hostname {
+			return fmt.Errorf("hostname %s is already reserved for client %s", res.Hostname, id)
+		}
+	}
+
+	previous := s.byClient[res.ClientID]
+	if res.Port != 0 && res.Port != previous.Port {
+		// Keep raw TCP tunnels from being handed the reserved port
+		if err := s.srv.reserveTCPTunnelPort(res.Port, res.ClientID); err != nil {
+			return err
+		}
+		if !s.parked[res.ClientID] {
+			if err := s.listenLocked(res.ClientID, res.Port); err != nil {
+				s.srv.unreserveTCPTunnelPort(res.Port)
+				return err
+			}
+		}
+	}
+	s.releaseLocked(previous, res)
+
+	s.byClient[res.ClientID] = res
+	if res.Hostname != "" {
+		s.byHost[res.Hostname] = res.ClientID
+	}
+	log.Printf("[RESERVATIONS] Reserved port %d and hostname %q for client %s", res.Port, res.Hostname, res.ClientID)
+	return nil
+}
+
+// Remove drops the client's reservation and closes its reserved port
+func (s *ReservationStore) Remove(clientID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, exists := s.byClient[clientID]
+	if !exists {
+		return false
+	}
+	s.releaseLocked(res, Reservation{})
+	delete(s.byClient, clientID)
+	log.Printf("[RESERVATIONS] Released reservation of client %s", clientID)
+	return true
+}
+
+// List returns all reservations sorted by client ID
+func (s *ReservationStore) List() []Reservation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Reservation, 0, len(s.byClient))
+	for _, res := range s.byClient {
+		list = append(list, res)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ClientID < list[j].ClientID })
+	return list
+}
+
+// SetParked closes the client's reserved port while its tunnel is outside
+// its schedule, or opens it again
+func (s *ReservationStore) SetParked(clientID string, parked bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if parked {
+		s.parked[clientID] = true
+	} else {
+		delete(s.parked, clientID)
+	}
+	res, ok := s.byClient[clientID]
+	if !ok || res.Port == 0 {
+		return nil
+	}
+	listener, listening := s.listeners[res.Port]
+	switch {
+	case parked && listening:
+		listener.Close()
+		delete(s.listeners, res.Port)
+		log.Printf("[RESERVATIONS] Parked port %d of client %s", res.Port, clientID)
+	case !parked && !listening:
+		return s.listenLocked(clientID, res.Port)
+	}
+	return nil
+}
+
+// ClientForHost returns the client a public hostname is reserved for
+func (s *ReservationStore) ClientForHost(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	clientID, ok := s.byHost[strings.ToLower(host)]
+	return clientID, ok
+}
+
+// Reserved reports whether the hostname is reserved for a client other than clientID
+func (s *ReservationStore) Reserved(hostname, clientID string) bool {
+	owner, ok := s.ClientForHost(hostname)
+	return ok && owner != clientID
+}
+
+// listenLocked serves the client on its reserved public port
+func (s *ReservationStore) listenLocked(clientID string, port int) error {
+	listener, err := s.srv.listenPublic(s.srv.bindAddresses.reserved, port, s.srv.listenSettings.public)
+	if err != nil {
+		return fmt.Errorf("failed to listen on reserved port %d: %v", port, err)
+	}
+	s.listeners[port] = listener
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.srv.proxyToReserved(w, r, clientID)
+	})
+	go func() {
+		err := s.srv.newPublicServer(s.srv.withAccessLog(handler)).Serve(s.srv.tcpmanager.TrackConnections(s.srv.admissionController.Listener(listener)))
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("[RESERVATIONS] Reserved port %d stopped: %v", port, err)
+		}
+	}()
+	log.Printf("[RESERVATIONS] Serving client %s on port %d", clientID, port)
+	return nil
+}
+
+// releaseLocked frees the endpoints of old that next doesn't keep
+func (s *ReservationStore) releaseLocked(old, next Reservation) {
+	if old.Port != 0 && old.Port != next.Port {
+		if listener, ok := s.listeners[old.Port]; ok {
+			listener.Close()
+			delete(s.listeners, old.Port)
+		}
+		s.srv.unreserveTCPTunnelPort(old.Port)
+	}
+	if old.Hostname != "" && old.Hostname != next.Hostname {
+		delete(s.byHost, old.Hostname)
+	}
+}
+
+// ReservationsHandler lists (GET), adds (POST), and removes (DELETE ?client_id=) reservations
+func (s *Server) ReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.reservations.List())
+	case http.MethodPost:
+		var res Reservation
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := res.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.reservations.Add(res); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		clientID := r.URL.Query().Get("client_id")
+		if !s.reservations.Remove(clientID) {
+			http.Error(w, fmt.Sprintf("No reservation for client: %s", clientID), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/schedule"
+)
+
+// scheduleInterval is how often tunnels are checked for leaving or entering
+// their availability window
+const scheduleInterval = time.Second
+
+// scheduleMessage is shown for tunnels outside their availability window
+const scheduleMessage = "This service is only available during its scheduled hours. Please try again later."
+
+// parseSchedule reads a registration's availability window, where an empty
+// spec means always available
+func parseSchedule(spec, timezone string) (*schedule.Schedule, error) {
+	if spec == "" {
+		if timezone != "" {
+			return nil, fmt.Errorf("timezone needs a schedule")
+		}
+		return nil, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+	}
+	return schedule.Parse(spec, location)
+}
+
+// startScheduleWatcher parks the reserved ports of tunnels outside their
+// availability window and opens them again when it starts. Requests by path
+// or hostname get the schedule's 503 whenever the window is closed.
+func (s *Server) startScheduleWatcher(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(scheduleInterval)
+		defer ticker.Stop()
+
+		parked := make(map[string]bool)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := time.Now()
+			current := s.clientManager.ParkedClients(now)
+			for clientID, client := range current {
+				if parked[clientID] {
+					continue
+				}
+				parked[clientID] = true
+				if err := s.reservations.SetParked(clientID, true); err != nil {
+					log.Printf("Failed to park reserved port of client %s: %v", clientID, err)
+				}
+				log.Printf("Parked tunnel of client %s outside its schedule %q until %s", clientID, client.Schedule, client.Schedule.Next(now).Format(time.RFC3339))
+				s.publishStatus(clientID, client.Tenant, firstPath(&client), "parked")
+			}
+			for clientID := range parked {
+				if _, ok := current[clientID]; ok {
+					continue
+				}
+				if err := s.reservations.SetParked(clientID, false); err != nil {
+					log.Printf("Failed to reopen reserved port of client %s, retrying: %v", clientID, err)
+					continue
+				}
+				delete(parked, clientID)
+				client := s.clientManager.GetClient(clientID)
+				if client == nil {
+					continue
+				}
+				log.Printf("Unparked tunnel of client %s, its scheduled window opened", clientID)
+				s.publishStatus(clientID, client.Tenant, firstPath(client), "unparked")
+			}
+		}
+	}()
+}
+
+// firstPath is the path events about the client carry
+func firstPath(client *Client) string {
+	if len(client.Paths) > 0 {
+		return client.Paths[0]
+	}
+	return ""
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+// secretSource is a config file that refers to secrets, kept so rotated
+// secrets can be fetched again
+type secretSource struct {
+	data     []byte
+	resolver *secrets.Resolver
+	values   map[string]string // Reference -> value of the latest load
+}
+
+// newSecretResolver registers the secret stores configured in data
+func newSecretResolver(data []byte) (*secrets.Resolver, error) {
+	var bootstrap struct {
+		Server struct {
+			Secrets SecretsConfig `yaml:"secrets"`
+		} `yaml:"server"`
+	}
+	if err := yaml.Unmarshal(data, &bootstrap); err != nil {
+		return nil, err
+	}
+	sc := bootstrap.Server.Secrets
+	if secrets.HasReferences(sc.Vault.Token + sc.AWS.AccessKeyID + sc.AWS.SecretAccessKey) {
+		return nil, fmt.Errorf("secret store credentials can't refer to secrets")
+	}
+
+	resolver := secrets.NewResolver()
+	if sc.Vault.Address != "" {
+		token := sc.Vault.Token
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		resolver.Register("vault", secrets.NewVault(sc.Vault.Address, token, sc.Vault.Namespace))
+	}
+	if sc.AWS.Region != "" {
+		credentials := secrets.AWSCredentials{
+			AccessKeyID:     sc.AWS.AccessKeyID,
+			SecretAccessKey: sc.AWS.SecretAccessKey,
+		}
+		if credentials.AccessKeyID == "" {
+			credentials.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+			credentials.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			credentials.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+			return nil, fmt.Errorf("secrets.aws needs access_key_id and secret_access_key or the AWS_ environment variables")
+		}
+		resolver.Register("aws", secrets.NewAWSSecretsManager(sc.AWS.Region, sc.AWS.Endpoint, credentials))
+	}
+	return resolver, nil
+}
+
+// load expands the secret references of the config file and parses it
+func (s *secretSource) load(ctx context.Context) (*Config, error) {
+	var tree interface{}
+	if err := yaml.Unmarshal(s.data, &tree); err != nil {
+		return nil, err
+	}
+	s.resolver.Forget()
+	expanded, err := expandSecrets(ctx, s.resolver, tree)
+	if err != nil {
+		return nil, err
+	}
+	data, err := yaml.Marshal(expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	config.secrets = s
+	s.values = s.resolver.Forget()
+	return &config, nil
+}
+
+// expandSecrets replaces secret references in the string values of a parsed
+// YAML document
+func expandSecrets(ctx context.Context, resolver *secrets.Resolver, node interface{}) (interface{}, error) {
+	switch v := node.(type) {
+	case string:
+		return resolver.Expand(ctx, v)
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			expanded, err := expandSecrets(ctx, resolver, value)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = expanded
+		}
+	case []interface{}:
+		for i, value := range v {
+			expanded, err := expandSecrets(ctx, resolver, value)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	}
+	return node, nil
+}
+
+// startSecretRefresh checks the config's secrets for rotation every
+// secrets.refresh_interval and applies the rotated values that can change
+// while serving
+func (s *Server) startSecretRefresh(ctx context.Context, config *Config) {
+	source := config.secrets
+	interval := time.Duration(config.Server.Secrets.RefreshInterval) * time.Second
+	if source == nil || interval <= 0 {
+		return
+	}
+	log.Printf("Secrets: Checking %d secret references for rotation every %s", len(source.values), interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			before := source.values
+			fresh, err := source.load(ctx)
+			if err != nil {
+				log.Printf("Secrets: Failed to refresh: %v", err)
+				continue
+			}
+			changed := secrets.Changed(before, source.values)
+			if len(changed) == 0 {
+				continue
+			}
+			log.Printf("Secrets: %s rotated", strings.Join(changed, ", "))
+			if err := s.applyRotatedSecrets(fresh); err != nil {
+				log.Printf("Secrets: Failed to apply rotated secrets: %v", err)
+			}
+		}
+	}()
+}
+
+// applyRotatedSecrets swaps in the credentials that can change while
+// serving: RBAC and tenant API keys and the default TLS certificate. Others
+// take effect on restart.
+func (s *Server) applyRotatedSecrets(config *Config) error {
+	if err := s.accessControl.Configure(config); err != nil {
+		return fmt.Errorf("RBAC: %v", err)
+	}
+	for _, tenant := range config.Server.Tenants {
+		if err := s.tenants.SetAPIKeys(tenant.Name, tenant.APIKeys); err != nil {
+			return fmt.Errorf("tenant %s: %v", tenant.Name, err)
+		}
+	}
+	if tc := config.Server.TLS; s.certStore != nil && tc.Cert != "" {
+		if err := s.certStore.SetDefaultPEM([]byte(tc.Cert), []byte(tc.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
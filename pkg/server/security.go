@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+)
+
+// securityHeaders returns the headers injected into HTTPS responses: HSTS
+// plus any configured extras
+func securityHeaders(config *Config) map[string]string {
+	tc := config.Server.TLS
+	headers := make(map[string]string, len(tc.SecurityHeaders)+1)
+	for name, value := range tc.SecurityHeaders {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	if tc.HSTS.MaxAge > 0 {
+		hsts := fmt.Sprintf("max-age=%d", tc.HSTS.MaxAge)
+		if tc.HSTS.IncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if tc.HSTS.Preload {
+			hsts += "; preload"
+		}
+		headers["Strict-Transport-Security"] = hsts
+	}
+	return headers
+}
+
+// withSecurityHeaders sets the headers on every response, overriding the
+// upstream's values for proxied responses
+func withSecurityHeaders(headers map[string]string, next http.Handler) http.Handler {
+	if len(headers) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, apply: func(h http.Header) {
+			for name, value := range headers {
+				h.Set(name, value)
+			}
+		}}, r)
+	})
+}
+
+// redirectToHTTPS permanently redirects plain HTTP requests to the same URL
+// on the HTTPS port
+func redirectToHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		logging.Debugf("Redirecting %s %s to %s", r.Method, r.URL.Path, target)
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,654 @@
+// Package server is the tunnel server: it accepts client tunnels on the
+// registration port and proxies the public frontend to them, so other Go
+// programs can embed it. cmd/server wraps it with flags and signal handling.
+// Each Server has its own state, so a process can run several.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/vikasavn/attachcloudip/pkg/admission"
+	"github.com/vikasavn/attachcloudip/pkg/certs"
+	"github.com/vikasavn/attachcloudip/pkg/events"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/middleware"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/recording"
+	"github.com/vikasavn/attachcloudip/pkg/redis"
+	"github.com/vikasavn/attachcloudip/pkg/registry"
+	"github.com/vikasavn/attachcloudip/pkg/service"
+	"github.com/vikasavn/attachcloudip/pkg/systemd"
+	"github.com/vikasavn/attachcloudip/pkg/usage"
+)
+
+// Server runs the tunnel server described by a Config
+type Server struct {
+	config           *Config
+	httpPort         int // Public HTTP port, 9999 unless configured
+	registrationPort int // Tunnel port, 9998 unless configured
+	drainPeriod      time.Duration
+	handlers         map[string]http.Handler // Extra routes on the public frontend
+	provided         map[int]net.Listener    // Listeners to serve ports from, by port
+
+	servers   []frontendServer // Public frontends, shut down gracefully
+	listeners []io.Closer      // Tunnel listeners, closed on shutdown
+	http3     *http3.Server    // HTTP/3 frontend advertised by the HTTPS ones, nil if off
+	ready     chan struct{}
+	cancel    context.CancelFunc
+	stop      sync.Once
+	mu        sync.Mutex
+
+	acceptErrors acceptErrorCounts
+
+	// accessLog receives one line per public request, nil when access logging is off
+	accessLog *log.Logger
+
+	// alerts evaluates the alert rules, nil when none are configured
+	alerts *alertMonitor
+
+	// hashKey is the request attribute that keeps a caller on one client of a
+	// route, or nil to split traffic by weight at random
+	hashKey func(r *http.Request) (string, bool)
+
+	faults chaosState
+
+	// claimPolicies decide what happens when a client claims a path another
+	// connected client of its tenant has
+	claimPolicies registry.ClaimPolicies
+
+	commandResults commandResultStore
+
+	frontendLimits frontendLimitSettings
+
+	// defaultBackend answers requests no tunnel is registered for, nil to answer
+	// them with a 404
+	defaultBackend http.Handler
+
+	// registryEvents carries registry changes to /events subscribers
+	registryEvents *events.Broker
+
+	// forwardedTrusted is the proxies in front of the server whose forwarding
+	// headers are kept. Headers from anyone else are replaced so callers can't
+	// spoof their address to backends.
+	forwardedTrusted []*net.IPNet
+
+	// clientCAs is the operator CA pool client certificates must chain to.
+	// When nil, client certificates are not required.
+	clientCAs *x509.CertPool
+
+	bindAddresses  bindSettings
+	listenSettings listenerSettings
+
+	maintenanceMessage    string
+	maintenanceRetryAfter int
+	maintenanceMu         sync.RWMutex
+
+	tenantRequests   map[string]int64
+	tenantRequestsMu sync.Mutex
+
+	// middleware holds the built-in middleware the chains are built from
+	middleware *middleware.Registry
+
+	// frontend is the middleware chain in front of the public router
+	frontend            *middleware.Chain
+	frontendResponses   map[string]int64 // Map status class, e.g. "2xx", to responses
+	frontendResponsesMu sync.Mutex
+
+	mirrorSlots chan struct{}
+
+	oidcCallbacks oidcCallbackStore
+
+	outboxes outboxSet
+
+	p2pSessions p2pSessionStore
+
+	// pathRules are checked in order, the first rule matching a client ID
+	// deciding what it may claim. Client IDs matching no rule are unrestricted.
+	pathRules []pathRule
+
+	// tunnelProfiles maps profile names to profiles
+	tunnelProfiles map[string]*tunnelProfile
+
+	proxyProtocol proxyProtocolSettings
+
+	// qosClasses are ordered highest priority first, empty when QoS is off
+	qosClasses []qosClass
+	// qosDefault is the class of tunnels that don't name one
+	qosDefault string
+
+	recordings recordingStore
+
+	// redisClient is shared by the features that keep state in Redis, nil when
+	// no Redis is configured
+	redisClient *redis.Client
+
+	releases releaseStore
+
+	tcpmanager          *TCPManager
+	clientManager       *ClientManager
+	admissionController *admission.Controller
+	certStore           *certs.Store // nil unless TLS is enabled
+	tenants             *TenantResolver
+	accessControl       *RBAC
+	sshIdentity         *SSHIdentity
+	sessions            *SessionStore
+	reservations        *ReservationStore
+	corsPolicies        *CORS
+	errorPages          *ErrorPages
+	readiness           *Readiness
+	// router serves the public frontend. It is separate from http.DefaultServeMux
+	// so debug handlers registered there by imports never become public.
+	router *http.ServeMux
+
+	tcpTunnels tcpTunnelState
+
+	tlsSettings tlsOptions
+
+	usageMeter *usage.Meter
+	usageFile  string // Where the rollups are persisted, "" keeps them in memory
+	metered    *usageSampler
+
+	wireDumps wireDumpStore
+}
+
+// Option changes how a Server runs, overriding its Config
+type Option func(*Server)
+
+// WithHTTPPort serves the public HTTP frontend on port
+func WithHTTPPort(port int) Option {
+	return func(s *Server) { s.httpPort = port }
+}
+
+// WithRegistrationPort accepts client tunnels on port
+func WithRegistrationPort(port int) Option {
+	return func(s *Server) { s.registrationPort = port }
+}
+
+// WithDrainPeriod sets how long Shutdown fails readiness before it stops
+// serving, giving load balancers time to stop sending traffic
+func WithDrainPeriod(period time.Duration) Option {
+	return func(s *Server) { s.drainPeriod = period }
+}
+
+// WithHandler serves handler for pattern on the public frontend instead of
+// proxying those requests to tunnels
+func WithHandler(pattern string, handler http.Handler) Option {
+	return func(s *Server) { s.handlers[pattern] = handler }
+}
+
+// WithListener serves port from l instead of opening it, as with a socket
+// inherited from systemd, so tests can run the server on in-memory listeners.
+// Only this server uses l.
+func WithListener(port int, l net.Listener) Option {
+	return func(s *Server) { s.provided[port] = l }
+}
+
+// WithTunnelService makes svc deliver its messages to clients over their
+// tunnels, through per-client outbound queues
+func WithTunnelService(svc *service.TunnelService) Option {
+	return func(s *Server) { svc.SetSender(s.tcpmanager) }
+}
+
+// New creates a Server for config, which may be nil for the defaults
+func New(config *Config, opts ...Option) (*Server, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	s := newServer(config)
+	if config.Server.Ports.HTTP != 0 {
+		s.httpPort = config.Server.Ports.HTTP
+	}
+	if config.Server.Ports.Registration != 0 {
+		s.registrationPort = config.Server.Ports.Registration
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// newServer creates a Server for config with its state at the defaults,
+// before any of config is applied
+func newServer(config *Config) *Server {
+	s := &Server{
+		config:           config,
+		httpPort:         defaultHTTPPort,
+		registrationPort: defaultRegistrationPort,
+		drainPeriod:      time.Duration(config.Server.Shutdown.DrainPeriod) * time.Second,
+		handlers:         make(map[string]http.Handler),
+		provided:         make(map[int]net.Listener),
+		ready:            make(chan struct{}),
+	}
+	s.acceptErrors = acceptErrorCounts{failures: make(map[acceptFailure]int64), recreations: make(map[int]int64)}
+	s.commandResults = commandResultStore{waiters: make(map[string]chan protocol.CommandResult)}
+	s.frontendLimits = frontendLimitSettings{readHeaderTimeout: defaultReadHeaderTimeout, idleTimeout: defaultIdleTimeout}
+	s.registryEvents = events.NewBroker(eventHistory)
+	s.listenSettings = listenerSettings{listenOptions{acceptors: 1}, listenOptions{acceptors: 1}}
+	s.maintenanceMessage = defaultMaintenanceMessage
+	s.tenantRequests = make(map[string]int64)
+	s.frontend = &middleware.Chain{}
+	s.frontendResponses = make(map[string]int64)
+	s.mirrorSlots = make(chan struct{}, maxMirrorsInFlight)
+	s.oidcCallbacks = oidcCallbackStore{handlers: make(map[string]http.Handler)}
+	s.outboxes = outboxSet{byClient: make(map[string]*outbox)}
+	s.p2pSessions = p2pSessionStore{byID: make(map[string]*p2pSession)}
+	s.tunnelProfiles = make(map[string]*tunnelProfile)
+	s.recordings = recordingStore{active: make(map[string]*recording.Recorder)}
+	s.releases = releaseStore{byName: make(map[string]cachedRelease)}
+	s.tcpmanager = NewTCPManager(s)
+	s.clientManager = NewClientManager()
+	s.admissionController = admission.NewController(0, 0)
+	s.tenants = NewTenantResolver()
+	s.accessControl = NewRBAC(s)
+	s.sshIdentity = NewSSHIdentity()
+	s.sessions = NewSessionStore()
+	s.reservations = NewReservationStore(s)
+	s.corsPolicies = NewCORS(s)
+	s.errorPages = NewErrorPages()
+	s.readiness = NewReadiness()
+	s.router = http.NewServeMux()
+	s.tcpTunnels = tcpTunnelState{
+		assigned:  make(map[string]int),
+		listeners: make(map[string]net.Listener),
+		pending:   make(map[string]*pendingStream),
+		hostnames: make(map[string]string),
+	}
+	s.tlsSettings = tlsOptions{minVersion: tls.VersionTLS12}
+	s.usageMeter = usage.NewMeter(defaultUsageHourlyRetention, defaultUsageDailyRetention)
+	s.metered = &usageSampler{srv: s, seen: make(map[string]usageState)}
+	s.wireDumps = wireDumpStore{dumps: make(map[string]WireDump)}
+	return s
+}
+
+// Ready is closed once Start has every listener up
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Start configures the server and serves until Shutdown, or until ctx is
+// cancelled, which shuts it down too. It returns nil once shut down and an
+// error if the server fails to start or stops serving.
+func (s *Server) Start(ctx context.Context) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+	defer cancel()
+
+	listener, err := s.setup(ctx)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		if parent.Err() != nil {
+			s.Shutdown(context.Background())
+		}
+	}()
+
+	server := s.serve(s.httpHandler(s.config))
+	close(s.ready)
+	if err := server.Serve(s.tcpmanager.TrackConnections(s.admissionController.Listener(listener))); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("HTTP server failed: %v", err)
+	}
+	return nil
+}
+
+// setup applies the config and starts everything but the public HTTP
+// frontend, whose listener it returns
+func (s *Server) setup(ctx context.Context) (net.Listener, error) {
+	config := s.config
+	log.Println("Starting server...")
+
+	if err := s.setupLogging(config); err != nil {
+		return nil, fmt.Errorf("failed to set up logging: %v", err)
+	}
+	level, err := logging.ParseLevel(config.Server.Log.Level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log configuration: %v", err)
+	}
+	logging.SetLevel(level)
+
+	for _, tenant := range config.Server.Tenants {
+		if err := s.tenants.AddTenant(tenant.Name, tenant.APIKeys, tenant.Hosts); err != nil {
+			return nil, fmt.Errorf("invalid tenant configuration: %v", err)
+		}
+	}
+
+	s.corsPolicies.Configure(config)
+	s.configureMaintenance(config)
+	if dir := config.Server.ErrorPages.Dir; dir != "" {
+		if err := s.errorPages.Load(dir); err != nil {
+			return nil, fmt.Errorf("failed to load error pages: %v", err)
+		}
+	}
+	if err := s.configureDefaultBackend(config); err != nil {
+		return nil, fmt.Errorf("invalid default backend: %v", err)
+	}
+
+	s.readiness.Expect("registry", "ports", "dispatcher", "registration", "http")
+	if config.Server.TLS.Enabled {
+		s.readiness.Expect("https")
+	}
+	if config.Server.Ports.Shared != 0 {
+		s.readiness.Expect("shared")
+	}
+
+	if err := inheritListeners(); err != nil {
+		return nil, fmt.Errorf("failed to inherit systemd sockets: %v", err)
+	}
+	if err := s.configureBind(config); err != nil {
+		return nil, fmt.Errorf("invalid bind configuration: %v", err)
+	}
+
+	if err := s.configureSockets(config); err != nil {
+		return nil, fmt.Errorf("invalid TCP configuration: %v", err)
+	}
+	if err := s.configureTCPTunnels(config); err != nil {
+		return nil, fmt.Errorf("invalid TCP tunnel configuration: %v", err)
+	}
+	if err := s.configureP2P(config); err != nil {
+		return nil, fmt.Errorf("invalid p2p configuration: %v", err)
+	}
+	if err := s.configureFrontendLimits(config); err != nil {
+		return nil, fmt.Errorf("invalid HTTP configuration: %v", err)
+	}
+
+	if err := s.configureProxyProtocol(config); err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol configuration: %v", err)
+	}
+
+	if err := s.configureForwarded(config); err != nil {
+		return nil, fmt.Errorf("invalid forwarded header configuration: %v", err)
+	}
+
+	if err := s.configureBalancer(config); err != nil {
+		return nil, fmt.Errorf("invalid balancer configuration: %v", err)
+	}
+
+	if err := s.configureClaimPolicies(config); err != nil {
+		return nil, fmt.Errorf("invalid claim policy: %v", err)
+	}
+
+	if err := s.accessControl.Configure(config); err != nil {
+		return nil, fmt.Errorf("invalid RBAC configuration: %v", err)
+	}
+
+	if err := s.configureRedis(config); err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+
+	if err := s.configureMiddleware(config); err != nil {
+		return nil, fmt.Errorf("invalid middleware configuration: %v", err)
+	}
+
+	if err := s.configureQoS(config); err != nil {
+		return nil, fmt.Errorf("invalid QoS configuration: %v", err)
+	}
+
+	if err := s.configureProfiles(config); err != nil {
+		return nil, fmt.Errorf("invalid profile configuration: %v", err)
+	}
+
+	if err := s.configureUsage(ctx, config); err != nil {
+		return nil, fmt.Errorf("invalid usage configuration: %v", err)
+	}
+
+	if err := s.configureAlerts(config); err != nil {
+		return nil, fmt.Errorf("invalid alerts configuration: %v", err)
+	}
+	s.startAlerts(ctx)
+
+	if err := s.configureChaos(config); err != nil {
+		return nil, fmt.Errorf("invalid chaos configuration: %v", err)
+	}
+
+	if err := s.configureRecording(config); err != nil {
+		return nil, fmt.Errorf("invalid recording configuration: %v", err)
+	}
+
+	if err := s.configureReleases(config); err != nil {
+		return nil, fmt.Errorf("invalid client_releases configuration: %v", err)
+	}
+
+	if grace := config.Server.Sessions.GracePeriod; grace > 0 {
+		s.sessions.SetGracePeriod(time.Duration(grace) * time.Second)
+	}
+	s.tcpmanager.SetStaleTimeout(time.Duration(config.Server.Sessions.StaleTimeout) * time.Second)
+
+	if err := s.configureClientLimits(config); err != nil {
+		return nil, fmt.Errorf("invalid limits configuration: %v", err)
+	}
+	limits := config.Server.Limits
+	s.tcpmanager.SetBandwidth(limits.ClientBytesPerSecond, limits.ClientBandwidth)
+	s.tcpmanager.SetConnectionLimits(limits.TunnelConnectionsPerSecond, limits.TunnelConnectionBurst, limits.MaxHandshakes)
+	s.admissionController.SetLimits(limits.MaxConnections, limits.MaxInFlight)
+	s.tcpmanager.SetCompressMinSize(config.Server.Compression.MinSize)
+
+	s.startSecretRefresh(ctx, config)
+
+	if err := s.startFailover(ctx, config); err != nil {
+		return nil, fmt.Errorf("failed to start failover: %v", err)
+	}
+
+	if identity := config.Server.Identity; identity.ClientCAFile != "" {
+		if !config.Server.TLS.Enabled {
+			return nil, errors.New("client certificate identity requires tls.enabled")
+		}
+		pool, err := loadClientCAs(identity.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CAs: %v", err)
+		}
+		s.clientCAs = pool
+		if identity.PinsFile != "" {
+			if err := s.clientManager.LoadPins(identity.PinsFile); err != nil {
+				return nil, fmt.Errorf("failed to load certificate pins: %v", err)
+			}
+			log.Printf("Identity: Persisting certificate pins to %s", identity.PinsFile)
+		}
+	}
+	if err := s.sshIdentity.Configure(config); err != nil {
+		return nil, fmt.Errorf("invalid SSH identity configuration: %v", err)
+	}
+	if err := s.configurePathRules(config); err != nil {
+		return nil, fmt.Errorf("invalid path_rules: %v", err)
+	}
+	if err := s.configureTLS(config); err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %v", err)
+	}
+
+	if config.Server.TLS.Enabled {
+		if err := s.startTLS(config); err != nil {
+			return nil, fmt.Errorf("failed to start TLS: %v", err)
+		}
+	}
+
+	if s.clientCAs != nil {
+		s.tcpmanager.SetTLSConfig(s.hardenTLS(&tls.Config{
+			GetCertificate: s.certStore.GetCertificate,
+			ClientAuth:     tls.RequireAndVerifyClientCert,
+			ClientCAs:      s.clientCAs,
+		}))
+		log.Println("Tunnel connections require client certificates")
+	}
+
+	for _, r := range config.Server.Reservations {
+		res := Reservation{ClientID: r.ClientID, Port: r.Port, Hostname: r.Hostname}
+		if err := s.reservations.Add(res); err != nil {
+			return nil, fmt.Errorf("invalid reservation: %v", err)
+		}
+	}
+	s.readiness.SetReady("registry")
+	s.readiness.SetReady("ports")
+
+	if err := s.startDebugServer(config); err != nil {
+		return nil, fmt.Errorf("failed to start debug server: %v", err)
+	}
+
+	if err := s.tcpmanager.StartListener(s.registrationPort); err != nil {
+		return nil, fmt.Errorf("failed to start TCP listener: %v", err)
+	}
+	s.track(*s.tcpmanager.listener)
+	log.Println("TCP Listener started on port", s.registrationPort)
+	s.readiness.SetReady("registration")
+
+	// Start handling TCP connections in a goroutine
+	go func() {
+		log.Println("Starting TCP connection handler...")
+		s.readiness.SetReady("dispatcher")
+		s.tcpmanager.HandleIncomingRequests()
+	}()
+	s.startExpiryReaper(ctx)
+	s.tcpmanager.startStaleReaper(ctx)
+	s.startScheduleWatcher(ctx)
+
+	log.Printf("HTTP Server starting on port %d...", s.httpPort)
+	s.routes()
+
+	listener, err := s.listenPublic(s.bindAddresses.http, s.httpPort, s.listenSettings.public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start HTTP server: %v", err)
+	}
+	if config.Server.TLS.Enabled && config.Server.TLS.RedirectHTTP {
+		log.Printf("Redirecting plain HTTP on port %d to HTTPS", s.httpPort)
+	}
+	if port := config.Server.Ports.Shared; port != 0 {
+		if err := s.startSharedPort(config, port); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to start shared port: %v", err)
+		}
+	}
+	if port := config.Server.P2P.Port; port != 0 {
+		if err := s.startRendezvous(port); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to start rendezvous: %v", err)
+		}
+	}
+
+	// Everything is listening, so systemd can start dependent units
+	s.readiness.SetReady("http")
+	if err := systemd.Notify("READY=1"); err != nil {
+		log.Printf("Failed to signal readiness: %v", err)
+	}
+	return listener, nil
+}
+
+// routes registers the public frontend's endpoints on the router
+func (s *Server) routes() {
+	s.router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	s.router.HandleFunc("/register", s.RegisterClient)
+	s.router.HandleFunc("/register/challenge", s.RegisterChallenge)
+	s.router.HandleFunc("/healthz", HealthCheck)
+	s.router.HandleFunc("/livez", LivenessHandler)
+	s.router.HandleFunc("/readyz", s.ReadinessHandler)
+	s.router.HandleFunc("/version", VersionHandler)
+	s.router.HandleFunc("/client/latest", s.LatestReleaseHandler)
+	s.router.HandleFunc("/client/download", s.DownloadReleaseHandler)
+	s.router.HandleFunc("/clients", s.accessControl.requireRole(RoleViewer, s.ListClients)) // Add new route for listing clients
+	s.router.HandleFunc("/clients/", s.accessControl.requireRole(RoleViewer, s.ClientDetail))
+	if _, ok := s.handlers["/status"]; !ok { // Embedders may serve their own, as in the README
+		s.router.HandleFunc("/status", s.accessControl.requireRole(RoleViewer, s.StatusHandler))
+	}
+	s.router.HandleFunc("/metrics", s.accessControl.requireRole(RoleViewer, s.MetricsHandler))
+	s.router.HandleFunc("/events", s.accessControl.requireRole(RoleViewer, s.EventsHandler))
+	s.router.HandleFunc("/admin/kick", s.accessControl.requireRole(RoleOperator, s.KickClient))
+	s.router.HandleFunc("/admin/loglevel", s.accessControl.requireRole(RoleOperator, LogLevel))
+	s.router.HandleFunc("/admin/reservations", s.accessControl.requireRole(RoleAdmin, s.ReservationsHandler))
+	s.router.HandleFunc("/admin/usage", s.accessControl.requireRole(RoleOperator, s.UsageHandler))
+	s.router.HandleFunc("/admin/connections", s.accessControl.requireRole(RoleOperator, s.ConnectionsHandler))
+	s.router.HandleFunc("/admin/clientconfig", s.accessControl.requireRole(RoleOperator, s.ClientConfigHandler))
+	s.router.HandleFunc("/admin/commands", s.accessControl.requireRole(RoleOperator, s.CommandsHandler))
+	s.router.HandleFunc("/admin/broadcast", s.accessControl.requireRole(RoleOperator, s.BroadcastHandler))
+	s.router.HandleFunc("/admin/recordings", s.accessControl.requireRole(RoleAdmin, s.RecordingsHandler))
+	s.router.HandleFunc("/admin/recordings/replay", s.accessControl.requireRole(RoleAdmin, s.ReplayHandler))
+	s.router.HandleFunc("/admin/wiredump", s.accessControl.requireRole(RoleAdmin, s.WireDumpHandler))
+	s.router.HandleFunc("/clients/pause", s.PauseClient)
+	s.router.HandleFunc("/clients/resume", s.ResumeClient)
+	s.router.HandleFunc("/clients/renew", s.RenewClient)
+	s.router.HandleFunc("/clients/bench", s.BenchClient)
+	s.router.HandleFunc("/clients/paths", s.UpdateClientPaths)
+	s.router.HandleFunc("/certificates", s.UploadCertificate)
+	s.router.HandleFunc("/p2p", s.P2PHandler)
+	s.oidcCallbacks.mu.Lock()
+	for path, handler := range s.oidcCallbacks.handlers {
+		s.router.Handle(path, handler)
+	}
+	s.oidcCallbacks.mu.Unlock()
+	for pattern, handler := range s.handlers {
+		s.router.Handle(pattern, handler)
+	}
+	s.router.HandleFunc("/", s.ProxyHandler) // Everything else is tunneled to clients
+}
+
+// serve returns an HTTP server for handler that Shutdown stops
+func (s *Server) serve(handler http.Handler) *http.Server {
+	server := s.newPublicServer(handler)
+	s.mu.Lock()
+	s.servers = append(s.servers, server)
+	s.mu.Unlock()
+	return server
+}
+
+// frontendServer is a public frontend over HTTP/1.1 and HTTP/2 or HTTP/3
+type frontendServer interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// track closes the tunnel listener on shutdown
+func (s *Server) track(listener io.Closer) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.mu.Unlock()
+}
+
+// Shutdown fails readiness for the drain period, then stops the public
+// frontends, waiting for in-flight requests until ctx is done, and closes
+// the tunnel listeners and connections. Cancelling ctx cuts the drain
+// period short.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	s.stop.Do(func() {
+		s.readiness.SetDraining()
+		log.Printf("Draining for %s before shutting down", s.drainPeriod)
+		select {
+		case <-time.After(s.drainPeriod):
+		case <-ctx.Done():
+		}
+
+		s.mu.Lock()
+		listeners, servers, cancel := s.listeners, s.servers, s.cancel
+		s.mu.Unlock()
+		for _, server := range servers {
+			if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+				server.Close()
+				err = shutdownErr
+			}
+		}
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		s.tcpmanager.CloseTunnels()
+		if cancel != nil {
+			cancel()
+		}
+		s.saveUsage()
+		log.Println("Server stopped")
+	})
+	return err
+}
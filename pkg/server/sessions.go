@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+)
+
+// defaultSessionGrace is how long a disconnected client can resume its session
+const defaultSessionGrace = 60 * time.Second
+
+var (
+	errSessionNotFound = errors.New("no session found")
+	errSessionMismatch = errors.New("session token does not match")
+)
+
+// session is the state a reconnecting client gets back when it presents its token
+type session struct {
+	token          string
+	tenant         string
+	path           string
+	port           int
+	healthy        bool
+	traffic        *traffic.Counters // Carried over so stats survive reconnects
+	disconnectedAt time.Time         // Zero while the tunnel is connected
+}
+
+// SessionStore issues session tokens to tunnels and keeps their state for a
+// grace period after they disconnect
+type SessionStore struct {
+	sessions map[string]*session // Map client ID to session
+	grace    time.Duration
+	mu       sync.Mutex
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*session),
+		grace:    defaultSessionGrace,
+	}
+}
+
+// SetGracePeriod sets how long sessions survive a disconnect
+func (s *SessionStore) SetGracePeriod(grace time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grace = grace
+}
+
+// Issue starts a new session for the client, replacing any previous one
+func (s *SessionStore) Issue(clientID, tenant, path string, port int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	token := uuid.New().String()
+	s.sessions[clientID] = &session{
+		token:   token,
+		tenant:  tenant,
+		path:    path,
+		port:    port,
+		healthy: true,
+	}
+	return token
+}
+
+// Lookup returns the client's session if token is valid and has not expired
+func (s *SessionStore) Lookup(clientID, token string) (session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	sess, ok := s.sessions[clientID]
+	if !ok {
+		return session{}, errSessionNotFound
+	}
+	if sess.token != token {
+		return session{}, errSessionMismatch
+	}
+	return *sess, nil
+}
+
+// Resume reattaches a reconnecting tunnel to its session
+func (s *SessionStore) Resume(clientID, token string) (session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	sess, ok := s.sessions[clientID]
+	if !ok {
+		return session{}, errSessionNotFound
+	}
+	if sess.token != token {
+		return session{}, errSessionMismatch
+	}
+	sess.disconnectedAt = time.Time{}
+	return *sess, nil
+}
+
+// Disconnect starts the grace period of the client's session
+func (s *SessionStore) Disconnect(clientID string, healthy bool, counters *traffic.Counters) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[clientID]; ok && sess.disconnectedAt.IsZero() {
+		sess.healthy = healthy
+		sess.traffic = counters
+		sess.disconnectedAt = time.Now()
+	}
+}
+
+// Remove ends the client's session so its token can no longer be resumed
+func (s *SessionStore) Remove(clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, clientID)
+}
+
+// Pending reports whether a disconnected client of the tenant is expected
+// back on a path matching the request
+func (s *SessionStore) Pending(tenant, path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	for _, sess := range s.sessions {
+		if !sess.disconnectedAt.IsZero() && sess.tenant == tenant && pathMatches(sess.path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SessionStore) expireLocked() {
+	for clientID, sess := range s.sessions {
+		if !sess.disconnectedAt.IsZero() && time.Since(sess.disconnectedAt) > s.grace {
+			delete(s.sessions, clientID)
+			log.Printf("Session for client %s expired", clientID)
+		}
+	}
+}
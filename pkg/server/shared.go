@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/vikasavn/attachcloudip/pkg/sniff"
+)
+
+// startSharedPort serves plain HTTP, HTTPS when TLS is enabled, and raw
+// tunnel connections on one port, telling them apart by their first bytes
+func (s *Server) startSharedPort(config *Config, port int) error {
+	listener, err := s.listenPublic(s.bindAddresses.shared, port, s.listenSettings.public)
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %v", port, err)
+	}
+	s.track(listener)
+	mux := sniff.New(listener)
+
+	plain := s.tcpmanager.TrackConnections(s.admissionController.Listener(mux.Listener(sniff.HTTP)))
+	plainServer := s.serve(s.httpHandler(config))
+	go func() {
+		if err := plainServer.Serve(plain); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Shared port: HTTP server stopped: %v", err)
+			s.readiness.SetNotReady("shared", err.Error())
+		}
+	}()
+	if s.certStore != nil {
+		secure := tls.NewListener(s.tcpmanager.TrackConnections(s.withPassthrough(config, s.admissionController.Listener(mux.Listener(sniff.TLS)))), s.frontendTLSConfig())
+		secureServer := s.serve(s.httpsHandler(config))
+		go func() {
+			if err := secureServer.Serve(secure); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Shared port: HTTPS server stopped: %v", err)
+				s.readiness.SetNotReady("shared", err.Error())
+			}
+		}()
+	} else if config.Server.TCPTunnels.PortMax != 0 {
+		// TLS is only passed through to raw TCP tunnels
+		go refuseTerminated(s.withPassthrough(config, s.admissionController.Listener(mux.Listener(sniff.TLS))))
+	}
+	go s.tcpmanager.ServeListener(mux.Listener(sniff.Tunnel))
+
+	log.Printf("Shared port %d serving HTTP, HTTPS, and tunnels...", port)
+	s.readiness.SetReady("shared")
+	go func() {
+		if err := mux.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Shared port %d stopped: %v", port, err)
+			s.readiness.SetNotReady("shared", err.Error())
+		}
+	}()
+	return nil
+}
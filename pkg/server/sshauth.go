@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/sshkey"
+)
+
+// sshChallengeTTL is how long a registration challenge can be answered
+const sshChallengeTTL = time.Minute
+
+// Caps on outstanding challenges, since anyone can ask for one
+const (
+	maxChallengesPerClient = 8
+	maxChallenges          = 4096
+)
+
+// errTooManyChallenges is returned by Challenge once a cap is reached
+var errTooManyChallenges = errors.New("too many outstanding SSH challenges")
+
+// SSHIdentity authenticates registrations by SSH keys: clients sign a
+// server-issued challenge with a private key whose public key is listed for
+// their client ID
+type SSHIdentity struct {
+	keys map[string][]*sshkey.PublicKey // Client ID -> authorized keys
+	// challenges are outstanding nonces by value, each answerable once
+	challenges map[string]sshChallenge
+	// tickets let the tunnel connections of a registered client in
+	tickets map[string]string
+	mu      sync.Mutex
+}
+
+type sshChallenge struct {
+	clientID string
+	expires  time.Time
+}
+
+func NewSSHIdentity() *SSHIdentity {
+	return &SSHIdentity{
+		keys:       make(map[string][]*sshkey.PublicKey),
+		challenges: make(map[string]sshChallenge),
+		tickets:    make(map[string]string),
+	}
+}
+
+// Configure loads the authorized keys from the inline list and the
+// authorized_keys file, whose key comments name the client IDs
+func (s *SSHIdentity) Configure(config *Config) error {
+	identity := config.Server.Identity
+	keys := make(map[string][]*sshkey.PublicKey)
+	for _, entry := range identity.SSHKeys {
+		if entry.ClientID == "" {
+			return fmt.Errorf("ssh_keys entries need a client_id")
+		}
+		key, err := sshkey.ParseAuthorizedKey(entry.PublicKey)
+		if err != nil {
+			return fmt.Errorf("invalid SSH key for client %s: %v", entry.ClientID, err)
+		}
+		keys[entry.ClientID] = append(keys[entry.ClientID], key)
+	}
+
+	if path := identity.SSHAuthorizedKeys; path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to read SSH authorized keys: %v", err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			key, err := sshkey.ParseAuthorizedKey(text)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			if key.Comment == "" {
+				return fmt.Errorf("%s:%d: key has no comment naming its client ID", path, line)
+			}
+			keys[key.Comment] = append(keys[key.Comment], key)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read SSH authorized keys: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	if len(keys) > 0 {
+		log.Printf("Registrations require SSH key signatures, %d client IDs have keys", len(keys))
+	}
+	return nil
+}
+
+// Enabled reports whether registrations must be signed
+func (s *SSHIdentity) Enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys) > 0
+}
+
+// Challenge issues a nonce for clientID to sign, refusing once clientID or
+// all clients together have too many unanswered ones
+func (s *SSHIdentity) Challenge(clientID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	outstanding := 0
+	for value, c := range s.challenges {
+		if now.After(c.expires) {
+			delete(s.challenges, value)
+		} else if c.clientID == clientID {
+			outstanding++
+		}
+	}
+	if outstanding >= maxChallengesPerClient || len(s.challenges) >= maxChallenges {
+		return "", errTooManyChallenges
+	}
+	nonce := randomNonce()
+	s.challenges[nonce] = sshChallenge{clientID: clientID, expires: now.Add(sshChallengeTTL)}
+	return nonce, nil
+}
+
+// Authorize checks a signature over a challenge issued to clientID, using up
+// the challenge, and returns the ticket its tunnel connections present
+func (s *SSHIdentity) Authorize(clientID, nonce, signature string) (string, error) {
+	if nonce == "" || signature == "" {
+		return "", fmt.Errorf("registration must be signed with the client's SSH key")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge, ok := s.challenges[nonce]
+	if ok {
+		delete(s.challenges, nonce)
+	}
+	if !ok || challenge.clientID != clientID || time.Now().After(challenge.expires) {
+		return "", fmt.Errorf("unknown or expired SSH challenge, request a new one")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid SSH signature encoding")
+	}
+	keys := s.keys[clientID]
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no SSH key is authorized for client %s", clientID)
+	}
+	message := sshRegistrationMessage(clientID, nonce)
+	for _, key := range keys {
+		if sshkey.Verify(key, message, sig) == nil {
+			ticket := randomNonce()
+			s.tickets[clientID] = ticket
+			log.Printf("Client %s proved SSH key %s", clientID, key.Fingerprint())
+			return ticket, nil
+		}
+	}
+	return "", fmt.Errorf("SSH signature doesn't match an authorized key of client %s", clientID)
+}
+
+// AuthorizeTunnel checks the ticket of a tunnel connection for clientID
+func (s *SSHIdentity) AuthorizeTunnel(clientID, ticket string) error {
+	if !s.Enabled() {
+		return nil
+	}
+	s.mu.Lock()
+	expected, ok := s.tickets[clientID]
+	s.mu.Unlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(ticket)) != 1 {
+		return fmt.Errorf("tunnel has no ticket from an SSH-signed registration")
+	}
+	return nil
+}
+
+// Forget drops the ticket and outstanding challenges of clientID, so its
+// tunnels need a fresh signed registration
+func (s *SSHIdentity) Forget(clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tickets, clientID)
+	for value, c := range s.challenges {
+		if c.clientID == clientID {
+			delete(s.challenges, value)
+		}
+	}
+}
+
+// sshRegistrationMessage is what clients sign, bound to the purpose and
+// client ID so signatures can't be replayed elsewhere
+func sshRegistrationMessage(clientID, nonce string) []byte {
+	return []byte("attachcloudip-register\n" + clientID + "\n" + nonce)
+}
+
+func randomNonce() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// RegisterChallenge issues an SSH challenge for the client ID in ?client_id=
+func (s *Server) RegisterChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.sshIdentity.Enabled() {
+		http.Error(w, "SSH key identity is not enabled on this server", http.StatusNotFound)
+		return
+	}
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" {
+		http.Error(w, "client_id is required", http.StatusBadRequest)
+		return
+	}
+	nonce, err := s.sshIdentity.Challenge(clientID)
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(sshChallengeTTL/time.Second)))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Nonce     string `json:"nonce"`
+		ExpiresIn int    `json:"expires_in"`
+	}{nonce, int(sshChallengeTTL / time.Second)})
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/sshkey"
+	"gopkg.in/yaml.v2"
+)
+
+// ed25519AuthorizedKey returns the authorized_keys line of key
+func ed25519AuthorizedKey(key ed25519.PublicKey, comment string) string {
+	var wire []byte
+	for _, field := range [][]byte{[]byte("ssh-ed25519"), key} {
+		wire = binary.BigEndian.AppendUint32(wire, uint32(len(field)))
+		wire = append(wire, field...)
+	}
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(wire) + " " + comment
+}
+
+// newTestIdentity configures an SSHIdentity with one key for client-a and
+// returns it with the key's private half
+func newTestIdentity(t *testing.T) (*SSHIdentity, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config Config
+	text := fmt.Sprintf("server:\n  identity:\n    ssh_keys:\n      - client_id: client-a\n        public_key: %q\n", ed25519AuthorizedKey(public, "laptop"))
+	if err := yaml.Unmarshal([]byte(text), &config); err != nil {
+		t.Fatal(err)
+	}
+	identity := NewSSHIdentity()
+	if err := identity.Configure(&config); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	if !identity.Enabled() {
+		t.Fatal("identity not enabled with a key configured")
+	}
+	return identity, private
+}
+
+// sign answers a challenge for clientID with key
+func sign(t *testing.T, key ed25519.PrivateKey, clientID, nonce string) string {
+	t.Helper()
+	signature, err := sshkey.Sign(key, sshRegistrationMessage(clientID, nonce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestSSHIdentityAuthorize(t *testing.T) {
+	identity, key := newTestIdentity(t)
+	nonce, err := identity.Challenge("client-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket, err := identity.Authorize("client-a", nonce, sign(t, key, "client-a", nonce))
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if err := identity.AuthorizeTunnel("client-a", ticket); err != nil {
+		t.Fatalf("AuthorizeTunnel: %v", err)
+	}
+	if identity.AuthorizeTunnel("client-a", "guess") == nil || identity.AuthorizeTunnel("client-b", ticket) == nil {
+		t.Fatal("AuthorizeTunnel accepted a ticket that wasn't issued to the client")
+	}
+
+	identity.Forget("client-a")
+	if identity.AuthorizeTunnel("client-a", ticket) == nil {
+		t.Fatal("AuthorizeTunnel accepted the ticket of a forgotten client")
+	}
+}
+
+func TestSSHIdentityRefuses(t *testing.T) {
+	identity, key := newTestIdentity(t)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := func(clientID string) string {
+		t.Helper()
+		nonce, err := identity.Challenge(clientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nonce
+	}
+
+	tests := []struct {
+		name     string
+		clientID string
+		answer   func() (nonce, signature string)
+	}{
+		{"unsigned", "client-a", func() (string, string) { return challenge("client-a"), "" }},
+		{"no nonce", "client-a", func() (string, string) { return "", sign(t, key, "client-a", "") }},
+		{"unknown nonce", "client-a", func() (string, string) { return "made-up", sign(t, key, "client-a", "made-up") }},
+		{"bad encoding", "client-a", func() (string, string) { return challenge("client-a"), "not base64!" }},
+		{"bad signature", "client-a", func() (string, string) {
+			return challenge("client-a"), base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))
+		}},
+		{"signed by another key", "client-a", func() (string, string) {
+			nonce := challenge("client-a")
+			return nonce, sign(t, otherKey, "client-a", nonce)
+		}},
+		{"signed for another nonce", "client-a", func() (string, string) {
+			nonce := challenge("client-a")
+			return nonce, sign(t, key, "client-a", challenge("client-a"))
+		}},
+		{"signed for another client", "client-a", func() (string, string) {
+			nonce := challenge("client-a")
+			return nonce, sign(t, key, "client-b", nonce)
+		}},
+		{"nonce of another client", "client-a", func() (string, string) {
+			nonce := challenge("client-b")
+			return nonce, sign(t, key, "client-a", nonce)
+		}},
+		{"client without keys", "client-b", func() (string, string) {
+			nonce := challenge("client-b")
+			return nonce, sign(t, key, "client-b", nonce)
+		}},
+	}
+	for _, tt := range tests {
+		nonce, signature := tt.answer()
+		if _, err := identity.Authorize(tt.clientID, nonce, signature); err == nil {
+			t.Errorf("%s: Authorize accepted the registration", tt.name)
+		}
+	}
+}
+
+func TestSSHIdentityNonceUsedOnce(t *testing.T) {
+	identity, key := newTestIdentity(t)
+	nonce, err := identity.Challenge("client-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := sign(t, key, "client-a", nonce)
+	if _, err := identity.Authorize("client-a", nonce, signature); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := identity.Authorize("client-a", nonce, signature); err == nil {
+		t.Fatal("Authorize accepted a reused nonce")
+	}
+
+	// A failed answer uses the nonce up as well
+	nonce, err = identity.Challenge("client-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := identity.Authorize("client-a", nonce, "bm90IGEgc2lnbmF0dXJl"); err == nil {
+		t.Fatal("Authorize accepted a bad signature")
+	}
+	if _, err := identity.Authorize("client-a", nonce, sign(t, key, "client-a", nonce)); err == nil {
+		t.Fatal("Authorize accepted a nonce after a failed answer")
+	}
+}
+
+func TestSSHIdentityNonceExpires(t *testing.T) {
+	identity, key := newTestIdentity(t)
+	nonce, err := identity.Challenge("client-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity.mu.Lock()
+	challenge := identity.challenges[nonce]
+	challenge.expires = time.Now().Add(-time.Second)
+	identity.challenges[nonce] = challenge
+	identity.mu.Unlock()
+
+	if _, err := identity.Authorize("client-a", nonce, sign(t, key, "client-a", nonce)); err == nil {
+		t.Fatal("Authorize accepted an expired nonce")
+	}
+}
+
+func TestSSHIdentityChallengeLimits(t *testing.T) {
+	identity, _ := newTestIdentity(t)
+	for i := 0; i < maxChallengesPerClient; i++ {
+		if _, err := identity.Challenge("client-a"); err != nil {
+			t.Fatalf("challenge %d: %v", i, err)
+		}
+	}
+	if _, err := identity.Challenge("client-a"); !errors.Is(err, errTooManyChallenges) {
+		t.Fatalf("challenge past the limit = %v, want %v", err, errTooManyChallenges)
+	}
+	if _, err := identity.Challenge("client-b"); err != nil {
+		t.Fatalf("another client's challenge: %v", err)
+	}
+	identity.Forget("client-a")
+	if _, err := identity.Challenge("client-a"); err != nil {
+		t.Fatalf("challenge after Forget: %v", err)
+	}
+}
+
+func TestSSHIdentityConfigure(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	valid := write("valid", "# team keys\n\n"+ed25519AuthorizedKey(public, "client-c")+"\n")
+	var config Config
+	config.Server.Identity.SSHAuthorizedKeys = valid
+	identity := NewSSHIdentity()
+	if err := identity.Configure(&config); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	if len(identity.keys["client-c"]) != 1 {
+		t.Fatalf("keys = %v, want one for client-c", identity.keys)
+	}
+
+	for name, content := range map[string]string{
+		"no comment": ed25519AuthorizedKey(public, "") + "\n",
+		"bad key":    "ssh-ed25519 AAAA client-d\n",
+	} {
+		config.Server.Identity.SSHAuthorizedKeys = write(name, content)
+		if err := NewSSHIdentity().Configure(&config); err == nil {
+			t.Errorf("%s: Configure accepted the authorized keys", name)
+		}
+	}
+	config.Server.Identity.SSHAuthorizedKeys = filepath.Join(dir, "missing")
+	if err := NewSSHIdentity().Configure(&config); err == nil {
+		t.Error("Configure accepted a missing authorized keys file")
+	}
+}
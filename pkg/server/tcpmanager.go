@@ -0,0 +1,1381 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/balancer"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/middleware"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/recording"
+	"github.com/vikasavn/attachcloudip/pkg/registry"
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// proxyTimeout bounds how long a proxied request waits without hearing from
+// the client, unless its profile sets a timeout. Clients send keepalives while their upstream is slow to answer
+// and between the chunks of a streamed response, so those can run for longer.
+const proxyTimeout = 30 * time.Second
+
+// handshakeTimeout bounds how long a new tunnel connection may take to send
+// its registration
+const handshakeTimeout = 10 * time.Second
+
+// historyRetention is how long the history of a disconnected client is kept
+const historyRetention = 24 * time.Hour
+
+// staleInterval is how often clients are checked for missed heartbeats
+const staleInterval = time.Second
+
+// pendingRequest receives the client's messages about one proxied request
+type pendingRequest struct {
+	clientID  string               // The client the request went to, the only one heard about it
+	responses chan *types.Response // The response, then the chunks of a streamed body
+	alive     chan struct{}        // Keepalives while the client waits on its upstream
+	done      chan struct{}        // Closed once the request is finished with
+	timeout   time.Duration        // How long to wait without hearing from the client
+	// upload tracks the chunks of a streamed request body, nil for others
+	upload *pendingUpload
+}
+
+var (
+	errNoClient        = errors.New("no client found")
+	errNoHealthyClient = errors.New("no healthy client found")
+	errClientBusy      = errors.New("client has too many requests in flight")
+	errRequestTimeout  = errors.New("timed out waiting for client response")
+	errRequestDeadline = errors.New("request passed its deadline")
+	errTunnelPaused    = errors.New("tunnel is paused")
+)
+
+type clientInfo struct {
+	conn       net.Conn
+	path       string
+	extraPaths []string // Paths added at runtime, routed like path
+	clientID   string
+	lastActive time.Time
+	// connectedAt is when the tunnel registered, for metering connection time
+	connectedAt time.Time
+	healthy     bool
+	weight      int
+	inFlight    chan struct{} // Slots for concurrent proxied requests, nil if unlimited
+	queued      *atomic.Int64 // Requests waiting for one of the slots
+	tenant      string
+	traffic     *traffic.Counters
+	rtt         *traffic.RTT        // Rolling average of heartbeat round trips reported by the client
+	metadata    map[string]string   // Latest metrics reported with heartbeats, copied on update
+	transport   *protocol.Transport // Codec negotiated at registration
+	conditions  routing.Conditions  // Requests the client's path is limited to
+	shadow      bool                // Receives copies of the path's traffic, never the requests themselves
+	class       string              // QoS priority class, "" for the default one
+	history     *registry.History   // Kept across the client's reconnects
+	tcpPort     int                 // Public port of a raw TCP tunnel, which has no routes
+}
+
+type TCPManager struct {
+	srv       *Server
+	listener  *net.Listener
+	clients   map[string]clientInfo        // Map client ID to client info
+	routes    map[string]*routing.Table    // Map tenant to the paths of its connected clients
+	mirrors   map[string]*routing.Table    // Map tenant to the paths of its shadow clients
+	histories map[string]*registry.History // Map client ID to its history, kept while it is disconnected
+	Ports     []int
+	waiters   map[string]*pendingRequest // Map request ID to pending request
+	waitersMu sync.Mutex
+	// maxInFlight caps each client's concurrent requests, unless
+	// inFlightOverrides has an entry for the client ID, and busyStatus
+	// answers those that waited queueTimeout for a slot in vain
+	maxInFlight       int
+	inFlightOverrides map[string]int
+	queueTimeout      time.Duration
+	busyStatus        int
+	tlsConfig         *tls.Config
+	// compressMinSize is the smallest request compressed for clients that
+	// negotiated compression
+	compressMinSize int
+	// bandwidth caps each tunnel's bytes per second each way, unless
+	// bandwidthOverrides has an entry for the client ID
+	bandwidth          int64
+	bandwidthOverrides map[string]int64
+	conns              map[string]*publicConn // Map connection ID to open public connection
+	connsByIP          map[string]int         // Map source IP to its open public connections, when limited
+	maxConnsPerIP      int
+	rejectedPerIP      atomic.Int64
+	connsMu            sync.Mutex
+	// connectionRate limits new tunnel connections per source IP, nil if
+	// unlimited, and maxHandshakes those not yet registered
+	connectionRate    middleware.Limiter
+	maxHandshakes     int64
+	handshakes        atomic.Int64
+	droppedRate       atomic.Int64
+	droppedHandshakes atomic.Int64
+	// configRevision numbers the configuration updates pushed to clients
+	configRevision atomic.Int64
+	// staleTimeout drops clients that sent no heartbeat for that long, 0 never
+	staleTimeout time.Duration
+	sync.RWMutex
+}
+
+func NewTCPManager(srv *Server) *TCPManager {
+	return &TCPManager{
+		srv:       srv,
+		clients:   make(map[string]clientInfo),
+		routes:    make(map[string]*routing.Table),
+		mirrors:   make(map[string]*routing.Table),
+		histories: make(map[string]*registry.History),
+		waiters:   make(map[string]*pendingRequest),
+		conns:     make(map[string]*publicConn),
+		connsByIP: make(map[string]int),
+	}
+}
+
+// SetClientLimits caps the number of concurrent proxied requests per client,
+// with per-client overrides. Zero is unlimited. Requests beyond the limit
+// wait up to queueTimeout for a free slot, then get busyStatus.
+func (m *TCPManager) SetClientLimits(maxInFlight int, overrides map[string]int, queueTimeout time.Duration, busyStatus int) {
+	m.Lock()
+	defer m.Unlock()
+	m.maxInFlight = maxInFlight
+	m.inFlightOverrides = overrides
+	m.queueTimeout = queueTimeout
+	m.busyStatus = busyStatus
+}
+
+// maxInFlightLocked returns the cap on the client's concurrent requests
+func (m *TCPManager) maxInFlightLocked(clientID string) int {
+	if limit, ok := m.inFlightOverrides[clientID]; ok {
+		return limit
+	}
+	return m.maxInFlight
+}
+
+// clientBusyStatus is the status of requests turned away for a client's
+// in-flight limit
+func (m *TCPManager) clientBusyStatus() int {
+	m.RLock()
+	defer m.RUnlock()
+	if m.busyStatus == 0 {
+		return http.StatusServiceUnavailable
+	}
+	return m.busyStatus
+}
+
+// SetConnectionLimits limits new tunnel connections to perSecond per source
+// IP with bursts of burst, and the connections that haven't sent their
+// registration yet to maxHandshakes. Zero values are unlimited.
+func (m *TCPManager) SetConnectionLimits(perSecond float64, burst, maxHandshakes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.connectionRate = nil
+	if perSecond > 0 {
+		if burst < 1 {
+			burst = int(math.Ceil(perSecond))
+		}
+		m.connectionRate = middleware.NewLocalLimiter(perSecond, burst)
+	}
+	m.maxHandshakes = int64(maxHandshakes)
+}
+
+// admitConnection takes a handshake slot for a new tunnel connection, unless
+// there are too many handshakes in progress or its source IP connects too
+// often. The returned function gives the slot back once the connection has
+// registered or closed.
+func (m *TCPManager) admitConnection(conn net.Conn) (func(), bool) {
+	m.RLock()
+	rate, maxHandshakes := m.connectionRate, m.maxHandshakes
+	m.RUnlock()
+
+	if n := m.handshakes.Add(1); maxHandshakes > 0 && n > maxHandshakes {
+		m.handshakes.Add(-1)
+		m.droppedHandshakes.Add(1)
+		logging.Debugf("TCP Manager: Dropping connection, %d handshakes already in progress", maxHandshakes)
+		return nil, false
+	}
+	var once sync.Once
+	release := func() { once.Do(func() { m.handshakes.Add(-1) }) }
+
+	if rate != nil {
+		ip := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if _, ok := rate.Allow(context.Background(), ip); !ok {
+			release()
+			m.droppedRate.Add(1)
+			logging.Debugf("TCP Manager: Dropping connection from %s, over its connection rate", ip)
+			return nil, false
+		}
+	}
+	return release, true
+}
+
+// SetBandwidth caps the bytes per second each tunnel carries in either
+// direction, with per-client overrides. Zero is unlimited.
+func (m *TCPManager) SetBandwidth(bytesPerSecond int64, overrides map[string]int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.bandwidth = bytesPerSecond
+	m.bandwidthOverrides = overrides
+}
+
+// bandwidthFor returns the cap of the client's tunnel, taking the cap of its
+// priority class over the server-wide one
+func (m *TCPManager) bandwidthFor(clientID, class string) int64 {
+	m.RLock()
+	defer m.RUnlock()
+	if limit, ok := m.bandwidthOverrides[clientID]; ok {
+		return limit
+	}
+	if limit := m.srv.classBandwidth(class); limit > 0 {
+		return limit
+	}
+	return m.bandwidth
+}
+
+// SetCompressMinSize sets the smallest request payload compressed on the tunnel
+func (m *TCPManager) SetCompressMinSize(size int) {
+	m.compressMinSize = size
+}
+
+// SetTLSConfig makes the tunnel listener require TLS with the given config
+func (m *TCPManager) SetTLSConfig(config *tls.Config) {
+	m.tlsConfig = config
+}
+
+func (m *TCPManager) StartListener(port int) error {
+	log.Printf("Starting TCP listener on port %d...", port)
+	listener, err := m.srv.listenPublic(m.srv.bindAddresses.registration, port, m.srv.listenSettings.tunnel)
+	if err != nil {
+		log.Printf("Failed to start TCP listener on port %d: %v", port, err)
+		return err
+	}
+	if m.tlsConfig != nil {
+		listener = tls.NewListener(listener, m.tlsConfig)
+	}
+
+	log.Printf("TCP listener started successfully on port %d", port)
+	m.listener = &listener
+	m.Ports = append(m.Ports, port)
+	return nil
+}
+
+func (m *TCPManager) AcceptConnection() (net.Conn, error) {
+	return (*m.listener).Accept()
+}
+
+// RegisterClient adds the client's tunnel, continuing the given traffic
+// counters if it resumed a session. The path is claimed under its claim
+// policy, which may reject the tunnel or evict the clients that had it.
+func (m *TCPManager) RegisterClient(clientID, path string, weight int, tenant string, conditions routing.Conditions, shadow bool, class string, conn net.Conn, counters *traffic.Counters, transport *protocol.Transport, tcpPort int) ([]registry.PathClaim, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	log.Printf("Registering client ID: %s, tenant: %q, path: %s, weight: %d, shadow: %t", clientID, tenant, path, weight, shadow)
+	claims, err := m.claimLocked(clientID, tenant, shadow, []string{path})
+	if err != nil {
+		return nil, err
+	}
+	m.evictLocked(claims)
+	var inFlight chan struct{}
+	if limit := m.maxInFlightLocked(clientID); limit > 0 {
+		inFlight = make(chan struct{}, limit)
+	}
+	if counters == nil {
+		counters = traffic.NewCounters()
+	}
+	if existing, ok := m.clients[clientID]; ok {
+		m.unrouteLocked(existing)
+		m.srv.publishTunnel(existing, false, "replaced")
+	}
+	m.pruneHistoriesLocked()
+	history, ok := m.histories[clientID]
+	if !ok {
+		history = registry.NewHistory()
+		m.histories[clientID] = history
+	}
+	history.Connected(conn.RemoteAddr().String(), counters)
+	client := clientInfo{
+		conn:        conn,
+		path:        path,
+		clientID:    clientID,
+		lastActive:  time.Now(),
+		connectedAt: time.Now(),
+		healthy:     true,
+		weight:      weight,
+		inFlight:    inFlight,
+		queued:      new(atomic.Int64),
+		tenant:      tenant,
+		traffic:     counters,
+		rtt:         traffic.NewRTT(),
+		transport:   transport,
+		conditions:  conditions,
+		shadow:      shadow,
+		class:       class,
+		history:     history,
+		tcpPort:     tcpPort,
+	}
+	m.clients[clientID] = client
+	m.routeLocked(client)
+	m.srv.publishTunnel(client, true, "")
+	log.Printf("Registered client %s with path %s", clientID, path)
+	return claims, nil
+}
+
+// paths returns every path the client is routed for, its first one first
+func (c clientInfo) paths() []string {
+	return append([]string{c.path}, c.extraPaths...)
+}
+
+// tablesLocked returns the route tables the client belongs in
+func (m *TCPManager) tablesLocked(client clientInfo) map[string]*routing.Table {
+	if client.shadow {
+		return m.mirrors
+	}
+	return m.routes
+}
+
+// routeLocked adds the client to its tenant's route table
+func (m *TCPManager) routeLocked(client clientInfo) {
+	if client.tcpPort != 0 {
+		return
+	}
+	tables := m.tablesLocked(client)
+	table, ok := tables[client.tenant]
+	if !ok {
+		table = routing.NewTable()
+		tables[client.tenant] = table
+	}
+	for _, path := range client.paths() {
+		if err := table.InsertConditional(path, client.clientID, client.conditions); err != nil {
+			log.Printf("TCP Manager: Not routing %s to client %s: %v", path, client.clientID, err)
+		}
+	}
+}
+
+// unrouteLocked removes the client from its tenant's route table
+func (m *TCPManager) unrouteLocked(client clientInfo) {
+	if client.tcpPort != 0 {
+		return
+	}
+	tables := m.tablesLocked(client)
+	table, ok := tables[client.tenant]
+	if !ok {
+		return
+	}
+	for _, path := range client.paths() {
+		table.Remove(path, client.clientID)
+	}
+	if table.Len() == 0 {
+		delete(tables, client.tenant)
+	}
+}
+
+// SetClientHealth records the health of the client's local upstream
+func (m *TCPManager) SetClientHealth(clientID string, healthy bool) {
+	m.Lock()
+	defer m.Unlock()
+	if client, exists := m.clients[clientID]; exists {
+		changed := client.healthy != healthy
+		client.healthy = healthy
+		m.clients[clientID] = client
+		log.Printf("Client %s upstream healthy: %v", clientID, healthy)
+		if changed {
+			status := "healthy"
+			if !healthy {
+				status = "unhealthy"
+			}
+			m.srv.publishStatus(clientID, client.tenant, client.path, status)
+		}
+	}
+}
+
+// SetClientMetrics records the metrics the client sent with its heartbeat,
+// keeping earlier values of metrics it left out
+func (m *TCPManager) SetClientMetrics(clientID string, metrics map[string]string) {
+	m.Lock()
+	defer m.Unlock()
+	if client, exists := m.clients[clientID]; exists {
+		merged := make(map[string]string, len(client.metadata)+len(metrics))
+		for name, value := range client.metadata {
+			merged[name] = value
+		}
+		for name, value := range metrics {
+			merged[name] = value
+		}
+		client.metadata = merged
+		m.clients[clientID] = client
+	}
+}
+
+func (m *TCPManager) UpdateClientActivity(clientID string) {
+	m.Lock()
+	defer m.Unlock()
+	if client, exists := m.clients[clientID]; exists {
+		client.lastActive = time.Now()
+		m.clients[clientID] = client
+		logging.Debugf("Updated activity for client %s", clientID)
+	}
+}
+
+// RemoveClient closes the client's tunnel and reports whether it was connected
+func (m *TCPManager) RemoveClient(clientID string) bool {
+	m.Lock()
+	defer m.Unlock()
+	client, exists := m.clients[clientID]
+	if exists {
+		client.conn.Close()
+		m.srv.metered.observe(client, time.Now())
+		delete(m.clients, clientID)
+		m.unrouteLocked(client)
+		m.srv.sessions.Disconnect(clientID, client.healthy, client.traffic)
+		client.history.Disconnected("removed")
+		m.srv.closeOutbox(clientID)
+		m.srv.closeTCPTunnel(clientID, true)
+		m.srv.publishTunnel(client, false, "removed")
+		log.Printf("Removed client %s", clientID)
+	}
+	m.srv.sshIdentity.Forget(clientID)
+	return exists
+}
+
+// CloseTunnels closes the tunnel connections of every client, which detach
+// as their reads fail
+func (m *TCPManager) CloseTunnels() {
+	m.Lock()
+	conns := make([]net.Conn, 0, len(m.clients))
+	for _, client := range m.clients {
+		conns = append(conns, client.conn)
+	}
+	m.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// SetStaleTimeout sets how long a client may go without a heartbeat
+func (m *TCPManager) SetStaleTimeout(timeout time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.staleTimeout = timeout
+}
+
+// RemoveStale removes the clients whose last heartbeat is older than the
+// stale timeout, closing their public TCP listeners and giving their ports
+// back, and returns their IDs. Their sessions can still be resumed.
+func (m *TCPManager) RemoveStale() []string {
+	m.Lock()
+	defer m.Unlock()
+	if m.staleTimeout <= 0 {
+		return nil
+	}
+	var removed []string
+	now := time.Now()
+	for clientID, client := range m.clients {
+		if now.Sub(client.lastActive) <= m.staleTimeout {
+			continue
+		}
+		client.conn.Close()
+		m.srv.metered.observe(client, now)
+		delete(m.clients, clientID)
+		m.unrouteLocked(client)
+		m.srv.sessions.Disconnect(clientID, client.healthy, client.traffic)
+		client.history.Disconnected("stale")
+		m.srv.closeOutbox(clientID)
+		m.srv.closeTCPTunnel(clientID, true)
+		m.srv.publishTunnel(client, false, "stale")
+		log.Printf("TCP Manager: Removed stale client %s, last heartbeat %s ago", clientID, now.Sub(client.lastActive).Round(time.Second))
+		removed = append(removed, clientID)
+	}
+	return removed
+}
+
+// startStaleReaper removes stale clients until ctx is done
+func (m *TCPManager) startStaleReaper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(staleInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			m.RemoveStale()
+		}
+	}()
+}
+
+// ExpireClient tells the client its registration expired and closes its
+// tunnel without keeping a session to resume
+func (m *TCPManager) ExpireClient(clientID string) {
+	m.Lock()
+	defer m.Unlock()
+	if client, exists := m.clients[clientID]; exists {
+		m.srv.sendLine(clientID, client.conn, "expired")
+		client.conn.Close()
+		m.srv.metered.observe(client, time.Now())
+		delete(m.clients, clientID)
+		m.unrouteLocked(client)
+		m.srv.closeOutbox(clientID)
+		m.srv.closeTCPTunnel(clientID, true)
+		m.srv.publishTunnel(client, false, "expired")
+	}
+	delete(m.histories, clientID)
+	m.srv.sessions.Remove(clientID)
+	m.srv.sshIdentity.Forget(clientID)
+}
+
+// detachClient removes the client if conn is still its tunnel, leaving a
+// newer connection of a resumed session in place
+func (m *TCPManager) detachClient(clientID string, conn net.Conn) {
+	m.Lock()
+	defer m.Unlock()
+	if client, exists := m.clients[clientID]; exists && client.conn == conn {
+		m.srv.metered.observe(client, time.Now())
+		delete(m.clients, clientID)
+		m.unrouteLocked(client)
+		m.srv.sessions.Disconnect(clientID, client.healthy, client.traffic)
+		client.history.Disconnected("disconnected")
+		m.srv.closeOutbox(clientID)
+		m.srv.closeTCPTunnel(clientID, false)
+		m.srv.publishTunnel(client, false, "disconnected")
+		log.Printf("Removed client %s", clientID)
+	}
+}
+
+// pruneHistoriesLocked forgets the histories of clients that have been
+// disconnected for longer than historyRetention
+func (m *TCPManager) pruneHistoriesLocked() {
+	for clientID, history := range m.histories {
+		if _, connected := m.clients[clientID]; connected {
+			continue
+		}
+		if at := history.DisconnectedAt(); !at.IsZero() && time.Since(at) > historyRetention {
+			delete(m.histories, clientID)
+			m.srv.closeTCPTunnel(clientID, true)
+		}
+	}
+}
+
+// GetHistory returns the history of a connected or recently disconnected client
+func (m *TCPManager) GetHistory(clientID string) (*registry.History, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	history, ok := m.histories[clientID]
+	return history, ok
+}
+
+// recordError adds an error to the client's history
+func (m *TCPManager) recordError(clientID string, err error) {
+	if history, ok := m.GetHistory(clientID); ok {
+		history.RecordError(err.Error())
+	}
+}
+
+func (m *TCPManager) HandleIncomingRequests() {
+	log.Println("TCP Manager: Starting to handle incoming requests...")
+	var backoff acceptBackoff
+	for {
+		logging.Debugf("TCP Manager: Waiting for new connection...")
+		conn, err := m.AcceptConnection()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("TCP Manager: Listener closed, no longer accepting connections")
+				return
+			}
+			if !isTemporaryAcceptError(err) {
+				log.Printf("TCP Manager: Error accepting connection, no longer accepting connections: %v", err)
+				return
+			}
+			delay := backoff.next()
+			log.Printf("TCP Manager: Error accepting connection, retrying in %s: %v", delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		backoff.reset()
+
+		// handleClient logs the peer, whose address may first need a PROXY header read
+		go m.handleClient(conn)
+	}
+}
+
+// ServeListener handles tunnel connections accepted from l until it is
+// closed, like those arriving on the shared port
+func (m *TCPManager) ServeListener(l net.Listener) {
+	var backoff acceptBackoff
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if isTemporaryAcceptError(err) {
+				delay := backoff.next()
+				log.Printf("TCP Manager: Error accepting connection, retrying in %s: %v", delay, err)
+				time.Sleep(delay)
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("TCP Manager: Error accepting connection: %v", err)
+			}
+			return
+		}
+		backoff.reset()
+		go m.handleClient(conn)
+	}
+}
+
+func (m *TCPManager) handleClient(conn net.Conn) {
+	registered, ok := m.admitConnection(conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	defer registered()
+
+	// The tunnel is throttled and its bytes dumped once the client is known
+	wire := &wireConn{srv: m.srv, Conn: conn}
+	c := traffic.NewThrottledConn(wire)
+	remoteAddr := c.RemoteAddr().String()
+	log.Printf("TCP Manager: Starting client handler for connection from %s", remoteAddr)
+
+	defer func() {
+		c.Close()
+		log.Printf("TCP Manager: Connection closed for: %s", remoteAddr)
+	}()
+
+	reader := protocol.NewReader(c)
+
+	// First message should be client ID and path separated by |, followed by
+	// the session token when resuming and the client's transport options
+	logging.Debugf("TCP Manager: Waiting for registration message from %s", remoteAddr)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	initialMsg, err := reader.ReadLine()
+	conn.SetReadDeadline(time.Time{})
+	registered()
+	if err != nil {
+		log.Printf("TCP Manager: Error reading registration message from %s: %v", remoteAddr, err)
+		return
+	}
+
+	// Raw TCP tunnels open a connection per stream (format: "stream|<stream id>")
+	if id, ok := strings.CutPrefix(initialMsg, "stream|"); ok {
+		m.attachStream(id, c, reader.Remaining())
+		return
+	}
+
+	// Parse client ID and path from first message (format: "clientID|path[|token[|options]]")
+	parts := strings.Split(initialMsg, "|")
+	if len(parts) < 2 || len(parts) > 4 {
+		log.Printf("TCP Manager: Invalid registration format from %s. Expected 'clientID|path[|token[|options]]', got: %s", remoteAddr, initialMsg)
+		return
+	}
+	log.Printf("TCP Manager: Received registration message from %s: '%s|%s'", remoteAddr, parts[0], parts[1])
+
+	clientID := strings.TrimSpace(parts[0])
+	path := strings.TrimSpace(parts[1])
+	wire.clientID.Store(clientID)
+	token := ""
+	if len(parts) >= 3 {
+		token = strings.TrimSpace(parts[2])
+	}
+	// Options negotiate the transport as a query string, e.g. "codec=msgpack,json",
+	// and carry the registration of clients that skip HTTP registration
+	var offer url.Values
+	if len(parts) == 4 {
+		if offer, err = url.ParseQuery(parts[3]); err != nil {
+			log.Printf("TCP Manager: Invalid registration options from %s: %v", remoteAddr, err)
+			return
+		}
+	}
+	transport, accepted, err := protocol.NegotiateTransport(offer)
+	var incompatible *protocol.IncompatibleError
+	if errors.As(err, &incompatible) {
+		log.Printf("TCP Manager: Refusing client %s from %s: %v", clientID, remoteAddr, err)
+		c.Write([]byte("incompatible|" + incompatible.Detail + "\n"))
+		return
+	}
+	if err != nil {
+		log.Printf("TCP Manager: Failed to negotiate transport with %s: %v", remoteAddr, err)
+		c.Write([]byte("unauthorized\n"))
+		return
+	}
+	transport.CompressMinSize = m.compressMinSize
+
+	// Remove any newlines from path
+	path = strings.ReplaceAll(path, "\n", "")
+	// Regular expressions are escaped since they may contain '|'
+	if routing.IsRegex(path) {
+		if path, err = url.PathUnescape(path); err != nil {
+			log.Printf("TCP Manager: Invalid registration from %s: bad path escaping: %v", remoteAddr, err)
+			return
+		}
+	}
+
+	if clientID == "" || path == "" {
+		log.Printf("TCP Manager: Invalid registration from %s: empty clientID or path. Message: %s", remoteAddr, initialMsg)
+		return
+	}
+	if err := routing.Validate(path); err != nil {
+		log.Printf("TCP Manager: Invalid registration from %s: %v", remoteAddr, err)
+		c.Write([]byte("unauthorized\n"))
+		return
+	}
+
+	if err := m.srv.authorizeTunnel(conn, clientID); err != nil {
+		log.Printf("TCP Manager: Refusing registration for client %s from %s: %v", clientID, remoteAddr, err)
+		c.Write([]byte("unauthorized\n"))
+		return
+	}
+	if err := m.srv.sshIdentity.AuthorizeTunnel(clientID, offer.Get("ticket")); err != nil {
+		log.Printf("TCP Manager: Refusing registration for client %s from %s: %v", clientID, remoteAddr, err)
+		c.Write([]byte("unauthorized\n"))
+		return
+	}
+	if err := m.srv.allowPaths(clientID, []string{path}); err != nil {
+		log.Printf("TCP Manager: Refusing registration for client %s from %s: %v", clientID, remoteAddr, err)
+		c.Write([]byte("unauthorized\n"))
+		return
+	}
+
+	// Clients bootstrapping on a single connection register here instead of over HTTP
+	if offer.Get("register") == "1" {
+		if err := m.srv.bootstrapClient(clientID, path, offer); err != nil {
+			log.Printf("TCP Manager: Refusing registration for client %s from %s: %v", clientID, remoteAddr, err)
+			c.Write([]byte("unauthorized\n"))
+			return
+		}
+	}
+
+	log.Printf("TCP Manager: Registering client. ID: %s, Path: %s, Address: %s, Protocol: %d", clientID, path, remoteAddr, transport.Version)
+	// Use the weight and tenant from HTTP registration, defaulting to weight 1
+	weight := 1
+	tenant := defaultTenant
+	var conditions routing.Conditions
+	shadow := false
+	class := ""
+	if registered := m.srv.clientManager.GetClient(clientID); registered != nil {
+		if registered.Weight > 0 {
+			weight = registered.Weight
+		}
+		tenant = registered.Tenant
+		conditions = routing.Conditions{Methods: registered.Methods, Headers: registered.Headers, ALPN: registered.ALPN}
+		shadow = registered.Shadow
+		class = registered.Class
+	} else if m.srv.tenants.Enabled() {
+		log.Printf("TCP Manager: Refusing unregistered client %s from %s", clientID, remoteAddr)
+		c.Write([]byte("unauthorized\n"))
+		return
+	}
+
+	// Resume the previous session so the client keeps its path claim and
+	// health. A new one is only started when the client ID has none, so a
+	// connection without the token can't take over a live or resumable
+	// session.
+	port := localPort(c)
+	healthy := true
+	var counters *traffic.Counters
+	sess, err := m.srv.sessions.Resume(clientID, token)
+	resumed := true
+	switch {
+	case errors.Is(err, errSessionNotFound):
+		token = m.srv.sessions.Issue(clientID, tenant, path, port)
+		resumed = false
+	case err != nil || sess.tenant != tenant:
+		log.Printf("TCP Manager: Refusing session resumption for client %s from %s: %v", clientID, remoteAddr, errSessionMismatch)
+		c.Write([]byte("unauthorized\n"))
+		return
+	default:
+		if sess.path != path {
+			log.Printf("TCP Manager: Client %s resumed with path %s, keeping session path %s", clientID, path, sess.path)
+		}
+		if sess.port != port {
+			log.Printf("TCP Manager: Client %s resumed on port %d instead of %d", clientID, port, sess.port)
+		}
+		path, healthy, counters = sess.path, sess.healthy, sess.traffic
+		log.Printf("TCP Manager: Resumed session for client %s", clientID)
+	}
+	// A refused registration mustn't leave the session marked connected
+	// with no tunnel, where it would never expire and lock the client ID out
+	abandonSession := func() {
+		if !resumed {
+			m.srv.sessions.Remove(clientID)
+		} else if _, connected := m.GetClient(clientID); !connected {
+			m.srv.sessions.Disconnect(clientID, healthy, counters)
+		}
+	}
+
+	if limit := m.bandwidthFor(clientID, class); limit > 0 {
+		c.SetRate(limit)
+		logging.Debugf("TCP Manager: Capping client %s at %d bytes per second", clientID, limit)
+	}
+	// Raw TCP tunnels are reached on a public port of their own instead of
+	// by path
+	tcpPort := 0
+	if offer.Get(protocol.TCPOption) == "1" {
+		sni := offer.Get(protocol.SNIOption)
+		if tcpPort, err = m.openTCPTunnel(clientID, sni); err != nil {
+			log.Printf("TCP Manager: Refusing raw TCP tunnel for client %s from %s: %v", clientID, remoteAddr, err)
+			if errors.Is(err, errTCPTunnelsDisabled) {
+				c.Write([]byte("incompatible|" + err.Error() + "\n"))
+			} else {
+				c.Write([]byte("conflict|" + err.Error() + "\n"))
+			}
+			abandonSession()
+			return
+		}
+		accepted.Set(protocol.TCPPortOption, strconv.Itoa(tcpPort))
+		if sni != "" {
+			accepted.Set(protocol.SNIOption, sni)
+		}
+	}
+	if _, err := m.RegisterClient(clientID, path, weight, tenant, conditions, shadow, class, c, counters, transport, tcpPort); err != nil {
+		log.Printf("TCP Manager: Refusing registration for client %s from %s: %v", clientID, remoteAddr, err)
+		if tcpPort != 0 {
+			m.srv.closeTCPTunnel(clientID, false)
+		}
+		c.Write([]byte("conflict|" + err.Error() + "\n"))
+		abandonSession()
+		return
+	}
+	if !healthy {
+		m.SetClientHealth(clientID, false)
+	}
+
+	// Send registration confirmation with the session token, and the accepted
+	// transport to clients that asked for one
+	confirmation := "registered|" + token
+	if offer != nil {
+		confirmation += "|" + accepted.Encode()
+	}
+	recorder := m.srv.startRecording(clientID, path)
+	defer m.srv.stopRecording(clientID, recorder)
+	logging.Debugf("TCP Manager: Sending registration confirmation to client %s at %s", clientID, remoteAddr)
+	_, err = m.srv.sendLine(clientID, c, confirmation)
+	if err != nil {
+		log.Printf("TCP Manager: Error sending registration confirmation to %s at %s: %v", clientID, remoteAddr, err)
+		m.detachClient(clientID, c)
+		return
+	}
+	logging.Debugf("TCP Manager: Registration confirmation sent to client %s at %s", clientID, remoteAddr)
+
+	// Handle incoming messages
+	for {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			log.Printf("TCP Manager: Error reading from client %s at %s: %v", clientID, remoteAddr, err)
+			if !errors.Is(err, io.EOF) {
+				m.recordError(clientID, fmt.Errorf("tunnel read failed: %v", err))
+			}
+			m.detachClient(clientID, c)
+			return
+		}
+		if m.srv.chaosFor(clientID).Reset() {
+			// The next read fails and detaches the client
+			resetTunnel(clientID, conn)
+			continue
+		}
+
+		message := msg.Line
+
+		// Handle proxied responses and the chunks of streamed ones (format:
+		// "response|<json>" or "chunk|<json>")
+		if kind, data, _ := strings.Cut(message, "|"); kind == "response" || kind == "chunk" {
+			if transport.Encrypted() {
+				log.Printf("TCP Manager: Ignoring unencrypted %s from client %s on an encrypted tunnel", kind, clientID)
+				continue
+			}
+			if client, ok := m.GetClient(clientID); ok {
+				client.traffic.AddReceived(msg.Size)
+			}
+			resp, err := protocol.JSONCodec{}.UnmarshalResponse([]byte(data))
+			if err != nil {
+				log.Printf("TCP Manager: Invalid response from client %s: %v", clientID, err)
+				m.recordError(clientID, fmt.Errorf("invalid response: %v", err))
+				continue
+			}
+			m.deliverResponse(clientID, resp)
+			continue
+		}
+
+		// Handle binary frames of a negotiated codec or compression
+		if frame := msg.Frame; frame != nil {
+			if frame.Kind != "response" && frame.Kind != "chunk" {
+				log.Printf("TCP Manager: Unexpected %s frame from client %s at %s", frame.Kind, clientID, remoteAddr)
+				continue
+			}
+			if client, ok := m.GetClient(clientID); ok {
+				client.traffic.AddReceived(msg.Size)
+			}
+			resp, err := transport.DecodeResponse(*frame)
+			if err != nil {
+				log.Printf("TCP Manager: Invalid response from client %s: %v", clientID, err)
+				m.recordError(clientID, fmt.Errorf("invalid response: %v", err))
+				continue
+			}
+			m.deliverResponse(clientID, resp)
+			continue
+		}
+
+		logging.Debugf("TCP Manager: Received message from client %s at %s: '%s'", clientID, remoteAddr, message)
+		recorder.Line(recording.DirectionIn, message)
+
+		// Handle heartbeat, echoing the client's timestamp so it can measure
+		// the round trip (format: "heartbeat[|<timestamp>[|<metrics>]]")
+		if message == "heartbeat" || strings.HasPrefix(message, "heartbeat|") {
+			m.UpdateClientActivity(clientID)
+			if client, ok := m.GetClient(clientID); ok {
+				client.history.RecordHeartbeat(time.Now())
+			}
+			ack := "heartbeat-ack"
+			if fields, ok := strings.CutPrefix(message, "heartbeat|"); ok {
+				sent, encoded, hasMetrics := strings.Cut(fields, "|")
+				ack += "|" + sent
+				if hasMetrics {
+					m.SetClientMetrics(clientID, parseClientMetrics(encoded))
+				}
+			}
+			if injector := m.srv.chaosFor(clientID); injector.CorruptHeartbeat() {
+				logging.Debugf("Chaos: Corrupting heartbeat-ack to client %s", clientID)
+				ack = injector.Corrupt(ack)
+			}
+			logging.Debugf("TCP Manager: Sending heartbeat-ack to client %s at %s", clientID, remoteAddr)
+			_, err := m.srv.sendLine(clientID, c, ack)
+			if err != nil {
+				log.Printf("TCP Manager: Error sending heartbeat acknowledgment to %s at %s: %v", clientID, remoteAddr, err)
+				m.detachClient(clientID, c)
+				return
+			}
+			logging.Debugf("TCP Manager: Heartbeat acknowledgment sent to %s at %s", clientID, remoteAddr)
+			continue
+		}
+
+		// Handle keepalives of requests the client is still working on
+		// (format: "pending|<request id>")
+		if requestID, ok := strings.CutPrefix(message, "pending|"); ok {
+			m.keepAlive(clientID, requestID)
+			continue
+		}
+
+		// Handle acknowledgments of streamed request body chunks
+		// (format: "body-ack|<request id>|<bytes>")
+		if data, ok := strings.CutPrefix(message, "body-ack|"); ok {
+			m.ackBody(clientID, data)
+			continue
+		}
+
+		// Handle round-trip reports for echoed heartbeats (format: "rtt|<duration>")
+		if strings.HasPrefix(message, "rtt|") {
+			rtt, err := time.ParseDuration(strings.TrimPrefix(message, "rtt|"))
+			if err != nil || rtt < 0 {
+				log.Printf("TCP Manager: Invalid round-trip report from client %s at %s: %s", clientID, remoteAddr, message)
+				continue
+			}
+			if client, ok := m.GetClient(clientID); ok {
+				client.rtt.Add(rtt)
+				client.history.RecordRTT(rtt)
+			}
+			continue
+		}
+
+		// Handle path updates (format: "update-paths|<json>")
+		if data, ok := strings.CutPrefix(message, "update-paths|"); ok {
+			m.handlePathUpdate(clientID, data)
+			continue
+		}
+
+		// Handle acknowledgments of pushed configuration (format:
+		// "config-ack|<revision>" or "config-error|<revision>|<reason>")
+		if strings.HasPrefix(message, "config-ack|") || strings.HasPrefix(message, "config-error|") {
+			m.handleConfigAck(clientID, message)
+			continue
+		}
+
+		// Handle results of remote commands (format: "command-result|<json>")
+		if data, ok := strings.CutPrefix(message, "command-result|"); ok {
+			m.handleCommandResult(clientID, data)
+			continue
+		}
+
+		// Handle streams of raw TCP tunnels the client couldn't open
+		// (format: "tcp-error|<stream id>|<reason>")
+		if data, ok := strings.CutPrefix(message, "tcp-error|"); ok {
+			m.failStream(clientID, data)
+			continue
+		}
+
+		// Handle upstream health reports (format: "health|ok" or "health|fail")
+		if strings.HasPrefix(message, "health|") {
+			m.SetClientHealth(clientID, strings.TrimPrefix(message, "health|") == "ok")
+			continue
+		}
+
+		// Handle other messages here
+		log.Printf("TCP Manager: Received other message from %s at %s: %s", clientID, remoteAddr, message)
+	}
+}
+
+// localPort returns the listener port a tunnel connection arrived on
+func localPort(c net.Conn) int {
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// GetClient returns the connected client with the given ID
+func (m *TCPManager) GetClient(clientID string) (clientInfo, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	client, ok := m.clients[clientID]
+	return client, ok
+}
+
+func (m *TCPManager) GetClients() []clientInfo {
+	m.RLock()
+	defer m.RUnlock()
+	clients := make([]clientInfo, 0, len(m.clients))
+	for _, client := range m.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// pathMatches reports whether requestPath is the registered path or below
+// it, or matches it when the registered path is a pattern
+func pathMatches(registered, requestPath string) bool {
+	if registered == "/" || registered == requestPath {
+		return true
+	}
+	return routing.Matches(registered, requestPath)
+}
+
+// negotiatedALPN returns the protocol negotiated for a request over TLS,
+// http/1.1 if the caller offered none, and "" for requests not over TLS
+func negotiatedALPN(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	if r.TLS.NegotiatedProtocol == "" {
+		return "http/1.1"
+	}
+	return r.TLS.NegotiatedProtocol
+}
+
+// selectClientForRouting picks a client of the tenant registered for the
+// most specific route matching the request whose local upstream is healthy,
+// splitting traffic according to client weights. With a hash key configured,
+// callers carrying the same key stay on the same client.
+func (m *TCPManager) selectClientForRouting(tenant string, r *http.Request) (clientInfo, error) {
+	path := r.URL.Path
+	m.RLock()
+	var matched []clientInfo
+	if table, ok := m.routes[tenant]; ok {
+		if match, ok := table.LookupRequest(path, r.Method, r.Header, negotiatedALPN(r)); ok {
+			for _, clientID := range match.IDs {
+				if client, ok := m.clients[clientID]; ok {
+					matched = append(matched, client)
+				}
+			}
+		}
+	}
+	m.RUnlock()
+
+	found := len(matched) > 0
+	var paused *clientInfo
+	candidates := make([]clientInfo, 0, len(matched))
+	totalWeight := 0
+	for _, client := range matched {
+		if isPaused, _ := m.srv.clientManager.Paused(client.clientID); isPaused {
+			paused = &client
+			continue
+		}
+		if client.healthy && client.weight > 0 {
+			candidates = append(candidates, client)
+			totalWeight += client.weight
+		}
+	}
+
+	if len(candidates) == 0 {
+		if paused != nil {
+			// The returned client tells the caller whose maintenance message to show
+			return *paused, fmt.Errorf("%w: %s", errTunnelPaused, paused.clientID)
+		}
+		if found || m.srv.sessions.Pending(tenant, path) {
+			return clientInfo{}, fmt.Errorf("%w with path %s", errNoHealthyClient, path)
+		}
+		return clientInfo{}, fmt.Errorf("%w with path %s", errNoClient, path)
+	}
+
+	if m.srv.hashKey != nil {
+		if key, ok := m.srv.hashKey(r); ok {
+			replicas := make([]balancer.Replica, len(candidates))
+			for i, client := range candidates {
+				replicas[i] = balancer.Replica{ID: client.clientID, Weight: client.weight}
+			}
+			client := candidates[balancer.Pick(key, replicas)]
+			logging.Debugf("TCP Manager: Routed %s to client %s by hash (path %s, %d candidates)",
+				path, client.clientID, client.path, len(candidates))
+			return client, nil
+		}
+	}
+
+	n := rand.Intn(totalWeight)
+	for _, client := range candidates {
+		if n < client.weight {
+			logging.Debugf("TCP Manager: Routed %s to client %s (path %s, weight %d of %d, %d candidates)",
+				path, client.clientID, client.path, client.weight, totalWeight, len(candidates))
+			return client, nil
+		}
+		n -= client.weight
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+// acquireSlot reserves one of the client's in-flight request slots, waiting
+// up to the queue timeout or until ctx is done. The returned function
+// releases the slot.
+func (m *TCPManager) acquireSlot(ctx context.Context, client clientInfo) (func(), error) {
+	if client.inFlight == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case client.inFlight <- struct{}{}:
+		return func() { <-client.inFlight }, nil
+	default:
+	}
+
+	m.RLock()
+	queueTimeout := m.queueTimeout
+	m.RUnlock()
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	client.queued.Add(1)
+	defer client.queued.Add(-1)
+
+	select {
+	case client.inFlight <- struct{}{}:
+		return func() { <-client.inFlight }, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: %s", errClientBusy, client.clientID)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("request for client %s abandoned while queued: %v", client.clientID, ctx.Err())
+	}
+}
+
+// ForwardRequest sends a request over the client's tunnel and waits for the
+// matching response. When the response is streamed, the caller must pass
+// its body on with StreamBody.
+func (m *TCPManager) ForwardRequest(ctx context.Context, client clientInfo, req *types.Request) (*types.Response, error) {
+	return m.forward(ctx, client, req, nil, 0)
+}
+
+// forward sends a request and waits for its response, streaming body to
+// the client after the request unless nil, with uploadTimeout counted from
+// when the client has read it all
+func (m *TCPManager) forward(ctx context.Context, client clientInfo, req *types.Request, body io.Reader, uploadTimeout time.Duration) (*types.Response, error) {
+	req.ID = uuid.New().String()
+	pending := &pendingRequest{
+		clientID:  client.clientID,
+		responses: make(chan *types.Response, 16),
+		alive:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		timeout:   m.srv.responseTimeout(client.clientID),
+	}
+	if body != nil {
+		req.Stream = true
+		pending.upload = &pendingUpload{
+			acked:   make(chan int, protocol.UploadWindow/protocol.UploadChunkSize+1),
+			timeout: uploadTimeout,
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("request %s abandoned: %v", req.ID, err)
+	}
+	m.waitersMu.Lock()
+	m.waiters[req.ID] = pending
+	m.waitersMu.Unlock()
+
+	n, err := m.srv.writeRequest(client, req)
+	if err != nil {
+		m.finishRequest(client, req.ID, true)
+		err = fmt.Errorf("failed to send request to client %s: %v", client.clientID, err)
+		client.history.RecordError(err.Error())
+		return nil, err
+	}
+	client.traffic.AddSent(n)
+
+	// The deadline bounds the wait for the response, not a streamed body
+	waitCtx := ctx
+	if req.Deadline != 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithDeadlineCause(ctx, time.UnixMilli(req.Deadline), errRequestDeadline)
+		defer cancel()
+	}
+	if body != nil {
+		var cancel context.CancelCauseFunc
+		waitCtx, cancel = context.WithCancelCause(waitCtx)
+		defer cancel(nil)
+		go m.sendBody(client, req.ID, pending, body, cancel)
+	}
+	resp, err := m.await(waitCtx, req.ID, pending)
+	if err != nil || !resp.Stream {
+		m.finishRequest(client, req.ID, err == nil)
+	}
+	if errors.Is(err, errRequestTimeout) {
+		client.history.RecordError(err.Error())
+	}
+	return resp, err
+}
+
+// StreamBody passes the chunks of a streamed response to write as they
+// arrive, until the client ends the stream, ctx is done, or the client goes
+// quiet for longer than its timeout
+func (m *TCPManager) StreamBody(ctx context.Context, client clientInfo, requestID string, write func([]byte) error) error {
+	m.waitersMu.Lock()
+	pending, exists := m.waiters[requestID]
+	m.waitersMu.Unlock()
+	if !exists {
+		return fmt.Errorf("no pending request %s", requestID)
+	}
+
+	for {
+		chunk, err := m.await(ctx, requestID, pending)
+		if err != nil {
+			m.finishRequest(client, requestID, false)
+			if errors.Is(err, errRequestTimeout) {
+				client.history.RecordError(err.Error())
+			}
+			return err
+		}
+		if chunk.Error != "" {
+			m.finishRequest(client, requestID, true)
+			err := fmt.Errorf("stream of request %s failed: %s", requestID, chunk.Error)
+			client.history.RecordError(err.Error())
+			return err
+		}
+		if len(chunk.Body) > 0 {
+			if err := write(chunk.Body); err != nil {
+				m.finishRequest(client, requestID, false)
+				return err
+			}
+		}
+		if !chunk.Stream {
+			m.finishRequest(client, requestID, true)
+			return nil
+		}
+	}
+}
+
+// await waits for the next message about a request, resetting the timeout
+// whenever the client sends a keepalive
+func (m *TCPManager) await(ctx context.Context, requestID string, pending *pendingRequest) (*types.Response, error) {
+	timer := time.NewTimer(pending.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case resp := <-pending.responses:
+			return resp, nil
+		case <-pending.alive:
+			timer.Reset(pending.timeout)
+		case <-timer.C:
+			return nil, fmt.Errorf("%w: request %s", errRequestTimeout, requestID)
+		case <-ctx.Done():
+			if errors.Is(context.Cause(ctx), errRequestDeadline) {
+				return nil, fmt.Errorf("%w: request %s passed its deadline", errRequestTimeout, requestID)
+			}
+			if cause := context.Cause(ctx); errors.Is(cause, errUploadFailed) {
+				return nil, cause
+			}
+			return nil, fmt.Errorf("request %s abandoned: %v", requestID, ctx.Err())
+		}
+	}
+}
+
+// finishRequest stops waiting for messages about a request. Unless the client
+// is done with it, the client is told to cancel it.
+func (m *TCPManager) finishRequest(client clientInfo, requestID string, ended bool) {
+	m.waitersMu.Lock()
+	pending, exists := m.waiters[requestID]
+	delete(m.waiters, requestID)
+	m.waitersMu.Unlock()
+	if !exists {
+		return
+	}
+	close(pending.done)
+
+	if !ended {
+		if _, err := m.srv.sendLine(client.clientID, client.conn, "cancel|"+requestID); err != nil {
+			logging.Debugf("TCP Manager: Failed to cancel request %s on client %s: %v", requestID, client.clientID, err)
+		}
+	}
+}
+
+// deliverResponse hands a response or chunk from the client to the waiting
+// request, blocking while a streamed response's reader falls behind
+func (m *TCPManager) deliverResponse(clientID string, resp *types.Response) {
+	m.srv.recorderFor(clientID).Response(resp)
+	if injector := m.srv.chaosFor(clientID); injector != nil {
+		if injector.Drop() {
+			logging.Debugf("Chaos: Dropping response frame for request %s from client %s", resp.RequestID, clientID)
+			return
+		}
+		if delay := injector.Delay(); delay > 0 {
+			logging.Debugf("Chaos: Delaying response frame for request %s from client %s by %s", resp.RequestID, clientID, delay)
+			time.Sleep(delay)
+		}
+	}
+	pending, exists := m.waiterFor(clientID, resp.RequestID)
+	if !exists {
+		log.Printf("TCP Manager: No pending request %s for response from client %s", resp.RequestID, clientID)
+		return
+	}
+
+	select {
+	case pending.responses <- resp:
+	case <-pending.done:
+	}
+}
+
+// waiterFor returns the pending request with requestID if it was sent to
+// clientID, so clients can't answer each other's requests
+func (m *TCPManager) waiterFor(clientID, requestID string) (*pendingRequest, bool) {
+	m.waitersMu.Lock()
+	pending, exists := m.waiters[requestID]
+	m.waitersMu.Unlock()
+	if !exists || pending.clientID != clientID {
+		return nil, false
+	}
+	return pending, true
+}
+
+// keepAlive resets the timeout of a request the client is still working on
+func (m *TCPManager) keepAlive(clientID, requestID string) {
+	pending, exists := m.waiterFor(clientID, requestID)
+	if !exists {
+		return
+	}
+
+	select {
+	case pending.alive <- struct{}{}:
+	default:
+	}
+}
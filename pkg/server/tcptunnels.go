@@ -0,0 +1,279 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/ports"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+)
+
+// tcpStreamTimeout bounds how long a connection to a raw TCP tunnel's port
+// waits for the client to open its stream
+const tcpStreamTimeout = 10 * time.Second
+
+var errTCPTunnelsDisabled = errors.New("raw TCP tunnels are not enabled on this server")
+
+// pendingStream is a connection to a raw TCP tunnel's port waiting for the
+// client's stream. Whoever takes it from tcpTunnels.pending owns public.
+type pendingStream struct {
+	clientID string
+	public   net.Conn
+	taken    chan struct{} // Closed once the stream attached or failed
+}
+
+// tcpTunnelState are the public ports of raw TCP tunnels. A client keeps its
+// port while its history is kept, so it comes back on the same port after
+// reconnecting.
+type tcpTunnelState struct {
+	mu        sync.Mutex
+	ports     *ports.Allocator          // nil while raw TCP tunnels are off
+	assigned  map[string]int            // Map client ID to its port
+	listeners map[string]net.Listener   // Map client ID to the listener of its connected tunnel
+	pending   map[string]*pendingStream // Map stream ID to the connection waiting for it
+	hostnames map[string]string         // Map SNI hostname to the connected client its TLS is passed through to
+}
+
+// configureTCPTunnels reads the port range of raw TCP tunnels
+func (s *Server) configureTCPTunnels(config *Config) error {
+	r := config.Server.TCPTunnels
+	s.tcpTunnels.mu.Lock()
+	defer s.tcpTunnels.mu.Unlock()
+	s.tcpTunnels.ports = nil
+	if r.PortMax == 0 {
+		return nil
+	}
+	if r.PortMin < 1 || r.PortMax > 65535 || r.PortMin > r.PortMax {
+		return fmt.Errorf("invalid port range %d-%d", r.PortMin, r.PortMax)
+	}
+	s.tcpTunnels.ports = ports.New(ports.Range{Min: r.PortMin, Max: r.PortMax})
+	log.Printf("Exposing raw TCP tunnels on ports %d-%d", r.PortMin, r.PortMax)
+	return nil
+}
+
+// reserveTCPTunnelPort keeps a reserved public port out of the ports raw
+// TCP tunnels are assigned
+func (s *Server) reserveTCPTunnelPort(port int, clientID string) error {
+	s.tcpTunnels.mu.Lock()
+	defer s.tcpTunnels.mu.Unlock()
+	if s.tcpTunnels.ports == nil {
+		return nil
+	}
+	if err := s.tcpTunnels.ports.Reserve(port, clientID); err != nil {
+		return fmt.Errorf("raw TCP tunnels: %v", err)
+	}
+	return nil
+}
+
+// unreserveTCPTunnelPort lets raw TCP tunnels be assigned a port again once
+// its reservation is gone
+func (s *Server) unreserveTCPTunnelPort(port int) {
+	s.tcpTunnels.mu.Lock()
+	defer s.tcpTunnels.mu.Unlock()
+	if s.tcpTunnels.ports != nil {
+		s.tcpTunnels.ports.Unreserve(port)
+	}
+}
+
+// openTCPTunnel listens on the client's public port, assigning it one first
+// if it has none, and returns the port. TLS connections to the HTTPS port
+// for hostname, if set, are passed through to the tunnel as well.
+func (m *TCPManager) openTCPTunnel(clientID, hostname string) (int, error) {
+	hostname = strings.ToLower(hostname)
+	if hostname != "" {
+		if err := m.srv.allowHostname(clientID, hostname); err != nil {
+			return 0, err
+		}
+	}
+	m.srv.tcpTunnels.mu.Lock()
+	defer m.srv.tcpTunnels.mu.Unlock()
+	if m.srv.tcpTunnels.ports == nil {
+		return 0, errTCPTunnelsDisabled
+	}
+	if owner, ok := m.srv.tcpTunnels.hostnames[hostname]; ok && owner != clientID {
+		return 0, fmt.Errorf("hostname %s is already passed through to client %s", hostname, owner)
+	}
+	if previous, ok := m.srv.tcpTunnels.listeners[clientID]; ok {
+		previous.Close()
+		delete(m.srv.tcpTunnels.listeners, clientID)
+	}
+	m.srv.releaseHostnameLocked(clientID)
+	port, ok := m.srv.tcpTunnels.assigned[clientID]
+	if !ok {
+		var err error
+		if port, err = m.srv.tcpTunnels.ports.Allocate(); err != nil {
+			return 0, fmt.Errorf("no public TCP port left: %v", err)
+		}
+	}
+	listener, err := m.srv.listenPublic(m.srv.bindAddresses.tcpTunnels, port, m.srv.listenSettings.public)
+	if err != nil {
+		if !ok {
+			m.srv.tcpTunnels.ports.Release(port)
+		}
+		return 0, fmt.Errorf("failed to listen on port %d: %v", port, err)
+	}
+	m.srv.tcpTunnels.assigned[clientID] = port
+	m.srv.tcpTunnels.listeners[clientID] = listener
+	go m.serveTCPTunnel(clientID, listener)
+	log.Printf("TCP Manager: Exposing raw TCP tunnel of client %s on port %d", clientID, port)
+	if hostname != "" {
+		m.srv.tcpTunnels.hostnames[hostname] = clientID
+		log.Printf("TCP Manager: Passing TLS for %s through to client %s", hostname, clientID)
+	}
+	return port, nil
+}
+
+// closeTCPTunnel stops listening on the client's public port, giving the
+// port up as well if release is set. Streams already open carry on.
+func (s *Server) closeTCPTunnel(clientID string, release bool) {
+	s.tcpTunnels.mu.Lock()
+	defer s.tcpTunnels.mu.Unlock()
+	if listener, ok := s.tcpTunnels.listeners[clientID]; ok {
+		listener.Close()
+		delete(s.tcpTunnels.listeners, clientID)
+	}
+	s.releaseHostnameLocked(clientID)
+	if port, ok := s.tcpTunnels.assigned[clientID]; ok && release {
+		s.tcpTunnels.ports.Release(port)
+		delete(s.tcpTunnels.assigned, clientID)
+	}
+}
+
+// releaseHostnameLocked stops passing TLS through to the client
+func (s *Server) releaseHostnameLocked(clientID string) {
+	for hostname, owner := range s.tcpTunnels.hostnames {
+		if owner == clientID {
+			delete(s.tcpTunnels.hostnames, hostname)
+		}
+	}
+}
+
+// passthroughClient returns the client TLS for hostname is passed through to
+func (s *Server) passthroughClient(hostname string) (string, bool) {
+	s.tcpTunnels.mu.Lock()
+	defer s.tcpTunnels.mu.Unlock()
+	clientID, ok := s.tcpTunnels.hostnames[strings.ToLower(hostname)]
+	return clientID, ok
+}
+
+// serveTCPTunnel opens a stream for each connection to a raw TCP tunnel's
+// port until the listener is closed
+func (m *TCPManager) serveTCPTunnel(clientID string, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// The resilient listener only fails once closed
+			return
+		}
+		go m.openStream(clientID, conn)
+	}
+}
+
+// openStream asks the client to open a stream for a connection to its port,
+// closing the connection unless the stream attaches within tcpStreamTimeout
+func (m *TCPManager) openStream(clientID string, public net.Conn) {
+	client, ok := m.GetClient(clientID)
+	if !ok {
+		public.Close()
+		return
+	}
+	if paused, _ := m.srv.clientManager.Paused(clientID); paused {
+		logging.Debugf("TCP Manager: Refusing connection from %s to paused client %s", public.RemoteAddr(), clientID)
+		public.Close()
+		return
+	}
+
+	id := uuid.NewString()
+	pending := &pendingStream{clientID: clientID, public: public, taken: make(chan struct{})}
+	m.srv.tcpTunnels.mu.Lock()
+	m.srv.tcpTunnels.pending[id] = pending
+	m.srv.tcpTunnels.mu.Unlock()
+	logging.Debugf("TCP Manager: Opening stream %s to client %s for %s", id, clientID, public.RemoteAddr())
+	if _, err := m.srv.sendLine(clientID, client.conn, "tcp-open|"+id); err != nil {
+		if m.srv.takeStream(id) != nil {
+			public.Close()
+		}
+		m.recordError(clientID, fmt.Errorf("failed to open stream %s: %v", id, err))
+		return
+	}
+
+	timer := time.NewTimer(tcpStreamTimeout)
+	defer timer.Stop()
+	select {
+	case <-pending.taken:
+	case <-timer.C:
+		if m.srv.takeStream(id) != nil {
+			public.Close()
+			m.recordError(clientID, fmt.Errorf("stream %s not opened within %v", id, tcpStreamTimeout))
+		}
+	}
+}
+
+// takeStream removes a pending stream, nil if it was already taken
+func (s *Server) takeStream(id string) *pendingStream {
+	s.tcpTunnels.mu.Lock()
+	defer s.tcpTunnels.mu.Unlock()
+	pending, ok := s.tcpTunnels.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(s.tcpTunnels.pending, id)
+	close(pending.taken)
+	return pending
+}
+
+// attachStream copies between a pending connection and the client's stream
+// connection (first line "stream|<stream id>") until both are done, reading
+// the stream through r, which may hold its first bytes
+func (m *TCPManager) attachStream(id string, stream *traffic.ThrottledConn, r io.Reader) {
+	pending := m.srv.takeStream(id)
+	if pending == nil {
+		log.Printf("TCP Manager: No pending connection for stream %s from %s", id, stream.RemoteAddr())
+		return
+	}
+	client, ok := m.GetClient(pending.clientID)
+	if !ok {
+		pending.public.Close()
+		return
+	}
+	if limit := m.bandwidthFor(client.clientID, client.class); limit > 0 {
+		stream.SetRate(limit)
+	}
+	logging.Debugf("TCP Manager: Stream %s of client %s attached", id, client.clientID)
+	sent, received := traffic.Splice(pending.public, streamConn{ThrottledConn: stream, r: r})
+	client.traffic.AddSent(int(sent))
+	client.traffic.AddReceived(int(received))
+	logging.Debugf("TCP Manager: Stream %s of client %s closed after %d bytes out and %d back", id, client.clientID, sent, received)
+}
+
+// failStream closes a pending connection the client couldn't open a stream
+// for (format: "tcp-error|<stream id>|<reason>")
+func (m *TCPManager) failStream(clientID, data string) {
+	id, reason, _ := strings.Cut(data, "|")
+	pending := m.srv.takeStream(id)
+	if pending == nil {
+		return
+	}
+	pending.public.Close()
+	m.recordError(clientID, fmt.Errorf("stream %s failed: %s", id, reason))
+	log.Printf("TCP Manager: Client %s failed to open stream %s: %s", clientID, id, reason)
+}
+
+// streamConn reads a stream connection through the reader of its first
+// line, which may have buffered the bytes after it
+type streamConn struct {
+	*traffic.ThrottledConn
+	r io.Reader
+}
+
+func (c streamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
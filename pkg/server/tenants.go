@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultTenant holds every client when no tenants are configured
+const defaultTenant = ""
+
+// TenantResolver maps API keys and public hostnames to tenant namespaces
+type TenantResolver struct {
+	byKey  map[string]string
+	byHost map[string]string
+	mu     sync.RWMutex
+}
+
+func NewTenantResolver() *TenantResolver {
+	return &TenantResolver{
+		byKey:  make(map[string]string),
+		byHost: make(map[string]string),
+	}
+}
+
+// AddTenant registers a tenant with its API keys and public hostnames
+func (t *TenantResolver) AddTenant(name string, apiKeys []string, hosts []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("tenant name is required")
+	}
+	for _, key := range apiKeys {
+		if owner, exists := t.byKey[key]; exists {
+			return fmt.Errorf("API key of tenant %s is already assigned to tenant %s", name, owner)
+		}
+		t.byKey[key] = name
+	}
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if owner, exists := t.byHost[host]; exists {
+			return fmt.Errorf("host %s of tenant %s is already assigned to tenant %s", host, name, owner)
+		}
+		t.byHost[host] = name
+	}
+	return nil
+}
+
+// SetAPIKeys replaces the API keys of a tenant, such as after they were rotated
+func (t *TenantResolver) SetAPIKeys(name string, apiKeys []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range apiKeys {
+		if owner, exists := t.byKey[key]; exists && owner != name {
+			return fmt.Errorf("API key of tenant %s is already assigned to tenant %s", name, owner)
+		}
+	}
+	for key, owner := range t.byKey {
+		if owner == name {
+			delete(t.byKey, key)
+		}
+	}
+	for _, key := range apiKeys {
+		t.byKey[key] = name
+	}
+	return nil
+}
+
+// Enabled reports whether any tenants are configured
+func (t *TenantResolver) Enabled() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.byKey) > 0
+}
+
+// FromRequest resolves the tenant owning the API key presented with the request.
+// ok is false when tenants are configured and the key is missing or unknown.
+func (t *TenantResolver) FromRequest(r *http.Request) (tenant string, ok bool) {
+	return t.FromAPIKey(apiKeyFromRequest(r))
+}
+
+// FromAPIKey resolves the tenant owning an API key, like FromRequest
+func (t *TenantResolver) FromAPIKey(key string) (tenant string, ok bool) {
+	if !t.Enabled() {
+		return defaultTenant, true
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tenant, ok = t.byKey[key]
+	return tenant, ok
+}
+
+// FromHost resolves the tenant serving a public hostname
+func (t *TenantResolver) FromHost(host string) (string, bool) {
+	if !t.Enabled() {
+		return defaultTenant, true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tenant, ok := t.byHost[strings.ToLower(host)]
+	return tenant, ok
+}
+
+// apiKeyFromRequest reads the API key from the Authorization or X-API-Key header
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// tenantScope resolves which clients a request to the admin API may see:
+// only its own tenant's with a tenant API key, and every tenant's with an
+// RBAC admin key or when no tenants are configured. Anyone else is refused,
+// and ok is false once the answer is written.
+func (s *Server) tenantScope(w http.ResponseWriter, r *http.Request) (tenant string, all bool, ok bool) {
+	if !s.tenants.Enabled() {
+		return defaultTenant, true, true
+	}
+	if tenant, ok := s.tenants.FromRequest(r); ok {
+		return tenant, false, true
+	}
+	if !s.accessControl.Enabled() {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized: a tenant API key is required", http.StatusUnauthorized)
+		return "", false, false
+	}
+	switch role := s.accessControl.roleForRequest(r); {
+	case role == RoleNone:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false, false
+	case role < RoleAdmin:
+		http.Error(w, fmt.Sprintf("Forbidden: requires %s role to see every tenant", RoleAdmin), http.StatusForbidden)
+		return "", false, false
+	}
+	return defaultTenant, true, true
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+)
+
+// tlsOptions hardens every TLS listener the server opens. The defaults
+// allow TLS 1.2 and later with Go's secure cipher suites and curves.
+type tlsOptions struct {
+	minVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+	clientAuth   tls.ClientAuthType
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+// configureTLS reads and validates the TLS hardening settings. It runs after
+// the client CAs are loaded, since the verifying client auth modes need them.
+func (s *Server) configureTLS(config *Config) error {
+	tc := config.Server.TLS
+
+	if tc.MinVersion != "" {
+		version, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return fmt.Errorf("unsupported min_version %q, use 1.2 or 1.3", tc.MinVersion)
+		}
+		s.tlsSettings.minVersion = version
+	}
+
+	if len(tc.CipherSuites) > 0 {
+		if s.tlsSettings.minVersion == tls.VersionTLS13 {
+			return fmt.Errorf("cipher_suites can't be set with min_version 1.3, whose suites are fixed")
+		}
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		insecure := make(map[string]bool)
+		for _, suite := range tls.InsecureCipherSuites() {
+			insecure[suite.Name] = true
+		}
+		s.tlsSettings.cipherSuites = nil
+		for _, name := range tc.CipherSuites {
+			if insecure[name] {
+				return fmt.Errorf("cipher suite %s is insecure", name)
+			}
+			id, ok := suites[name]
+			if !ok {
+				return fmt.Errorf("unknown cipher suite %s", name)
+			}
+			s.tlsSettings.cipherSuites = append(s.tlsSettings.cipherSuites, id)
+		}
+	}
+
+	s.tlsSettings.curves = nil
+	for _, name := range tc.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("unknown curve %s, use X25519, P256, P384, or P521", name)
+		}
+		s.tlsSettings.curves = append(s.tlsSettings.curves, curve)
+	}
+
+	// Browsers don't need certificates, but registrations are checked against
+	// the client CAs, so those default to verifying certificates that are given
+	s.tlsSettings.clientAuth = tls.NoClientCert
+	if s.clientCAs != nil {
+		s.tlsSettings.clientAuth = tls.VerifyClientCertIfGiven
+	}
+	if tc.ClientAuth != "" {
+		mode, ok := tlsClientAuth[tc.ClientAuth]
+		if !ok {
+			return fmt.Errorf("unknown client_auth %q, use none, request, require, verify_if_given, or require_and_verify", tc.ClientAuth)
+		}
+		verifies := mode == tls.VerifyClientCertIfGiven || mode == tls.RequireAndVerifyClientCert
+		if verifies && s.clientCAs == nil {
+			return fmt.Errorf("client_auth %s requires identity.client_ca_file", tc.ClientAuth)
+		}
+		if !verifies && s.clientCAs != nil {
+			return fmt.Errorf("client_auth %s doesn't verify the certificates identity.client_ca_file requires", tc.ClientAuth)
+		}
+		s.tlsSettings.clientAuth = mode
+	}
+
+	if tc.Enabled && tc.MinVersion != "" {
+		log.Printf("TLS listeners accept TLS %s and later", tc.MinVersion)
+	}
+	return nil
+}
+
+// hardenTLS applies the TLS settings to c and returns it
+func (s *Server) hardenTLS(c *tls.Config) *tls.Config {
+	c.MinVersion = s.tlsSettings.minVersion
+	c.CipherSuites = s.tlsSettings.cipherSuites
+	c.CurvePreferences = s.tlsSettings.curves
+	return c
+}
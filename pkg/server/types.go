@@ -0,0 +1,427 @@
+package server
+
+import (
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/schedule"
+)
+
+type Client struct {
+	ClientId string   `json:"client_id"`
+	Paths    []string `json:"paths"`
+	Protocol string   `json:"protocol"`
+	Weight   int      `json:"weight"`
+	Tenant   string   `json:"tenant,omitempty"`
+	// Methods, Headers, and ALPN limit the client's path to matching requests
+	Methods []string          `json:"methods,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	ALPN    []string          `json:"alpn,omitempty"`
+	// Shadow clients get copies of their path's traffic, whose responses are discarded
+	Shadow bool `json:"shadow,omitempty"`
+	// Class is the tunnel's QoS priority class, "" for the default one
+	Class string `json:"class,omitempty"`
+	// Fingerprint pins the client ID to its mTLS certificate
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Paused tunnels keep their registration but get a maintenance response
+	Paused       bool   `json:"paused,omitempty"`
+	PauseMessage string `json:"pause_message,omitempty"`
+	// Schedule is the tunnel's availability window, nil for always available
+	Schedule *schedule.Schedule `json:"-"`
+	// Profile is the server.profiles entry the client registered with
+	Profile string `json:"profile,omitempty"`
+	// TTL is how long the registration lasts without renewal, 0 never expires
+	TTL       time.Duration `json:"-"`
+	ExpiresAt time.Time     `json:"-"`
+}
+
+type ClientList struct {
+	Clients []Client `json:"clients"`
+}
+
+type ClientRegisterRequest struct {
+	ClientId string   `json:"client_id"`
+	Paths    []string `json:"paths"`
+	Protocol string   `json:"protocol"`
+	Weight   int      `json:"weight"`
+}
+
+// CORSPolicy is a cross-origin policy for browser calls to a set of endpoints
+type CORSPolicy struct {
+	AllowedOrigins   []string `yaml:"allowed_origins"` // "*" allows any origin
+	AllowedMethods   []string `yaml:"allowed_methods"`
+	AllowedHeaders   []string `yaml:"allowed_headers"` // Echoes the requested headers if empty
+	ExposedHeaders   []string `yaml:"exposed_headers"`
+	AllowCredentials bool     `yaml:"allow_credentials"`
+	MaxAge           int      `yaml:"max_age"` // Seconds browsers may cache a preflight
+}
+
+// SocketConfig tunes TCP sockets, zero values keeping the system defaults
+type SocketConfig struct {
+	NoDelay          *bool `yaml:"no_delay"`          // TCP_NODELAY, on by default
+	KeepAliveSeconds int   `yaml:"keepalive_seconds"` // Keepalive probe period, -1 disables keepalives
+	ReadBuffer       int   `yaml:"read_buffer"`       // SO_RCVBUF in bytes
+	WriteBuffer      int   `yaml:"write_buffer"`      // SO_SNDBUF in bytes
+	Linger           *int  `yaml:"linger"`            // SO_LINGER in seconds, 0 resets connections on close
+}
+
+// SecretsConfig configures the secret stores config values refer to as
+// ${vault:path#field} or ${aws:name#field}
+type SecretsConfig struct {
+	RefreshInterval int `yaml:"refresh_interval"` // Seconds between checks for rotated secrets, 0 disables
+	Vault           struct {
+		Address   string `yaml:"address"`
+		Token     string `yaml:"token"` // VAULT_TOKEN if empty
+		Namespace string `yaml:"namespace"`
+	} `yaml:"vault"`
+	AWS struct {
+		Region          string `yaml:"region"`
+		Endpoint        string `yaml:"endpoint"`          // Overrides the regional endpoint
+		AccessKeyID     string `yaml:"access_key_id"`     // AWS_ACCESS_KEY_ID if empty
+		SecretAccessKey string `yaml:"secret_access_key"` // AWS_SECRET_ACCESS_KEY if empty
+	} `yaml:"aws"`
+}
+
+// MiddlewareConfig is one entry of a middleware chain
+type MiddlewareConfig struct {
+	Name    string            `yaml:"name"`
+	Paths   []string          `yaml:"paths"`   // Route patterns it applies to, every request if empty
+	Options map[string]string `yaml:"options"` // Settings of the middleware, e.g. rate and burst
+}
+
+// ServerConfig represents the configuration for the server
+type ServerConfig struct {
+	Host string `yaml:"host"`
+	SSH  struct {
+		Port     int    `yaml:"port"`
+		Username string `yaml:"username"`
+		KeyPath  string `yaml:"key_path"`
+	} `yaml:"ssh"`
+	Ports struct {
+		HTTP         int `yaml:"http"`
+		HTTPS        int `yaml:"https"`
+		Grpc         int `yaml:"grpc"`
+		Registration int `yaml:"registration"`
+		// Shared serves HTTP, HTTPS, and tunnels on one port, 0 disables
+		Shared int `yaml:"shared"`
+	} `yaml:"ports"`
+	// Bind selects the IP address or interface each listener binds to,
+	// empty for all interfaces
+	Bind struct {
+		Address      string `yaml:"address"` // Default for listeners without their own
+		HTTP         string `yaml:"http"`
+		HTTPS        string `yaml:"https"`
+		Registration string `yaml:"registration"`
+		Shared       string `yaml:"shared"`
+		Reserved     string `yaml:"reserved"`    // Reserved tunnel ports
+		TCPTunnels   string `yaml:"tcp_tunnels"` // Public ports of raw TCP tunnels
+	} `yaml:"bind"`
+	// HTTP protects the public frontends from slow and oversized requests
+	HTTP struct {
+		ReadHeaderTimeout   int `yaml:"read_header_timeout"`    // Seconds clients have to send request headers, default 10
+		ReadTimeout         int `yaml:"read_timeout"`           // Seconds clients have to send a whole request, 0 is unlimited
+		IdleTimeout         int `yaml:"idle_timeout"`           // Seconds keep-alive connections may idle, default 120
+		RequestTimeout      int `yaml:"request_timeout"`        // Seconds tunneled requests have until their response starts, 0 is unlimited
+		MaxHeaderBytes      int `yaml:"max_header_bytes"`       // Largest request headers, default 1 MiB
+		MaxConnectionsPerIP int `yaml:"max_connections_per_ip"` // Open public connections per source IP, 0 is unlimited
+	} `yaml:"http"`
+	TCP struct {
+		Public SocketConfig `yaml:"public"` // HTTP, HTTPS, shared, and reserved port connections
+		Tunnel SocketConfig `yaml:"tunnel"` // Registration port connections
+		// ReusePort opens this many SO_REUSEPORT listeners per public port,
+		// each with its own accept loop; 0 or 1 opens one listener
+		ReusePort int `yaml:"reuse_port"`
+	} `yaml:"tcp"`
+	// TCPTunnels exposes raw TCP tunnels on public ports from this range,
+	// off while port_max is 0
+	TCPTunnels struct {
+		PortMin int `yaml:"port_min"`
+		PortMax int `yaml:"port_max"`
+	} `yaml:"tcp_tunnels"`
+	// P2P lets visitors connect to raw TCP tunnels directly, meeting their
+	// clients on this UDP rendezvous port first
+	P2P struct {
+		Port int `yaml:"port"` // 0 disables peer-to-peer connections
+	} `yaml:"p2p"`
+	Routing struct {
+		PathMatching struct {
+			CaseSensitive bool   `yaml:"case_sensitive"`
+			TrailingSlash string `yaml:"trailing_slash"`
+		} `yaml:"path_matching"`
+		// ClaimPolicy is what happens when a client claims a path another
+		// client has: share (default), reject, or takeover
+		ClaimPolicy string `yaml:"claim_policy"`
+		Paths       []struct {
+			Pattern      string `yaml:"pattern"`
+			Description  string `yaml:"description"`
+			RequiredAuth bool   `yaml:"required_auth"`
+			ClaimPolicy  string `yaml:"claim_policy"` // Overrides routing.claim_policy for the pattern
+		} `yaml:"paths"`
+	} `yaml:"routing"`
+	TLS struct {
+		Enabled  bool   `yaml:"enabled"`
+		CertFile string `yaml:"cert_file"` // Default certificate for hostnames without their own
+		KeyFile  string `yaml:"key_file"`
+		// Cert and Key hold the default certificate in PEM instead of files,
+		// typically from a secret store
+		Cert    string `yaml:"cert"`
+		Key     string `yaml:"key"`
+		CertDir string `yaml:"cert_dir"` // Where per-tunnel certificates are stored
+		// RedirectHTTP makes the plain HTTP port only redirect to HTTPS
+		RedirectHTTP bool `yaml:"redirect_http"`
+		// HTTP3 also serves HTTPS over QUIC on the UDP side of the HTTPS
+		// port, advertised to HTTPS callers with Alt-Svc
+		HTTP3 bool `yaml:"http3"`
+		HSTS  struct {
+			MaxAge            int  `yaml:"max_age"` // Seconds, 0 disables HSTS
+			IncludeSubdomains bool `yaml:"include_subdomains"`
+			Preload           bool `yaml:"preload"`
+		} `yaml:"hsts"`
+		SecurityHeaders map[string]string `yaml:"security_headers"` // Added to every HTTPS response
+		// Hardening applied to every TLS listener
+		MinVersion       string   `yaml:"min_version"`       // 1.2 (default) or 1.3
+		CipherSuites     []string `yaml:"cipher_suites"`     // TLS 1.2 suites by Go name, Go's secure defaults if empty
+		CurvePreferences []string `yaml:"curve_preferences"` // X25519, P256, P384, P521
+		ClientAuth       string   `yaml:"client_auth"`       // none, request, require, verify_if_given, or require_and_verify
+	} `yaml:"tls"`
+	Identity struct {
+		ClientCAFile string `yaml:"client_ca_file"` // Require client certificates signed by this CA
+		PinsFile     string `yaml:"pins_file"`      // Where certificate pins persist, in memory only if empty
+		// Registrations must be signed by an SSH key listed for the client ID
+		SSHKeys []struct {
+			ClientID  string `yaml:"client_id"`
+			PublicKey string `yaml:"public_key"` // authorized_keys format
+		} `yaml:"ssh_keys"`
+		SSHAuthorizedKeys string `yaml:"ssh_authorized_keys"` // authorized_keys file, each key's comment its client ID
+		// PathRules limit what client IDs may claim, the first matching rule applying
+		PathRules []struct {
+			ClientID  string   `yaml:"client_id"` // Client ID or pattern such as "team-a-*"
+			Paths     []string `yaml:"paths"`     // Allowed paths and the paths below them
+			Hostnames []string `yaml:"hostnames"` // Allowed TLS hostnames, "*.example.com" for subdomains
+		} `yaml:"path_rules"`
+	} `yaml:"identity"`
+	Tenants []struct {
+		Name    string   `yaml:"name"`
+		APIKeys []string `yaml:"api_keys"`
+		Hosts   []string `yaml:"hosts"` // Public hostnames routed to this tenant's clients
+	} `yaml:"tenants"`
+	RBAC struct {
+		Enabled bool `yaml:"enabled"`
+		APIKeys []struct {
+			Key  string `yaml:"key"`
+			Role string `yaml:"role"` // viewer, operator, or admin
+		} `yaml:"api_keys"`
+		OIDC struct {
+			Issuer      string            `yaml:"issuer"`
+			Audience    string            `yaml:"audience"`
+			GroupsClaim string            `yaml:"groups_claim"`
+			GroupRoles  map[string]string `yaml:"group_roles"` // OIDC group -> role
+		} `yaml:"oidc"`
+	} `yaml:"rbac"`
+	Maintenance struct {
+		Message    string `yaml:"message"`     // Shown for paused tunnels without their own message
+		RetryAfter int    `yaml:"retry_after"` // Seconds, sent as Retry-After
+	} `yaml:"maintenance"`
+	DefaultBackend struct {
+		Static   string `yaml:"static"`   // Directory served for unmatched paths, or "builtin" for a landing page
+		Upstream string `yaml:"upstream"` // URL unmatched requests are forwarded to instead
+	} `yaml:"default_backend"`
+	ErrorPages struct {
+		Dir string `yaml:"dir"` // Templates named <status>.html or default.html
+	} `yaml:"error_pages"`
+	CORS struct {
+		API   *CORSPolicy `yaml:"api"` // The server's own endpoints
+		Paths []struct {
+			Path       string `yaml:"path"`
+			CORSPolicy `yaml:",inline"`
+		} `yaml:"paths"` // Injected into proxied responses, overriding the upstream's
+	} `yaml:"cors"`
+	Secrets      SecretsConfig `yaml:"secrets"`
+	Reservations []struct {
+		ClientID string `yaml:"client_id"`
+		Port     int    `yaml:"port"`     // Public HTTP port serving only this client
+		Hostname string `yaml:"hostname"` // Public hostname serving only this client
+	} `yaml:"reservations"`
+	Log struct {
+		Level       string `yaml:"level"`         // info or debug, changeable at runtime via /admin/loglevel
+		File        string `yaml:"file"`          // Server log file, stderr if empty
+		AccessFile  string `yaml:"access_file"`   // Access log of public requests, disabled if empty
+		MaxSizeMB   int    `yaml:"max_size_mb"`   // Rotate log files at this size, 0 disables
+		MaxAgeHours int    `yaml:"max_age_hours"` // Rotate log files at this age, 0 disables
+		MaxBackups  int    `yaml:"max_backups"`   // Rotated files to keep, 0 keeps all
+		Compress    bool   `yaml:"compress"`      // Gzip rotated files
+	} `yaml:"log"`
+	Debug struct {
+		Enabled bool   `yaml:"enabled"` // Serve pprof and expvar
+		Address string `yaml:"address"` // Admin address, defaults to 127.0.0.1:6060
+	} `yaml:"debug"`
+	Sessions struct {
+		GracePeriod  int `yaml:"grace_period"`  // Seconds a disconnected client can resume its session
+		StaleTimeout int `yaml:"stale_timeout"` // Seconds without a heartbeat before a client is dropped, 0 never
+	} `yaml:"sessions"`
+	Shutdown struct {
+		DrainPeriod int `yaml:"drain_period"` // Seconds /readyz fails before exiting on SIGTERM
+	} `yaml:"shutdown"`
+	Usage struct {
+		File                string `yaml:"file"`                  // Where usage rollups persist, in memory only if empty
+		IntervalSeconds     int    `yaml:"interval_seconds"`      // How often connected clients are metered, default 60
+		HourlyRetentionDays int    `yaml:"hourly_retention_days"` // Default 7
+		DailyRetentionDays  int    `yaml:"daily_retention_days"`  // Default 400
+	} `yaml:"usage"`
+	Alerts struct {
+		IntervalSeconds int `yaml:"interval_seconds"` // How often rules are evaluated, default 15
+		Rules           []struct {
+			Name string `yaml:"name"`
+			Type string `yaml:"type"` // client_inactive, client_unhealthy, connections, or in_flight
+			// Threshold is the seconds without a heartbeat for client_inactive,
+			// and the percent of the limit in use for connections and in_flight
+			Threshold float64  `yaml:"threshold"`
+			Client    string   `yaml:"client"`   // Only this client ID for client rules, every client if empty
+			Severity  string   `yaml:"severity"` // critical, error, warning (default), or info
+			Notify    []string `yaml:"notify"`   // Integrations to notify, all if empty
+		} `yaml:"rules"`
+		Integrations []struct {
+			Name       string            `yaml:"name"`
+			Type       string            `yaml:"type"`        // webhook, slack, or pagerduty
+			URL        string            `yaml:"url"`         // PagerDuty's Events API if empty for pagerduty
+			RoutingKey string            `yaml:"routing_key"` // PagerDuty integration key
+			Headers    map[string]string `yaml:"headers"`     // Added to webhook requests
+		} `yaml:"integrations"`
+	} `yaml:"alerts"`
+	QoS struct {
+		// Classes are ordered highest priority first
+		Classes []struct {
+			Name           string `yaml:"name"`
+			BytesPerSecond int64  `yaml:"bytes_per_second"` // Tunnel bandwidth cap of the class, 0 keeps limits.client_bytes_per_second
+		} `yaml:"classes"`
+		Default        string `yaml:"default"`          // Class of tunnels that don't name one, the lowest if empty
+		QueueTimeoutMs int    `yaml:"queue_timeout_ms"` // How long requests beyond limits.max_in_flight wait, 0 sheds them at once
+	} `yaml:"qos"`
+	Limits struct {
+		MaxConnections       int `yaml:"max_connections"`         // Open public connections, 0 means unlimited
+		MaxInFlight          int `yaml:"max_in_flight"`           // Proxied requests server-wide, 0 means unlimited
+		ClientMaxInFlight    int `yaml:"client_max_in_flight"`    // 0 means unlimited
+		ClientQueueTimeoutMs int `yaml:"client_queue_timeout_ms"` // How long excess requests wait for a slot
+		ClientBusyStatus     int `yaml:"client_busy_status"`      // Answer to requests that waited in vain, 503 (default) or 429
+		// ClientInFlight overrides client_max_in_flight by client ID, 0 lifting it
+		ClientInFlight map[string]int `yaml:"client_in_flight"`
+		// ClientBytesPerSecond caps each tunnel in each direction, 0 means unlimited
+		ClientBytesPerSecond int64 `yaml:"client_bytes_per_second"`
+		// ClientBandwidth overrides the cap by client ID, 0 lifting it
+		ClientBandwidth map[string]int64 `yaml:"client_bandwidth"`
+		// TunnelConnectionsPerSecond limits new tunnel connections per source IP, 0 means unlimited
+		TunnelConnectionsPerSecond float64 `yaml:"tunnel_connections_per_second"`
+		TunnelConnectionBurst      int     `yaml:"tunnel_connection_burst"` // Defaults to the rate rounded up
+		MaxHandshakes              int     `yaml:"max_handshakes"`          // Tunnel connections not yet registered, 0 means unlimited
+	} `yaml:"limits"`
+	ProxyProtocol struct {
+		Enabled bool     `yaml:"enabled"` // Read PROXY v1/v2 headers on public listeners
+		Trusted []string `yaml:"trusted"` // Load balancer addresses or CIDRs, empty trusts all
+	} `yaml:"proxy_protocol"`
+	Forwarded struct {
+		// Trusted peers keep the forwarding headers they send, others' are replaced
+		Trusted []string `yaml:"trusted"`
+	} `yaml:"forwarded"`
+	Balancer struct {
+		// Hash keeps callers on one client of a route by "ip", "header:Name",
+		// or "cookie:name"; empty splits traffic by weight at random
+		Hash string `yaml:"hash"`
+	} `yaml:"balancer"`
+	Redis struct {
+		Address  string `yaml:"address"` // host:port shared by the cache and rate limits, disabled if empty
+		Password string `yaml:"password"`
+		DB       int    `yaml:"db"`
+	} `yaml:"redis"`
+	// Middleware is the ordered chain in front of the HTTP frontend, by default
+	// access_log, security_headers, and cors
+	Middleware []MiddlewareConfig `yaml:"middleware"`
+	// Profiles are named tunnel settings clients pick by name at registration
+	Profiles []struct {
+		Name     string `yaml:"name"`
+		Timeout  int    `yaml:"timeout"`  // Seconds requests wait without hearing from the client, default 30
+		TTL      string `yaml:"ttl"`      // Registration TTL, e.g. "8h"
+		Class    string `yaml:"class"`    // QoS priority class
+		Schedule string `yaml:"schedule"` // Availability window, e.g. "* 9-17 * * mon-fri"
+		Timezone string `yaml:"timezone"` // Of schedule, UTC if empty
+		// Middleware is a chain run for the requests of the profile's tunnels
+		// after the server.middleware chain
+		Middleware []MiddlewareConfig `yaml:"middleware"`
+	} `yaml:"profiles"`
+	// Recording writes tunnel sessions to disk for replay at
+	// /admin/recordings/replay
+	Recording struct {
+		Dir           string   `yaml:"dir"`            // Recording is off if empty
+		Clients       []string `yaml:"clients"`        // Client ID patterns recorded, all if empty
+		MaxBytes      int64    `yaml:"max_bytes"`      // Size cap per session, 0 for none
+		RedactHeaders []string `yaml:"redact_headers"` // Authorization, Proxy-Authorization, Cookie, and Set-Cookie if empty
+	} `yaml:"recording"`
+	// Chaos injects tunnel faults to test client reconnects and failover.
+	// Rates are chances from 0 to 1; never enable it in production.
+	Chaos struct {
+		Enabled              bool     `yaml:"enabled"`
+		DropRate             float64  `yaml:"drop_rate"`              // Per request and response frame
+		DelayRate            float64  `yaml:"delay_rate"`             // Per response frame
+		MaxDelayMs           int      `yaml:"max_delay_ms"`           // Delays are random up to this long
+		ResetRate            float64  `yaml:"reset_rate"`             // Per message read from a tunnel
+		CorruptHeartbeatRate float64  `yaml:"corrupt_heartbeat_rate"` // Per heartbeat acknowledgment
+		Seed                 int64    `yaml:"seed"`                   // Random seed for repeatable runs, 0 for the time
+		Clients              []string `yaml:"clients"`                // Client ID patterns targeted, all if empty
+	} `yaml:"chaos"`
+	// ClientReleases serves the client binaries `client update` installs
+	ClientReleases struct {
+		Dir     string `yaml:"dir"`     // client-<os>-<arch> binaries with optional .sig files, off if empty
+		Version string `yaml:"version"` // Version of the binaries in dir
+	} `yaml:"client_releases"`
+	Compression struct {
+		MinSize int `yaml:"min_size"` // Smallest request in bytes compressed for clients that ask, 0 uses the default
+	} `yaml:"compression"`
+	Failover struct {
+		Role             string `yaml:"role"`     // active or standby
+		Provider         string `yaml:"provider"` // digitalocean or hetzner
+		APIToken         string `yaml:"api_token"`
+		FloatingIP       string `yaml:"floating_ip"`
+		TargetID         string `yaml:"target_id"`
+		PeerURL          string `yaml:"peer_url"`
+		PeerAPIKey       string `yaml:"peer_api_key"` // Viewer key used to mirror the peer's clients
+		CheckInterval    int    `yaml:"check_interval"`
+		FailureThreshold int    `yaml:"failure_threshold"`
+	} `yaml:"failover"`
+}
+
+// ClientConfig represents the configuration for the client
+type ClientConfig struct {
+	ID    string `yaml:"id"`
+	Ports struct {
+		HTTPStart   int `yaml:"http_start"`
+		TunnelStart int `yaml:"tunnel_start"`
+	} `yaml:"ports"`
+	Registration struct {
+		RetryInterval int `yaml:"retry_interval"`
+		Timeout       int `yaml:"timeout"`
+		Paths         []struct {
+			Path        string `yaml:"path"`
+			Description string `yaml:"description"`
+			Metadata    []struct {
+				Version  string `yaml:"version"`
+				Provider string `yaml:"provider"`
+			} `yaml:"metadata,omitempty"`
+		} `yaml:"paths"`
+	} `yaml:"registration"`
+	Heartbeat struct {
+		Interval int `yaml:"interval"`
+		Timeout  int `yaml:"timeout"`
+	} `yaml:"heartbeat"`
+}
+
+// Config represents the overall configuration
+// containing both server and client configurations
+type Config struct {
+	Server ServerConfig `yaml:"server"`
+	Client ClientConfig `yaml:"client"`
+
+	secrets *secretSource // nil unless the config file refers to secrets
+}
+
+type ClientRegisterResponse struct {
+	Client *Client `json:"client"`
+	Port   []int   `json:"port"`
+}
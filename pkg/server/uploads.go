@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/types"
+)
+
+// streamUploadMin is the body size from which requests to clients that
+// take streamed bodies are streamed instead of buffered, as are bodies of
+// unknown size
+const streamUploadMin = 1 << 20
+
+// errUploadFailed ends a request whose body couldn't be read from the caller
+var errUploadFailed = errors.New("failed to read request body")
+
+// pendingUpload receives the client's acknowledgments of body chunks
+type pendingUpload struct {
+	acked chan int // Bytes of each chunk the upstream has read
+	// timeout is the request timeout, counted from when the upstream has
+	// read the whole body, 0 for none
+	timeout time.Duration
+}
+
+// streamsUpload reports whether a request's body is streamed to the client
+func streamsUpload(client clientInfo, contentLength int64) bool {
+	return client.transport.Version >= protocol.UploadVersion &&
+		(contentLength < 0 || contentLength >= streamUploadMin)
+}
+
+// ForwardUpload is ForwardRequest for a request whose body is streamed to
+// the client as it is read, no faster than the client's upstream takes it.
+// req carries no deadline, since an upload may take any time; instead the
+// request fails once timeout passes after the upstream has read the whole
+// body.
+func (m *TCPManager) ForwardUpload(ctx context.Context, client clientInfo, req *types.Request, body io.Reader, timeout time.Duration) (*types.Response, error) {
+	return m.forward(ctx, client, req, body, timeout)
+}
+
+// sendBody sends the chunks of a streamed request body, keeping at most
+// protocol.UploadWindow bytes unacknowledged, until the body ends or the
+// request is done. The request fails if the body can't be read, or if the
+// upload's timeout passes once every chunk is acknowledged.
+func (m *TCPManager) sendBody(client clientInfo, requestID string, pending *pendingRequest, body io.Reader, fail context.CancelCauseFunc) {
+	buf := make([]byte, protocol.UploadChunkSize)
+	unacked := 0
+	var sent int64
+	for {
+		n, err := io.ReadFull(body, buf)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		if err != nil && err != io.EOF {
+			select {
+			case <-pending.done:
+			default:
+				fail(fmt.Errorf("%w: %v", errUploadFailed, err))
+			}
+			return
+		}
+		for unacked > 0 && unacked+n > protocol.UploadWindow {
+			select {
+			case acked := <-pending.upload.acked:
+				unacked -= acked
+			case <-pending.done:
+				return
+			}
+		}
+
+		chunk := &types.Request{ID: requestID, Stream: err == nil, Timestamp: time.Now().Unix()}
+		if n > 0 {
+			chunk.Body = buf[:n]
+		}
+		select {
+		case <-pending.done:
+			return
+		default:
+		}
+		written, werr := client.transport.WriteBodyChunk(client.conn, chunk)
+		if werr != nil {
+			// The tunnel is gone, and with it the request
+			logging.Debugf("TCP Manager: Failed to send body of request %s to client %s: %v", requestID, client.clientID, werr)
+			return
+		}
+		client.traffic.AddSent(written)
+		unacked += n
+		sent += int64(n)
+		if err == io.EOF {
+			logging.Debugf("TCP Manager: Sent %d byte body of request %s to client %s", sent, requestID, client.clientID)
+			break
+		}
+	}
+
+	if pending.upload.timeout <= 0 {
+		return
+	}
+	for unacked > 0 {
+		select {
+		case acked := <-pending.upload.acked:
+			unacked -= acked
+		case <-pending.done:
+			return
+		}
+	}
+	timer := time.NewTimer(pending.upload.timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		fail(errRequestDeadline)
+	case <-pending.done:
+	}
+}
+
+// ackBody records the client's acknowledgment of a body chunk (format:
+// "<request id>|<bytes>"), which also shows the client is working on it
+func (m *TCPManager) ackBody(clientID, data string) {
+	requestID, value, _ := strings.Cut(data, "|")
+	acked, err := strconv.Atoi(value)
+	if err != nil || acked < 0 {
+		logging.Debugf("TCP Manager: Invalid body acknowledgment from client %s: %s", clientID, data)
+		return
+	}
+	pending, exists := m.waiterFor(clientID, requestID)
+	if !exists || pending.upload == nil {
+		return
+	}
+	m.keepAlive(clientID, requestID)
+	select {
+	case pending.upload.acked <- acked:
+	default:
+		logging.Debugf("TCP Manager: Client %s acknowledged more of request %s than was sent", clientID, requestID)
+	}
+}
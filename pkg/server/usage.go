@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
+	"github.com/vikasavn/attachcloudip/pkg/usage"
+)
+
+// Default usage metering settings
+const (
+	defaultUsageInterval        = time.Minute
+	defaultUsageHourlyRetention = 7 * 24 * time.Hour
+	defaultUsageDailyRetention  = 400 * 24 * time.Hour
+)
+
+// usageSampler turns each tunnel's cumulative counters into the usage
+// since it was last metered
+type usageSampler struct {
+	srv  *Server
+	mu   sync.Mutex
+	seen map[string]usageState
+}
+
+type usageState struct {
+	counters *traffic.Counters // Sessions that resume keep their counters
+	stats    traffic.Stats
+	at       time.Time
+}
+
+// configureUsage loads the persisted rollups and meters connected clients
+// until ctx is done
+func (s *Server) configureUsage(ctx context.Context, config *Config) error {
+	uc := config.Server.Usage
+	interval := defaultUsageInterval
+	if uc.IntervalSeconds < 0 || uc.HourlyRetentionDays < 0 || uc.DailyRetentionDays < 0 {
+		return fmt.Errorf("interval and retention must not be negative")
+	}
+	if uc.IntervalSeconds > 0 {
+		interval = time.Duration(uc.IntervalSeconds) * time.Second
+	}
+	hourly, daily := defaultUsageHourlyRetention, defaultUsageDailyRetention
+	if uc.HourlyRetentionDays > 0 {
+		hourly = time.Duration(uc.HourlyRetentionDays) * 24 * time.Hour
+	}
+	if uc.DailyRetentionDays > 0 {
+		daily = time.Duration(uc.DailyRetentionDays) * 24 * time.Hour
+	}
+	s.usageMeter = usage.NewMeter(hourly, daily)
+
+	if uc.File != "" {
+		if err := s.usageMeter.Load(uc.File); err != nil {
+			return err
+		}
+		s.usageFile = uc.File
+		log.Printf("Usage: Persisting rollups to %s", uc.File)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := time.Now()
+			for _, client := range s.tcpmanager.GetClients() {
+				s.metered.observe(client, now)
+			}
+			s.metered.forgetStale(now, hourly)
+			s.usageMeter.Prune(now)
+			s.saveUsage()
+		}
+	}()
+	return nil
+}
+
+// saveUsage persists the rollups when a usage file is configured
+func (s *Server) saveUsage() {
+	if s.usageFile == "" {
+		return
+	}
+	if err := s.usageMeter.Save(s.usageFile); err != nil {
+		log.Printf("Usage: Failed to save %s: %v", s.usageFile, err)
+	}
+}
+
+// observe meters what the client used since it was last observed, or since
+// it connected
+func (s *usageSampler) observe(client clientInfo, now time.Time) {
+	stats := client.traffic.Snapshot()
+	s.mu.Lock()
+	prev, ok := s.seen[client.clientID]
+	s.seen[client.clientID] = usageState{counters: client.traffic, stats: stats, at: now}
+	s.mu.Unlock()
+
+	var base traffic.Stats
+	if ok && prev.counters == client.traffic {
+		base = prev.stats
+	}
+	from := client.connectedAt
+	if ok && prev.at.After(from) {
+		from = prev.at
+	}
+	s.srv.usageMeter.Add(client.clientID, from, now, usage.Usage{
+		Requests:      stats.Requests - base.Requests,
+		BytesSent:     stats.BytesSent - base.BytesSent,
+		BytesReceived: stats.BytesReceived - base.BytesReceived,
+	})
+}
+
+// forgetStale drops the counters of clients that haven't been observed for
+// longer than any session could be resumed after
+func (s *usageSampler) forgetStale(now time.Time, age time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for clientID, state := range s.seen {
+		if now.Sub(state.at) > age {
+			delete(s.seen, clientID)
+		}
+	}
+}
+
+// UsageHandler reports metered usage (GET ?client=&from=&to=&granularity=hour|day&format=json|csv).
+// from and to are RFC 3339 times or dates, defaulting to the last 24 hours.
+func (s *Server) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	now := time.Now()
+	from, err := parseUsageTime(query.Get("from"), now.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid from: %v", err), http.StatusBadRequest)
+		return
+	}
+	to, err := parseUsageTime(query.Get("to"), now)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid to: %v", err), http.StatusBadRequest)
+		return
+	}
+	granularity := usage.Hourly
+	if value := query.Get("granularity"); value != "" {
+		if granularity, err = usage.ParseGranularity(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	records := s.usageMeter.Query(query.Get("client"), from, to, granularity)
+	switch query.Get("format") {
+	case "", "json":
+		if records == nil {
+			records = []usage.Record{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		out := csv.NewWriter(w)
+		out.Write([]string{"client_id", "start", "requests", "bytes_sent", "bytes_received", "connection_hours"})
+		for _, rec := range records {
+			out.Write([]string{
+				rec.ClientID,
+				rec.Start.Format(time.RFC3339),
+				strconv.FormatInt(rec.Requests, 10),
+				strconv.FormatInt(rec.BytesSent, 10),
+				strconv.FormatInt(rec.BytesReceived, 10),
+				strconv.FormatFloat(rec.ConnectionHours, 'f', 4, 64),
+			})
+		}
+		out.Flush()
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+	}
+}
+
+// parseUsageTime reads an RFC 3339 time or a date, returning fallback for ""
+func parseUsageTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/failover"
+	"github.com/vikasavn/attachcloudip/pkg/logging"
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+	"gopkg.in/yaml.v2"
+)
+
+// Listener ports used when the config doesn't set them
+const (
+	defaultHTTPPort         = 9999
+	defaultRegistrationPort = 9998
+)
+
+// validateTimeout bounds the checks that reach Redis and the failover
+// provider's API
+const validateTimeout = 10 * time.Second
+
+// Validate checks config the way Start applies it, without binding sockets
+// or starting background work, and returns every problem found. It reaches
+// Redis and the failover provider's API to check their credentials.
+func Validate(config *Config) error {
+	return newServer(config).validate(config)
+}
+
+// validate applies config to the server's state the way setup does,
+// collecting every problem instead of stopping at the first
+func (s *Server) validate(config *Config) error {
+	var errs []error
+	check := func(section string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", section, err))
+		}
+	}
+	sc := config.Server
+
+	_, err := logging.ParseLevel(sc.Log.Level)
+	check("log", err)
+	for _, tenant := range sc.Tenants {
+		check("tenants", s.tenants.AddTenant(tenant.Name, tenant.APIKeys, tenant.Hosts))
+	}
+	if dir := sc.ErrorPages.Dir; dir != "" {
+		check("error_pages", s.errorPages.Load(dir))
+	}
+	check("default_backend", s.configureDefaultBackend(config))
+	check("bind", s.configureBind(config))
+	check("tcp", s.configureSockets(config))
+	check("tcp_tunnels", s.configureTCPTunnels(config))
+	check("p2p", s.configureP2P(config))
+	check("http", s.configureFrontendLimits(config))
+	check("limits", s.configureClientLimits(config))
+	check("proxy_protocol", s.configureProxyProtocol(config))
+	check("forwarded", s.configureForwarded(config))
+	check("balancer", s.configureBalancer(config))
+	check("routing", s.configureClaimPolicies(config))
+	for _, path := range sc.Routing.Paths {
+		check("routing.paths", routing.Validate(path.Pattern))
+	}
+	check("rbac", s.accessControl.Configure(config))
+	check("redis", s.configureRedis(config))
+	check("middleware", s.configureMiddleware(config))
+	check("qos", s.configureQoS(config))
+	check("profiles", s.configureProfiles(config))
+	if uc := sc.Usage; uc.IntervalSeconds < 0 || uc.HourlyRetentionDays < 0 || uc.DailyRetentionDays < 0 {
+		check("usage", fmt.Errorf("interval and retention must not be negative"))
+	}
+	check("alerts", s.configureAlerts(config))
+	check("chaos", s.configureChaos(config))
+	check("recording", s.configureRecording(config))
+	check("client_releases", s.configureReleases(config))
+	check("failover", validateFailover(config))
+
+	if sc.TLS.HTTP3 && !sc.TLS.Enabled {
+		check("tls", errors.New("http3 requires tls.enabled"))
+	}
+	if identity := sc.Identity; identity.ClientCAFile != "" {
+		if !sc.TLS.Enabled {
+			check("identity", errors.New("client certificate identity requires tls.enabled"))
+		}
+		s.clientCAs, err = loadClientCAs(identity.ClientCAFile)
+		check("identity", err)
+		if identity.PinsFile != "" {
+			check("identity", s.clientManager.LoadPins(identity.PinsFile))
+		}
+	}
+	check("identity", s.sshIdentity.Configure(config))
+	check("identity.path_rules", s.configurePathRules(config))
+	check("tls", s.configureTLS(config))
+	check("tls", validateTLSMaterial(config))
+
+	for _, r := range sc.Reservations {
+		check("reservations", Reservation{ClientID: r.ClientID, Port: r.Port, Hostname: r.Hostname}.validate())
+	}
+	check("ports", s.validatePorts(config))
+	return errors.Join(errs...)
+}
+
+// validateTLSMaterial loads the default certificate, as startTLS does
+func validateTLSMaterial(config *Config) error {
+	tc := config.Server.TLS
+	if !tc.Enabled {
+		return nil
+	}
+	var err error
+	switch {
+	case tc.Cert != "":
+		_, err = tls.X509KeyPair([]byte(tc.Cert), []byte(tc.Key))
+	case tc.CertFile != "":
+		_, err = tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid default certificate: %v", err)
+	}
+	return nil
+}
+
+// validatePorts checks that every listener has a port in range and that no
+// two listeners on the same address share one
+func (s *Server) validatePorts(config *Config) error {
+	sc := config.Server
+	type listener struct {
+		name, address string
+		port          int
+	}
+	listeners := []listener{
+		{"ports.http", s.bindAddresses.http, orDefault(sc.Ports.HTTP, defaultHTTPPort)},
+		{"ports.registration", s.bindAddresses.registration, orDefault(sc.Ports.Registration, defaultRegistrationPort)},
+	}
+	if sc.TLS.Enabled {
+		listeners = append(listeners, listener{"ports.https", s.bindAddresses.https, httpsPort(config)})
+	}
+	if sc.Ports.Shared != 0 {
+		listeners = append(listeners, listener{"ports.shared", s.bindAddresses.shared, sc.Ports.Shared})
+	}
+	for _, r := range sc.Reservations {
+		if r.Port != 0 {
+			listeners = append(listeners, listener{"reservation " + r.ClientID, s.bindAddresses.reserved, r.Port})
+		}
+	}
+
+	var errs []error
+	seen := make(map[string]string)
+	for _, l := range listeners {
+		if l.port < 1 || l.port > 65535 {
+			errs = append(errs, fmt.Errorf("%s: port %d is out of range", l.name, l.port))
+			continue
+		}
+		address := net.JoinHostPort(l.address, strconv.Itoa(l.port))
+		if other, ok := seen[address]; ok {
+			errs = append(errs, fmt.Errorf("%s: port %d is also used by %s", l.name, l.port, other))
+			continue
+		}
+		seen[address] = l.name
+	}
+	return errors.Join(errs...)
+}
+
+func orDefault(value, def int) int {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// validateFailover checks the failover settings and that the provider's API
+// token can see the floating IP
+func validateFailover(config *Config) error {
+	fc := config.Server.Failover
+	if fc.Role == "" {
+		return nil
+	}
+	role := failover.Role(fc.Role)
+	if role != failover.RoleActive && role != failover.RoleStandby {
+		return fmt.Errorf("invalid failover role: %s", fc.Role)
+	}
+	if fc.APIToken == "" || fc.FloatingIP == "" || fc.TargetID == "" {
+		return fmt.Errorf("api_token, floating_ip, and target_id are required")
+	}
+	if role == failover.RoleStandby && fc.PeerURL == "" {
+		return fmt.Errorf("standby instances need peer_url")
+	}
+	provider, err := failover.NewProvider(fc.Provider, fc.APIToken)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+	if err := provider.CheckFloatingIP(ctx, fc.FloatingIP); err != nil {
+		return fmt.Errorf("floating IP %s: %v", fc.FloatingIP, err)
+	}
+	return nil
+}
+
+// secretKeys match the config keys whose values EffectiveConfig redacts
+var secretKeys = regexp.MustCompile(`^(key|api_keys|api_token|peer_api_key|routing_key|password|token|secret_access_key)$`)
+
+// EffectiveConfig returns the server section of config as YAML, with the
+// defaults Start applies filled in and credentials redacted
+func EffectiveConfig(config *Config) ([]byte, error) {
+	effective := *config
+	sc := &effective.Server
+	sc.Ports.HTTP = orDefault(sc.Ports.HTTP, defaultHTTPPort)
+	sc.Ports.Registration = orDefault(sc.Ports.Registration, defaultRegistrationPort)
+	if sc.TLS.Enabled {
+		sc.Ports.HTTPS = httpsPort(config)
+		if sc.TLS.MinVersion == "" {
+			sc.TLS.MinVersion = "1.2"
+		}
+	}
+	if len(sc.Middleware) == 0 {
+		for _, entry := range defaultMiddleware {
+			sc.Middleware = append(sc.Middleware, MiddlewareConfig{Name: entry.Name})
+		}
+	}
+	if sc.Routing.ClaimPolicy == "" {
+		sc.Routing.ClaimPolicy = "share"
+	}
+
+	data, err := yaml.Marshal(map[string]interface{}{"server": sc})
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(redactSecrets(tree, false))
+}
+
+// redactSecrets replaces the non-empty values under secret keys in a parsed
+// YAML document, sorting map keys so the output is stable
+func redactSecrets(node interface{}, secret bool) interface{} {
+	switch v := node.(type) {
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, fmt.Sprint(key))
+		}
+		sort.Strings(keys)
+		sorted := make(yaml.MapSlice, 0, len(keys))
+		for _, key := range keys {
+			sorted = append(sorted, yaml.MapItem{Key: key, Value: redactSecrets(v[key], secret || secretKeys.MatchString(key))})
+		}
+		return sorted
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactSecrets(item, secret)
+		}
+	case string:
+		if secret && v != "" {
+			return "<redacted>"
+		}
+	}
+	return node
+}
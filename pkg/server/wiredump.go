@@ -0,0 +1,251 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Wire dump defaults
+const (
+	defaultWireDumpBytes    = 256 // Logged per read or write, the rest is counted
+	maxWireDumpBytes        = 64 * 1024
+	defaultWireDumpDuration = 10 * time.Minute
+	maxWireDumpDuration     = 24 * time.Hour
+)
+
+// WireDump is a client or public connection whose raw bytes are logged as a
+// hexdump until it expires
+type WireDump struct {
+	ClientID     string    `json:"client_id,omitempty"`
+	ConnectionID string    `json:"connection_id,omitempty"`
+	MaxBytes     int       `json:"max_bytes"` // Logged per read or write
+	Expires      time.Time `json:"expires"`
+}
+
+func (d WireDump) key() string {
+	if d.ConnectionID != "" {
+		return "connection|" + d.ConnectionID
+	}
+	return "client|" + d.ClientID
+}
+
+// wireDumpStore holds the enabled wire dumps
+type wireDumpStore struct {
+	enabled atomic.Int32 // Dumps held, so reads and writes skip the lock while there are none
+
+	mu    sync.Mutex
+	dumps map[string]WireDump // By key
+}
+
+// addWireDump enables or replaces a wire dump
+func (s *Server) addWireDump(dump WireDump) {
+	s.wireDumps.mu.Lock()
+	defer s.wireDumps.mu.Unlock()
+	s.wireDumps.dumps[dump.key()] = dump
+	s.wireDumps.enabled.Store(int32(len(s.wireDumps.dumps)))
+}
+
+// removeWireDump disables a wire dump, reporting whether it was enabled
+func (s *Server) removeWireDump(dump WireDump) bool {
+	s.wireDumps.mu.Lock()
+	defer s.wireDumps.mu.Unlock()
+	_, ok := s.wireDumps.dumps[dump.key()]
+	delete(s.wireDumps.dumps, dump.key())
+	s.wireDumps.enabled.Store(int32(len(s.wireDumps.dumps)))
+	return ok
+}
+
+// listWireDumps returns the enabled wire dumps, dropping expired ones
+func (s *Server) listWireDumps() []WireDump {
+	s.wireDumps.mu.Lock()
+	defer s.wireDumps.mu.Unlock()
+	list := []WireDump{}
+	now := time.Now()
+	for key, dump := range s.wireDumps.dumps {
+		if now.After(dump.Expires) {
+			s.expireWireDumpLocked(key, dump)
+			continue
+		}
+		list = append(list, dump)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+	return list
+}
+
+func (s *Server) expireWireDumpLocked(key string, dump WireDump) {
+	delete(s.wireDumps.dumps, key)
+	s.wireDumps.enabled.Store(int32(len(s.wireDumps.dumps)))
+	log.Printf("Wire dump: Expired dump of %s", dump.subject())
+}
+
+func (d WireDump) subject() string {
+	if d.ConnectionID != "" {
+		return "connection " + d.ConnectionID
+	}
+	return "client " + d.ClientID
+}
+
+// wireDumpFor returns the dump enabled for the connection or client, checking
+// the connection first. Either ID may be empty.
+func (s *Server) wireDumpFor(connectionID, clientID string) (WireDump, bool) {
+	if s.wireDumps.enabled.Load() == 0 {
+		return WireDump{}, false
+	}
+	s.wireDumps.mu.Lock()
+	defer s.wireDumps.mu.Unlock()
+	for _, candidate := range []WireDump{{ConnectionID: connectionID}, {ClientID: clientID}} {
+		if candidate.ConnectionID == "" && candidate.ClientID == "" {
+			continue
+		}
+		dump, ok := s.wireDumps.dumps[candidate.key()]
+		if !ok {
+			continue
+		}
+		if time.Now().After(dump.Expires) {
+			s.expireWireDumpLocked(candidate.key(), dump)
+			continue
+		}
+		return dump, true
+	}
+	return WireDump{}, false
+}
+
+// logWire logs the bytes of one read or write as a hexdump, truncated to the
+// dump's max bytes
+func logWire(dump WireDump, what string, p []byte) {
+	shown := p
+	if len(shown) > dump.MaxBytes {
+		shown = shown[:dump.MaxBytes]
+	}
+	more := ""
+	if n := len(p) - len(shown); n > 0 {
+		more = fmt.Sprintf("... %d more bytes not shown\n", n)
+	}
+	log.Printf("Wire dump: %s, %d bytes:\n%s%s", what, len(p), hex.Dump(shown), more)
+}
+
+// wireConn dumps the bytes of a tunnel connection once its client is known
+type wireConn struct {
+	srv *Server
+	net.Conn
+	clientID atomic.Value // string, stored after registration
+}
+
+func (c *wireConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.dump("read from", p[:n])
+	}
+	return n, err
+}
+
+func (c *wireConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.dump("wrote to", p[:n])
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the connection, if the one it wraps can be
+func (c *wireConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *wireConn) dump(direction string, p []byte) {
+	if c.srv.wireDumps.enabled.Load() == 0 {
+		return
+	}
+	clientID, _ := c.clientID.Load().(string)
+	if dump, ok := c.srv.wireDumpFor("", clientID); ok {
+		logWire(dump, fmt.Sprintf("%s tunnel of client %s", direction, clientID), p)
+	}
+}
+
+// dump logs the bytes of a public connection if it or the client of its
+// latest request is dumped
+func (c *publicConn) dump(direction string, p []byte) {
+	if c.srv.wireDumps.enabled.Load() == 0 {
+		return
+	}
+	clientID, _ := c.clientID.Load().(string)
+	if dump, ok := c.srv.wireDumpFor(c.id, clientID); ok {
+		logWire(dump, fmt.Sprintf("%s connection %s", direction, c.id), p)
+	}
+}
+
+// WireDumpHandler lists the wire dumps (GET), enables one (POST with
+// {"client_id": id} or {"connection_id": id}, and optionally "max_bytes" and
+// "duration_seconds"), or disables one (DELETE ?client_id= or ?connection_id=)
+func (s *Server) WireDumpHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request struct {
+			ClientID        string `json:"client_id"`
+			ConnectionID    string `json:"connection_id"`
+			MaxBytes        int    `json:"max_bytes"`
+			DurationSeconds int    `json:"duration_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if (request.ClientID == "") == (request.ConnectionID == "") {
+			http.Error(w, "One of client_id or connection_id is required", http.StatusBadRequest)
+			return
+		}
+		if request.MaxBytes < 0 || request.MaxBytes > maxWireDumpBytes {
+			http.Error(w, fmt.Sprintf("max_bytes must be between 0 and %d", maxWireDumpBytes), http.StatusBadRequest)
+			return
+		}
+		duration := time.Duration(request.DurationSeconds) * time.Second
+		if duration < 0 || duration > maxWireDumpDuration {
+			http.Error(w, fmt.Sprintf("duration_seconds must be between 0 and %d", int(maxWireDumpDuration.Seconds())), http.StatusBadRequest)
+			return
+		}
+		dump := WireDump{ClientID: request.ClientID, ConnectionID: request.ConnectionID, MaxBytes: request.MaxBytes}
+		if dump.MaxBytes == 0 {
+			dump.MaxBytes = defaultWireDumpBytes
+		}
+		if duration == 0 {
+			duration = defaultWireDumpDuration
+		}
+		dump.Expires = time.Now().Add(duration)
+		s.addWireDump(dump)
+		log.Printf("Wire dump: Dumping %s, up to %d bytes per read or write, until %s",
+			dump.subject(), dump.MaxBytes, dump.Expires.Format(time.RFC3339))
+	case http.MethodDelete:
+		query := r.URL.Query()
+		dump := WireDump{ClientID: query.Get("client_id"), ConnectionID: query.Get("connection_id")}
+		if (dump.ClientID == "") == (dump.ConnectionID == "") {
+			http.Error(w, "One of client_id or connection_id is required", http.StatusBadRequest)
+			return
+		}
+		if !s.removeWireDump(dump) {
+			http.Error(w, fmt.Sprintf("No wire dump of %s", dump.subject()), http.StatusNotFound)
+			return
+		}
+		log.Printf("Wire dump: Stopped dumping %s", dump.subject())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.listWireDumps())
+}
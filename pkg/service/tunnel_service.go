@@ -3,20 +3,31 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
 	"net/http"
 	"os"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/vikasavn/attachcloudip/pkg/ports"
+	"github.com/vikasavn/attachcloudip/pkg/registry"
+	"github.com/vikasavn/attachcloudip/pkg/routing"
+	"github.com/vikasavn/attachcloudip/pkg/traffic"
 )
 
 var logger = log.New(os.Stdout, "\x1b[32m[TunnelService]\x1b[0m ", log.LstdFlags|log.Lmicroseconds)
 
+// errNoSender fails deliveries before SetSender gives the service a
+// transport to its clients
+var errNoSender = errors.New("no transport to clients")
+
 type HttpRequest struct {
 	Method  string
 	Path    string
@@ -45,13 +56,24 @@ const (
 	StreamResponseType_HTTP_RESPONSE
 	StreamResponseType_ERROR
 	StreamResponseType_REGISTRATION_SUCCESS
+	StreamResponseType_PATHS_UPDATED
+	StreamResponseType_BROADCAST
+	StreamResponseType_CANCEL // The server gave up on RequestId
 )
 
+// cancelSendTimeout bounds telling a client to cancel a request the caller
+// abandoned
+const cancelSendTimeout = 5 * time.Second
+
 type StreamRequest struct {
 	Type        StreamRequestType
 	RequestId   string
 	HttpRequest *HttpRequest
 	Protocol    string
+	Tenant      string
+	// AddPaths and RemovePaths are the changes of a PATH_UPDATE
+	AddPaths    []string
+	RemovePaths []string
 }
 
 type StreamResponse struct {
@@ -61,6 +83,7 @@ type StreamResponse struct {
 	HttpResponse *HttpResponse
 	Message      string
 	Port         int
+	Paths        []string // The client's paths after a PATH_UPDATE
 }
 
 type ResponseWaiter struct {
@@ -70,6 +93,7 @@ type ResponseWaiter struct {
 
 type ClientInfo struct {
 	ID          string
+	Tenant      string
 	SessionID   string
 	Paths       []string
 	Description string
@@ -78,6 +102,8 @@ type ClientInfo struct {
 	Status      string
 	Protocol    string
 	Port        int
+	Traffic     *traffic.Counters
+	RTT         *traffic.RTT // Rolling average of heartbeat round trips
 }
 
 type ConnectionOptionsProtocol int
@@ -95,53 +121,49 @@ type ConnectionOptions struct {
 	IdleTimeout       int
 }
 
-type PortManager struct {
-	ports map[int]bool
-	mu    sync.RWMutex
-}
-
-func NewPortManager() *PortManager {
-	return &PortManager{
-		ports: make(map[int]bool),
-	}
-}
-
-func (pm *PortManager) AllocatePort() (int, error) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	for port := 1024; port < 65536; port++ {
-		if !pm.ports[port] {
-			pm.ports[port] = true
-			return port, nil
-		}
-	}
-
-	return 0, fmt.Errorf("no available ports")
-}
-
-func (pm *PortManager) ReleasePort(port int) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	pm.ports[port] = false
+// Sender delivers messages over the connections of clients, returning once
+// the message is written or failed to be
+type Sender interface {
+	Send(ctx context.Context, clientID string, msg *StreamResponse) error
 }
 
 type TunnelService struct {
 	clients         map[string]*ClientInfo
-	pathClients     map[string][]string
+	routes          map[string]*routing.Table // Map tenant to its route table
 	responseWaiters *sync.Map
 	mu              sync.RWMutex
-	availablePorts  []int
+	ports           *ports.Allocator
+	sender          Sender // Nil until SetSender, when messages are only logged
 }
 
-func NewTunnelService(ports []int) *TunnelService {
+func NewTunnelService(available []int) *TunnelService {
 	return &TunnelService{
 		clients:         make(map[string]*ClientInfo),
-		pathClients:     make(map[string][]string),
+		routes:          make(map[string]*routing.Table),
 		responseWaiters: &sync.Map{},
-		availablePorts:  ports,
+		ports:           ports.Of(available),
+	}
+}
+
+// ReservePort assigns a fixed port to a client ID so it always registers on
+// the same port. The port is removed from the dynamic pool.
+func (s *TunnelService) ReservePort(clientID string, port int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, client := range s.clients {
+		if client.Port == port && id != clientID {
+			return fmt.Errorf("port %d is in use by client %s", port, id)
+		}
+	}
+	previous, hadReservation := s.ports.Reservation(clientID)
+	if err := s.ports.Reserve(port, clientID); err != nil {
+		return err
 	}
+	if hadReservation && previous != port {
+		s.ports.Unreserve(previous)
+	}
+	return nil
 }
 
 func (s *TunnelService) Register(ctx context.Context, req *StreamRequest) (*StreamResponse, error) {
@@ -155,29 +177,51 @@ func (s *TunnelService) Register(ctx context.Context, req *StreamRequest) (*Stre
 		return nil, fmt.Errorf("at least one path is required")
 	}
 
-	if len(s.availablePorts) == 0 {
-		return nil, fmt.Errorf("no available ports for registration")
-	}
-
 	sessionID := uuid.New().String()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// Remove existing client if any
+	// Remove existing client if any, unless it belongs to another tenant
 	if oldClient, exists := s.clients[req.RequestId]; exists {
+		if oldClient.Tenant != req.Tenant {
+			return nil, fmt.Errorf("client ID %s belongs to another tenant", req.RequestId)
+		}
 		logger.Printf("⚠️  Removing existing client: %s", req.RequestId)
-		s.removeClientPaths(oldClient)
-		delete(s.clients, req.RequestId)
+		s.removeClient(req.RequestId)
+	}
+
+	// Route the path to the client before taking a port, since the pattern may be invalid
+	normalizedPath := normalizePath(req.HttpRequest.Path)
+	table, ok := s.routes[req.Tenant]
+	if !ok {
+		table = routing.NewTable()
+		s.routes[req.Tenant] = table
+	}
+	if err := table.Insert(normalizedPath, req.RequestId); err != nil {
+		if table.Len() == 0 {
+			delete(s.routes, req.Tenant)
+		}
+		return nil, err
 	}
 
-	// Get an available port
-	port := s.availablePorts[0]
-	s.availablePorts = s.availablePorts[1:] // Remove used port
+	// Use the client's reserved port, or get an available one
+	port, reserved := s.ports.Reservation(req.RequestId)
+	if !reserved {
+		var err error
+		if port, err = s.ports.Allocate(); err != nil {
+			table.Remove(normalizedPath, req.RequestId)
+			return nil, fmt.Errorf("no available ports for registration")
+		}
+	}
 
 	// Create new client info
 	client := &ClientInfo{
 		ID:          req.RequestId,
+		Tenant:      req.Tenant,
 		SessionID:   sessionID,
 		Paths:       make([]string, 0, 1),
 		Description: "",
@@ -186,13 +230,13 @@ func (s *TunnelService) Register(ctx context.Context, req *StreamRequest) (*Stre
 		Status:      "connecting",
 		Protocol:    req.Protocol,
 		Port:        port,
+		Traffic:     traffic.NewCounters(),
+		RTT:         traffic.NewRTT(),
 	}
 
 	// Process paths
-	normalizedPath := normalizePath(req.HttpRequest.Path)
 	if !contains(client.Paths, normalizedPath) {
 		client.Paths = append(client.Paths, normalizedPath)
-		s.pathClients[normalizedPath] = append(s.pathClients[normalizedPath], req.RequestId)
 	}
 
 	// Store client
@@ -200,6 +244,7 @@ func (s *TunnelService) Register(ctx context.Context, req *StreamRequest) (*Stre
 
 	logger.Printf("✅ Client registered successfully:")
 	logger.Printf("   - Client ID: %s", req.RequestId)
+	logger.Printf("   - Tenant: %q", req.Tenant)
 	logger.Printf("   - Session ID: %s", sessionID)
 	logger.Printf("   - Assigned Port: %d", port)
 	logger.Printf("   - Paths: %v", client.Paths)
@@ -211,20 +256,145 @@ func (s *TunnelService) Register(ctx context.Context, req *StreamRequest) (*Stre
 	}, nil
 }
 
-func (s *TunnelService) SendToClient(clientID string, msg *StreamResponse) error {
+// UpdatePaths handles a PATH_UPDATE from a registered client, changing its
+// paths and routes together. Nothing changes if a path is invalid, not the
+// client's to remove, or registered by another client of the tenant.
+func (s *TunnelService) UpdatePaths(ctx context.Context, req *StreamRequest) (*StreamResponse, error) {
+	if req.Type != StreamRequestType_PATH_UPDATE {
+		return nil, fmt.Errorf("not a path update")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	client, ok := s.clients[req.RequestId]
+	if !ok {
+		return nil, fmt.Errorf("client not found: %s", req.RequestId)
+	}
+	paths := append([]string(nil), client.Paths...)
+	remove := make([]string, 0, len(req.RemovePaths))
+	for _, p := range req.RemovePaths {
+		normalizedPath := normalizePath(p)
+		i := slices.Index(paths, normalizedPath)
+		if i < 0 {
+			return nil, fmt.Errorf("client %s has no path %s", client.ID, normalizedPath)
+		}
+		paths = slices.Delete(paths, i, i+1)
+		remove = append(remove, normalizedPath)
+	}
+	add := make([]string, 0, len(req.AddPaths))
+	for _, p := range req.AddPaths {
+		normalizedPath := normalizePath(p)
+		if err := routing.Validate(normalizedPath); err != nil {
+			return nil, err
+		}
+		if contains(paths, normalizedPath) {
+			return nil, fmt.Errorf("client %s already has path %s", client.ID, normalizedPath)
+		}
+		for id, other := range s.clients {
+			if id != client.ID && other.Tenant == client.Tenant && contains(other.Paths, normalizedPath) {
+				return nil, fmt.Errorf("path %s is claimed by client %s", normalizedPath, id)
+			}
+		}
+		paths = append(paths, normalizedPath)
+		add = append(add, normalizedPath)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("client %s must keep at least one path", client.ID)
+	}
+
+	table, ok := s.routes[client.Tenant]
+	if !ok {
+		table = routing.NewTable()
+		s.routes[client.Tenant] = table
+	}
+	for _, p := range remove {
+		table.Remove(p, client.ID)
+	}
+	for _, p := range add {
+		table.Insert(p, client.ID) // Validated above
+	}
+	if table.Len() == 0 {
+		delete(s.routes, client.Tenant)
+	}
+	client.Paths = paths
+	logger.Printf("🔀 Client %s paths updated: %v", client.ID, paths)
+
+	return &StreamResponse{
+		Type:      StreamResponseType_PATHS_UPDATED,
+		RequestId: req.RequestId,
+		Paths:     append([]string(nil), paths...),
+	}, nil
+}
+
+// RecordRTT adds a heartbeat round trip reported by the client to its rolling average
+func (s *TunnelService) RecordRTT(clientID string, rtt time.Duration) error {
+	s.mu.RLock()
+	client, ok := s.clients[clientID]
+	s.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("client not found: %s", clientID)
+	}
+	client.RTT.Add(rtt)
+	return nil
+}
+
+// SetSender makes SendToClient deliver messages with sender
+func (s *TunnelService) SetSender(sender Sender) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sender = sender
+}
+
+// SendToClient delivers a message to a registered client, unless ctx is
+// already done. It fails with errNoSender until SetSender is called.
+func (s *TunnelService) SendToClient(ctx context.Context, clientID string, msg *StreamResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	s.mu.RLock()
 	_, ok := s.clients[clientID]
+	sender := s.sender
 	s.mu.RUnlock()
 
 	if !ok {
 		return fmt.Errorf("client not found: %s", clientID)
 	}
 
-	// In a non-gRPC world, this would involve a different communication mechanism
-	// For now, we'll just log that a message would be sent
-	fmt.Printf("Would send message to client %s: %+v\n", clientID, msg)
+	if sender == nil {
+		return errNoSender
+	}
+	return sender.Send(ctx, clientID, msg)
+}
 
-	return nil
+// Broadcast sends a BROADCAST message to the registered clients for which
+// match returns true, all of them if match is nil, and returns each
+// client's delivery error, nil if it got the message
+func (s *TunnelService) Broadcast(ctx context.Context, message string, match func(*ClientInfo) bool) map[string]error {
+	s.mu.RLock()
+	var targets []string
+	for id, client := range s.clients {
+		if match == nil || match(client) {
+			targets = append(targets, id)
+		}
+	}
+	s.mu.RUnlock()
+
+	results := make(map[string]error, len(targets))
+	for _, id := range targets {
+		results[id] = s.SendToClient(ctx, id, &StreamResponse{
+			Type:      StreamResponseType_BROADCAST,
+			RequestId: uuid.New().String(),
+			Message:   message,
+		})
+	}
+	logger.Printf("📣 Broadcast to %d clients", len(targets))
+	return results
 }
 
 func (s *TunnelService) handleHTTPRequest(ctx context.Context, clientID string, req *HttpRequest, requestID string) error {
@@ -241,23 +411,50 @@ func (s *TunnelService) handleHTTPRequest(ctx context.Context, clientID string,
 		HttpRequest: req,
 	}
 
-	if err := s.SendToClient(clientID, streamResp); err != nil {
+	if err := s.SendToClient(ctx, clientID, streamResp); err != nil {
 		return fmt.Errorf("failed to send request to client: %v", err)
 	}
 
+	s.mu.RLock()
+	client := s.clients[clientID]
+	s.mu.RUnlock()
+	if client != nil {
+		client.Traffic.AddRequest()
+		client.Traffic.AddSent(len(req.Body))
+	}
+
 	select {
 	case resp := <-waiter.Response:
+		if client != nil && resp.HttpResponse != nil {
+			client.Traffic.AddReceived(len(resp.HttpResponse.Body))
+		}
 		if resp.Type == StreamResponseType_ERROR {
 			return fmt.Errorf("client error: %s", resp.Message)
 		}
 		return nil
 	case <-ctx.Done():
-		return fmt.Errorf("request cancelled")
+		s.cancelOnClient(ctx, clientID, requestID)
+		return fmt.Errorf("request cancelled: %v", ctx.Err())
 	case <-time.After(30 * time.Second):
+		s.cancelOnClient(ctx, clientID, requestID)
 		return fmt.Errorf("request timeout")
 	}
 }
 
+// cancelOnClient tells a client to stop working on a request nobody waits
+// for anymore, such as one whose caller disconnected
+func (s *TunnelService) cancelOnClient(ctx context.Context, clientID, requestID string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cancelSendTimeout)
+	defer cancel()
+	err := s.SendToClient(ctx, clientID, &StreamResponse{
+		Type:      StreamResponseType_CANCEL,
+		RequestId: requestID,
+	})
+	if err != nil {
+		logger.Printf("Failed to cancel request %s on client %s: %v", requestID, clientID, err)
+	}
+}
+
 func (s *TunnelService) handleHTTPResponse(req *StreamRequest) error {
 	if req.RequestId == "" {
 		return fmt.Errorf("empty request ID")
@@ -319,27 +516,20 @@ func (s *TunnelService) GetResponseWaiter(requestID string) (*ResponseWaiter, bo
 	return waiter, ok
 }
 
-func (s *TunnelService) FindMatchingClient(requestPath string) (*ClientInfo, error) {
+func (s *TunnelService) FindMatchingClient(ctx context.Context, tenant, requestPath string) (*ClientInfo, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-
-	normalizedRequestPath := normalizePath(requestPath)
-	logger.Printf("Finding client for path: %s (normalized: %s)", requestPath, normalizedRequestPath)
-
-	// First try exact match
-	if clientIDs, exists := s.pathClients[normalizedRequestPath]; exists && len(clientIDs) > 0 {
-		if client, exists := s.clients[clientIDs[0]]; exists {
-			logger.Printf("Found exact match client %s for path %s", client.ID, normalizedRequestPath)
-			return client, nil
-		}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	// Then try pattern matching
-	for path, clientIDs := range s.pathClients {
-		if len(clientIDs) > 0 && isPathMatch(path, normalizedRequestPath) {
-			if client, exists := s.clients[clientIDs[0]]; exists {
-				logger.Printf("Found pattern match client %s for path %s using pattern %s",
-					client.ID, normalizedRequestPath, path)
+	normalizedRequestPath := normalizePath(requestPath)
+	logger.Printf("Finding client for path: %s (normalized: %s, tenant: %q)", requestPath, normalizedRequestPath, tenant)
+	if table, ok := s.routes[tenant]; ok {
+		if match, ok := table.Lookup(normalizedRequestPath); ok {
+			if client, exists := s.clients[match.IDs[0]]; exists {
+				logger.Printf("Found client %s for path %s using route %s",
+					client.ID, normalizedRequestPath, match.Pattern)
 				return client, nil
 			}
 		}
@@ -353,29 +543,38 @@ func (s *TunnelService) removeClient(clientID string) {
 	if client, exists := s.clients[clientID]; exists {
 		s.removeClientPaths(client)
 		delete(s.clients, clientID)
+		s.ports.Release(client.Port) // A no-op for reserved ports
 		logger.Printf("Removed client %s", clientID)
 	}
 }
 
 func (s *TunnelService) removeClientPaths(client *ClientInfo) {
+	table, ok := s.routes[client.Tenant]
+	if !ok {
+		return
+	}
 	for _, p := range client.Paths {
 		normalizedPath := normalizePath(p)
-		clients := s.pathClients[normalizedPath]
-		for i, id := range clients {
-			if id == client.ID {
-				s.pathClients[normalizedPath] = append(clients[:i], clients[i+1:]...)
-				logger.Printf("Removed path mapping: %s -> %s", normalizedPath, client.ID)
-				break
-			}
-		}
-		if len(s.pathClients[normalizedPath]) == 0 {
-			delete(s.pathClients, normalizedPath)
-			logger.Printf("Removed empty path mapping for: %s", normalizedPath)
-		}
+		table.Remove(normalizedPath, client.ID)
+		logger.Printf("Removed path mapping: %s -> %s", normalizedPath, client.ID)
+	}
+	if table.Len() == 0 {
+		delete(s.routes, client.Tenant)
 	}
 }
 
+// routePaths returns the tenant's routes with the clients registered for each
+func (s *TunnelService) routePaths(tenant string) map[string][]string {
+	if table, ok := s.routes[tenant]; ok {
+		return table.Routes()
+	}
+	return nil
+}
+
 func normalizePath(p string) string {
+	if routing.IsRegex(p) {
+		return p
+	}
 	// Remove trailing slash if present
 	p = strings.TrimRight(p, "/")
 	// Ensure path starts with /
@@ -385,12 +584,6 @@ func normalizePath(p string) string {
 	return p
 }
 
-func isPathMatch(pattern, requestPath string) bool {
-	// For now, just check if the request path starts with the pattern
-	// TODO: Implement more sophisticated pattern matching (e.g., glob patterns)
-	return strings.HasPrefix(requestPath, pattern)
-}
-
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
 		if s == item {
@@ -400,24 +593,53 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
+// HandleStatusRequest reports clients and path mappings, filtered to one
+// tenant with ?tenant=
 func (s *TunnelService) HandleStatusRequest(w http.ResponseWriter, r *http.Request) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	opts, err := registry.ParseListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	// Copy what is reported under the lock and encode it after
+	s.mu.RLock()
 	status := make([]map[string]interface{}, 0)
-	for _, client := range s.clients {
+	ids := make([]string, 0, len(s.clients))
+	for id := range s.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		client := s.clients[id]
+		if opts.FilterTenant && client.Tenant != opts.Tenant {
+			continue
+		}
+		if opts.Status != "" && client.Status != opts.Status {
+			continue
+		}
+		if opts.Path != "" && !contains(client.Paths, normalizePath(opts.Path)) {
+			continue
+		}
 		status = append(status, map[string]interface{}{
 			"id":          client.ID,
-			"paths":       client.Paths,
+			"tenant":      client.Tenant,
+			"paths":       append([]string(nil), client.Paths...),
 			"description": client.Description,
 			"status":      client.Status,
 			"port":        client.Port,
+			"traffic":     client.Traffic.Snapshot(),
+			"rtt_ms":      float64(client.RTT.Average()) / float64(time.Millisecond),
 		})
 	}
+	paths := s.routePaths(opts.Tenant)
+	s.mu.RUnlock()
 
+	start, end := opts.Page(len(status))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"clients": status,
-		"paths":   s.pathClients,
+		"clients": status[start:end],
+		"total":   len(status),
+		"paths":   paths,
 	})
 }
@@ -0,0 +1,52 @@
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// errHelloRead stops a handshake once the ClientHello has been read
+var errHelloRead = errors.New("client hello read")
+
+// PeekClientHello reads the TLS ClientHello a connection starts with and
+// returns it, with a connection that reads it again for whoever completes
+// the handshake. The connection is returned even when no ClientHello could
+// be read.
+func PeekClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
+	var peeked bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	err := tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			copied := *info
+			hello = &copied
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	replay := &peekedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(&peeked, conn))}
+	if hello == nil {
+		return nil, replay, err
+	}
+	return hello, replay, nil
+}
+
+// helloConn feeds a handshake the bytes read from the connection, dropping
+// what the handshake writes to it, like the alert on aborting
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c helloConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,169 @@
+// Package sniff shares one listener between HTTP, TLS, and the tunnel
+// protocol by peeking at the first bytes of each connection
+package sniff
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Protocol is what a connection on a shared listener speaks
+type Protocol int
+
+const (
+	HTTP   Protocol = iota // Plain HTTP/1.x
+	TLS                    // A TLS handshake, e.g. HTTPS
+	Tunnel                 // Anything else, e.g. a tunnel registration
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case HTTP:
+		return "http"
+	case TLS:
+		return "tls"
+	}
+	return "tunnel"
+}
+
+// sniffTimeout bounds how long a new connection may take to send the bytes
+// that identify its protocol
+const sniffTimeout = 10 * time.Second
+
+// maxMethodLength is the longest HTTP method recognized, "OPTIONS"
+const maxMethodLength = 7
+
+var httpMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+// Mux accepts connections from a shared listener and hands each to the
+// listener of its protocol. Connections for protocols without a listener are
+// closed.
+type Mux struct {
+	root      net.Listener
+	listeners map[Protocol]*listener
+	mu        sync.Mutex
+}
+
+func New(root net.Listener) *Mux {
+	return &Mux{root: root, listeners: make(map[Protocol]*listener)}
+}
+
+// Listener returns the listener for connections speaking p
+func (m *Mux) Listener(p Protocol) net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.listeners[p]; ok {
+		return l
+	}
+	l := &listener{addr: m.root.Addr(), conns: make(chan net.Conn), done: make(chan struct{})}
+	m.listeners[p] = l
+	return l
+}
+
+// Serve accepts connections until the shared listener is closed
+func (m *Mux) Serve() error {
+	for {
+		conn, err := m.root.Accept()
+		if err != nil {
+			m.mu.Lock()
+			for _, l := range m.listeners {
+				l.Close()
+			}
+			m.mu.Unlock()
+			return err
+		}
+		go m.dispatch(conn)
+	}
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	peeked := &peekedConn{Conn: conn, r: bufio.NewReader(conn)}
+	p, err := detect(peeked.r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	m.mu.Lock()
+	l, ok := m.listeners[p]
+	m.mu.Unlock()
+	if !ok {
+		log.Printf("Shared port: No %s listener for connection from %s", p, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- peeked:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// detect identifies the protocol from the first bytes without consuming them.
+// It only waits for as many bytes as it needs, since a tunnel client sends a
+// short registration line and then waits for the answer.
+func detect(r *bufio.Reader) (Protocol, error) {
+	for n := 1; n <= maxMethodLength+1; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return 0, err
+		}
+		c := b[n-1]
+		switch {
+		case n == 1 && c == 0x16: // TLS handshake record
+			return TLS, nil
+		case c == ' ':
+			if httpMethods[string(b[:n-1])] {
+				return HTTP, nil
+			}
+			return Tunnel, nil
+		case c < 'A' || c > 'Z':
+			return Tunnel, nil
+		}
+	}
+	return Tunnel, nil
+}
+
+// peekedConn reads the bytes peeked while sniffing before the rest of the connection
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// listener hands out the connections the mux dispatched to one protocol
+type listener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,103 @@
+// Package sockopt tunes the TCP sockets of public and tunnel connections,
+// shared by the server's listeners and the client's dialers
+package sockopt
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Options are TCP socket settings. Zero values keep the system defaults.
+type Options struct {
+	NoDelay         *bool         // TCP_NODELAY, which Go enables by default
+	KeepAlive       time.Duration // Keepalive probe period, negative disables keepalives
+	ReadBufferSize  int           // SO_RCVBUF in bytes
+	WriteBufferSize int           // SO_SNDBUF in bytes
+	Linger          *int          // SO_LINGER in seconds, 0 resets the connection on close
+}
+
+// IsZero reports whether the options change nothing
+func (o Options) IsZero() bool {
+	return o.NoDelay == nil && o.KeepAlive == 0 && o.ReadBufferSize == 0 &&
+		o.WriteBufferSize == 0 && o.Linger == nil
+}
+
+// Apply sets the options on conn. Connections that aren't TCP, such as
+// those wrapped in TLS, are left alone.
+func (o Options) Apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok || o.IsZero() {
+		return nil
+	}
+	if o.NoDelay != nil {
+		if err := tcp.SetNoDelay(*o.NoDelay); err != nil {
+			return err
+		}
+	}
+	if o.KeepAlive < 0 {
+		if err := tcp.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if o.KeepAlive > 0 {
+		if err := tcp.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcp.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+			return err
+		}
+	}
+	if o.ReadBufferSize > 0 {
+		if err := tcp.SetReadBuffer(o.ReadBufferSize); err != nil {
+			return err
+		}
+	}
+	if o.WriteBufferSize > 0 {
+		if err := tcp.SetWriteBuffer(o.WriteBufferSize); err != nil {
+			return err
+		}
+	}
+	if o.Linger != nil {
+		if err := tcp.SetLinger(*o.Linger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DialContext connects to addr and sets the options on the connection
+func (o Options) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Listener wraps l so the connections it accepts get the options. A
+// connection the options can't be set on is served as it is.
+func (o Options) Listener(l net.Listener) net.Listener {
+	if o.IsZero() {
+		return l
+	}
+	return &listener{Listener: l, opts: o}
+}
+
+type listener struct {
+	net.Listener
+	opts Options
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.opts.Apply(conn)
+	return conn, nil
+}
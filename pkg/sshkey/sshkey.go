@@ -0,0 +1,258 @@
+// Package sshkey reads SSH public and private keys and signs and verifies
+// messages with them, so clients can prove their identity with the keys they
+// already use for SSH. Ed25519, RSA, and ECDSA P-256 keys are supported.
+package sshkey
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// PublicKey is a key from an authorized_keys line
+type PublicKey struct {
+	Key     crypto.PublicKey
+	Type    string // e.g. ssh-ed25519
+	Comment string
+	wire    []byte
+}
+
+// Fingerprint returns the key's SHA256 fingerprint as ssh-keygen -l prints it
+func (k *PublicKey) Fingerprint() string {
+	sum := sha256.Sum256(k.wire)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// ParseAuthorizedKey reads a public key in authorized_keys format, such as
+// "ssh-ed25519 AAAA... alice@laptop". Options before the key type aren't
+// supported.
+func ParseAuthorizedKey(line string) (*PublicKey, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.New("expected a key type and base64 key")
+	}
+	wire, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 key: %v", err)
+	}
+	key, keyType, err := parseWireKey(wire)
+	if err != nil {
+		return nil, err
+	}
+	if keyType != fields[0] {
+		return nil, fmt.Errorf("key type %s doesn't match the key's %s", fields[0], keyType)
+	}
+	return &PublicKey{Key: key, Type: keyType, Comment: strings.Join(fields[2:], " "), wire: wire}, nil
+}
+
+// parseWireKey reads a public key in the SSH wire format
+func parseWireKey(wire []byte) (crypto.PublicKey, string, error) {
+	r := &reader{data: wire}
+	keyType := string(r.bytes())
+	switch keyType {
+	case "ssh-ed25519":
+		key := r.bytes()
+		if r.err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, "", errors.New("invalid ssh-ed25519 key")
+		}
+		return ed25519.PublicKey(key), keyType, nil
+	case "ssh-rsa":
+		e, n := r.mpint(), r.mpint()
+		if r.err != nil || !e.IsInt64() {
+			return nil, "", errors.New("invalid ssh-rsa key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, keyType, nil
+	case "ecdsa-sha2-nistp256":
+		curve, point := string(r.bytes()), r.bytes()
+		if r.err != nil || curve != "nistp256" {
+			return nil, "", errors.New("invalid ecdsa-sha2-nistp256 key")
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), point)
+		if x == nil {
+			return nil, "", errors.New("invalid ecdsa-sha2-nistp256 point")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, keyType, nil
+	}
+	if r.err != nil {
+		return nil, "", errors.New("invalid key")
+	}
+	return nil, "", fmt.Errorf("unsupported key type %s", keyType)
+}
+
+// LoadPrivateKey reads an unencrypted private key in OpenSSH format, as
+// ssh-keygen writes, or in PEM PKCS#1, PKCS#8, or SEC 1 form
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key found in %s", path)
+	}
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		return nil, fmt.Errorf("encrypted keys aren't supported, decrypt a copy with ssh-keygen -p")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "OPENSSH PRIVATE KEY":
+		key, err = parseOpenSSHPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH key: %v", err)
+	}
+	switch key := key.(type) {
+	case ed25519.PrivateKey, *rsa.PrivateKey:
+		return key.(crypto.Signer), nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("only P-256 ECDSA keys are supported")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key %T", key)
+}
+
+// parseOpenSSHPrivateKey reads the openssh-key-v1 format
+func parseOpenSSHPrivateKey(data []byte) (interface{}, error) {
+	const magic = "openssh-key-v1\x00"
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, errors.New("not an openssh-key-v1 key")
+	}
+	r := &reader{data: data[len(magic):]}
+	cipher, _, _ := string(r.bytes()), r.bytes(), r.bytes()
+	if count := r.uint32(); r.err == nil && count != 1 {
+		return nil, errors.New("only files with one key are supported")
+	}
+	r.bytes() // Public key, repeated in the private section
+	private := &reader{data: r.bytes()}
+	if r.err != nil {
+		return nil, errors.New("truncated key")
+	}
+	if cipher != "none" {
+		return nil, errors.New("encrypted keys aren't supported, decrypt a copy with ssh-keygen -p")
+	}
+	if private.uint32() != private.uint32() {
+		return nil, errors.New("corrupt key")
+	}
+
+	switch keyType := string(private.bytes()); keyType {
+	case "ssh-ed25519":
+		private.bytes()
+		key := private.bytes()
+		if private.err != nil || len(key) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid ssh-ed25519 key")
+		}
+		return ed25519.PrivateKey(key), nil
+	case "ssh-rsa":
+		n, e, d, _, p, q := private.mpint(), private.mpint(), private.mpint(), private.mpint(), private.mpint(), private.mpint()
+		if private.err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid ssh-rsa key")
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+	case "ecdsa-sha2-nistp256":
+		private.bytes()
+		point, d := private.bytes(), private.mpint()
+		x, y := elliptic.Unmarshal(elliptic.P256(), point)
+		if private.err != nil || x == nil {
+			return nil, errors.New("invalid ecdsa-sha2-nistp256 key")
+		}
+		return &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, D: d}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", keyType)
+	}
+}
+
+// Sign signs message with key: Ed25519 directly, RSA with PKCS #1 v1.5 over
+// SHA-256, and ECDSA as ASN.1 over SHA-256
+func Sign(key crypto.Signer, message []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, message, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(message)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// Verify checks a signature made by Sign
+func Verify(key *PublicKey, message, signature []byte) error {
+	digest := sha256.Sum256(message)
+	switch pub := key.Key.(type) {
+	case ed25519.PublicKey:
+		if ed25519.Verify(pub, message, signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return nil
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// reader reads the length-prefixed fields of the SSH wire format, keeping
+// the first error
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) uint32() uint32 {
+	if r.err != nil || len(r.data) < 4 {
+		r.err = errors.New("truncated")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < n {
+		r.err = errors.New("truncated")
+		return nil
+	}
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *reader) mpint() *big.Int {
+	return new(big.Int).SetBytes(r.bytes())
+}
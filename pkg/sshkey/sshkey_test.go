@@ -0,0 +1,260 @@
+package sshkey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// wireString appends an SSH wire format string
+func wireString(b []byte, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func wireMpint(b []byte, n *big.Int) []byte {
+	data := n.Bytes()
+	if len(data) > 0 && data[0]&0x80 != 0 {
+		data = append([]byte{0}, data...)
+	}
+	return wireString(b, data)
+}
+
+// wireKey encodes a public key in the SSH wire format
+func wireKey(t *testing.T, key crypto.PublicKey) (string, []byte) {
+	t.Helper()
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return "ssh-ed25519", wireString(wireString(nil, []byte("ssh-ed25519")), key)
+	case *rsa.PublicKey:
+		b := wireString(nil, []byte("ssh-rsa"))
+		return "ssh-rsa", wireMpint(wireMpint(b, big.NewInt(int64(key.E))), key.N)
+	case *ecdsa.PublicKey:
+		b := wireString(wireString(nil, []byte("ecdsa-sha2-nistp256")), []byte("nistp256"))
+		return "ecdsa-sha2-nistp256", wireString(b, elliptic.Marshal(key.Curve, key.X, key.Y))
+	}
+	t.Fatalf("unsupported key %T", key)
+	return "", nil
+}
+
+// authorizedKey returns the authorized_keys line of key
+func authorizedKey(t *testing.T, key crypto.PublicKey, comment string) string {
+	t.Helper()
+	keyType, wire := wireKey(t, key)
+	return keyType + " " + base64.StdEncoding.EncodeToString(wire) + " " + comment
+}
+
+// testKeys returns a key of each supported type
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"ssh-ed25519": ed, "ssh-rsa": rsaKey, "ecdsa-sha2-nistp256": ecKey}
+}
+
+func TestSignVerify(t *testing.T) {
+	keys := testKeys(t)
+	message := []byte("attachcloudip-register\nclient-a\nnonce")
+	for keyType, signer := range keys {
+		t.Run(keyType, func(t *testing.T) {
+			public, err := ParseAuthorizedKey(authorizedKey(t, signer.Public(), "client-a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if public.Type != keyType || public.Comment != "client-a" {
+				t.Fatalf("parsed %s key with comment %q", public.Type, public.Comment)
+			}
+			signature, err := Sign(signer, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Verify(public, message, signature); err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+
+			if Verify(public, []byte("attachcloudip-register\nclient-b\nnonce"), signature) == nil {
+				t.Error("signature verified for another message")
+			}
+			tampered := append([]byte(nil), signature...)
+			tampered[len(tampered)/2] ^= 0x01
+			if Verify(public, message, tampered) == nil {
+				t.Error("tampered signature verified")
+			}
+			if Verify(public, message, nil) == nil {
+				t.Error("empty signature verified")
+			}
+			for otherType, other := range keys {
+				if otherType == keyType {
+					continue
+				}
+				otherSignature, err := Sign(other, message)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if Verify(public, message, otherSignature) == nil {
+					t.Errorf("%s signature verified with the %s key", otherType, keyType)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAuthorizedKeyErrors(t *testing.T) {
+	_, ed, _ := ed25519.GenerateKey(rand.Reader)
+	_, wire := wireKey(t, ed.Public())
+	encoded := base64.StdEncoding.EncodeToString(wire)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongCurve := wireString(wireString(wireString(nil, []byte("ecdsa-sha2-nistp256")), []byte("nistp384")), elliptic.Marshal(p384.Curve, p384.X, p384.Y))
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"empty", ""},
+		{"no key", "ssh-ed25519"},
+		{"bad base64", "ssh-ed25519 !!!"},
+		{"type mismatch", "ssh-rsa " + encoded},
+		{"truncated", "ssh-ed25519 " + base64.StdEncoding.EncodeToString(wire[:len(wire)-1])},
+		{"short ed25519 key", "ssh-ed25519 " + base64.StdEncoding.EncodeToString(wireString(wireString(nil, []byte("ssh-ed25519")), []byte("short")))},
+		{"unsupported type", "ssh-dss " + base64.StdEncoding.EncodeToString(wireString(nil, []byte("ssh-dss")))},
+		{"wrong curve", "ecdsa-sha2-nistp256 " + base64.StdEncoding.EncodeToString(wrongCurve)},
+		{"point off the curve", "ecdsa-sha2-nistp256 " + base64.StdEncoding.EncodeToString(wireString(wireString(wireString(nil, []byte("ecdsa-sha2-nistp256")), []byte("nistp256")), []byte{4, 1, 2}))},
+	}
+	for _, tt := range tests {
+		if _, err := ParseAuthorizedKey(tt.line); err == nil {
+			t.Errorf("%s: ParseAuthorizedKey accepted %q", tt.name, tt.line)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	// A key and its fingerprint as ssh-keygen -l prints it
+	key, err := ParseAuthorizedKey("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMiFLLWSmCLdamJSr0jyIGbzt5kPtoMb2t1g7wxd3MXF test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := key.Fingerprint(), "SHA256:CQKVVSW3HKaFt36tA9cN71t7iUybg/25EpXAe4BG3rA"; got != want {
+		t.Fatalf("Fingerprint() = %s, want %s", got, want)
+	}
+}
+
+// writeKey writes a PEM block to a file in dir and returns its path
+func writeKey(t *testing.T, dir, name string, block *pem.Block) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// openSSHKey encodes an Ed25519 key in the openssh-key-v1 format
+func openSSHKey(key ed25519.PrivateKey, cipher string) []byte {
+	public := wireString(wireString(nil, []byte("ssh-ed25519")), key.Public().(ed25519.PublicKey))
+	private := binary.BigEndian.AppendUint32(nil, 42)
+	private = binary.BigEndian.AppendUint32(private, 42)
+	private = wireString(private, []byte("ssh-ed25519"))
+	private = wireString(private, key.Public().(ed25519.PublicKey))
+	private = wireString(private, key)
+	private = wireString(private, []byte("comment"))
+
+	data := []byte("openssh-key-v1\x00")
+	data = wireString(data, []byte(cipher))
+	data = wireString(data, []byte("none"))
+	data = wireString(data, nil)
+	data = binary.BigEndian.AppendUint32(data, 1)
+	data = wireString(data, public)
+	return wireString(data, private)
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	dir := t.TempDir()
+	keys := testKeys(t)
+	ed := keys["ssh-ed25519"].(ed25519.PrivateKey)
+	sec1, err := x509.MarshalECPrivateKey(keys["ecdsa-sha2-nistp256"].(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := map[string]*pem.Block{
+		"openssh":  {Type: "OPENSSH PRIVATE KEY", Bytes: openSSHKey(ed, "none")},
+		"pkcs8":    {Type: "PRIVATE KEY", Bytes: mustPKCS8(t, ed)},
+		"pkcs1":    {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(keys["ssh-rsa"].(*rsa.PrivateKey))},
+		"sec1":     {Type: "EC PRIVATE KEY", Bytes: sec1},
+		"pkcs8 ec": {Type: "PRIVATE KEY", Bytes: mustPKCS8(t, keys["ecdsa-sha2-nistp256"])},
+	}
+	for name, block := range valid {
+		signer, err := LoadPrivateKey(writeKey(t, dir, name, block))
+		if err != nil {
+			t.Errorf("%s: LoadPrivateKey: %v", name, err)
+			continue
+		}
+		public, err := ParseAuthorizedKey(authorizedKey(t, signer.Public(), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := Sign(signer, []byte("message"))
+		if err != nil || Verify(public, []byte("message"), signature) != nil {
+			t.Errorf("%s: signature doesn't verify: %v", name, err)
+		}
+	}
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Bytes, err := x509.MarshalECPrivateKey(p384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]*pem.Block{
+		"encrypted openssh": {Type: "OPENSSH PRIVATE KEY", Bytes: openSSHKey(ed, "aes256-ctr")},
+		"encrypted pem":     {Type: "RSA PRIVATE KEY", Headers: map[string]string{"Proc-Type": "4,ENCRYPTED"}, Bytes: []byte("x")},
+		"truncated openssh": {Type: "OPENSSH PRIVATE KEY", Bytes: openSSHKey(ed, "none")[:40]},
+		"not openssh":       {Type: "OPENSSH PRIVATE KEY", Bytes: []byte("garbage")},
+		"p384":              {Type: "EC PRIVATE KEY", Bytes: p384Bytes},
+		"unknown block":     {Type: "CERTIFICATE", Bytes: []byte("x")},
+		"corrupt pkcs8":     {Type: "PRIVATE KEY", Bytes: []byte("x")},
+	}
+	for name, block := range invalid {
+		if _, err := LoadPrivateKey(writeKey(t, dir, strings.ReplaceAll(name, " ", "-"), block)); err == nil {
+			t.Errorf("%s: LoadPrivateKey accepted the key", name)
+		}
+	}
+	if _, err := LoadPrivateKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("LoadPrivateKey accepted a missing file")
+	}
+}
+
+func mustPKCS8(t *testing.T, key crypto.Signer) []byte {
+	t.Helper()
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,318 @@
+// Package testutil runs the server and clients in one process over an
+// in-memory network, so routing, registration, and proxying can be tested
+// end to end without opening ports:
+//
+//	h, err := testutil.StartServer(config)
+//	defer h.Close()
+//	c, err := h.Connect(ctx)
+//	tunnel, err := c.RegisterPath(ctx, "/api", handler, client.TunnelOptions{})
+//	resp, err := h.HTTPClient().Get(h.URL("/api/users"))
+package testutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errRefused is returned when dialing an address nothing listens on
+var errRefused = errors.New("connection refused")
+
+// Network is an in-memory network of listeners by address. Its zero value
+// is not usable, see NewNetwork.
+type Network struct {
+	mu        sync.Mutex
+	listeners map[string]*Listener
+	nextPort  int // Local port of the next dialed connection
+}
+
+// NewNetwork returns an empty network
+func NewNetwork() *Network {
+	return &Network{listeners: make(map[string]*Listener), nextPort: 40000}
+}
+
+// Listen listens on addr, a "host:port" that dials must use as written
+func (n *Network) Listen(addr string) (*Listener, error) {
+	tcpAddr, err := memoryAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr, Err: errors.New("address already in use")}
+	}
+	l := &Listener{
+		network: n,
+		key:     addr,
+		addr:    tcpAddr,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// DialContext connects to the listener on addr, with the signature of
+// net.Dialer.DialContext so it can stand in for it
+func (n *Network) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	port := n.nextPort
+	n.nextPort++
+	n.mu.Unlock()
+	if !ok {
+		remote, _ := memoryAddr(addr)
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: remote, Err: errRefused}
+	}
+
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	client, server := Pipe(local, l.addr)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: l.addr, Err: errRefused}
+	case <-ctx.Done():
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: l.addr, Err: ctx.Err()}
+	}
+}
+
+// memoryAddr returns the TCP address connections on addr report. Hostnames
+// stand for the loopback address, as ports are what the server looks at.
+func memoryAddr(addr string) (*net.TCPAddr, error) {
+	host, portValue, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// Listener accepts the connections dialed to its address on a Network
+type Listener struct {
+	network *Network
+	key     string
+	addr    *net.TCPAddr
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and frees the address. Accepted connections stay
+// open.
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.network.mu.Lock()
+		delete(l.network.listeners, l.key)
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Pipe returns the two ends of an in-memory connection between the given
+// addresses. Unlike net.Pipe, writes are buffered without limit and don't
+// wait for the other end to read, as with the socket buffers of TCP.
+func Pipe(a, b net.Addr) (net.Conn, net.Conn) {
+	ab, ba := newBuffer(), newBuffer()
+	return &Conn{local: a, remote: b, rx: ba, tx: ab, readDeadline: newDeadline(), writeDeadline: newDeadline()},
+		&Conn{local: b, remote: a, rx: ab, tx: ba, readDeadline: newDeadline(), writeDeadline: newDeadline()}
+}
+
+// Conn is one end of a Pipe
+type Conn struct {
+	local, remote               net.Addr
+	rx, tx                      *buffer // Read from and written to
+	readDeadline, writeDeadline *deadline
+	once                        sync.Once
+}
+
+// Read reads what the other end wrote, returning io.EOF once it is closed
+// and everything was read
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.rx.read(p, c.readDeadline.wait())
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	select {
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	return c.tx.write(p)
+}
+
+// Close closes both directions, so the other end reads io.EOF after the
+// data already written and its writes fail
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		c.tx.closeWriter()
+		c.rx.closeReader()
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// buffer carries one direction of a Pipe
+type buffer struct {
+	mu           sync.Mutex
+	data         []byte
+	writerClosed bool
+	readerClosed bool
+	changed      chan struct{} // Closed and replaced whenever the fields above change
+}
+
+func newBuffer() *buffer {
+	return &buffer{changed: make(chan struct{})}
+}
+
+// notifyLocked wakes the reader waiting for a change
+func (b *buffer) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *buffer) read(p []byte, deadline <-chan struct{}) (int, error) {
+	for {
+		b.mu.Lock()
+		switch {
+		case b.readerClosed:
+			b.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(b.data) > 0:
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.mu.Unlock()
+			return n, nil
+		case b.writerClosed:
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (b *buffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.writerClosed {
+		return 0, net.ErrClosed
+	}
+	if b.readerClosed {
+		return 0, io.ErrClosedPipe
+	}
+	b.data = append(b.data, p...)
+	b.notifyLocked()
+	return len(p), nil
+}
+
+func (b *buffer) closeWriter() {
+	b.mu.Lock()
+	b.writerClosed = true
+	b.notifyLocked()
+	b.mu.Unlock()
+}
+
+func (b *buffer) closeReader() {
+	b.mu.Lock()
+	b.readerClosed = true
+	b.data = nil
+	b.notifyLocked()
+	b.mu.Unlock()
+}
+
+// deadline is a channel closed when the deadline passes
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{expired: make(chan struct{})}
+}
+
+// set moves the deadline to t, the zero time for none
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, so the channel is closed or about to be
+		<-d.expired
+	}
+	d.timer = nil
+
+	select {
+	case <-d.expired:
+		d.expired = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return
+	}
+	if delay := time.Until(t); delay > 0 {
+		expired := d.expired
+		d.timer = time.AfterFunc(delay, func() { close(expired) })
+		return
+	}
+	close(d.expired)
+}
+
+// wait returns a channel closed once the current deadline passes
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
@@ -0,0 +1,131 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/client"
+	"github.com/vikasavn/attachcloudip/pkg/server"
+)
+
+// Host is the server's hostname on the harness network
+const Host = "tunnel.test"
+
+// Ports the harness server listens on
+const (
+	HTTPPort         = 9999
+	RegistrationPort = 9998
+)
+
+// startTimeout bounds how long StartServer waits for the server's listeners
+const startTimeout = 10 * time.Second
+
+// Harness is a server running in the test process on an in-memory network
+type Harness struct {
+	Network *Network
+	Server  *server.Server
+	// Addresses of the public frontend and the registration port
+	HTTPAddr, RegistrationAddr string
+
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// StartServer starts a server for config, which may be nil for the
+// defaults, on a new in-memory network, and returns once it is ready. Each
+// harness has its own server and network, so tests can start one apiece.
+// opts are applied after the harness's own listener options.
+func StartServer(config *server.Config, opts ...server.Option) (*Harness, error) {
+	network := NewNetwork()
+	h := &Harness{
+		Network:          network,
+		HTTPAddr:         net.JoinHostPort(Host, strconv.Itoa(HTTPPort)),
+		RegistrationAddr: net.JoinHostPort(Host, strconv.Itoa(RegistrationPort)),
+		done:             make(chan error, 1),
+	}
+	httpListener, err := network.Listen(h.HTTPAddr)
+	if err != nil {
+		return nil, err
+	}
+	registrationListener, err := network.Listen(h.RegistrationAddr)
+	if err != nil {
+		httpListener.Close()
+		return nil, err
+	}
+
+	opts = append([]server.Option{
+		server.WithHTTPPort(HTTPPort),
+		server.WithRegistrationPort(RegistrationPort),
+		server.WithListener(HTTPPort, httpListener),
+		server.WithListener(RegistrationPort, registrationListener),
+		server.WithDrainPeriod(0),
+	}, opts...)
+	srv, err := server.New(config, opts...)
+	if err != nil {
+		httpListener.Close()
+		registrationListener.Close()
+		return nil, err
+	}
+	h.Server = srv
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go func() { h.done <- srv.Start(ctx) }()
+	select {
+	case <-srv.Ready():
+		return h, nil
+	case err := <-h.done:
+		cancel()
+		return nil, fmt.Errorf("server failed to start: %v", err)
+	case <-time.After(startTimeout):
+		cancel()
+		return nil, fmt.Errorf("server not ready after %s", startTimeout)
+	}
+}
+
+// Close shuts the server down and returns the error it stopped with
+func (h *Harness) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	if err := h.Server.Shutdown(ctx); err != nil {
+		return err
+	}
+	h.cancel()
+	return <-h.done
+}
+
+// Connect connects a client to the harness server over its network
+func (h *Harness) Connect(ctx context.Context, opts ...client.Option) (*client.Client, error) {
+	return h.connect(ctx, h.HTTPAddr, opts)
+}
+
+// ConnectBootstrap connects a client that registers on the tunnel
+// connection, see client.WithBootstrap
+func (h *Harness) ConnectBootstrap(ctx context.Context, opts ...client.Option) (*client.Client, error) {
+	return h.connect(ctx, h.RegistrationAddr, append([]client.Option{client.WithBootstrap()}, opts...))
+}
+
+func (h *Harness) connect(ctx context.Context, addr string, opts []client.Option) (*client.Client, error) {
+	return client.Connect(ctx, addr, append([]client.Option{client.WithDialer(h.Network.DialContext)}, opts...)...)
+}
+
+// HTTPClient returns an HTTP client that reaches the harness network, for
+// requests to URL
+func (h *Harness) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{DialContext: h.Network.DialContext},
+		// Let tests see the server's redirects
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// URL returns the public frontend's URL for path
+func (h *Harness) URL(path string) string {
+	return "http://" + h.HTTPAddr + path
+}
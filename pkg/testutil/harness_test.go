@@ -0,0 +1,653 @@
+package testutil
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vikasavn/attachcloudip/pkg/client"
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+	"github.com/vikasavn/attachcloudip/pkg/server"
+	"github.com/vikasavn/attachcloudip/pkg/update"
+)
+
+// testTimeout bounds each test's registrations and requests
+const testTimeout = 10 * time.Second
+
+// startHarness starts a harness for config, closed when the test ends
+func startHarness(t *testing.T, config *server.Config) *Harness {
+	t.Helper()
+	h, err := StartServer(config)
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := h.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+	return h
+}
+
+// connect connects a client to h, closed when the test ends
+func connect(t *testing.T, ctx context.Context, h *Harness, bootstrap bool) *client.Client {
+	t.Helper()
+	connect := h.Connect
+	if bootstrap {
+		connect = h.ConnectBootstrap
+	}
+	c, err := connect(ctx)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// named answers with name and the request's path
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+	})
+}
+
+// get requests path from h's frontend and returns the status and body
+func get(t *testing.T, ctx context.Context, h *Harness, path string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL(path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestRegisterAndProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	h := startHarness(t, nil)
+	c := connect(t, ctx, h, false)
+
+	tunnel, err := c.RegisterPath(ctx, "/api", named("api"), client.TunnelOptions{ID: "api-client"})
+	if err != nil {
+		t.Fatalf("RegisterPath: %v", err)
+	}
+	if tunnel.ID() != "api-client" {
+		t.Errorf("ID() = %q, want api-client", tunnel.ID())
+	}
+
+	status, body := get(t, ctx, h, "/api/users")
+	if status != http.StatusOK || body != "api /api/users" {
+		t.Errorf("GET /api/users = %d %q, want 200 %q", status, body, "api /api/users")
+	}
+}
+
+func TestRouting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	h := startHarness(t, nil)
+	c := connect(t, ctx, h, false)
+
+	for _, path := range []string{"/api", "/api/admin"} {
+		if _, err := c.RegisterPath(ctx, path, named(path), client.TunnelOptions{}); err != nil {
+			t.Fatalf("RegisterPath %s: %v", path, err)
+		}
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/api", http.StatusOK, "/api /api"},
+		{"/api/users", http.StatusOK, "/api /api/users"},
+		{"/api/admin/settings", http.StatusOK, "/api/admin /api/admin/settings"},
+		{"/other", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		status, body := get(t, ctx, h, tt.path)
+		if status != tt.status || (tt.body != "" && body != tt.body) {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.path, status, body, tt.status, tt.body)
+		}
+	}
+}
+
+func TestCloseUnregisters(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	h := startHarness(t, nil)
+	c := connect(t, ctx, h, false)
+
+	tunnel, err := c.RegisterPath(ctx, "/gone", named("gone"), client.TunnelOptions{})
+	if err != nil {
+		t.Fatalf("RegisterPath: %v", err)
+	}
+	if status, _ := get(t, ctx, h, "/gone"); status != http.StatusOK {
+		t.Fatalf("GET /gone = %d before Close, want 200", status)
+	}
+	tunnel.Close()
+
+	// The server notices the closed connection asynchronously
+	for {
+		status, _ := get(t, ctx, h, "/gone")
+		if status != http.StatusOK {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("GET /gone still answered after Close")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	h := startHarness(t, nil)
+	c := connect(t, ctx, h, true)
+
+	if _, err := c.RegisterPath(ctx, "/boot", named("boot"), client.TunnelOptions{ID: "boot-client"}); err != nil {
+		t.Fatalf("RegisterPath: %v", err)
+	}
+	status, body := get(t, ctx, h, "/boot/ping")
+	if status != http.StatusOK || body != "boot /boot/ping" {
+		t.Errorf("GET /boot/ping = %d %q, want 200 %q", status, body, "boot /boot/ping")
+	}
+}
+
+func TestHarnessesAreIndependent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	first, second := startHarness(t, nil), startHarness(t, nil)
+
+	c := connect(t, ctx, first, false)
+	if _, err := c.RegisterPath(ctx, "/only-first", named("first"), client.TunnelOptions{ID: "shared-id"}); err != nil {
+		t.Fatalf("RegisterPath: %v", err)
+	}
+	if status, _ := get(t, ctx, first, "/only-first"); status != http.StatusOK {
+		t.Errorf("first GET /only-first = %d, want 200", status)
+	}
+	if status, _ := get(t, ctx, second, "/only-first"); status != http.StatusNotFound {
+		t.Errorf("second GET /only-first = %d, want 404", status)
+	}
+
+	// The same client ID registers on the second server without conflict
+	c2 := connect(t, ctx, second, false)
+	if _, err := c2.RegisterPath(ctx, "/only-second", named("second"), client.TunnelOptions{ID: "shared-id"}); err != nil {
+		t.Fatalf("RegisterPath on second: %v", err)
+	}
+	if status, body := get(t, ctx, second, "/only-second"); status != http.StatusOK || body != "second /only-second" {
+		t.Errorf("second GET /only-second = %d %q, want 200", status, body)
+	}
+}
+
+func TestShutdownClosesTunnels(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	h, err := StartServer(nil)
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+
+	conn, err := h.Network.DialContext(ctx, "tcp", h.RegistrationAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := io.WriteString(conn, "raw-client|/raw\n"); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "registered|") {
+		t.Fatalf("registration = %q, %v", line, err)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Whatever the server sent before closing, the tunnel ends
+	for {
+		if _, err := reader.ReadString('\n'); err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("tunnel read after Close: %v, want EOF", err)
+			}
+			return
+		}
+	}
+}
+
+// TestConcurrentRequestsOverOneTunnel holds several requests in the client
+// at once and answers them in reverse order, so each response has to find
+// its request by ID
+func TestConcurrentRequestsOverOneTunnel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	h := startHarness(t, nil)
+	c := connect(t, ctx, h, false)
+
+	const n = 8
+	arrived := make(chan struct{}, n)
+	release := make([]chan struct{}, n)
+	for i := range release {
+		release[i] = make(chan struct{})
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var i int
+		fmt.Sscanf(r.URL.Path, "/slow/%d", &i)
+		arrived <- struct{}{}
+		select {
+		case <-release[i]:
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprintf(w, "answer %d", i)
+	})
+	if _, err := c.RegisterPath(ctx, "/slow", handler, client.TunnelOptions{}); err != nil {
+		t.Fatalf("RegisterPath: %v", err)
+	}
+
+	type result struct {
+		i    int
+		body string
+		err  error
+	}
+	results := make(chan result, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			resp, err := h.HTTPClient().Get(h.URL(fmt.Sprintf("/slow/%d", i)))
+			if err != nil {
+				results <- result{i: i, err: err}
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err == nil && resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+			results <- result{i, string(body), err}
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-arrived:
+		case <-ctx.Done():
+			t.Fatalf("only %d of %d requests reached the client at once", i, n)
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		close(release[i])
+		r := <-results
+		if want := fmt.Sprintf("answer %d", r.i); r.err != nil || r.i != i || r.body != want {
+			t.Fatalf("released %d, got request %d: %q, %v", i, r.i, r.body, r.err)
+		}
+	}
+}
+
+// TestStaleClientReleasesPort registers a raw TCP tunnel that never sends a
+// heartbeat and checks its public port can be listened on once it's dropped
+func TestStaleClientReleasesPort(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	config := &server.Config{}
+	config.Server.Bind.TCPTunnels = "127.0.0.1"
+	config.Server.TCPTunnels.PortMin, config.Server.TCPTunnels.PortMax = port, port
+	config.Server.Sessions.StaleTimeout = 1
+	h := startHarness(t, config)
+
+	conn, err := h.Network.DialContext(ctx, "tcp", h.RegistrationAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := io.WriteString(conn, "stale-client|/stale||"+protocol.TCPOption+"=1\n"); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if err != nil || parts[0] != "registered" || len(parts) != 3 {
+		t.Fatalf("registration = %q, %v", line, err)
+	}
+	accepted, err := url.ParseQuery(parts[2])
+	if err != nil || accepted.Get(protocol.TCPPortOption) != strconv.Itoa(port) {
+		t.Fatalf("accepted options = %q, want %s=%d", parts[2], protocol.TCPPortOption, port)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if l, err := net.Listen("tcp", addr); err == nil {
+		l.Close()
+		t.Fatalf("port %d is free while the tunnel is connected", port)
+	}
+
+	// Without heartbeats the server drops the tunnel
+	for {
+		if _, err := reader.ReadString('\n'); err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("stale tunnel read: %v, want EOF", err)
+			}
+			break
+		}
+	}
+	for {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			l.Close()
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("port %d still in use after the stale client was dropped: %v", port, err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// TestStatusListsLikeClients checks that /status filters and pages the same
+// clients /clients does
+func TestStatusListsLikeClients(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	h := startHarness(t, nil)
+	c := connect(t, ctx, h, false)
+	for _, id := range []string{"list-c", "list-a", "list-b"} {
+		if _, err := c.RegisterPath(ctx, "/"+id, named(id), client.TunnelOptions{ID: id}); err != nil {
+			t.Fatalf("RegisterPath %s: %v", id, err)
+		}
+	}
+
+	var listed []server.ClientResponse
+	_, body := get(t, ctx, h, "/clients?offset=1&limit=1")
+	if err := json.Unmarshal([]byte(body), &listed); err != nil {
+		t.Fatalf("/clients: %v: %s", err, body)
+	}
+	var status struct {
+		Clients []server.ClientResponse `json:"clients"`
+		Total   int                     `json:"total"`
+		Paths   map[string][]string     `json:"paths"`
+	}
+	_, body = get(t, ctx, h, "/status?offset=1&limit=1")
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("/status: %v: %s", err, body)
+	}
+	if len(listed) != 1 || listed[0].ID != "list-b" {
+		t.Fatalf("/clients page = %+v, want list-b", listed)
+	}
+	if len(status.Clients) != 1 || status.Clients[0].ID != "list-b" || status.Total != 3 {
+		t.Fatalf("/status page = %+v of %d, want list-b of 3", status.Clients, status.Total)
+	}
+	if ids := status.Paths["/list-a"]; len(ids) != 1 || ids[0] != "list-a" {
+		t.Fatalf("/status paths = %v", status.Paths)
+	}
+
+	status.Paths = nil
+	_, body = get(t, ctx, h, "/status?path=/list-c")
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("/status: %v: %s", err, body)
+	}
+	if status.Total != 1 || status.Clients[0].ID != "list-c" || len(status.Paths) != 1 {
+		t.Fatalf("/status?path=/list-c = %+v", status)
+	}
+}
+
+// TestCertificateHostnameOwner checks that only the tunnel owning a hostname
+// can change its certificate, and that another client can't take the name
+func TestCertificateHostnameOwner(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	config := &server.Config{}
+	config.Server.TLS.Enabled = true
+	config.Server.TLS.CertDir = t.TempDir()
+	config.Server.Ports.HTTPS = httpsPort
+	config.Server.Bind.HTTPS = "127.0.0.1"
+	h := startHarness(t, config)
+	c := connect(t, ctx, h, false)
+
+	const hostname = "app.example.test"
+	if _, err := c.RegisterPath(ctx, "/owner", named("owner"), client.TunnelOptions{ID: "owner", Hostname: hostname}); err != nil {
+		t.Fatalf("RegisterPath owner: %v", err)
+	}
+	if _, err := c.RegisterPath(ctx, "/intruder", named("intruder"), client.TunnelOptions{ID: "intruder", Hostname: hostname}); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("RegisterPath intruder = %v, want a 409 for the owned hostname", err)
+	}
+
+	certificates := func(method, query, body string) int {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, method, h.URL("/certificates"+query), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := h.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatalf("%s /certificates: %v", method, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		body   string
+	}{
+		{"upload without a session token", http.MethodPost, "", `{"client_id": "owner", "hostname": "` + hostname + `"}`},
+		{"upload with a wrong session token", http.MethodPost, "", `{"client_id": "owner", "hostname": "` + hostname + `", "session_token": "guess"}`},
+		{"upload with a wrong ticket", http.MethodPost, "", `{"client_id": "owner", "hostname": "` + hostname + `", "ticket": "guess"}`},
+		{"delete without a session token", http.MethodDelete, "?client_id=owner&hostname=" + hostname, ""},
+	}
+	for _, tt := range tests {
+		if status := certificates(tt.method, tt.query, tt.body); status != http.StatusUnauthorized {
+			t.Errorf("%s = %d, want 401", tt.name, status)
+		}
+	}
+}
+
+// TestClientUpdate installs the server's client release and refuses it when
+// it is unsigned, signed by another key, or changed after signing
+func TestClientUpdate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	binary := filepath.Join(dir, update.BinaryName(runtime.GOOS, runtime.GOARCH))
+	publish := func(content string, signed bool) {
+		t.Helper()
+		if err := os.WriteFile(binary, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(binary + ".sig")
+		if !signed {
+			return
+		}
+		signature, err := update.Sign(private, binary, "1.2.0", runtime.GOOS, runtime.GOARCH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(binary+".sig", []byte(signature), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := &server.Config{}
+	config.Server.ClientReleases.Dir, config.Server.ClientReleases.Version = dir, "1.2.0"
+	h := startHarness(t, config)
+	c := connect(t, ctx, h, false)
+
+	install := func(key ed25519.PublicKey) (string, error) {
+		t.Helper()
+		executable := filepath.Join(t.TempDir(), "client")
+		if err := os.WriteFile(executable, []byte("installed"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		release, err := c.LatestRelease(ctx)
+		if err != nil {
+			t.Fatalf("LatestRelease: %v", err)
+		}
+		err = c.InstallRelease(ctx, release, key, executable)
+		data, readErr := os.ReadFile(executable)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		return string(data), err
+	}
+
+	publish("release 1.2.0", true)
+	if got, err := install(public); err != nil || got != "release 1.2.0" {
+		t.Fatalf("signed release installed %q, %v", got, err)
+	}
+	if got, err := install(otherPublic); err == nil || got != "installed" {
+		t.Errorf("release for another key installed %q, %v", got, err)
+	}
+
+	publish("release 1.2.0, unsigned", false)
+	if got, err := install(public); err == nil || got != "installed" {
+		t.Errorf("unsigned release installed %q, %v", got, err)
+	}
+
+	// A binary replaced under its signature no longer matches it
+	publish("release 1.2.0", true)
+	if err := os.WriteFile(binary, []byte("release 1.2.0, tampered"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := install(public); err == nil || got != "installed" {
+		t.Errorf("tampered release installed %q, %v", got, err)
+	}
+}
+
+// TestRedisRateLimit runs a rate limit kept in Redis, which the server
+// connects to at startup and reconnects to after Redis drops its connections
+func TestRedisRateLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	redis, err := StartRedis(func(args []string) string {
+		switch args[0] {
+		case "AUTH":
+			if args[1] != "secret" {
+				return "-WRONGPASS invalid password\r\n"
+			}
+			return "+OK\r\n"
+		case "SELECT", "PING":
+			return "+OK\r\n"
+		case "EVAL":
+			// One request per key, then a second's wait
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[args[3]] {
+				return ":1000000\r\n"
+			}
+			seen[args[3]] = true
+			return ":0\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redis.Close()
+
+	config := &server.Config{}
+	config.Server.Redis.Address, config.Server.Redis.Password, config.Server.Redis.DB = redis.Addr, "secret", 2
+	config.Server.Middleware = []server.MiddlewareConfig{{Name: "rate_limit", Options: map[string]string{"store": "redis", "rate": "1"}}}
+	h := startHarness(t, config)
+	if got := redis.Commands()[:3]; got[0][0] != "AUTH" || got[1][0] != "SELECT" || got[1][1] != "2" || got[2][0] != "PING" {
+		t.Fatalf("startup commands = %q, want AUTH, SELECT 2, and PING", got)
+	}
+
+	if status, _ := get(t, ctx, h, "/limited"); status == http.StatusTooManyRequests {
+		t.Fatal("first request limited")
+	}
+	if status, _ := get(t, ctx, h, "/limited"); status != http.StatusTooManyRequests {
+		t.Fatalf("second request = %d, want %d", status, http.StatusTooManyRequests)
+	}
+
+	// Requests are let through while Redis is away, and limited once it's back
+	redis.Drop()
+	if status, _ := get(t, ctx, h, "/limited"); status == http.StatusTooManyRequests {
+		t.Fatal("request limited over a dropped Redis connection")
+	}
+	if status, _ := get(t, ctx, h, "/limited"); status != http.StatusTooManyRequests {
+		t.Fatalf("request after reconnecting = %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+// TestRedisRefused checks that the server doesn't start with a Redis it
+// can't use
+func TestRedisRefused(t *testing.T) {
+	redis, err := StartRedis(func(args []string) string {
+		if args[0] == "AUTH" && args[1] != "secret" {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		return "+OK\r\n"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped, err := StartRedis(func(args []string) string { return "+OK\r\n" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped.Close()
+	defer redis.Close()
+
+	for name, address := range map[string]string{"wrong password": redis.Addr, "unreachable": stopped.Addr} {
+		config := &server.Config{}
+		config.Server.Redis.Address, config.Server.Redis.Password = address, "guess"
+		if h, err := StartServer(config); err == nil {
+			h.Close()
+			t.Errorf("%s: server started", name)
+		}
+	}
+
+	// A redis store needs server.redis.address
+	config := &server.Config{}
+	config.Server.Middleware = []server.MiddlewareConfig{{Name: "rate_limit", Options: map[string]string{"store": "redis", "rate": "1"}}}
+	if h, err := StartServer(config); err == nil {
+		h.Close()
+		t.Error("server started with a redis rate limit and no Redis")
+	}
+}
@@ -0,0 +1,144 @@
+package testutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RedisHandler answers one command with a raw RESP reply, such as "+OK\r\n"
+type RedisHandler func(args []string) string
+
+// RedisServer is a fake Redis on a local TCP port. The Redis client dials
+// real addresses, so it doesn't use the harness network.
+type RedisServer struct {
+	Addr string
+
+	listener net.Listener
+	handler  RedisHandler
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	accepted int
+	commands [][]string
+	wg       sync.WaitGroup
+}
+
+// StartRedis starts a fake Redis answering with handler
+func StartRedis(handler RedisHandler) (*RedisServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &RedisServer{Addr: l.Addr().String(), listener: l, handler: handler, conns: make(map[net.Conn]struct{})}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+func (s *RedisServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.accepted++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *RedisServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		s.mu.Unlock()
+		if _, err := io.WriteString(conn, s.handler(args)); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads one command, sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	header, err := readLine(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, header)
+	for i := range args {
+		n, err := readLine(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:n])
+	}
+	return args, nil
+}
+
+// readLine reads a line of kind and returns its number
+func readLine(r *bufio.Reader, kind byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != kind {
+		return 0, fmt.Errorf("unexpected line %q", line)
+	}
+	return strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+}
+
+// Commands returns the commands received so far
+func (s *RedisServer) Commands() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.commands...)
+}
+
+// Connections returns how many connections were accepted so far
+func (s *RedisServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Drop closes the open connections, as a restarting Redis would
+func (s *RedisServer) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the server and closes its connections
+func (s *RedisServer) Close() error {
+	err := s.listener.Close()
+	s.Drop()
+	s.wg.Wait()
+	return err
+}
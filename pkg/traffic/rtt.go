@@ -0,0 +1,46 @@
+package traffic
+
+import (
+	"sync"
+	"time"
+)
+
+// rttSamples is how many of the latest round trips the average covers
+const rttSamples = 10
+
+// RTT keeps a rolling average of a tunnel's heartbeat round-trip times
+type RTT struct {
+	samples [rttSamples]time.Duration
+	next    int
+	count   int
+	mu      sync.Mutex
+}
+
+func NewRTT() *RTT {
+	return &RTT{}
+}
+
+// Add records a measured round trip
+func (r *RTT) Add(rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[r.next] = rtt
+	r.next = (r.next + 1) % rttSamples
+	if r.count < rttSamples {
+		r.count++
+	}
+}
+
+// Average returns the mean of the latest round trips, zero before the first
+func (r *RTT) Average() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, rtt := range r.samples[:r.count] {
+		total += rtt
+	}
+	return total / time.Duration(r.count)
+}
@@ -0,0 +1,45 @@
+package traffic
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// closeWriter is implemented by connections that can be half-closed, like
+// *net.TCPConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Splice copies between a and b both ways until both directions end, then
+// closes them. The end of one direction half-closes the connection it was
+// written to, or closes both connections if that one can't be half-closed.
+// It returns the bytes copied from a to b and from b to a.
+func Splice(a, b net.Conn) (aToB, bToA int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aToB = pipe(b, a)
+	}()
+	go func() {
+		defer wg.Done()
+		bToA = pipe(a, b)
+	}()
+	wg.Wait()
+	a.Close()
+	b.Close()
+	return aToB, bToA
+}
+
+// pipe copies src to dst until src ends, then passes the end on to dst
+func pipe(dst, src net.Conn) int64 {
+	n, _ := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+		return n
+	}
+	dst.Close()
+	src.Close()
+	return n
+}
@@ -0,0 +1,117 @@
+package traffic
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxThrottleChunk bounds the bytes moved between waits, so a capped
+// tunnel trickles evenly instead of stalling and then bursting
+const maxThrottleChunk = 32 * 1024
+
+// Bucket meters bytes at a steady rate, allowing bursts of one second's worth
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second, 0 means unlimited
+	tokens float64
+	last   time.Time
+}
+
+// SetRate changes the rate, starting with a full burst
+func (b *Bucket) SetRate(bytesPerSecond int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(bytesPerSecond)
+	b.tokens = b.rate
+	b.last = time.Now()
+}
+
+// Take spends n bytes and returns how long to wait before they fit the rate
+func (b *Bucket) Take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// chunk returns how many bytes to move before the next wait
+func (b *Bucket) chunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	return max(1, min(maxThrottleChunk, int(b.rate)))
+}
+
+// ThrottledConn caps the bytes per second a connection reads and writes,
+// each direction separately. It is unlimited until SetRate is called.
+type ThrottledConn struct {
+	net.Conn
+	read  Bucket
+	write Bucket
+	// writeMu keeps each Write contiguous while it is split into chunks, since
+	// concurrent writers each send whole messages
+	writeMu sync.Mutex
+}
+
+func NewThrottledConn(conn net.Conn) *ThrottledConn {
+	return &ThrottledConn{Conn: conn}
+}
+
+// SetRate caps both directions at bytesPerSecond, 0 lifts the cap
+func (c *ThrottledConn) SetRate(bytesPerSecond int64) {
+	c.read.SetRate(bytesPerSecond)
+	c.write.SetRate(bytesPerSecond)
+}
+
+func (c *ThrottledConn) Read(p []byte) (int, error) {
+	if chunk := c.read.chunk(); chunk > 0 && len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := c.Conn.Read(p)
+	if wait := c.read.Take(n); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+func (c *ThrottledConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(p) {
+		end := len(p)
+		if chunk := c.write.chunk(); chunk > 0 && end-written > chunk {
+			end = written + chunk
+		}
+		if wait := c.write.Take(end - written); wait > 0 {
+			time.Sleep(wait)
+		}
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the connection, if the one it wraps can be
+func (c *ThrottledConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,97 @@
+package traffic
+
+import (
+	"sync"
+	"time"
+)
+
+// window is the span of the per-minute rates, tracked in one-second buckets
+const window = 60
+
+type bucket struct {
+	second        int64
+	requests      int64
+	bytesSent     int64
+	bytesReceived int64
+}
+
+// Counters tracks a tunnel's requests and bytes, both cumulative and over
+// the last minute
+type Counters struct {
+	requests      int64
+	bytesSent     int64
+	bytesReceived int64
+	buckets       [window]bucket
+	mu            sync.Mutex
+}
+
+// Stats is a snapshot of a tunnel's counters. Sent bytes go from the server
+// to the client over the tunnel, received bytes come back from the client.
+type Stats struct {
+	Requests               int64 `json:"requests"`
+	BytesSent              int64 `json:"bytes_sent"`
+	BytesReceived          int64 `json:"bytes_received"`
+	RequestsPerMinute      int64 `json:"requests_per_minute"`
+	BytesSentPerMinute     int64 `json:"bytes_sent_per_minute"`
+	BytesReceivedPerMinute int64 `json:"bytes_received_per_minute"`
+}
+
+func NewCounters() *Counters {
+	return &Counters{}
+}
+
+// AddRequest counts a request routed to the tunnel
+func (c *Counters) AddRequest() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	c.current().requests++
+}
+
+// AddSent counts bytes written to the tunnel
+func (c *Counters) AddSent(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bytesSent += int64(n)
+	c.current().bytesSent += int64(n)
+}
+
+// AddReceived counts bytes read from the tunnel
+func (c *Counters) AddReceived(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bytesReceived += int64(n)
+	c.current().bytesReceived += int64(n)
+}
+
+// Snapshot returns the cumulative counts and the counts of the last minute
+func (c *Counters) Snapshot() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := Stats{
+		Requests:      c.requests,
+		BytesSent:     c.bytesSent,
+		BytesReceived: c.bytesReceived,
+	}
+	now := time.Now().Unix()
+	for _, b := range c.buckets {
+		if now-b.second < window {
+			stats.RequestsPerMinute += b.requests
+			stats.BytesSentPerMinute += b.bytesSent
+			stats.BytesReceivedPerMinute += b.bytesReceived
+		}
+	}
+	return stats
+}
+
+// current returns the bucket of the current second, resetting it if it
+// still holds counts from a previous minute
+func (c *Counters) current() *bucket {
+	now := time.Now().Unix()
+	b := &c.buckets[now%window]
+	if b.second != now {
+		*b = bucket{second: now}
+	}
+	return b
+}
@@ -0,0 +1,17 @@
+package types
+
+// Client metrics a tunnel can report with its heartbeats
+const (
+	MetricGoroutines              = "goroutines"
+	MetricHeapBytes               = "heap_bytes"
+	MetricUpstreamResponseSeconds = "upstream_response_seconds" // Mean since the previous heartbeat
+	MetricOpenStreams             = "open_streams"              // Tunneled requests being handled
+)
+
+// ClientMetrics lists the metrics a server accepts from heartbeats
+var ClientMetrics = []string{
+	MetricGoroutines,
+	MetricHeapBytes,
+	MetricUpstreamResponseSeconds,
+	MetricOpenStreams,
+}
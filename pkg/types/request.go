@@ -14,6 +14,7 @@ const (
 	HeartbeatRequest      RequestType = "heartbeat"
 	ProxyRequest          RequestType = "proxy"
 	PortAllocationRequest RequestType = "port_allocation"
+	RequestTypeBench      RequestType = "bench" // Answered by the client itself, never its upstream
 )
 
 type Request struct {
@@ -28,6 +29,8 @@ type Request struct {
 	Host        string            `json:"host,omitempty"`
 	Protocol    string            `json:"protocol,omitempty"`
 	ClientID    string            `json:"client_id,omitempty"`
+	Deadline    int64             `json:"deadline,omitempty"` // Unix milliseconds by which the response must start, 0 for none
+	Stream      bool              `json:"stream,omitempty"`   // More of the body follows in body messages
 	Payload     interface{}       `json:"payload"`
 }
 
@@ -48,6 +51,7 @@ type Response struct {
 	ClientID    string      `json:"client_id,omitempty"` // Assigned client ID
 	Protocol    string      `json:"protocol,omitempty"`
 	ContentType string      `json:"content_type,omitempty"`
+	Stream      bool        `json:"stream,omitempty"` // More of the body follows in chunk messages
 }
 
 type Worker interface {
@@ -0,0 +1,333 @@
+// Package update describes client releases and installs them over the running
+// binary. A release is a binary with its SHA-256 checksum and, optionally, an
+// Ed25519 signature of its version, platform, and checksum, so a fleet can
+// require releases signed by a key kept off the server.
+package update
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Release is one client binary, as served by the server's /client/latest or
+// found at a release URL
+type Release struct {
+	Version   string `json:"version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	URL       string `json:"url"` // Of the binary, relative to the release's own URL
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`              // Hex
+	Signature string `json:"signature,omitempty"` // Base64 Ed25519 signature of SignedMessage
+}
+
+// SignedMessage is what a release's signature covers,
+// "<version>|<os>|<arch>|<hex sha256>", so a signed binary can't be offered
+// as another version or for another platform
+func SignedMessage(version, goos, goarch, digest string) []byte {
+	return []byte(version + "|" + goos + "|" + goarch + "|" + strings.ToLower(digest))
+}
+
+// Compare orders two versions such as v1.4.0 and 1.5.0-rc.1 by their dotted
+// numbers, a pre-release coming before its release. It returns -1, 0, or 1
+// as a is older than, the same as, or newer than b.
+func Compare(a, b string) (int, error) {
+	an, apre, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bn, bpre, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < max(len(an), len(bn)); i++ {
+		var x, y int
+		if i < len(an) {
+			x = an[i]
+		}
+		if i < len(bn) {
+			y = bn[i]
+		}
+		if x != y {
+			return cmp.Compare(x, y), nil
+		}
+	}
+	switch {
+	case apre == bpre:
+		return 0, nil
+	case apre == "":
+		return 1, nil
+	case bpre == "":
+		return -1, nil
+	}
+	return strings.Compare(apre, bpre), nil
+}
+
+// parseVersion splits a version into its numbers and pre-release suffix
+func parseVersion(v string) ([]int, string, error) {
+	core, pre, _ := strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	core, _, _ = strings.Cut(core, "+")
+	var numbers []int
+	for _, field := range strings.Split(core, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("invalid version %q", v)
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, pre, nil
+}
+
+// BinaryName returns the file name of the client binary for a platform
+func BinaryName(goos, goarch string) string {
+	name := "client-" + goos + "-" + goarch
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// ParseBinaryName returns the platform of a binary named as BinaryName does
+func ParseBinaryName(name string) (goos, goarch string, ok bool) {
+	rest, ok := strings.CutPrefix(filepath.Base(name), "client-")
+	if !ok {
+		return "", "", false
+	}
+	goos, goarch, ok = strings.Cut(strings.TrimSuffix(rest, ".exe"), "-")
+	if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "-") {
+		return "", "", false
+	}
+	return goos, goarch, true
+}
+
+// Describe returns the release of the binary at path, reading its signature
+// from path.sig if that exists
+func Describe(path, version, goos, goarch string) (Release, error) {
+	digest, size, err := checksum(path)
+	if err != nil {
+		return Release{}, err
+	}
+	release := Release{
+		Version: version,
+		OS:      goos,
+		Arch:    goarch,
+		Size:    size,
+		SHA256:  hex.EncodeToString(digest),
+	}
+	signature, err := os.ReadFile(path + ".sig")
+	if err == nil {
+		release.Signature = strings.TrimSpace(string(signature))
+	} else if !os.IsNotExist(err) {
+		return Release{}, fmt.Errorf("failed to read release signature: %v", err)
+	}
+	return release, nil
+}
+
+// checksum returns the SHA-256 and size of the file at path
+func checksum(path string) ([]byte, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read release: %v", err)
+	}
+	return hash.Sum(nil), size, nil
+}
+
+// Fetch reads the release for this platform from releaseURL, which serves
+// either one release or a list of releases for several platforms. The
+// release's URL is made absolute.
+func Fetch(ctx context.Context, client *http.Client, releaseURL string) (*Release, error) {
+	base, err := url.Parse(releaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid release URL: %v", err)
+	}
+	query := base.Query()
+	query.Set("os", runtime.GOOS)
+	query.Set("arch", runtime.GOARCH)
+	base.RawQuery = query.Encode()
+
+	body, err := get(ctx, client, base.String())
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var raw json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(body, 1<<20)).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid release: %v", err)
+	}
+	var releases []Release
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "[") {
+		err = json.Unmarshal(raw, &releases)
+	} else {
+		releases = make([]Release, 1)
+		err = json.Unmarshal(raw, &releases[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid release: %v", err)
+	}
+	for _, release := range releases {
+		if release.OS != runtime.GOOS || release.Arch != runtime.GOARCH {
+			continue
+		}
+		binary, err := base.Parse(release.URL)
+		if err != nil || release.URL == "" {
+			return nil, fmt.Errorf("invalid release binary URL %q", release.URL)
+		}
+		release.URL = binary.String()
+		return &release, nil
+	}
+	return nil, fmt.Errorf("no release for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key, expected %d base64 bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Sign returns the base64 signature of the binary at path as release
+// version for goos/goarch, to store as path.sig
+func Sign(key ed25519.PrivateKey, path, version, goos, goarch string) (string, error) {
+	digest, _, err := checksum(path)
+	if err != nil {
+		return "", err
+	}
+	message := SignedMessage(version, goos, goarch, hex.EncodeToString(digest))
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, message)), nil
+}
+
+// Verify checks the release's signature with key
+func (r *Release) Verify(key ed25519.PublicKey) error {
+	if r.Signature == "" {
+		return fmt.Errorf("release %s is not signed", r.Version)
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid release signature: %v", err)
+	}
+	digest, err := hex.DecodeString(r.SHA256)
+	if err != nil || len(digest) != sha256.Size {
+		return fmt.Errorf("invalid release checksum %q", r.SHA256)
+	}
+	if !ed25519.Verify(key, SignedMessage(r.Version, r.OS, r.Arch, r.SHA256), signature) {
+		return fmt.Errorf("release %s has a bad signature", r.Version)
+	}
+	return nil
+}
+
+// Install downloads the release, verifies its checksum and, with a key, its
+// signature, and atomically replaces the binary at executable with it
+func Install(ctx context.Context, client *http.Client, release *Release, key ed25519.PublicKey, executable string) error {
+	if key != nil {
+		// Before downloading, so an unsigned release fails fast
+		if err := release.Verify(key); err != nil {
+			return err
+		}
+	}
+	digest, err := hex.DecodeString(release.SHA256)
+	if err != nil || len(digest) != sha256.Size {
+		return fmt.Errorf("invalid release checksum %q", release.SHA256)
+	}
+	info, err := os.Stat(executable)
+	if err != nil {
+		return err
+	}
+
+	// Download next to the binary so the rename stays on one filesystem
+	dir := filepath.Dir(executable)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(executable)+".update-*")
+	if err != nil {
+		return fmt.Errorf("failed to create download: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	body, err := get(ctx, client, release.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	// One byte more than the release's size reveals an oversized download
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, release.Size+1))
+	if err != nil {
+		return fmt.Errorf("failed to download release: %v", err)
+	}
+	if n != release.Size {
+		return fmt.Errorf("downloaded %d bytes, release has %d", n, release.Size)
+	}
+	if got := hash.Sum(nil); !bytes.Equal(got, digest) {
+		return fmt.Errorf("checksum mismatch: downloaded %x, release has %s", got, release.SHA256)
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return replace(tmp.Name(), executable)
+}
+
+// replace renames the new binary over the old one. Windows can't replace a
+// running executable, but can rename it out of the way first.
+func replace(newPath, executable string) error {
+	if runtime.GOOS == "windows" {
+		old := executable + ".old"
+		os.Remove(old)
+		if err := os.Rename(executable, old); err != nil {
+			return fmt.Errorf("failed to move the running binary aside: %v", err)
+		}
+		if err := os.Rename(newPath, executable); err != nil {
+			os.Rename(old, executable)
+			return fmt.Errorf("failed to install release: %v", err)
+		}
+		return nil
+	}
+	if err := os.Rename(newPath, executable); err != nil {
+		return fmt.Errorf("failed to install release: %v", err)
+	}
+	return nil
+}
+
+func get(ctx context.Context, client *http.Client, target string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", target, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s failed with status %d: %s", target, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,239 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// release writes binary to a file in dir and describes it as version 1.2.0
+// for this platform, signed with key
+func release(t *testing.T, dir string, binary []byte, key ed25519.PrivateKey) Release {
+	t.Helper()
+	path := filepath.Join(dir, BinaryName(runtime.GOOS, runtime.GOARCH))
+	if err := os.WriteFile(path, binary, 0755); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := Sign(key, path, "1.2.0", runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".sig", []byte(signature+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Describe(path, "1.2.0", runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func TestVerify(t *testing.T) {
+	public, private := newKey(t)
+	otherPublic, otherPrivate := newKey(t)
+	r := release(t, t.TempDir(), []byte("binary"), private)
+	if err := r.Verify(public); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(r *Release)
+		key    ed25519.PublicKey
+	}{
+		{"unsigned", func(r *Release) { r.Signature = "" }, public},
+		{"bad encoding", func(r *Release) { r.Signature = "not base64!" }, public},
+		{"wrong key", func(r *Release) {}, otherPublic},
+		{"signed by another key", func(r *Release) {
+			r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(otherPrivate, SignedMessage(r.Version, r.OS, r.Arch, r.SHA256)))
+		}, public},
+		{"other version", func(r *Release) { r.Version = "9.9.9" }, public},
+		{"other platform", func(r *Release) { r.OS = "plan9" }, public},
+		{"other checksum", func(r *Release) { r.SHA256 = strings.Repeat("00", 32) }, public},
+		{"bad checksum", func(r *Release) { r.SHA256 = "xyz" }, public},
+	}
+	for _, tt := range tests {
+		changed := r
+		tt.change(&changed)
+		if err := changed.Verify(tt.key); err == nil {
+			t.Errorf("%s: Verify accepted the release", tt.name)
+		}
+	}
+}
+
+// releaseServer serves binary at /binary and counts its downloads
+func releaseServer(t *testing.T, binary []byte) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		w.Write(binary)
+	}))
+	t.Cleanup(server.Close)
+	return server, &downloads
+}
+
+// executable writes an installed binary to install over
+func executable(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "client")
+	if err := os.WriteFile(path, []byte("installed"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func installed(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInstall(t *testing.T) {
+	public, private := newKey(t)
+	r := release(t, t.TempDir(), []byte("new binary"), private)
+	server, _ := releaseServer(t, []byte("new binary"))
+	r.URL = server.URL + "/binary"
+
+	path := executable(t)
+	if err := Install(context.Background(), server.Client(), &r, public, path); err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	if got := installed(t, path); got != "new binary" {
+		t.Fatalf("installed %q", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0755 {
+		t.Fatalf("installed binary mode = %v, %v", info.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("Install left %d files behind", len(entries)-1)
+	}
+}
+
+func TestInstallRefuses(t *testing.T) {
+	public, private := newKey(t)
+	otherPublic, _ := newKey(t)
+	r := release(t, t.TempDir(), []byte("new binary"), private)
+
+	tests := []struct {
+		name     string
+		served   string
+		change   func(r *Release)
+		key      ed25519.PublicKey
+		download bool // Whether the binary is fetched before Install refuses
+	}{
+		{"unsigned", "new binary", func(r *Release) { r.Signature = "" }, public, false},
+		{"wrong key", "new binary", func(r *Release) {}, otherPublic, false},
+		{"other version", "new binary", func(r *Release) { r.Version = "9.9.9" }, public, false},
+		{"tampered binary", "new binarY", func(r *Release) {}, public, true},
+		{"tampered binary without a key", "new binarY", func(r *Release) {}, nil, true},
+		{"longer binary", "new binary and more", func(r *Release) {}, public, true},
+		{"shorter binary", "new", func(r *Release) {}, public, true},
+		{"bad checksum", "new binary", func(r *Release) { r.SHA256 = "xyz" }, nil, false},
+	}
+	for _, tt := range tests {
+		server, downloads := releaseServer(t, []byte(tt.served))
+		changed := r
+		changed.URL = server.URL + "/binary"
+		tt.change(&changed)
+
+		path := executable(t)
+		if err := Install(context.Background(), server.Client(), &changed, tt.key, path); err == nil {
+			t.Errorf("%s: Install accepted the release", tt.name)
+		}
+		if got := installed(t, path); got != "installed" {
+			t.Errorf("%s: binary replaced with %q", tt.name, got)
+		}
+		if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+			t.Errorf("%s: Install left %d files behind", tt.name, len(entries)-1)
+		}
+		if got := downloads.Load() > 0; got != tt.download {
+			t.Errorf("%s: downloaded %v, want %v", tt.name, got, tt.download)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	releases := []Release{
+		{Version: "1.2.0", OS: "plan9", Arch: "386", URL: "other"},
+		{Version: "1.2.0", OS: runtime.GOOS, Arch: runtime.GOARCH, URL: "binaries/client"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases/list":
+			json.NewEncoder(w).Encode(releases)
+		case "/releases/one":
+			json.NewEncoder(w).Encode(releases[1])
+		case "/releases/other":
+			json.NewEncoder(w).Encode(releases[:1])
+		case "/releases/garbage":
+			w.Write([]byte("{"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/releases/list", "/releases/one"} {
+		r, err := Fetch(context.Background(), server.Client(), server.URL+path)
+		if err != nil {
+			t.Fatalf("Fetch %s: %v", path, err)
+		}
+		if r.URL != server.URL+"/releases/binaries/client" {
+			t.Fatalf("Fetch %s: binary URL = %s", path, r.URL)
+		}
+	}
+	for _, path := range []string{"/releases/other", "/releases/garbage", "/releases/missing"} {
+		if _, err := Fetch(context.Background(), server.Client(), server.URL+path); err == nil {
+			t.Errorf("Fetch %s accepted the release", path)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "v1.2.0", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.2.0", "1.10.0", -1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.5.0-rc.1", "1.5.0", -1},
+		{"1.5.0-rc.2", "1.5.0-rc.1", 1},
+		{"1.5.0+build", "1.5.0", 0},
+	}
+	for _, tt := range tests {
+		got, err := Compare(tt.a, tt.b)
+		if err != nil || got != tt.want {
+			t.Errorf("Compare(%s, %s) = %d, %v, want %d", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+	for _, v := range []string{"", "1.x", "-1.0", "1..0"} {
+		if _, err := Compare(v, "1.0.0"); err == nil {
+			t.Errorf("Compare accepted version %q", v)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Package usage meters what each client uses of the server, keeping hourly
+// and daily rollups of its requests, bytes, and connection time
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Granularity is the span of a rollup
+type Granularity time.Duration
+
+const (
+	Hourly = Granularity(time.Hour)
+	Daily  = Granularity(24 * time.Hour)
+)
+
+// ParseGranularity reads "hour" or "day"
+func ParseGranularity(s string) (Granularity, error) {
+	switch s {
+	case "hour", "hourly":
+		return Hourly, nil
+	case "day", "daily":
+		return Daily, nil
+	}
+	return 0, fmt.Errorf("unknown granularity %q, expected hour or day", s)
+}
+
+// Record is a client's usage within one hour or day
+type Record struct {
+	ClientID        string    `json:"client_id"`
+	Start           time.Time `json:"start"` // Start of the hour or UTC day
+	Requests        int64     `json:"requests"`
+	BytesSent       int64     `json:"bytes_sent"`     // From the server to the client
+	BytesReceived   int64     `json:"bytes_received"` // From the client back to the server
+	ConnectionHours float64   `json:"connection_hours"`
+}
+
+// Usage is an amount of use to add to a client's rollups
+type Usage struct {
+	Requests      int64
+	BytesSent     int64
+	BytesReceived int64
+}
+
+type key struct {
+	clientID string
+	start    int64 // Unix seconds
+}
+
+// Meter keeps the rollups, dropping those older than their retention
+type Meter struct {
+	mu              sync.Mutex
+	hourly          map[key]*Record
+	daily           map[key]*Record
+	hourlyRetention time.Duration
+	dailyRetention  time.Duration
+}
+
+func NewMeter(hourlyRetention, dailyRetention time.Duration) *Meter {
+	return &Meter{
+		hourly:          make(map[key]*Record),
+		daily:           make(map[key]*Record),
+		hourlyRetention: hourlyRetention,
+		dailyRetention:  dailyRetention,
+	}
+}
+
+// Add records usage at the end of a client's connection from from to to. The
+// connection time is split across the hours and days the span covers.
+func (m *Meter) Add(clientID string, from, to time.Time, u Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, g := range []Granularity{Hourly, Daily} {
+		rec := m.recordLocked(clientID, to, g)
+		rec.Requests += u.Requests
+		rec.BytesSent += u.BytesSent
+		rec.BytesReceived += u.BytesReceived
+
+		for start := from; start.Before(to); {
+			end := periodStart(start, g).Add(time.Duration(g))
+			if end.After(to) {
+				end = to
+			}
+			m.recordLocked(clientID, start, g).ConnectionHours += end.Sub(start).Hours()
+			start = end
+		}
+	}
+}
+
+func (m *Meter) recordLocked(clientID string, at time.Time, g Granularity) *Record {
+	records := m.records(g)
+	start := periodStart(at, g)
+	k := key{clientID: clientID, start: start.Unix()}
+	rec, ok := records[k]
+	if !ok {
+		rec = &Record{ClientID: clientID, Start: start}
+		records[k] = rec
+	}
+	return rec
+}
+
+func (m *Meter) records(g Granularity) map[key]*Record {
+	if g == Daily {
+		return m.daily
+	}
+	return m.hourly
+}
+
+// periodStart truncates t to the start of its hour or UTC day
+func periodStart(t time.Time, g Granularity) time.Time {
+	return t.UTC().Truncate(time.Duration(g))
+}
+
+// Query returns the rollups of the client, or of every client if clientID is
+// empty, starting within [from, to), ordered by client and time
+func (m *Meter) Query(clientID string, from, to time.Time, g Granularity) []Record {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from = periodStart(from, g)
+	var result []Record
+	for _, rec := range m.records(g) {
+		if clientID != "" && rec.ClientID != clientID {
+			continue
+		}
+		if rec.Start.Before(from) || !rec.Start.Before(to) {
+			continue
+		}
+		result = append(result, *rec)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ClientID != result[j].ClientID {
+			return result[i].ClientID < result[j].ClientID
+		}
+		return result[i].Start.Before(result[j].Start)
+	})
+	return result
+}
+
+// Prune drops rollups older than their retention
+func (m *Meter) Prune(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, g := range []Granularity{Hourly, Daily} {
+		retention := m.hourlyRetention
+		if g == Daily {
+			retention = m.dailyRetention
+		}
+		if retention <= 0 {
+			continue
+		}
+		cutoff := periodStart(now.Add(-retention), g)
+		records := m.records(g)
+		for k, rec := range records {
+			if rec.Start.Before(cutoff) {
+				delete(records, k)
+			}
+		}
+	}
+}
+
+// snapshot is the file format of a saved meter
+type snapshot struct {
+	Hourly []Record `json:"hourly"`
+	Daily  []Record `json:"daily"`
+}
+
+// Save writes the rollups to path, replacing it atomically
+func (m *Meter) Save(path string) error {
+	m.mu.Lock()
+	var snap snapshot
+	for _, rec := range m.hourly {
+		snap.Hourly = append(snap.Hourly, *rec)
+	}
+	for _, rec := range m.daily {
+		snap.Daily = append(snap.Daily, *rec)
+	}
+	m.mu.Unlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load adds the rollups saved at path, which may not exist yet
+func (m *Meter) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("invalid usage file %s: %v", path, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for g, records := range map[Granularity][]Record{Hourly: snap.Hourly, Daily: snap.Daily} {
+		for _, rec := range records {
+			rec.Start = periodStart(rec.Start, g)
+			m.records(g)[key{clientID: rec.ClientID, start: rec.Start.Unix()}] = &rec
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Package version reports how the running binary was built. Release builds
+// set the variables with -ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/vikasavn/attachcloudip/pkg/version.Version=v1.2.0" ./cmd/server
+//
+// and builds from a git checkout fall back to the VCS stamp of the Go
+// toolchain.
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/vikasavn/attachcloudip/pkg/protocol"
+)
+
+// Set at build time with -ldflags -X
+var (
+	Version   = "dev"
+	Commit    = "" // Git commit, from the VCS stamp if unset
+	BuildTime = "" // RFC 3339, from the commit time if unset
+)
+
+// Info describes the running binary
+type Info struct {
+	Version            string `json:"version"`
+	Commit             string `json:"commit,omitempty"`
+	BuildTime          string `json:"build_time,omitempty"`
+	Modified           bool   `json:"modified,omitempty"` // Built from a checkout with uncommitted changes
+	GoVersion          string `json:"go_version"`
+	ProtocolVersion    int    `json:"protocol_version"`
+	MinProtocolVersion int    `json:"min_protocol_version"` // Oldest tunnel protocol accepted from peers
+}
+
+// Get returns the build info of the running binary
+func Get() Info {
+	info := Info{
+		Version:            Version,
+		Commit:             Commit,
+		BuildTime:          BuildTime,
+		GoVersion:          runtime.Version(),
+		ProtocolVersion:    protocol.Version,
+		MinProtocolVersion: protocol.MinVersion,
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		case "vcs.time":
+			if info.BuildTime == "" {
+				info.BuildTime = setting.Value
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// String describes the build on one line, e.g. for -version
+func (i Info) String() string {
+	s := i.Version
+	if i.Commit != "" {
+		commit := i.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		s += " (" + commit
+		if i.Modified {
+			s += ", modified"
+		}
+		s += ")"
+	}
+	if i.BuildTime != "" {
+		s += " built " + i.BuildTime
+	}
+	return fmt.Sprintf("%s, %s, tunnel protocol %d", s, i.GoVersion, i.ProtocolVersion)
+}
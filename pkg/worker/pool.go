@@ -2,10 +2,13 @@ package worker
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"sync"
 )
 
+// ErrQueueFull is returned by Submit when no more jobs can be queued
+var ErrQueueFull = errors.New("job queue is full")
+
 // Pool represents a pool of workers
 type Pool struct {
 	maxWorkers int
@@ -15,11 +18,12 @@ type Pool struct {
 	mu         sync.RWMutex
 }
 
-// NewPool creates a new worker pool
-func NewPool(maxWorkers int) *Pool {
+// NewPool creates a new worker pool queueing up to queueSize jobs while all
+// workers are busy
+func NewPool(maxWorkers, queueSize int) *Pool {
 	pool := &Pool{
 		maxWorkers: maxWorkers,
-		jobQueue:   make(chan Job),
+		jobQueue:   make(chan Job, queueSize),
 		workerPool: make(chan chan Job, maxWorkers),
 		workers:    make([]*Worker, 0),
 	}
@@ -47,15 +51,38 @@ func (p *Pool) Stop() {
 	}
 }
 
-// Submit adds a job to the pool
-func (p *Pool) Submit(job Job) {
+// Submit adds a job to the pool, failing with ErrQueueFull instead of
+// blocking when the queue is full. The job runs with a context that is done
+// when either the pool's or ctx is, and is skipped if ctx ends while queued.
+func (p *Pool) Submit(ctx context.Context, job Job) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	select {
-	case p.jobQueue <- job:
+	case p.jobQueue <- submittedJob{ctx: ctx, job: job}:
+		return nil
 	default:
-		fmt.Printf("Job queue is full. Job dropped.")
+		return ErrQueueFull
 	}
 }
 
+// submittedJob runs a job under both the pool's and its submitter's context
+type submittedJob struct {
+	ctx context.Context
+	job Job
+}
+
+func (j submittedJob) Execute(ctx context.Context) error {
+	if err := j.ctx.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := context.AfterFunc(j.ctx, func() { cancel(context.Cause(j.ctx)) })
+	defer stop()
+	return j.job.Execute(ctx)
+}
+
 // dispatch routes jobs to available workers
 func (p *Pool) dispatch(ctx context.Context) {
 	for {
@@ -64,13 +91,19 @@ func (p *Pool) dispatch(ctx context.Context) {
 			return
 		case job := <-p.jobQueue:
 			// Get the next available worker job queue
-			jobQueue := <-p.workerPool
+			var jobQueue chan Job
+			select {
+			case jobQueue = <-p.workerPool:
+			case <-ctx.Done():
+				return
+			}
 
-			// Dispatch the job to the worker job queue
+			// Dispatch the job to the worker job queue, which the worker
+			// reads from right after making itself available
 			select {
 			case jobQueue <- job:
-			default:
-				fmt.Printf("Worker pool at capacity. Job dropped.")
+			case <-ctx.Done():
+				return
 			}
 		}
 	}